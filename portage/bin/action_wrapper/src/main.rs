@@ -5,7 +5,7 @@
 use anyhow::{ensure, Context, Result};
 use chrome_trace::{Event, Phase, Trace};
 use clap::Parser;
-use cliutil::{handle_top_level_result, TRACE_DIR_ENV};
+use cliutil::{handle_top_level_result, LoggingArgs, TRACE_DIR_ENV};
 use fileutil::SafeTempDir;
 use nix::sys::resource::{getrusage, Usage, UsageWho};
 use nix::sys::time::TimeValLike;
@@ -29,6 +29,10 @@ const SUDO_PATH: &str = "/usr/bin/sudo";
     about = "General-purpose wrapper of programs implementing Bazel actions.",
     author, version, about, long_about=None, trailing_var_arg = true)]
 struct Cli {
+    /// Logging flags exported to the wrapped process and its subprocesses.
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     /// If set, redirects stdout/stderr of the wrapped process to
     /// the specified file, and print it to stderr only when it exits
     /// abnormally.
@@ -313,6 +317,7 @@ fn main() -> ExitCode {
 
     // Always enable Rust backtraces.
     std::env::set_var("RUST_BACKTRACE", "1");
+    args.logging.export_env();
 
     // Redirect stdout/stderr to a file if `--log` was specified.
     let redirector = args
@@ -8,6 +8,7 @@ SHARED_CRATES = [
     "//bazel/portage/common/chrome_trace:srcs",
     "//bazel/portage/common/cliutil:srcs",
     "//bazel/portage/common/fileutil:srcs",
+    "//bazel/portage/common/portage/manifest:srcs",
     "//bazel/portage/common/portage/version:srcs",
     "//bazel/portage/common/testutil:srcs",
     "//bazel/portage/common/tracing_chrome_trace:srcs",
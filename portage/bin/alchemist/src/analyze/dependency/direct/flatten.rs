@@ -86,7 +86,7 @@ pub fn flatten_dependencies(
 
     let deps = simplify(deps);
 
-    // Resolve any-of dependencies by picking the first item.
+    // Resolve any-of dependencies by picking an item.
     let deps = deps.map_tree_par(|dep| match dep {
         Dependency::Composite(composite) => match *composite {
             CompositeDependency::AnyOf { children } if !children.is_empty() => {
@@ -111,7 +111,18 @@ pub fn flatten_dependencies(
                         .join(", ");
                     Dependency::new_constant(false, &format!("any-of ( {result} )"))
                 } else {
-                    children.into_iter().next().unwrap()
+                    // Pick the first alternative like Portage, unless one is
+                    // listed in package.preferred, e.g. to choose the provider
+                    // of a virtual package.
+                    let preferred = children.iter().position(|c| match c {
+                        Dependency::Leaf(atom) => resolver
+                            .find_best_package_dependency(use_map, atom)
+                            .ok()
+                            .flatten()
+                            .is_some_and(|details| resolver.is_package_preferred(&details)),
+                        _ => false,
+                    });
+                    children.into_iter().nth(preferred.unwrap_or(0)).unwrap()
                 }
             }
             other => Dependency::new_composite(other),
@@ -19,9 +19,11 @@ use crate::{
 use self::{
     flatten::flatten_dependencies,
     hacks::{get_extra_dependencies, is_rust_source_package, DEPEND_AS_BDEPEND_ALLOW_LIST},
-    slot::rewrite_subslot_deps,
+    slot::{find_subslot_rebuild_package_names, rewrite_subslot_deps},
 };
 
+pub use self::hacks::{ExtraDependency, EXTRA_DEPENDENCIES};
+
 /// Analyzed direct dependencies of a package. It is returned by [`analyze_direct_dependencies`].
 ///
 /// This struct represents dependencies as lists of [`PackageDetails`] instead of
@@ -46,6 +48,11 @@ pub struct DirectDependencies {
 
     /// Host packages to install before installing the package, aka IDEPEND.
     pub install_host: Vec<Arc<PackageDetails>>,
+
+    /// Target packages in DEPEND or RDEPEND that are referenced with the
+    /// sub-slot rebuild operator (:=). The package must be rebuilt when their
+    /// slots or sub-slots change.
+    pub subslot_rebuild_target: Vec<Arc<PackageDetails>>,
 }
 
 impl DirectDependencies {
@@ -99,6 +106,22 @@ pub enum DependencyKind {
     InstallHost,
 }
 
+/// Returns the raw *DEPEND expression declared by the ebuild, without extra
+/// dependencies added by hacks.
+fn get_declared_dependencies(details: &PackageDetails, kind: DependencyKind) -> Result<&str> {
+    let var_name = match kind {
+        DependencyKind::BuildTarget => Some("DEPEND"),
+        DependencyKind::RunTarget => Some("RDEPEND"),
+        DependencyKind::PostTarget => Some("PDEPEND"),
+        DependencyKind::BuildHost => Some("BDEPEND"),
+        DependencyKind::InstallHost => details.supports_idepend().then_some("IDEPEND"),
+    };
+
+    var_name.map_or(Ok(""), |var_name| {
+        details.metadata.vars.get_scalar_or_default(var_name)
+    })
+}
+
 // TODO(b:299056510): Consider removing 4-argument variant of this function.
 fn extract_dependencies(
     details: &PackageDetails,
@@ -125,17 +148,7 @@ fn extract_dependencies_use(
     resolver: &PackageResolver,
     allow_list: Option<&[&str]>,
 ) -> Result<(Vec<Arc<PackageDetails>>, String)> {
-    let var_name = match kind {
-        DependencyKind::BuildTarget => Some("DEPEND"),
-        DependencyKind::RunTarget => Some("RDEPEND"),
-        DependencyKind::PostTarget => Some("PDEPEND"),
-        DependencyKind::BuildHost => Some("BDEPEND"),
-        DependencyKind::InstallHost => details.supports_idepend().then_some("IDEPEND"),
-    };
-
-    let raw_deps = var_name.map_or(Ok(""), |var_name| {
-        details.metadata.vars.get_scalar_or_default(var_name)
-    })?;
+    let raw_deps = get_declared_dependencies(details, kind)?;
 
     let raw_extra_deps = get_extra_dependencies(details, kind, cross_compile);
 
@@ -149,6 +162,79 @@ fn extract_dependencies_use(
     Ok((dep_list, expression))
 }
 
+/// Selects packages from `deps`, the resolved dependencies of `kind`, that are
+/// referenced with the sub-slot rebuild operator (:=).
+///
+/// Packages are matched by name so that any-of expressions pick the same
+/// packages as [`flatten_dependencies`].
+fn select_subslot_rebuild_dependencies<'a>(
+    details: &PackageDetails,
+    kind: DependencyKind,
+    cross_compile: bool,
+    deps: &'a [Arc<PackageDetails>],
+) -> Result<impl Iterator<Item = &'a Arc<PackageDetails>>> {
+    let raw_deps = get_declared_dependencies(details, kind)?;
+    let raw_extra_deps = get_extra_dependencies(details, kind, cross_compile);
+    let names = find_subslot_rebuild_package_names(
+        format!("{} {}", raw_deps, raw_extra_deps).parse::<PackageDependency>()?,
+        &details.use_map,
+    );
+    Ok(deps
+        .iter()
+        .filter(move |package| names.contains(&package.as_basic_data().package_name)))
+}
+
+/// Finds packages that an extra dependency hack adds to a package on top of
+/// the dependencies declared by its ebuild.
+///
+/// An empty result means that the ebuild already declares the dependencies and
+/// the hack is redundant for the package.
+pub fn find_packages_added_by_hack(
+    details: &PackageDetails,
+    hack: &ExtraDependency,
+    host_resolver: &PackageResolver,
+    target_resolver: &PackageResolver,
+) -> Result<Vec<Arc<PackageDetails>>> {
+    let resolver = match hack.kind {
+        DependencyKind::BuildHost | DependencyKind::InstallHost => host_resolver,
+        _ => target_resolver,
+    };
+
+    let added = flatten_dependencies(
+        hack.deps.parse::<PackageDependency>()?,
+        &details.use_map,
+        resolver,
+        None,
+    )?;
+
+    let mut declared = flatten_dependencies(
+        get_declared_dependencies(details, hack.kind)?.parse::<PackageDependency>()?,
+        &details.use_map,
+        resolver,
+        None,
+    )?;
+    // Keep in sync with how analyze_direct_dependencies computes BDEPEND for
+    // EAPIs without BDEPEND support.
+    if hack.kind == DependencyKind::BuildHost && !details.supports_bdepend() {
+        declared.extend(flatten_dependencies(
+            get_declared_dependencies(details, DependencyKind::BuildTarget)?
+                .parse::<PackageDependency>()?,
+            &details.use_map,
+            host_resolver,
+            Some(&DEPEND_AS_BDEPEND_ALLOW_LIST),
+        )?);
+    }
+
+    Ok(added
+        .into_iter()
+        .filter(|package| {
+            !declared
+                .iter()
+                .any(|d| d.as_basic_data().ebuild_path == package.as_basic_data().ebuild_path)
+        })
+        .collect())
+}
+
 /// Analyzes ebuild variables to determine direct dependencies of a package.
 pub fn analyze_direct_dependencies(
     details: &PackageDetails,
@@ -315,6 +401,22 @@ pub fn analyze_direct_dependencies(
         )
     })?;
 
+    let subslot_rebuild_target_deps = select_subslot_rebuild_dependencies(
+        details,
+        DependencyKind::BuildTarget,
+        cross_compile,
+        &build_target_deps,
+    )?
+    .chain(select_subslot_rebuild_dependencies(
+        details,
+        DependencyKind::RunTarget,
+        cross_compile,
+        &run_target_deps,
+    )?)
+    .unique_by(|package| package.as_basic_data().ebuild_path.clone())
+    .cloned()
+    .collect();
+
     Ok((
         DirectDependencies {
             build_target: build_target_deps,
@@ -323,6 +425,7 @@ pub fn analyze_direct_dependencies(
             post_target: post_target_deps,
             build_host: build_host_deps,
             install_host: install_host_deps,
+            subslot_rebuild_target: subslot_rebuild_target_deps,
         },
         DependencyExpressions {
             build_target: build_target_expr,
@@ -2,6 +2,8 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
+use std::collections::HashSet;
+
 use anyhow::{bail, Context, Result};
 use itertools::Itertools;
 
@@ -9,7 +11,7 @@ use crate::{
     data::UseMap,
     dependency::{
         algorithm::{elide_use_conditions, simplify},
-        package::{PackageDependency, PackageSlotDependency},
+        package::{PackageDependency, PackageSlotDependency, SlotOperator},
         CompositeDependency, Dependency,
     },
     resolver::PackageResolver,
@@ -95,3 +97,27 @@ pub fn rewrite_subslot_deps(
 
     Ok(expr)
 }
+
+/// Evaluates any USE constraints in the dependency expression and returns the
+/// names of packages referenced by atoms with the sub-slot rebuild operator
+/// (:=).
+pub fn find_subslot_rebuild_package_names(
+    deps: PackageDependency,
+    use_map: &UseMap,
+) -> HashSet<String> {
+    let mut names = HashSet::new();
+    if let Some(deps) = elide_use_conditions(deps, use_map) {
+        deps.map_tree(|dep| {
+            if let Dependency::Leaf(atom) = &dep {
+                if atom
+                    .slot()
+                    .is_some_and(|slot| slot.operator() == Some(SlotOperator::Rebuild))
+                {
+                    names.insert(atom.package_name().to_owned());
+                }
+            }
+            dep
+        });
+    }
+    names
+}
@@ -3,17 +3,18 @@
 // found in the LICENSE file.
 
 use std::{
-    collections::HashMap,
+    collections::{BTreeMap, HashMap},
     path::{Path, PathBuf},
     sync::Arc,
+    time::{Duration, Instant},
 };
 
-use anyhow::{bail, Result};
+use anyhow::{bail, Context, Result};
 use rayon::prelude::*;
 use tracing::instrument;
 
 use crate::{
-    config::bundle::ConfigBundle,
+    config::{bundle::ConfigBundle, miscconf::bashrc::find_metadata_assignments},
     dependency::package::{AsPackageRef, PackageRef},
     ebuild::{
         metadata::{EBuildBasicData, EBuildMetadata},
@@ -28,11 +29,13 @@ use self::{
         indirect::{analyze_indirect_dependencies, IndirectDependencies},
     },
     source::{analyze_sources, PackageSources},
+    stats::{AnalysisStats, BashrcWarning, PackageAnalysisTime},
 };
 
 pub mod dependency;
 pub mod restrict;
 pub mod source;
+pub mod stats;
 #[cfg(test)]
 mod tests;
 
@@ -187,6 +190,7 @@ fn analyze_local(
     src_dir: &Path,
     host_resolver: &PackageResolver,
     target_resolver: &PackageResolver,
+    time: &mut PackageAnalysisTime,
 ) -> MaybePackageLocalAnalysis {
     let details = match details {
         MaybePackageDetails::Ok(details) => details,
@@ -197,7 +201,7 @@ fn analyze_local(
             }));
         }
     };
-    let result = (|| -> Result<PackageLocalAnalysis> {
+    let mut result = || -> Result<PackageLocalAnalysis> {
         if let PackageReadiness::Masked { reason } = &details.readiness {
             // We do not support building masked packages because of
             // edge cases: e.g., if one masked package depends on
@@ -205,9 +209,15 @@ fn analyze_local(
             // dependency error.
             bail!("The package is masked: {}", reason);
         }
+        let start = Instant::now();
         let (direct_dependencies, expressions) =
             analyze_direct_dependencies(details, cross_compile, host_resolver, target_resolver)?;
+        time.dependencies = start.elapsed();
+
+        let start = Instant::now();
         let sources = analyze_sources(config, details, src_dir)?;
+        time.sources = start.elapsed();
+
         let bashrcs = config.package_bashrcs(&details.as_package_ref());
 
         let supports_interface_libraries = details
@@ -226,8 +236,8 @@ fn analyze_local(
             supports_interface_libraries,
             generate_interface_libraries,
         })
-    })();
-    match result {
+    };
+    match result() {
         Ok(local) => Ok(Box::new(local)),
         Err(err) => Err(Arc::new(PackageAnalysisError {
             details: MaybePackageDetails::Ok(details.clone()),
@@ -237,6 +247,8 @@ fn analyze_local(
 }
 
 /// Runs package-local analysis, i.e. analysis that can be done independently of other packages.
+///
+/// It also returns the time spent on analyzing each package.
 fn analyze_locals(
     all_details: &[MaybePackageDetails],
     config: &ConfigBundle,
@@ -244,11 +256,22 @@ fn analyze_locals(
     src_dir: &Path,
     host_resolver: &PackageResolver,
     target_resolver: &PackageResolver,
-) -> HashMap<PathBuf, MaybePackageLocalAnalysis> {
+) -> (
+    HashMap<PathBuf, MaybePackageLocalAnalysis>,
+    Vec<PackageAnalysisTime>,
+) {
     // Analyze packages in parallel.
     all_details
         .into_par_iter()
         .map(|details| {
+            let basic_data = details.as_basic_data();
+            let mut time = PackageAnalysisTime {
+                package: format!("{}-{}", basic_data.package_name, basic_data.version),
+                dependencies: Duration::ZERO,
+                sources: Duration::ZERO,
+                total: Duration::ZERO,
+            };
+            let start = Instant::now();
             let local = analyze_local(
                 details,
                 config,
@@ -256,10 +279,12 @@ fn analyze_locals(
                 src_dir,
                 host_resolver,
                 target_resolver,
+                &mut time,
             );
-            (details.as_basic_data().ebuild_path.clone(), local)
+            time.total = start.elapsed();
+            ((basic_data.ebuild_path.clone(), local), time)
         })
-        .collect()
+        .unzip()
 }
 
 fn analyze_global(
@@ -306,7 +331,6 @@ fn analyze_globals(
         .collect()
 }
 
-#[instrument(skip_all)]
 pub fn analyze_packages(
     config: &ConfigBundle,
     cross_compile: bool,
@@ -314,11 +338,66 @@ pub fn analyze_packages(
     host_resolver: &PackageResolver,
     target_resolver: &PackageResolver,
 ) -> Result<Vec<MaybePackage>> {
+    let (packages, _) = analyze_packages_with_stats(
+        config,
+        cross_compile,
+        src_dir,
+        host_resolver,
+        target_resolver,
+    )?;
+    Ok(packages)
+}
+
+/// Scans bashrc files executed by packages for assignments to variables
+/// affecting package metadata, which the analysis does not take into account.
+fn check_bashrcs(packages: &[MaybePackage]) -> Result<BTreeMap<PathBuf, BashrcWarning>> {
+    let mut package_counts: BTreeMap<&Path, usize> = BTreeMap::new();
+    for package in packages {
+        if let MaybePackage::Ok(package) = package {
+            for bashrc in &package.bashrcs {
+                *package_counts.entry(bashrc).or_default() += 1;
+            }
+        }
+    }
+
+    let mut warnings = BTreeMap::new();
+    for (path, packages) in package_counts {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        let assignments = find_metadata_assignments(&contents);
+        if !assignments.is_empty() {
+            warnings.insert(
+                path.to_owned(),
+                BashrcWarning {
+                    assignments,
+                    packages,
+                },
+            );
+        }
+    }
+    Ok(warnings)
+}
+
+/// Similar to [`analyze_packages`], but also returns statistics of the analysis.
+///
+/// Metadata cache statistics are not filled in since they are tracked by the evaluator owned by
+/// the caller.
+#[instrument(skip_all)]
+pub fn analyze_packages_with_stats(
+    config: &ConfigBundle,
+    cross_compile: bool,
+    src_dir: &Path,
+    host_resolver: &PackageResolver,
+    target_resolver: &PackageResolver,
+) -> Result<(Vec<MaybePackage>, AnalysisStats)> {
     // Load all packages.
+    let start = Instant::now();
     let all_details = target_resolver.find_all_packages()?;
+    let metadata_evaluation = start.elapsed();
 
     // Run package-local analysis.
-    let mut local_map = analyze_locals(
+    let start = Instant::now();
+    let (mut local_map, package_times) = analyze_locals(
         &all_details,
         config,
         cross_compile,
@@ -326,9 +405,12 @@ pub fn analyze_packages(
         host_resolver,
         target_resolver,
     );
+    let local_analysis = start.elapsed();
 
     // Run package-global analysis.
+    let start = Instant::now();
     let mut global_map = analyze_globals(&all_details, &local_map);
+    let global_analysis = start.elapsed();
 
     // Join analysis results.
     let packages: Vec<MaybePackage> = all_details
@@ -368,13 +450,35 @@ pub fn analyze_packages(
         })
         .collect();
 
-    let errors = packages
-        .iter()
-        .filter(|p| matches!(p, MaybePackage::Err(_)))
-        .count();
-    if errors > 0 {
-        eprintln!("WARNING: Analysis failed for {} packages", errors);
+    let mut stats = AnalysisStats {
+        metadata_evaluation,
+        local_analysis,
+        global_analysis,
+        package_times,
+        ..Default::default()
+    };
+    for package in &packages {
+        let basic_data = package.as_basic_data();
+        let error = match package {
+            MaybePackage::Ok(_) => None,
+            MaybePackage::Err(error) => Some(error.error.as_str()),
+        };
+        stats.record_package(&basic_data.repo_name, &basic_data.category_name, error);
+    }
+    if stats.failed_packages > 0 {
+        eprintln!(
+            "WARNING: Analysis failed for {} packages",
+            stats.failed_packages
+        );
     }
 
-    Ok(packages)
+    stats.bashrc_warnings = check_bashrcs(&packages)?;
+    if !stats.bashrc_warnings.is_empty() {
+        eprintln!(
+            "WARNING: {} bashrc files modify variables affecting package metadata",
+            stats.bashrc_warnings.len()
+        );
+    }
+
+    Ok((packages, stats))
 }
@@ -8,7 +8,7 @@ use crate::{
 use anyhow::{ensure, Context};
 use std::{
     collections::{HashMap, HashSet},
-    fs::{metadata, read_to_string},
+    fs::metadata,
     io::ErrorKind,
     iter::repeat,
     path::{Path, PathBuf},
@@ -18,6 +18,7 @@ use std::{
 use anyhow::{anyhow, bail, Result};
 use itertools::izip;
 use itertools::Itertools;
+use manifest::{EntryKind, Manifest, ManifestEntry};
 use serde::{Deserialize, Serialize};
 use url::Url;
 use version::VersionSuffixLabel;
@@ -116,12 +117,28 @@ impl PackageDistSource {
     }
 }
 
+/// A CROS_WORKON project of a 9999 ebuild whose directory does not exist in
+/// the workspace. It usually means that CROS_WORKON_LOCALNAME is wrong.
+#[derive(Clone, Debug, Eq, PartialEq, Serialize)]
+pub struct MissingLocalSource {
+    /// The value of CROS_WORKON_PROJECT, e.g. "chromiumos/platform2".
+    pub project: String,
+    /// The value of CROS_WORKON_LOCALNAME, e.g. "platform2".
+    pub local_name: String,
+    /// The path relative to src/ computed from the variables above, e.g.
+    /// "platform2".
+    pub path: PathBuf,
+}
+
 /// Analyzed source information of a package. It is returned by
 /// [`analyze_sources`].
 pub struct PackageSources {
     pub local_sources: Vec<PackageLocalSource>,
     pub repo_sources: Vec<PackageRepoSource>,
     pub dist_sources: Vec<PackageDistSource>,
+    /// CROS_WORKON projects that were skipped because their directories do
+    /// not exist.
+    pub missing_local_sources: Vec<MissingLocalSource>,
 }
 
 fn get_cros_workon_array_variable(
@@ -180,11 +197,15 @@ fn get_cros_workon_tree(details: &PackageDetails) -> Result<Vec<String>> {
 fn extract_cros_workon_sources(
     details: &PackageDetails,
     src_dir: &Path,
-) -> Result<(Vec<PackageLocalSource>, Vec<PackageRepoSource>)> {
+) -> Result<(
+    Vec<PackageLocalSource>,
+    Vec<PackageRepoSource>,
+    Vec<MissingLocalSource>,
+)> {
     let projects = match details.metadata.vars.hash_map().get("CROS_WORKON_PROJECT") {
         None => {
             // This is not a cros-workon package.
-            return Ok((Vec::new(), Vec::new()));
+            return Ok((Vec::new(), Vec::new(), Vec::new()));
         }
         Some(BashValue::Scalar(project)) => vec![project.clone()],
         Some(BashValue::IndexedArray(projects)) => projects.clone(),
@@ -207,6 +228,7 @@ fn extract_cros_workon_sources(
 
     let mut source_paths = Vec::<PathBuf>::new();
     let mut repo_sources = Vec::<PackageRepoSource>::new();
+    let mut missing_sources = Vec::<MissingLocalSource>::new();
     let mut seen_trees = HashSet::<&String>::new();
 
     let mut tree_index = 0;
@@ -221,7 +243,7 @@ fn extract_cros_workon_sources(
             // TODO: Fix the ebuild and remove this hack.
             "platform/chromiumos-assets".to_owned()
         } else if is_chromeos_base {
-            local_name
+            local_name.clone()
         } else if let Some(clean_path) = local_name.strip_prefix("../") {
             clean_path.to_owned()
         } else {
@@ -248,6 +270,24 @@ fn extract_cros_workon_sources(
                 // Skip the whole project
                 continue;
             }
+            match metadata(src_dir.join(&local_path)) {
+                Err(err) if err.kind() == ErrorKind::NotFound => {
+                    // Unlike missing subtrees, a missing project directory
+                    // is a sign of a wrong CROS_WORKON_LOCALNAME.
+                    missing_sources.push(MissingLocalSource {
+                        project: project.to_string(),
+                        local_name,
+                        path: PathBuf::from(&local_path),
+                    });
+                    continue;
+                }
+                Err(err) => {
+                    return Err(err).with_context(|| {
+                        format!("failed to stat {}", src_dir.join(&local_path).display())
+                    });
+                }
+                Ok(_) => {}
+            }
             for subtree in local_subtrees {
                 let subtree = subtree.trim_start_matches('/');
 
@@ -340,7 +380,7 @@ fn extract_cros_workon_sources(
         })
         .collect::<Result<_>>()?;
 
-    Ok((sources, repo_sources))
+    Ok((sources, repo_sources, missing_sources))
 }
 
 fn apply_local_sources_workarounds(
@@ -455,46 +495,6 @@ fn parse_uri_dependencies(deps: UriDependency, use_map: &UseMap) -> Result<Vec<U
     parse_simplified_dependency(deps)
 }
 
-struct DistEntry {
-    pub filename: String,
-    pub size: u64,
-    pub hashes: HashMap<String, String>,
-}
-
-struct PackageManifest {
-    pub dists: Vec<DistEntry>,
-}
-
-fn load_package_manifest(dir: &Path) -> Result<PackageManifest> {
-    let full_path = &dir.join("Manifest");
-    let content = read_to_string(full_path).with_context(|| full_path.display().to_string())?;
-    let dists = content
-        .split('\n')
-        .map(|line| {
-            let mut columns = line.split_ascii_whitespace().map(|s| s.to_owned());
-
-            let dist = columns.next();
-            match dist {
-                Some(s) if s == "DIST" => {}
-                _ => return Ok(None), // ignore other lines
-            }
-
-            let (filename, size_str) = columns
-                .next_tuple()
-                .ok_or_else(|| anyhow!("Corrupted Manifest line: {}", line))?;
-            let size = size_str.parse()?;
-            let hashes = HashMap::<String, String>::from_iter(columns.tuples());
-            Ok(Some(DistEntry {
-                filename,
-                size,
-                hashes,
-            }))
-        })
-        .flatten_ok()
-        .collect::<Result<Vec<_>>>()?;
-    Ok(PackageManifest { dists })
-}
-
 // These are the only public gs buckets an ebuild should be accessing.
 // See https://source.chromium.org/chromium/chromiumos/docs/+/main:archive_mirrors.md
 static PUBLIC_GS_BUCKETS: &[&str] = &[
@@ -590,11 +590,17 @@ fn extract_remote_sources(
         return Ok(Vec::new());
     }
 
-    let manifest = load_package_manifest(details.as_basic_data().ebuild_path.parent().unwrap())?;
+    let manifest = Manifest::load(
+        &details
+            .as_basic_data()
+            .ebuild_path
+            .with_file_name("Manifest"),
+    )?;
 
-    let mut dist_map: HashMap<String, DistEntry> = manifest
-        .dists
+    let mut dist_map: HashMap<String, ManifestEntry> = manifest
+        .entries
         .into_iter()
+        .filter(|entry| entry.kind == EntryKind::Dist)
         .map(|dist| (dist.filename.clone(), dist))
         .collect();
 
@@ -635,7 +641,7 @@ fn extract_remote_sources(
                 urls,
                 filename,
                 size: dist.size,
-                hashes: dist.hashes,
+                hashes: dist.hashes.into_iter().collect(),
             })
         })
         .collect::<Result<Vec<_>>>()?;
@@ -651,7 +657,8 @@ pub fn analyze_sources(
     details: &PackageDetails,
     src_dir: &Path,
 ) -> Result<PackageSources> {
-    let (mut local_sources, repo_sources) = extract_cros_workon_sources(details, src_dir)?;
+    let (mut local_sources, repo_sources, missing_local_sources) =
+        extract_cros_workon_sources(details, src_dir)?;
 
     apply_local_sources_workarounds(details, &mut local_sources)?;
 
@@ -662,6 +669,7 @@ pub fn analyze_sources(
         local_sources,
         repo_sources,
         dist_sources: extract_remote_sources(config, details)?,
+        missing_local_sources,
     })
 }
 
@@ -729,7 +737,7 @@ mod tests {
     #[test]
     fn non_cros_workon_package() -> Result<()> {
         let (package, _tmpdir) = new_non_cros_workon_package(UseMap::new())?;
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, Path::new("/src"))?;
 
         assert_eq!(local_sources, []);
@@ -883,7 +891,7 @@ mod tests {
             direct_build_target: None,
             bazel_metadata: Default::default(),
         };
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, Path::new("/src"))?;
 
         assert_eq!(local_sources, []);
@@ -1006,7 +1014,7 @@ mod tests {
             direct_build_target: None,
             bazel_metadata: Default::default(),
         };
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, Path::new("/src"))?;
 
         assert_eq!(local_sources, []);
@@ -1107,7 +1115,7 @@ mod tests {
             direct_build_target: None,
             bazel_metadata: Default::default(),
         };
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, Path::new("/src"))?;
 
         assert_eq!(local_sources, []);
@@ -1232,7 +1240,7 @@ mod tests {
             direct_build_target: None,
             bazel_metadata: Default::default(),
         };
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, &dir.join("src"))?;
 
         assert_eq!(repo_sources, []);
@@ -1318,7 +1326,7 @@ mod tests {
             direct_build_target: None,
             bazel_metadata: Default::default(),
         };
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, &dir.join("src"))?;
 
         assert_eq!(repo_sources, []);
@@ -1411,7 +1419,7 @@ mod tests {
         let package =
             create_optional_subtree_package(UseMap::from([("coreboot".to_owned(), true)]));
 
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, Path::new("/src"))?;
 
         assert_eq!(local_sources, []);
@@ -1471,7 +1479,7 @@ mod tests {
         let package =
             create_optional_subtree_package(UseMap::from([("coreboot".to_owned(), false)]));
 
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, Path::new("/src"))?;
 
         assert_eq!(local_sources, []);
@@ -1570,7 +1578,7 @@ mod tests {
             direct_build_target: None,
             bazel_metadata: Default::default(),
         };
-        let (local_sources, repo_sources) =
+        let (local_sources, repo_sources, _) =
             extract_cros_workon_sources(&package, &dir.join("src"))?;
 
         assert_eq!(repo_sources, []);
@@ -1585,4 +1593,98 @@ mod tests {
 
         Ok(())
     }
+
+    #[test]
+    fn cros_workon_9999_package_with_missing_project() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        write_files(
+            dir,
+            [
+                ("src/platform/depthcharge/README", ""),
+                ("src/platform/vboot_reference/README", ""),
+            ],
+        )?;
+
+        let package = PackageDetails {
+            metadata: Arc::new(EBuildMetadata {
+                basic_data: EBuildBasicData {
+                    repo_name: "baz".to_owned(),
+                    ebuild_path: PathBuf::from("/dev/null"),
+                    package_name: "sys-boot/depthcharge".to_owned(),
+                    short_package_name: "depthcharge".to_owned(),
+                    category_name: "sys-boot".to_owned(),
+                    version: Version::try_new("0.1.0").unwrap(),
+                },
+                vars: BashVars::new(HashMap::from([
+                    (
+                        "CROS_WORKON_PROJECT".to_owned(),
+                        BashValue::IndexedArray(Vec::from([
+                            "chromiumos/platform/depthcharge".to_owned(),
+                            "chromiumos/platform/vboot_reference".to_owned(),
+                            "chromiumos/third_party/coreboot".to_owned(),
+                        ])),
+                    ),
+                    (
+                        "CROS_WORKON_LOCALNAME".to_owned(),
+                        BashValue::IndexedArray(Vec::from([
+                            "../platform/depthcharge".to_owned(),
+                            "../platform/vboot_reference".to_owned(),
+                            "../third_party/coreboot".to_owned(),
+                        ])),
+                    ),
+                    (
+                        "CROS_WORKON_COMMIT".to_owned(),
+                        BashValue::Scalar("".to_owned()),
+                    ),
+                    (
+                        "CROS_WORKON_TREE".to_owned(),
+                        BashValue::Scalar("".to_owned()),
+                    ),
+                    (
+                        "CROS_WORKON_SUBTREE".to_owned(),
+                        BashValue::Scalar("".to_owned()),
+                    ),
+                    (
+                        "CROS_WORKON_OPTIONAL_CHECKOUT".to_owned(),
+                        BashValue::IndexedArray(Vec::from([
+                            "".to_owned(),
+                            "".to_owned(),
+                            "".to_owned(),
+                        ])),
+                    ),
+                ])),
+            }),
+            slot: Slot::new("0"),
+            use_map: UseMap::new(),
+            stable: true,
+            readiness: PackageReadiness::Ok,
+            inherited: HashSet::new(),
+            inherit_paths: vec![],
+            direct_build_target: None,
+            bazel_metadata: Default::default(),
+        };
+        let (local_sources, repo_sources, missing_sources) =
+            extract_cros_workon_sources(&package, &dir.join("src"))?;
+
+        assert_eq!(repo_sources, []);
+        assert_eq!(
+            local_sources,
+            [
+                PackageLocalSource::Src("src/platform/depthcharge".into()),
+                PackageLocalSource::Src("src/platform/vboot_reference".into()),
+            ]
+        );
+        assert_eq!(
+            missing_sources,
+            [MissingLocalSource {
+                project: "chromiumos/third_party/coreboot".into(),
+                local_name: "../third_party/coreboot".into(),
+                path: "third_party/coreboot".into(),
+            }]
+        );
+
+        Ok(())
+    }
 }
@@ -0,0 +1,837 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{collections::BTreeMap, fmt::Display, fmt::Write as _, path::PathBuf, time::Duration};
+
+use itertools::Itertools;
+use serde_json::json;
+
+use crate::config::miscconf::bashrc::MetadataAssignment;
+
+/// Number of the slowest packages to report.
+const SLOWEST_PACKAGES_LIMIT: usize = 10;
+
+/// Number of the most common failure reasons to print.
+const FAILURE_REASONS_LIMIT: usize = 10;
+
+/// Prefix of metric names in the Prometheus text format.
+const METRIC_PREFIX: &str = "alchemist_analysis";
+
+/// Number of analyzed packages in a group, e.g. a category or a repository.
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
+pub struct PackageCounts {
+    /// Number of analyzed packages.
+    pub packages: usize,
+    /// Number of packages that failed to analyze.
+    pub failed: usize,
+}
+
+impl PackageCounts {
+    /// Returns the ratio of packages analyzed successfully. An empty group is
+    /// considered to be fully passing.
+    pub fn pass_rate(&self) -> f64 {
+        if self.packages == 0 {
+            return 1.0;
+        }
+        (self.packages - self.failed) as f64 / self.packages as f64
+    }
+
+    fn merge(&mut self, other: PackageCounts) {
+        self.packages += other.packages;
+        self.failed += other.failed;
+    }
+
+    fn to_json(self) -> serde_json::Value {
+        json!({
+            "packages": self.packages,
+            "failed_packages": self.failed,
+            "pass_rate": self.pass_rate(),
+        })
+    }
+}
+
+/// Computes a signature of an analysis error so that errors of the same kind
+/// in different packages can be grouped together.
+///
+/// Errors are formatted with `{:#}`, so the innermost cause comes last after
+/// the contexts describing the package being analyzed. Numbers are masked out
+/// since they mostly come from package versions.
+pub fn error_signature(error: &str) -> String {
+    let first_line = error.lines().next().unwrap_or_default();
+    let cause = first_line.rsplit(": ").next().unwrap_or_default().trim();
+    let mut signature = String::new();
+    let mut in_number = false;
+    for c in cause.chars() {
+        if c.is_ascii_digit() {
+            if !in_number {
+                signature.push('N');
+            }
+            in_number = true;
+        } else {
+            signature.push(c);
+            in_number = false;
+        }
+    }
+    signature
+}
+
+/// Time spent on package-local analysis of a single package.
+#[derive(Clone, Debug)]
+pub struct PackageAnalysisTime {
+    /// The package, e.g. "sys-apps/attr-2.5.1".
+    pub package: String,
+    /// Time spent on computing direct dependencies.
+    pub dependencies: Duration,
+    /// Time spent on locating sources. This mostly consists of file system IO.
+    pub sources: Duration,
+    /// Total time spent on package-local analysis.
+    pub total: Duration,
+}
+
+/// A bashrc file assigning variables that affect package metadata. Packages
+/// executing it may be built with metadata diverging from the analysis.
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct BashrcWarning {
+    /// Assignments found in the file.
+    pub assignments: Vec<MetadataAssignment>,
+    /// Number of analyzed packages executing the file.
+    pub packages: usize,
+}
+
+/// Statistics of package analysis, used to measure performance of the
+/// analyzer across releases.
+#[derive(Clone, Debug, Default)]
+pub struct AnalysisStats {
+    /// Number of analyzed packages.
+    pub packages: usize,
+    /// Number of packages that failed to analyze.
+    pub failed_packages: usize,
+    /// Number of ebuild metadata lookups served from the cache.
+    pub metadata_cache_hits: usize,
+    /// Number of ebuild metadata lookups that required evaluating ebuilds.
+    pub metadata_cache_misses: usize,
+    /// Wall time spent on loading packages, including ebuild metadata
+    /// evaluation.
+    pub metadata_evaluation: Duration,
+    /// Wall time spent on package-local analysis.
+    pub local_analysis: Duration,
+    /// Wall time spent on package-global analysis.
+    pub global_analysis: Duration,
+    /// Time spent on package-local analysis of each package.
+    pub package_times: Vec<PackageAnalysisTime>,
+    /// Package counts keyed by category names, e.g. "sys-apps".
+    pub categories: BTreeMap<String, PackageCounts>,
+    /// Package counts keyed by repository names, e.g. "portage-stable".
+    pub repos: BTreeMap<String, PackageCounts>,
+    /// Number of failed packages keyed by error signatures computed with
+    /// [`error_signature`].
+    pub failure_reasons: BTreeMap<String, usize>,
+    /// bashrc files assigning variables that affect package metadata, keyed
+    /// by their paths.
+    pub bashrc_warnings: BTreeMap<PathBuf, BashrcWarning>,
+}
+
+impl AnalysisStats {
+    /// Accumulates statistics of another analysis run into this one.
+    pub fn merge(&mut self, other: AnalysisStats) {
+        self.packages += other.packages;
+        self.failed_packages += other.failed_packages;
+        self.metadata_cache_hits += other.metadata_cache_hits;
+        self.metadata_cache_misses += other.metadata_cache_misses;
+        self.metadata_evaluation += other.metadata_evaluation;
+        self.local_analysis += other.local_analysis;
+        self.global_analysis += other.global_analysis;
+        self.package_times.extend(other.package_times);
+        for (category, counts) in other.categories {
+            self.categories.entry(category).or_default().merge(counts);
+        }
+        for (repo, counts) in other.repos {
+            self.repos.entry(repo).or_default().merge(counts);
+        }
+        for (signature, count) in other.failure_reasons {
+            *self.failure_reasons.entry(signature).or_default() += count;
+        }
+        for (path, warning) in other.bashrc_warnings {
+            self.bashrc_warnings
+                .entry(path)
+                .and_modify(|w| w.packages += warning.packages)
+                .or_insert(warning);
+        }
+    }
+
+    /// Records the analysis result of a package. `error` is set if the
+    /// package failed to analyze.
+    pub fn record_package(&mut self, repo: &str, category: &str, error: Option<&str>) {
+        let failed = usize::from(error.is_some());
+        self.packages += 1;
+        self.failed_packages += failed;
+        for counts in [
+            self.categories.entry(category.to_string()).or_default(),
+            self.repos.entry(repo.to_string()).or_default(),
+        ] {
+            counts.packages += 1;
+            counts.failed += failed;
+        }
+        if let Some(error) = error {
+            *self
+                .failure_reasons
+                .entry(error_signature(error))
+                .or_default() += 1;
+        }
+    }
+
+    /// Returns failure reasons sorted by the number of failed packages in
+    /// descending order.
+    pub fn top_failure_reasons(&self) -> Vec<(&str, usize)> {
+        self.failure_reasons
+            .iter()
+            .map(|(signature, count)| (signature.as_str(), *count))
+            .sorted_by(|a, b| b.1.cmp(&a.1).then_with(|| a.0.cmp(b.0)))
+            .collect()
+    }
+
+    /// Returns the total time spent on computing direct dependencies, summed
+    /// over all threads.
+    pub fn dependency_analysis(&self) -> Duration {
+        self.package_times.iter().map(|t| t.dependencies).sum()
+    }
+
+    /// Returns the total time spent on locating sources, summed over all
+    /// threads.
+    pub fn source_analysis(&self) -> Duration {
+        self.package_times.iter().map(|t| t.sources).sum()
+    }
+
+    /// Returns the packages that took the longest to analyze.
+    pub fn slowest_packages(&self) -> Vec<&PackageAnalysisTime> {
+        self.package_times
+            .iter()
+            .sorted_by(|a, b| {
+                b.total
+                    .cmp(&a.total)
+                    .then_with(|| a.package.cmp(&b.package))
+            })
+            .take(SLOWEST_PACKAGES_LIMIT)
+            .collect()
+    }
+
+    /// Converts the statistics into JSON. Durations are represented in seconds.
+    pub fn to_json(&self) -> serde_json::Value {
+        json!({
+            "packages": self.packages,
+            "failed_packages": self.failed_packages,
+            "metadata_cache_hits": self.metadata_cache_hits,
+            "metadata_cache_misses": self.metadata_cache_misses,
+            "metadata_evaluation_secs": self.metadata_evaluation.as_secs_f64(),
+            "local_analysis_secs": self.local_analysis.as_secs_f64(),
+            "dependency_analysis_secs": self.dependency_analysis().as_secs_f64(),
+            "source_analysis_secs": self.source_analysis().as_secs_f64(),
+            "global_analysis_secs": self.global_analysis.as_secs_f64(),
+            "slowest_packages": self
+                .slowest_packages()
+                .into_iter()
+                .map(|t| json!({
+                    "package": t.package,
+                    "dependency_analysis_secs": t.dependencies.as_secs_f64(),
+                    "source_analysis_secs": t.sources.as_secs_f64(),
+                    "total_secs": t.total.as_secs_f64(),
+                }))
+                .collect_vec(),
+            "categories": self
+                .categories
+                .iter()
+                .map(|(category, counts)| (category.clone(), counts.to_json()))
+                .collect::<serde_json::Map<_, _>>(),
+            "repos": self
+                .repos
+                .iter()
+                .map(|(repo, counts)| (repo.clone(), counts.to_json()))
+                .collect::<serde_json::Map<_, _>>(),
+            "failure_reasons": self
+                .top_failure_reasons()
+                .into_iter()
+                .map(|(signature, count)| json!({
+                    "signature": signature,
+                    "packages": count,
+                }))
+                .collect_vec(),
+            "bashrc_warnings": self
+                .bashrc_warnings
+                .iter()
+                .map(|(path, warning)| json!({
+                    "path": path,
+                    "packages": warning.packages,
+                    "assignments": warning
+                        .assignments
+                        .iter()
+                        .map(|a| json!({
+                            "line": a.line,
+                            "variable": a.variable,
+                        }))
+                        .collect_vec(),
+                }))
+                .collect_vec(),
+        })
+    }
+
+    /// Converts the statistics into the Prometheus text exposition format, so
+    /// that they can be scraped or pushed to a Pushgateway by CI.
+    pub fn to_prometheus(&self) -> String {
+        let mut out = String::new();
+        let mut metric = |name: &str, help: &str, samples: Vec<(String, f64)>| {
+            writeln!(out, "# HELP {METRIC_PREFIX}_{name} {help}").unwrap();
+            writeln!(out, "# TYPE {METRIC_PREFIX}_{name} gauge").unwrap();
+            for (labels, value) in samples {
+                writeln!(out, "{METRIC_PREFIX}_{name}{labels} {value}").unwrap();
+            }
+        };
+        let single = |value: f64| vec![(String::new(), value)];
+        let grouped = |label: &str,
+                       groups: &BTreeMap<String, PackageCounts>,
+                       f: fn(&PackageCounts) -> f64| {
+            groups
+                .iter()
+                .map(|(key, counts)| {
+                    (
+                        format!("{{{label}=\"{}\"}}", escape_label_value(key)),
+                        f(counts),
+                    )
+                })
+                .collect_vec()
+        };
+
+        metric(
+            "packages",
+            "Number of analyzed packages.",
+            single(self.packages as f64),
+        );
+        metric(
+            "failed_packages",
+            "Number of packages that failed to analyze.",
+            single(self.failed_packages as f64),
+        );
+        metric(
+            "metadata_cache_hits",
+            "Number of ebuild metadata lookups served from the cache.",
+            single(self.metadata_cache_hits as f64),
+        );
+        metric(
+            "metadata_cache_misses",
+            "Number of ebuild metadata lookups that required evaluating ebuilds.",
+            single(self.metadata_cache_misses as f64),
+        );
+        for (name, help, duration) in [
+            (
+                "metadata_evaluation_seconds",
+                "Wall time spent on loading packages.",
+                self.metadata_evaluation,
+            ),
+            (
+                "local_analysis_seconds",
+                "Wall time spent on package-local analysis.",
+                self.local_analysis,
+            ),
+            (
+                "global_analysis_seconds",
+                "Wall time spent on package-global analysis.",
+                self.global_analysis,
+            ),
+        ] {
+            metric(name, help, single(duration.as_secs_f64()));
+        }
+        metric(
+            "category_packages",
+            "Number of analyzed packages per category.",
+            grouped("category", &self.categories, |c| c.packages as f64),
+        );
+        metric(
+            "category_failed_packages",
+            "Number of packages that failed to analyze per category.",
+            grouped("category", &self.categories, |c| c.failed as f64),
+        );
+        metric(
+            "repo_packages",
+            "Number of analyzed packages per repository.",
+            grouped("repo", &self.repos, |c| c.packages as f64),
+        );
+        metric(
+            "repo_failed_packages",
+            "Number of packages that failed to analyze per repository.",
+            grouped("repo", &self.repos, |c| c.failed as f64),
+        );
+        metric(
+            "repo_pass_rate",
+            "Ratio of packages analyzed successfully per repository.",
+            grouped("repo", &self.repos, PackageCounts::pass_rate),
+        );
+        metric(
+            "failure_reason_packages",
+            "Number of failed packages per error signature.",
+            self.failure_reasons
+                .iter()
+                .map(|(signature, count)| {
+                    (
+                        format!("{{signature=\"{}\"}}", escape_label_value(signature)),
+                        *count as f64,
+                    )
+                })
+                .collect_vec(),
+        );
+        out
+    }
+
+    /// Computes changes from statistics of a previous run, given as JSON
+    /// produced by [`AnalysisStats::to_json`].
+    pub fn delta_from(&self, previous: &serde_json::Value) -> StatsDelta {
+        let count = |value: &serde_json::Value| value.as_u64().unwrap_or_default() as i64;
+        let groups = |current: &BTreeMap<String, PackageCounts>, key: &str| {
+            let empty = serde_json::Map::new();
+            let previous = previous[key].as_object().unwrap_or(&empty);
+            current
+                .keys()
+                .chain(previous.keys())
+                .unique()
+                .filter_map(|name| {
+                    let counts = current.get(name).copied().unwrap_or_default();
+                    let old = previous.get(name);
+                    let delta = GroupDelta {
+                        packages: counts.packages as i64
+                            - old.map(|o| count(&o["packages"])).unwrap_or_default(),
+                        failed: counts.failed as i64
+                            - old
+                                .map(|o| count(&o["failed_packages"]))
+                                .unwrap_or_default(),
+                    };
+                    (delta != GroupDelta::default()).then(|| (name.clone(), delta))
+                })
+                .collect()
+        };
+
+        let mut failure_reasons: BTreeMap<String, i64> = self
+            .failure_reasons
+            .iter()
+            .map(|(signature, count)| (signature.clone(), *count as i64))
+            .collect();
+        for reason in previous["failure_reasons"].as_array().into_iter().flatten() {
+            if let Some(signature) = reason["signature"].as_str() {
+                *failure_reasons.entry(signature.to_string()).or_default() -=
+                    count(&reason["packages"]);
+            }
+        }
+        failure_reasons.retain(|_, delta| *delta != 0);
+
+        StatsDelta {
+            packages: self.packages as i64 - count(&previous["packages"]),
+            failed_packages: self.failed_packages as i64 - count(&previous["failed_packages"]),
+            categories: groups(&self.categories, "categories"),
+            repos: groups(&self.repos, "repos"),
+            failure_reasons,
+        }
+    }
+}
+
+/// Escapes a string to be used as a label value in the Prometheus text format.
+fn escape_label_value(s: &str) -> String {
+    s.replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Changes of package counts in a group between two runs.
+#[derive(Clone, Copy, Debug, Default, Eq, PartialEq)]
+pub struct GroupDelta {
+    pub packages: i64,
+    pub failed: i64,
+}
+
+/// Changes of statistics from a previous run, used to track progress over
+/// time. Groups without changes are omitted.
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct StatsDelta {
+    pub packages: i64,
+    pub failed_packages: i64,
+    pub categories: BTreeMap<String, GroupDelta>,
+    pub repos: BTreeMap<String, GroupDelta>,
+    pub failure_reasons: BTreeMap<String, i64>,
+}
+
+impl StatsDelta {
+    /// Converts the delta into JSON.
+    pub fn to_json(&self) -> serde_json::Value {
+        let groups = |groups: &BTreeMap<String, GroupDelta>| {
+            groups
+                .iter()
+                .map(|(name, delta)| {
+                    (
+                        name.clone(),
+                        json!({
+                            "packages": delta.packages,
+                            "failed_packages": delta.failed,
+                        }),
+                    )
+                })
+                .collect::<serde_json::Map<_, _>>()
+        };
+        json!({
+            "packages": self.packages,
+            "failed_packages": self.failed_packages,
+            "categories": groups(&self.categories),
+            "repos": groups(&self.repos),
+            "failure_reasons": self.failure_reasons,
+        })
+    }
+}
+
+impl Display for StatsDelta {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        writeln!(
+            f,
+            "Packages analyzed: {:+} ({:+} failed)",
+            self.packages, self.failed_packages
+        )?;
+        for (title, groups) in [
+            ("Categories", &self.categories),
+            ("Repositories", &self.repos),
+        ] {
+            if groups.is_empty() {
+                continue;
+            }
+            writeln!(f, "{title}:")?;
+            for (name, delta) in groups {
+                writeln!(
+                    f,
+                    "  {:+}\t{:+} failed\t{}",
+                    delta.packages, delta.failed, name
+                )?;
+            }
+        }
+        if !self.failure_reasons.is_empty() {
+            writeln!(f, "Failure reasons:")?;
+            for (signature, delta) in &self.failure_reasons {
+                writeln!(f, "  {delta:+}\t{signature}")?;
+            }
+        }
+        Ok(())
+    }
+}
+
+impl Display for AnalysisStats {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        writeln!(
+            f,
+            "Packages analyzed: {} ({} failed)",
+            self.packages, self.failed_packages
+        )?;
+        writeln!(
+            f,
+            "Metadata cache: {} hits, {} misses",
+            self.metadata_cache_hits, self.metadata_cache_misses
+        )?;
+        writeln!(f, "Metadata evaluation: {:.2?}", self.metadata_evaluation)?;
+        writeln!(
+            f,
+            "Local analysis: {:.2?} (dependencies: {:.2?}, sources: {:.2?}, summed over threads)",
+            self.local_analysis,
+            self.dependency_analysis(),
+            self.source_analysis()
+        )?;
+        writeln!(f, "Global analysis: {:.2?}", self.global_analysis)?;
+        writeln!(f, "Slowest packages:")?;
+        for t in self.slowest_packages() {
+            writeln!(f, "  {:.2?}\t{}", t.total, t.package)?;
+        }
+        if !self.repos.is_empty() {
+            writeln!(f, "Pass rate by repository:")?;
+            for (repo, counts) in &self.repos {
+                writeln!(
+                    f,
+                    "  {:.1}%\t{}/{}\t{}",
+                    counts.pass_rate() * 100.0,
+                    counts.packages - counts.failed,
+                    counts.packages,
+                    repo
+                )?;
+            }
+        }
+        if !self.failure_reasons.is_empty() {
+            writeln!(f, "Most common failure reasons:")?;
+            for (signature, count) in self
+                .top_failure_reasons()
+                .into_iter()
+                .take(FAILURE_REASONS_LIMIT)
+            {
+                writeln!(f, "  {count}\t{signature}")?;
+            }
+        }
+        if !self.bashrc_warnings.is_empty() {
+            writeln!(
+                f,
+                "bashrc files modifying package metadata (builds may diverge from the analysis):"
+            )?;
+            for (path, warning) in &self.bashrc_warnings {
+                writeln!(
+                    f,
+                    "  {}\t{} ({})",
+                    warning.packages,
+                    path.display(),
+                    warning
+                        .assignments
+                        .iter()
+                        .map(|a| format!("{} at line {}", a.variable, a.line))
+                        .join(", ")
+                )?;
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::Path;
+
+    fn package_time(package: &str, millis: u64) -> PackageAnalysisTime {
+        PackageAnalysisTime {
+            package: package.to_string(),
+            dependencies: Duration::from_millis(millis / 2),
+            sources: Duration::from_millis(millis / 4),
+            total: Duration::from_millis(millis),
+        }
+    }
+
+    #[test]
+    fn test_merge() {
+        let mut stats = AnalysisStats {
+            packages: 2,
+            failed_packages: 1,
+            metadata_evaluation: Duration::from_secs(1),
+            package_times: vec![package_time("a/a-1", 100), package_time("a/b-1", 200)],
+            ..Default::default()
+        };
+        stats.merge(AnalysisStats {
+            packages: 1,
+            metadata_cache_hits: 3,
+            metadata_evaluation: Duration::from_secs(2),
+            package_times: vec![package_time("b/c-1", 40)],
+            ..Default::default()
+        });
+
+        assert_eq!(stats.packages, 3);
+        assert_eq!(stats.failed_packages, 1);
+        assert_eq!(stats.metadata_cache_hits, 3);
+        assert_eq!(stats.metadata_evaluation, Duration::from_secs(3));
+        assert_eq!(stats.dependency_analysis(), Duration::from_millis(170));
+        assert_eq!(stats.source_analysis(), Duration::from_millis(85));
+    }
+
+    #[test]
+    fn test_slowest_packages() {
+        let stats = AnalysisStats {
+            package_times: (0..20)
+                .map(|i| package_time(&format!("a/p{i:02}-1"), i))
+                .collect(),
+            ..Default::default()
+        };
+
+        let slowest = stats
+            .slowest_packages()
+            .into_iter()
+            .map(|t| t.package.as_str())
+            .collect_vec();
+        assert_eq!(
+            slowest,
+            vec![
+                "a/p19-1", "a/p18-1", "a/p17-1", "a/p16-1", "a/p15-1", "a/p14-1", "a/p13-1",
+                "a/p12-1", "a/p11-1", "a/p10-1"
+            ]
+        );
+        assert_eq!(
+            stats.to_json()["slowest_packages"]
+                .as_array()
+                .unwrap()
+                .len(),
+            SLOWEST_PACKAGES_LIMIT
+        );
+    }
+
+    #[test]
+    fn test_error_signature() {
+        assert_eq!(
+            error_signature(
+                "Failed to analyze sys-apps/attr-2.5.1: No package satisfies >=dev-libs/foo-1.23"
+            ),
+            "No package satisfies >=dev-libs/foo-N.N"
+        );
+        assert_eq!(
+            error_signature("ebuild exited with status 1\nsome trace"),
+            "ebuild exited with status N"
+        );
+        assert_eq!(error_signature(""), "");
+    }
+
+    fn sample_stats() -> AnalysisStats {
+        let mut stats = AnalysisStats::default();
+        stats.record_package("portage-stable", "sys-apps", None);
+        stats.record_package(
+            "portage-stable",
+            "sys-libs",
+            Some("Failed to analyze sys-libs/a-1: No package satisfies x/y-2"),
+        );
+        stats.record_package(
+            "chromiumos",
+            "sys-apps",
+            Some("Failed to analyze sys-apps/b-3: No package satisfies x/y-4"),
+        );
+        stats
+    }
+
+    #[test]
+    fn test_record_package() {
+        let stats = sample_stats();
+        assert_eq!(stats.packages, 3);
+        assert_eq!(stats.failed_packages, 2);
+        assert_eq!(
+            stats.categories,
+            BTreeMap::from([
+                (
+                    "sys-apps".to_string(),
+                    PackageCounts {
+                        packages: 2,
+                        failed: 1
+                    }
+                ),
+                (
+                    "sys-libs".to_string(),
+                    PackageCounts {
+                        packages: 1,
+                        failed: 1
+                    }
+                ),
+            ])
+        );
+        assert_eq!(stats.repos["portage-stable"].pass_rate(), 0.5);
+        assert_eq!(
+            stats.top_failure_reasons(),
+            vec![("No package satisfies x/y-N", 2)]
+        );
+
+        let mut merged = sample_stats();
+        merged.merge(stats);
+        assert_eq!(merged.repos["chromiumos"].packages, 2);
+        assert_eq!(merged.failure_reasons["No package satisfies x/y-N"], 4);
+    }
+
+    #[test]
+    fn test_to_prometheus() {
+        let prometheus = sample_stats().to_prometheus();
+        for line in [
+            "# TYPE alchemist_analysis_packages gauge",
+            "alchemist_analysis_packages 3",
+            "alchemist_analysis_failed_packages 2",
+            "alchemist_analysis_category_failed_packages{category=\"sys-libs\"} 1",
+            "alchemist_analysis_repo_pass_rate{repo=\"portage-stable\"} 0.5",
+            "alchemist_analysis_repo_pass_rate{repo=\"chromiumos\"} 0",
+            "alchemist_analysis_failure_reason_packages{signature=\"No package satisfies x/y-N\"} 2",
+        ] {
+            assert!(
+                prometheus.lines().any(|l| l == line),
+                "{line:?} not found in:\n{prometheus}"
+            );
+        }
+        assert_eq!(escape_label_value("a\"b\\c\n"), "a\\\"b\\\\c\\n");
+    }
+
+    #[test]
+    fn test_delta_from() {
+        let previous = sample_stats().to_json();
+
+        let mut stats = AnalysisStats::default();
+        stats.record_package("portage-stable", "sys-apps", None);
+        stats.record_package("portage-stable", "sys-libs", None);
+        stats.record_package("chromiumos", "sys-apps", Some("ebuild failed"));
+        stats.record_package("chromiumos", "chromeos-base", None);
+
+        let delta = stats.delta_from(&previous);
+        assert_eq!(
+            delta,
+            StatsDelta {
+                packages: 1,
+                failed_packages: -1,
+                categories: BTreeMap::from([
+                    (
+                        "chromeos-base".to_string(),
+                        GroupDelta {
+                            packages: 1,
+                            failed: 0
+                        }
+                    ),
+                    (
+                        "sys-libs".to_string(),
+                        GroupDelta {
+                            packages: 0,
+                            failed: -1
+                        }
+                    ),
+                ]),
+                repos: BTreeMap::from([
+                    (
+                        "chromiumos".to_string(),
+                        GroupDelta {
+                            packages: 1,
+                            failed: 0
+                        }
+                    ),
+                    (
+                        "portage-stable".to_string(),
+                        GroupDelta {
+                            packages: 0,
+                            failed: -1
+                        }
+                    ),
+                ]),
+                failure_reasons: BTreeMap::from([
+                    ("No package satisfies x/y-N".to_string(), -2),
+                    ("ebuild failed".to_string(), 1),
+                ]),
+            }
+        );
+        assert_eq!(stats.delta_from(&stats.to_json()), StatsDelta::default());
+    }
+
+    #[test]
+    fn test_bashrc_warnings() {
+        let warning = || BashrcWarning {
+            assignments: vec![MetadataAssignment {
+                line: 3,
+                variable: "DEPEND".to_string(),
+            }],
+            packages: 2,
+        };
+        let mut stats = AnalysisStats {
+            bashrc_warnings: BTreeMap::from([(PathBuf::from("/a/profile.bashrc"), warning())]),
+            ..Default::default()
+        };
+        stats.merge(AnalysisStats {
+            bashrc_warnings: BTreeMap::from([(PathBuf::from("/a/profile.bashrc"), warning())]),
+            ..Default::default()
+        });
+
+        assert_eq!(
+            stats.bashrc_warnings[Path::new("/a/profile.bashrc")].packages,
+            4
+        );
+        assert!(stats
+            .to_string()
+            .contains("  4\t/a/profile.bashrc (DEPEND at line 3)\n"));
+        assert_eq!(
+            stats.to_json()["bashrc_warnings"],
+            json!([{
+                "path": "/a/profile.bashrc",
+                "packages": 4,
+                "assignments": [{"line": 3, "variable": "DEPEND"}],
+            }])
+        );
+    }
+}
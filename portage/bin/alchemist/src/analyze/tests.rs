@@ -90,6 +90,7 @@ struct PackageDependenciesDescription {
     post_target: Vec<String>,
     build_host: Vec<String>,
     install_host: Vec<String>,
+    subslot_rebuild_target: Vec<String>,
     install_set: Vec<String>,
     build_host_set: Vec<String>,
     reusable_host_set: Vec<String>,
@@ -105,6 +106,7 @@ impl PackageDependenciesDescription {
         post_target: Vec::new(),
         build_host: Vec::new(),
         install_host: Vec::new(),
+        subslot_rebuild_target: Vec::new(),
         install_set: Vec::new(),
         build_host_set: Vec::new(),
         reusable_host_set: Vec::new(),
@@ -171,6 +173,7 @@ impl From<MaybePackage> for MaybePackageDescription {
                 post_target: describe_package_list(&deps.direct.post_target),
                 build_host: describe_package_list(&deps.direct.build_host),
                 install_host: describe_package_list(&deps.direct.install_host),
+                subslot_rebuild_target: describe_package_list(&deps.direct.subslot_rebuild_target),
                 install_set: describe_package_list(&deps.indirect.install_set),
                 build_host_set: describe_package_list(&deps.indirect.build_host_set),
                 reusable_host_set: describe_package_list(&deps.indirect.reusable_host_set),
@@ -945,6 +948,12 @@ fn test_analyze_dep_xpak_values() -> Result<()> {
                     "sys-apps/coreboot-utils-6".into(),
                     "sys-fs/e2fsprogs-1.50".into()
                 ],
+                subslot_rebuild_target: vec![
+                    "app-arch/libarchive-4".into(),
+                    "chromeos-base/crosid-2".into(),
+                    "dev-libs/libzip-5".into(),
+                    "sys-apps/coreboot-utils-6".into(),
+                ],
                 install_set: vec![
                     "app-arch/libarchive-4".into(),
                     "chromeos-base/crosid-2".into(),
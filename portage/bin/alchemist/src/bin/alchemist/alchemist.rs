@@ -10,28 +10,42 @@ use std::sync::Arc;
 
 use std::{env::current_dir, path::PathBuf};
 
+use crate::depdiff::depdiff_main;
 use crate::digest_repo::digest_repo_main;
 use crate::dump_package::dump_package_main;
 use crate::dump_profile::dump_profile_main;
-use crate::generate_repo::generate_repo_main;
+use crate::eclass_report::eclass_report_main;
+use crate::generate_md5_cache::generate_md5_cache_main;
+use crate::generate_repo::{
+    deps::{merge_deps_main, validate_deps_main},
+    generate_repo_main,
+};
+use crate::graph::graph_main;
+use crate::hacks_report::hacks_report_main;
+use crate::lookup_prebuilts::lookup_prebuilts_main;
+use crate::plan_subset::plan_subset_main;
+use crate::query::query_main;
+use crate::watch::watch_main;
 
 use alchemist::data::Vars;
 use alchemist::fakechroot;
 use alchemist::toolchain::ToolchainConfig;
 use alchemist::{
     config::{
-        bundle::ConfigBundle, profile::Profile, site::SiteSettings, ConfigNode, ConfigNodeValue,
-        ConfigSource, PackageMaskKind, PackageMaskUpdate, SimpleConfigSource, UseUpdate,
-        UseUpdateFilter, UseUpdateKind,
+        bundle::ConfigBundle, miscconf::mask::load_repository_package_configs, profile::Profile,
+        site::SiteSettings, ConfigNode, ConfigNodeValue, ConfigSource, PackageMaskKind,
+        PackageMaskUpdate, SimpleConfigSource, UseUpdate, UseUpdateFilter, UseUpdateKind,
     },
     ebuild::{metadata::CachedEBuildEvaluator, CachedPackageLoader, PackageLoader},
     fakechroot::{enter_fake_chroot, PathTranslator},
+    packages_index::BinaryPackageIndex,
     repository::RepositorySet,
     resolver::PackageResolver,
     toolchain::load_toolchains,
 };
 use anyhow::{bail, Context, Result};
 use clap::{ArgAction, Parser, Subcommand};
+use cliutil::{LoggingArgs, LoggingConfig};
 use tempfile::TempDir;
 
 /// Returns true when running inside ChromeOS SDK chroot.
@@ -147,12 +161,39 @@ pub struct Args {
     #[arg(short = 's', long, value_name = "DIR", global = true)]
     source_dir: Option<String>,
 
+    /// Number of threads used to analyze packages and generate files.
+    /// If unset, it defaults to the number of CPUs.
+    #[arg(short = 'j', long, value_name = "N", global = true)]
+    jobs: Option<usize>,
+
+    /// Directory to persist ebuild metadata evaluation results in. Later runs
+    /// reuse them for ebuilds whose contents and inherited eclasses are
+    /// unchanged, which makes analysis much faster.
+    #[arg(long, value_name = "DIR", global = true)]
+    metadata_cache_dir: Option<PathBuf>,
+
+    /// Resolves target packages against binary packages listed in
+    /// PKGDIR/Packages instead of ebuilds in overlays.
+    #[arg(long, value_name = "PKGDIR", global = true)]
+    binary_packages_dir: Option<PathBuf>,
+
+    // Read from the command line by LoggingConfig::from_env.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(subcommand)]
     command: Commands,
 }
 
 #[derive(Subcommand, Debug)]
 pub enum Commands {
+    /// Reports differences between two dependency graphs generated by
+    /// `graph --format=json`, e.g. to review changes in presubmit.
+    Depdiff {
+        #[command(flatten)]
+        args: crate::depdiff::Args,
+    },
     /// Dumps information of packages.
     DumpPackage {
         #[command(flatten)]
@@ -163,6 +204,18 @@ pub enum Commands {
         #[command(flatten)]
         args: crate::dump_profile::Args,
     },
+    /// Reports how eclasses and their functions and variables are used by
+    /// packages, to prioritize eclass compatibility work.
+    EclassReport {
+        #[command(flatten)]
+        args: crate::eclass_report::Args,
+    },
+    /// Writes Portage metadata cache (metadata/md5-cache) entries of ebuilds
+    /// for repositories lacking them.
+    GenerateMd5Cache {
+        #[command(flatten)]
+        args: crate::generate_md5_cache::Args,
+    },
     /// Generates a Bazel repository containing overlays and packages.
     GenerateRepo {
         /// Output directory path.
@@ -172,6 +225,92 @@ pub enum Commands {
         #[arg(long)]
         /// An output path for a json-encoded Vec<deps::Repository>.
         output_repos_json: PathBuf,
+
+        #[arg(long)]
+        /// An optional output path for json-encoded analysis statistics.
+        output_stats_json: Option<PathBuf>,
+
+        #[arg(long)]
+        /// An optional output path for analysis statistics in the Prometheus
+        /// text format.
+        output_stats_prometheus: Option<PathBuf>,
+
+        #[arg(long)]
+        /// An optional path to json-encoded analysis statistics of a previous
+        /// run. Changes from it are reported and recorded in the "delta" field
+        /// of --output-stats-json.
+        previous_stats_json: Option<PathBuf>,
+
+        #[arg(long)]
+        /// An optional output path for a json-encoded list of CROS_WORKON
+        /// projects that point to nonexistent paths in the workspace.
+        output_missing_sources_json: Option<PathBuf>,
+
+        #[arg(long)]
+        /// Fails if any CROS_WORKON project points to a nonexistent path in
+        /// the workspace, instead of just warning about it.
+        strict_src: bool,
+    },
+    /// Re-tests hard-coded extra dependency hacks against the current
+    /// overlays and reports which of them can be removed.
+    HacksReport {
+        #[command(flatten)]
+        args: crate::hacks_report::Args,
+    },
+    /// Prints the dependency graph of packages in Graphviz DOT or JSON.
+    Graph {
+        #[command(flatten)]
+        args: crate::graph::Args,
+    },
+    /// Looks up prebuilt binary packages on binhosts that can be used instead
+    /// of building packages locally.
+    LookupPrebuilts {
+        #[command(flatten)]
+        args: crate::lookup_prebuilts::Args,
+    },
+    /// Plans a build of the packages needed to deploy the given packages to
+    /// an existing sysroot, instead of building the whole image.
+    PlanSubset {
+        #[command(flatten)]
+        args: crate::plan_subset::Args,
+    },
+    /// Answers questions about the dependency graph of packages, e.g. why a
+    /// package is needed.
+    Query {
+        #[command(flatten)]
+        args: crate::query::Args,
+    },
+    /// Runs another subcommand, e.g. generate-repo, whenever files in
+    /// overlays change, to keep its outputs up to date while editing ebuilds.
+    Watch {
+        #[command(flatten)]
+        args: crate::watch::Args,
+    },
+    /// Merges deps files generated by generate-repo for multiple boards into
+    /// one, so that a single workspace can fetch sources for all of them.
+    MergeDeps {
+        /// Paths to the deps files to merge.
+        #[arg(value_name = "PATH", required = true)]
+        deps_files: Vec<PathBuf>,
+
+        /// Path to write the merged deps file to.
+        #[arg(long, value_name = "PATH")]
+        output: PathBuf,
+    },
+    /// Validates a deps file generated by generate-repo.
+    ValidateDeps {
+        /// Path to the deps file to validate.
+        #[arg(value_name = "PATH", required_unless_present = "print_schema")]
+        deps_file: Option<PathBuf>,
+
+        /// Rejects unknown repository types and fields in addition to type
+        /// mismatches.
+        #[arg(long)]
+        strict: bool,
+
+        /// Prints the JSON schema of deps files instead of validating one.
+        #[arg(long)]
+        print_schema: bool,
     },
     /// Generates a digest of the repository that can be used to indicate if
     /// any of the overlays, ebuilds, eclasses, etc have changed.
@@ -312,6 +451,7 @@ pub struct TargetData {
     pub profile: String,
     pub repos: Arc<RepositorySet>,
     pub config: Arc<ConfigBundle>,
+    pub evaluator: Arc<CachedEBuildEvaluator>,
     pub loader: Arc<CachedPackageLoader>,
     pub resolver: PackageResolver,
     pub toolchains: ToolchainConfig,
@@ -332,6 +472,7 @@ fn load_board(
 
     // Load configurations.
     let (config, profile_path) = {
+        let repository_source = SimpleConfigSource::new(load_repository_package_configs(&repos)?);
         let profile = Profile::load_default(root_dir, &repos)?;
         let site_settings = SiteSettings::load(root_dir)?;
         let override_source = build_override_config_source(root_dir, use_portage_site_configs)?;
@@ -340,6 +481,7 @@ fn load_board(
 
         let mut config_sources = vec![
             // The order matters.
+            Box::new(repository_source) as Box<dyn ConfigSource>,
             Box::new(profile) as Box<dyn ConfigSource>,
             Box::new(site_settings) as Box<dyn ConfigSource>,
             Box::new(override_source) as Box<dyn ConfigSource>,
@@ -381,6 +523,7 @@ fn load_board(
         profile: profile_name.to_string(),
         repos,
         config,
+        evaluator: Arc::clone(evaluator),
         loader,
         resolver,
         toolchains,
@@ -389,6 +532,30 @@ fn load_board(
 }
 
 pub fn alchemist_main(args: Args) -> Result<()> {
+    // generate-repo sets up logging by itself to save a trace in its output
+    // directory.
+    let mut logging = Some(LoggingConfig::from_env()?);
+    let _log_guard = match &args.command {
+        Commands::GenerateRepo { .. } => None,
+        _ => logging.take().map(LoggingConfig::setup).transpose()?,
+    };
+
+    // Handle subcommands that don't need to load Portage trees first.
+    if let Commands::ValidateDeps {
+        deps_file,
+        strict,
+        print_schema,
+    } = &args.command
+    {
+        return validate_deps_main(deps_file.as_deref(), *strict, *print_schema);
+    }
+    if let Commands::MergeDeps { deps_files, output } = &args.command {
+        return merge_deps_main(deps_files, output);
+    }
+    if let Commands::Depdiff { args: local_args } = &args.command {
+        return depdiff_main(local_args.clone());
+    }
+
     if args.board.is_none() && !args.host {
         bail!("Either --board or --host should be specified.")
     }
@@ -396,12 +563,27 @@ pub fn alchemist_main(args: Args) -> Result<()> {
         bail!("--board and --host shouldn't be specified together.");
     }
 
+    if let Some(jobs) = args.jobs {
+        if jobs == 0 {
+            bail!("--jobs must be positive");
+        }
+        rayon::ThreadPoolBuilder::new()
+            .num_threads(jobs)
+            .build_global()
+            .context("Failed to initialize the thread pool")?;
+    }
+
     let source_dir = match args.source_dir {
         Some(s) => PathBuf::from(s),
         None => default_source_dir()?,
     };
     let src_dir = source_dir.join("src");
 
+    // The watched subcommand enters a fake chroot by itself.
+    if let Commands::Watch { args: local_args } = &args.command {
+        return watch_main(&source_dir, local_args.clone());
+    }
+
     let host_target = fakechroot::BoardTarget {
         board: &args.host_board,
         profile: &args.host_profile,
@@ -493,7 +675,7 @@ pub fn alchemist_main(args: Args) -> Result<()> {
 
     // We share an evaluator between both config ROOTS so we only have to parse
     // the ebuilds once.
-    let evaluator = Arc::new(CachedEBuildEvaluator::new(
+    let mut evaluator = CachedEBuildEvaluator::new(
         [target_data.as_ref().map(|x| &x.1), Some(&host_data.1)]
             .into_iter()
             .flatten()
@@ -501,9 +683,13 @@ pub fn alchemist_main(args: Args) -> Result<()> {
             .cloned()
             .collect(),
         tools_dir.path(),
-    ));
+    );
+    if let Some(dir) = &args.metadata_cache_dir {
+        evaluator.set_disk_cache_dir(dir)?;
+    }
+    let evaluator = Arc::new(evaluator);
 
-    let target = if let Some((root_dir, repos, board_target)) = target_data {
+    let mut target = if let Some((root_dir, repos, board_target)) = target_data {
         Some(load_board(
             repos,
             &evaluator,
@@ -519,7 +705,7 @@ pub fn alchemist_main(args: Args) -> Result<()> {
     };
 
     #[allow(clippy::match_single_binding)]
-    let host = match host_data {
+    let mut host = match host_data {
         (root_dir, repos, host_target) => load_board(
             repos,
             &evaluator,
@@ -532,6 +718,12 @@ pub fn alchemist_main(args: Args) -> Result<()> {
         )?,
     };
 
+    if let Some(pkgdir) = &args.binary_packages_dir {
+        let index = Arc::new(BinaryPackageIndex::load(pkgdir)?);
+        let data = target.as_mut().unwrap_or(&mut host);
+        data.resolver = PackageResolver::new_binary(index, Arc::clone(&data.config));
+    }
+
     match args.command {
         Commands::DumpPackage { args: local_args } => {
             dump_package_main(&host, target.as_ref(), local_args)?;
@@ -539,22 +731,60 @@ pub fn alchemist_main(args: Args) -> Result<()> {
         Commands::DumpProfile { args: local_args } => {
             dump_profile_main(&target.unwrap_or(host), local_args)?;
         }
+        Commands::EclassReport { args: local_args } => {
+            eclass_report_main(&host, target.as_ref(), local_args)?;
+        }
+        Commands::GenerateMd5Cache { args: local_args } => {
+            generate_md5_cache_main(&host, target.as_ref(), local_args)?;
+        }
         Commands::GenerateRepo {
             output_dir,
             output_repos_json,
+            output_stats_json,
+            output_stats_prometheus,
+            previous_stats_json,
+            output_missing_sources_json,
+            strict_src,
         } => {
             generate_repo_main(
+                logging.context("Logging has been set up already")?,
                 &host,
                 target.as_ref(),
                 &translator,
                 &src_dir,
                 &output_dir,
                 &output_repos_json,
+                output_stats_json.as_deref(),
+                output_stats_prometheus.as_deref(),
+                previous_stats_json.as_deref(),
+                output_missing_sources_json.as_deref(),
+                strict_src,
             )?;
         }
         Commands::DigestRepo { args: local_args } => {
             digest_repo_main(&host, target.as_ref(), local_args)?;
         }
+        Commands::Graph { args: local_args } => {
+            graph_main(&host, target.as_ref(), local_args)?;
+        }
+        Commands::HacksReport { args: local_args } => {
+            hacks_report_main(&host, target.as_ref(), local_args)?;
+        }
+        Commands::LookupPrebuilts { args: local_args } => {
+            lookup_prebuilts_main(&host, target.as_ref(), local_args)?;
+        }
+        Commands::PlanSubset { args: local_args } => {
+            plan_subset_main(&host, target.as_ref(), local_args)?;
+        }
+        Commands::Query { args: local_args } => {
+            query_main(&host, target.as_ref(), local_args)?;
+        }
+        Commands::Depdiff { .. }
+        | Commands::MergeDeps { .. }
+        | Commands::ValidateDeps { .. }
+        | Commands::Watch { .. } => {
+            unreachable!("handled above")
+        }
     }
 
     Ok(())
@@ -0,0 +1,510 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    fmt::Write as _,
+    path::{Path, PathBuf},
+    str::FromStr,
+};
+
+use anyhow::{bail, Context, Result};
+use fileutil::glob_match;
+use serde::{Deserialize, Serialize};
+use version::Version;
+
+/// Output format of the diff.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, clap::ValueEnum)]
+pub enum Format {
+    /// Human-readable text.
+    Text,
+    /// JSON.
+    Json,
+}
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Output format.
+    #[arg(long, value_enum, default_value = "text")]
+    format: Format,
+
+    /// Fails if the diff contains a change matching the rule. Can be
+    /// specified multiple times. A rule is one of:
+    ///
+    /// "any": any change;
+    /// "added-package:PATTERN": a package matching PATTERN is added;
+    /// "removed-package:PATTERN": a package matching PATTERN is removed;
+    /// "added-dep:PATTERN": a package gains a dependency on a package matching
+    /// PATTERN.
+    ///
+    /// PATTERN is a package name that may contain shell wildcards, e.g.
+    /// "dev-java/*". It matches both target and host packages unless it starts
+    /// with "host:".
+    #[arg(long, value_name = "RULE")]
+    fail_on: Vec<Rule>,
+
+    /// Dependency graph generated by `alchemist graph --format=json` before
+    /// the change.
+    old: PathBuf,
+
+    /// Dependency graph generated by `alchemist graph --format=json` after
+    /// the change.
+    new: PathBuf,
+}
+
+/// A node in the JSON output of `alchemist graph`.
+#[derive(Deserialize)]
+struct JsonNode {
+    package: String,
+    dependencies: Vec<JsonDependency>,
+}
+
+#[derive(Deserialize)]
+struct JsonDependency {
+    package: String,
+    kind: String,
+}
+
+/// A dependency of a package, without the version of the dependency so that
+/// version bumps are not reported as dependency changes.
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+struct Dependency {
+    /// The package name, prefixed with "host:" for host packages.
+    package: String,
+    /// Portage's name of the dependency type, e.g. "RDEPEND".
+    kind: String,
+}
+
+/// A dependency graph snapshot keyed by package names, e.g. "sys-apps/attr"
+/// or "host:sys-apps/attr".
+#[derive(Debug, Default)]
+struct Snapshot {
+    /// Versions of each package with their repositories, e.g.
+    /// "2.5.1::portage-stable". A package can have multiple versions if it is
+    /// slotted.
+    versions: BTreeMap<String, BTreeSet<String>>,
+    dependencies: BTreeMap<String, BTreeSet<Dependency>>,
+}
+
+/// Splits a package ID in the graph, e.g.
+/// "host:sys-apps/attr-2.5.1::portage-stable", into the package name
+/// "host:sys-apps/attr" and the version "2.5.1::portage-stable".
+fn split_package_id(id: &str) -> Result<(String, String)> {
+    let (prefix, rest) = match id.strip_prefix("host:") {
+        Some(rest) => ("host:", rest),
+        None => ("", id),
+    };
+    let (cpv, repo) = rest
+        .rsplit_once("::")
+        .with_context(|| format!("Missing repository name in {id:?}"))?;
+    let (package_name, version) =
+        Version::from_str_suffix(cpv).with_context(|| format!("Invalid package {id:?}"))?;
+    Ok((
+        format!("{prefix}{package_name}"),
+        format!("{version}::{repo}"),
+    ))
+}
+
+impl Snapshot {
+    fn parse(contents: &str) -> Result<Self> {
+        let nodes: Vec<JsonNode> = serde_json::from_str(contents)?;
+        let mut snapshot = Self::default();
+        for node in nodes {
+            let (name, version) = split_package_id(&node.package)?;
+            snapshot
+                .versions
+                .entry(name.clone())
+                .or_default()
+                .insert(version);
+            let deps = snapshot.dependencies.entry(name).or_default();
+            for dep in node.dependencies {
+                let (package, _) = split_package_id(&dep.package)?;
+                deps.insert(Dependency {
+                    package,
+                    kind: dep.kind,
+                });
+            }
+        }
+        Ok(snapshot)
+    }
+
+    fn load(path: &Path) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse(&contents).with_context(|| format!("Failed to parse {}", path.display()))
+    }
+}
+
+#[derive(Debug, PartialEq, Eq, Serialize)]
+struct VersionChange {
+    old: BTreeSet<String>,
+    new: BTreeSet<String>,
+}
+
+/// Differences between two dependency graph snapshots.
+#[derive(Debug, Default, PartialEq, Eq, Serialize)]
+struct Diff {
+    added_packages: BTreeMap<String, BTreeSet<String>>,
+    removed_packages: BTreeMap<String, BTreeSet<String>>,
+    version_changes: BTreeMap<String, VersionChange>,
+    /// Dependencies gained by each package. Dependencies of added packages
+    /// are included.
+    added_dependencies: BTreeMap<String, BTreeSet<Dependency>>,
+    /// Dependencies lost by each package. Dependencies of removed packages
+    /// are not included.
+    removed_dependencies: BTreeMap<String, BTreeSet<Dependency>>,
+}
+
+impl Diff {
+    fn compute(old: &Snapshot, new: &Snapshot) -> Self {
+        let mut diff = Self::default();
+
+        for (name, old_versions) in &old.versions {
+            match new.versions.get(name) {
+                None => {
+                    diff.removed_packages
+                        .insert(name.clone(), old_versions.clone());
+                }
+                Some(new_versions) if new_versions != old_versions => {
+                    diff.version_changes.insert(
+                        name.clone(),
+                        VersionChange {
+                            old: old_versions.clone(),
+                            new: new_versions.clone(),
+                        },
+                    );
+                }
+                Some(_) => {}
+            }
+        }
+        for (name, new_versions) in &new.versions {
+            if !old.versions.contains_key(name) {
+                diff.added_packages
+                    .insert(name.clone(), new_versions.clone());
+            }
+        }
+
+        let empty = BTreeSet::new();
+        for (name, new_deps) in &new.dependencies {
+            let old_deps = old.dependencies.get(name).unwrap_or(&empty);
+            let added: BTreeSet<Dependency> = new_deps.difference(old_deps).cloned().collect();
+            if !added.is_empty() {
+                diff.added_dependencies.insert(name.clone(), added);
+            }
+        }
+        for (name, old_deps) in &old.dependencies {
+            let Some(new_deps) = new.dependencies.get(name) else {
+                continue;
+            };
+            let removed: BTreeSet<Dependency> = old_deps.difference(new_deps).cloned().collect();
+            if !removed.is_empty() {
+                diff.removed_dependencies.insert(name.clone(), removed);
+            }
+        }
+
+        diff
+    }
+
+    fn is_empty(&self) -> bool {
+        self == &Self::default()
+    }
+
+    fn render_text(&self) -> String {
+        if self.is_empty() {
+            return "No changes\n".to_owned();
+        }
+
+        let mut out = String::new();
+        for (title, packages, sign) in [
+            ("Added packages", &self.added_packages, '+'),
+            ("Removed packages", &self.removed_packages, '-'),
+        ] {
+            if packages.is_empty() {
+                continue;
+            }
+            writeln!(out, "{title}:").unwrap();
+            for (name, versions) in packages {
+                for version in versions {
+                    writeln!(out, "  {sign} {name}-{version}").unwrap();
+                }
+            }
+        }
+
+        if !self.version_changes.is_empty() {
+            writeln!(out, "Version changes:").unwrap();
+            for (name, change) in &self.version_changes {
+                let join = |versions: &BTreeSet<String>| {
+                    versions.iter().cloned().collect::<Vec<_>>().join(", ")
+                };
+                writeln!(
+                    out,
+                    "  {name}: {} -> {}",
+                    join(&change.old),
+                    join(&change.new)
+                )
+                .unwrap();
+            }
+        }
+
+        let names: BTreeSet<&String> = self
+            .added_dependencies
+            .keys()
+            .chain(self.removed_dependencies.keys())
+            .collect();
+        if !names.is_empty() {
+            writeln!(out, "Dependency changes:").unwrap();
+            for name in names {
+                writeln!(out, "  {name}:").unwrap();
+                for (deps, sign) in [
+                    (self.added_dependencies.get(name), '+'),
+                    (self.removed_dependencies.get(name), '-'),
+                ] {
+                    for dep in deps.into_iter().flatten() {
+                        writeln!(out, "    {sign} {} {}", dep.kind, dep.package).unwrap();
+                    }
+                }
+            }
+        }
+        out
+    }
+}
+
+/// A glob pattern of package names.
+#[derive(Clone, Debug)]
+struct Pattern {
+    raw: String,
+}
+
+impl Pattern {
+    fn matches(&self, name: &str) -> bool {
+        let name = if self.raw.starts_with("host:") {
+            name
+        } else {
+            name.strip_prefix("host:").unwrap_or(name)
+        };
+        glob_match(self.raw.as_bytes(), name.as_bytes())
+    }
+}
+
+impl FromStr for Pattern {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        if s.is_empty() {
+            bail!("Empty package pattern");
+        }
+        Ok(Self { raw: s.to_owned() })
+    }
+}
+
+/// A policy given by `--fail-on`.
+#[derive(Clone, Debug)]
+enum Rule {
+    Any,
+    AddedPackage(Pattern),
+    RemovedPackage(Pattern),
+    AddedDependency(Pattern),
+}
+
+impl FromStr for Rule {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        if s == "any" {
+            return Ok(Self::Any);
+        }
+        let Some((kind, pattern)) = s.split_once(':') else {
+            bail!("Invalid rule {s:?}: expected \"any\" or KIND:PATTERN");
+        };
+        let pattern = pattern.parse()?;
+        Ok(match kind {
+            "added-package" => Self::AddedPackage(pattern),
+            "removed-package" => Self::RemovedPackage(pattern),
+            "added-dep" => Self::AddedDependency(pattern),
+            _ => bail!("Invalid rule {s:?}: unknown kind {kind:?}"),
+        })
+    }
+}
+
+impl Rule {
+    /// Returns descriptions of changes in `diff` violating the rule.
+    fn check(&self, diff: &Diff) -> Vec<String> {
+        match self {
+            Self::Any => {
+                if diff.is_empty() {
+                    vec![]
+                } else {
+                    vec!["The dependency graph changed".to_owned()]
+                }
+            }
+            Self::AddedPackage(pattern) => diff
+                .added_packages
+                .keys()
+                .filter(|name| pattern.matches(name))
+                .map(|name| format!("{name} was added"))
+                .collect(),
+            Self::RemovedPackage(pattern) => diff
+                .removed_packages
+                .keys()
+                .filter(|name| pattern.matches(name))
+                .map(|name| format!("{name} was removed"))
+                .collect(),
+            Self::AddedDependency(pattern) => diff
+                .added_dependencies
+                .iter()
+                .flat_map(|(name, deps)| {
+                    deps.iter()
+                        .filter(|dep| pattern.matches(&dep.package))
+                        .map(move |dep| format!("{name} gained {} on {}", dep.kind, dep.package))
+                })
+                .collect(),
+        }
+    }
+}
+
+/// The entry point of "depdiff" subcommand.
+pub fn depdiff_main(args: Args) -> Result<()> {
+    let old = Snapshot::load(&args.old)?;
+    let new = Snapshot::load(&args.new)?;
+    let diff = Diff::compute(&old, &new);
+
+    match args.format {
+        Format::Text => print!("{}", diff.render_text()),
+        Format::Json => println!("{}", serde_json::to_string_pretty(&diff)?),
+    }
+
+    let violations: Vec<String> = args
+        .fail_on
+        .iter()
+        .flat_map(|rule| rule.check(&diff))
+        .collect();
+    if !violations.is_empty() {
+        for violation in &violations {
+            eprintln!("{violation}");
+        }
+        bail!("{} change(s) violate --fail-on rules", violations.len());
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn snapshot(value: serde_json::Value) -> Result<Snapshot> {
+        Snapshot::parse(&value.to_string())
+    }
+
+    fn sample_diff() -> Result<Diff> {
+        let old = snapshot(json!([
+            {
+                "package": "virtual/target-os-1::chromiumos",
+                "dependencies": [
+                    {"package": "sys-apps/attr-2.5.1::portage-stable", "kind": "RDEPEND"},
+                    {"package": "dev-libs/old-1.0::portage-stable", "kind": "RDEPEND"},
+                ],
+            },
+            {
+                "package": "sys-apps/attr-2.5.1::portage-stable",
+                "dependencies": [
+                    {"package": "host:sys-devel/gcc-10.2.0::portage-stable", "kind": "BDEPEND"},
+                ],
+            },
+            {"package": "dev-libs/old-1.0::portage-stable", "dependencies": []},
+            {"package": "host:sys-devel/gcc-10.2.0::portage-stable", "dependencies": []},
+        ]))?;
+        let new = snapshot(json!([
+            {
+                "package": "virtual/target-os-1::chromiumos",
+                "dependencies": [
+                    {"package": "sys-apps/attr-2.5.2-r1::portage-stable", "kind": "RDEPEND"},
+                ],
+            },
+            {
+                "package": "sys-apps/attr-2.5.2-r1::portage-stable",
+                "dependencies": [
+                    {"package": "host:sys-devel/gcc-10.2.0::portage-stable", "kind": "BDEPEND"},
+                    {"package": "dev-java/openjdk-17::portage-stable", "kind": "RDEPEND"},
+                ],
+            },
+            {"package": "dev-java/openjdk-17::portage-stable", "dependencies": []},
+            {"package": "host:sys-devel/gcc-10.2.0::portage-stable", "dependencies": []},
+        ]))?;
+        Ok(Diff::compute(&old, &new))
+    }
+
+    #[test]
+    fn test_split_package_id() -> Result<()> {
+        assert_eq!(
+            split_package_id("host:sys-apps/attr-2.5.1-r1::portage-stable")?,
+            (
+                "host:sys-apps/attr".to_owned(),
+                "2.5.1-r1::portage-stable".to_owned()
+            )
+        );
+        assert!(split_package_id("sys-apps/attr-2.5.1").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_render_text() -> Result<()> {
+        assert_eq!(
+            sample_diff()?.render_text(),
+            "Added packages:
+  + dev-java/openjdk-17::portage-stable
+Removed packages:
+  - dev-libs/old-1.0::portage-stable
+Version changes:
+  sys-apps/attr: 2.5.1::portage-stable -> 2.5.2-r1::portage-stable
+Dependency changes:
+  sys-apps/attr:
+    + RDEPEND dev-java/openjdk
+  virtual/target-os:
+    - RDEPEND dev-libs/old
+"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_no_changes() -> Result<()> {
+        let old = snapshot(json!([{
+            "package": "sys-apps/attr-2.5.1::portage-stable",
+            "dependencies": [],
+        }]))?;
+        let diff = Diff::compute(&old, &old);
+        assert!(diff.is_empty());
+        assert_eq!(diff.render_text(), "No changes\n");
+        assert!(Rule::Any.check(&diff).is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn test_rules() -> Result<()> {
+        let diff = sample_diff()?;
+        let check = |rule: &str| -> Result<Vec<String>> { Ok(rule.parse::<Rule>()?.check(&diff)) };
+
+        assert_eq!(
+            check("added-dep:dev-java/*")?,
+            vec!["sys-apps/attr gained RDEPEND on dev-java/openjdk"]
+        );
+        assert!(check("added-dep:host:dev-java/*")?.is_empty());
+        assert_eq!(
+            check("added-package:dev-java/openjdk")?,
+            vec!["dev-java/openjdk was added"]
+        );
+        assert_eq!(
+            check("removed-package:dev-libs/*")?,
+            vec!["dev-libs/old was removed"]
+        );
+        assert!(check("removed-package:sys-devel/*")?.is_empty());
+        assert_eq!(check("any")?.len(), 1);
+
+        assert!("added-dep".parse::<Rule>().is_err());
+        assert!("removed-dep:foo/*".parse::<Rule>().is_err());
+        assert!("added-dep:".parse::<Rule>().is_err());
+        Ok(())
+    }
+}
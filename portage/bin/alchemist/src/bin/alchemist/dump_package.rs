@@ -20,6 +20,11 @@ pub struct Args {
     #[arg(short = 'e', long)]
     env: bool,
 
+    /// Additionally dump a raw metadata value of the package, e.g. HOMEPAGE.
+    /// Can be specified multiple times.
+    #[arg(long, value_name = "KEY")]
+    metadata: Vec<String>,
+
     /// Package names.
     packages: Vec<String>,
 }
@@ -44,6 +49,7 @@ pub fn dump_package_main(host: &TargetData, target: Option<&TargetData>, args: A
         .collect::<Result<Vec<_>>>()?;
 
     let resolver = &target.unwrap_or(host).resolver;
+    let evaluator = &target.unwrap_or(host).evaluator;
 
     let cross_compile = if let Some(target) = target {
         let cbuild = host
@@ -154,6 +160,17 @@ pub fn dump_package_main(host: &TargetData, target: Option<&TargetData>, args: A
                     );
                 }
             }
+
+            if !args.metadata.is_empty() {
+                println!("Metadata:");
+                let ebuild_path = &details.as_basic_data().ebuild_path;
+                for key in &args.metadata {
+                    match evaluator.get_metadata_value(ebuild_path, key)? {
+                        Some(value) => println!("  {key}: {value}"),
+                        None => println!("  {key}: (unset)"),
+                    }
+                }
+            }
         }
     }
     Ok(())
@@ -9,6 +9,11 @@ use crate::alchemist::TargetData;
 
 #[derive(clap::Args, Clone, Debug)]
 pub struct Args {
+    /// Additionally prints the values assigned to each variable by
+    /// configuration files, in the order they're evaluated.
+    #[arg(long)]
+    provenance: bool,
+
     /// Environment variables to dump.
     vars: Option<Vec<String>>,
 }
@@ -29,6 +34,24 @@ pub fn dump_profile_main(target: &TargetData, args: Args) -> Result<()> {
             map.get(key)
                 .with_context(|| format!("Failed to find key: {key}"))?
         );
+
+        if args.provenance {
+            if target.config.is_incremental_variable(key) {
+                println!("  # Incremental; values below are merged in order");
+            }
+            for contribution in target.config.var_contributions(key) {
+                println!(
+                    "  {}: {}=\"{}\"",
+                    contribution
+                        .sources
+                        .iter()
+                        .map(|path| path.display())
+                        .join(", "),
+                    key,
+                    contribution.value
+                );
+            }
+        }
     }
     Ok(())
 }
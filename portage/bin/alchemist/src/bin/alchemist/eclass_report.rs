@@ -0,0 +1,433 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{BTreeMap, BTreeSet, HashMap, HashSet},
+    fmt::Write as _,
+    path::{Path, PathBuf},
+};
+
+use alchemist::ebuild::{MaybePackageDetails, PackageDetails};
+use anyhow::{Context, Result};
+use lazy_static::lazy_static;
+use regex::Regex;
+use serde_json::json;
+
+use crate::alchemist::TargetData;
+
+/// Output format of the report.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, clap::ValueEnum)]
+pub enum Format {
+    /// Human-readable text.
+    Text,
+    /// JSON.
+    Json,
+}
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Output format.
+    #[arg(long, value_enum, default_value = "text")]
+    format: Format,
+
+    /// Name of an eclass known to work under Bazel, e.g. "cros-workon". Can be
+    /// specified multiple times.
+    #[arg(long = "validated-eclass", value_name = "NAME")]
+    validated_eclasses: Vec<String>,
+
+    /// Path to a file listing eclasses known to work under Bazel, one per
+    /// line. Empty lines and lines starting with "#" are ignored.
+    #[arg(long, value_name = "PATH")]
+    validated_eclasses_file: Option<PathBuf>,
+
+    /// Output path. If unset, the report is printed to stdout.
+    #[arg(long, value_name = "PATH")]
+    output: Option<PathBuf>,
+}
+
+/// Functions and variables an eclass provides to ebuilds.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+struct EclassFeatures {
+    functions: BTreeSet<String>,
+    variables: BTreeSet<String>,
+}
+
+/// Extracts public functions and documented variables from the contents of an
+/// eclass.
+///
+/// Functions whose names start with an underscore are considered internal and
+/// skipped. Variables are taken from `@ECLASS_VARIABLE` doc tags, excluding
+/// ones tagged `@INTERNAL`.
+fn parse_eclass_features(contents: &str) -> EclassFeatures {
+    lazy_static! {
+        static ref FUNCTION_RE: Regex = Regex::new(
+            r"^(?:function\s+([A-Za-z][A-Za-z0-9_+-]*)|([A-Za-z][A-Za-z0-9_+-]*)\s*\(\))"
+        )
+        .unwrap();
+        static ref VARIABLE_RE: Regex =
+            Regex::new(r"^#\s*@ECLASS[_-]VARIABLE:\s*([A-Za-z_][A-Za-z0-9_]*)").unwrap();
+    }
+
+    let mut features = EclassFeatures::default();
+    let mut pending_variable: Option<String> = None;
+    for line in contents.lines() {
+        if let Some(caps) = VARIABLE_RE.captures(line) {
+            pending_variable = Some(caps[1].to_string());
+            continue;
+        }
+        if let Some(variable) = pending_variable.take() {
+            // A doc comment block continues until the first non-comment line.
+            if line.starts_with('#') {
+                if line.trim_start_matches('#').trim() != "@INTERNAL" {
+                    pending_variable = Some(variable);
+                }
+                continue;
+            }
+            features.variables.insert(variable);
+        }
+        if let Some(caps) = FUNCTION_RE.captures(line) {
+            let name = caps.get(1).or_else(|| caps.get(2)).unwrap();
+            features.functions.insert(name.as_str().to_string());
+        }
+    }
+    if let Some(variable) = pending_variable {
+        features.variables.insert(variable);
+    }
+    features
+}
+
+/// Splits the contents of an ebuild into shell words that may refer to
+/// functions or variables.
+fn tokenize(contents: &str) -> HashSet<&str> {
+    contents
+        .lines()
+        .map(|line| line.split_once('#').map_or(line, |(code, _)| code))
+        .flat_map(|code| {
+            code.split(|c: char| !(c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '+')))
+        })
+        .filter(|token| !token.is_empty())
+        .collect()
+}
+
+/// Usage of an eclass across packages.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+struct EclassUsage {
+    /// Packages inheriting the eclass, directly or indirectly.
+    packages: BTreeSet<String>,
+    /// Number of packages referencing each function or variable of the eclass
+    /// in their ebuilds. Features never referenced are included with zero.
+    features: BTreeMap<String, usize>,
+}
+
+/// Aggregated eclass usage of a set of packages.
+#[derive(Debug, Default)]
+struct Report {
+    eclasses: BTreeMap<String, EclassUsage>,
+    /// Packages inheriting eclasses not validated under Bazel, mapped to those
+    /// eclasses. Empty if no validated eclass was given.
+    unvalidated: BTreeMap<String, BTreeSet<String>>,
+}
+
+/// Returns the eclass name of an eclass path, e.g. "cros-workon" for
+/// ".../eclass/cros-workon.eclass".
+fn eclass_name(path: &Path) -> Option<String> {
+    Some(path.file_stem()?.to_string_lossy().into_owned())
+}
+
+fn package_name(details: &PackageDetails) -> String {
+    let basic_data = details.as_basic_data();
+    format!(
+        "{}-{}::{}",
+        basic_data.package_name, basic_data.version, basic_data.repo_name
+    )
+}
+
+fn build_report(packages: &[&PackageDetails], validated: &HashSet<String>) -> Result<Report> {
+    let mut features_cache: HashMap<PathBuf, EclassFeatures> = HashMap::new();
+    let mut report = Report::default();
+
+    for details in packages {
+        let name = package_name(details);
+        let ebuild_path = &details.as_basic_data().ebuild_path;
+        let ebuild = std::fs::read_to_string(ebuild_path)
+            .with_context(|| format!("Failed to read {}", ebuild_path.display()))?;
+        let tokens = tokenize(&ebuild);
+
+        for path in &details.inherit_paths {
+            let Some(eclass) = eclass_name(path) else {
+                continue;
+            };
+            if !features_cache.contains_key(path) {
+                let contents = std::fs::read_to_string(path)
+                    .with_context(|| format!("Failed to read {}", path.display()))?;
+                features_cache.insert(path.clone(), parse_eclass_features(&contents));
+            }
+            let features = &features_cache[path];
+
+            let usage = report.eclasses.entry(eclass.clone()).or_default();
+            usage.packages.insert(name.clone());
+            for feature in features.functions.iter().chain(features.variables.iter()) {
+                let count = usage.features.entry(feature.clone()).or_default();
+                if tokens.contains(feature.as_str()) {
+                    *count += 1;
+                }
+            }
+
+            if !validated.is_empty() && !validated.contains(&eclass) {
+                report
+                    .unvalidated
+                    .entry(name.clone())
+                    .or_default()
+                    .insert(eclass);
+            }
+        }
+    }
+
+    Ok(report)
+}
+
+fn render_text(report: &Report, validated: &HashSet<String>) -> String {
+    let mut out = String::new();
+
+    let mut eclasses: Vec<_> = report.eclasses.iter().collect();
+    eclasses.sort_by(|(a_name, a), (b_name, b)| {
+        b.packages
+            .len()
+            .cmp(&a.packages.len())
+            .then_with(|| a_name.cmp(b_name))
+    });
+
+    writeln!(out, "Eclasses by number of inheriting packages:").unwrap();
+    for (name, usage) in &eclasses {
+        let mark = if !validated.is_empty() && !validated.contains(*name) {
+            " (unvalidated)"
+        } else {
+            ""
+        };
+        writeln!(out, "  {:6} {}{}", usage.packages.len(), name, mark).unwrap();
+    }
+
+    writeln!(out).unwrap();
+    writeln!(out, "Referenced eclass features:").unwrap();
+    for (name, usage) in &eclasses {
+        let mut features: Vec<_> = usage
+            .features
+            .iter()
+            .filter(|(_, count)| **count > 0)
+            .collect();
+        if features.is_empty() {
+            continue;
+        }
+        features.sort_by(|(a_name, a), (b_name, b)| b.cmp(a).then_with(|| a_name.cmp(b_name)));
+        writeln!(out, "  {name}:").unwrap();
+        for (feature, count) in features {
+            writeln!(out, "    {count:6} {feature}").unwrap();
+        }
+    }
+
+    if !validated.is_empty() {
+        writeln!(out).unwrap();
+        writeln!(
+            out,
+            "Packages using unvalidated eclasses ({}):",
+            report.unvalidated.len()
+        )
+        .unwrap();
+        for (package, eclasses) in &report.unvalidated {
+            let eclasses: Vec<&str> = eclasses.iter().map(|s| s.as_str()).collect();
+            writeln!(out, "  {}: {}", package, eclasses.join(" ")).unwrap();
+        }
+    }
+
+    out
+}
+
+fn render_json(report: &Report, validated: &HashSet<String>) -> Result<String> {
+    let eclasses = report
+        .eclasses
+        .iter()
+        .map(|(name, usage)| {
+            json!({
+                "eclass": name,
+                "validated": validated.contains(name),
+                "packages": usage.packages,
+                "features": usage.features,
+            })
+        })
+        .collect::<Vec<_>>();
+    Ok(serde_json::to_string_pretty(&json!({
+        "eclasses": eclasses,
+        "unvalidated_packages": report.unvalidated,
+    }))?)
+}
+
+fn load_validated_eclasses(args: &Args) -> Result<HashSet<String>> {
+    let mut validated: HashSet<String> = args.validated_eclasses.iter().cloned().collect();
+    if let Some(path) = &args.validated_eclasses_file {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        validated.extend(
+            contents
+                .lines()
+                .map(|line| line.trim())
+                .filter(|line| !line.is_empty() && !line.starts_with('#'))
+                .map(|line| line.to_string()),
+        );
+    }
+    Ok(validated)
+}
+
+/// The entry point of "eclass-report" subcommand.
+pub fn eclass_report_main(
+    host: &TargetData,
+    target: Option<&TargetData>,
+    args: Args,
+) -> Result<()> {
+    let validated = load_validated_eclasses(&args)?;
+
+    let data = target.unwrap_or(host);
+    let packages = data.resolver.find_all_packages()?;
+    let packages: Vec<&PackageDetails> = packages
+        .iter()
+        .filter_map(|package| match package {
+            MaybePackageDetails::Ok(details) => Some(details.as_ref()),
+            MaybePackageDetails::Err(_) => None,
+        })
+        .collect();
+
+    let report = build_report(&packages, &validated)?;
+    eprintln!(
+        "Found {} eclasses inherited by {} packages",
+        report.eclasses.len(),
+        packages.len()
+    );
+
+    let contents = match args.format {
+        Format::Text => render_text(&report, &validated),
+        Format::Json => render_json(&report, &validated)?,
+    };
+    match &args.output {
+        Some(path) => std::fs::write(path, contents)
+            .with_context(|| format!("Failed to write {}", path.display()))?,
+        None => print!("{contents}"),
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_eclass_features() {
+        let features = parse_eclass_features(
+            r#"# @ECLASS: foo.eclass
+# @ECLASS_VARIABLE: FOO_SRC
+# @DESCRIPTION:
+# Source directory.
+: "${FOO_SRC:=src}"
+
+# @ECLASS-VARIABLE: FOO_LEGACY
+: "${FOO_LEGACY:=}"
+
+# @ECLASS_VARIABLE: _FOO_STATE
+# @INTERNAL
+_FOO_STATE=
+
+foo_src_compile() {
+	_foo_helper
+}
+
+function foo-run {
+	:
+}
+
+function foo-install() {
+	:
+}
+
+_foo_helper() {
+	:
+}
+
+EXPORT_FUNCTIONS src_compile
+"#,
+        );
+        assert_eq!(
+            features,
+            EclassFeatures {
+                functions: BTreeSet::from([
+                    "foo-install".to_string(),
+                    "foo-run".to_string(),
+                    "foo_src_compile".to_string(),
+                ]),
+                variables: BTreeSet::from(["FOO_LEGACY".to_string(), "FOO_SRC".to_string()]),
+            }
+        );
+    }
+
+    #[test]
+    fn test_tokenize() {
+        let tokens = tokenize(
+            "inherit foo\n\
+             FOO_SRC=\"${S}/lib\" # FOO_LEGACY is not used\n\
+             src_compile() { foo-install \"${FOO_SRC}\"; }\n",
+        );
+        for token in [
+            "inherit",
+            "foo",
+            "FOO_SRC",
+            "S",
+            "src_compile",
+            "foo-install",
+        ] {
+            assert!(tokens.contains(token), "{token} should be found");
+        }
+        assert!(!tokens.contains("FOO_LEGACY"));
+    }
+
+    #[test]
+    fn test_render_text() {
+        let report = Report {
+            eclasses: BTreeMap::from([
+                (
+                    "foo".to_string(),
+                    EclassUsage {
+                        packages: BTreeSet::from(["a/b-1::x".to_string(), "a/c-1::x".to_string()]),
+                        features: BTreeMap::from([
+                            ("FOO_SRC".to_string(), 1),
+                            ("foo_src_compile".to_string(), 0),
+                        ]),
+                    },
+                ),
+                (
+                    "bar".to_string(),
+                    EclassUsage {
+                        packages: BTreeSet::from(["a/c-1::x".to_string()]),
+                        features: BTreeMap::new(),
+                    },
+                ),
+            ]),
+            unvalidated: BTreeMap::from([(
+                "a/c-1::x".to_string(),
+                BTreeSet::from(["bar".to_string()]),
+            )]),
+        };
+        let validated = HashSet::from(["foo".to_string()]);
+        assert_eq!(
+            render_text(&report, &validated),
+            "Eclasses by number of inheriting packages:
+       2 foo
+       1 bar (unvalidated)
+
+Referenced eclass features:
+  foo:
+         1 FOO_SRC
+
+Packages using unvalidated eclasses (1):
+  a/c-1::x: bar
+"
+        );
+    }
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use alchemist::{
+    ebuild::{
+        md5_cache::{load_md5_cache_entry, md5_cache_path, Md5CacheEntry},
+        metadata::{CachedEBuildEvaluator, MaybeEBuildMetadata},
+    },
+    repository::Repository,
+};
+use anyhow::{bail, Context, Result};
+use fileutil::{atomic_write, SyncMode};
+use itertools::Itertools;
+use rayon::prelude::*;
+
+use crate::alchemist::TargetData;
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Name of a repository to generate the metadata cache for. Can be
+    /// specified multiple times. If unset, repositories without
+    /// metadata/md5-cache are processed.
+    #[arg(long = "repo", value_name = "NAME")]
+    repos: Vec<String>,
+}
+
+/// Writes md5-cache entries of ebuilds in a repository that are missing or
+/// stale, and returns the number of entries written.
+fn generate_md5_cache(evaluator: &CachedEBuildEvaluator, repo: &Repository) -> Result<usize> {
+    let eclass_dirs = repo.eclass_dirs().collect_vec();
+    let written = repo
+        .find_all_ebuilds()?
+        .par_iter()
+        .map(|ebuild_path| -> Result<bool> {
+            if load_md5_cache_entry(repo, ebuild_path).is_some() {
+                return Ok(false);
+            }
+            let metadata = match evaluator.evaluate_metadata(ebuild_path)? {
+                MaybeEBuildMetadata::Ok(metadata) => metadata,
+                MaybeEBuildMetadata::Err(error) => {
+                    eprintln!(
+                        "WARNING: Skipping {}: {}",
+                        ebuild_path.display(),
+                        error.error
+                    );
+                    return Ok(false);
+                }
+            };
+            let entry = Md5CacheEntry::from_metadata(&metadata, &eclass_dirs)
+                .with_context(|| format!("Failed to compute md5-cache of {ebuild_path:?}"))?;
+            let path = md5_cache_path(repo, ebuild_path)?;
+            std::fs::create_dir_all(path.parent().unwrap())?;
+            // Write entries atomically since Portage may read them concurrently.
+            atomic_write(&path, entry.to_string(), SyncMode::NoSync)?;
+            Ok(true)
+        })
+        .collect::<Result<Vec<_>>>()?
+        .into_iter()
+        .filter(|written| *written)
+        .count();
+    Ok(written)
+}
+
+/// The entry point of "generate-md5-cache" subcommand.
+pub fn generate_md5_cache_main(
+    host: &TargetData,
+    target: Option<&TargetData>,
+    args: Args,
+) -> Result<()> {
+    let target = target.unwrap_or(host);
+    let all_repos = target.repos.get_repos();
+
+    for name in &args.repos {
+        if !all_repos.iter().any(|repo| repo.name() == name) {
+            bail!("Unknown repository: {name}");
+        }
+    }
+
+    let repos = all_repos.into_iter().filter(|repo| {
+        if args.repos.is_empty() {
+            !repo.base_dir().join("metadata/md5-cache").exists()
+        } else {
+            args.repos.iter().any(|name| name == repo.name())
+        }
+    });
+    for repo in repos {
+        let written = generate_md5_cache(&target.evaluator, repo)?;
+        eprintln!("{}: wrote {} md5-cache entries", repo.name(), written);
+    }
+    Ok(())
+}
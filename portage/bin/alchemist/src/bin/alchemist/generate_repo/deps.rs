@@ -2,19 +2,24 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use std::{fs::File, path::Path};
+use std::path::{Path, PathBuf};
 
 use alchemist::analyze::source::{ChromeType, PackageLocalSource, PackageSources};
-use anyhow::Result;
+use anyhow::{bail, ensure, Context, Result};
+use fileutil::{atomic_write_with, SyncMode};
 use itertools::Itertools;
-use serde::Serialize;
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
 use tracing::instrument;
 
 use super::common::DistFileEntry;
 
 // Each entry here corresponds to a repository rule, and the fields in the
 // struct must correspond to the parameters to that repository rule.
-#[derive(Serialize, Debug)]
+//
+// When you update this enum, update REPOSITORY_FIELDS and deps.schema.json
+// too. Unit tests ensure they are in sync.
+#[derive(Serialize, Deserialize, Debug, PartialEq, Eq)]
 enum Repository {
     CipdFile {
         name: String,
@@ -46,11 +51,262 @@ enum Repository {
     },
 }
 
+impl Repository {
+    fn name(&self) -> &str {
+        match self {
+            Repository::CipdFile { name, .. }
+            | Repository::GsFile { name, .. }
+            | Repository::HttpFile { name, .. }
+            | Repository::RepoRepository { name, .. }
+            | Repository::CrosChromeRepository { name, .. } => name,
+        }
+    }
+}
+
+/// Types of values of [`Repository`] fields.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum FieldType {
+    String,
+    Bool,
+    StringArray,
+}
+
+impl FieldType {
+    fn schema(self) -> Value {
+        match self {
+            FieldType::String => json!({"type": "string"}),
+            FieldType::Bool => json!({"type": "boolean"}),
+            FieldType::StringArray => json!({"type": "array", "items": {"type": "string"}}),
+        }
+    }
+
+    /// Checks that `value` has this type. `path` is used in error messages.
+    fn check(self, value: &Value, path: &str) -> Result<()> {
+        match self {
+            FieldType::String => ensure!(value.is_string(), "{path}: expected a string"),
+            FieldType::Bool => ensure!(value.is_boolean(), "{path}: expected a boolean"),
+            FieldType::StringArray => {
+                let items = value
+                    .as_array()
+                    .with_context(|| format!("{path}: expected an array"))?;
+                for (i, item) in items.iter().enumerate() {
+                    FieldType::String.check(item, &format!("{path}[{i}]"))?;
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Describes the fields of each [`Repository`] variant. This is the source of
+/// truth of the JSON schema of deps files.
+const REPOSITORY_FIELDS: &[(&str, &[(&str, FieldType)])] = &[
+    (
+        "CipdFile",
+        &[
+            ("name", FieldType::String),
+            ("downloaded_file_path", FieldType::String),
+            ("url", FieldType::String),
+        ],
+    ),
+    (
+        "GsFile",
+        &[
+            ("name", FieldType::String),
+            ("downloaded_file_path", FieldType::String),
+            ("url", FieldType::String),
+        ],
+    ),
+    (
+        "HttpFile",
+        &[
+            ("name", FieldType::String),
+            ("downloaded_file_path", FieldType::String),
+            ("integrity", FieldType::String),
+            ("urls", FieldType::StringArray),
+        ],
+    ),
+    (
+        "RepoRepository",
+        &[
+            ("name", FieldType::String),
+            ("project", FieldType::String),
+            ("tree", FieldType::String),
+        ],
+    ),
+    (
+        "CrosChromeRepository",
+        &[
+            ("name", FieldType::String),
+            ("revision", FieldType::String),
+            ("internal", FieldType::Bool),
+        ],
+    ),
+];
+
+/// Returns the JSON schema of deps files. It is published as
+/// deps.schema.json so that external tools can validate deps files.
+fn deps_schema() -> Value {
+    let variants = REPOSITORY_FIELDS
+        .iter()
+        .map(|(kind, fields)| {
+            let properties: serde_json::Map<String, Value> = fields
+                .iter()
+                .map(|(name, ty)| (name.to_string(), ty.schema()))
+                .collect();
+            let required = fields.iter().map(|(name, _)| *name).collect_vec();
+            json!({
+                "type": "object",
+                "properties": {
+                    *kind: {
+                        "type": "object",
+                        "properties": properties,
+                        "required": required,
+                        "additionalProperties": false,
+                    },
+                },
+                "required": [kind],
+                "additionalProperties": false,
+            })
+        })
+        .collect_vec();
+    json!({
+        "$schema": "https://json-schema.org/draft/2020-12/schema",
+        "title": "deps.json",
+        "description": "Repository rules to instantiate for sources of Portage packages, generated by `alchemist generate-repo`.",
+        "type": "array",
+        "items": {"oneOf": variants},
+    })
+}
+
+/// Validates a deps file strictly against [`REPOSITORY_FIELDS`].
+///
+/// Unlike deserializing with serde, this rejects unknown repository types and
+/// fields, and reports errors with JSON paths (e.g. `$[3].HttpFile.urls[0]`).
+fn validate_deps(value: &Value) -> Result<()> {
+    let entries = value.as_array().context("$: expected an array")?;
+    for (i, entry) in entries.iter().enumerate() {
+        let path = format!("$[{i}]");
+        let entry = entry
+            .as_object()
+            .with_context(|| format!("{path}: expected an object"))?;
+        let (kind, params) = match entry.iter().exactly_one() {
+            Ok(kv) => kv,
+            Err(_) => bail!(
+                "{path}: expected exactly one repository type, got {}",
+                entry.len()
+            ),
+        };
+        let (_, fields) = REPOSITORY_FIELDS
+            .iter()
+            .find(|(k, _)| *k == kind.as_str())
+            .with_context(|| format!("{path}: unknown repository type {kind:?}"))?;
+
+        let path = format!("{path}.{kind}");
+        let params = params
+            .as_object()
+            .with_context(|| format!("{path}: expected an object"))?;
+        for name in params.keys() {
+            ensure!(
+                fields.iter().any(|(n, _)| *n == name.as_str()),
+                "{path}: unknown field {name:?}"
+            );
+        }
+        for (name, ty) in fields.iter() {
+            let value = params
+                .get(*name)
+                .with_context(|| format!("{path}: missing field {name:?}"))?;
+            ty.check(value, &format!("{path}.{name}"))?;
+        }
+    }
+    Ok(())
+}
+
+/// Loads a deps file. If `strict` is true, unknown repository types, unknown
+/// fields and type mismatches are rejected with precise error locations.
+/// Otherwise unknown fields are ignored.
+fn load_deps(contents: &str, strict: bool) -> Result<Vec<Repository>> {
+    let value: Value = serde_json::from_str(contents)?;
+    if strict {
+        validate_deps(&value)?;
+    }
+    Ok(serde_json::from_value(value)?)
+}
+
+/// The entry point of "validate-deps" subcommand.
+pub fn validate_deps_main(
+    deps_file: Option<&Path>,
+    strict: bool,
+    print_schema: bool,
+) -> Result<()> {
+    if print_schema {
+        println!("{}", serde_json::to_string_pretty(&deps_schema())?);
+        return Ok(());
+    }
+    let deps_file = deps_file.context("The deps file path is not specified")?;
+    let contents = std::fs::read_to_string(deps_file)
+        .with_context(|| format!("Failed to read {}", deps_file.display()))?;
+    let repos = load_deps(&contents, strict)
+        .with_context(|| format!("Invalid deps file {}", deps_file.display()))?;
+    eprintln!("{}: {} repositories", deps_file.display(), repos.len());
+    Ok(())
+}
+
+/// Merges deps files generated for different boards into one.
+///
+/// Repositories are identified by their names. Repositories with the same name
+/// must be identical since they are instantiated only once in the workspace.
+fn merge_deps(all_repos: Vec<Vec<Repository>>) -> Result<Vec<Repository>> {
+    let mut merged: Vec<Repository> = Vec::new();
+    for repo in all_repos
+        .into_iter()
+        .flatten()
+        .sorted_by(|a, b| a.name().cmp(b.name()))
+    {
+        match merged.last() {
+            Some(last) if last.name() == repo.name() => {
+                ensure!(
+                    *last == repo,
+                    "Conflicting definitions of repository {:?}:\n{:?}\n{:?}",
+                    repo.name(),
+                    last,
+                    repo
+                );
+            }
+            _ => merged.push(repo),
+        }
+    }
+    Ok(merged)
+}
+
+/// The entry point of "merge-deps" subcommand.
+pub fn merge_deps_main(deps_files: &[PathBuf], output: &Path) -> Result<()> {
+    let all_repos = deps_files
+        .iter()
+        .map(|deps_file| {
+            let contents = std::fs::read_to_string(deps_file)
+                .with_context(|| format!("Failed to read {}", deps_file.display()))?;
+            load_deps(&contents, true)
+                .with_context(|| format!("Invalid deps file {}", deps_file.display()))
+        })
+        .collect::<Result<Vec<_>>>()?;
+    let merged = merge_deps(all_repos)?;
+    atomic_write_with(output, SyncMode::NoSync, |file| {
+        Ok(serde_json::to_writer(file, &merged)?)
+    })?;
+    eprintln!(
+        "Merged {} deps files into {} repositories",
+        deps_files.len(),
+        merged.len()
+    );
+    Ok(())
+}
+
 pub fn generate_deps_file(all_sources: &[&PackageSources], out: &Path) -> Result<()> {
     let repos = generate_deps(all_sources)?;
-    let mut file = File::create(out)?;
-    serde_json::to_writer(&mut file, &repos)?;
-    Ok(())
+    atomic_write_with(out, SyncMode::NoSync, |file| {
+        Ok(serde_json::to_writer(file, &repos)?)
+    })
 }
 
 #[instrument(skip_all)]
@@ -150,6 +406,7 @@ mod tests {
         let cipd_sources = PackageSources {
             local_sources: vec![],
             repo_sources: vec![],
+            missing_local_sources: vec![],
             dist_sources: vec![PackageDistSource {
                 urls: vec![Url::parse("cipd://skia/tools/goldctl/linux-amd64:0ov3TU").unwrap()],
                 filename: "goldctl-2021.03.31-amd64.zip".to_owned(),
@@ -161,6 +418,7 @@ mod tests {
         let gs_sources = PackageSources {
             local_sources: vec![],
             repo_sources: vec![],
+            missing_local_sources: vec![],
             dist_sources: vec![PackageDistSource {
                 urls: vec![Url::parse("gs://secret-bucket/secret-file.tar.gz").unwrap()],
                 filename: "secret-file.tar.gz".to_owned(),
@@ -172,6 +430,7 @@ mod tests {
         let https_sources = PackageSources {
             local_sources: vec![],
             repo_sources: vec![],
+            missing_local_sources: vec![],
             dist_sources: vec![
                 PackageDistSource {
                     urls: vec![
@@ -218,4 +477,143 @@ mod tests {
 
         Ok(())
     }
+
+    fn all_repository_kinds() -> Vec<Repository> {
+        vec![
+            Repository::CipdFile {
+                name: "a".into(),
+                downloaded_file_path: "b".into(),
+                url: "c".into(),
+            },
+            Repository::GsFile {
+                name: "a".into(),
+                downloaded_file_path: "b".into(),
+                url: "c".into(),
+            },
+            Repository::HttpFile {
+                name: "a".into(),
+                downloaded_file_path: "b".into(),
+                integrity: "c".into(),
+                urls: vec!["d".into()],
+            },
+            Repository::RepoRepository {
+                name: "a".into(),
+                project: "b".into(),
+                tree: "c".into(),
+            },
+            Repository::CrosChromeRepository {
+                name: "a".into(),
+                revision: "b".into(),
+                internal: true,
+            },
+        ]
+    }
+
+    #[test]
+    fn repository_fields_in_sync() -> Result<()> {
+        let repos = all_repository_kinds();
+        assert_eq!(repos.len(), REPOSITORY_FIELDS.len());
+
+        // Serialized repositories must have exactly the fields described in
+        // REPOSITORY_FIELDS.
+        let value = serde_json::to_value(&repos)?;
+        for (entry, (kind, fields)) in value.as_array().unwrap().iter().zip(REPOSITORY_FIELDS) {
+            let params = entry.get(kind).and_then(|p| p.as_object());
+            let params = params.unwrap_or_else(|| panic!("{kind} not found in {entry}"));
+            let names = params.keys().sorted().collect_vec();
+            let expected_names = fields.iter().map(|(name, _)| *name).sorted().collect_vec();
+            assert_eq!(names, expected_names, "fields of {kind}");
+        }
+
+        // Strict loading round-trips all repository kinds.
+        let loaded = load_deps(&serde_json::to_string(&repos)?, true)?;
+        assert_eq!(loaded, repos);
+
+        Ok(())
+    }
+
+    #[test]
+    fn schema_file_in_sync() -> Result<()> {
+        let published: Value = serde_json::from_str(include_str!("deps.schema.json"))?;
+        assert_eq!(
+            published,
+            deps_schema(),
+            "deps.schema.json is stale; regenerate it with \
+            `alchemist validate-deps --print-schema`"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn load_deps_lenient_ignores_unknown_fields() -> Result<()> {
+        let repos = load_deps(
+            r#"[{"GsFile": {"name": "a", "downloaded_file_path": "b", "url": "c", "new": 1}}]"#,
+            false,
+        )?;
+        assert_eq!(
+            repos,
+            vec![Repository::GsFile {
+                name: "a".into(),
+                downloaded_file_path: "b".into(),
+                url: "c".into(),
+            }]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn merge_deps_deduplicates() -> Result<()> {
+        let repo = |name: &str, tree: &str| Repository::RepoRepository {
+            name: name.into(),
+            project: "chromiumos/platform2".into(),
+            tree: tree.into(),
+        };
+
+        let merged = merge_deps(vec![
+            vec![repo("b", "1"), repo("a", "1")],
+            vec![repo("c", "1"), repo("a", "1")],
+        ])?;
+        assert_eq!(merged, vec![repo("a", "1"), repo("b", "1"), repo("c", "1")]);
+
+        let err = merge_deps(vec![vec![repo("a", "1")], vec![repo("a", "2")]]).unwrap_err();
+        assert!(
+            err.to_string()
+                .starts_with(r#"Conflicting definitions of repository "a""#),
+            "{err}"
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn load_deps_strict_errors() {
+        for (contents, expected) in [
+            (r#"{}"#, "$: expected an array"),
+            (r#"[1]"#, "$[0]: expected an object"),
+            (
+                r#"[{"GsFile": {}, "CipdFile": {}}]"#,
+                "$[0]: expected exactly one repository type, got 2",
+            ),
+            (r#"[{"Foo": {}}]"#, r#"$[0]: unknown repository type "Foo""#),
+            (
+                r#"[{"GsFile": {"name": "a", "downloaded_file_path": "b", "url": "c", "new": 1}}]"#,
+                r#"$[0].GsFile: unknown field "new""#,
+            ),
+            (
+                r#"[{"GsFile": {"name": "a", "downloaded_file_path": "b"}}]"#,
+                r#"$[0].GsFile: missing field "url""#,
+            ),
+            (
+                r#"[{"GsFile": {"name": "a", "downloaded_file_path": "b", "url": 1}}]"#,
+                "$[0].GsFile.url: expected a string",
+            ),
+            (
+                r#"[{"HttpFile": {"name": "a", "downloaded_file_path": "b", "integrity": "c", "urls": ["d", 2]}}]"#,
+                "$[0].HttpFile.urls[1]: expected a string",
+            ),
+        ] {
+            let err = load_deps(contents, true).unwrap_err();
+            assert_eq!(err.to_string(), expected, "input: {contents}");
+        }
+    }
 }
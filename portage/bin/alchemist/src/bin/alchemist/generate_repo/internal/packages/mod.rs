@@ -29,6 +29,7 @@ use rayon::prelude::*;
 use serde::Serialize;
 use tera::Tera;
 use tracing::instrument;
+use walkdir::WalkDir;
 
 use crate::generate_repo::common::{
     escape_starlark_string, package_details_to_target_path, repository_set_to_target_path,
@@ -63,6 +64,8 @@ pub struct EBuildEntry {
     cache_sources: Vec<String>,
     git_trees: Vec<String>,
     dists: Vec<DistFileEntry>,
+    has_manifest: bool,
+    files: Vec<String>,
     eclasses: Vec<String>,
     provided_host_build_deps: Vec<String>,
     reusable_host_build_deps: Vec<String>,
@@ -84,6 +87,8 @@ pub struct EBuildEntry {
     use_interface_libraries: bool,
     generate_interface_libraries: bool,
     interface_library_allowlist: Vec<PathBuf>,
+    enforce_sandbox_policy: bool,
+    exec_requirements: Vec<String>,
 }
 
 /// Specifies the config used to generate host packages.
@@ -193,6 +198,38 @@ fn get_ebuild_name_from_path(ebuild_path: &Path) -> Result<String> {
         .to_string())
 }
 
+/// Lists files under the `cros` and `files` directories next to the ebuild,
+/// relative to the package directory.
+///
+/// They're listed explicitly instead of being globbed in generated BUILD files
+/// so that a package only depends on the files that actually exist.
+fn list_package_files(ebuild_path: &Path) -> Result<Vec<String>> {
+    let package_dir = ebuild_path
+        .parent()
+        .ok_or_else(|| anyhow!("ebuild path {ebuild_path:?} has no parent"))?;
+    let mut files = Vec::new();
+    for name in ["cros", "files"] {
+        let dir = package_dir.join(name);
+        if !dir.try_exists()? {
+            continue;
+        }
+        for entry in WalkDir::new(&dir).follow_links(true).sort_by_file_name() {
+            let entry = entry?;
+            if entry.file_type().is_dir() {
+                continue;
+            }
+            let relative_path = entry.path().strip_prefix(package_dir)?;
+            files.push(
+                relative_path
+                    .to_str()
+                    .with_context(|| format!("{relative_path:?} is not a valid string"))?
+                    .to_owned(),
+            );
+        }
+    }
+    Ok(files)
+}
+
 impl EBuildEntry {
     pub fn try_new(target: &PackageType, package: &Package) -> Result<Self> {
         let ebuild_name =
@@ -580,6 +617,15 @@ impl EBuildEntry {
             vec![]
         };
 
+        let has_manifest = package
+            .details
+            .as_basic_data()
+            .ebuild_path
+            .with_file_name("Manifest")
+            .try_exists()?;
+
+        let files = list_package_files(&package.details.as_basic_data().ebuild_path)?;
+
         Ok(Self {
             ebuild_name,
             basename,
@@ -593,6 +639,8 @@ impl EBuildEntry {
             cache_sources,
             git_trees,
             dists,
+            has_manifest,
+            files,
             eclasses,
             host_build_deps,
             provided_host_build_deps,
@@ -614,6 +662,14 @@ impl EBuildEntry {
             use_interface_libraries,
             generate_interface_libraries: package.generate_interface_libraries,
             interface_library_allowlist,
+            enforce_sandbox_policy: package.details.bazel_metadata.enforce_sandbox_policy,
+            exec_requirements: package
+                .details
+                .bazel_metadata
+                .exec_requirements
+                .iter()
+                .map(|requirement| requirement.as_ref().to_owned())
+                .collect(),
         })
     }
 }
@@ -731,8 +787,8 @@ fn generate_package(
             // Create a `files` and `cros` symlink if necessary.
             // The `cros` symlink is ChromeOS specific. It contains additional
             // bashrc files and patches that can be applied to portage-stable
-            // packages.
-            for name in ["files", "cros"] {
+            // packages. `Manifest` is used to verify distfiles.
+            for name in ["files", "cros", "Manifest"] {
                 let files_dir = ebuild.with_file_name(name);
                 if files_dir.try_exists()? {
                     let output_files_dir = output_dir.join(name);
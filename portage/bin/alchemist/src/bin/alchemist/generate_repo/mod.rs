@@ -2,25 +2,18 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-mod common;
-mod deps;
+pub mod common;
+pub mod deps;
 pub mod internal;
 mod public;
 
-use std::{
-    collections::HashMap,
-    fs::{create_dir_all, remove_dir_all, File},
-    io::{ErrorKind, Write},
-    path::Path,
-    str::FromStr,
-    sync::Arc,
-};
+use std::{collections::HashMap, fs::File, io::Write, path::Path, str::FromStr, sync::Arc};
 
 use alchemist::{
     analyze::{
-        analyze_packages, dependency::direct::DependencyKind,
-        dependency::indirect::collect_transitive_dependencies, MaybePackage, Package,
-        PackageAnalysisError,
+        analyze_packages_with_stats, dependency::direct::DependencyKind,
+        dependency::indirect::collect_transitive_dependencies, source::MissingLocalSource,
+        stats::AnalysisStats, MaybePackage, Package, PackageAnalysisError,
     },
     config::ProvidedPackage,
     dependency::package::{AsPackageRef, PackageAtom},
@@ -29,7 +22,10 @@ use alchemist::{
     resolver::select_best_version,
 };
 use anyhow::{anyhow, bail, Context, Result};
+use cliutil::LoggingConfig;
+use fileutil::{atomic_replace_dir, atomic_write, atomic_write_with, SyncMode};
 use itertools::Itertools;
+use serde::Serialize;
 
 use crate::alchemist::TargetData;
 
@@ -56,7 +52,7 @@ fn load_packages(
     host: &TargetData,
     target: &TargetData,
     src_dir: &Path,
-) -> Result<Vec<MaybePackage>> {
+) -> Result<(Vec<MaybePackage>, AnalysisStats)> {
     eprintln!(
         "Loading packages for {}:{}...",
         target.board, target.profile
@@ -76,7 +72,7 @@ fn load_packages(
         cbuild != chost
     };
 
-    let packages = analyze_packages(
+    let (packages, stats) = analyze_packages_with_stats(
         &target.config,
         cross_compile,
         src_dir,
@@ -86,7 +82,7 @@ fn load_packages(
 
     eprintln!("Loaded {} packages", packages.len());
 
-    Ok(packages)
+    Ok((packages, stats))
 }
 
 fn get_sdk_implicit_system_package(host_packages: &[MaybePackage]) -> Result<Arc<Package>> {
@@ -189,16 +185,18 @@ fn compute_bootstrap_packages<'a>(
 }
 
 /// Generates the stage1, stage2, etc packages and SDKs.
+///
+/// It returns all loaded packages along with statistics of their analysis.
 pub fn generate_stages(
     host: &TargetData,
     target: Option<&TargetData>,
     translator: &PathTranslator,
     src_dir: &Path,
     output_dir: &Path,
-) -> Result<Vec<MaybePackage>> {
+) -> Result<(Vec<MaybePackage>, AnalysisStats)> {
     let mut all_packages = vec![];
 
-    let host_packages = load_packages(host, host, src_dir)?;
+    let (host_packages, mut stats) = load_packages(host, host, src_dir)?;
 
     let packages_by_path = host_packages
         .iter()
@@ -397,10 +395,13 @@ pub fn generate_stages(
     // Generate public aliases
     generate_public_packages(&host_packages, "stage2/host", &output_dir.join("host"))?;
 
-    all_packages.extend(host_packages);
+    // Keep host packages around as images refer to the cross-compilation
+    // toolchain among them.
+    all_packages.extend(host_packages.iter().cloned());
 
     if let Some(target) = target {
-        let target_packages = load_packages(host, target, src_dir)?;
+        let (target_packages, target_stats) = load_packages(host, target, src_dir)?;
+        stats.merge(target_stats);
 
         // Generate the stage 2 target board SDK. This will be used to build
         // all the target's packages.
@@ -447,7 +448,16 @@ pub fn generate_stages(
             &output_dir.join("target"),
         )?;
 
-        generate_public_images(&target.board, &output_dir.join("images"))?;
+        generate_public_images(
+            &target.board,
+            target
+                .toolchains
+                .primary()
+                .context("Target is missing primary toolchain")?,
+            &host_packages,
+            &target_packages,
+            &output_dir.join("images"),
+        )?;
 
         // TODO: Generate the Stage 3 target packages if we decide to build
         // targets against the stage 3 SDK.
@@ -455,31 +465,86 @@ pub fn generate_stages(
         all_packages.extend(target_packages);
     }
 
-    Ok(all_packages)
+    Ok((all_packages, stats))
 }
 
-/// The entry point of "generate-repo" subcommand.
-pub fn generate_repo_main(
+/// An entry of the report written by `--output-missing-sources-json`.
+#[derive(Serialize)]
+struct MissingLocalSourceEntry<'a> {
+    ebuild: &'a Path,
+    #[serde(flatten)]
+    source: &'a MissingLocalSource,
+}
+
+/// Warns about CROS_WORKON projects whose directories do not exist, which
+/// would otherwise be silently left out of the package sources.
+///
+/// The warnings are also written to `report_file` as JSON if it is set. If
+/// `strict` is true, any missing project is an error.
+fn report_missing_local_sources(
+    all_packages: &[MaybePackage],
+    report_file: Option<&Path>,
+    strict: bool,
+) -> Result<()> {
+    // Host and target packages often share ebuilds, so deduplicate entries.
+    let entries = all_packages
+        .iter()
+        .flat_map(|package| match package {
+            MaybePackage::Ok(package) => package
+                .sources
+                .missing_local_sources
+                .iter()
+                .map(|source| MissingLocalSourceEntry {
+                    ebuild: &package.details.as_basic_data().ebuild_path,
+                    source,
+                })
+                .collect_vec(),
+            _ => Vec::new(),
+        })
+        .sorted_by(|a, b| (a.ebuild, &a.source.path).cmp(&(b.ebuild, &b.source.path)))
+        .dedup_by(|a, b| a.ebuild == b.ebuild && a.source == b.source)
+        .collect_vec();
+
+    for entry in &entries {
+        eprintln!(
+            "WARNING: {}: CROS_WORKON_LOCALNAME={:?} of {} points to src/{}, which does not exist",
+            entry.ebuild.display(),
+            entry.source.local_name,
+            entry.source.project,
+            entry.source.path.display(),
+        );
+    }
+
+    if let Some(report_file) = report_file {
+        atomic_write_with(report_file, SyncMode::NoSync, |file| {
+            Ok(serde_json::to_writer_pretty(file, &entries)?)
+        })?;
+    }
+
+    if strict && !entries.is_empty() {
+        bail!(
+            "{} CROS_WORKON projects point to nonexistent paths (see warnings above)",
+            entries.len()
+        );
+    }
+    Ok(())
+}
+
+/// Generates the contents of @portage under `output_dir`, and returns all
+/// analyzed packages with the analysis statistics.
+fn generate_repo(
+    logging: LoggingConfig,
     host: &TargetData,
     target: Option<&TargetData>,
     translator: &PathTranslator,
     src_dir: &Path,
     output_dir: &Path,
-    deps_file: &Path,
-) -> Result<()> {
-    match remove_dir_all(output_dir) {
-        Ok(_) => {}
-        Err(err) if err.kind() == ErrorKind::NotFound => {}
-        err => {
-            err?;
-        }
-    };
-    create_dir_all(output_dir)?;
-
-    let _guard = cliutil::LoggingConfig {
+    missing_sources_file: Option<&Path>,
+    strict_src: bool,
+) -> Result<(Vec<MaybePackage>, AnalysisStats)> {
+    let _guard = LoggingConfig {
         trace_file: Some(output_dir.join("trace.json")),
-        log_file: None,
-        console_logger: None,
+        ..logging
     }
     .setup()?;
 
@@ -497,18 +562,13 @@ pub fn generate_repo_main(
 
     generate_internal_bashrcs(translator, host, target, output_dir)?;
 
-    let all_packages = generate_stages(host, target, translator, src_dir, output_dir)?;
+    let (all_packages, mut stats) = generate_stages(host, target, translator, src_dir, output_dir)?;
 
-    generate_deps_file(
-        &all_packages
-            .iter()
-            .flat_map(|package| match package {
-                MaybePackage::Ok(package) => Some(&package.sources),
-                _ => None,
-            })
-            .collect_vec(),
-        deps_file,
-    )?;
+    report_missing_local_sources(&all_packages, missing_sources_file, strict_src)?;
+
+    // The evaluator is shared between host and target, so its cache
+    // statistics cover both of them.
+    (stats.metadata_cache_hits, stats.metadata_cache_misses) = host.evaluator.cache_stats();
 
     generate_portage_config(host, target, output_dir)?;
 
@@ -532,6 +592,79 @@ pub fn generate_repo_main(
         generate_sysroot_build_file(target, output_dir)?;
     }
 
+    Ok((all_packages, stats))
+}
+
+/// The entry point of "generate-repo" subcommand.
+pub fn generate_repo_main(
+    logging: LoggingConfig,
+    host: &TargetData,
+    target: Option<&TargetData>,
+    translator: &PathTranslator,
+    src_dir: &Path,
+    output_dir: &Path,
+    deps_file: &Path,
+    stats_file: Option<&Path>,
+    stats_prometheus_file: Option<&Path>,
+    previous_stats_file: Option<&Path>,
+    missing_sources_file: Option<&Path>,
+    strict_src: bool,
+) -> Result<()> {
+    // Generate the repository in a temporary directory and swap it in at the
+    // end so that an interrupted run never leaves a half-generated @portage.
+    let (all_packages, stats) = atomic_replace_dir(output_dir, SyncMode::NoSync, |output_dir| {
+        generate_repo(
+            logging,
+            host,
+            target,
+            translator,
+            src_dir,
+            output_dir,
+            missing_sources_file,
+            strict_src,
+        )
+    })?;
+
+    eprintln!("Analysis statistics:\n{stats}");
+    let mut stats_json = stats.to_json();
+    if let Some(previous_stats_file) = previous_stats_file {
+        let previous: serde_json::Value = serde_json::from_slice(
+            &std::fs::read(previous_stats_file)
+                .with_context(|| format!("Failed to read {}", previous_stats_file.display()))?,
+        )
+        .with_context(|| format!("Failed to parse {}", previous_stats_file.display()))?;
+        let delta = stats.delta_from(&previous);
+        eprintln!("Changes since the previous run:\n{delta}");
+        stats_json["delta"] = delta.to_json();
+    }
+    if let Some(stats_file) = stats_file {
+        atomic_write(
+            stats_file,
+            serde_json::to_string_pretty(&stats_json)?,
+            SyncMode::NoSync,
+        )?;
+    }
+    if let Some(stats_prometheus_file) = stats_prometheus_file {
+        atomic_write(
+            stats_prometheus_file,
+            stats.to_prometheus(),
+            SyncMode::NoSync,
+        )?;
+    }
+
+    // The deps file is written after swapping the repository in since it is
+    // usually placed in the output directory.
+    generate_deps_file(
+        &all_packages
+            .iter()
+            .flat_map(|package| match package {
+                MaybePackage::Ok(package) => Some(&package.sources),
+                _ => None,
+            })
+            .collect_vec(),
+        deps_file,
+    )?;
+
     eprintln!("Generated @portage.");
     Ok(())
 }
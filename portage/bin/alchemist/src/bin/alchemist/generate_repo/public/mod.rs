@@ -13,8 +13,10 @@ use tracing::instrument;
 
 use alchemist::{
     analyze::MaybePackage, dependency::package::AsPackageRef, resolver::select_best_version,
+    toolchain::Toolchain,
 };
 use anyhow::Result;
+use itertools::Itertools;
 use lazy_static::lazy_static;
 use rayon::prelude::*;
 use serde::Serialize;
@@ -69,6 +71,25 @@ struct BuildTemplateContext<'a> {
     best_version_selection_failure: Option<&'a str>,
 }
 
+/// Determines the best version among packages of the same name, or returns a
+/// message explaining why it can't be determined.
+fn determine_best_version<'a>(maybe_packages: &[&'a MaybePackage]) -> Result<&'a Version, String> {
+    match select_best_version(maybe_packages) {
+        Some(MaybePackage::Err(error))
+            if error.details.as_package_ref().readiness != Some(true) =>
+        {
+            Err(format!(
+                "Can't determine the best version for {0} due to analysis errors: {0}-{1}: {2}",
+                error.as_basic_data().package_name,
+                error.as_basic_data().version,
+                error.error,
+            ))
+        }
+        Some(maybe_package) => Ok(&maybe_package.as_basic_data().version),
+        None => Err("All packages are masked".to_string()),
+    }
+}
+
 fn generate_public_package(
     maybe_packages: &[&MaybePackage],
     package_prefix: &str,
@@ -119,20 +140,7 @@ fn generate_public_package(
         });
     }
 
-    let maybe_best_version: Result<&Version, String> = match select_best_version(maybe_packages) {
-        Some(MaybePackage::Err(error))
-            if error.details.as_package_ref().readiness != Some(true) =>
-        {
-            Err(format!(
-                "Can't determine the best version for {0} due to analysis errors: {0}-{1}: {2}",
-                error.as_basic_data().package_name,
-                error.as_basic_data().version,
-                error.error,
-            ))
-        }
-        Some(maybe_package) => Ok(&maybe_package.as_basic_data().version),
-        None => Err("All packages are masked".to_string()),
-    };
+    let maybe_best_version = determine_best_version(maybe_packages);
 
     // Generate unversioned aliases. In case where we cannot determine the best version, all aliases
     // point to the error-printing target.
@@ -237,17 +245,75 @@ pub fn generate_public_packages(
         })
 }
 
+/// Describes the cross-compilation toolchain of a board. It is saved as
+/// `toolchain.json` in the images package and passed to build_image.
+#[derive(Serialize)]
+struct ToolchainDescriptor<'a> {
+    board: &'a str,
+    chost: &'a str,
+    /// Host packages providing the cross-compilation toolchain, e.g.
+    /// "cross-aarch64-cros-linux-gnu/gcc".
+    cross_packages: Vec<&'a str>,
+}
+
 #[derive(Serialize)]
 struct ImagesTemplateContext<'a> {
     board: &'a str,
+    toolchain_packages: &'a [&'a str],
+    /// Whether //target/virtual/target-os-factory-shim:package_set resolves,
+    /// i.e. the board can build the factory install shim.
+    has_factory_shim: bool,
 }
 
+/// The package providing the default package set of factory install shims.
+const FACTORY_SHIM_PACKAGE: &str = "virtual/target-os-factory-shim";
+
 /// Generates the public targets for images.
+///
+/// Host packages in the `cross-$CHOST` category of the board's primary
+/// toolchain are made available to build_image. The factory install shim is
+/// generated only if the best version of [`FACTORY_SHIM_PACKAGE`] is found
+/// among target packages.
 #[instrument(skip_all)]
-pub fn generate_public_images(board: &str, output_dir: &Path) -> Result<()> {
+pub fn generate_public_images(
+    board: &str,
+    toolchain: &Toolchain,
+    host_packages: &[MaybePackage],
+    target_packages: &[MaybePackage],
+    output_dir: &Path,
+) -> Result<()> {
     create_dir_all(output_dir)?;
 
-    let context = ImagesTemplateContext { board };
+    let cross_category = format!("cross-{}", toolchain.name);
+    let cross_packages: Vec<&str> = host_packages
+        .iter()
+        .map(|package| package.as_basic_data())
+        .filter(|data| data.category_name == cross_category)
+        .map(|data| data.package_name.as_str())
+        .sorted()
+        .dedup()
+        .collect();
+
+    let descriptor = ToolchainDescriptor {
+        board,
+        chost: &toolchain.name,
+        cross_packages: cross_packages.clone(),
+    };
+    let mut file = File::create(output_dir.join("toolchain.json"))?;
+    serde_json::to_writer_pretty(&mut file, &descriptor)?;
+    file.write_all(b"\n")?;
+
+    let factory_shim_packages: Vec<&MaybePackage> = target_packages
+        .iter()
+        .filter(|package| package.as_basic_data().package_name == FACTORY_SHIM_PACKAGE)
+        .collect();
+    let has_factory_shim = determine_best_version(&factory_shim_packages).is_ok();
+
+    let context = ImagesTemplateContext {
+        board,
+        toolchain_packages: &cross_packages,
+        has_factory_shim,
+    };
 
     let mut file = File::create(output_dir.join("BUILD.bazel"))?;
     file.write_all(AUTOGENERATE_NOTICE.as_bytes())?;
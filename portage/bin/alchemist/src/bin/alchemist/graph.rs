@@ -0,0 +1,467 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{BTreeMap, BTreeSet, HashSet, VecDeque},
+    fmt::Write as _,
+    path::PathBuf,
+    sync::Arc,
+};
+
+use alchemist::{
+    analyze::dependency::direct::{analyze_direct_dependencies, DependencyKind},
+    dependency::package::PackageAtom,
+    ebuild::PackageDetails,
+    resolver::PackageResolver,
+};
+use anyhow::{bail, Context, Result};
+use serde_json::json;
+
+use crate::alchemist::TargetData;
+
+/// Output format of the dependency graph.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, clap::ValueEnum)]
+pub enum Format {
+    /// Graphviz DOT.
+    Dot,
+    /// JSON adjacency lists.
+    Json,
+}
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Output format.
+    #[arg(long, value_enum, default_value = "dot")]
+    format: Format,
+
+    /// Maximum depth of dependencies to follow from the root packages. If
+    /// unset, all transitive dependencies are included.
+    #[arg(long, value_name = "N")]
+    max_depth: Option<usize>,
+
+    /// Output path. If unset, the graph is printed to stdout.
+    #[arg(long, value_name = "PATH")]
+    output: Option<PathBuf>,
+
+    /// Comma-separated names of overlays that dependencies may come from,
+    /// e.g. "portage-stable,chromiumos". If set, fails when a dependency of
+    /// the root packages comes from another overlay, e.g. to keep generic
+    /// targets from depending on private or board-specific overlays.
+    #[arg(long, value_name = "OVERLAYS", value_delimiter = ',')]
+    allowed_overlays: Option<Vec<String>>,
+
+    /// Root packages to start traversing dependencies from, e.g.
+    /// "virtual/target-os".
+    #[arg(required = true)]
+    packages: Vec<String>,
+}
+
+/// A package in the dependency graph.
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub struct Node {
+    /// The package name, version and repository, e.g.
+    /// "sys-apps/attr-2.5.1::portage-stable".
+    pub name: String,
+    /// Whether the package is installed to the host (SDK) rather than the
+    /// target. This is always false when the target is the host itself.
+    pub host: bool,
+}
+
+impl Node {
+    pub fn new(details: &PackageDetails, host: bool) -> Self {
+        let basic_data = details.as_basic_data();
+        Self {
+            name: format!(
+                "{}-{}::{}",
+                basic_data.package_name, basic_data.version, basic_data.repo_name
+            ),
+            host,
+        }
+    }
+
+    /// Returns the name of the overlay the package comes from, e.g.
+    /// "portage-stable".
+    pub fn overlay(&self) -> &str {
+        self.name
+            .rsplit_once("::")
+            .map_or("", |(_, overlay)| overlay)
+    }
+
+    pub fn id(&self) -> String {
+        if self.host {
+            format!("host:{}", self.name)
+        } else {
+            self.name.clone()
+        }
+    }
+}
+
+/// A dependency edge in the graph.
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub struct Edge {
+    pub from: Node,
+    pub to: Node,
+    /// Portage's name of the dependency type, e.g. "RDEPEND", or "SUBSLOT"
+    /// for a package to be rebuilt when the sub-slot of the dependency
+    /// changes.
+    pub kind: &'static str,
+}
+
+/// A dependency graph reachable from a set of root packages.
+#[derive(Debug, Default)]
+pub struct Graph {
+    pub roots: BTreeSet<Node>,
+    pub nodes: BTreeSet<Node>,
+    pub edges: BTreeSet<Edge>,
+    /// Paths to the ebuilds of nodes.
+    pub ebuild_paths: BTreeMap<Node, PathBuf>,
+}
+
+/// Returns the DOT attributes to draw edges of a dependency kind with.
+fn edge_style(kind: &str) -> &'static str {
+    match kind {
+        // Build-time dependencies.
+        "DEPEND" => "style=solid",
+        "BDEPEND" => "style=solid, color=blue",
+        // Install-time and run-time dependencies.
+        "IDEPEND" => "style=dashed, color=blue",
+        "RDEPEND" => "style=dashed",
+        // Post dependencies.
+        "PDEPEND" => "style=dotted",
+        // Rebuild triggers of the sub-slot rebuild operator (:=).
+        "SUBSLOT" => "style=bold, color=red",
+        _ => "",
+    }
+}
+
+const DEPENDENCY_KINDS: [(DependencyKind, &str); 5] = [
+    (DependencyKind::BuildTarget, "DEPEND"),
+    (DependencyKind::RunTarget, "RDEPEND"),
+    (DependencyKind::PostTarget, "PDEPEND"),
+    (DependencyKind::BuildHost, "BDEPEND"),
+    (DependencyKind::InstallHost, "IDEPEND"),
+];
+
+/// Traverses dependencies from the root packages up to `max_depth` and
+/// returns the resulting graph.
+pub fn build_graph(
+    host: &TargetData,
+    target: Option<&TargetData>,
+    roots: &[Arc<PackageDetails>],
+    max_depth: Option<usize>,
+) -> Result<Graph> {
+    let cross_compile = match target {
+        Some(target) => {
+            let cbuild = host
+                .config
+                .env()
+                .get("CHOST")
+                .context("host is missing CHOST")?;
+            let chost = target
+                .config
+                .env()
+                .get("CHOST")
+                .context("target is missing CHOST")?;
+            cbuild != chost
+        }
+        None => false,
+    };
+
+    let mut graph = Graph::default();
+    let mut visited = HashSet::new();
+    let mut queue = VecDeque::new();
+    for details in roots {
+        let node = Node::new(details, false);
+        graph.roots.insert(node.clone());
+        if visited.insert(node.clone()) {
+            queue.push_back((details.clone(), node, 0));
+        }
+    }
+
+    while let Some((details, node, depth)) = queue.pop_front() {
+        graph.nodes.insert(node.clone());
+        graph
+            .ebuild_paths
+            .insert(node.clone(), details.as_basic_data().ebuild_path.clone());
+        if max_depth.is_some_and(|max_depth| depth >= max_depth) {
+            continue;
+        }
+
+        // Dependencies of host packages are resolved entirely on the host.
+        let (deps, _expressions) = if node.host || target.is_none() {
+            analyze_direct_dependencies(&details, false, &host.resolver, &host.resolver)
+        } else {
+            analyze_direct_dependencies(
+                &details,
+                cross_compile,
+                &host.resolver,
+                &target.unwrap().resolver,
+            )
+        }
+        .with_context(|| format!("Failed to analyze dependencies of {}", node.name))?;
+
+        for (kind, kind_name) in DEPENDENCY_KINDS {
+            let to_host = node.host
+                || (target.is_some()
+                    && matches!(
+                        kind,
+                        DependencyKind::BuildHost | DependencyKind::InstallHost
+                    ));
+            for dep in deps.get(kind) {
+                let dep_node = Node::new(dep, to_host);
+                graph.edges.insert(Edge {
+                    from: node.clone(),
+                    to: dep_node.clone(),
+                    kind: kind_name,
+                });
+                if visited.insert(dep_node.clone()) {
+                    queue.push_back((dep.clone(), dep_node, depth + 1));
+                }
+            }
+        }
+
+        // The packages are already reachable via DEPEND or RDEPEND edges.
+        for dep in &deps.subslot_rebuild_target {
+            graph.edges.insert(Edge {
+                from: node.clone(),
+                to: Node::new(dep, node.host),
+                kind: "SUBSLOT",
+            });
+        }
+    }
+
+    Ok(graph)
+}
+
+/// Escapes a string to be used as a quoted DOT identifier.
+fn quote_dot(s: &str) -> String {
+    format!("\"{}\"", s.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+fn render_dot(graph: &Graph) -> String {
+    let mut out = String::new();
+    writeln!(out, "digraph deps {{").unwrap();
+    writeln!(out, "  rankdir=LR;").unwrap();
+    writeln!(out, "  node [shape=box];").unwrap();
+    for node in graph.nodes.iter() {
+        let mut attrs = vec![format!("label={}", quote_dot(&node.name))];
+        if node.host {
+            attrs.push("color=blue".to_string());
+        }
+        if graph.roots.contains(node) {
+            attrs.push("style=bold".to_string());
+        }
+        writeln!(out, "  {} [{}];", quote_dot(&node.id()), attrs.join(", ")).unwrap();
+    }
+    for edge in graph.edges.iter() {
+        writeln!(
+            out,
+            "  {} -> {} [label={}, {}];",
+            quote_dot(&edge.from.id()),
+            quote_dot(&edge.to.id()),
+            quote_dot(edge.kind),
+            edge_style(edge.kind),
+        )
+        .unwrap();
+    }
+    writeln!(out, "}}").unwrap();
+    out
+}
+
+fn render_json(graph: &Graph) -> Result<String> {
+    let nodes = graph
+        .nodes
+        .iter()
+        .map(|node| {
+            let deps = graph
+                .edges
+                .iter()
+                .filter(|edge| &edge.from == node)
+                .map(|edge| json!({ "package": edge.to.id(), "kind": edge.kind }))
+                .collect::<Vec<_>>();
+            json!({
+                "package": node.id(),
+                "overlay": node.overlay(),
+                "host": node.host,
+                "root": graph.roots.contains(node),
+                "dependencies": deps,
+            })
+        })
+        .collect::<Vec<_>>();
+    Ok(serde_json::to_string_pretty(&nodes)?)
+}
+
+/// Fails if any dependency in the graph comes from an overlay not in
+/// `allowed_overlays`. Root packages are exempt unless other packages depend on
+/// them.
+fn check_overlays(graph: &Graph, allowed_overlays: &[String]) -> Result<()> {
+    let violations: Vec<String> = graph
+        .edges
+        .iter()
+        .filter(|edge| !allowed_overlays.iter().any(|o| o == edge.to.overlay()))
+        .map(|edge| format!("{} ({} of {})", edge.to.id(), edge.kind, edge.from.id()))
+        .collect();
+    if !violations.is_empty() {
+        bail!(
+            "Dependencies come from overlays not in --allowed-overlays:\n  {}",
+            violations.join("\n  ")
+        );
+    }
+    Ok(())
+}
+
+/// Resolves package atoms given in the command line to the best packages.
+pub fn find_packages(
+    resolver: &PackageResolver,
+    raws: &[String],
+) -> Result<Vec<Arc<PackageDetails>>> {
+    raws.iter()
+        .map(|raw| {
+            let atom = raw.parse::<PackageAtom>()?;
+            resolver
+                .find_best_package(&atom)?
+                .with_context(|| format!("No package satisfies {atom}"))
+        })
+        .collect()
+}
+
+/// The entry point of "graph" subcommand.
+pub fn graph_main(host: &TargetData, target: Option<&TargetData>, args: Args) -> Result<()> {
+    let roots = find_packages(&target.unwrap_or(host).resolver, &args.packages)?;
+
+    let graph = build_graph(host, target, &roots, args.max_depth)?;
+    eprintln!(
+        "Found {} packages and {} dependencies",
+        graph.nodes.len(),
+        graph.edges.len()
+    );
+
+    if let Some(allowed_overlays) = &args.allowed_overlays {
+        check_overlays(&graph, allowed_overlays)?;
+    }
+
+    let contents = match args.format {
+        Format::Dot => render_dot(&graph),
+        Format::Json => render_json(&graph)?,
+    };
+    match &args.output {
+        Some(path) => std::fs::write(path, contents)
+            .with_context(|| format!("Failed to write {}", path.display()))?,
+        None => print!("{contents}"),
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn node(name: &str, host: bool) -> Node {
+        Node {
+            name: name.to_string(),
+            host,
+        }
+    }
+
+    fn sample_graph() -> Graph {
+        let os = node("virtual/target-os-1::chromiumos", false);
+        let attr = node("sys-apps/attr-2.5.1::portage-stable", false);
+        let gcc = node("sys-devel/gcc-10.2.0::portage-stable", true);
+        Graph {
+            roots: BTreeSet::from([os.clone()]),
+            nodes: BTreeSet::from([os.clone(), attr.clone(), gcc.clone()]),
+            edges: BTreeSet::from([
+                Edge {
+                    from: os,
+                    to: attr.clone(),
+                    kind: "RDEPEND",
+                },
+                Edge {
+                    from: attr,
+                    to: gcc,
+                    kind: "BDEPEND",
+                },
+            ]),
+            ebuild_paths: BTreeMap::new(),
+        }
+    }
+
+    #[test]
+    fn test_render_dot() {
+        assert_eq!(
+            render_dot(&sample_graph()),
+            r#"digraph deps {
+  rankdir=LR;
+  node [shape=box];
+  "sys-apps/attr-2.5.1::portage-stable" [label="sys-apps/attr-2.5.1::portage-stable"];
+  "host:sys-devel/gcc-10.2.0::portage-stable" [label="sys-devel/gcc-10.2.0::portage-stable", color=blue];
+  "virtual/target-os-1::chromiumos" [label="virtual/target-os-1::chromiumos", style=bold];
+  "sys-apps/attr-2.5.1::portage-stable" -> "host:sys-devel/gcc-10.2.0::portage-stable" [label="BDEPEND", style=solid, color=blue];
+  "virtual/target-os-1::chromiumos" -> "sys-apps/attr-2.5.1::portage-stable" [label="RDEPEND", style=dashed];
+}
+"#
+        );
+    }
+
+    #[test]
+    fn test_render_json() -> Result<()> {
+        let value: serde_json::Value = serde_json::from_str(&render_json(&sample_graph())?)?;
+        assert_eq!(
+            value,
+            json!([
+                {
+                    "package": "sys-apps/attr-2.5.1::portage-stable",
+                    "overlay": "portage-stable",
+                    "host": false,
+                    "root": false,
+                    "dependencies": [
+                        {
+                            "package": "host:sys-devel/gcc-10.2.0::portage-stable",
+                            "kind": "BDEPEND",
+                        },
+                    ],
+                },
+                {
+                    "package": "host:sys-devel/gcc-10.2.0::portage-stable",
+                    "overlay": "portage-stable",
+                    "host": true,
+                    "root": false,
+                    "dependencies": [],
+                },
+                {
+                    "package": "virtual/target-os-1::chromiumos",
+                    "overlay": "chromiumos",
+                    "host": false,
+                    "root": true,
+                    "dependencies": [
+                        {
+                            "package": "sys-apps/attr-2.5.1::portage-stable",
+                            "kind": "RDEPEND",
+                        },
+                    ],
+                },
+            ])
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_check_overlays() {
+        let graph = sample_graph();
+        assert!(check_overlays(&graph, &["portage-stable".to_string()]).is_ok());
+
+        let err = check_overlays(&graph, &["chromiumos".to_string()]).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Dependencies come from overlays not in --allowed-overlays:
+  host:sys-devel/gcc-10.2.0::portage-stable (BDEPEND of sys-apps/attr-2.5.1::portage-stable)
+  sys-apps/attr-2.5.1::portage-stable (RDEPEND of virtual/target-os-1::chromiumos)"
+        );
+    }
+
+    #[test]
+    fn test_quote_dot() {
+        assert_eq!(quote_dot(r#"a"b\c"#), r#""a\"b\\c""#);
+    }
+}
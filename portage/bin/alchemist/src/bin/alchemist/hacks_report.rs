@@ -0,0 +1,346 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{collections::BTreeMap, fmt::Write as _, path::PathBuf};
+
+use alchemist::{
+    analyze::dependency::direct::{
+        find_packages_added_by_hack, DependencyKind, ExtraDependency, EXTRA_DEPENDENCIES,
+    },
+    ebuild::{MaybePackageDetails, PackageDetails},
+};
+use anyhow::{Context, Result};
+use serde::Serialize;
+
+use crate::alchemist::TargetData;
+
+/// Output format of the report.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, clap::ValueEnum)]
+pub enum Format {
+    /// Human-readable text.
+    Text,
+    /// JSON.
+    Json,
+}
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Output format.
+    #[arg(long, value_enum, default_value = "text")]
+    format: Format,
+
+    /// Output path. If unset, the report is printed to stdout.
+    #[arg(long, value_name = "PATH")]
+    output: Option<PathBuf>,
+}
+
+/// Whether a hack is still needed.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "snake_case")]
+enum Status {
+    /// No package in the overlays matches the hack, e.g. because the package
+    /// was upgraded. The hack can be removed.
+    Unused,
+    /// Ebuilds of all matching packages declare the dependencies by
+    /// themselves. The hack can be removed.
+    Redundant,
+    /// The hack adds dependencies that ebuilds don't declare.
+    Required,
+    /// Dependencies of some matching packages failed to resolve.
+    Failed,
+    /// The hack applies only when cross-compiling, but the target is not
+    /// cross-compiled.
+    Skipped,
+}
+
+impl Status {
+    fn name(self) -> &'static str {
+        match self {
+            Self::Unused => "unused",
+            Self::Redundant => "redundant",
+            Self::Required => "required",
+            Self::Failed => "failed",
+            Self::Skipped => "skipped",
+        }
+    }
+
+    fn is_removable(self) -> bool {
+        matches!(self, Self::Unused | Self::Redundant)
+    }
+}
+
+/// The result of re-testing a hack against the current overlays.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+struct HackResult {
+    package: &'static str,
+    kind: &'static str,
+    deps: &'static str,
+    cross_compile_only: bool,
+    status: Status,
+    /// Packages added only by the hack, keyed by matching packages.
+    added: BTreeMap<String, Vec<String>>,
+    /// Errors keyed by matching packages.
+    errors: BTreeMap<String, String>,
+}
+
+fn kind_name(kind: DependencyKind) -> &'static str {
+    match kind {
+        DependencyKind::BuildTarget => "DEPEND",
+        DependencyKind::RunTarget => "RDEPEND",
+        DependencyKind::PostTarget => "PDEPEND",
+        DependencyKind::BuildHost => "BDEPEND",
+        DependencyKind::InstallHost => "IDEPEND",
+    }
+}
+
+fn package_name(details: &PackageDetails) -> String {
+    let basic_data = details.as_basic_data();
+    format!(
+        "{}-{}::{}",
+        basic_data.package_name, basic_data.version, basic_data.repo_name
+    )
+}
+
+/// Summarizes the outcomes of re-testing a hack against matching packages.
+///
+/// Each outcome is either the list of packages added only by the hack, or an
+/// error message. `outcomes` is None if the hack is not applicable.
+fn summarize(
+    hack: &ExtraDependency,
+    outcomes: Option<Vec<(String, Result<Vec<String>, String>)>>,
+) -> HackResult {
+    let mut result = HackResult {
+        package: hack.package,
+        kind: kind_name(hack.kind),
+        deps: hack.deps,
+        cross_compile_only: hack.cross_compile_only,
+        status: Status::Skipped,
+        added: BTreeMap::new(),
+        errors: BTreeMap::new(),
+    };
+    let Some(outcomes) = outcomes else {
+        return result;
+    };
+
+    let matched = !outcomes.is_empty();
+    for (package, outcome) in outcomes {
+        match outcome {
+            Ok(added) if added.is_empty() => {}
+            Ok(added) => {
+                result.added.insert(package, added);
+            }
+            Err(error) => {
+                result.errors.insert(package, error);
+            }
+        }
+    }
+    result.status = if !result.errors.is_empty() {
+        Status::Failed
+    } else if !result.added.is_empty() {
+        Status::Required
+    } else if matched {
+        Status::Redundant
+    } else {
+        Status::Unused
+    };
+    result
+}
+
+fn check_hack(
+    hack: &ExtraDependency,
+    packages: &[&PackageDetails],
+    cross_compile: bool,
+    host: &TargetData,
+    data: &TargetData,
+) -> HackResult {
+    if hack.cross_compile_only && !cross_compile {
+        return summarize(hack, None);
+    }
+    let outcomes = packages
+        .iter()
+        .filter(|details| hack.matches(details))
+        .map(|details| {
+            let outcome =
+                find_packages_added_by_hack(details, hack, &host.resolver, &data.resolver)
+                    .map(|added| added.iter().map(|added| package_name(added)).collect())
+                    .map_err(|err| format!("{err:#}"));
+            (package_name(details), outcome)
+        })
+        .collect();
+    summarize(hack, Some(outcomes))
+}
+
+fn render_text(results: &[HackResult]) -> String {
+    let mut out = String::new();
+
+    let removable = results
+        .iter()
+        .filter(|result| result.status.is_removable())
+        .count();
+    writeln!(
+        out,
+        "{} of {} hacks can be removed.",
+        removable,
+        results.len()
+    )
+    .unwrap();
+
+    let mut results: Vec<_> = results.iter().collect();
+    results.sort_by_key(|result| result.status);
+    for result in results {
+        writeln!(out).unwrap();
+        writeln!(
+            out,
+            "[{}] {} {}: {}",
+            result.status.name(),
+            result.package,
+            result.kind,
+            result.deps
+        )
+        .unwrap();
+        for (package, added) in &result.added {
+            writeln!(out, "  {package} adds {}", added.join(" ")).unwrap();
+        }
+        for (package, error) in &result.errors {
+            writeln!(out, "  {package}: {error}").unwrap();
+        }
+    }
+
+    out
+}
+
+/// The entry point of "hacks-report" subcommand.
+pub fn hacks_report_main(host: &TargetData, target: Option<&TargetData>, args: Args) -> Result<()> {
+    let cross_compile = match target {
+        Some(target) => {
+            let cbuild = host
+                .config
+                .env()
+                .get("CHOST")
+                .context("host is missing CHOST")?;
+            let chost = target
+                .config
+                .env()
+                .get("CHOST")
+                .context("target is missing CHOST")?;
+            cbuild != chost
+        }
+        None => false,
+    };
+
+    let data = target.unwrap_or(host);
+    let packages = data.resolver.find_all_packages()?;
+    let packages: Vec<&PackageDetails> = packages
+        .iter()
+        .filter_map(|package| match package {
+            MaybePackageDetails::Ok(details) => Some(details.as_ref()),
+            MaybePackageDetails::Err(_) => None,
+        })
+        .collect();
+
+    let results: Vec<HackResult> = EXTRA_DEPENDENCIES
+        .iter()
+        .map(|hack| check_hack(hack, &packages, cross_compile, host, data))
+        .collect();
+
+    let contents = match args.format {
+        Format::Text => render_text(&results),
+        Format::Json => serde_json::to_string_pretty(&results)?,
+    };
+    match &args.output {
+        Some(path) => std::fs::write(path, contents)
+            .with_context(|| format!("Failed to write {}", path.display()))?,
+        None => print!("{contents}"),
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const HACK: ExtraDependency = ExtraDependency {
+        package: "sys-fs/fuse-2.9.8",
+        kind: DependencyKind::BuildHost,
+        cross_compile_only: false,
+        deps: "sys-devel/automake sys-devel/gettext",
+    };
+
+    #[test]
+    fn test_summarize() {
+        assert_eq!(summarize(&HACK, None).status, Status::Skipped);
+        assert_eq!(summarize(&HACK, Some(vec![])).status, Status::Unused);
+        assert_eq!(
+            summarize(
+                &HACK,
+                Some(vec![(
+                    "sys-fs/fuse-2.9.8-r5::portage-stable".into(),
+                    Ok(vec![])
+                )])
+            )
+            .status,
+            Status::Redundant
+        );
+
+        let result = summarize(
+            &HACK,
+            Some(vec![
+                ("sys-fs/fuse-2.9.8-r5::portage-stable".into(), Ok(vec![])),
+                (
+                    "sys-fs/fuse-2.9.8-r6::chromiumos".into(),
+                    Ok(vec!["sys-devel/gettext-0.22.4::portage-stable".into()]),
+                ),
+            ]),
+        );
+        assert_eq!(result.status, Status::Required);
+        assert_eq!(
+            result.added,
+            BTreeMap::from([(
+                "sys-fs/fuse-2.9.8-r6::chromiumos".to_string(),
+                vec!["sys-devel/gettext-0.22.4::portage-stable".to_string()]
+            )])
+        );
+
+        let result = summarize(
+            &HACK,
+            Some(vec![(
+                "sys-fs/fuse-2.9.8-r5::portage-stable".into(),
+                Err("No package satisfies sys-devel/gettext".into()),
+            )]),
+        );
+        assert_eq!(result.status, Status::Failed);
+    }
+
+    #[test]
+    fn test_render_text() {
+        let results = vec![
+            summarize(
+                &HACK,
+                Some(vec![(
+                    "sys-fs/fuse-2.9.8-r5::portage-stable".into(),
+                    Ok(vec!["sys-devel/gettext-0.22.4::portage-stable".into()]),
+                )]),
+            ),
+            summarize(
+                &ExtraDependency {
+                    package: "dev-libs/libdaemon-0.14",
+                    kind: DependencyKind::BuildHost,
+                    cross_compile_only: false,
+                    deps: "sys-devel/gnuconfig",
+                },
+                Some(vec![]),
+            ),
+        ];
+        assert_eq!(
+            render_text(&results),
+            "1 of 2 hacks can be removed.
+
+[unused] dev-libs/libdaemon-0.14 BDEPEND: sys-devel/gnuconfig
+
+[required] sys-fs/fuse-2.9.8 BDEPEND: sys-devel/automake sys-devel/gettext
+  sys-fs/fuse-2.9.8-r5::portage-stable adds sys-devel/gettext-0.22.4::portage-stable
+"
+        );
+    }
+}
@@ -0,0 +1,475 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{BTreeMap, HashSet},
+    io::Write,
+    path::PathBuf,
+    process::Command,
+};
+
+use alchemist::ebuild::{MaybePackageDetails, PackageDetails};
+use anyhow::{bail, Context, Result};
+use itertools::Itertools;
+
+use crate::{alchemist::TargetData, generate_repo::common::package_details_to_target_path};
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// URL of a binhost directory containing a Portage `Packages` index, e.g.
+    /// gs://chromeos-prebuilt/board/amd64-generic/postsubmit-.../packages.
+    /// Can be specified multiple times; earlier binhosts take precedence.
+    #[arg(long, value_name = "URL", required = true)]
+    binhost: Vec<String>,
+
+    /// Output path of a JSON file mapping ebuild target labels to prebuilt
+    /// binary package URLs.
+    #[arg(long, value_name = "PATH")]
+    output: PathBuf,
+
+    /// Optional output path of a bazelrc file that sets the prebuilt flags of
+    /// the found packages under `--config=prebuilts`.
+    #[arg(long, value_name = "PATH")]
+    output_bazelrc: Option<PathBuf>,
+}
+
+/// A binary package entry in a binhost `Packages` index.
+#[derive(Clone, Debug, PartialEq, Eq)]
+struct BinhostPackage {
+    /// The package name and version, e.g. "sys-apps/attr-2.5.1".
+    cpv: String,
+    /// USE flags enabled on building the package.
+    use_flags: HashSet<String>,
+    /// IUSE of the package, without default markers. Not all binhosts
+    /// record it.
+    iuse: Option<HashSet<String>>,
+    /// The build ID used to distinguish multiple instances of the same CPV.
+    build_id: u64,
+    /// The URL of the binary package.
+    url: String,
+}
+
+/// Parses a Portage `Packages` index file of a binhost.
+fn parse_packages_index(binhost: &str, contents: &str) -> Result<Vec<BinhostPackage>> {
+    let binhost = binhost.trim_end_matches('/');
+    alchemist::packages_index::parse_packages_index(contents)?
+        .into_iter()
+        .map(|fields| {
+            let cpv = *fields.get("CPV").context("Package entry is missing CPV")?;
+            let split_flags = |value: &str| -> HashSet<String> {
+                value
+                    .split_ascii_whitespace()
+                    .map(|flag| flag.trim_start_matches(['+', '-']).to_string())
+                    .collect()
+            };
+            let build_id = match fields.get("BUILD_ID") {
+                Some(value) => value
+                    .parse()
+                    .with_context(|| format!("{cpv}: invalid BUILD_ID {value:?}"))?,
+                None => 0,
+            };
+            let path = match fields.get("PATH") {
+                Some(path) => path.to_string(),
+                None => format!("{cpv}.tbz2"),
+            };
+            Ok(BinhostPackage {
+                cpv: cpv.to_string(),
+                use_flags: split_flags(fields.get("USE").copied().unwrap_or_default()),
+                iuse: fields.get("IUSE").map(|value| split_flags(value)),
+                build_id,
+                url: format!("{binhost}/{path}"),
+            })
+        })
+        .collect()
+}
+
+/// Downloads the `Packages` index of a binhost.
+fn fetch_packages_index(binhost: &str) -> Result<String> {
+    let url = format!("{}/Packages", binhost.trim_end_matches('/'));
+    let mut command = if url.starts_with("gs://") {
+        let mut command = Command::new("gsutil");
+        command.args(["cat", &url]);
+        command
+    } else if url.starts_with("http://") || url.starts_with("https://") {
+        let mut command = Command::new("wget");
+        command.args(["-q", "-O", "-", &url]);
+        command
+    } else {
+        bail!("Unsupported binhost URL: {binhost}");
+    };
+    let output = command
+        .output()
+        .with_context(|| format!("Failed to run {:?}", command.get_program()))?;
+    if !output.status.success() {
+        bail!(
+            "Failed to download {url}: {}\n{}",
+            output.status,
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    String::from_utf8(output.stdout).with_context(|| format!("{url} is not UTF-8"))
+}
+
+/// Checks if a binary package was built with the same configuration as the
+/// package to build.
+fn is_compatible(details: &PackageDetails, prebuilt: &BinhostPackage) -> bool {
+    // Our USE map covers the effective IUSE, which includes implicit flags
+    // such as arch flags. If the binary package records IUSE, compare flags
+    // declared there only; a flag unknown to us means the ebuild has changed.
+    let effective_iuse: HashSet<&str> = details.use_map.keys().map(|flag| flag.as_str()).collect();
+    let iuse: HashSet<&str> = match &prebuilt.iuse {
+        Some(prebuilt_iuse) => {
+            let prebuilt_iuse: HashSet<&str> =
+                prebuilt_iuse.iter().map(|flag| flag.as_str()).collect();
+            if !prebuilt_iuse.is_subset(&effective_iuse) {
+                return false;
+            }
+            prebuilt_iuse
+        }
+        None => effective_iuse,
+    };
+    let expected_use: HashSet<&str> = details
+        .use_map
+        .iter()
+        .filter(|(flag, enabled)| **enabled && iuse.contains(flag.as_str()))
+        .map(|(flag, _)| flag.as_str())
+        .collect();
+    let actual_use: HashSet<&str> = prebuilt
+        .use_flags
+        .iter()
+        .map(|flag| flag.as_str())
+        .filter(|flag| iuse.contains(flag))
+        .collect();
+    expected_use == actual_use
+}
+
+/// Finds prebuilt binary packages usable for the given packages, and returns
+/// a map from ebuild target labels to their URLs.
+///
+/// `binhosts` must be ordered by precedence. If a binhost has multiple
+/// compatible instances of a package, the one with the largest build ID is
+/// chosen.
+fn find_prebuilts(
+    packages: &[MaybePackageDetails],
+    binhosts: &[Vec<BinhostPackage>],
+    prefix: &str,
+) -> BTreeMap<String, String> {
+    let binhost_maps = binhosts
+        .iter()
+        .map(|prebuilts| prebuilts.iter().into_group_map_by(|p| p.cpv.as_str()))
+        .collect_vec();
+
+    packages
+        .iter()
+        .filter_map(|package| match package {
+            MaybePackageDetails::Ok(details) => Some(details),
+            MaybePackageDetails::Err(_) => None,
+        })
+        .filter_map(|details| {
+            let cpv = format!(
+                "{}-{}",
+                details.as_basic_data().package_name,
+                details.as_basic_data().version
+            );
+            let prebuilt = binhost_maps.iter().find_map(|prebuilts| {
+                prebuilts
+                    .get(cpv.as_str())?
+                    .iter()
+                    .filter(|prebuilt| is_compatible(details, prebuilt))
+                    .max_by_key(|prebuilt| prebuilt.build_id)
+            })?;
+            Some((
+                format!(
+                    "@portage{}",
+                    package_details_to_target_path(details, prefix)
+                ),
+                prebuilt.url.clone(),
+            ))
+        })
+        .collect()
+}
+
+/// The entry point of "lookup-prebuilts" subcommand.
+pub fn lookup_prebuilts_main(
+    host: &TargetData,
+    target: Option<&TargetData>,
+    args: Args,
+) -> Result<()> {
+    // Keep in sync with the prefixes used by generate_stages.
+    let (data, prefix) = match target {
+        Some(target) => (target, "stage2/target/board"),
+        None => (host, "stage2/host"),
+    };
+
+    let binhosts = args
+        .binhost
+        .iter()
+        .map(|binhost| {
+            eprintln!("Fetching the package index of {binhost}...");
+            let contents = fetch_packages_index(binhost)?;
+            parse_packages_index(binhost, &contents)
+                .with_context(|| format!("Failed to parse the package index of {binhost}"))
+        })
+        .collect::<Result<Vec<_>>>()?;
+
+    let packages = data.resolver.find_all_packages()?;
+    let prebuilts = find_prebuilts(&packages, &binhosts, prefix);
+    eprintln!(
+        "Found prebuilts for {} of {} packages",
+        prebuilts.len(),
+        packages.len()
+    );
+
+    std::fs::write(&args.output, serde_json::to_string_pretty(&prebuilts)?)
+        .with_context(|| format!("Failed to write {}", args.output.display()))?;
+
+    if let Some(path) = &args.output_bazelrc {
+        let mut file = std::fs::File::create(path)
+            .with_context(|| format!("Failed to create {}", path.display()))?;
+        for (label, url) in prebuilts.iter() {
+            writeln!(file, "build:prebuilts --{label}_prebuilt={url}")?;
+        }
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{collections::HashMap, path::PathBuf, sync::Arc};
+
+    use alchemist::{
+        bash::vars::BashVars,
+        data::{Slot, UseMap},
+        ebuild::{
+            metadata::{EBuildBasicData, EBuildMetadata, MaybeEBuildMetadata},
+            PackageLoadError, PackageReadiness,
+        },
+    };
+    use version::Version;
+
+    use super::*;
+
+    const PACKAGES: &str = "ARCH: amd64
+PACKAGES: 3
+VERSION: 0
+
+BUILD_ID: 1
+CPV: sys-apps/attr-2.5.1
+IUSE: debug +nls static-libs
+USE: amd64 elibc_glibc nls
+PATH: sys-apps/attr/attr-2.5.1-1.xpak
+
+BUILD_ID: 2
+CPV: sys-apps/attr-2.5.1
+IUSE: debug +nls static-libs
+USE: amd64 nls static-libs
+PATH: sys-apps/attr/attr-2.5.1-2.xpak
+
+CPV: sys-libs/zlib-1.2.13
+USE: amd64
+";
+
+    fn flags(flags: &[&str]) -> HashSet<String> {
+        flags.iter().map(|flag| flag.to_string()).collect()
+    }
+
+    fn new_package(cpv: &str, use_map: &[(&str, bool)]) -> PackageDetails {
+        let (package_name, version) = Version::from_str_suffix(cpv).unwrap();
+        let (category_name, short_package_name) = package_name.split_once('/').unwrap();
+        PackageDetails {
+            metadata: Arc::new(EBuildMetadata {
+                basic_data: EBuildBasicData {
+                    repo_name: "chromiumos".to_owned(),
+                    ebuild_path: PathBuf::from(format!(
+                        "/overlay/{package_name}/{short_package_name}-{version}.ebuild"
+                    )),
+                    package_name: package_name.to_owned(),
+                    short_package_name: short_package_name.to_owned(),
+                    category_name: category_name.to_owned(),
+                    version,
+                },
+                vars: BashVars::new(HashMap::new()),
+            }),
+            slot: Slot::new("0"),
+            use_map: use_map
+                .iter()
+                .map(|(flag, enabled)| (flag.to_string(), *enabled))
+                .collect::<UseMap>(),
+            stable: true,
+            readiness: PackageReadiness::Ok,
+            inherited: HashSet::new(),
+            inherit_paths: vec![],
+            direct_build_target: None,
+            bazel_metadata: Default::default(),
+        }
+    }
+
+    fn new_prebuilt(
+        cpv: &str,
+        use_flags: &[&str],
+        iuse: Option<&[&str]>,
+        build_id: u64,
+    ) -> BinhostPackage {
+        BinhostPackage {
+            cpv: cpv.into(),
+            use_flags: flags(use_flags),
+            iuse: iuse.map(flags),
+            build_id,
+            url: format!("gs://binhost/{cpv}-{build_id}.xpak"),
+        }
+    }
+
+    #[test]
+    fn test_parse_packages_index() -> Result<()> {
+        let packages = parse_packages_index("gs://binhost/packages/", PACKAGES)?;
+        assert_eq!(
+            packages,
+            vec![
+                BinhostPackage {
+                    cpv: "sys-apps/attr-2.5.1".into(),
+                    use_flags: flags(&["amd64", "elibc_glibc", "nls"]),
+                    iuse: Some(flags(&["debug", "nls", "static-libs"])),
+                    build_id: 1,
+                    url: "gs://binhost/packages/sys-apps/attr/attr-2.5.1-1.xpak".into(),
+                },
+                BinhostPackage {
+                    cpv: "sys-apps/attr-2.5.1".into(),
+                    use_flags: flags(&["amd64", "nls", "static-libs"]),
+                    iuse: Some(flags(&["debug", "nls", "static-libs"])),
+                    build_id: 2,
+                    url: "gs://binhost/packages/sys-apps/attr/attr-2.5.1-2.xpak".into(),
+                },
+                BinhostPackage {
+                    cpv: "sys-libs/zlib-1.2.13".into(),
+                    use_flags: flags(&["amd64"]),
+                    iuse: None,
+                    build_id: 0,
+                    url: "gs://binhost/packages/sys-libs/zlib-1.2.13.tbz2".into(),
+                },
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse_packages_index_errors() {
+        assert!(parse_packages_index("gs://binhost", "").is_err());
+        assert!(parse_packages_index("gs://binhost", "VERSION: 0\n\nUSE: amd64\n").is_err());
+        assert!(
+            parse_packages_index("gs://binhost", "VERSION: 0\n\nCPV: a/b-1\nBUILD_ID: x\n")
+                .is_err()
+        );
+    }
+
+    #[test]
+    fn test_is_compatible() {
+        let details = new_package(
+            "sys-apps/attr-2.5.1",
+            &[
+                ("amd64", true),
+                ("arm", false),
+                ("debug", false),
+                ("nls", true),
+                ("static-libs", false),
+            ],
+        );
+        let iuse: &[&str] = &["debug", "nls", "static-libs"];
+
+        // Flags outside IUSE recorded by the binhost are ignored.
+        assert!(is_compatible(
+            &details,
+            &new_prebuilt(
+                "sys-apps/attr-2.5.1",
+                &["nls", "elibc_glibc"],
+                Some(iuse),
+                1
+            )
+        ));
+        // A flag in IUSE is enabled differently.
+        assert!(!is_compatible(
+            &details,
+            &new_prebuilt(
+                "sys-apps/attr-2.5.1",
+                &["nls", "static-libs"],
+                Some(iuse),
+                1
+            )
+        ));
+        assert!(!is_compatible(
+            &details,
+            &new_prebuilt("sys-apps/attr-2.5.1", &[], Some(iuse), 1)
+        ));
+        // The binhost knows a flag the ebuild doesn't declare anymore.
+        assert!(!is_compatible(
+            &details,
+            &new_prebuilt(
+                "sys-apps/attr-2.5.1",
+                &["nls"],
+                Some(&["debug", "nls", "static-libs", "xattr"]),
+                1
+            )
+        ));
+        // Without IUSE, all flags in the effective IUSE are compared.
+        assert!(is_compatible(
+            &details,
+            &new_prebuilt("sys-apps/attr-2.5.1", &["amd64", "nls"], None, 1)
+        ));
+        assert!(!is_compatible(
+            &details,
+            &new_prebuilt("sys-apps/attr-2.5.1", &["nls"], None, 1)
+        ));
+    }
+
+    #[test]
+    fn test_find_prebuilts() {
+        let attr = new_package("sys-apps/attr-2.5.1", &[("nls", true)]);
+        let zlib = new_package("sys-libs/zlib-1.2.13", &[("static-libs", false)]);
+        let acl = new_package("sys-apps/acl-2.3.1", &[]);
+        let broken = MaybePackageDetails::Err(Arc::new(PackageLoadError {
+            metadata: MaybeEBuildMetadata::Ok(new_package("sys-apps/broken-1", &[]).metadata),
+            error: "broken".into(),
+        }));
+        let packages = vec![
+            MaybePackageDetails::Ok(Arc::new(attr)),
+            MaybePackageDetails::Ok(Arc::new(zlib)),
+            MaybePackageDetails::Ok(Arc::new(acl)),
+            broken,
+        ];
+        let binhosts = vec![
+            vec![
+                // The largest build ID among compatible instances wins.
+                new_prebuilt("sys-apps/attr-2.5.1", &["nls"], None, 1),
+                new_prebuilt("sys-apps/attr-2.5.1", &["nls"], None, 3),
+                new_prebuilt("sys-apps/attr-2.5.1", &[], None, 4),
+                // Incompatible instances fall back to later binhosts.
+                new_prebuilt("sys-libs/zlib-1.2.13", &["static-libs"], None, 1),
+                new_prebuilt("sys-apps/broken-1", &[], None, 1),
+            ],
+            vec![
+                new_prebuilt("sys-apps/attr-2.5.1", &["nls"], None, 5),
+                new_prebuilt("sys-libs/zlib-1.2.13", &[], None, 2),
+                new_prebuilt("sys-apps/acl-2.3.0", &[], None, 1),
+            ],
+        ];
+
+        let prebuilts = find_prebuilts(&packages, &binhosts, "stage2/host");
+
+        assert_eq!(
+            prebuilts,
+            BTreeMap::from([
+                (
+                    "@portage//internal/packages/stage2/host/chromiumos/sys-apps/attr:2.5.1"
+                        .to_string(),
+                    "gs://binhost/sys-apps/attr-2.5.1-3.xpak".to_string(),
+                ),
+                (
+                    "@portage//internal/packages/stage2/host/chromiumos/sys-libs/zlib:1.2.13"
+                        .to_string(),
+                    "gs://binhost/sys-libs/zlib-1.2.13-2.xpak".to_string(),
+                ),
+            ])
+        );
+    }
+}
@@ -3,12 +3,21 @@
 // found in the LICENSE file.
 
 mod alchemist;
+mod depdiff;
 mod digest_repo;
 mod dump_package;
 mod dump_profile;
+mod eclass_report;
+mod generate_md5_cache;
 mod generate_repo;
+mod graph;
+mod hacks_report;
+mod lookup_prebuilts;
+mod plan_subset;
+mod query;
 mod ver_rs;
 mod ver_test;
+mod watch;
 
 use std::process::ExitCode;
 
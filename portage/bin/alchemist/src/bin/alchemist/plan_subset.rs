@@ -0,0 +1,514 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{HashMap, HashSet},
+    fmt::Write as _,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use alchemist::{
+    analyze::dependency::direct::{analyze_direct_dependencies, DependencyKind},
+    dependency::package::PackageAtom,
+    ebuild::PackageDetails,
+};
+use anyhow::{Context, Result};
+use serde::Serialize;
+use version::Version;
+
+use crate::{alchemist::TargetData, generate_repo::common::package_details_to_target_path};
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Packages installed in the existing sysroot. This is either a text file
+    /// listing "<category>/<package>-<version>" per line, or a sysroot
+    /// directory whose installed package database is read.
+    #[arg(long, value_name = "PATH")]
+    installed: PathBuf,
+
+    /// Output path of a Bazel target pattern file listing the ebuild targets
+    /// to build, to be passed to `bazel build --target_pattern_file`.
+    #[arg(long, value_name = "PATH")]
+    output_targets: PathBuf,
+
+    /// Optional output path of a JSON install plan listing the packages to
+    /// install to the sysroot in order.
+    #[arg(long, value_name = "PATH")]
+    output_plan: Option<PathBuf>,
+
+    /// Packages to deploy to the image, e.g. "chromeos-base/shill". They are
+    /// always rebuilt.
+    #[arg(required = true)]
+    packages: Vec<String>,
+}
+
+/// Why a package needs to be built and installed.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case", tag = "kind")]
+enum Reason {
+    /// The package was requested on the command line.
+    Requested,
+    /// No version of the package is installed in the sysroot.
+    NotInstalled,
+    /// A different version of the package is installed in the sysroot.
+    VersionChanged { installed: Vec<String> },
+}
+
+/// A package to build and install.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize)]
+struct PlanEntry {
+    /// The package name and version, e.g. "sys-apps/attr-2.5.1".
+    package: String,
+    /// The Bazel label of the ebuild target.
+    label: String,
+    reason: Reason,
+}
+
+/// The result of planning a subset build.
+#[derive(Debug, Default, Serialize)]
+struct Plan {
+    /// Packages to install in order, with dependencies coming first.
+    install: Vec<PlanEntry>,
+    /// The number of packages in the runtime closure that are already
+    /// installed with the same versions.
+    up_to_date: usize,
+}
+
+/// Versions of packages installed in a sysroot, keyed by package names.
+type InstalledPackages = HashMap<String, Vec<Version>>;
+
+/// Parses a list of installed packages in the form of
+/// "<category>/<package>-<version>". Empty lines and comments starting with
+/// "#" are ignored, as well as repository suffixes like "::chromiumos".
+fn parse_installed_list(contents: &str) -> Result<InstalledPackages> {
+    let mut installed = InstalledPackages::new();
+    for line in contents.lines() {
+        let line = line.split('#').next().unwrap().trim();
+        if line.is_empty() {
+            continue;
+        }
+        let cpv = line.split_once("::").map_or(line, |(cpv, _)| cpv);
+        let (package_name, version) = Version::from_str_suffix(cpv)
+            .with_context(|| format!("Invalid installed package: {line:?}"))?;
+        installed
+            .entry(package_name.to_string())
+            .or_default()
+            .push(version);
+    }
+    Ok(installed)
+}
+
+/// Lists installed packages from the package database of a sysroot.
+fn list_vdb_packages(sysroot: &Path) -> Result<String> {
+    let vdb_dir = sysroot.join("var/db/pkg");
+    let mut list = String::new();
+    for category in std::fs::read_dir(&vdb_dir)
+        .with_context(|| format!("Failed to read {}", vdb_dir.display()))?
+    {
+        let category = category?;
+        if !category.file_type()?.is_dir() {
+            continue;
+        }
+        for package in std::fs::read_dir(category.path())? {
+            let package = package?;
+            let name = package.file_name();
+            let name = name.to_string_lossy();
+            // Skip temporary directories left by interrupted merges.
+            if name.starts_with('-') || name.contains("-MERGING-") {
+                continue;
+            }
+            writeln!(list, "{}/{}", category.file_name().to_string_lossy(), name)?;
+        }
+    }
+    Ok(list)
+}
+
+fn load_installed(path: &Path) -> Result<InstalledPackages> {
+    let contents = if path.is_dir() {
+        list_vdb_packages(path)?
+    } else {
+        std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?
+    };
+    parse_installed_list(&contents)
+}
+
+/// Determines if a package needs to be built and installed.
+fn check_package(details: &PackageDetails, installed: &InstalledPackages) -> Option<Reason> {
+    let basic_data = details.as_basic_data();
+    match installed.get(&basic_data.package_name) {
+        None => Some(Reason::NotInstalled),
+        Some(versions) if versions.contains(&basic_data.version) => None,
+        Some(versions) => Some(Reason::VersionChanged {
+            installed: versions.iter().map(|v| v.to_string()).collect(),
+        }),
+    }
+}
+
+/// Computes the runtime closure of the root packages, and returns the
+/// packages in it ordered so that dependencies come first.
+///
+/// Only runtime dependencies are followed since build-time dependencies do not
+/// contribute to the image. Bazel builds them as needed anyway.
+fn runtime_closure(
+    host: &TargetData,
+    target: Option<&TargetData>,
+    roots: &[Arc<PackageDetails>],
+) -> Result<Vec<Arc<PackageDetails>>> {
+    let cross_compile = match target {
+        Some(target) => {
+            let cbuild = host
+                .config
+                .env()
+                .get("CHOST")
+                .context("host is missing CHOST")?;
+            let chost = target
+                .config
+                .env()
+                .get("CHOST")
+                .context("target is missing CHOST")?;
+            cbuild != chost
+        }
+        None => false,
+    };
+    let resolver = &target.unwrap_or(host).resolver;
+
+    dependencies_first(roots, |details| {
+        let (deps, _expressions) =
+            analyze_direct_dependencies(details, cross_compile, &host.resolver, resolver)
+                .with_context(|| {
+                    format!(
+                        "Failed to analyze dependencies of {}-{}",
+                        details.as_basic_data().package_name,
+                        details.as_basic_data().version
+                    )
+                })?;
+        Ok(deps
+            .get(DependencyKind::RunTarget)
+            .iter()
+            .chain(deps.get(DependencyKind::PostTarget).iter())
+            .cloned()
+            .collect())
+    })
+}
+
+/// Returns the packages reachable from the root packages via `get_deps`,
+/// ordered so that dependencies come first.
+///
+/// Dependencies of a package are visited in the order of their ebuild paths
+/// so that the result is deterministic.
+fn dependencies_first(
+    roots: &[Arc<PackageDetails>],
+    mut get_deps: impl FnMut(&Arc<PackageDetails>) -> Result<Vec<Arc<PackageDetails>>>,
+) -> Result<Vec<Arc<PackageDetails>>> {
+    // Iterative post-order DFS. Dependency cycles, which happen with PDEPEND,
+    // are broken at the first revisited package.
+    let mut visited = HashSet::new();
+    let mut order = Vec::new();
+    let mut stack: Vec<(Arc<PackageDetails>, Option<Vec<Arc<PackageDetails>>>)> = roots
+        .iter()
+        .rev()
+        .map(|details| (details.clone(), None))
+        .collect();
+    while let Some((details, deps)) = stack.pop() {
+        let deps = match deps {
+            Some(deps) => deps,
+            None => {
+                if !visited.insert(details.as_basic_data().ebuild_path.clone()) {
+                    continue;
+                }
+                let mut deps = get_deps(&details)?;
+                // Sort in the reverse order since dependencies are popped from
+                // the end.
+                deps.sort_by(|a, b| {
+                    b.as_basic_data()
+                        .ebuild_path
+                        .cmp(&a.as_basic_data().ebuild_path)
+                });
+                deps
+            }
+        };
+        // Visit the remaining dependencies one by one, and emit the package
+        // once all of them are done.
+        let mut deps = deps;
+        match deps.pop() {
+            Some(dep) => {
+                stack.push((details, Some(deps)));
+                if !visited.contains(&dep.as_basic_data().ebuild_path) {
+                    stack.push((dep, None));
+                }
+            }
+            None => order.push(details),
+        }
+    }
+    Ok(order)
+}
+
+/// Computes the packages to build and install from the runtime closure.
+fn make_plan(
+    closure: &[Arc<PackageDetails>],
+    roots: &[Arc<PackageDetails>],
+    installed: &InstalledPackages,
+    prefix: &str,
+) -> Plan {
+    let root_paths: HashSet<&Path> = roots
+        .iter()
+        .map(|details| details.as_basic_data().ebuild_path.as_path())
+        .collect();
+    let mut plan = Plan::default();
+    for details in closure {
+        let basic_data = details.as_basic_data();
+        let reason = if root_paths.contains(basic_data.ebuild_path.as_path()) {
+            Some(Reason::Requested)
+        } else {
+            check_package(details, installed)
+        };
+        match reason {
+            Some(reason) => plan.install.push(PlanEntry {
+                package: format!("{}-{}", basic_data.package_name, basic_data.version),
+                label: format!(
+                    "@portage{}",
+                    package_details_to_target_path(details, prefix)
+                ),
+                reason,
+            }),
+            None => plan.up_to_date += 1,
+        }
+    }
+    plan
+}
+
+/// The entry point of "plan-subset" subcommand.
+pub fn plan_subset_main(host: &TargetData, target: Option<&TargetData>, args: Args) -> Result<()> {
+    // Keep in sync with the prefixes used by generate_stages.
+    let (data, prefix) = match target {
+        Some(target) => (target, "stage2/target/board"),
+        None => (host, "stage2/host"),
+    };
+
+    let roots = args
+        .packages
+        .iter()
+        .map(|raw| {
+            let atom = raw.parse::<PackageAtom>()?;
+            data.resolver
+                .find_best_package(&atom)?
+                .with_context(|| format!("No package satisfies {atom}"))
+        })
+        .collect::<Result<Vec<_>>>()?;
+
+    let installed = load_installed(&args.installed)?;
+    let closure = runtime_closure(host, target, &roots)?;
+    let plan = make_plan(&closure, &roots, &installed, prefix);
+    eprintln!(
+        "Planned to build {} of {} packages in the runtime closure",
+        plan.install.len(),
+        closure.len()
+    );
+
+    let mut targets = String::new();
+    for entry in plan.install.iter() {
+        writeln!(targets, "{}", entry.label)?;
+    }
+    std::fs::write(&args.output_targets, targets)
+        .with_context(|| format!("Failed to write {}", args.output_targets.display()))?;
+
+    if let Some(path) = &args.output_plan {
+        std::fs::write(path, serde_json::to_string_pretty(&plan)?)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::collections::BTreeMap;
+
+    use alchemist::{
+        bash::vars::BashVars,
+        data::{Slot, UseMap},
+        ebuild::{
+            metadata::{EBuildBasicData, EBuildMetadata},
+            PackageReadiness,
+        },
+    };
+    use anyhow::bail;
+
+    use super::*;
+
+    fn new_package(cpv: &str) -> Arc<PackageDetails> {
+        let (package_name, version) = Version::from_str_suffix(cpv).unwrap();
+        let (category_name, short_package_name) = package_name.split_once('/').unwrap();
+        Arc::new(PackageDetails {
+            metadata: Arc::new(EBuildMetadata {
+                basic_data: EBuildBasicData {
+                    repo_name: "chromiumos".to_owned(),
+                    ebuild_path: PathBuf::from(format!(
+                        "/overlay/{package_name}/{short_package_name}-{version}.ebuild"
+                    )),
+                    package_name: package_name.to_owned(),
+                    short_package_name: short_package_name.to_owned(),
+                    category_name: category_name.to_owned(),
+                    version,
+                },
+                vars: BashVars::new(HashMap::new()),
+            }),
+            slot: Slot::new("0"),
+            use_map: UseMap::new(),
+            stable: true,
+            readiness: PackageReadiness::Ok,
+            inherited: HashSet::new(),
+            inherit_paths: vec![],
+            direct_build_target: None,
+            bazel_metadata: Default::default(),
+        })
+    }
+
+    fn cpvs(packages: &[Arc<PackageDetails>]) -> Vec<String> {
+        packages
+            .iter()
+            .map(|details| {
+                format!(
+                    "{}-{}",
+                    details.as_basic_data().package_name,
+                    details.as_basic_data().version
+                )
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_dependencies_first() -> Result<()> {
+        let app = new_package("chromeos-base/app-1");
+        let libc = new_package("sys-libs/glibc-2.35");
+        let ssl = new_package("dev-libs/openssl-3.0");
+        let zlib = new_package("sys-libs/zlib-1.3");
+        let tool = new_package("app-misc/tool-1");
+        // openssl and zlib depend on each other, as with PDEPEND.
+        let deps: HashMap<&Path, Vec<Arc<PackageDetails>>> = HashMap::from([
+            (
+                app.as_basic_data().ebuild_path.as_path(),
+                vec![zlib.clone(), ssl.clone()],
+            ),
+            (
+                ssl.as_basic_data().ebuild_path.as_path(),
+                vec![libc.clone(), zlib.clone()],
+            ),
+            (
+                zlib.as_basic_data().ebuild_path.as_path(),
+                vec![libc.clone(), ssl.clone()],
+            ),
+            (
+                tool.as_basic_data().ebuild_path.as_path(),
+                vec![libc.clone()],
+            ),
+        ]);
+
+        let order = dependencies_first(&[app.clone(), tool.clone()], |details| {
+            Ok(deps
+                .get(details.as_basic_data().ebuild_path.as_path())
+                .cloned()
+                .unwrap_or_default())
+        })?;
+        assert_eq!(
+            cpvs(&order),
+            vec![
+                "sys-libs/glibc-2.35",
+                "sys-libs/zlib-1.3",
+                "dev-libs/openssl-3.0",
+                "chromeos-base/app-1",
+                "app-misc/tool-1",
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_dependencies_first_error() {
+        let app = new_package("chromeos-base/app-1");
+        assert!(dependencies_first(&[app], |_| bail!("broken")).is_err());
+    }
+
+    #[test]
+    fn test_make_plan() -> Result<()> {
+        let libc = new_package("sys-libs/glibc-2.35");
+        let zlib = new_package("sys-libs/zlib-1.3");
+        let attr = new_package("sys-apps/attr-2.5.1");
+        let app = new_package("chromeos-base/app-1");
+        let closure = vec![libc, zlib, attr, app.clone()];
+        let installed = parse_installed_list(
+            "sys-libs/glibc-2.35
+             sys-libs/zlib-1.2.13
+             chromeos-base/app-1
+",
+        )?;
+
+        let plan = make_plan(&closure, &[app], &installed, "stage2/host");
+        assert_eq!(plan.up_to_date, 1);
+        assert_eq!(
+            plan.install,
+            vec![
+                PlanEntry {
+                    package: "sys-libs/zlib-1.3".to_owned(),
+                    label: "@portage//internal/packages/stage2/host/chromiumos/sys-libs/zlib:1.3"
+                        .to_owned(),
+                    reason: Reason::VersionChanged {
+                        installed: vec!["1.2.13".to_owned()],
+                    },
+                },
+                PlanEntry {
+                    package: "sys-apps/attr-2.5.1".to_owned(),
+                    label: "@portage//internal/packages/stage2/host/chromiumos/sys-apps/attr:2.5.1"
+                        .to_owned(),
+                    reason: Reason::NotInstalled,
+                },
+                PlanEntry {
+                    package: "chromeos-base/app-1".to_owned(),
+                    label: "@portage//internal/packages/stage2/host/chromiumos/chromeos-base/app:1"
+                        .to_owned(),
+                    reason: Reason::Requested,
+                },
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse_installed_list() -> Result<()> {
+        let installed = parse_installed_list(
+            "# Installed packages\n\
+             sys-apps/attr-2.5.1\n\
+             \n\
+             sys-libs/zlib-1.2.13-r1::portage-stable\n\
+             sys-libs/zlib-1.3\n",
+        )?;
+        let installed: BTreeMap<_, _> = installed
+            .into_iter()
+            .map(|(name, versions)| {
+                (
+                    name,
+                    versions.iter().map(|v| v.to_string()).collect::<Vec<_>>(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            installed,
+            BTreeMap::from([
+                ("sys-apps/attr".to_string(), vec!["2.5.1".to_string()]),
+                (
+                    "sys-libs/zlib".to_string(),
+                    vec!["1.2.13-r1".to_string(), "1.3".to_string()]
+                ),
+            ])
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse_installed_list_errors() {
+        assert!(parse_installed_list("sys-apps/attr\n").is_err());
+    }
+}
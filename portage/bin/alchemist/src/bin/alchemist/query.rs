@@ -0,0 +1,826 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{BTreeMap, BTreeSet, HashSet, VecDeque},
+    io::ErrorKind,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{bail, Context, Result};
+use serde_json::json;
+
+use crate::{
+    alchemist::TargetData,
+    graph::{build_graph, find_packages, Edge, Graph, Node},
+};
+
+/// Output format of query results.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, clap::ValueEnum)]
+pub enum Format {
+    /// Human-readable text.
+    Text,
+    /// JSON.
+    Json,
+}
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Root packages to build the dependency graph from, e.g.
+    /// "virtual/target-os". Queries only see packages reachable from them.
+    #[arg(long = "root", value_name = "ATOM", required = true)]
+    roots: Vec<String>,
+
+    /// Output format.
+    #[arg(long, value_enum, default_value = "text")]
+    format: Format,
+
+    #[command(subcommand)]
+    query: Query,
+}
+
+/// Packages in queries are package atoms, e.g. "sys-apps/attr". Prefix one
+/// with "host:" to refer to the package installed to the host (SDK) rather
+/// than the target.
+#[derive(clap::Subcommand, Clone, Debug)]
+enum Query {
+    /// Prints the dependencies of a package.
+    Deps {
+        /// Includes indirect dependencies.
+        #[arg(long)]
+        transitive: bool,
+        package: String,
+    },
+    /// Prints the packages depending on a package.
+    Rdeps {
+        /// Includes indirect reverse dependencies.
+        #[arg(long)]
+        transitive: bool,
+        package: String,
+    },
+    /// Prints a shortest dependency chain from a package to another.
+    Path { from: String, to: String },
+    /// Prints dependency chains from the root packages to a package, which
+    /// explains why the package is in the graph.
+    Why {
+        /// Maximum number of chains to print.
+        #[arg(long, value_name = "N", default_value_t = 100)]
+        max_chains: usize,
+        package: String,
+    },
+    /// Recommends failing packages to work on next.
+    ///
+    /// Prints failing packages that are unblocked, i.e. none of whose
+    /// dependencies are failing, sorted by the number of packages they
+    /// unblock, i.e. packages whose only failing dependency is the package.
+    /// Text output has tab-separated columns: the package, the number of
+    /// packages it unblocks, the number of packages depending on it, and its
+    /// owners from the nearest OWNERS file in the ebuild directory or its
+    /// ancestors up to the overlay. Failing packages in a dependency cycle
+    /// are treated as one package as they must be fixed together: they do not
+    /// block each other and are printed next to each other.
+    Next {
+        /// A file listing failing packages, one per line. Empty lines and
+        /// lines starting with "#" are ignored.
+        #[arg(long, value_name = "PATH")]
+        failing: PathBuf,
+        /// Maximum number of packages to print.
+        #[arg(long, value_name = "N")]
+        limit: Option<usize>,
+    },
+}
+
+/// A failing package recommended to work on by the "next" query.
+struct Recommendation<'a> {
+    node: &'a Node,
+    /// The number of packages whose only failing dependency is the package.
+    unblocks: usize,
+    /// The number of packages depending on the package.
+    blocks: usize,
+}
+
+/// Adjacency lists of a [`Graph`] in both directions.
+struct Index<'a> {
+    graph: &'a Graph,
+    forward: BTreeMap<&'a Node, Vec<&'a Edge>>,
+    backward: BTreeMap<&'a Node, Vec<&'a Edge>>,
+}
+
+impl<'a> Index<'a> {
+    fn new(graph: &'a Graph) -> Self {
+        let mut forward: BTreeMap<&Node, Vec<&Edge>> = BTreeMap::new();
+        let mut backward: BTreeMap<&Node, Vec<&Edge>> = BTreeMap::new();
+        for edge in &graph.edges {
+            forward.entry(&edge.from).or_default().push(edge);
+            backward.entry(&edge.to).or_default().push(edge);
+        }
+        Self {
+            graph,
+            forward,
+            backward,
+        }
+    }
+
+    fn forward(&self, node: &Node) -> &[&'a Edge] {
+        self.forward
+            .get(node)
+            .map(Vec::as_slice)
+            .unwrap_or_default()
+    }
+
+    fn backward(&self, node: &Node) -> &[&'a Edge] {
+        self.backward
+            .get(node)
+            .map(Vec::as_slice)
+            .unwrap_or_default()
+    }
+
+    /// Returns the direct dependency edges of `node`.
+    fn deps(&self, node: &Node) -> Vec<&'a Edge> {
+        self.forward(node).to_vec()
+    }
+
+    /// Returns the direct reverse dependency edges of `node`.
+    fn rdeps(&self, node: &Node) -> Vec<&'a Edge> {
+        self.backward(node).to_vec()
+    }
+
+    /// Returns nodes reachable from `node` following edges in a direction,
+    /// not including `node` itself.
+    fn reachable(&self, node: &'a Node, reverse: bool) -> BTreeSet<&'a Node> {
+        let mut found = BTreeSet::new();
+        let mut queue = VecDeque::from([node]);
+        while let Some(current) = queue.pop_front() {
+            let edges = if reverse {
+                self.backward(current)
+            } else {
+                self.forward(current)
+            };
+            for edge in edges {
+                let next = if reverse { &edge.from } else { &edge.to };
+                if next != node && found.insert(next) {
+                    queue.push_back(next);
+                }
+            }
+        }
+        found
+    }
+
+    /// Returns a shortest chain of edges from `from` to `to`.
+    fn path(&self, from: &'a Node, to: &'a Node) -> Option<Vec<&'a Edge>> {
+        let mut parents: BTreeMap<&Node, &Edge> = BTreeMap::new();
+        let mut visited = HashSet::from([from]);
+        let mut queue = VecDeque::from([from]);
+        while let Some(current) = queue.pop_front() {
+            if current == to {
+                let mut chain = Vec::new();
+                let mut node = to;
+                while let Some(edge) = parents.get(node) {
+                    chain.push(*edge);
+                    node = &edge.from;
+                }
+                chain.reverse();
+                return Some(chain);
+            }
+            for edge in self.forward(current) {
+                if visited.insert(&edge.to) {
+                    parents.insert(&edge.to, edge);
+                    queue.push_back(&edge.to);
+                }
+            }
+        }
+        None
+    }
+
+    /// Returns up to `max_chains` dependency chains without cycles from the
+    /// root packages to `to`. Returns an empty chain if `to` is a root.
+    fn why(&self, to: &'a Node, max_chains: usize) -> Vec<Vec<&'a Edge>> {
+        // Only follow nodes that can reach the destination, otherwise the
+        // search would explore the whole graph.
+        let mut relevant = self.reachable(to, true);
+        relevant.insert(to);
+
+        let mut chains = Vec::new();
+        for root in &self.graph.roots {
+            if relevant.contains(root) {
+                let mut chain = Vec::new();
+                let mut on_chain = HashSet::from([root]);
+                self.collect_chains(
+                    root,
+                    to,
+                    &relevant,
+                    &mut chain,
+                    &mut on_chain,
+                    &mut chains,
+                    max_chains,
+                );
+            }
+        }
+        chains
+    }
+
+    /// Returns failing packages without failing dependencies, sorted by the
+    /// number of packages they unblock in descending order.
+    ///
+    /// Failing packages in a strongly connected component are collapsed into
+    /// one, identified by its smallest node, so that a cycle of failing
+    /// packages does not block itself.
+    fn next(&self, failing: &BTreeSet<&'a Node>) -> Vec<Recommendation<'a>> {
+        // Failing packages each failing package depends on.
+        let failing_deps: BTreeMap<&Node, BTreeSet<&Node>> = failing
+            .iter()
+            .map(|node| {
+                let deps = self
+                    .reachable(node, false)
+                    .into_iter()
+                    .filter(|dep| failing.contains(dep))
+                    .collect();
+                (*node, deps)
+            })
+            .collect();
+
+        // Failing packages depending on each other are in the same component.
+        let components: BTreeMap<&Node, &Node> = failing_deps
+            .iter()
+            .map(|(node, deps)| {
+                let component = deps
+                    .iter()
+                    .copied()
+                    .filter(|dep| failing_deps[dep].contains(node))
+                    .chain([*node])
+                    .min()
+                    .unwrap();
+                (*node, component)
+            })
+            .collect();
+
+        // Failing components each package depends on, excluding its own.
+        let mut blockers: BTreeMap<&Node, BTreeSet<&Node>> = BTreeMap::new();
+        for (node, component) in &components {
+            for rdep in self.reachable(node, true) {
+                if components.get(rdep) != Some(component) {
+                    blockers.entry(rdep).or_default().insert(component);
+                }
+            }
+        }
+
+        let mut recommendations: Vec<Recommendation> = failing
+            .iter()
+            .filter(|node| !blockers.contains_key(*node))
+            .map(|node| {
+                let component = components[node];
+                let mut unblocks = 0;
+                let mut blocks = 0;
+                for nodes in blockers.values() {
+                    if nodes.contains(component) {
+                        blocks += 1;
+                        if nodes.len() == 1 {
+                            unblocks += 1;
+                        }
+                    }
+                }
+                Recommendation {
+                    node,
+                    unblocks,
+                    blocks,
+                }
+            })
+            .collect();
+        recommendations.sort_by(|a, b| {
+            b.unblocks
+                .cmp(&a.unblocks)
+                .then(b.blocks.cmp(&a.blocks))
+                .then(components[a.node].cmp(components[b.node]))
+                .then(a.node.cmp(b.node))
+        });
+        recommendations
+    }
+
+    #[allow(clippy::too_many_arguments)]
+    fn collect_chains(
+        &self,
+        current: &'a Node,
+        to: &'a Node,
+        relevant: &BTreeSet<&'a Node>,
+        chain: &mut Vec<&'a Edge>,
+        on_chain: &mut HashSet<&'a Node>,
+        chains: &mut Vec<Vec<&'a Edge>>,
+        max_chains: usize,
+    ) {
+        if chains.len() >= max_chains {
+            return;
+        }
+        if current == to {
+            chains.push(chain.clone());
+            return;
+        }
+        for edge in self.forward(current) {
+            if !relevant.contains(&edge.to) || !on_chain.insert(&edge.to) {
+                continue;
+            }
+            chain.push(edge);
+            self.collect_chains(&edge.to, to, relevant, chain, on_chain, chains, max_chains);
+            chain.pop();
+            on_chain.remove(&edge.to);
+        }
+    }
+}
+
+/// Formats a chain of edges as "a -[RDEPEND]-> b -[BDEPEND]-> c".
+fn format_chain(start: &Node, chain: &[&Edge]) -> String {
+    let mut out = start.id();
+    for edge in chain {
+        out.push_str(&format!(" -[{}]-> {}", edge.kind, edge.to.id()));
+    }
+    out
+}
+
+fn chain_to_json(start: &Node, chain: &[&Edge]) -> serde_json::Value {
+    let mut steps = vec![json!({ "package": start.id() })];
+    steps.extend(
+        chain
+            .iter()
+            .map(|edge| json!({ "package": edge.to.id(), "kind": edge.kind })),
+    );
+    json!(steps)
+}
+
+fn edges_to_json(edges: &[&Edge], reverse: bool) -> serde_json::Value {
+    json!(edges
+        .iter()
+        .map(|edge| {
+            let node = if reverse { &edge.from } else { &edge.to };
+            json!({ "package": node.id(), "kind": edge.kind })
+        })
+        .collect::<Vec<_>>())
+}
+
+/// Extracts email addresses of owners from the content of an OWNERS file.
+/// Directives such as "set noparent", "per-file" and "include" are ignored.
+fn parse_owners(contents: &str) -> Vec<String> {
+    contents
+        .lines()
+        .map(|line| line.split('#').next().unwrap_or_default().trim())
+        .filter(|line| line.contains('@') && !line.contains([' ', '=']))
+        .map(|line| line.to_owned())
+        .collect()
+}
+
+/// Returns the owners of a package listed in the nearest OWNERS file in the
+/// ebuild directory or its ancestors up to the overlay directory.
+fn find_owners(ebuild_path: &Path) -> Result<Vec<String>> {
+    // Ebuilds are at <overlay>/<category>/<package>/<package>-<version>.ebuild.
+    let overlay_dir = ebuild_path.ancestors().nth(3);
+    for dir in ebuild_path.ancestors().skip(1) {
+        let path = dir.join("OWNERS");
+        match std::fs::read_to_string(&path) {
+            Ok(contents) => {
+                let owners = parse_owners(&contents);
+                if !owners.is_empty() {
+                    return Ok(owners);
+                }
+            }
+            Err(err) if err.kind() == ErrorKind::NotFound => {}
+            Err(err) => {
+                return Err(err).with_context(|| format!("Failed to read {}", path.display()))
+            }
+        }
+        if Some(dir) == overlay_dir {
+            break;
+        }
+    }
+    Ok(Vec::new())
+}
+
+/// Reads a file listing packages, one per line. Empty lines and lines starting
+/// with "#" are ignored.
+fn read_package_list(path: &Path) -> Result<Vec<String>> {
+    let contents = std::fs::read_to_string(path)
+        .with_context(|| format!("Failed to read {}", path.display()))?;
+    Ok(contents
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(|line| line.to_owned())
+        .collect())
+}
+
+/// Runs a query against a graph and returns the output.
+///
+/// `lookup` resolves a package given by the user to a node, and `owners`
+/// returns the owners of a node.
+fn run_query<'a>(
+    graph: &'a Graph,
+    query: &Query,
+    format: Format,
+    lookup: impl Fn(&str) -> Result<&'a Node>,
+    owners: impl Fn(&Node) -> Result<Vec<String>>,
+) -> Result<String> {
+    let index = Index::new(graph);
+    let output = match query {
+        Query::Deps {
+            transitive: false,
+            package,
+        }
+        | Query::Rdeps {
+            transitive: false,
+            package,
+        } => {
+            let node = lookup(package)?;
+            let reverse = matches!(query, Query::Rdeps { .. });
+            let edges = if reverse {
+                index.rdeps(node)
+            } else {
+                index.deps(node)
+            };
+            match format {
+                Format::Text => edges
+                    .iter()
+                    .map(|edge| {
+                        let other = if reverse { &edge.from } else { &edge.to };
+                        format!("{}\t{}\n", other.id(), edge.kind)
+                    })
+                    .collect(),
+                Format::Json => serde_json::to_string_pretty(&edges_to_json(&edges, reverse))?,
+            }
+        }
+        Query::Deps {
+            transitive: true,
+            package,
+        }
+        | Query::Rdeps {
+            transitive: true,
+            package,
+        } => {
+            let node = lookup(package)?;
+            let reverse = matches!(query, Query::Rdeps { .. });
+            let nodes = index.reachable(node, reverse);
+            match format {
+                Format::Text => nodes
+                    .iter()
+                    .map(|node| format!("{}\n", node.id()))
+                    .collect(),
+                Format::Json => serde_json::to_string_pretty(&json!(nodes
+                    .iter()
+                    .map(|node| node.id())
+                    .collect::<Vec<_>>()))?,
+            }
+        }
+        Query::Path { from, to } => {
+            let from = lookup(from)?;
+            let to = lookup(to)?;
+            let Some(chain) = index.path(from, to) else {
+                bail!("{} does not depend on {}", from.id(), to.id());
+            };
+            match format {
+                Format::Text => format!("{}\n", format_chain(from, &chain)),
+                Format::Json => serde_json::to_string_pretty(&chain_to_json(from, &chain))?,
+            }
+        }
+        Query::Why {
+            max_chains,
+            package,
+        } => {
+            let node = lookup(package)?;
+            let chains = index.why(node, *max_chains);
+            let start = |chain: &[&'a Edge]| chain.first().map_or(node, |edge| &edge.from);
+            match format {
+                Format::Text => chains
+                    .iter()
+                    .map(|chain| format!("{}\n", format_chain(start(chain), chain)))
+                    .collect(),
+                Format::Json => serde_json::to_string_pretty(&json!(chains
+                    .iter()
+                    .map(|chain| chain_to_json(start(chain), chain))
+                    .collect::<Vec<_>>()))?,
+            }
+        }
+        Query::Next { failing, limit } => {
+            let mut nodes = BTreeSet::new();
+            for package in read_package_list(failing)? {
+                // Failing packages may be out of the graph of the root
+                // packages.
+                match lookup(&package) {
+                    Ok(node) => {
+                        nodes.insert(node);
+                    }
+                    Err(err) => eprintln!("WARNING: Ignoring {package}: {err:#}"),
+                }
+            }
+            let mut recommendations = index.next(&nodes);
+            recommendations.truncate(limit.unwrap_or(usize::MAX));
+            let recommendations = recommendations
+                .into_iter()
+                .map(|r| Ok((owners(r.node)?, r)))
+                .collect::<Result<Vec<_>>>()?;
+            match format {
+                Format::Text => recommendations
+                    .iter()
+                    .map(|(owners, r)| {
+                        format!(
+                            "{}\t{}\t{}\t{}\n",
+                            r.node.id(),
+                            r.unblocks,
+                            r.blocks,
+                            owners.join(",")
+                        )
+                    })
+                    .collect(),
+                Format::Json => serde_json::to_string_pretty(&json!(recommendations
+                    .iter()
+                    .map(|(owners, r)| json!({
+                        "package": r.node.id(),
+                        "unblocks": r.unblocks,
+                        "blocks": r.blocks,
+                        "owners": owners,
+                    }))
+                    .collect::<Vec<_>>()))?,
+            }
+        }
+    };
+    Ok(output)
+}
+
+/// The entry point of "query" subcommand.
+pub fn query_main(host: &TargetData, target: Option<&TargetData>, args: Args) -> Result<()> {
+    let roots = find_packages(&target.unwrap_or(host).resolver, &args.roots)?;
+    let graph = build_graph(host, target, &roots, None)?;
+
+    let lookup = |raw: &str| -> Result<&Node> {
+        let (data, atom, is_host) = match raw.strip_prefix("host:") {
+            Some(atom) if target.is_some() => (host, atom, true),
+            Some(atom) => (host, atom, false),
+            None => (target.unwrap_or(host), raw, false),
+        };
+        let details = find_packages(&data.resolver, &[atom.to_owned()])?
+            .pop()
+            .unwrap();
+        let node = Node::new(&details, is_host);
+        match graph.nodes.get(&node) {
+            Some(node) => Ok(node),
+            None => bail!("{} is not reachable from the root packages", node.id()),
+        }
+    };
+
+    let owners = |node: &Node| -> Result<Vec<String>> {
+        match graph.ebuild_paths.get(node) {
+            Some(ebuild_path) => find_owners(ebuild_path),
+            None => Ok(Vec::new()),
+        }
+    };
+
+    print!(
+        "{}",
+        run_query(&graph, &args.query, args.format, lookup, owners)?
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn node(name: &str) -> Node {
+        Node {
+            name: name.to_string(),
+            host: false,
+        }
+    }
+
+    fn edge(from: &str, to: &str, kind: &'static str) -> Edge {
+        Edge {
+            from: node(from),
+            to: node(to),
+            kind,
+        }
+    }
+
+    /// Returns a graph like:
+    ///
+    ///   os -> shell -> libc
+    ///   os -> net -> libc
+    ///   net -> shell
+    fn sample_graph() -> Graph {
+        Graph {
+            roots: BTreeSet::from([node("os")]),
+            nodes: ["os", "shell", "net", "libc"]
+                .into_iter()
+                .map(node)
+                .collect(),
+            edges: BTreeSet::from([
+                edge("os", "shell", "RDEPEND"),
+                edge("os", "net", "RDEPEND"),
+                edge("shell", "libc", "DEPEND"),
+                edge("net", "libc", "DEPEND"),
+                edge("net", "shell", "RDEPEND"),
+            ]),
+            ebuild_paths: BTreeMap::new(),
+        }
+    }
+
+    fn query(graph: &Graph, query: Query, format: Format) -> Result<String> {
+        run_query(
+            graph,
+            &query,
+            format,
+            |name| {
+                graph
+                    .nodes
+                    .iter()
+                    .find(|node| node.name == name)
+                    .ok_or_else(|| anyhow::anyhow!("{name} not found"))
+            },
+            |node| Ok(vec![format!("{}@example.com", node.name)]),
+        )
+    }
+
+    #[test]
+    fn test_deps() -> Result<()> {
+        let graph = sample_graph();
+        let deps = |transitive, package: &str| {
+            query(
+                &graph,
+                Query::Deps {
+                    transitive,
+                    package: package.to_string(),
+                },
+                Format::Text,
+            )
+        };
+        assert_eq!(deps(false, "net")?, "libc\tDEPEND\nshell\tRDEPEND\n");
+        assert_eq!(deps(true, "net")?, "libc\nshell\n");
+        assert_eq!(deps(true, "libc")?, "");
+        Ok(())
+    }
+
+    #[test]
+    fn test_rdeps() -> Result<()> {
+        let graph = sample_graph();
+        let rdeps = |transitive, package: &str| {
+            query(
+                &graph,
+                Query::Rdeps {
+                    transitive,
+                    package: package.to_string(),
+                },
+                Format::Text,
+            )
+        };
+        assert_eq!(rdeps(false, "shell")?, "net\tRDEPEND\nos\tRDEPEND\n");
+        assert_eq!(rdeps(true, "libc")?, "net\nos\nshell\n");
+        assert_eq!(rdeps(true, "os")?, "");
+        Ok(())
+    }
+
+    #[test]
+    fn test_path() -> Result<()> {
+        let graph = sample_graph();
+        assert_eq!(
+            query(
+                &graph,
+                Query::Path {
+                    from: "os".to_string(),
+                    to: "libc".to_string(),
+                },
+                Format::Text,
+            )?,
+            "os -[RDEPEND]-> net -[DEPEND]-> libc\n"
+        );
+        assert!(query(
+            &graph,
+            Query::Path {
+                from: "libc".to_string(),
+                to: "os".to_string(),
+            },
+            Format::Text,
+        )
+        .is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_why() -> Result<()> {
+        let graph = sample_graph();
+        let why = |max_chains, format| {
+            query(
+                &graph,
+                Query::Why {
+                    max_chains,
+                    package: "libc".to_string(),
+                },
+                format,
+            )
+        };
+        assert_eq!(
+            why(100, Format::Text)?,
+            "os -[RDEPEND]-> net -[DEPEND]-> libc
+os -[RDEPEND]-> net -[RDEPEND]-> shell -[DEPEND]-> libc
+os -[RDEPEND]-> shell -[DEPEND]-> libc
+"
+        );
+        assert_eq!(
+            why(1, Format::Text)?,
+            "os -[RDEPEND]-> net -[DEPEND]-> libc\n"
+        );
+
+        let value: serde_json::Value = serde_json::from_str(&why(1, Format::Json)?)?;
+        assert_eq!(
+            value,
+            json!([[
+                { "package": "os" },
+                { "package": "net", "kind": "RDEPEND" },
+                { "package": "libc", "kind": "DEPEND" },
+            ]])
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_next() -> Result<()> {
+        let graph = sample_graph();
+        let dir = tempfile::tempdir()?;
+        let failing = dir.path().join("failing.txt");
+        let next = |packages: &str, limit, format| -> Result<String> {
+            std::fs::write(&failing, packages)?;
+            query(
+                &graph,
+                Query::Next {
+                    failing: failing.clone(),
+                    limit,
+                },
+                format,
+            )
+        };
+
+        // net is blocked by libc. Fixing libc unblocks shell and net, but not
+        // os, which also depends on the failing net.
+        assert_eq!(
+            next("# comment\n\nlibc\nnet\nunknown\n", None, Format::Text)?,
+            "libc\t2\t3\tlibc@example.com\n"
+        );
+        assert_eq!(
+            next("net\nshell\n", None, Format::Text)?,
+            "shell\t1\t2\tshell@example.com\n"
+        );
+        assert_eq!(next("libc\n", Some(0), Format::Text)?, "");
+
+        let value: serde_json::Value = serde_json::from_str(&next("libc\n", None, Format::Json)?)?;
+        assert_eq!(
+            value,
+            json!([{
+                "package": "libc",
+                "unblocks": 3,
+                "blocks": 3,
+                "owners": ["libc@example.com"],
+            }])
+        );
+
+        // shell and net depend on each other, so fixing both unblocks os.
+        let mut graph = sample_graph();
+        graph.edges.insert(edge("shell", "net", "PDEPEND"));
+        std::fs::write(&failing, "net\nshell\n")?;
+        assert_eq!(
+            query(
+                &graph,
+                Query::Next {
+                    failing: failing.clone(),
+                    limit: None,
+                },
+                Format::Text,
+            )?,
+            "net\t1\t1\tnet@example.com\nshell\t1\t1\tshell@example.com\n"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_find_owners() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let overlay = dir.path().join("overlay");
+        let ebuild_path = overlay.join("sys-apps/attr/attr-2.5.1.ebuild");
+        std::fs::create_dir_all(ebuild_path.parent().unwrap())?;
+        std::fs::write(dir.path().join("OWNERS"), "root@example.com\n")?;
+        std::fs::write(
+            overlay.join("OWNERS"),
+            "set noparent\n# Overlay owners\nfoo@example.com\nbar@example.com  # backup\n",
+        )?;
+        assert_eq!(
+            find_owners(&ebuild_path)?,
+            ["foo@example.com", "bar@example.com"]
+        );
+
+        // Package owners take precedence.
+        std::fs::write(
+            overlay.join("sys-apps/attr/OWNERS"),
+            "per-file *.patch=baz@example.com\nattr@example.com\n",
+        )?;
+        assert_eq!(find_owners(&ebuild_path)?, ["attr@example.com"]);
+
+        // OWNERS files outside the overlay are not consulted.
+        std::fs::remove_file(overlay.join("OWNERS"))?;
+        std::fs::remove_file(overlay.join("sys-apps/attr/OWNERS"))?;
+        assert!(find_owners(&ebuild_path)?.is_empty());
+        Ok(())
+    }
+}
@@ -12,11 +12,15 @@ ALCHEMIST_REPO_RULE_SRCS = [
     "@@rules_rust~~crate~alchemy_crates//:BUILD.bazel",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:BUILD.bazel",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:alchemist.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:depdiff.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:digest_repo.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:dump_package.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:dump_profile.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:eclass_report.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_md5_cache.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/common.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/deps.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/deps.schema.json",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/internal/bashrcs/mod.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/internal/bashrcs/templates/bashrc.BUILD.bazel",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/internal/mod.rs",
@@ -45,9 +49,15 @@ ALCHEMIST_REPO_RULE_SRCS = [
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/public/templates/images.BUILD.bazel",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/public/templates/package.BUILD.bazel",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:generate_repo/templates/root.BUILD.bazel",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:graph.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:hacks_report.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:lookup_prebuilts.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:main.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:plan_subset.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:query.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:ver_rs.rs",
     "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:ver_test.rs",
+    "@cros//bazel/portage/bin/alchemist/src/bin/alchemist:watch.rs",
     "@cros//bazel/portage/bin/alchemist:BUILD.bazel",
     "@cros//bazel/portage/bin/alchemist:src/analyze/dependency/direct/flatten.rs",
     "@cros//bazel/portage/bin/alchemist:src/analyze/dependency/direct/hacks.rs",
@@ -58,6 +68,7 @@ ALCHEMIST_REPO_RULE_SRCS = [
     "@cros//bazel/portage/bin/alchemist:src/analyze/mod.rs",
     "@cros//bazel/portage/bin/alchemist:src/analyze/restrict.rs",
     "@cros//bazel/portage/bin/alchemist:src/analyze/source.rs",
+    "@cros//bazel/portage/bin/alchemist:src/analyze/stats.rs",
     "@cros//bazel/portage/bin/alchemist:src/analyze/tests.rs",
     "@cros//bazel/portage/bin/alchemist:src/bash/expr/eval.rs",
     "@cros//bazel/portage/bin/alchemist:src/bash/expr/mod.rs",
@@ -75,6 +86,7 @@ ALCHEMIST_REPO_RULE_SRCS = [
     "@cros//bazel/portage/bin/alchemist:src/config/miscconf/bashrc.rs",
     "@cros//bazel/portage/bin/alchemist:src/config/miscconf/mask.rs",
     "@cros//bazel/portage/bin/alchemist:src/config/miscconf/mod.rs",
+    "@cros//bazel/portage/bin/alchemist:src/config/miscconf/preferred.rs",
     "@cros//bazel/portage/bin/alchemist:src/config/miscconf/provided.rs",
     "@cros//bazel/portage/bin/alchemist:src/config/miscconf/useflags.rs",
     "@cros//bazel/portage/bin/alchemist:src/config/mod.rs",
@@ -93,11 +105,14 @@ ALCHEMIST_REPO_RULE_SRCS = [
     "@cros//bazel/portage/bin/alchemist:src/dependency/uri/mod.rs",
     "@cros//bazel/portage/bin/alchemist:src/dependency/uri/parser.rs",
     "@cros//bazel/portage/bin/alchemist:src/ebuild/ebuild_prelude.sh",
+    "@cros//bazel/portage/bin/alchemist:src/ebuild/md5_cache.rs",
     "@cros//bazel/portage/bin/alchemist:src/ebuild/metadata.rs",
+    "@cros//bazel/portage/bin/alchemist:src/ebuild/metadata_cache.rs",
     "@cros//bazel/portage/bin/alchemist:src/ebuild/mod.rs",
     "@cros//bazel/portage/bin/alchemist:src/fakechroot.rs",
     "@cros//bazel/portage/bin/alchemist:src/fileops.rs",
     "@cros//bazel/portage/bin/alchemist:src/lib.rs",
+    "@cros//bazel/portage/bin/alchemist:src/packages_index.rs",
     "@cros//bazel/portage/bin/alchemist:src/path.rs",
     "@cros//bazel/portage/bin/alchemist:src/repository.rs",
     "@cros//bazel/portage/bin/alchemist:src/resolver.rs",
@@ -113,13 +128,18 @@ ALCHEMIST_REPO_RULE_SRCS = [
     "@cros//bazel/portage/common/cliutil:src/param_file.rs",
     "@cros//bazel/portage/common/cliutil:src/stdio_redirector.rs",
     "@cros//bazel/portage/common/fileutil:BUILD.bazel",
+    "@cros//bazel/portage/common/fileutil:src/atomic.rs",
+    "@cros//bazel/portage/common/fileutil:src/copy.rs",
     "@cros//bazel/portage/common/fileutil:src/dualpath.rs",
+    "@cros//bazel/portage/common/fileutil:src/glob.rs",
     "@cros//bazel/portage/common/fileutil:src/lib.rs",
     "@cros//bazel/portage/common/fileutil:src/move.rs",
     "@cros//bazel/portage/common/fileutil:src/remove.rs",
     "@cros//bazel/portage/common/fileutil:src/symlink_forest.rs",
     "@cros//bazel/portage/common/fileutil:src/tempdir.rs",
     "@cros//bazel/portage/common/fileutil:src/xattr.rs",
+    "@cros//bazel/portage/common/portage/manifest:BUILD.bazel",
+    "@cros//bazel/portage/common/portage/manifest:src/lib.rs",
     "@cros//bazel/portage/common/portage/version:BUILD.bazel",
     "@cros//bazel/portage/common/portage/version:src/lib.rs",
     "@cros//bazel/portage/common/portage/version:src/version.rs",
@@ -0,0 +1,283 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{BTreeSet, HashMap},
+    ffi::OsString,
+    io::ErrorKind,
+    os::unix::process::CommandExt,
+    path::{Path, PathBuf},
+    process::Command,
+    time::{Duration, Instant},
+};
+
+use anyhow::{bail, Context, Result};
+use nix::{
+    errno::Errno,
+    sys::inotify::{AddWatchFlags, InitFlags, Inotify, WatchDescriptor},
+};
+use walkdir::WalkDir;
+
+/// Directories under the source checkout that contain overlays.
+const DEFAULT_WATCH_DIRS: &[&str] = &[
+    "src/overlays",
+    "src/private-overlays",
+    "src/third_party/chromiumos-overlay",
+    "src/third_party/eclass-overlay",
+    "src/third_party/portage-stable",
+];
+
+#[derive(clap::Args, Clone, Debug)]
+pub struct Args {
+    /// Directory to watch for changes. Can be specified multiple times. If
+    /// unset, overlays in the source checkout are watched.
+    #[arg(long = "watch-dir", value_name = "DIR")]
+    watch_dirs: Vec<PathBuf>,
+
+    /// Interval to check the directories for changes.
+    #[arg(long, value_name = "DURATION", default_value = "1s", value_parser = cliutil::parse_duration)]
+    interval: Duration,
+
+    /// The alchemist subcommand to run with its arguments, e.g.
+    /// "generate-repo --output-dir=... --output-repos-json=...". Global
+    /// options given before "watch" are passed to it.
+    #[arg(last = true, required = true, value_name = "COMMAND")]
+    command: Vec<OsString>,
+}
+
+/// Returns true if changes to a file or directory of the name should be
+/// ignored.
+fn is_ignored_name(name: &std::ffi::OsStr) -> bool {
+    name == ".git" || name == "md5-cache"
+}
+
+/// Returns inotify(7) events that indicate changes to the contents of a
+/// watched directory.
+fn watch_flags() -> AddWatchFlags {
+    AddWatchFlags::IN_CREATE
+        | AddWatchFlags::IN_DELETE
+        | AddWatchFlags::IN_MODIFY
+        | AddWatchFlags::IN_ATTRIB
+        | AddWatchFlags::IN_MOVED_FROM
+        | AddWatchFlags::IN_MOVED_TO
+        | AddWatchFlags::IN_DELETE_SELF
+        | AddWatchFlags::IN_ONLYDIR
+}
+
+/// Watches directory trees for changes with inotify(7).
+///
+/// Unlike polling, the cost of checking for changes doesn't grow with the
+/// size of the trees; they are walked only once, and then again only for
+/// directories newly created in them.
+struct Watcher {
+    inotify: Inotify,
+    dirs: HashMap<WatchDescriptor, PathBuf>,
+}
+
+impl Watcher {
+    fn new(dirs: &[PathBuf]) -> Result<Self> {
+        let mut watcher = Self {
+            inotify: Inotify::init(InitFlags::IN_NONBLOCK | InitFlags::IN_CLOEXEC)?,
+            dirs: HashMap::new(),
+        };
+        for dir in dirs {
+            watcher.add_tree(dir)?;
+        }
+        Ok(watcher)
+    }
+
+    /// Starts watching directories under `root`, including itself.
+    fn add_tree(&mut self, root: &Path) -> Result<()> {
+        for entry in WalkDir::new(root)
+            .into_iter()
+            .filter_entry(|entry| entry.file_type().is_dir() && !is_ignored_name(entry.file_name()))
+        {
+            let entry = match entry {
+                Ok(entry) => entry,
+                // Directories may be removed while we walk them.
+                Err(err) if err.io_error().map(|err| err.kind()) == Some(ErrorKind::NotFound) => {
+                    continue
+                }
+                Err(err) => return Err(err.into()),
+            };
+            match self.inotify.add_watch(entry.path(), watch_flags()) {
+                Ok(wd) => {
+                    self.dirs.insert(wd, entry.path().to_owned());
+                }
+                Err(Errno::ENOENT | Errno::ENOTDIR) => {}
+                Err(Errno::ENOSPC) => bail!(
+                    "Too many directories to watch; raise fs.inotify.max_user_watches with sysctl"
+                ),
+                Err(err) => {
+                    return Err(err).with_context(|| format!("Failed to watch {}", root.display()))
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns paths changed since the last call, without blocking.
+    fn changes(&mut self) -> Result<BTreeSet<PathBuf>> {
+        let mut changes = BTreeSet::new();
+        loop {
+            let events = match self.inotify.read_events() {
+                Ok(events) => events,
+                Err(Errno::EAGAIN) => return Ok(changes),
+                Err(err) => return Err(err.into()),
+            };
+            for event in events {
+                if event.mask.contains(AddWatchFlags::IN_Q_OVERFLOW) {
+                    // Events were lost, so report all trees as changed.
+                    changes.extend(self.dirs.values().cloned());
+                    continue;
+                }
+                if event.mask.contains(AddWatchFlags::IN_IGNORED) {
+                    self.dirs.remove(&event.wd);
+                    continue;
+                }
+                let Some(dir) = self.dirs.get(&event.wd) else {
+                    continue;
+                };
+                let path = match &event.name {
+                    Some(name) if is_ignored_name(name) => continue,
+                    Some(name) => dir.join(name),
+                    None => dir.clone(),
+                };
+                if event.mask.contains(AddWatchFlags::IN_ISDIR)
+                    && event
+                        .mask
+                        .intersects(AddWatchFlags::IN_CREATE | AddWatchFlags::IN_MOVED_TO)
+                {
+                    self.add_tree(&path)?;
+                }
+                changes.insert(path);
+            }
+        }
+    }
+}
+
+/// Returns the global options given before the "watch" subcommand.
+fn global_args() -> Vec<OsString> {
+    std::env::args_os()
+        .skip(1)
+        .take_while(|arg| arg != "watch")
+        .collect()
+}
+
+/// Runs the alchemist subcommand in a new process so that it loads the
+/// Portage trees afresh.
+fn run_command(args: &Args) -> Result<()> {
+    let argv0 = std::env::args_os()
+        .next()
+        .unwrap_or_else(|| "alchemist".into());
+    let start = Instant::now();
+    let status = Command::new(std::env::current_exe()?)
+        .arg0(argv0)
+        .args(global_args())
+        .args(&args.command)
+        .status()
+        .context("Failed to run alchemist")?;
+    if status.success() {
+        eprintln!("Finished in {:.1}s", start.elapsed().as_secs_f64());
+    } else {
+        eprintln!("Failed with {status}; waiting for changes");
+    }
+    Ok(())
+}
+
+/// The entry point of "watch" subcommand.
+pub fn watch_main(source_dir: &Path, args: Args) -> Result<()> {
+    let dirs: Vec<PathBuf> = if args.watch_dirs.is_empty() {
+        DEFAULT_WATCH_DIRS
+            .iter()
+            .map(|dir| source_dir.join(dir))
+            .filter(|dir| dir.is_dir())
+            .collect()
+    } else {
+        args.watch_dirs.clone()
+    };
+    if dirs.is_empty() {
+        bail!("No directories to watch; specify --watch-dir");
+    }
+    for dir in &dirs {
+        eprintln!("Watching {}", dir.display());
+    }
+
+    let mut watcher = Watcher::new(&dirs)?;
+    loop {
+        // Changes made while the command is running are detected afterwards
+        // since the watcher queues events.
+        run_command(&args)?;
+        loop {
+            std::thread::sleep(args.interval);
+            let changes = watcher.changes()?;
+            if let Some(path) = changes.first() {
+                if changes.len() == 1 {
+                    eprintln!("Detected changes in {}", path.display());
+                } else {
+                    eprintln!(
+                        "Detected changes in {} and {} more",
+                        path.display(),
+                        changes.len() - 1
+                    );
+                }
+                eprintln!("Running alchemist again");
+                break;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_watcher() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.path();
+        std::fs::create_dir_all(dir.join("sys-apps/attr"))?;
+        std::fs::write(dir.join("sys-apps/attr/attr-1.ebuild"), "EAPI=7\n")?;
+
+        let mut watcher = Watcher::new(&[dir.to_owned()])?;
+        assert_eq!(watcher.changes()?, BTreeSet::new());
+
+        // Files in .git and md5-cache are ignored.
+        std::fs::create_dir_all(dir.join(".git"))?;
+        std::fs::write(dir.join(".git/index"), "")?;
+        std::fs::create_dir_all(dir.join("metadata"))?;
+        assert_eq!(watcher.changes()?, BTreeSet::from([dir.join("metadata")]));
+        std::fs::create_dir_all(dir.join("metadata/md5-cache"))?;
+        std::fs::write(dir.join("metadata/md5-cache/attr-1"), "EAPI=7\n")?;
+        assert_eq!(watcher.changes()?, BTreeSet::new());
+
+        // Modifying a file is detected.
+        std::fs::write(dir.join("sys-apps/attr/attr-1.ebuild"), "EAPI=8\n")?;
+        assert_eq!(
+            watcher.changes()?,
+            BTreeSet::from([dir.join("sys-apps/attr/attr-1.ebuild")])
+        );
+
+        // Files in new directories are watched.
+        std::fs::create_dir_all(dir.join("sys-apps/acl/files"))?;
+        assert_eq!(
+            watcher.changes()?,
+            BTreeSet::from([dir.join("sys-apps/acl")])
+        );
+        std::fs::write(dir.join("sys-apps/acl/files/fix.patch"), "")?;
+        assert_eq!(
+            watcher.changes()?,
+            BTreeSet::from([dir.join("sys-apps/acl/files/fix.patch")])
+        );
+
+        // Removing a file is detected.
+        std::fs::remove_file(dir.join("sys-apps/acl/files/fix.patch"))?;
+        assert_eq!(
+            watcher.changes()?,
+            BTreeSet::from([dir.join("sys-apps/acl/files/fix.patch")])
+        );
+
+        Ok(())
+    }
+}
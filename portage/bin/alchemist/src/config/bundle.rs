@@ -109,6 +109,17 @@ pub enum IsPackageAcceptedResult {
     Accepted { stable: bool },
 }
 
+/// A value assigned to a variable by a [`ConfigNode`].
+///
+/// This is returned by [`ConfigBundle::var_contributions`].
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct VarContribution<'a> {
+    /// Paths to the files that provided the value.
+    pub sources: &'a [PathBuf],
+    /// The value just as it's defined in the files.
+    pub value: &'a str,
+}
+
 /// A collection of [`ConfigNode`]s, providing access to the configurations
 /// computed from them.
 #[derive(Clone, Debug)]
@@ -371,24 +382,48 @@ impl ConfigBundle {
     }
 
     /// Returns if a package is masked by package.mask and friends.
+    ///
+    /// Mask and unmask entries are applied in the order of configuration
+    /// sources, with "-atom" entries cancelling earlier ones of the same kind,
+    /// and the last entry matching a package decides whether it is masked.
+    /// Thus masks in the override source, which comes last, are never
+    /// defeated by unmasks in profiles.
     pub fn is_package_masked(&self, package: &PackageRef) -> bool {
-        let status = self
-            .nodes
+        let mut entries = Vec::new();
+        for update in self.nodes.iter().flat_map(|node| match &node.value {
+            ConfigNodeValue::PackageMasks(updates) => updates.as_slice(),
+            _ => &[],
+        }) {
+            match update.kind {
+                PackageMaskKind::Mask => entries.push((true, &update.atom)),
+                PackageMaskKind::Unmask => entries.push((false, &update.atom)),
+                PackageMaskKind::RemoveMask => {
+                    entries.retain(|(masked, atom)| !*masked || *atom != &update.atom)
+                }
+                PackageMaskKind::RemoveUnmask => {
+                    entries.retain(|(masked, atom)| *masked || *atom != &update.atom)
+                }
+            }
+        }
+        entries
+            .iter()
+            .rev()
+            .find(|(_, atom)| atom.matches(package))
+            .is_some_and(|(masked, _)| *masked)
+    }
+
+    /// Checks if a package is preferred by package.preferred.
+    ///
+    /// Preferred packages are picked over other alternatives in any-of
+    /// dependencies, e.g. to choose the provider of a virtual package.
+    pub fn is_package_preferred(&self, package: &PackageRef) -> bool {
+        self.nodes
             .iter()
             .flat_map(|node| match &node.value {
-                ConfigNodeValue::PackageMasks(updates) => updates.as_slice(),
+                ConfigNodeValue::PreferredPackages(atoms) => atoms.as_slice(),
                 _ => &[],
             })
-            .filter_map(|update| {
-                if update.atom.matches(package) {
-                    Some(update.kind)
-                } else {
-                    None
-                }
-            })
-            .last()
-            .unwrap_or(PackageMaskKind::Unmask);
-        status == PackageMaskKind::Mask
+            .any(|atom| atom.matches(package))
     }
 
     /// Returns a list of package declared as "provided" by package.provided.
@@ -396,6 +431,32 @@ impl ConfigBundle {
         &self.provided_packages
     }
 
+    /// Returns the values assigned to a variable by configuration nodes in the
+    /// order they're evaluated.
+    ///
+    /// This is useful to find out which configuration files affect the final
+    /// value of a variable. If the variable is incremental (see
+    /// [`ConfigBundle::is_incremental_variable`]), its tokens are merged in
+    /// this order; otherwise the last value wins.
+    pub fn var_contributions(&self, name: &str) -> Vec<VarContribution> {
+        self.nodes
+            .iter()
+            .filter_map(|node| match &node.value {
+                ConfigNodeValue::Vars(vars) => vars.get(name).map(|value| VarContribution {
+                    sources: &node.sources,
+                    value,
+                }),
+                _ => None,
+            })
+            .collect()
+    }
+
+    /// Checks if a variable is incremental, i.e. its value is computed by
+    /// merging tokens of all values assigned to it.
+    pub fn is_incremental_variable(&self, name: &str) -> bool {
+        name == "USE" || name == "ACCEPT_KEYWORDS" || self.incremental_variables.contains_key(name)
+    }
+
     /// Returns a list of all the configuration sources.
     pub fn sources(&self) -> Vec<&Path> {
         self.nodes
@@ -707,8 +768,10 @@ mod tests {
     use lazy_static::lazy_static;
 
     use crate::{
+        bash::vars::BashValue,
         config::{
-            AcceptKeywordsUpdate, PackageBashrc, SimpleConfigSource, UseUpdate, UseUpdateFilter,
+            AcceptKeywordsUpdate, PackageBashrc, PackageMaskUpdate, SimpleConfigSource, UseUpdate,
+            UseUpdateFilter,
         },
         dependency::package::PackageAtom,
     };
@@ -845,6 +908,52 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_var_contributions() -> Result<()> {
+        let bundle = ConfigBundle::from_sources(vec![SimpleConfigSource::new(vec![
+            ConfigNode {
+                sources: vec![PathBuf::from("a/make.defaults")],
+                value: ConfigNodeValue::Vars(HashMap::from([
+                    ("CFLAGS".to_owned(), "-O2".to_owned()),
+                    ("USE_EXPAND".to_owned(), "FOO".to_owned()),
+                ])),
+            },
+            ConfigNode {
+                sources: vec![PathBuf::from("b/package.use")],
+                value: ConfigNodeValue::Uses(vec![]),
+            },
+            ConfigNode {
+                sources: vec![PathBuf::from("c/make.conf")],
+                value: ConfigNodeValue::Vars(HashMap::from([(
+                    "CFLAGS".to_owned(),
+                    "-O2 -g".to_owned(),
+                )])),
+            },
+        ])]);
+
+        assert_eq!(
+            bundle.var_contributions("CFLAGS"),
+            vec![
+                VarContribution {
+                    sources: &[PathBuf::from("a/make.defaults")],
+                    value: "-O2",
+                },
+                VarContribution {
+                    sources: &[PathBuf::from("c/make.conf")],
+                    value: "-O2 -g",
+                },
+            ]
+        );
+        assert_eq!(bundle.var_contributions("NO_SUCH_VAR"), vec![]);
+
+        assert!(!bundle.is_incremental_variable("CFLAGS"));
+        assert!(bundle.is_incremental_variable("USE"));
+        assert!(bundle.is_incremental_variable("USE_EXPAND"));
+        assert!(bundle.is_incremental_variable("FOO"));
+
+        Ok(())
+    }
+
     #[test]
     fn test_is_keyword_accepted() -> Result<()> {
         // "**" matches with anything including empty keywords.
@@ -1081,6 +1190,104 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_stable_use_mask_and_force() -> Result<()> {
+        let bundle = ConfigBundle::from_sources(vec![SimpleConfigSource::new(vec![
+            ConfigNode {
+                sources: vec![PathBuf::from("use.stable.mask")],
+                value: ConfigNodeValue::Uses(vec![UseUpdate {
+                    kind: UseUpdateKind::Mask,
+                    filter: UseUpdateFilter {
+                        atom: None,
+                        stable_only: true,
+                    },
+                    use_tokens: "bar".to_string(),
+                }]),
+            },
+            ConfigNode {
+                sources: vec![PathBuf::from("package.use.stable.force")],
+                value: ConfigNodeValue::Uses(vec![UseUpdate {
+                    kind: UseUpdateKind::Force,
+                    filter: UseUpdateFilter {
+                        atom: Some(PackageAtom::from_str("aaa/bbb")?),
+                        stable_only: true,
+                    },
+                    use_tokens: "foo".to_string(),
+                }]),
+            },
+            ConfigNode {
+                sources: vec![PathBuf::from("package.use.stable.mask")],
+                value: ConfigNodeValue::Uses(vec![UseUpdate {
+                    kind: UseUpdateKind::Mask,
+                    filter: UseUpdateFilter {
+                        atom: Some(PackageAtom::from_str("aaa/other")?),
+                        stable_only: true,
+                    },
+                    use_tokens: "baz".to_string(),
+                }]),
+            },
+        ])]);
+
+        let iuse = HashMap::from([
+            ("foo".to_string(), false),
+            ("bar".to_string(), true),
+            ("baz".to_string(), true),
+        ]);
+        let slot = Slot::<String>::new("0");
+
+        // Stable restrictions apply to stable packages only.
+        let stable_use_map = bundle.compute_use_map("aaa/bbb", &VERSION_9999, true, &slot, &iuse);
+        assert_eq!(
+            stable_use_map,
+            UseMap::from([
+                ("foo".to_string(), true),
+                ("bar".to_string(), false),
+                ("baz".to_string(), true),
+            ])
+        );
+
+        let unstable_use_map =
+            bundle.compute_use_map("aaa/bbb", &VERSION_9999, false, &slot, &iuse);
+        assert_eq!(
+            unstable_use_map,
+            UseMap::from([
+                ("foo".to_string(), false),
+                ("bar".to_string(), true),
+                ("baz".to_string(), true),
+            ])
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_is_package_accepted_stable() -> Result<()> {
+        let bundle = ConfigBundle::from_sources(vec![SimpleConfigSource::new(vec![ConfigNode {
+            sources: vec![PathBuf::from("make.defaults")],
+            value: ConfigNodeValue::Vars(HashMap::from([
+                ("ARCH".to_owned(), "amd64".to_owned()),
+                ("ACCEPT_KEYWORDS".to_owned(), "amd64 ~amd64".to_owned()),
+            ])),
+        }])]);
+
+        let is_stable = |keywords: &str| -> Result<Option<bool>> {
+            let vars = BashVars::from_iter([(
+                "KEYWORDS".to_owned(),
+                BashValue::Scalar(keywords.to_owned()),
+            )]);
+            Ok(match bundle.is_package_accepted(&vars, &PACKAGE_REF_A)? {
+                IsPackageAcceptedResult::Accepted { stable } => Some(stable),
+                IsPackageAcceptedResult::Unaccepted { .. } => None,
+            })
+        };
+
+        assert_eq!(is_stable("amd64")?, Some(true));
+        assert_eq!(is_stable("~amd64")?, Some(false));
+        assert_eq!(is_stable("~arm64")?, None);
+
+        Ok(())
+    }
+
     #[test]
     fn test_features() -> Result<()> {
         let bundle = ConfigBundle::from_sources(vec![SimpleConfigSource::new(vec![
@@ -1189,4 +1396,110 @@ mod tests {
 
         Ok(())
     }
+
+    #[test]
+    fn test_is_package_masked() -> Result<()> {
+        let masks = |sources: &str, updates: &[(PackageMaskKind, &str)]| -> Result<ConfigNode> {
+            Ok(ConfigNode {
+                sources: vec![PathBuf::from(sources)],
+                value: ConfigNodeValue::PackageMasks(
+                    updates
+                        .iter()
+                        .map(|(kind, atom)| {
+                            Ok(PackageMaskUpdate {
+                                kind: *kind,
+                                atom: atom.parse()?,
+                            })
+                        })
+                        .collect::<Result<_>>()?,
+                ),
+            })
+        };
+        let bundle = ConfigBundle::from_sources(vec![SimpleConfigSource::new(vec![
+            // Repository-level profiles/package.mask.
+            masks(
+                "overlay/profiles/package.mask",
+                &[
+                    (PackageMaskKind::Mask, "pkg/a"),
+                    (PackageMaskKind::Mask, ">=pkg/b-2"),
+                    (PackageMaskKind::Mask, "pkg/c"),
+                ],
+            )?,
+            // A profile cancels a mask and unmasks a version.
+            masks(
+                "profile/package.mask",
+                &[(PackageMaskKind::RemoveMask, "pkg/a")],
+            )?,
+            masks(
+                "profile/package.unmask",
+                &[
+                    (PackageMaskKind::Unmask, "=pkg/b-2"),
+                    (PackageMaskKind::Unmask, "pkg/d"),
+                ],
+            )?,
+            // Later entries take precedence over earlier ones.
+            masks(
+                "etc/portage/package.mask",
+                &[(PackageMaskKind::Mask, "<pkg/b-2")],
+            )?,
+            masks(
+                "etc/portage/package.unmask",
+                &[(PackageMaskKind::Unmask, "pkg/c")],
+            )?,
+            // Masks in the override source are not defeated by the profile.
+            masks("", &[(PackageMaskKind::Mask, "=pkg/d-9999")])?,
+        ])]);
+
+        let is_masked = |package_name: &str, version: &str| -> Result<bool> {
+            Ok(bundle.is_package_masked(&PackageRef {
+                package_name,
+                version: &version.parse()?,
+                slot: None,
+                use_map: None,
+                readiness: None,
+            }))
+        };
+
+        assert!(!is_masked("pkg/a", "1")?);
+        assert!(is_masked("pkg/b", "1")?);
+        assert!(!is_masked("pkg/b", "2")?);
+        assert!(is_masked("pkg/b", "3")?);
+        assert!(!is_masked("pkg/c", "1")?);
+        assert!(!is_masked("pkg/d", "1")?);
+        assert!(is_masked("pkg/d", "9999")?);
+        assert!(!is_masked("pkg/e", "1")?);
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_is_package_preferred() -> Result<()> {
+        let bundle = ConfigBundle::from_sources(vec![SimpleConfigSource::new(vec![
+            ConfigNode {
+                sources: vec![PathBuf::from("profile/package.preferred")],
+                value: ConfigNodeValue::PreferredPackages(vec!["app-editors/vim".parse()?]),
+            },
+            ConfigNode {
+                sources: vec![PathBuf::from("etc/portage/package.preferred")],
+                value: ConfigNodeValue::PreferredPackages(vec![">=sys-apps/busybox-2".parse()?]),
+            },
+        ])]);
+
+        let is_preferred = |package_name: &str, version: &str| -> Result<bool> {
+            Ok(bundle.is_package_preferred(&PackageRef {
+                package_name,
+                version: &version.parse()?,
+                slot: None,
+                use_map: None,
+                readiness: None,
+            }))
+        };
+
+        assert!(is_preferred("app-editors/vim", "9.0")?);
+        assert!(!is_preferred("app-editors/nano", "7.2")?);
+        assert!(is_preferred("sys-apps/busybox", "2.1")?);
+        assert!(!is_preferred("sys-apps/busybox", "1.36")?);
+
+        Ok(())
+    }
 }
@@ -73,6 +73,16 @@ pub fn load_accept_keywords_configs(dir: &Path) -> Result<Vec<ConfigNode>> {
     load_accept_keywords_configs_internal(dir.join("package.accept_keywords"))
 }
 
+/// Loads package.keywords in the specified directory in the same way as
+/// [`load_accept_keywords_configs`].
+///
+/// package.keywords is the deprecated name of package.accept_keywords that
+/// Portage still honors in /etc/portage, applying it before
+/// package.accept_keywords.
+pub fn load_legacy_keywords_configs(dir: &Path) -> Result<Vec<ConfigNode>> {
+    load_accept_keywords_configs_internal(dir.join("package.keywords"))
+}
+
 #[cfg(test)]
 mod tests {
     use std::str::FromStr;
@@ -147,4 +157,31 @@ mod tests {
         );
         Ok(())
     }
+
+    #[test]
+    fn test_load_legacy_keywords_configs() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        write_files(
+            dir,
+            [
+                ("package.keywords", "pkg/a ~amd64"),
+                ("package.accept_keywords", "pkg/b"),
+            ],
+        )?;
+
+        let nodes = load_legacy_keywords_configs(dir)?;
+        assert_eq!(
+            vec![ConfigNode {
+                sources: vec![dir.join("package.keywords")],
+                value: ConfigNodeValue::AcceptKeywords(vec![AcceptKeywordsUpdate {
+                    atom: PackageAtom::from_str("pkg/a").unwrap(),
+                    accept_keywords: "~amd64".to_owned(),
+                }]),
+            },],
+            nodes
+        );
+        Ok(())
+    }
 }
@@ -5,6 +5,8 @@
 use anyhow::{bail, Result};
 use anyhow::{ensure, Context};
 use itertools::Itertools;
+use once_cell::sync::Lazy;
+use regex::Regex;
 use std::fs::read_to_string;
 use std::path::{Path, PathBuf};
 use std::vec;
@@ -121,6 +123,80 @@ fn load_package_bashrc(dir: &Path) -> Result<Vec<ConfigNode>> {
     Ok(nodes)
 }
 
+/// Variables that affect package metadata computed statically from ebuilds,
+/// e.g. dependencies and sources.
+const METADATA_VARIABLES: &[&str] = &[
+    "BDEPEND",
+    "DEPEND",
+    "IDEPEND",
+    "IUSE",
+    "KEYWORDS",
+    "LICENSE",
+    "PDEPEND",
+    "PROPERTIES",
+    "RDEPEND",
+    "REQUIRED_USE",
+    "RESTRICT",
+    "SLOT",
+    "SRC_URI",
+];
+
+/// Prefixes of variables that affect package metadata. CROS_WORKON_*
+/// variables determine the source code checked out for cros-workon packages.
+const METADATA_VARIABLE_PREFIXES: &[&str] = &["CROS_WORKON_"];
+
+/// Matches a variable assignment, possibly with a builtin declaring it, e.g.
+/// `DEPEND+=" foo"`, `export SLOT=0`, `CROS_WORKON_SUBTREE[1]=bar`.
+static ASSIGNMENT_RE: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(
+        r"(?:^|[\s;&|({])(?:(?:export|local|declare|typeset|readonly)(?:\s+-\w+)*\s+)?([A-Z_][A-Z0-9_]*)(?:\[[^\]]*\])?\+?=",
+    )
+    .unwrap()
+});
+
+/// An assignment to a variable affecting package metadata found in a bashrc
+/// file.
+#[derive(Clone, Debug, Eq, Ord, PartialEq, PartialOrd)]
+pub struct MetadataAssignment {
+    /// The 1-based line number.
+    pub line: usize,
+    pub variable: String,
+}
+
+fn is_metadata_variable(name: &str) -> bool {
+    METADATA_VARIABLES.contains(&name)
+        || METADATA_VARIABLE_PREFIXES
+            .iter()
+            .any(|prefix| name.starts_with(prefix))
+}
+
+/// Finds assignments to variables affecting package metadata in the contents
+/// of a bashrc file.
+///
+/// bashrc files are executed only when packages are built, so such
+/// assignments make the build diverge from the statically computed metadata.
+/// This is a best-effort scan of the source code without evaluating it, so
+/// assignments made indirectly, e.g. with `eval`, are not detected.
+pub fn find_metadata_assignments(contents: &str) -> Vec<MetadataAssignment> {
+    let mut assignments = vec![];
+    for (lineno, line) in contents.lines().enumerate() {
+        let line = line.trim_start();
+        if line.starts_with('#') {
+            continue;
+        }
+        for caps in ASSIGNMENT_RE.captures_iter(line) {
+            let variable = &caps[1];
+            if is_metadata_variable(variable) {
+                assignments.push(MetadataAssignment {
+                    line: lineno + 1,
+                    variable: variable.to_string(),
+                });
+            }
+        }
+    }
+    assignments
+}
+
 #[cfg(test)]
 mod tests {
     use crate::testutils::write_files;
@@ -241,4 +317,41 @@ cross-arm-none-eabi/gcc cross-arm-none-eabi/gcc.sh cross-arm-none-eabi/other.sh
         );
         Ok(())
     }
+
+    #[test]
+    fn test_find_metadata_assignments() {
+        let assignments = find_metadata_assignments(
+            r#"
+# DEPEND="commented out"
+cros_pre_src_prepare_hack() {
+    DEPEND+=" dev-libs/foo"
+    export CROS_WORKON_COMMIT="deadbeef"; RDEPEND="${DEPEND}"
+    CROS_WORKON_SUBTREE[1]=bar
+    local MY_DEPEND=x
+    ECONF_EXTRA=x
+}
+"#,
+        );
+        assert_eq!(
+            assignments,
+            vec![
+                MetadataAssignment {
+                    line: 4,
+                    variable: "DEPEND".to_string(),
+                },
+                MetadataAssignment {
+                    line: 5,
+                    variable: "CROS_WORKON_COMMIT".to_string(),
+                },
+                MetadataAssignment {
+                    line: 5,
+                    variable: "RDEPEND".to_string(),
+                },
+                MetadataAssignment {
+                    line: 6,
+                    variable: "CROS_WORKON_SUBTREE".to_string(),
+                },
+            ]
+        );
+    }
 }
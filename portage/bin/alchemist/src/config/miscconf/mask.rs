@@ -8,6 +8,7 @@ use std::{fs::read_to_string, path::Path};
 use crate::{
     config::{ConfigNode, ConfigNodeValue, PackageMaskKind, PackageMaskUpdate},
     dependency::package::PackageAtom,
+    repository::RepositorySet,
 };
 
 fn load_package_config(source: &Path, kind: PackageMaskKind) -> Result<Vec<ConfigNode>> {
@@ -43,6 +44,17 @@ fn load_package_config(source: &Path, kind: PackageMaskKind) -> Result<Vec<Confi
         .enumerate()
         .filter(|(_, line)| !line.is_empty() && !line.starts_with('#'))
     {
+        // "-atom" cancels the same atom listed earlier in the stack.
+        let (kind, line) = match line.strip_prefix('-') {
+            Some(line) => (
+                match kind {
+                    PackageMaskKind::Mask => PackageMaskKind::RemoveMask,
+                    _ => PackageMaskKind::RemoveUnmask,
+                },
+                line,
+            ),
+            None => (kind, line),
+        };
         let atom = line.trim().parse::<PackageAtom>().with_context(|| {
             format!(
                 "Failed to load {}: syntax error at line {}",
@@ -59,12 +71,27 @@ fn load_package_config(source: &Path, kind: PackageMaskKind) -> Result<Vec<Confi
     }])
 }
 
+/// Loads package.mask and package.unmask in the specified directory.
 pub fn load_package_configs(dir: &Path) -> Result<Vec<ConfigNode>> {
     let mask_nodes = load_package_config(&dir.join("package.mask"), PackageMaskKind::Mask)?;
     let unmask_nodes = load_package_config(&dir.join("package.unmask"), PackageMaskKind::Unmask)?;
     Ok([mask_nodes, unmask_nodes].concat())
 }
 
+/// Loads package.mask and package.unmask in the `profiles` directory of each
+/// repository. Portage applies them before the profile ones, regardless of the
+/// selected profile.
+pub fn load_repository_package_configs(repos: &RepositorySet) -> Result<Vec<ConfigNode>> {
+    let mut nodes = Vec::new();
+    for repo in repos.get_partially_ordered_repos() {
+        nodes.extend(
+            load_package_configs(repo.profiles_dir())
+                .with_context(|| format!("Failed to load masks of {}", repo.name()))?,
+        );
+    }
+    Ok(nodes)
+}
+
 #[cfg(test)]
 mod tests {
     use std::str::FromStr;
@@ -176,4 +203,37 @@ mod tests {
         );
         Ok(())
     }
+
+    #[test]
+    fn test_load_package_configs_removal() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        write_files(
+            dir,
+            [("package.mask", "-pkg/a"), ("package.unmask", "-=pkg/b-1")],
+        )?;
+
+        let nodes = load_package_configs(dir)?;
+        assert_eq!(
+            vec![
+                ConfigNode {
+                    sources: vec![dir.join("package.mask")],
+                    value: ConfigNodeValue::PackageMasks(vec![PackageMaskUpdate {
+                        kind: PackageMaskKind::RemoveMask,
+                        atom: PackageAtom::from_str("pkg/a")?,
+                    }]),
+                },
+                ConfigNode {
+                    sources: vec![dir.join("package.unmask")],
+                    value: ConfigNodeValue::PackageMasks(vec![PackageMaskUpdate {
+                        kind: PackageMaskKind::RemoveUnmask,
+                        atom: PackageAtom::from_str("=pkg/b-1")?,
+                    }]),
+                },
+            ],
+            nodes
+        );
+        Ok(())
+    }
 }
@@ -5,5 +5,6 @@
 pub mod accept_keywords;
 pub mod bashrc;
 pub mod mask;
+pub mod preferred;
 pub mod provided;
 pub mod useflags;
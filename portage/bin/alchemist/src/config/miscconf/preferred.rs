@@ -0,0 +1,96 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use std::{fs::read_to_string, path::Path};
+
+use crate::{
+    config::{ConfigNode, ConfigNodeValue},
+    dependency::package::PackageAtom,
+};
+
+/// Loads `package.preferred`, which lists packages to prefer when resolving
+/// any-of dependencies, e.g. the providers of virtual packages.
+///
+/// This is not a standard Portage configuration file. Portage always picks the
+/// first satisfiable alternative unless one is already installed.
+pub fn load_preferred_packages_config(dir: &Path) -> Result<Vec<ConfigNode>> {
+    let source = dir.join("package.preferred");
+
+    if !source.exists() {
+        return Ok(Vec::new());
+    }
+
+    let contents = read_to_string(&source)?;
+
+    let mut atoms = Vec::<PackageAtom>::new();
+
+    for (lineno, line) in contents
+        .split('\n')
+        .map(|line| line.trim())
+        .enumerate()
+        .filter(|(_, line)| !line.is_empty() && !line.starts_with('#'))
+    {
+        let atom = line.parse::<PackageAtom>().with_context(|| {
+            format!(
+                "Failed to load {}: syntax error at line {}",
+                source.display(),
+                lineno + 1
+            )
+        })?;
+        atoms.push(atom);
+    }
+
+    Ok(vec![ConfigNode {
+        sources: vec![source],
+        value: ConfigNodeValue::PreferredPackages(atoms),
+    }])
+}
+
+#[cfg(test)]
+mod tests {
+    use std::str::FromStr;
+
+    use crate::testutils::write_files;
+
+    use super::*;
+
+    #[test]
+    fn test_load_preferred_packages_config() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        write_files(
+            dir,
+            [(
+                "package.preferred",
+                r#"
+                    # this is a comment line
+                    app-editors/vim
+                    >=sys-apps/busybox-1.36
+                "#,
+            )],
+        )?;
+
+        let nodes = load_preferred_packages_config(dir)?;
+        assert_eq!(
+            vec![ConfigNode {
+                sources: vec![dir.join("package.preferred")],
+                value: ConfigNodeValue::PreferredPackages(vec![
+                    PackageAtom::from_str("app-editors/vim")?,
+                    PackageAtom::from_str(">=sys-apps/busybox-1.36")?,
+                ]),
+            }],
+            nodes
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_load_preferred_packages_config_missing() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        assert_eq!(load_preferred_packages_config(dir.as_ref())?, vec![]);
+        Ok(())
+    }
+}
@@ -85,6 +85,12 @@ pub enum PackageMaskKind {
     Mask,
     /// Unmasks a package.
     Unmask,
+    /// Cancels an earlier [`PackageMaskKind::Mask`] with the same atom. This is
+    /// written as "-atom" in `package.mask`.
+    RemoveMask,
+    /// Cancels an earlier [`PackageMaskKind::Unmask`] with the same atom. This
+    /// is written as "-atom" in `package.unmask`.
+    RemoveUnmask,
 }
 
 /// Represents an update of a package mask state.
@@ -129,6 +135,8 @@ pub enum ConfigNodeValue {
     PackageMasks(Vec<PackageMaskUpdate>),
     /// Updates provided packages.
     ProvidedPackages(Vec<ProvidedPackage>),
+    /// Adds packages to prefer when resolving any-of dependencies.
+    PreferredPackages(Vec<PackageAtom>),
     /// The profile.bashrc files.
     ProfileBashrc(Vec<PathBuf>),
     /// The bashrcs to execute for each package.
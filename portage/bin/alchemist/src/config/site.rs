@@ -11,8 +11,11 @@ use crate::data::Vars;
 use super::{
     makeconf::MakeConf,
     miscconf::{
-        accept_keywords::load_accept_keywords_configs, mask::load_package_configs,
-        provided::load_provided_packages_config, useflags::load_use_configs,
+        accept_keywords::{load_accept_keywords_configs, load_legacy_keywords_configs},
+        mask::load_package_configs,
+        preferred::load_preferred_packages_config,
+        provided::load_provided_packages_config,
+        useflags::load_use_configs,
     },
     ConfigNode, ConfigSource,
 };
@@ -51,10 +54,13 @@ impl SiteSettings {
             load_accept_keywords_configs(&site_profile_dir)?,
             load_use_configs(&site_profile_dir)?,
             load_provided_packages_config(&site_profile_dir)?,
+            load_preferred_packages_config(&site_profile_dir)?,
             load_package_configs(&portage_dir)?,
+            load_legacy_keywords_configs(&portage_dir)?,
             load_accept_keywords_configs(&portage_dir)?,
             load_use_configs(&portage_dir)?,
             load_provided_packages_config(&portage_dir)?,
+            load_preferred_packages_config(&portage_dir)?,
         ]
         .concat();
 
@@ -87,6 +87,20 @@ impl<'a> FromIterator<PackageRef<'a>> for PackageRefSet<'a> {
     }
 }
 
+/// Represents a slot operator in a package SLOT dependency.
+///
+/// See the PMS for the specification:
+/// https://projects.gentoo.org/pms/8/pms.html#x1-820008.3.3
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum SlotOperator {
+    /// `:*`: Any slot matches, and the slot or sub-slot of the matched package
+    /// doesn't affect the depending package.
+    Any,
+    /// `:=` or `:SLOT=`: The depending package must be rebuilt when the slot
+    /// or sub-slot of the matched package changes.
+    Rebuild,
+}
+
 /// Represents a package SLOT dependency.
 ///
 /// This is a subcomponent of [`PackageAtomDependency`].
@@ -111,6 +125,18 @@ impl PackageSlotDependency {
         self.rebuild_on_slot_change
     }
 
+    /// Returns the slot operator, or `None` if the dependency names a slot
+    /// without an operator, e.g. `:1`.
+    pub fn operator(&self) -> Option<SlotOperator> {
+        if self.rebuild_on_slot_change {
+            Some(SlotOperator::Rebuild)
+        } else if self.slot.is_none() {
+            Some(SlotOperator::Any)
+        } else {
+            None
+        }
+    }
+
     pub fn matches(&self, slot: &Slot<&str>) -> bool {
         match &self.slot {
             None => true,
@@ -302,7 +328,6 @@ impl PackageVersionDependency {
         match self.op {
             PackageVersionOp::Equal { wildcard } => {
                 if wildcard {
-                    // TODO(b/272798056): Support real wildcards.
                     version.starts_with(&self.version)
                 } else {
                     version == &self.version
@@ -792,8 +817,9 @@ mod tests {
         let test_cases = HashMap::from([
             ("sys-apps/systemd-utils", true),
             ("=sys-apps/systemd-utils-9999", true),
-            // TODO(b/272798056): Wildcard matching doesn't quite work right.
-            // ("=sys-apps/systemd-utils-9*", true),
+            ("=sys-apps/systemd-utils-9999*", true),
+            ("=sys-apps/systemd-utils-99*", false),
+            ("=sys-apps/systemd-utils-9*", false),
             ("=sys-apps/systemd-utils-1*", false),
             ("~sys-apps/systemd-utils-1", false),
             ("sys-apps/systemd-utils:1", true),
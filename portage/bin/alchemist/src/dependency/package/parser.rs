@@ -293,6 +293,8 @@ mod tests {
 
     use nom::sequence::terminated;
 
+    use crate::dependency::package::SlotOperator;
+
     use super::*;
 
     #[test]
@@ -355,6 +357,43 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_parse_blockers() -> Result<()> {
+        let expr = PackageDependencyParser::parse_atom("!sys-apps/systemd-utils")?;
+        assert_eq!(expr.block(), PackageBlock::Weak);
+        assert_eq!(expr.version(), None);
+
+        let expr = PackageDependencyParser::parse_atom("!!<sys-apps/systemd-utils-2")?;
+        assert_eq!(
+            expr,
+            PackageDependencyAtom {
+                package_name: "sys-apps/systemd-utils".to_owned(),
+                version: Some(PackageVersionDependency {
+                    op: PackageVersionOp::Less,
+                    version: Version::from_str("2")?,
+                }),
+                slot: None,
+                uses: vec![],
+                block: PackageBlock::Strong
+            }
+        );
+
+        let expr = PackageDependencyParser::parse_atom("!=sys-apps/systemd-utils-1.2*")?;
+        assert_eq!(expr.block(), PackageBlock::Weak);
+        assert_eq!(
+            expr.version(),
+            Some(&PackageVersionDependency {
+                op: PackageVersionOp::Equal { wildcard: true },
+                version: Version::from_str("1.2")?,
+            })
+        );
+        assert_eq!(expr.to_string(), "!=sys-apps/systemd-utils-1.2*");
+
+        assert!(PackageDependencyParser::parse_atom("!!!sys-apps/systemd-utils").is_err());
+
+        Ok(())
+    }
+
     #[test]
     fn test_parse_slot() -> Result<()> {
         let expr = PackageDependencyParser::parse_atom("sys-apps/systemd-utils:1")?;
@@ -397,6 +436,29 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_parse_slot_operator() -> Result<()> {
+        for (input, want) in [
+            ("sys-libs/foo", None),
+            ("sys-libs/foo:1", None),
+            ("sys-libs/foo:1/2", None),
+            ("sys-libs/foo:*", Some(SlotOperator::Any)),
+            ("sys-libs/foo:=", Some(SlotOperator::Rebuild)),
+            ("sys-libs/foo:1=", Some(SlotOperator::Rebuild)),
+            ("sys-libs/foo:1/2=", Some(SlotOperator::Rebuild)),
+        ] {
+            let atom = PackageDependencyParser::parse_atom(input)?;
+            assert_eq!(
+                atom.slot().and_then(|slot| slot.operator()),
+                want,
+                "{input}"
+            );
+            assert_eq!(atom.to_string(), input);
+        }
+
+        Ok(())
+    }
+
     #[test]
     fn test_parse_use_item() -> Result<()> {
         let test_cases = HashMap::from([
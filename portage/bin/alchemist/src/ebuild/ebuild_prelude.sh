@@ -250,11 +250,17 @@ RDEPEND="${__alchemist_eclass_RDEPEND:+${__alchemist_eclass_RDEPEND} }${RDEPEND}
 PDEPEND="${__alchemist_eclass_PDEPEND:+${__alchemist_eclass_PDEPEND} }${PDEPEND}"
 IDEPEND="${__alchemist_eclass_IDEPEND:+${__alchemist_eclass_IDEPEND} }${IDEPEND}"
 
-if [[ "$(type -t src_compile)" == "function" ]]; then
-  __alchemist_out_has_src_compile=1
-else
-  __alchemist_out_has_src_compile=0
-fi
+# Collect phase functions defined by the ebuild and eclasses, without their
+# prefixes, to compute DEFINED_PHASES of the metadata cache.
+__alchemist_out_defined_phases=""
+for __alchemist_phase in pkg_pretend pkg_setup src_unpack src_prepare \
+    src_configure src_compile src_test src_install pkg_preinst pkg_postinst \
+    pkg_prerm pkg_postrm pkg_config pkg_info pkg_nofetch; do
+  if declare -F "${__alchemist_phase}" > /dev/null; then
+    __alchemist_out_defined_phases+=" ${__alchemist_phase#*_}"
+  fi
+done
+unset __alchemist_phase
 
 set -o posix
 set > "${__alchemist_in_output_vars:?}"
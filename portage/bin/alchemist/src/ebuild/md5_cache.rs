@@ -0,0 +1,307 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::BTreeMap,
+    fmt::{Display, Formatter},
+    path::{Path, PathBuf},
+};
+
+use anyhow::{bail, Context, Result};
+use itertools::Itertools;
+use md5::{Digest, Md5};
+
+use crate::{bash::vars::BashVars, repository::Repository};
+
+use super::{metadata::EBuildMetadata, metadata_cache::find_eclass};
+
+/// Metadata keys saved in md5-cache entries, except the ones starting with
+/// underscores which are computed by [`Md5CacheEntry::from_metadata`].
+///
+/// INHERIT, which lists eclasses inherited directly by the ebuild, is not
+/// saved since ebuild evaluation only tracks all inherited eclasses.
+const METADATA_KEYS: &[&str] = &[
+    "BDEPEND",
+    "DEPEND",
+    "DESCRIPTION",
+    "EAPI",
+    "HOMEPAGE",
+    "IDEPEND",
+    "IUSE",
+    "KEYWORDS",
+    "LICENSE",
+    "PDEPEND",
+    "PROPERTIES",
+    "RDEPEND",
+    "REQUIRED_USE",
+    "RESTRICT",
+    "SLOT",
+    "SRC_URI",
+];
+
+/// Returns whether a key is saved in md5-cache entries, i.e. an md5-cache
+/// entry is authoritative for the key.
+pub(super) fn is_metadata_key(key: &str) -> bool {
+    key == "DEFINED_PHASES" || METADATA_KEYS.contains(&key)
+}
+
+/// Computes DEFINED_PHASES of the metadata cache from the variables of an
+/// evaluated ebuild, e.g. "compile install", or "-" if no phase function is
+/// defined.
+pub(super) fn defined_phases(vars: &BashVars) -> Result<String> {
+    let phases = vars
+        .maybe_get_scalar("__alchemist_out_defined_phases")?
+        .unwrap_or_default()
+        .split_ascii_whitespace()
+        .sorted()
+        .join(" ");
+    Ok(if phases.is_empty() {
+        "-".to_owned()
+    } else {
+        phases
+    })
+}
+
+fn md5_hex(data: impl AsRef<[u8]>) -> String {
+    hex::encode(Md5::digest(data))
+}
+
+fn md5_file(path: &Path) -> Result<String> {
+    Ok(md5_hex(std::fs::read(path).with_context(|| {
+        format!("Failed to read {}", path.display())
+    })?))
+}
+
+/// An entry of the Portage metadata cache found in `metadata/md5-cache` of
+/// repositories, in the md5-dict format.
+///
+/// Each entry is a list of `KEY=value` lines. Besides metadata variables, it
+/// records the MD5 digest of the ebuild in `_md5_`, and names and MD5 digests
+/// of inherited eclasses in `_eclasses_`, so that stale entries can be
+/// detected.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Md5CacheEntry {
+    values: BTreeMap<String, String>,
+}
+
+impl Md5CacheEntry {
+    /// Parses the contents of an md5-cache entry.
+    pub fn parse(contents: &str) -> Result<Self> {
+        let values = contents
+            .lines()
+            .filter(|line| !line.is_empty())
+            .map(|line| {
+                let (key, value) = line
+                    .split_once('=')
+                    .with_context(|| format!("Invalid md5-cache line: {line:?}"))?;
+                Ok((key.to_owned(), value.to_owned()))
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self { values })
+    }
+
+    /// Computes an md5-cache entry from the metadata of an evaluated ebuild.
+    ///
+    /// `eclass_dirs` must be the eclass directories the ebuild was evaluated
+    /// with, in the order of precedence used by the evaluation.
+    pub fn from_metadata(metadata: &EBuildMetadata, eclass_dirs: &[&Path]) -> Result<Self> {
+        let vars = &metadata.vars;
+        let mut values = BTreeMap::new();
+        for key in METADATA_KEYS {
+            // Portage flattens whitespaces in metadata values.
+            let value = vars
+                .maybe_get_scalar(key)?
+                .unwrap_or_default()
+                .split_ascii_whitespace()
+                .join(" ");
+            if !value.is_empty() {
+                values.insert(key.to_string(), value);
+            }
+        }
+
+        values.insert("DEFINED_PHASES".to_owned(), defined_phases(vars)?);
+
+        let eclasses = vars
+            .maybe_get_scalar("INHERITED")?
+            .unwrap_or_default()
+            .split_ascii_whitespace()
+            .unique()
+            .map(|name| {
+                let path = find_eclass(name, eclass_dirs)
+                    .with_context(|| format!("{name}.eclass not found"))?;
+                Ok(format!("{name}\t{}", md5_file(&path)?))
+            })
+            .collect::<Result<Vec<_>>>()?;
+        if !eclasses.is_empty() {
+            values.insert("_eclasses_".to_owned(), eclasses.join("\t"));
+        }
+
+        values.insert(
+            "_md5_".to_owned(),
+            md5_file(&metadata.basic_data.ebuild_path)?,
+        );
+
+        Ok(Self { values })
+    }
+
+    /// Returns the value of a key, e.g. "SLOT".
+    pub fn get(&self, key: &str) -> Option<&str> {
+        self.values.get(key).map(|value| value.as_str())
+    }
+
+    /// Verifies that the entry is up to date, i.e. the ebuild and all
+    /// inherited eclasses have the recorded digests, and the eclasses are
+    /// resolved to the same files.
+    pub fn verify(&self, ebuild_path: &Path, eclass_dirs: &[&Path]) -> Result<()> {
+        let expected_md5 = self.get("_md5_").context("_md5_ is missing")?;
+        if md5_file(ebuild_path)? != expected_md5 {
+            bail!("{} has been modified", ebuild_path.display());
+        }
+
+        let eclasses = self.get("_eclasses_").unwrap_or_default();
+        for (name, expected_md5) in eclasses.split('\t').filter(|s| !s.is_empty()).tuples() {
+            let path = find_eclass(name, eclass_dirs)
+                .with_context(|| format!("{name}.eclass not found"))?;
+            if md5_file(&path)? != expected_md5 {
+                bail!("{} has been modified", path.display());
+            }
+        }
+        Ok(())
+    }
+}
+
+impl Display for Md5CacheEntry {
+    /// Renders the entry in the md5-dict format.
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        for (key, value) in &self.values {
+            writeln!(f, "{key}={value}")?;
+        }
+        Ok(())
+    }
+}
+
+/// Returns the path of the md5-cache entry of an ebuild in a repository, e.g.
+/// `metadata/md5-cache/sys-apps/attr-2.5.1` under the repository.
+pub fn md5_cache_path(repo: &Repository, ebuild_path: &Path) -> Result<PathBuf> {
+    let relative_path = ebuild_path.strip_prefix(repo.base_dir()).with_context(|| {
+        format!(
+            "{} is not in repository {}",
+            ebuild_path.display(),
+            repo.name()
+        )
+    })?;
+    let (category, _, file_name) = relative_path
+        .iter()
+        .collect_tuple()
+        .with_context(|| format!("Unexpected ebuild path: {}", ebuild_path.display()))?;
+    let pf = Path::new(file_name)
+        .file_stem()
+        .context("Invalid ebuild file name")?;
+    Ok(repo
+        .base_dir()
+        .join("metadata/md5-cache")
+        .join(category)
+        .join(pf))
+}
+
+/// Loads the md5-cache entry of an ebuild if it exists and is up to date.
+///
+/// Missing, corrupted and stale entries are treated as missing.
+pub fn load_md5_cache_entry(repo: &Repository, ebuild_path: &Path) -> Option<Md5CacheEntry> {
+    let contents = std::fs::read_to_string(md5_cache_path(repo, ebuild_path).ok()?).ok()?;
+    let entry = Md5CacheEntry::parse(&contents).ok()?;
+    let eclass_dirs = repo.eclass_dirs().collect_vec();
+    entry.verify(ebuild_path, &eclass_dirs).ok()?;
+    Some(entry)
+}
+
+#[cfg(test)]
+mod tests {
+    use tempfile::TempDir;
+
+    use crate::ebuild::metadata::{CachedEBuildEvaluator, MaybeEBuildMetadata};
+
+    use super::*;
+
+    const EBUILD: &str = r#"
+EAPI=7
+inherit foo
+DESCRIPTION="A  test
+package"
+SLOT=0
+KEYWORDS="*"
+src_install() { :; }
+"#;
+
+    #[test]
+    fn test_parse_and_render() -> Result<()> {
+        let contents = "EAPI=7\nSLOT=0/1\n_md5_=abc\n";
+        let entry = Md5CacheEntry::parse(contents)?;
+        assert_eq!(entry.get("SLOT"), Some("0/1"));
+        assert_eq!(entry.get("IUSE"), None);
+        assert_eq!(entry.to_string(), contents);
+
+        assert!(Md5CacheEntry::parse("EAPI\n").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_generate_and_verify() -> Result<()> {
+        let temp_dir = TempDir::new()?;
+        let repo_dir = temp_dir.path();
+        let ebuild_path = repo_dir.join("sys-apps/hello/hello-1.2.3.ebuild");
+        std::fs::create_dir_all(ebuild_path.parent().unwrap())?;
+        std::fs::write(&ebuild_path, EBUILD)?;
+        std::fs::create_dir_all(repo_dir.join("eclass"))?;
+        std::fs::write(
+            repo_dir.join("eclass/foo.eclass"),
+            "IUSE=\"foo\"\nsrc_compile() { :; }\n",
+        )?;
+
+        let repo = Repository::new_no_parents("test", repo_dir);
+        let evaluator = CachedEBuildEvaluator::new(
+            [repo.clone()].into_iter().collect(),
+            &repo_dir.join("tools"),
+        );
+        let metadata = match evaluator.evaluate_metadata(&ebuild_path)? {
+            MaybeEBuildMetadata::Ok(metadata) => metadata,
+            MaybeEBuildMetadata::Err(error) => panic!("Failed to evaluate metadata: {error:?}"),
+        };
+        let eclass_dirs = repo.eclass_dirs().collect_vec();
+
+        let entry = Md5CacheEntry::from_metadata(&metadata, &eclass_dirs)?;
+        assert_eq!(
+            entry.to_string(),
+            format!(
+                "DEFINED_PHASES=compile install\n\
+                DESCRIPTION=A test package\n\
+                EAPI=7\n\
+                IUSE=foo\n\
+                KEYWORDS=*\n\
+                SLOT=0\n\
+                _eclasses_=foo\t{}\n\
+                _md5_={}\n",
+                md5_hex("IUSE=\"foo\"\nsrc_compile() { :; }\n"),
+                md5_hex(EBUILD),
+            )
+        );
+
+        let cache_path = md5_cache_path(&repo, &ebuild_path)?;
+        assert_eq!(
+            cache_path,
+            repo_dir.join("metadata/md5-cache/sys-apps/hello-1.2.3")
+        );
+        assert_eq!(load_md5_cache_entry(&repo, &ebuild_path), None);
+
+        std::fs::create_dir_all(cache_path.parent().unwrap())?;
+        std::fs::write(&cache_path, entry.to_string())?;
+        assert_eq!(load_md5_cache_entry(&repo, &ebuild_path), Some(entry));
+
+        // Modifying an eclass invalidates the entry.
+        std::fs::write(repo_dir.join("eclass/foo.eclass"), "IUSE=\"bar\"\n")?;
+        assert_eq!(load_md5_cache_entry(&repo, &ebuild_path), None);
+
+        Ok(())
+    }
+}
@@ -9,6 +9,7 @@ use anyhow::{anyhow, bail, Context, Result};
 use itertools::Itertools;
 use once_cell::sync::OnceCell;
 use std::collections::HashMap;
+use std::sync::atomic::{AtomicUsize, Ordering};
 use std::sync::Arc;
 use std::sync::Mutex;
 use std::{
@@ -20,16 +21,23 @@ use std::{
 use version::Version;
 
 use crate::{
-    bash::vars::{parse_set_output, BashVars},
+    bash::vars::{parse_set_output, BashValue, BashVars},
     data::Vars,
 };
 
+use super::{
+    md5_cache::{defined_phases, is_metadata_key, load_md5_cache_entry, Md5CacheEntry},
+    metadata_cache::MetadataDiskCache,
+};
+
+/// Evaluates an ebuild and returns the raw output of `set` at the end of the
+/// evaluation.
 fn run_ebuild<'a>(
     ebuild_path: &Path,
     env: &Vars,
     eclass_dirs: impl IntoIterator<Item = &'a Path>,
     tools_dir: &Path,
-) -> Result<BashVars> {
+) -> Result<String> {
     let mut script_file = tempfile::tempfile()?;
     script_file.write_all(include_bytes!("ebuild_prelude.sh"))?;
     script_file.seek(SeekFrom::Start(0))?;
@@ -81,19 +89,48 @@ fn run_ebuild<'a>(
     set_output_file
         .as_file_mut()
         .read_to_string(&mut set_output)?;
-    parse_set_output(&set_output)
+    Ok(set_output)
 }
 
 #[derive(Debug)]
 pub(super) struct EBuildEvaluator {
     tools_dir: PathBuf,
+    disk_cache: Option<MetadataDiskCache>,
 }
 
 impl EBuildEvaluator {
     pub(super) fn new(tools_dir: &Path) -> Self {
         Self {
             tools_dir: tools_dir.to_owned(),
+            disk_cache: None,
+        }
+    }
+
+    /// Evaluates an ebuild and returns its variables, reusing a previous
+    /// result in the disk cache if available.
+    fn run_ebuild_cached(
+        &self,
+        ebuild_path: &Path,
+        env: &Vars,
+        repo: &Repository,
+    ) -> Result<BashVars> {
+        let eclass_dirs = repo.eclass_dirs().collect_vec();
+        if let Some(disk_cache) = &self.disk_cache {
+            if let Some(vars) = disk_cache.load(ebuild_path, &eclass_dirs) {
+                return Ok(vars);
+            }
         }
+        let set_output = run_ebuild(
+            ebuild_path,
+            env,
+            eclass_dirs.iter().copied(),
+            &self.tools_dir,
+        )?;
+        let vars = parse_set_output(&set_output)?;
+        if let Some(disk_cache) = &self.disk_cache {
+            disk_cache.store(ebuild_path, &eclass_dirs, &set_output, &vars)?;
+        }
+        Ok(vars)
     }
 
     pub(super) fn evaluate_metadata(
@@ -118,7 +155,7 @@ impl EBuildEvaluator {
             category_name: path_info.category_name,
             version: path_info.version,
         };
-        match run_ebuild(ebuild_path, &env, repo.eclass_dirs(), &self.tools_dir) {
+        match self.run_ebuild_cached(ebuild_path, &env, repo) {
             Ok(vars) => Ok(MaybeEBuildMetadata::Ok(Arc::new(EBuildMetadata {
                 basic_data,
                 vars,
@@ -171,6 +208,33 @@ impl EBuildMetadata {
     pub fn as_basic_data(&self) -> &EBuildBasicData {
         &self.basic_data
     }
+
+    /// Returns the value of a raw metadata key, e.g. "DESCRIPTION", in the
+    /// same form as md5-cache entries, i.e. with whitespaces flattened.
+    ///
+    /// This gives access to variables not modeled by [`PackageDetails`]
+    /// fields, as well as keys computed from the evaluation rather than set by
+    /// ebuilds, such as "DEFINED_PHASES". Indexed arrays are joined with
+    /// spaces. Returns `None` if the key is unset or empty.
+    ///
+    /// [`PackageDetails`]: super::PackageDetails
+    pub fn get(&self, key: &str) -> Result<Option<String>> {
+        let value = match key {
+            "DEFINED_PHASES" => defined_phases(&self.vars)?,
+            _ => match self.vars.hash_map().get(key) {
+                None => return Ok(None),
+                Some(BashValue::Scalar(value)) => value.split_ascii_whitespace().join(" "),
+                Some(BashValue::IndexedArray(values)) => values
+                    .iter()
+                    .flat_map(|value| value.split_ascii_whitespace())
+                    .join(" "),
+                Some(BashValue::AssociativeArray(_)) => {
+                    bail!("{key} is an associative array")
+                }
+            },
+        };
+        Ok(if value.is_empty() { None } else { Some(value) })
+    }
 }
 
 impl AsPackageRef for EBuildMetadata {
@@ -311,6 +375,9 @@ pub struct CachedEBuildEvaluator {
     repos: UnorderedRepositorySet,
     evaluator: EBuildEvaluator,
     cache: Mutex<HashMap<PathBuf, Arc<OnceCell<MaybeEBuildMetadata>>>>,
+    md5_cache_entries: Mutex<HashMap<PathBuf, Arc<OnceCell<Option<Md5CacheEntry>>>>>,
+    lookups: AtomicUsize,
+    evaluations: AtomicUsize,
 }
 
 impl CachedEBuildEvaluator {
@@ -321,10 +388,30 @@ impl CachedEBuildEvaluator {
             repos,
             evaluator,
             cache: Default::default(),
+            md5_cache_entries: Default::default(),
+            lookups: Default::default(),
+            evaluations: Default::default(),
         }
     }
 
+    /// Enables persisting evaluation results in `dir` so that they can be
+    /// reused by later alchemist runs while the ebuilds and their eclasses are
+    /// unchanged.
+    pub fn set_disk_cache_dir(&mut self, dir: &Path) -> Result<()> {
+        self.evaluator.disk_cache = Some(MetadataDiskCache::new(dir)?);
+        Ok(())
+    }
+
+    /// Returns the number of metadata lookups served from the cache and the number of lookups
+    /// that required evaluating ebuilds, in this order.
+    pub fn cache_stats(&self) -> (usize, usize) {
+        let lookups = self.lookups.load(Ordering::Relaxed);
+        let evaluations = self.evaluations.load(Ordering::Relaxed);
+        (lookups.saturating_sub(evaluations), evaluations)
+    }
+
     pub fn evaluate_metadata(&self, ebuild_path: &Path) -> Result<MaybeEBuildMetadata> {
+        self.lookups.fetch_add(1, Ordering::Relaxed);
         let once_cell = {
             let mut cache_guard = self.cache.lock().unwrap();
             cache_guard
@@ -333,11 +420,56 @@ impl CachedEBuildEvaluator {
                 .clone()
         };
         let details = once_cell.get_or_try_init(|| {
+            self.evaluations.fetch_add(1, Ordering::Relaxed);
             let repo = self.repos.get_repo_by_path(ebuild_path)?;
             self.evaluator.evaluate_metadata(ebuild_path, repo)
         })?;
         Ok(details.clone())
     }
+
+    /// Loads the md5-cache entry of an ebuild once, if it exists and is up to
+    /// date.
+    fn md5_cache_entry(&self, ebuild_path: &Path) -> Result<Option<Md5CacheEntry>> {
+        let once_cell = {
+            let mut cache_guard = self.md5_cache_entries.lock().unwrap();
+            cache_guard
+                .entry(ebuild_path.to_owned())
+                .or_default()
+                .clone()
+        };
+        let entry = once_cell.get_or_try_init(|| -> Result<_> {
+            let repo = self.repos.get_repo_by_path(ebuild_path)?;
+            Ok(load_md5_cache_entry(repo, ebuild_path))
+        })?;
+        Ok(entry.clone())
+    }
+
+    /// Returns the value of a raw metadata key of an ebuild. See
+    /// [`EBuildMetadata::get`] for the format of values.
+    ///
+    /// Values are computed lazily: keys recorded in the md5-cache are read
+    /// from an up-to-date md5-cache entry of the repository, and other keys
+    /// are taken from the evaluation of the ebuild with bash. The source of a
+    /// key doesn't depend on earlier lookups, and both md5-cache entries and
+    /// evaluation results are cached, so tools can look up keys without
+    /// adding them to [`PackageDetails`].
+    ///
+    /// [`PackageDetails`]: super::PackageDetails
+    pub fn get_metadata_value(&self, ebuild_path: &Path, key: &str) -> Result<Option<String>> {
+        if is_metadata_key(key) {
+            if let Some(entry) = self.md5_cache_entry(ebuild_path)? {
+                return Ok(entry.get(key).map(|value| value.to_owned()));
+            }
+        }
+        match self.evaluate_metadata(ebuild_path)? {
+            MaybeEBuildMetadata::Ok(metadata) => metadata.get(key),
+            MaybeEBuildMetadata::Err(error) => bail!(
+                "Failed to evaluate {}: {}",
+                ebuild_path.display(),
+                error.error
+            ),
+        }
+    }
 }
 
 #[cfg(test)]
@@ -623,4 +755,80 @@ assert_var PVR "1.2.3-r99"
 
         Ok(())
     }
+
+    /// Ensures [`CachedEBuildEvaluator::get_metadata_value`] prefers the md5-cache and falls back
+    /// to evaluating the ebuild.
+    #[test]
+    fn test_get_metadata_value() -> Result<()> {
+        use md5::{Digest, Md5};
+
+        let temp_dir = TempDir::new()?;
+        let temp_dir = temp_dir.path();
+
+        let ebuild = r#"
+EAPI=7
+SLOT=0
+KEYWORDS="*"
+DESCRIPTION="Evaluated  description"
+CROS_EXTRA_VAR=(hello world)
+src_compile() { :; }
+"#;
+        let ebuild_path = temp_dir.join("sys-apps/hello/hello-1.2.3.ebuild");
+        std::fs::create_dir_all(ebuild_path.parent().unwrap())?;
+        std::fs::write(&ebuild_path, ebuild)?;
+
+        let cache_path = temp_dir.join("metadata/md5-cache/sys-apps/hello-1.2.3");
+        std::fs::create_dir_all(cache_path.parent().unwrap())?;
+        std::fs::write(
+            &cache_path,
+            format!(
+                "DEFINED_PHASES=compile\nDESCRIPTION=Cached description\n_md5_={}\n",
+                hex::encode(Md5::digest(ebuild))
+            ),
+        )?;
+
+        let repo = Repository::new_no_parents("test", temp_dir);
+        let evaluator =
+            CachedEBuildEvaluator::new([repo].into_iter().collect(), &temp_dir.join("tools"));
+
+        // Keys recorded in the md5-cache don't require evaluation.
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "DESCRIPTION")?,
+            Some("Cached description".to_owned())
+        );
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "HOMEPAGE")?,
+            None
+        );
+        assert_eq!(evaluator.cache_stats(), (0, 0));
+
+        // Other keys are evaluated.
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "CROS_EXTRA_VAR")?,
+            Some("hello world".to_owned())
+        );
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "UNSET_VAR")?,
+            None
+        );
+        assert_eq!(evaluator.cache_stats(), (1, 1));
+
+        // The md5-cache is still used after evaluation, so results don't
+        // depend on the order of lookups, and the evaluation is cached.
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "DESCRIPTION")?,
+            Some("Cached description".to_owned())
+        );
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "DEFINED_PHASES")?,
+            Some("compile".to_owned())
+        );
+        assert_eq!(
+            evaluator.get_metadata_value(&ebuild_path, "CROS_EXTRA_VAR")?,
+            Some("hello world".to_owned())
+        );
+        assert_eq!(evaluator.cache_stats(), (2, 1));
+
+        Ok(())
+    }
 }
@@ -0,0 +1,250 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::BTreeMap,
+    os::unix::ffi::OsStrExt,
+    path::{Path, PathBuf},
+};
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::bash::vars::{parse_set_output, BashVars};
+
+/// A cache entry saved to the disk.
+#[derive(Debug, Serialize, Deserialize)]
+struct CacheEntry {
+    /// Digest of the inputs known before evaluating the ebuild. See
+    /// [`MetadataDiskCache::compute_key`].
+    key: String,
+    /// Eclasses inherited by the ebuild, mapped to their resolved paths and
+    /// digests.
+    eclasses: BTreeMap<String, (PathBuf, String)>,
+    /// Raw output of `set` at the end of the evaluation.
+    set_output: String,
+}
+
+/// Persists ebuild metadata evaluation results across alchemist runs.
+///
+/// An entry is reused only if the ebuild file, the list of eclass directories,
+/// and the contents of all inherited eclasses are unchanged. Profiles are not
+/// part of the key because ebuild metadata is defined independently of them.
+#[derive(Debug)]
+pub(super) struct MetadataDiskCache {
+    dir: PathBuf,
+}
+
+fn sha256_hex(data: impl AsRef<[u8]>) -> String {
+    hex::encode(Sha256::digest(data))
+}
+
+/// Finds an eclass in the same way as `__alchemist_find_eclass` in
+/// `ebuild_prelude.sh`, i.e. later directories take precedence.
+pub(super) fn find_eclass(name: &str, eclass_dirs: &[&Path]) -> Option<PathBuf> {
+    eclass_dirs
+        .iter()
+        .rev()
+        .map(|dir| dir.join(format!("{name}.eclass")))
+        .find(|path| path.is_file())
+}
+
+impl MetadataDiskCache {
+    pub(super) fn new(dir: &Path) -> Result<Self> {
+        std::fs::create_dir_all(dir)
+            .with_context(|| format!("Failed to create {}", dir.display()))?;
+        Ok(Self {
+            dir: dir.to_owned(),
+        })
+    }
+
+    fn entry_path(&self, ebuild_path: &Path) -> PathBuf {
+        self.dir
+            .join(sha256_hex(ebuild_path.as_os_str().as_bytes()))
+    }
+
+    /// Computes a digest of the inputs of an ebuild evaluation that are known
+    /// before evaluating it.
+    fn compute_key(ebuild_path: &Path, eclass_dirs: &[&Path]) -> Result<String> {
+        let contents = std::fs::read(ebuild_path)
+            .with_context(|| format!("Failed to read {}", ebuild_path.display()))?;
+        let mut hasher = Sha256::new();
+        hasher.update(include_bytes!("ebuild_prelude.sh"));
+        hasher.update(ebuild_path.as_os_str().as_bytes());
+        hasher.update([0]);
+        for dir in eclass_dirs {
+            hasher.update(dir.as_os_str().as_bytes());
+            hasher.update([0]);
+        }
+        hasher.update(contents);
+        Ok(hex::encode(hasher.finalize()))
+    }
+
+    /// Loads the variables of a previous evaluation of the ebuild if its
+    /// inputs are unchanged.
+    ///
+    /// Stale or corrupted entries are treated as missing.
+    pub(super) fn load(&self, ebuild_path: &Path, eclass_dirs: &[&Path]) -> Option<BashVars> {
+        let contents = std::fs::read(self.entry_path(ebuild_path)).ok()?;
+        let entry: CacheEntry = serde_json::from_slice(&contents).ok()?;
+        if entry.key != Self::compute_key(ebuild_path, eclass_dirs).ok()? {
+            return None;
+        }
+        for (name, (path, digest)) in entry.eclasses.iter() {
+            if find_eclass(name, eclass_dirs).as_ref() != Some(path) {
+                return None;
+            }
+            if &sha256_hex(std::fs::read(path).ok()?) != digest {
+                return None;
+            }
+        }
+        parse_set_output(&entry.set_output).ok()
+    }
+
+    /// Saves the result of an ebuild evaluation.
+    pub(super) fn store(
+        &self,
+        ebuild_path: &Path,
+        eclass_dirs: &[&Path],
+        set_output: &str,
+        vars: &BashVars,
+    ) -> Result<()> {
+        let eclasses = vars
+            .maybe_get_scalar("INHERITED")?
+            .unwrap_or_default()
+            .split_ascii_whitespace()
+            .map(|name| {
+                let path = find_eclass(name, eclass_dirs)
+                    .with_context(|| format!("{name}.eclass not found"))?;
+                let digest = sha256_hex(
+                    std::fs::read(&path)
+                        .with_context(|| format!("Failed to read {}", path.display()))?,
+                );
+                Ok((name.to_owned(), (path, digest)))
+            })
+            .collect::<Result<_>>()?;
+        let entry = CacheEntry {
+            key: Self::compute_key(ebuild_path, eclass_dirs)?,
+            eclasses,
+            set_output: set_output.to_owned(),
+        };
+
+        // Write to a temporary file first so that concurrent readers never see
+        // a partially written entry.
+        let path = self.entry_path(ebuild_path);
+        let mut file = tempfile::NamedTempFile::new_in(&self.dir)?;
+        serde_json::to_writer(&mut file, &entry)?;
+        file.persist(&path)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use tempfile::TempDir;
+
+    use super::*;
+
+    const SET_OUTPUT: &str = "EAPI=7\nINHERITED=' foo'\nSLOT=0\n";
+
+    struct Fixture {
+        _temp_dir: TempDir,
+        cache: MetadataDiskCache,
+        ebuild_path: PathBuf,
+        eclass_dir: PathBuf,
+    }
+
+    impl Fixture {
+        fn new() -> Result<Self> {
+            let temp_dir = TempDir::new()?;
+            let ebuild_path = temp_dir.path().join("sys-apps/hello/hello-1.2.3.ebuild");
+            std::fs::create_dir_all(ebuild_path.parent().unwrap())?;
+            std::fs::write(&ebuild_path, "EAPI=7\ninherit foo\nSLOT=0\n")?;
+            let eclass_dir = temp_dir.path().join("eclass");
+            std::fs::create_dir_all(&eclass_dir)?;
+            std::fs::write(eclass_dir.join("foo.eclass"), "# foo\n")?;
+            let cache = MetadataDiskCache::new(&temp_dir.path().join("cache"))?;
+            Ok(Self {
+                _temp_dir: temp_dir,
+                cache,
+                ebuild_path,
+                eclass_dir,
+            })
+        }
+
+        fn store(&self) -> Result<()> {
+            self.cache.store(
+                &self.ebuild_path,
+                &[self.eclass_dir.as_path()],
+                SET_OUTPUT,
+                &parse_set_output(SET_OUTPUT)?,
+            )
+        }
+
+        fn load(&self) -> Option<BashVars> {
+            self.cache
+                .load(&self.ebuild_path, &[self.eclass_dir.as_path()])
+        }
+    }
+
+    #[test]
+    fn test_load_stored() -> Result<()> {
+        let fixture = Fixture::new()?;
+        assert_eq!(fixture.load(), None);
+
+        fixture.store()?;
+
+        let vars = fixture.load().expect("cache entry should be valid");
+        assert_eq!(vars, parse_set_output(SET_OUTPUT)?);
+        Ok(())
+    }
+
+    #[test]
+    fn test_ebuild_changed() -> Result<()> {
+        let fixture = Fixture::new()?;
+        fixture.store()?;
+
+        std::fs::write(&fixture.ebuild_path, "EAPI=8\ninherit foo\nSLOT=0\n")?;
+
+        assert_eq!(fixture.load(), None);
+        Ok(())
+    }
+
+    #[test]
+    fn test_eclass_changed() -> Result<()> {
+        let fixture = Fixture::new()?;
+        fixture.store()?;
+
+        std::fs::write(fixture.eclass_dir.join("foo.eclass"), "# new foo\n")?;
+
+        assert_eq!(fixture.load(), None);
+        Ok(())
+    }
+
+    #[test]
+    fn test_eclass_overridden() -> Result<()> {
+        let fixture = Fixture::new()?;
+        let overlay_eclass_dir = fixture.eclass_dir.with_file_name("overlay-eclass");
+        std::fs::create_dir_all(&overlay_eclass_dir)?;
+        let eclass_dirs = [fixture.eclass_dir.as_path(), overlay_eclass_dir.as_path()];
+        fixture.cache.store(
+            &fixture.ebuild_path,
+            &eclass_dirs,
+            SET_OUTPUT,
+            &parse_set_output(SET_OUTPUT)?,
+        )?;
+        assert!(fixture
+            .cache
+            .load(&fixture.ebuild_path, &eclass_dirs)
+            .is_some());
+
+        // An eclass with the same name in a preferred directory takes over.
+        std::fs::write(overlay_eclass_dir.join("foo.eclass"), "# foo\n")?;
+
+        assert_eq!(fixture.cache.load(&fixture.ebuild_path, &eclass_dirs), None);
+        Ok(())
+    }
+}
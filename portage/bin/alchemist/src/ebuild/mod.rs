@@ -2,7 +2,9 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
+pub mod md5_cache;
 pub mod metadata;
+mod metadata_cache;
 
 use anyhow::{bail, Context, Result};
 use itertools::Itertools;
@@ -11,7 +13,7 @@ use serde::Deserialize;
 use version::Version;
 
 use std::{
-    collections::{HashMap, HashSet},
+    collections::{BTreeSet, HashMap, HashSet},
     io::ErrorKind,
     path::{Path, PathBuf},
     str::FromStr,
@@ -101,6 +103,21 @@ impl<'de> Deserialize<'de> for BashExpr {
     }
 }
 
+/// A feature of the executor that a package requires to build.
+#[derive(
+    Clone, Copy, Debug, Eq, PartialEq, Ord, PartialOrd, Hash, Deserialize, strum_macros::AsRefStr,
+)]
+#[serde(rename_all = "snake_case")]
+#[strum(serialize_all = "snake_case")]
+pub enum ExecRequirement {
+    /// /dev/kvm is available, e.g. to run VMs in tests.
+    Kvm,
+    /// /dev/fuse is available, e.g. to mount FUSE file systems.
+    Fuse,
+    /// The executor has much more memory than usual.
+    LargeMemory,
+}
+
 /// Defines the merged Bazel-specific metadata found in all relevant TOML files.
 ///
 /// Metadata of a package may consist of multiple TOML files: one for the ebuild file and those for
@@ -177,6 +194,28 @@ pub struct BazelSpecificMetadata {
     ///
     /// The path is relative to the sysroot.
     pub interface_library_allowlist: HashSet<PathBuf>,
+
+    /// Fails the package build if it violates the policy of Portage's sandbox,
+    /// e.g. by writing files outside of `${D}` and `${T}`.
+    ///
+    /// Portage's sandbox is disabled in our containers, so violations are
+    /// otherwise only reported when `--//bazel/portage:sandbox_report` is set.
+    /// Turn this on once a package builds without violations to keep it that
+    /// way.
+    ///
+    /// When multiple TOML files set this metadata for the same package, the
+    /// ebuild's TOML file takes precedence over eclasses'.
+    pub enforce_sandbox_policy: bool,
+
+    /// Features of the executor the package requires to build, e.g. `["kvm"]`.
+    ///
+    /// The generated ebuild targets set `exec_properties` so that remote
+    /// execution schedules their actions on workers providing the features,
+    /// instead of failing at run time on other workers.
+    ///
+    /// When multiple TOML files set this metadata for the same package,
+    /// requirements are simply merged.
+    pub exec_requirements: BTreeSet<ExecRequirement>,
 }
 
 impl BazelSpecificMetadata {
@@ -218,6 +257,8 @@ struct SingleBazelSpecificMetadata {
     supports_interface_libraries: Option<BashExpr>,
     generate_interface_libraries: Option<BashExpr>,
     interface_library_allowlist: Option<Vec<PathBuf>>,
+    enforce_sandbox_policy: Option<bool>,
+    exec_requirements: Option<Vec<ExecRequirement>>,
 }
 
 /// Defines the TOML metadata file format.
@@ -271,6 +312,12 @@ impl BazelSpecificMetadata {
                 self.interface_library_allowlist
                     .extend(interface_library_allowlist);
             }
+            if let Some(enforce_sandbox_policy) = other.enforce_sandbox_policy {
+                self.enforce_sandbox_policy = enforce_sandbox_policy;
+            }
+            if let Some(exec_requirements) = other.exec_requirements {
+                self.exec_requirements.extend(exec_requirements);
+            }
         }
     }
 }
@@ -846,6 +893,8 @@ REQUIRED_USE="|| ( foo !bar )"
                 supports_interface_libraries: vec![BashExpr::from_str("true")?],
                 interface_library_allowlist: HashSet::from([]),
                 generate_interface_libraries: vec![],
+                enforce_sandbox_policy: false,
+                exec_requirements: BTreeSet::from([]),
             }
         );
         Ok(())
@@ -922,6 +971,8 @@ KEYWORDS="*"
             supports_interface_libraries: vec![],
             interface_library_allowlist: HashSet::from([]),
             generate_interface_libraries: vec![],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         assert_eq!(write_toml("", &[])?, metadata);
@@ -937,6 +988,8 @@ KEYWORDS="*"
             supports_interface_libraries: vec![BashExpr::from_str("false")?],
             interface_library_allowlist: HashSet::from([]),
             generate_interface_libraries: vec![],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         assert_eq!(
@@ -957,6 +1010,8 @@ supports_interface_libraries = false
             supports_interface_libraries: vec![BashExpr::from_str("true")?],
             interface_library_allowlist: HashSet::from([]),
             generate_interface_libraries: vec![],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         assert_eq!(
@@ -982,6 +1037,8 @@ supports_interface_libraries = true
             supports_interface_libraries: vec![BashExpr::from_str("use !static")?],
             interface_library_allowlist: HashSet::from([]),
             generate_interface_libraries: vec![BashExpr::from_str("use !static")?],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         assert_eq!(
@@ -1016,6 +1073,8 @@ generate_interface_libraries = "use !static"
             supports_interface_libraries: vec![BashExpr::from_str("true")?],
             interface_library_allowlist: HashSet::from([]),
             generate_interface_libraries: vec![BashExpr::from_str("true")?],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         assert_eq!(
@@ -1047,6 +1106,8 @@ generate_interface_libraries = true
                 BashExpr::from_str("true")?,
                 BashExpr::from_str("false")?,
             ],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         // Verify packages can override the eclasses.
@@ -1085,6 +1146,8 @@ generate_interface_libraries = true
                 PathBuf::from("/usr/lib/bar.a"),
             ]),
             generate_interface_libraries: vec![],
+            enforce_sandbox_policy: false,
+            exec_requirements: BTreeSet::from([]),
         };
 
         assert_eq!(
@@ -1111,4 +1174,73 @@ interface_library_allowlist = [
 
         Ok(())
     }
+
+    #[test]
+    fn test_toml_enforce_sandbox_policy() -> Result<()> {
+        let eclass_toml = [(
+            "foo",
+            r#"
+[bazel]
+enforce_sandbox_policy = true
+"#,
+        )];
+
+        // Packages inherit the setting from eclasses.
+        assert!(write_toml("", &eclass_toml)?.enforce_sandbox_policy);
+
+        // Packages can override the eclasses.
+        assert!(
+            !write_toml(
+                r#"
+[bazel]
+enforce_sandbox_policy = false
+"#,
+                &eclass_toml
+            )?
+            .enforce_sandbox_policy
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_toml_exec_requirements() -> Result<()> {
+        let eclass_toml = [(
+            "foo",
+            r#"
+[bazel]
+exec_requirements = ["fuse"]
+"#,
+        )];
+
+        // Requirements of packages and eclasses are merged.
+        let metadata = write_toml(
+            r#"
+[bazel]
+exec_requirements = ["kvm", "large_memory"]
+"#,
+            &eclass_toml,
+        )?;
+        assert_eq!(
+            metadata.exec_requirements,
+            BTreeSet::from([
+                ExecRequirement::Kvm,
+                ExecRequirement::Fuse,
+                ExecRequirement::LargeMemory
+            ])
+        );
+        assert_eq!(ExecRequirement::LargeMemory.as_ref(), "large_memory");
+
+        // Unknown requirements are rejected.
+        assert!(write_toml(
+            r#"
+[bazel]
+exec_requirements = ["gpu"]
+"#,
+            &[]
+        )
+        .is_err());
+
+        Ok(())
+    }
 }
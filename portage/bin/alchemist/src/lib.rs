@@ -11,6 +11,7 @@ pub mod dependency;
 pub mod ebuild;
 pub mod fakechroot;
 pub mod fileops;
+pub mod packages_index;
 pub mod path;
 pub mod repository;
 pub mod resolver;
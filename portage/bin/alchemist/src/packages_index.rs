@@ -0,0 +1,258 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::{HashMap, HashSet},
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+use anyhow::{bail, Context, Result};
+use version::Version;
+
+use crate::{
+    bash::vars::{BashValue, BashVars},
+    data::{Slot, UseMap},
+    ebuild::{
+        metadata::{EBuildBasicData, EBuildMetadata},
+        PackageDetails, PackageReadiness,
+    },
+};
+
+/// Parses a Portage `Packages` index file.
+///
+/// The file consists of blocks of `KEY: VALUE` lines separated by empty lines.
+/// The first block is a header, and each following block describes a binary
+/// package. This function returns the fields of package blocks, skipping the
+/// header.
+pub fn parse_packages_index(contents: &str) -> Result<Vec<HashMap<&str, &str>>> {
+    let mut blocks = contents
+        .split("\n\n")
+        .map(|block| {
+            block
+                .lines()
+                .filter(|line| !line.is_empty())
+                .map(|line| {
+                    let (key, value) = line
+                        .split_once(':')
+                        .with_context(|| format!("Malformed line in Packages: {line:?}"))?;
+                    Ok((key.trim(), value.trim()))
+                })
+                .collect::<Result<HashMap<_, _>>>()
+        })
+        .filter(|block| !matches!(block, Ok(fields) if fields.is_empty()));
+
+    // Skip the header.
+    if blocks.next().transpose()?.is_none() {
+        bail!("Packages index is empty");
+    }
+
+    blocks.collect()
+}
+
+/// The repository name reported for binary packages whose `Packages` entry
+/// doesn't record one.
+const UNKNOWN_REPO_NAME: &str = "binpkg";
+
+/// Converts a package entry of a `Packages` index to [`PackageDetails`].
+///
+/// Fields of the entry, e.g. `RDEPEND` and `EAPI`, are exposed as ebuild
+/// variables. Dependencies recorded in binary packages have USE conditionals
+/// already evaluated, so they resolve the same regardless of the USE map.
+fn package_details_from_fields(
+    pkgdir: &Path,
+    fields: &HashMap<&str, &str>,
+) -> Result<PackageDetails> {
+    let cpv = *fields.get("CPV").context("Package entry is missing CPV")?;
+    let (package_name, version) =
+        Version::from_str_suffix(cpv).with_context(|| format!("Invalid CPV: {cpv:?}"))?;
+    let (category_name, short_package_name) = package_name
+        .split_once('/')
+        .with_context(|| format!("Invalid CPV: {cpv:?}"))?;
+
+    let path = match fields.get("PATH") {
+        Some(path) => PathBuf::from(path),
+        None => PathBuf::from(format!("{cpv}.tbz2")),
+    };
+
+    let split_flags = |value: &str| -> HashSet<String> {
+        value
+            .split_ascii_whitespace()
+            .map(|flag| flag.trim_start_matches(['+', '-']).to_string())
+            .collect()
+    };
+    let enabled = split_flags(fields.get("USE").copied().unwrap_or_default());
+    let use_map: UseMap = split_flags(fields.get("IUSE").copied().unwrap_or_default())
+        .into_iter()
+        .map(|flag| {
+            let value = enabled.contains(&flag);
+            (flag, value)
+        })
+        .collect();
+
+    let vars = fields
+        .iter()
+        .map(|(key, value)| (key.to_string(), BashValue::Scalar(value.to_string())))
+        .collect();
+
+    Ok(PackageDetails {
+        metadata: Arc::new(EBuildMetadata {
+            basic_data: EBuildBasicData {
+                repo_name: fields
+                    .get("REPO")
+                    .copied()
+                    .unwrap_or(UNKNOWN_REPO_NAME)
+                    .to_string(),
+                ebuild_path: pkgdir.join(path),
+                package_name: package_name.to_string(),
+                short_package_name: short_package_name.to_string(),
+                category_name: category_name.to_string(),
+                version,
+            },
+            vars: BashVars::new(vars),
+        }),
+        slot: Slot::new(fields.get("SLOT").copied().unwrap_or("0")),
+        use_map,
+        stable: true,
+        readiness: PackageReadiness::Ok,
+        inherited: HashSet::new(),
+        inherit_paths: Vec::new(),
+        direct_build_target: None,
+        bazel_metadata: Default::default(),
+    })
+}
+
+/// Binary packages listed in the `Packages` index of a PKGDIR, used to
+/// resolve packages without ebuilds.
+///
+/// [`PackageDetails::as_basic_data`] of the packages points `ebuild_path` to
+/// the binary package file instead of an ebuild.
+#[derive(Debug, Default)]
+pub struct BinaryPackageIndex {
+    packages: HashMap<String, Vec<Arc<PackageDetails>>>,
+}
+
+impl BinaryPackageIndex {
+    /// Loads `Packages` in a PKGDIR.
+    pub fn load(pkgdir: &Path) -> Result<Self> {
+        let path = pkgdir.join("Packages");
+        let contents = std::fs::read_to_string(&path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse(pkgdir, &contents)
+            .with_context(|| format!("Failed to parse {}", path.display()))
+    }
+
+    /// Parses the contents of `Packages` in a PKGDIR.
+    pub fn parse(pkgdir: &Path, contents: &str) -> Result<Self> {
+        let mut entries = parse_packages_index(contents)?
+            .into_iter()
+            .map(|fields| {
+                let build_id: u64 = match fields.get("BUILD_ID") {
+                    Some(value) => value
+                        .parse()
+                        .with_context(|| format!("Invalid BUILD_ID {value:?}"))?,
+                    None => 0,
+                };
+                Ok((build_id, package_details_from_fields(pkgdir, &fields)?))
+            })
+            .collect::<Result<Vec<_>>>()?;
+
+        // Among binary packages of the same version, the resolver prefers the
+        // last one, so sort them by build IDs.
+        entries.sort_by_key(|(build_id, _)| *build_id);
+
+        let mut packages: HashMap<String, Vec<Arc<PackageDetails>>> = HashMap::new();
+        for (_, details) in entries {
+            packages
+                .entry(details.as_basic_data().package_name.clone())
+                .or_default()
+                .push(Arc::new(details));
+        }
+        Ok(Self { packages })
+    }
+
+    /// Returns all binary packages.
+    pub fn all_packages(&self) -> impl Iterator<Item = &Arc<PackageDetails>> {
+        self.packages.values().flatten()
+    }
+
+    /// Returns binary packages of the package name, e.g. "sys-apps/attr".
+    pub fn find_packages(&self, package_name: &str) -> &[Arc<PackageDetails>] {
+        self.packages
+            .get(package_name)
+            .map(|packages| packages.as_slice())
+            .unwrap_or_default()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PACKAGES: &str = "ARCH: amd64
+PACKAGES: 3
+VERSION: 0
+
+BUILD_ID: 2
+CPV: sys-apps/attr-2.5.1
+EAPI: 7
+IUSE: debug +nls
+PATH: sys-apps/attr-2.5.1-2.xpak
+RDEPEND: virtual/libintl
+REPO: portage-stable
+SLOT: 0
+USE: amd64 nls
+
+BUILD_ID: 1
+CPV: sys-apps/attr-2.5.1
+SLOT: 0
+
+CPV: virtual/libintl-0-r2
+SLOT: 0/1
+";
+
+    #[test]
+    fn test_parse_packages_index() -> Result<()> {
+        let blocks = parse_packages_index(PACKAGES)?;
+        assert_eq!(blocks.len(), 3);
+        assert_eq!(blocks[2].get("CPV"), Some(&"virtual/libintl-0-r2"));
+
+        assert!(parse_packages_index("").is_err());
+        assert!(parse_packages_index("ARCH: amd64\n\nCPV\n").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_binary_package_index() -> Result<()> {
+        let index = BinaryPackageIndex::parse(Path::new("/pkgdir"), PACKAGES)?;
+        assert_eq!(index.all_packages().count(), 3);
+        assert!(index.find_packages("sys-apps/which").is_empty());
+
+        let attrs = index.find_packages("sys-apps/attr");
+        assert_eq!(attrs.len(), 2);
+        // The package with the larger build ID comes last.
+        let attr = &attrs[1];
+        assert_eq!(
+            attr.as_basic_data().ebuild_path,
+            PathBuf::from("/pkgdir/sys-apps/attr-2.5.1-2.xpak")
+        );
+        assert_eq!(attr.as_basic_data().repo_name, "portage-stable");
+        assert_eq!(attr.as_basic_data().version.to_string(), "2.5.1");
+        assert_eq!(
+            attr.use_map,
+            UseMap::from([("debug".to_string(), false), ("nls".to_string(), true)])
+        );
+        assert_eq!(attr.metadata.vars.get_scalar("RDEPEND")?, "virtual/libintl");
+        assert!(attr.supports_bdepend());
+
+        let libintl = &index.find_packages("virtual/libintl")[0];
+        assert_eq!(libintl.as_basic_data().repo_name, UNKNOWN_REPO_NAME);
+        assert_eq!(
+            libintl.as_basic_data().ebuild_path,
+            PathBuf::from("/pkgdir/virtual/libintl-0-r2.tbz2")
+        );
+        assert_eq!(libintl.slot.to_string(), "0/1");
+        Ok(())
+    }
+}
@@ -15,6 +15,7 @@ use crate::{
         Predicate,
     },
     ebuild::{CachedPackageLoader, MaybePackageDetails, PackageDetails},
+    packages_index::BinaryPackageIndex,
     repository::RepositorySet,
 };
 
@@ -35,12 +36,23 @@ pub fn select_best_version<T: AsPackageRef, I: IntoIterator<Item = T>>(packages:
         .max_by(|a, b| a.as_package_ref().version.cmp(b.as_package_ref().version))
 }
 
+/// Where [`PackageResolver`] finds packages.
+#[derive(Debug)]
+enum Backend {
+    /// Loads packages from ebuilds in repositories.
+    Ebuilds {
+        repos: Arc<RepositorySet>,
+        loader: Arc<CachedPackageLoader>,
+    },
+    /// Uses binary packages listed in a `Packages` index.
+    BinaryPackages(Arc<BinaryPackageIndex>),
+}
+
 /// Answers queries related to Portage packages.
 #[derive(Debug)]
 pub struct PackageResolver {
-    repos: Arc<RepositorySet>,
+    backend: Backend,
     config: Arc<ConfigBundle>,
-    loader: Arc<CachedPackageLoader>,
 }
 
 impl PackageResolver {
@@ -51,20 +63,73 @@ impl PackageResolver {
         loader: Arc<CachedPackageLoader>,
     ) -> Self {
         Self {
-            repos,
+            backend: Backend::Ebuilds { repos, loader },
+            config,
+        }
+    }
+
+    /// Constructs a new [`Resolver`] that resolves packages against binary
+    /// packages only, e.g. to inspect prebuilt binhosts without ebuilds.
+    ///
+    /// `config` is used for `package.provided` only.
+    pub fn new_binary(index: Arc<BinaryPackageIndex>, config: Arc<ConfigBundle>) -> Self {
+        Self {
+            backend: Backend::BinaryPackages(index),
             config,
-            loader,
         }
     }
 
     /// Loads all packages covered by this resolver.
     #[instrument(skip_all)]
     pub fn find_all_packages(&self) -> Result<Vec<MaybePackageDetails>> {
-        // Load packages in parallel.
-        self.repos
-            .find_all_ebuilds()?
+        match &self.backend {
+            Backend::Ebuilds { repos, loader } => {
+                // Load packages in parallel.
+                repos
+                    .find_all_ebuilds()?
+                    .into_par_iter()
+                    .map(|ebuild_path| loader.load_package(&ebuild_path))
+                    .collect()
+            }
+            Backend::BinaryPackages(index) => Ok(index
+                .all_packages()
+                .map(|details| MaybePackageDetails::Ok(details.clone()))
+                .collect()),
+        }
+    }
+
+    /// Loads all versions of a package, e.g. "sys-apps/attr", with `filter`
+    /// applied.
+    fn find_package_versions<F>(
+        &self,
+        package_name: &str,
+        filter: F,
+    ) -> Result<Vec<MaybePackageDetails>>
+    where
+        F: Fn(&MaybePackageDetails) -> Result<bool> + Sync,
+    {
+        let candidates: Vec<Result<MaybePackageDetails>> = match &self.backend {
+            Backend::Ebuilds { repos, loader } => repos
+                .find_ebuilds(package_name)?
+                .into_par_iter()
+                .map(|ebuild_path| loader.load_package(&ebuild_path))
+                .collect(),
+            Backend::BinaryPackages(index) => index
+                .find_packages(package_name)
+                .iter()
+                .map(|details| Ok(MaybePackageDetails::Ok(details.clone())))
+                .collect(),
+        };
+        candidates
             .into_par_iter()
-            .map(|ebuild_path| self.loader.load_package(&ebuild_path))
+            .filter_map(|maybe_details| match maybe_details {
+                Ok(maybe_details) => match filter(&maybe_details) {
+                    Ok(true) => Some(Ok(maybe_details)),
+                    Ok(false) => None,
+                    Err(err) => Some(Err(err)),
+                },
+                Err(err) => Some(Err(err)),
+            })
             .collect()
     }
 
@@ -75,16 +140,9 @@ impl PackageResolver {
     /// Packages from a lower-priority repository come before packages from a higher-priority
     /// repository, which is the suitable order for [`select_best_version`].
     pub fn find_packages(&self, atom: &PackageAtom) -> Result<Vec<MaybePackageDetails>> {
-        let ebuild_paths = self.repos.find_ebuilds(atom.package_name())?;
-
-        let packages = ebuild_paths
-            .into_par_iter()
-            .filter_map(|ebuild_path| match self.loader.load_package(&ebuild_path) {
-                Ok(maybe_details) if !atom.matches(&maybe_details.as_package_ref()) => None,
-                other => Some(other),
-            })
-            .collect::<Result<Vec<_>>>()?;
-        Ok(packages)
+        self.find_package_versions(atom.package_name(), |maybe_details| {
+            Ok(atom.matches(&maybe_details.as_package_ref()))
+        })
     }
 
     /// Finds the valid package best matching the specified [`PackageAtom`].
@@ -127,23 +185,10 @@ impl PackageResolver {
         source_use_map: &UseMap,
         atom: &PackageDependencyAtom,
     ) -> Result<Option<Arc<PackageDetails>>> {
-        let ebuild_paths = self.repos.find_ebuilds(atom.package_name())?;
-
-        let packages = ebuild_paths
-            .into_par_iter()
-            .map(|ebuild_path| -> Result<Option<MaybePackageDetails>> {
-                let maybe_details = self.loader.load_package(&ebuild_path)?;
-                // TODO: Make match errors non-fatal.
-                if atom.matches(source_use_map, &maybe_details.as_package_ref())? {
-                    Ok(Some(maybe_details))
-                } else {
-                    Ok(None)
-                }
-            })
-            .collect::<Result<Vec<_>>>()?
-            .into_iter()
-            .flatten()
-            .collect::<Vec<_>>();
+        // TODO: Make match errors non-fatal.
+        let packages = self.find_package_versions(atom.package_name(), |maybe_details| {
+            atom.matches(source_use_map, &maybe_details.as_package_ref())
+        })?;
 
         match select_best_version(&packages) {
             Some(MaybePackageDetails::Ok(details)) => Ok(Some(details.clone())),
@@ -158,6 +203,12 @@ impl PackageResolver {
         }
     }
 
+    /// Checks if a package is listed in `package.preferred`, which takes
+    /// priority over the order of alternatives in any-of dependencies.
+    pub fn is_package_preferred(&self, details: &PackageDetails) -> bool {
+        self.config.is_package_preferred(&details.as_package_ref())
+    }
+
     /// Finds *provided packages* matching the specified [`PackageAtomDependency`].
     ///
     /// Portage allows pretending a missing package as "provided" by configuring
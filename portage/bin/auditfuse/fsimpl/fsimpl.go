@@ -22,16 +22,110 @@ type AuditNode struct {
 
 var _ fs.InodeEmbedder = &AuditNode{}
 
+// callerPID returns the PID of the process making a FUSE request, or 0 if
+// unknown.
+func callerPID(ctx context.Context) uint32 {
+	if caller, ok := fuse.FromContext(ctx); ok {
+		return caller.Pid
+	}
+	return 0
+}
+
+// path returns the absolute path of the node in the file system.
+func (n *AuditNode) path() string {
+	return filepath.Join("/", n.Path(nil))
+}
+
+// reportIfOK reports a mutation if it succeeded.
+func (n *AuditNode) reportIfOK(ctx context.Context, errno syscall.Errno, t reporter.AccessType, path string) {
+	if errno == 0 {
+		n.r.Report(t, path, callerPID(ctx))
+	}
+}
+
 func (n *AuditNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	n.r.Report(reporter.Lookup, filepath.Join("/", n.Path(nil), name))
+	n.r.Report(reporter.Lookup, filepath.Join(n.path(), name), callerPID(ctx))
 	return n.LoopbackNode.Lookup(ctx, name, out)
 }
 
 func (n *AuditNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	n.r.Report(reporter.Readdir, filepath.Join("/", n.Path(nil)))
+	n.r.Report(reporter.Readdir, n.path(), callerPID(ctx))
 	return n.LoopbackNode.Readdir(ctx)
 }
 
+func (n *AuditNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	inode, fh, fuseFlags, errno := n.LoopbackNode.Create(ctx, name, flags, mode, out)
+	n.reportIfOK(ctx, errno, reporter.Create, filepath.Join(n.path(), name))
+	return inode, fh, fuseFlags, errno
+}
+
+func (n *AuditNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Mkdir(ctx, name, mode, out)
+	n.reportIfOK(ctx, errno, reporter.Create, filepath.Join(n.path(), name))
+	return inode, errno
+}
+
+func (n *AuditNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Mknod(ctx, name, mode, rdev, out)
+	n.reportIfOK(ctx, errno, reporter.Create, filepath.Join(n.path(), name))
+	return inode, errno
+}
+
+func (n *AuditNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Symlink(ctx, target, name, out)
+	n.reportIfOK(ctx, errno, reporter.Create, filepath.Join(n.path(), name))
+	return inode, errno
+}
+
+func (n *AuditNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	inode, errno := n.LoopbackNode.Link(ctx, target, name, out)
+	n.reportIfOK(ctx, errno, reporter.Create, filepath.Join(n.path(), name))
+	return inode, errno
+}
+
+func (n *AuditNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	fh, fuseFlags, errno := n.LoopbackNode.Open(ctx, flags)
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		n.reportIfOK(ctx, errno, reporter.Write, n.path())
+	}
+	return fh, fuseFlags, errno
+}
+
+func (n *AuditNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	errno := n.LoopbackNode.Setattr(ctx, f, in, out)
+	if _, ok := in.GetSize(); ok {
+		n.reportIfOK(ctx, errno, reporter.Write, n.path())
+	}
+	if _, ok := in.GetMode(); ok {
+		n.reportIfOK(ctx, errno, reporter.Chmod, n.path())
+	}
+	_, uok := in.GetUID()
+	_, gok := in.GetGID()
+	if uok || gok {
+		n.reportIfOK(ctx, errno, reporter.Chown, n.path())
+	}
+	return errno
+}
+
+func (n *AuditNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	errno := n.LoopbackNode.Rename(ctx, name, newParent, newName, flags)
+	n.reportIfOK(ctx, errno, reporter.Rename, filepath.Join(n.path(), name))
+	n.reportIfOK(ctx, errno, reporter.Rename, filepath.Join("/", newParent.EmbeddedInode().Path(nil), newName))
+	return errno
+}
+
+func (n *AuditNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	errno := n.LoopbackNode.Unlink(ctx, name)
+	n.reportIfOK(ctx, errno, reporter.Unlink, filepath.Join(n.path(), name))
+	return errno
+}
+
+func (n *AuditNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	errno := n.LoopbackNode.Rmdir(ctx, name)
+	n.reportIfOK(ctx, errno, reporter.Unlink, filepath.Join(n.path(), name))
+	return errno
+}
+
 func NewRoot(origDir string, r *reporter.Reporter) (*AuditNode, error) {
 	// Compute the absolute file path to allow changing the working directory.
 	origDir, err := filepath.Abs(origDir)
@@ -2,8 +2,9 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-// auditfuse is a FUSE file system that audits file accesses on a read-only view
-// of another directory.
+// auditfuse is a FUSE file system that audits file accesses on a view of
+// another directory. The view is read-only unless --read-write is specified, in
+// which case mutations are passed through to the directory and audited as well.
 package main
 
 import (
@@ -26,6 +27,33 @@ var flagOutput = &cli.StringFlag{
 	Required: true,
 }
 
+var flagFormat = &cli.StringFlag{
+	Name:  "format",
+	Usage: "output format: audit (null-separated TYPE<tab>PATH), json or csv",
+	Value: string(reporter.FormatAudit),
+}
+
+var flagInclude = &cli.StringSliceFlag{
+	Name:  "include",
+	Usage: "report only accesses to paths matching the glob pattern or under matching directories (repeatable)",
+}
+
+var flagExclude = &cli.StringSliceFlag{
+	Name:  "exclude",
+	Usage: "do not report accesses to paths matching the glob pattern or under matching directories (repeatable)",
+}
+
+var flagDedup = &cli.BoolFlag{
+	Name:  "dedup",
+	Usage: "report only the first access of each type to each path",
+	Value: true,
+}
+
+var flagReadWrite = &cli.BoolFlag{
+	Name:  "read-write",
+	Usage: "allow mutating files and report CREATE, WRITE, RENAME, UNLINK, CHMOD and CHOWN",
+}
+
 var flagForeground = &cli.BoolFlag{
 	Name:    "foreground",
 	Aliases: []string{"f"},
@@ -49,6 +77,11 @@ var app = &cli.App{
 	ArgsUsage: "orig-dir mount-dir",
 	Flags: []cli.Flag{
 		flagOutput,
+		flagFormat,
+		flagInclude,
+		flagExclude,
+		flagDedup,
+		flagReadWrite,
 		flagForeground,
 		flagVerbose,
 		flagDebug,
@@ -66,6 +99,18 @@ var app = &cli.App{
 		origDir := args[0]
 		mountDir := args[1]
 
+		format, err := reporter.ParseFormat(c.String(flagFormat.Name))
+		if err != nil {
+			return err
+		}
+		opts := reporter.Options{
+			Format:         format,
+			Include:        c.StringSlice(flagInclude.Name),
+			Exclude:        c.StringSlice(flagExclude.Name),
+			KeepDuplicates: !c.Bool(flagDedup.Name),
+			Verbose:        verbose,
+		}
+
 		if !foreground {
 			if exit, err := daemonize.Start(); err != nil {
 				return err
@@ -80,11 +125,21 @@ var app = &cli.App{
 		}
 		defer out.Close()
 
-		root, err := fsimpl.NewRoot(origDir, reporter.New(out, verbose))
+		r, err := reporter.New(out, opts)
+		if err != nil {
+			return err
+		}
+
+		root, err := fsimpl.NewRoot(origDir, r)
 		if err != nil {
 			return err
 		}
 
+		var mountOptions []string
+		if !c.Bool(flagReadWrite.Name) {
+			mountOptions = append(mountOptions, "ro")
+		}
+
 		server, err := fs.Mount(mountDir, root, &fs.Options{
 			NullPermissions: true,
 			MountOptions: fuse.MountOptions{
@@ -93,6 +148,7 @@ var app = &cli.App{
 				FsName:            origDir,
 				DirectMountStrict: true,
 				Debug:             debug,
+				Options:           mountOptions,
 			},
 		})
 		if err != nil {
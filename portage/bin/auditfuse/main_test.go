@@ -5,6 +5,9 @@
 package main_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -28,7 +31,7 @@ func auditfuseBin(t *testing.T) string {
 	return bin
 }
 
-func mount(t *testing.T, origDir string) (mountDir string, outputPath string) {
+func mount(t *testing.T, origDir string, extraArgs ...string) (mountDir string, outputPath string) {
 	tempDir := t.TempDir()
 	mountDir = filepath.Join(tempDir, "mount")
 	outputPath = filepath.Join(tempDir, "output")
@@ -37,7 +40,9 @@ func mount(t *testing.T, origDir string) (mountDir string, outputPath string) {
 		t.Fatal(err)
 	}
 
-	cmd := exec.Command(auditfuseBin(t), "--output", outputPath, origDir, mountDir)
+	args := append([]string{"--output", outputPath}, extraArgs...)
+	args = append(args, origDir, mountDir)
+	cmd := exec.Command(auditfuseBin(t), args...)
 	if err := cmd.Run(); err != nil {
 		t.Fatalf("Failed to mount auditfuse: %v", err)
 	}
@@ -95,6 +100,109 @@ func TestReaddir(t *testing.T) {
 	}
 }
 
+func TestReadOnly(t *testing.T) {
+	origDir := t.TempDir()
+	mountDir, _ := mount(t, origDir)
+	defer unmount(t, mountDir)
+
+	err := os.WriteFile(filepath.Join(mountDir, "foo"), nil, 0o600)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("WriteFile: got %v, want EROFS", err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	origDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(origDir, "old"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mountDir, outputPath := mount(t, origDir, "--read-write")
+	defer unmount(t, mountDir)
+
+	for _, f := range []func() error{
+		func() error { return os.Mkdir(filepath.Join(mountDir, "dir"), 0o700) },
+		func() error { return os.WriteFile(filepath.Join(mountDir, "dir/new"), []byte("x"), 0o600) },
+		func() error { return os.Rename(filepath.Join(mountDir, "dir/new"), filepath.Join(mountDir, "renamed")) },
+		func() error { return os.Chmod(filepath.Join(mountDir, "renamed"), 0o644) },
+		func() error { return os.Truncate(filepath.Join(mountDir, "old"), 0) },
+		func() error { return os.Remove(filepath.Join(mountDir, "old")) },
+	} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(origDir, "renamed")); err != nil {
+		t.Errorf("Mutation was not passed through: %v", err)
+	}
+
+	out, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		if !strings.HasPrefix(line, "LOOKUP\t") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		"CREATE\t/dir",
+		"CREATE\t/dir/new",
+		"RENAME\t/dir/new",
+		"RENAME\t/renamed",
+		"CHMOD\t/renamed",
+		"WRITE\t/old",
+		"UNLINK\t/old",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Wrong output: got %q, want %q", got, want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	origDir := t.TempDir()
+	for _, dir := range []string{"foo", "bar"} {
+		if err := os.Mkdir(filepath.Join(origDir, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mountDir, outputPath := mount(t, origDir, "--format=json", "--exclude=/bar", "--dedup=false")
+	defer unmount(t, mountDir)
+
+	os.ReadDir(filepath.Join(mountDir, "foo"))
+	os.ReadDir(filepath.Join(mountDir, "foo"))
+	os.ReadDir(filepath.Join(mountDir, "bar"))
+
+	out, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var rec struct {
+			Path      string `json:"path"`
+			Operation string `json:"operation"`
+			PID       int    `json:"pid"`
+		}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.PID == 0 {
+			t.Errorf("Missing PID for %s", rec.Path)
+		}
+		got = append(got, rec.Operation+" "+rec.Path)
+	}
+
+	want := []string{"LOOKUP /foo", "READDIR /foo", "LOOKUP /foo", "READDIR /foo"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Wrong output: got %q, want %q", got, want)
+	}
+}
+
 func TestConcurrency(t *testing.T) {
 	const workers = 10
 	const entries = 10000
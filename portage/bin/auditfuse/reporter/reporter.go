@@ -5,10 +5,16 @@
 package reporter
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type AccessType string
@@ -16,26 +22,167 @@ type AccessType string
 const (
 	Lookup  AccessType = "LOOKUP"
 	Readdir AccessType = "READDIR"
+
+	// Mutations are reported only in the read-write mode.
+
+	// Create is reported for a new file, directory, device, symlink or hard
+	// link.
+	Create AccessType = "CREATE"
+	// Write is reported when a file is opened for writing or truncated.
+	Write AccessType = "WRITE"
+	// Rename is reported for both the source and destination paths.
+	Rename AccessType = "RENAME"
+	// Unlink is reported for a removed file or directory.
+	Unlink AccessType = "UNLINK"
+	Chmod  AccessType = "CHMOD"
+	Chown  AccessType = "CHOWN"
+)
+
+// Format is the format of an audit file.
+type Format string
+
+const (
+	// FormatAudit writes "TYPE\tPATH" records separated by null bytes.
+	FormatAudit Format = "audit"
+	// FormatJSON writes a JSON object per line.
+	FormatJSON Format = "json"
+	// FormatCSV writes comma-separated values with a header line.
+	FormatCSV Format = "csv"
 )
 
+// Formats lists all supported formats.
+var Formats = []Format{FormatAudit, FormatJSON, FormatCSV}
+
+// ParseFormat parses a format name.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown format %q", s)
+}
+
+// Options customizes a Reporter.
+type Options struct {
+	// Format is the format of the audit file. Defaults to FormatAudit.
+	Format Format
+
+	// Include is a list of glob patterns of paths to report. If it is
+	// non-empty, only accesses to paths matching any of them, or under
+	// directories matching any of them, are reported.
+	Include []string
+
+	// Exclude is a list of glob patterns of paths not to report. Accesses to
+	// paths matching any of them, or under directories matching any of them,
+	// are not reported. Exclude takes precedence over Include.
+	//
+	// Patterns follow filepath.Match. Patterns without slashes are matched
+	// against base names.
+	Exclude []string
+
+	// KeepDuplicates reports every access, instead of only the first access
+	// of each type to each path.
+	KeepDuplicates bool
+
+	// Verbose logs every access to stderr.
+	Verbose bool
+}
+
 type entry struct {
 	Type AccessType `json:"type"`
 	Path string     `json:"path"`
 }
 
+// record is a single access written in the JSON format.
+type record struct {
+	Path      string     `json:"path"`
+	Operation AccessType `json:"operation"`
+	PID       uint32     `json:"pid"`
+	Timestamp string     `json:"timestamp"`
+}
+
 type Reporter struct {
-	out     io.Writer
-	verbose bool
+	out  io.Writer
+	opts Options
+	csv  *csv.Writer // set for FormatCSV
 
 	mu   sync.RWMutex
 	seen map[entry]struct{} // protected by mu
 }
 
-func (r *Reporter) Report(t AccessType, path string) error {
-	if r.verbose {
+// matchAny reports whether path or any of its ancestor directories matches
+// one of the glob patterns. Patterns without slashes are matched against base
+// names, e.g. "*.pyc" matches "/foo/bar.pyc".
+func matchAny(patterns []string, path string) bool {
+	for p := path; ; p = filepath.Dir(p) {
+		for _, pattern := range patterns {
+			name := p
+			if !strings.Contains(pattern, "/") {
+				name = filepath.Base(p)
+			}
+			// Patterns are validated in New.
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+func (r *Reporter) filtered(path string) bool {
+	if len(r.opts.Include) > 0 && !matchAny(r.opts.Include, path) {
+		return true
+	}
+	return matchAny(r.opts.Exclude, path)
+}
+
+// write writes a record. r.mu must be held.
+func (r *Reporter) write(t AccessType, path string, pid uint32) error {
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	switch r.opts.Format {
+	case FormatJSON:
+		b, err := json.Marshal(&record{
+			Path:      path,
+			Operation: t,
+			PID:       pid,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = r.out.Write(append(b, '\n'))
+		return err
+	case FormatCSV:
+		if err := r.csv.Write([]string{path, string(t), strconv.FormatUint(uint64(pid), 10), timestamp}); err != nil {
+			return err
+		}
+		r.csv.Flush()
+		return r.csv.Error()
+	default:
+		_, err := fmt.Fprintf(r.out, "%s\t%s\x00", t, path)
+		return err
+	}
+}
+
+// Report records an access to path by the process pid. pid is 0 if unknown.
+func (r *Reporter) Report(t AccessType, path string, pid uint32) error {
+	if r.opts.Verbose {
 		fmt.Fprintf(os.Stderr, "[auditfuse] %s: %s\n", t, path)
 	}
 
+	if r.filtered(path) {
+		return nil
+	}
+
+	if r.opts.KeepDuplicates {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.write(t, path, pid)
+	}
+
 	e := entry{
 		Type: t,
 		Path: path,
@@ -49,16 +196,41 @@ func (r *Reporter) Report(t AccessType, path string) error {
 	}
 
 	r.mu.Lock()
-	_, err := fmt.Fprintf(r.out, "%s\t%s\x00", t, path)
+	defer r.mu.Unlock()
+	if _, ok := r.seen[e]; ok {
+		return nil
+	}
 	r.seen[e] = struct{}{}
-	r.mu.Unlock()
-	return err
+	return r.write(t, path, pid)
 }
 
-func New(out io.Writer, verbose bool) *Reporter {
-	return &Reporter{
-		out:     out,
-		verbose: verbose,
-		seen:    make(map[entry]struct{}),
+func New(out io.Writer, opts Options) (*Reporter, error) {
+	if opts.Format == "" {
+		opts.Format = FormatAudit
+	}
+	if _, err := ParseFormat(string(opts.Format)); err != nil {
+		return nil, err
+	}
+	for _, pattern := range append(append([]string(nil), opts.Include...), opts.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	r := &Reporter{
+		out:  out,
+		opts: opts,
+		seen: make(map[entry]struct{}),
+	}
+	if opts.Format == FormatCSV {
+		r.csv = csv.NewWriter(out)
+		if err := r.csv.Write([]string{"path", "operation", "pid", "timestamp"}); err != nil {
+			return nil, err
+		}
+		r.csv.Flush()
+		if err := r.csv.Error(); err != nil {
+			return nil, err
+		}
 	}
+	return r, nil
 }
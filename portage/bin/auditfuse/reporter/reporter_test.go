@@ -6,7 +6,10 @@ package reporter_test
 
 import (
 	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"regexp"
 	"strings"
@@ -16,15 +19,23 @@ import (
 	"cros.local/bazel/portage/bin/auditfuse/reporter"
 )
 
+func newReporter(t *testing.T, out io.Writer, opts reporter.Options) *reporter.Reporter {
+	r, err := reporter.New(out, opts)
+	if err != nil {
+		t.Fatalf("reporter.New failed: %v", err)
+	}
+	return r
+}
+
 func TestReporter(t *testing.T) {
 	var buf bytes.Buffer
-	r := reporter.New(&buf, false)
-	r.Report(reporter.Lookup, "/aaa")
-	r.Report(reporter.Readdir, "/aaa")
-	r.Report(reporter.Lookup, "/bbb")
-	r.Report(reporter.Readdir, "/ccc")
-	r.Report(reporter.Lookup, "/aaa")
-	r.Report(reporter.Readdir, "/ccc")
+	r := newReporter(t, &buf, reporter.Options{})
+	r.Report(reporter.Lookup, "/aaa", 0)
+	r.Report(reporter.Readdir, "/aaa", 0)
+	r.Report(reporter.Lookup, "/bbb", 0)
+	r.Report(reporter.Readdir, "/ccc", 0)
+	r.Report(reporter.Lookup, "/aaa", 0)
+	r.Report(reporter.Readdir, "/ccc", 0)
 
 	const want = "LOOKUP\t/aaa\x00READDIR\t/aaa\x00LOOKUP\t/bbb\x00READDIR\t/ccc\x00"
 	got := buf.String()
@@ -38,7 +49,7 @@ func TestReporter_Concurrency(t *testing.T) {
 	const reportPerWorker = 100000
 
 	var buf bytes.Buffer
-	r := reporter.New(&buf, false)
+	r := newReporter(t, &buf, reporter.Options{})
 
 	// Run N goroutines making reports concurrently.
 	var wg sync.WaitGroup
@@ -47,7 +58,7 @@ func TestReporter_Concurrency(t *testing.T) {
 			defer wg.Done()
 			for j := 0; j < reportPerWorker; j++ {
 				path := fmt.Sprintf("/%09d", rand.Intn(1000000000))
-				r.Report(reporter.Lookup, path)
+				r.Report(reporter.Lookup, path, 0)
 			}
 		}()
 		wg.Add(1)
@@ -67,3 +78,105 @@ func TestReporter_Concurrency(t *testing.T) {
 		}
 	}
 }
+
+func TestReporter_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(t, &buf, reporter.Options{Format: reporter.FormatJSON})
+	r.Report(reporter.Lookup, "/aaa", 123)
+	r.Report(reporter.Readdir, "/b\tb", 456)
+
+	type record struct {
+		Path      string `json:"path"`
+		Operation string `json:"operation"`
+		PID       uint32 `json:"pid"`
+		Timestamp string `json:"timestamp"`
+	}
+	var got []record
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Timestamp == "" {
+			t.Errorf("Missing timestamp: %#v", rec)
+		}
+		rec.Timestamp = ""
+		got = append(got, rec)
+	}
+
+	want := []record{
+		{Path: "/aaa", Operation: "LOOKUP", PID: 123},
+		{Path: "/b\tb", Operation: "READDIR", PID: 456},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Report result mismatch: got %v, want %v", got, want)
+	}
+}
+
+func TestReporter_CSV(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(t, &buf, reporter.Options{Format: reporter.FormatCSV})
+	r.Report(reporter.Lookup, "/a,a", 123)
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Unexpected number of rows: got %d, want 2", len(rows))
+	}
+	if got, want := strings.Join(rows[0], ","), "path,operation,pid,timestamp"; got != want {
+		t.Errorf("Header mismatch: got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(rows[1][:3], "|"), "/a,a|LOOKUP|123"; got != want {
+		t.Errorf("Row mismatch: got %q, want %q", got, want)
+	}
+}
+
+func TestReporter_Filter(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(t, &buf, reporter.Options{
+		Include: []string{"/src/*"},
+		Exclude: []string{"/src/*/.git", "*.pyc"},
+	})
+	for _, path := range []string{
+		"/src",
+		"/src/aaa",
+		"/src/aaa/bbb",
+		"/src/aaa/.git",
+		"/src/aaa/.git/config",
+		"/src/aaa/ccc.pyc",
+		"/other",
+	} {
+		r.Report(reporter.Lookup, path, 0)
+	}
+
+	const want = "LOOKUP\t/src/aaa\x00LOOKUP\t/src/aaa/bbb\x00"
+	if got := buf.String(); got != want {
+		t.Fatalf("Report result mismatch: got %q, want %q", got, want)
+	}
+}
+
+func TestReporter_KeepDuplicates(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(t, &buf, reporter.Options{KeepDuplicates: true})
+	r.Report(reporter.Lookup, "/aaa", 0)
+	r.Report(reporter.Lookup, "/aaa", 0)
+
+	const want = "LOOKUP\t/aaa\x00LOOKUP\t/aaa\x00"
+	if got := buf.String(); got != want {
+		t.Fatalf("Report result mismatch: got %q, want %q", got, want)
+	}
+}
+
+func TestNew_InvalidOptions(t *testing.T) {
+	for _, opts := range []reporter.Options{
+		{Format: "xml"},
+		{Include: []string{"/src/["}},
+	} {
+		if _, err := reporter.New(io.Discard, opts); err == nil {
+			t.Errorf("reporter.New(%#v) succeeded unexpectedly", opts)
+		}
+	}
+}
@@ -2,22 +2,114 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::{ensure, Result};
+mod plan;
+
+use anyhow::{bail, ensure, Context, Result};
 use binarypackage::BinaryPackage;
-use clap::Parser;
-use cliutil::cli_main;
-use container::{enter_mount_namespace, BindMount, CommonArgs, ContainerSettings};
-use fileutil::resolve_symlink_forest;
+use clap::{Parser, ValueEnum};
+use cliutil::{cli_main, LoggingArgs};
+use container::{
+    enter_mount_namespace, exit_on_container_error, BindMount, CommonArgs, ContainerSettings,
+    MountPropagation,
+};
+use fileutil::{copy_file, resolve_symlink_forest};
+use plan::ImagePlan;
+use serde::Deserialize;
 use std::{
+    collections::BTreeSet,
     path::{Path, PathBuf},
     process::ExitCode,
 };
+use version::Version;
 
 const MAIN_SCRIPT: &str = "/mnt/host/.build_image/build_image.sh";
 
+/// The type of an image to build.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+enum ImageType {
+    Base,
+    Dev,
+    Test,
+    Factory,
+}
+
+impl ImageType {
+    /// Returns the image name to pass to the build_image script.
+    fn image_to_build(self) -> &'static str {
+        match self {
+            Self::Base => "base",
+            Self::Dev => "dev",
+            Self::Test => "test",
+            Self::Factory => "factory_install",
+        }
+    }
+
+    /// Returns the name of the image file generated by the build_image
+    /// script, without the extension.
+    fn image_file_name(self) -> &'static str {
+        match self {
+            Self::Base => "chromiumos_base_image",
+            Self::Dev => "chromiumos_image",
+            Self::Test => "chromiumos_test_image",
+            Self::Factory => "factory_install_shim",
+        }
+    }
+}
+
+/// Describes the cross-compilation toolchain of a board. Generated by
+/// alchemist from the board's primary toolchain.
+#[derive(Debug, Deserialize)]
+struct ToolchainDescriptor {
+    board: String,
+    chost: String,
+    /// Host packages providing the cross-compilation toolchain, e.g.
+    /// "cross-aarch64-cros-linux-gnu/gcc".
+    cross_packages: Vec<String>,
+}
+
+impl ToolchainDescriptor {
+    fn load(path: &Path) -> Result<Self> {
+        let content = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse {}", path.display()))
+    }
+
+    /// Fails if the descriptor is for another board or any cross package is
+    /// missing from `host_packages`, which are package names without
+    /// versions.
+    fn check(&self, board: &str, host_packages: &BTreeSet<String>) -> Result<()> {
+        ensure!(
+            self.board == board,
+            "Toolchain descriptor is for {}, not {}",
+            self.board,
+            board
+        );
+        let missing: Vec<&str> = self
+            .cross_packages
+            .iter()
+            .filter(|package| !host_packages.contains(*package))
+            .map(|package| package.as_str())
+            .collect();
+        if !missing.is_empty() {
+            bail!(
+                "Cross toolchain packages for {} are not given as host packages: {}",
+                self.chost,
+                missing.join(", ")
+            );
+        }
+        Ok(())
+    }
+}
+
 #[derive(Parser, Debug)]
 #[clap()]
 pub struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
@@ -29,13 +121,9 @@ pub struct Cli {
     #[arg(long, required = true)]
     output: PathBuf,
 
-    /// Image to build.
-    #[arg(long, required = true)]
-    image_to_build: String,
-
-    /// The name of the image file generated by build_image script.
-    #[arg(long, required = true)]
-    image_file_name: String,
+    /// Type of the image to build.
+    #[arg(long, value_enum, required = true)]
+    image_type: ImageType,
 
     /// File paths to binary packages to be installed on the output image.
     #[arg(long)]
@@ -48,6 +136,20 @@ pub struct Cli {
 
     #[arg(long)]
     override_base_package: Vec<String>,
+
+    /// Path to a JSON file describing the cross-compilation toolchain of the
+    /// board. If set, the host packages must provide the toolchain.
+    #[arg(long)]
+    toolchain: Option<PathBuf>,
+
+    /// Prints the plan of the build, such as binary packages to be made
+    /// available, and exits without mounting anything or building the image.
+    #[arg(long)]
+    dry_run: bool,
+
+    /// Saves the plan of the build to the specified file in JSON.
+    #[arg(long)]
+    plan_json: Option<PathBuf>,
 }
 
 fn do_main() -> Result<()> {
@@ -67,6 +169,7 @@ fn do_main() -> Result<()> {
             .join(&args.board)
             .join("var/cache/edb/chromeos"),
         rw: false,
+        propagation: MountPropagation::Private,
     });
     settings.push_bind_mount(BindMount {
         source: resolve_symlink_forest(&runfiles::rlocation!(
@@ -77,6 +180,7 @@ fn do_main() -> Result<()> {
             .join(&args.board)
             .join("etc/portage/package.accept_keywords/accept_all"),
         rw: false,
+        propagation: MountPropagation::Private,
     });
     settings.push_bind_mount(BindMount {
         source: resolve_symlink_forest(&runfiles::rlocation!(
@@ -87,6 +191,7 @@ fn do_main() -> Result<()> {
             .join(&args.board)
             .join("etc/portage/profile/package.provided"),
         rw: false,
+        propagation: MountPropagation::Private,
     });
     settings.push_bind_mount(BindMount {
         source: resolve_symlink_forest(&runfiles::rlocation!(
@@ -95,8 +200,22 @@ fn do_main() -> Result<()> {
         ))?,
         mount_path: PathBuf::from(MAIN_SCRIPT),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
+    let image_path = Path::new("/mnt/host/source/src/build/images")
+        .join(&args.board)
+        .join("latest")
+        .join(format!("{}.bin", args.image_type.image_file_name()));
+    let mut plan = ImagePlan {
+        board: args.board.clone(),
+        image_to_build: args.image_type.image_to_build().to_owned(),
+        image_path: image_path.clone(),
+        layers: args.common.layer.clone(),
+        base_packages: args.override_base_package.clone(),
+        ..Default::default()
+    };
+
     for path in args.target_package {
         let path = resolve_symlink_forest(&path)?;
         let package = BinaryPackage::open(&path)?;
@@ -104,47 +223,106 @@ fn do_main() -> Result<()> {
             .join(&args.board)
             .join("packages")
             .join(format!("{}.tbz2", package.category_pf()));
+        plan.packages.insert(mount_path.clone(), path.clone());
         settings.push_bind_mount(BindMount {
             mount_path,
             source: path,
             rw: false,
+            propagation: MountPropagation::Private,
         });
     }
 
+    let mut host_package_names = BTreeSet::new();
     for path in args.host_package {
         let path = resolve_symlink_forest(&path)?;
         let package = BinaryPackage::open(&path)?;
+        let (package_name, _) = Version::from_str_suffix(package.category_p())?;
+        host_package_names.insert(package_name.to_owned());
         let mount_path =
             Path::new("/var/lib/portage/pkgs").join(format!("{}.tbz2", package.category_pf()));
+        plan.packages.insert(mount_path.clone(), path.clone());
         settings.push_bind_mount(BindMount {
             mount_path,
             source: path,
             rw: false,
+            propagation: MountPropagation::Private,
         });
     }
 
+    if let Some(path) = &args.toolchain {
+        let toolchain = ToolchainDescriptor::load(path)?;
+        toolchain.check(&args.board, &host_package_names)?;
+        plan.chost = Some(toolchain.chost);
+    }
+
+    if let Some(path) = &args.plan_json {
+        plan.save(path)?;
+    }
+    if args.dry_run {
+        print!("{plan}");
+        return Ok(());
+    }
+
     let mut container = settings.prepare()?;
 
-    let status = container
+    container
         .command(MAIN_SCRIPT)
         .arg("--board")
         .arg(&args.board)
-        .arg(&args.image_to_build)
+        .arg(args.image_type.image_to_build())
         .env("BASE_PACKAGE", args.override_base_package.join(" "))
-        .status()?;
-
-    ensure!(status.success());
+        .run()?;
 
-    let path = Path::new("mnt/host/source/src/build/images")
-        .join(&args.board)
-        .join("latest")
-        .join(args.image_file_name + ".bin");
-    std::fs::copy(container.root_dir().join(path), args.output)?;
+    // The image is several gigabytes, so use reflink where possible.
+    copy_file(
+        &container
+            .root_dir()
+            .join(image_path.strip_prefix("/").unwrap()),
+        &args.output,
+    )?;
 
     Ok(())
 }
 
 fn main() -> ExitCode {
     enter_mount_namespace().expect("Failed to enter a mount namespace");
-    cli_main(do_main, Default::default())
+    cli_main(|| exit_on_container_error(do_main()), Default::default())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_toolchain_check() -> Result<()> {
+        let toolchain: ToolchainDescriptor = serde_json::from_str(
+            r#"{
+                "board": "arm64-generic",
+                "chost": "aarch64-cros-linux-gnu",
+                "cross_packages": [
+                    "cross-aarch64-cros-linux-gnu/binutils",
+                    "cross-aarch64-cros-linux-gnu/gcc"
+                ]
+            }"#,
+        )?;
+
+        let mut host_packages = BTreeSet::from([
+            "cross-aarch64-cros-linux-gnu/binutils".to_owned(),
+            "cross-aarch64-cros-linux-gnu/gcc".to_owned(),
+            "sys-apps/portage".to_owned(),
+        ]);
+        toolchain.check("arm64-generic", &host_packages)?;
+        assert!(toolchain.check("amd64-generic", &host_packages).is_err());
+
+        host_packages.remove("cross-aarch64-cros-linux-gnu/gcc");
+        let err = toolchain
+            .check("arm64-generic", &host_packages)
+            .unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Cross toolchain packages for aarch64-cros-linux-gnu are not given as host packages: \
+             cross-aarch64-cros-linux-gnu/gcc"
+        );
+        Ok(())
+    }
 }
@@ -0,0 +1,109 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use serde::Serialize;
+use std::{
+    collections::BTreeMap,
+    fmt::Display,
+    fs::File,
+    path::{Path, PathBuf},
+};
+
+/// Describes what build_image is going to do, without mounting anything or
+/// running the build_image script.
+#[derive(Clone, Debug, Default, Eq, PartialEq, Serialize)]
+pub struct ImagePlan {
+    pub board: String,
+    /// The image name passed to the build_image script, e.g. "test".
+    pub image_to_build: String,
+    /// The path of the image file generated in the container.
+    pub image_path: PathBuf,
+    /// CHOST of the cross toolchain, if a toolchain descriptor is given.
+    pub chost: Option<String>,
+    /// Layers of the container, in the mount order.
+    pub layers: Vec<PathBuf>,
+    /// Binary packages made available to the build_image script, keyed by
+    /// their paths in the container.
+    pub packages: BTreeMap<PathBuf, PathBuf>,
+    /// Overrides of the packages to install to the image.
+    pub base_packages: Vec<String>,
+}
+
+impl ImagePlan {
+    /// Saves the plan as JSON.
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let file =
+            File::create(path).with_context(|| format!("Failed to create {}", path.display()))?;
+        serde_json::to_writer_pretty(file, self)?;
+        Ok(())
+    }
+}
+
+impl Display for ImagePlan {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        writeln!(f, "Board: {}", self.board)?;
+        writeln!(f, "Image: {}", self.image_to_build)?;
+        writeln!(f, "Output: {}", self.image_path.display())?;
+        if let Some(chost) = &self.chost {
+            writeln!(f, "Cross toolchain: {chost}")?;
+        }
+        if !self.base_packages.is_empty() {
+            writeln!(f, "Base packages: {}", self.base_packages.join(" "))?;
+        }
+        writeln!(f, "Layers:")?;
+        for layer in &self.layers {
+            writeln!(f, "  {}", layer.display())?;
+        }
+        writeln!(f, "Packages:")?;
+        for (mount_path, source) in &self.packages {
+            writeln!(f, "  {} <- {}", mount_path.display(), source.display())?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_display() {
+        let plan = ImagePlan {
+            board: "amd64-generic".to_owned(),
+            image_to_build: "test".to_owned(),
+            image_path: PathBuf::from(
+                "/mnt/host/source/src/build/images/amd64-generic/latest/chromiumos_test_image.bin",
+            ),
+            chost: Some("x86_64-cros-linux-gnu".to_owned()),
+            layers: vec![PathBuf::from("/sdk")],
+            packages: BTreeMap::from([
+                (
+                    PathBuf::from("/build/amd64-generic/packages/sys-apps/attr-2.5.1.tbz2"),
+                    PathBuf::from("/out/attr.tbz2"),
+                ),
+                (
+                    PathBuf::from(
+                        "/var/lib/portage/pkgs/cross-x86_64-cros-linux-gnu/gcc-10.2.tbz2",
+                    ),
+                    PathBuf::from("/out/gcc.tbz2"),
+                ),
+            ]),
+            base_packages: vec![],
+        };
+        assert_eq!(
+            plan.to_string(),
+            "Board: amd64-generic
+Image: test
+Output: /mnt/host/source/src/build/images/amd64-generic/latest/chromiumos_test_image.bin
+Cross toolchain: x86_64-cros-linux-gnu
+Layers:
+  /sdk
+Packages:
+  /build/amd64-generic/packages/sys-apps/attr-2.5.1.tbz2 <- /out/attr.tbz2
+  /var/lib/portage/pkgs/cross-x86_64-cros-linux-gnu/gcc-10.2.tbz2 <- /out/gcc.tbz2
+"
+        );
+    }
+}
@@ -17,4 +17,11 @@ fi
 
 export FEATURES="${FEATURES} fakeroot"
 
-exec "$@"
+if [[ -z "${FAKEFS_DB_EXPORT:-}" ]]; then
+  exec "$@"
+fi
+
+# fakefs records file ownership in FAKEFS_DB instead of xattrs. Export it so
+# that it can be captured as an action output.
+"$@"
+fakeroot --db-root="${FAKEFS_DB_ROOT}" --db-export="${FAKEFS_DB_EXPORT}"
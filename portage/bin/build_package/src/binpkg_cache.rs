@@ -0,0 +1,379 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use sha2::{Digest, Sha256};
+use std::{
+    fs::File,
+    io::Read,
+    os::unix::ffi::OsStrExt,
+    path::{Path, PathBuf},
+    process::Command,
+};
+use walkdir::WalkDir;
+
+/// Inputs that determine the contents of a binary package built by
+/// build_package. Packages built from the same inputs are interchangeable, so
+/// their digest is used to look up the remote binary package cache.
+#[derive(Clone, Debug)]
+pub struct CacheKeyInputs<'a> {
+    /// The path to the build_package executable. Its contents identify the
+    /// version of the tool, so that cached packages are invalidated when the
+    /// tool changes.
+    pub tool: &'a Path,
+    /// The board name, or None for host packages.
+    pub board: Option<&'a str>,
+    /// The path to the ebuild file.
+    pub ebuild: &'a Path,
+    /// Pairs of the path inside the package directory and the source path of
+    /// files under the package directory.
+    pub files: Vec<(&'a Path, &'a Path)>,
+    /// Pairs of the file name and the source path of distfiles.
+    pub distfiles: Vec<(&'a Path, &'a Path)>,
+    /// Git tree archives used by CROS_WORKON_TREE.
+    pub git_trees: &'a [PathBuf],
+    /// USE flags to build with.
+    pub use_flags: &'a [String],
+    /// USE flag overrides applied on top of `use_flags`.
+    pub use_overrides: &'a [String],
+    /// Paths of bashrc files in the container. Their contents are given as
+    /// layers, which are covered by `extra`.
+    pub bashrcs: &'a [PathBuf],
+    /// Pairs of the path in the sysroot and the source path of files copied
+    /// into the sysroot.
+    pub sysroot_files: Vec<(&'a Path, &'a Path)>,
+    /// Other files or directories affecting the build, such as binary packages
+    /// of dependencies and eclasses.
+    pub extra: &'a [PathBuf],
+}
+
+/// Feeds the contents of a file to the hasher, prefixed with its size so that
+/// concatenated contents can't collide.
+fn hash_file(hasher: &mut Sha256, path: &Path) -> Result<()> {
+    let mut file =
+        File::open(path).with_context(|| format!("Failed to open {}", path.display()))?;
+    hasher.update(file.metadata()?.len().to_le_bytes());
+    let mut buf = [0; 64 * 1024];
+    loop {
+        let size = file.read(&mut buf)?;
+        if size == 0 {
+            break;
+        }
+        hasher.update(&buf[..size]);
+    }
+    Ok(())
+}
+
+/// Feeds a file, or all files under a directory in a stable order, to the
+/// hasher. Symlinks are hashed by their targets rather than followed.
+fn hash_path(hasher: &mut Sha256, path: &Path) -> Result<()> {
+    for entry in WalkDir::new(path).sort_by_file_name() {
+        let entry = entry?;
+        let relative_path = entry.path().strip_prefix(path)?;
+        let file_type = entry.file_type();
+        if file_type.is_dir() {
+            hasher.update(b"dir\0");
+            hasher.update(relative_path.as_os_str().as_bytes());
+            hasher.update(b"\0");
+        } else if file_type.is_symlink() {
+            let target = std::fs::read_link(entry.path())?;
+            hasher.update(b"symlink\0");
+            hasher.update(relative_path.as_os_str().as_bytes());
+            hasher.update(b"\0");
+            hasher.update(target.as_os_str().as_bytes());
+            hasher.update(b"\0");
+        } else {
+            hasher.update(b"file\0");
+            hasher.update(relative_path.as_os_str().as_bytes());
+            hasher.update(b"\0");
+            hash_file(hasher, entry.path())?;
+        }
+    }
+    Ok(())
+}
+
+fn hash_str(hasher: &mut Sha256, tag: &str, value: &str) {
+    hasher.update(tag.as_bytes());
+    hasher.update(b"\0");
+    hasher.update(value.as_bytes());
+    hasher.update(b"\0");
+}
+
+impl CacheKeyInputs<'_> {
+    /// Computes the cache key as a hex-encoded SHA-256 digest.
+    ///
+    /// USE flags are sorted since their order doesn't matter, while the order
+    /// of USE flag overrides is significant.
+    pub fn compute_key(&self) -> Result<String> {
+        let mut hasher = Sha256::new();
+
+        hasher.update(b"tool\0");
+        hash_file(&mut hasher, self.tool)?;
+
+        hash_str(&mut hasher, "board", self.board.unwrap_or_default());
+
+        hasher.update(b"ebuild\0");
+        hash_file(&mut hasher, self.ebuild)?;
+
+        let mut files = self.files.clone();
+        files.sort();
+        for (name, source) in files {
+            hash_str(&mut hasher, "file", &name.to_string_lossy());
+            hash_path(&mut hasher, source)?;
+        }
+
+        let mut distfiles = self.distfiles.clone();
+        distfiles.sort();
+        for (name, source) in distfiles {
+            hash_str(&mut hasher, "distfile", &name.to_string_lossy());
+            hash_file(&mut hasher, source)?;
+        }
+
+        let mut git_trees: Vec<&PathBuf> = self.git_trees.iter().collect();
+        git_trees.sort();
+        for git_tree in git_trees {
+            // Git tree archives are named after their tree hashes, so their
+            // names identify their contents.
+            let name = git_tree
+                .file_name()
+                .with_context(|| format!("{} has no file name", git_tree.display()))?;
+            hash_str(&mut hasher, "git_tree", &name.to_string_lossy());
+        }
+
+        let mut use_flags: Vec<&str> = self.use_flags.iter().map(|s| s.as_str()).collect();
+        use_flags.sort();
+        hash_str(&mut hasher, "use", &use_flags.join(" "));
+        hash_str(&mut hasher, "use_overrides", &self.use_overrides.join(" "));
+
+        // The order of bashrcs is significant.
+        for bashrc in self.bashrcs {
+            hash_str(&mut hasher, "bashrc", &bashrc.to_string_lossy());
+        }
+
+        let mut sysroot_files = self.sysroot_files.clone();
+        sysroot_files.sort();
+        for (name, source) in sysroot_files {
+            hash_str(&mut hasher, "sysroot_file", &name.to_string_lossy());
+            hash_file(&mut hasher, source)?;
+        }
+
+        // Digest each extra input separately and sort the digests so that the
+        // key doesn't depend on the order of dependencies.
+        let mut extra_digests = self
+            .extra
+            .iter()
+            .map(|path| {
+                let mut hasher = Sha256::new();
+                hash_path(&mut hasher, path)?;
+                Ok(hex::encode(hasher.finalize()))
+            })
+            .collect::<Result<Vec<_>>>()?;
+        extra_digests.sort();
+        for digest in extra_digests {
+            hash_str(&mut hasher, "extra", &digest);
+        }
+
+        Ok(hex::encode(hasher.finalize()))
+    }
+}
+
+/// A remote cache of binary packages on Google Cloud Storage or an HTTP
+/// server. Binary packages are stored as `<URL>/<key>.tbz2`.
+#[derive(Clone, Debug)]
+pub struct BinpkgCache {
+    url: String,
+}
+
+impl BinpkgCache {
+    pub fn new(url: &str) -> Result<Self> {
+        if !["gs://", "http://", "https://"]
+            .iter()
+            .any(|scheme| url.starts_with(scheme))
+        {
+            bail!("Unsupported binary package cache URL: {url}");
+        }
+        Ok(Self {
+            url: url.trim_end_matches('/').to_string(),
+        })
+    }
+
+    fn object_url(&self, key: &str) -> String {
+        format!("{}/{}.tbz2", self.url, key)
+    }
+
+    /// Downloads the binary package for the key to `output`.
+    ///
+    /// Returns false if the package is missing in the cache or could not be
+    /// downloaded for other reasons.
+    pub fn fetch(&self, key: &str, output: &Path) -> Result<bool> {
+        let url = self.object_url(key);
+        let mut command = if self.url.starts_with("gs://") {
+            let mut command = Command::new("gsutil");
+            command.arg("-q").arg("cp").arg(&url).arg(output);
+            command
+        } else {
+            let mut command = Command::new("curl");
+            command.args(["-fsSL", "-o"]).arg(output).arg(&url);
+            command
+        };
+        let status = command
+            .status()
+            .with_context(|| format!("Failed to run {:?}", command.get_program()))?;
+        if !status.success() {
+            // Do not leave a partially downloaded file.
+            if output.try_exists()? {
+                std::fs::remove_file(output)?;
+            }
+            return Ok(false);
+        }
+        Ok(true)
+    }
+
+    /// Uploads a binary package built for the key.
+    pub fn upload(&self, key: &str, path: &Path) -> Result<()> {
+        let url = self.object_url(key);
+        let mut command = if self.url.starts_with("gs://") {
+            let mut command = Command::new("gsutil");
+            command.arg("-q").arg("cp").arg(path).arg(&url);
+            command
+        } else {
+            let mut command = Command::new("curl");
+            command.args(["-fsS", "-T"]).arg(path).arg(&url);
+            command
+        };
+        let status = command
+            .status()
+            .with_context(|| format!("Failed to run {:?}", command.get_program()))?;
+        if !status.success() {
+            bail!("Failed to upload {} to {url}: {status}", path.display());
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use fileutil::SafeTempDir;
+
+    use super::*;
+
+    #[test]
+    fn test_compute_key() -> Result<()> {
+        let temp_dir = SafeTempDir::new()?;
+        let temp_dir = temp_dir.path();
+        let ebuild = temp_dir.join("foo-1.ebuild");
+        std::fs::write(&ebuild, "EAPI=7\n")?;
+        let tool = temp_dir.join("build_package");
+        std::fs::write(&tool, "v1")?;
+        let dep_a = temp_dir.join("a.tbz2");
+        std::fs::write(&dep_a, "a")?;
+        let dep_b = temp_dir.join("b.tbz2");
+        std::fs::write(&dep_b, "b")?;
+
+        let use_flags = vec!["foo".to_string(), "-bar".to_string()];
+        let extra = vec![dep_a.clone(), dep_b.clone()];
+        let base = CacheKeyInputs {
+            tool: &tool,
+            board: Some("amd64-generic"),
+            ebuild: &ebuild,
+            files: vec![],
+            distfiles: vec![],
+            git_trees: &[],
+            use_flags: &use_flags,
+            use_overrides: &[],
+            bashrcs: &[],
+            sysroot_files: vec![],
+            extra: &extra,
+        };
+        let key = base.compute_key()?;
+        assert_eq!(key.len(), 64);
+
+        // The order of USE flags and dependencies doesn't matter.
+        let reordered_use_flags = vec!["-bar".to_string(), "foo".to_string()];
+        let reordered_extra = vec![dep_b.clone(), dep_a.clone()];
+        assert_eq!(
+            CacheKeyInputs {
+                use_flags: &reordered_use_flags,
+                extra: &reordered_extra,
+                ..base.clone()
+            }
+            .compute_key()?,
+            key
+        );
+
+        // Other inputs do matter.
+        let new_tool = temp_dir.join("build_package.new");
+        std::fs::write(&new_tool, "v2")?;
+        assert_ne!(
+            CacheKeyInputs {
+                tool: &new_tool,
+                ..base.clone()
+            }
+            .compute_key()?,
+            key
+        );
+        let use_overrides = vec!["-foo".to_string()];
+        assert_ne!(
+            CacheKeyInputs {
+                use_overrides: &use_overrides,
+                ..base.clone()
+            }
+            .compute_key()?,
+            key
+        );
+        assert_ne!(
+            CacheKeyInputs {
+                board: None,
+                ..base.clone()
+            }
+            .compute_key()?,
+            key
+        );
+        let extra_only_a = vec![dep_a.clone()];
+        assert_ne!(
+            CacheKeyInputs {
+                extra: &extra_only_a,
+                ..base.clone()
+            }
+            .compute_key()?,
+            key
+        );
+        let bashrcs = vec![PathBuf::from("/mnt/host/bashrc")];
+        assert_ne!(
+            CacheKeyInputs {
+                bashrcs: &bashrcs,
+                ..base.clone()
+            }
+            .compute_key()?,
+            key
+        );
+        let sysroot_file = temp_dir.join("config");
+        std::fs::write(&sysroot_file, "x")?;
+        let with_sysroot_file = CacheKeyInputs {
+            sysroot_files: vec![(Path::new("/etc/config"), &sysroot_file)],
+            ..base.clone()
+        };
+        let sysroot_file_key = with_sysroot_file.compute_key()?;
+        assert_ne!(sysroot_file_key, key);
+        std::fs::write(&sysroot_file, "y")?;
+        assert_ne!(with_sysroot_file.compute_key()?, sysroot_file_key);
+        std::fs::write(&dep_b, "b2")?;
+        assert_ne!(base.compute_key()?, key);
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_new() {
+        assert!(BinpkgCache::new("gs://bucket/binpkgs/").is_ok());
+        assert!(BinpkgCache::new("https://example.com/binpkgs").is_ok());
+        assert!(BinpkgCache::new("/tmp/binpkgs").is_err());
+        assert_eq!(
+            BinpkgCache::new("gs://bucket/binpkgs/")
+                .unwrap()
+                .object_url("abc"),
+            "gs://bucket/binpkgs/abc.tbz2"
+        );
+    }
+}
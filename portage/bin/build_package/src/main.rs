@@ -2,31 +2,53 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::{anyhow, bail, ensure, Context, Result};
+mod binpkg_cache;
+mod phase_timing;
+mod sandbox_policy;
+mod source_audit;
+
+use anyhow::{anyhow, bail, Context, Result};
+use binarypackage::BinaryPackage;
+use binpkg_cache::{BinpkgCache, CacheKeyInputs};
 use clap::{command, Parser};
-use cliutil::{cli_main, expanded_args_os};
-use container::{enter_mount_namespace, BindMount, CommonArgs, ContainerSettings};
+use cliutil::{cli_main, expanded_args_os, LoggingArgs};
+use container::{
+    enter_mount_namespace_with_id_maps, exit_on_container_error, BindMount, CommonArgs,
+    ContainerError, ContainerSettings, IdMap, MountPropagation,
+};
+use itertools::Itertools;
+use manifest::Manifest;
+use sandbox_policy::{Violation, WriteAudit};
+use source_audit::SourceAudit;
 use std::format;
 use std::io::Write;
 use std::{
     borrow::Cow,
-    collections::{HashMap, HashSet},
+    collections::{BTreeSet, HashMap, HashSet},
     ffi::{OsStr, OsString},
     fs::File,
     io::BufReader,
-    os::unix::process::ExitStatusExt,
     path::{Path, PathBuf},
     process::ExitCode,
     str::FromStr,
+    time::SystemTime,
 };
 
 const EBUILD_EXT: &str = ".ebuild";
 const MAIN_SCRIPT: &str = "/mnt/host/.build_package/build_package.sh";
 const JOB_SERVER: &str = "/mnt/host/.build_package/jobserver";
+const USE_OVERRIDES_XPAK_KEY: &str = "USE_OVERRIDES";
+const FAKEFS_DB_DIR: &str = "/var/tmp/fakefs_db";
+const FAKEFS_DB_EXPORT: &str = "/var/tmp/fakefs_db.txt";
 
 #[derive(Parser, Debug)]
 #[clap(author, version, about, long_about=None)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
@@ -43,6 +65,27 @@ struct Cli {
     #[arg(long)]
     distfile: Vec<BindMount>,
 
+    /// Path to the Manifest file of the package.
+    #[arg(long)]
+    manifest: Option<PathBuf>,
+
+    /// Verifies distfiles against their checksums in the Manifest before
+    /// starting the build.
+    #[arg(long, requires = "manifest")]
+    verify_distfiles: bool,
+
+    /// Maps a range of UIDs in the container in the form of
+    /// "<inside>:<outside>:<count>", e.g. "0:1000:1" for the current user and
+    /// "1:100000:65536" for its subordinate UIDs. This allows emerge to drop
+    /// privileges to the portage user. Requires newuidmap(1).
+    #[arg(long)]
+    uid_map: Vec<IdMap>,
+
+    /// Maps a range of GIDs in the container, similarly to --uid-map.
+    /// Requires newgidmap(1).
+    #[arg(long)]
+    gid_map: Vec<IdMap>,
+
     /// Git trees used by CROS_WORKON_TREE
     #[arg(long)]
     git_tree: Vec<PathBuf>,
@@ -52,6 +95,12 @@ struct Cli {
     #[arg(long, value_delimiter = ',')]
     use_flags: Vec<String>,
 
+    /// USE flag to override on top of --use-flags, e.g. "foo" or "-foo".
+    /// Can be specified multiple times. The overrides are recorded in the
+    /// binary package as the USE_OVERRIDES XPAK entry.
+    #[arg(long = "use", allow_hyphen_values = true)]
+    use_overrides: Vec<String>,
+
     /// The bashrc files to execute. The path must be absolute.
     #[arg(long)]
     bashrc: Vec<PathBuf>,
@@ -76,6 +125,28 @@ struct Cli {
     #[arg(long)]
     output: Option<PathBuf>,
 
+    /// Records SHA-256 digests of the files in the output binary package in
+    /// its CONTENTS_DIGESTS XPAK entry.
+    #[arg(long, requires = "output")]
+    contents_digests: bool,
+
+    /// URL of a remote binary package cache, e.g. gs://bucket/binpkgs or
+    /// https://example.com/binpkgs. If a binary package built from the same
+    /// inputs is found there, it is downloaded to --output instead of building
+    /// the package.
+    #[arg(long, value_name = "URL", requires = "output")]
+    binpkg_cache: Option<String>,
+
+    /// Uploads the built binary package to the remote binary package cache.
+    #[arg(long, requires = "binpkg_cache")]
+    binpkg_cache_upload: bool,
+
+    /// Extra file or directory to include in the binary package cache key,
+    /// such as binary packages of dependencies. Can be specified multiple
+    /// times.
+    #[arg(long, value_name = "PATH")]
+    binpkg_cache_key_input: Vec<PathBuf>,
+
     /// <inside path>=<outside path>: Copies the outside file into the sysroot
     #[arg(long)]
     sysroot_file: Vec<SysrootFileSpec>,
@@ -84,6 +155,38 @@ struct Cli {
     #[arg(long)]
     allow_network_access: bool,
 
+    /// Audits reads of source code under /mnt/host/source with auditfuse, and
+    /// writes accesses not covered by --declared-source to this file.
+    #[arg(long, value_name = "PATH")]
+    audit_source_reads: Option<PathBuf>,
+
+    /// Source directory declared by the package, relative to
+    /// /mnt/host/source, e.g. "src/platform2/common-mk". Can be specified
+    /// multiple times. Used by --audit-source-reads and --sandbox-report.
+    #[arg(long, value_name = "PATH")]
+    declared_source: Vec<PathBuf>,
+
+    /// Checks the build against the policy of Portage's sandbox, and writes
+    /// violations to this file: writes outside PORTAGE_TMPDIR (which
+    /// contains ${D} and ${T}), PKGDIR and temporary directories, and reads
+    /// of source code not covered by --declared-source.
+    #[arg(long, value_name = "PATH")]
+    sandbox_report: Option<PathBuf>,
+
+    /// Fails the build if it violates the sandbox policy.
+    #[arg(long, requires = "sandbox_report")]
+    enforce_sandbox_policy: bool,
+
+    /// Makes fakefs record file ownership and modes in a database instead of
+    /// xattrs, and writes those of files under PORTAGE_TMPDIR to this file
+    /// after the build. Paths in the file are relative to PORTAGE_TMPDIR.
+    #[arg(long, value_name = "PATH", conflicts_with = "binpkg_cache")]
+    fakefs_db_output: Option<PathBuf>,
+
+    /// Writes the time spent on each ebuild phase to this file in JSON.
+    #[arg(long, value_name = "PATH")]
+    phase_timings: Option<PathBuf>,
+
     /// Remoteexec-related info encoded as JSON.
     #[arg(long)]
     remoteexec_info: Option<PathBuf>,
@@ -163,13 +266,15 @@ impl FromStr for EbuildMetadata {
 }
 
 /// Writes a package.use for the specific package that sets the specified USE flags.
+/// The overrides are appended after the USE flags so that they take precedence.
 /// If there are no flags, nothing is written.
 fn write_use_flags(
     sysroot: &Path,
     package: &EbuildMetadata,
-    use_flags: &Vec<String>,
+    use_flags: &[String],
+    use_overrides: &[String],
 ) -> Result<()> {
-    if use_flags.is_empty() {
+    if use_flags.is_empty() && use_overrides.is_empty() {
         return Ok(());
     }
 
@@ -182,7 +287,7 @@ fn write_use_flags(
         "{}/{} {}",
         package.category,
         package.package_name,
-        use_flags.join(" ")
+        use_flags.iter().chain(use_overrides).join(" ")
     );
 
     std::fs::write(&package_use_path, content)
@@ -191,6 +296,25 @@ fn write_use_flags(
     Ok(())
 }
 
+/// Records the USE flag overrides in the XPAK of the binary package so that
+/// it is possible to tell that the package was built with non-default flags.
+fn record_use_overrides(binary_package: &Path, use_overrides: &[String]) -> Result<()> {
+    if use_overrides.is_empty() {
+        return Ok(());
+    }
+
+    let pkg = BinaryPackage::open(binary_package)?;
+    let mut xpak = pkg.xpak().clone();
+    xpak.insert(
+        USE_OVERRIDES_XPAK_KEY.to_string(),
+        format!("{}\n", use_overrides.join(" ")).into_bytes(),
+    );
+    pkg.replace_xpak(&xpak)
+        .with_context(|| format!("Failed to update XPAK of {binary_package:?}"))?;
+
+    Ok(())
+}
+
 /// Writes a profile.bashrc for the specific package. It uses `source` to
 /// execute the files so that when the script is executed `${BASH_SOURCE[0]}`
 /// reports the correct path.
@@ -262,8 +386,85 @@ struct RemoteexecInfo {
     gcloud_config_dir: Option<PathBuf>,
 }
 
-fn do_main() -> Result<()> {
-    let args = Cli::try_parse_from(expanded_args_os()?)?;
+/// Returns the package name with the version and revision, e.g.
+/// "attr-2.5.1-r1", which Portage calls PF.
+fn ebuild_pf(ebuild: &EbuildMetadata) -> Result<&str> {
+    ebuild
+        .file_name
+        .strip_suffix(EBUILD_EXT)
+        .with_context(|| anyhow!("Ebuild file must end with .ebuild"))
+}
+
+/// Computes the key to look up the remote binary package cache with.
+fn compute_binpkg_cache_key(args: &Cli) -> Result<String> {
+    let tool = std::env::current_exe().context("Failed to locate build_package")?;
+    CacheKeyInputs {
+        tool: &tool,
+        board: args.board.as_deref(),
+        ebuild: &args.ebuild.source,
+        files: args
+            .file
+            .iter()
+            .map(|mount| (mount.mount_path.as_path(), mount.source.as_path()))
+            .collect(),
+        distfiles: args
+            .distfile
+            .iter()
+            .map(|mount| (mount.mount_path.as_path(), mount.source.as_path()))
+            .collect(),
+        git_trees: &args.git_tree,
+        use_flags: &args.use_flags,
+        use_overrides: &args.use_overrides,
+        bashrcs: &args.bashrc,
+        sysroot_files: args
+            .sysroot_file
+            .iter()
+            .map(|spec| (spec.sysroot_path.as_path(), spec.src_path.as_path()))
+            .collect(),
+        extra: &args.binpkg_cache_key_input,
+    }
+    .compute_key()
+}
+
+fn do_main(args: Cli) -> Result<()> {
+    let binpkg_cache = match &args.binpkg_cache {
+        Some(url) => {
+            let cache = BinpkgCache::new(url)?;
+            let key = compute_binpkg_cache_key(&args)
+                .context("Failed to compute the binary package cache key")?;
+            let output = args.output.as_deref().unwrap();
+            match cache.fetch(&key, output) {
+                Ok(true) => {
+                    eprintln!("Downloaded the binary package from the cache (key: {key})");
+                    // The cached package may have been built without digests.
+                    if args.contents_digests {
+                        let pkg = BinaryPackage::open(output)?;
+                        if pkg.contents_digests()?.is_none() {
+                            pkg.embed_contents_digests()?;
+                        }
+                    }
+                    record_use_overrides(output, &args.use_overrides)?;
+                    if let Some(report) = &args.phase_timings {
+                        // No phase ran.
+                        phase_timing::write_report(
+                            report,
+                            &format!("{}/{}", args.ebuild.category, ebuild_pf(&args.ebuild)?),
+                            &[],
+                        )?;
+                    }
+                    return Ok(());
+                }
+                Ok(false) => {
+                    eprintln!("Binary package cache miss (key: {key})");
+                }
+                Err(e) => {
+                    eprintln!("WARNING: Failed to look up the binary package cache: {e:?}");
+                }
+            }
+            Some((cache, key))
+        }
+        None => None,
+    };
 
     let mut settings = ContainerSettings::new();
     settings.apply_common_args(&args.common)?;
@@ -274,12 +475,14 @@ fn do_main() -> Result<()> {
         source: runfiles::rlocation!(r, "cros/bazel/portage/bin/build_package/build_package.sh"),
         mount_path: PathBuf::from(MAIN_SCRIPT),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     settings.push_bind_mount(BindMount {
         source: args.ebuild.source.clone(),
         mount_path: args.ebuild.mount_path.clone(),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     let ebuild_mount_dir = args.ebuild.mount_path.parent().unwrap();
@@ -289,14 +492,27 @@ fn do_main() -> Result<()> {
             source: mount.source,
             mount_path: ebuild_mount_dir.join(mount.mount_path),
             rw: false,
+            propagation: MountPropagation::Private,
         })
     }
 
+    if args.verify_distfiles {
+        let manifest_path = args.manifest.as_deref().unwrap();
+        let manifest = Manifest::load(manifest_path)?;
+        for mount in &args.distfile {
+            let filename = mount.mount_path.to_string_lossy();
+            manifest
+                .verify_distfile(&filename, &mount.source)
+                .with_context(|| format!("Distfile {filename} is corrupted"))?;
+        }
+    }
+
     for mount in args.distfile {
         settings.push_bind_mount(BindMount {
             source: mount.source,
             mount_path: PathBuf::from("/var/cache/distfiles").join(mount.mount_path),
             rw: false,
+            propagation: MountPropagation::Private,
         })
     }
 
@@ -315,12 +531,15 @@ fn do_main() -> Result<()> {
             mount_path: PathBuf::from("/var/cache/trees")
                 .join(file.file_name().expect("path to contain file name")),
             rw: false,
+            propagation: MountPropagation::Private,
         })
     }
 
-    settings.set_allow_network_access(args.allow_network_access);
-
+    // Keep the network mode set by --network unless network access is
+    // required by the package.
     if args.allow_network_access {
+        settings.set_allow_network_access(true);
+
         // TODO(b/329422481): Remove this.
         eprintln!("### Debug log for b/329422481 ###");
         for path in [
@@ -366,6 +585,7 @@ fn do_main() -> Result<()> {
                     source: path.to_owned(),
                     mount_path: path.to_owned(),
                     rw: false,
+                    propagation: MountPropagation::Private,
                 })
             }
         }
@@ -398,6 +618,7 @@ fn do_main() -> Result<()> {
             mount_path: portage_cache_dir,
             source: dir,
             rw: true,
+            propagation: MountPropagation::Private,
         });
     }
 
@@ -407,6 +628,7 @@ fn do_main() -> Result<()> {
                 mount_path: PathBuf::from("/var/cache/distfiles/ccache"),
                 source: ccache_dir,
                 rw: true,
+                propagation: MountPropagation::Private,
             });
         }
     }
@@ -434,6 +656,7 @@ fn do_main() -> Result<()> {
                 source: gcloud_config_dir,
                 mount_path: PathBuf::from("/home/root/.config/gcloud"),
                 rw: false,
+                propagation: MountPropagation::Private,
             });
         }
     }
@@ -445,6 +668,7 @@ fn do_main() -> Result<()> {
             source: jobserver,
             mount_path: PathBuf::from(JOB_SERVER),
             rw: false,
+            propagation: MountPropagation::Private,
         });
 
         envs.push((
@@ -453,6 +677,22 @@ fn do_main() -> Result<()> {
         ));
     }
 
+    if args.fakefs_db_output.is_some() {
+        // build_package.sh exports the database after the build.
+        envs.push((
+            OsStr::new("FAKEFS_DB").into(),
+            OsStr::new(FAKEFS_DB_DIR).into(),
+        ));
+        envs.push((
+            OsStr::new("FAKEFS_DB_EXPORT").into(),
+            OsStr::new(FAKEFS_DB_EXPORT).into(),
+        ));
+        envs.push((
+            OsStr::new("FAKEFS_DB_ROOT").into(),
+            portage_tmp_dir.as_os_str().to_owned().into(),
+        ));
+    }
+
     let mut container = settings.prepare()?;
 
     let root_dir = container.root_dir().to_owned();
@@ -471,9 +711,34 @@ fn do_main() -> Result<()> {
         spec.install(&sysroot)?;
     }
 
-    write_use_flags(&sysroot, &args.ebuild, &args.use_flags)?;
+    write_use_flags(&sysroot, &args.ebuild, &args.use_flags, &args.use_overrides)?;
     write_profile_bashrc(&sysroot, &args.bashrc)?;
 
+    let audit = if args.audit_source_reads.is_some() || args.sandbox_report.is_some() {
+        let audit = SourceAudit::start(container.root_dir())
+            .context("Failed to start auditing source reads")?;
+        if audit.is_none() {
+            eprintln!(
+                "WARNING: {} does not exist; source reads are not audited",
+                source_audit::SOURCE_DIR
+            );
+        }
+        audit
+    } else {
+        None
+    };
+
+    let write_audit = match &args.sandbox_report {
+        Some(_) => Some(
+            WriteAudit::start(container.upper_dir(), &[&portage_tmp_dir, &portage_pkg_dir])
+                .context("Failed to start auditing writes")?,
+        ),
+        None => None,
+    };
+
+    let category = args.ebuild.category.clone();
+    let pf = ebuild_pf(&args.ebuild)?.to_owned();
+
     let mut command = container.command(MAIN_SCRIPT);
     command
         .arg("ebuild")
@@ -495,39 +760,121 @@ fn do_main() -> Result<()> {
         if args.ccache { "1" } else { "0" },
     );
 
-    let status = command.status()?;
+    let start_time = SystemTime::now();
+    let status = command.status().context(ContainerError::Setup)?;
+
+    let build_dir = container
+        .root_dir()
+        .join(portage_tmp_dir.strip_prefix("/")?)
+        .join(&category)
+        .join(&pf);
+    let timings = phase_timing::collect_phase_timings(&build_dir, start_time)
+        .context("Failed to collect phase timings")?;
+    if !timings.is_empty() {
+        eprintln!("Phase timings: {}", phase_timing::format_summary(&timings));
+    }
+    if let Some(report) = &args.phase_timings {
+        phase_timing::write_report(report, &format!("{category}/{pf}"), &timings)?;
+    }
+
+    let undeclared = match audit {
+        Some(audit) => audit.finish(&args.declared_source)?,
+        None => Default::default(),
+    };
+    if let Some(report) = &args.audit_source_reads {
+        source_audit::write_report(report, &undeclared)?;
+        if !undeclared.is_empty() {
+            eprintln!(
+                "WARNING: The build read {} undeclared source paths. See {}",
+                undeclared.len(),
+                report.display()
+            );
+        }
+    }
+
+    let mut violations: BTreeSet<Violation> = BTreeSet::new();
+    if let Some(report) = &args.sandbox_report {
+        violations.extend(undeclared.into_iter().map(Violation::Read));
+        if let Some(write_audit) = write_audit {
+            violations.extend(write_audit.finish()?.into_iter().map(Violation::Write));
+        }
+        sandbox_policy::write_report(report, &violations)?;
+        if !violations.is_empty() && !args.enforce_sandbox_policy {
+            eprintln!(
+                "WARNING: The build violated the sandbox policy {} times. See {}",
+                violations.len(),
+                report.display()
+            );
+        }
+    }
+
     collect_reclient_log_files(container.root_dir())
         .context("Failed to collect reclient log files")?;
-    ensure!(
-        status.success(),
-        "Command failed: status={:?}, code={:?}, signal={:?}",
-        status,
-        status.code(),
-        status.signal()
-    );
+    container.check_status(status)?;
 
-    let binary_out_path = portage_pkg_dir.join(args.ebuild.category).join(format!(
-        "{}.tbz2",
-        args.ebuild
-            .file_name
-            .strip_suffix(EBUILD_EXT)
-            .with_context(|| anyhow!("Ebuild file must end with .ebuild"))?
-    ));
+    if args.enforce_sandbox_policy && !violations.is_empty() {
+        bail!(
+            "The build violated the sandbox policy:\n{}",
+            violations.iter().join("\n")
+        );
+    }
+
+    let binary_out_path = portage_pkg_dir.join(&category).join(format!("{pf}.tbz2"));
+
+    if let Some(output) = &args.fakefs_db_output {
+        std::fs::copy(
+            container
+                .root_dir()
+                .join(FAKEFS_DB_EXPORT.strip_prefix('/').unwrap()),
+            output,
+        )
+        .with_context(|| format!("{FAKEFS_DB_EXPORT} wasn't produced by build_package"))?;
+    }
 
     if let Some(output) = args.output {
         std::fs::copy(
             container
                 .root_dir()
                 .join(binary_out_path.strip_prefix("/")?),
-            output,
+            &output,
         )
         .with_context(|| format!("{binary_out_path:?} wasn't produced by build_package"))?;
+
+        // Make the output reproducible so that Bazel caching and package
+        // comparison are not affected by build timestamps.
+        BinaryPackage::normalize(&output)
+            .with_context(|| format!("Failed to normalize {output:?}"))?;
+
+        if args.contents_digests {
+            BinaryPackage::open(&output)?
+                .embed_contents_digests()
+                .with_context(|| format!("Failed to record file digests in {output:?}"))?;
+        }
+
+        // Upload the package before recording USE flag overrides so that a
+        // cache hit goes through the same step as a fresh build.
+        if let Some((cache, key)) = &binpkg_cache {
+            if args.binpkg_cache_upload {
+                if let Err(e) = cache.upload(key, &output) {
+                    eprintln!("WARNING: Failed to upload to the binary package cache: {e:?}");
+                }
+            }
+        }
+
+        record_use_overrides(&output, &args.use_overrides)?;
     }
 
     Ok(())
 }
 
 fn main() -> ExitCode {
-    enter_mount_namespace().expect("Failed to enter a mount namespace");
-    cli_main(do_main, Default::default())
+    // Parse arguments before entering a mount namespace since ID mappings
+    // must be set up on entering a user namespace.
+    let args = Cli::parse_from(expanded_args_os().expect("Failed to expand arguments"));
+    enter_mount_namespace_with_id_maps(&args.uid_map, &args.gid_map)
+        .expect("Failed to enter a mount namespace");
+    cli_main(
+        || exit_on_container_error(do_main(args)),
+        Default::default(),
+    )
 }
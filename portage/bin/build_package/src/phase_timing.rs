@@ -0,0 +1,154 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use itertools::Itertools;
+use serde_json::json;
+use std::{
+    io::ErrorKind,
+    path::Path,
+    time::{Duration, SystemTime},
+};
+
+/// Ebuild phases with the marker files Portage creates in the build directory
+/// when they complete.
+const PHASE_MARKERS: &[(&str, &str)] = &[
+    ("setup", ".setuped"),
+    ("unpack", ".unpacked"),
+    ("prepare", ".prepared"),
+    ("configure", ".configured"),
+    ("compile", ".compiled"),
+    ("test", ".tested"),
+    ("install", ".installed"),
+    ("package", ".packaged"),
+];
+
+/// Time spent on an ebuild phase.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct PhaseTiming {
+    pub phase: &'static str,
+    pub duration: Duration,
+}
+
+/// Computes the time spent on each ebuild phase from the modification times of
+/// the phase marker files in a Portage build directory, e.g.
+/// /var/tmp/portage/sys-apps/attr-2.5.1.
+///
+/// A phase is considered to start when the preceding phase completes. The
+/// first phase starts at `start_time`, so it also covers the time spent on
+/// setting up the container and starting Portage. Phases that did not run are
+/// omitted.
+pub fn collect_phase_timings(build_dir: &Path, start_time: SystemTime) -> Result<Vec<PhaseTiming>> {
+    let mut completions = Vec::new();
+    for (phase, marker) in PHASE_MARKERS {
+        let path = build_dir.join(marker);
+        let modified = match std::fs::metadata(&path) {
+            Ok(metadata) => metadata.modified()?,
+            Err(e) if e.kind() == ErrorKind::NotFound => continue,
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to stat {}", path.display()));
+            }
+        };
+        completions.push((*phase, modified));
+    }
+
+    // Phases do not necessarily complete in the order above, e.g. when a
+    // phase is requested explicitly after others, so order them by time.
+    completions.sort_by_key(|(_, modified)| *modified);
+
+    let mut last = start_time;
+    Ok(completions
+        .into_iter()
+        .map(|(phase, modified)| {
+            let duration = modified.duration_since(last).unwrap_or_default();
+            last = last.max(modified);
+            PhaseTiming { phase, duration }
+        })
+        .collect())
+}
+
+/// Formats phase timings in a single line, e.g.
+/// "setup 1.2s, unpack 0.3s, compile 40.5s".
+pub fn format_summary(timings: &[PhaseTiming]) -> String {
+    timings
+        .iter()
+        .map(|t| format!("{} {:.1}s", t.phase, t.duration.as_secs_f64()))
+        .join(", ")
+}
+
+/// Writes phase timings of a package to a JSON file.
+pub fn write_report(path: &Path, package: &str, timings: &[PhaseTiming]) -> Result<()> {
+    let report = json!({
+        "package": package,
+        "phases": timings
+            .iter()
+            .map(|t| json!({
+                "phase": t.phase,
+                "seconds": t.duration.as_secs_f64(),
+            }))
+            .collect_vec(),
+        "total_seconds": timings
+            .iter()
+            .map(|t| t.duration)
+            .sum::<Duration>()
+            .as_secs_f64(),
+    });
+    std::fs::write(path, serde_json::to_string_pretty(&report)?)
+        .with_context(|| format!("Failed to write {}", path.display()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use fileutil::SafeTempDir;
+
+    fn touch(path: &Path, time: SystemTime) -> Result<()> {
+        std::fs::File::create(path)?.set_modified(time)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_collect_phase_timings() -> Result<()> {
+        let build_dir = SafeTempDir::new()?;
+        let build_dir = build_dir.path();
+        let start_time = SystemTime::UNIX_EPOCH + Duration::from_secs(1000);
+        let at = |secs: u64| start_time + Duration::from_secs(secs);
+
+        touch(&build_dir.join(".setuped"), at(2))?;
+        touch(&build_dir.join(".unpacked"), at(3))?;
+        touch(&build_dir.join(".prepared"), at(3))?;
+        touch(&build_dir.join(".compiled"), at(13))?;
+        touch(&build_dir.join(".installed"), at(15))?;
+        touch(&build_dir.join(".packaged"), at(16))?;
+        // The test phase may complete after the package phase.
+        touch(&build_dir.join(".tested"), at(20))?;
+
+        let timings = collect_phase_timings(build_dir, start_time)?;
+        assert_eq!(
+            format_summary(&timings),
+            "setup 2.0s, unpack 1.0s, prepare 0.0s, compile 10.0s, install 2.0s, package 1.0s, test 4.0s"
+        );
+
+        let report_path = build_dir.join("report.json");
+        write_report(&report_path, "sys-apps/attr-2.5.1", &timings)?;
+        let report: serde_json::Value = serde_json::from_slice(&std::fs::read(&report_path)?)?;
+        assert_eq!(report["package"], "sys-apps/attr-2.5.1");
+        assert_eq!(
+            report["phases"][3],
+            json!({"phase": "compile", "seconds": 10.0})
+        );
+        assert_eq!(report["total_seconds"], 20.0);
+        Ok(())
+    }
+
+    #[test]
+    fn test_collect_phase_timings_empty() -> Result<()> {
+        let build_dir = SafeTempDir::new()?;
+        assert_eq!(
+            collect_phase_timings(build_dir.path(), SystemTime::now())?,
+            vec![]
+        );
+        Ok(())
+    }
+}
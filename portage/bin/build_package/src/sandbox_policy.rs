@@ -0,0 +1,219 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    fmt::Display,
+    io::Write,
+    os::unix::fs::MetadataExt,
+    path::{Path, PathBuf},
+};
+use walkdir::WalkDir;
+
+use crate::source_audit::AuditEntry;
+
+/// Directories the build may write to, relative to the container root, in
+/// addition to PORTAGE_TMPDIR and PKGDIR. They follow the default write
+/// permissions of Portage's sandbox.
+const ALLOWED_WRITE_DIRS: &[&str] = &["dev", "proc", "tmp", "var/tmp"];
+
+/// A violation of the sandbox policy that Portage would enforce with
+/// FEATURES=sandbox, which is unavailable in our containers.
+#[derive(Clone, Debug, Eq, Ord, PartialEq, PartialOrd)]
+pub enum Violation {
+    /// A file outside of the allowed directories was created, modified or
+    /// deleted. The path is absolute in the container.
+    Write(PathBuf),
+    /// Source code not declared by the package was read.
+    Read(AuditEntry),
+}
+
+impl Display for Violation {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Write(path) => write!(f, "WRITE\t{}", path.display()),
+            Self::Read(entry) => write!(f, "{entry}"),
+        }
+    }
+}
+
+/// Identifies the state of a file in an overlayfs upper directory.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+struct FileStamp {
+    ino: u64,
+    ctime: i64,
+    ctime_nsec: i64,
+}
+
+fn walk_upper_dir(upper_dir: &Path) -> Result<BTreeMap<PathBuf, (FileStamp, bool)>> {
+    let mut files = BTreeMap::new();
+    for entry in WalkDir::new(upper_dir).min_depth(1) {
+        let entry = entry?;
+        let metadata = entry.metadata()?;
+        let stamp = FileStamp {
+            ino: metadata.ino(),
+            ctime: metadata.ctime(),
+            ctime_nsec: metadata.ctime_nsec(),
+        };
+        let rel_path = entry.path().strip_prefix(upper_dir)?.to_owned();
+        files.insert(rel_path, (stamp, metadata.is_dir()));
+    }
+    Ok(files)
+}
+
+/// Detects writes by a build by comparing an overlayfs upper directory
+/// before and after the build.
+///
+/// Files set up by build_package itself, e.g. make.conf, are in the upper
+/// directory before the build starts, so they are not reported unless the
+/// build modifies them.
+pub struct WriteAudit {
+    upper_dir: PathBuf,
+    allowed_dirs: Vec<PathBuf>,
+    baseline: BTreeMap<PathBuf, (FileStamp, bool)>,
+}
+
+impl WriteAudit {
+    /// Takes a snapshot of an upper directory. `allowed_dirs` are absolute
+    /// paths in the container, in addition to [`ALLOWED_WRITE_DIRS`].
+    pub fn start(upper_dir: &Path, allowed_dirs: &[&Path]) -> Result<Self> {
+        let allowed_dirs = ALLOWED_WRITE_DIRS
+            .iter()
+            .map(PathBuf::from)
+            .chain(
+                allowed_dirs
+                    .iter()
+                    .map(|dir| dir.strip_prefix("/").unwrap_or(dir).to_owned()),
+            )
+            .collect();
+        let baseline = walk_upper_dir(upper_dir)
+            .with_context(|| format!("Failed to scan {}", upper_dir.display()))?;
+        Ok(Self {
+            upper_dir: upper_dir.to_owned(),
+            allowed_dirs,
+            baseline,
+        })
+    }
+
+    /// Returns absolute paths in the container written outside of the allowed
+    /// directories since [`WriteAudit::start`]. When a new directory is
+    /// reported, its contents are not.
+    pub fn finish(self) -> Result<BTreeSet<PathBuf>> {
+        let current = walk_upper_dir(&self.upper_dir)
+            .with_context(|| format!("Failed to scan {}", self.upper_dir.display()))?;
+
+        let mut violations: BTreeSet<PathBuf> = BTreeSet::new();
+        for (rel_path, (stamp, is_dir)) in current {
+            if self
+                .allowed_dirs
+                .iter()
+                .any(|dir| rel_path.starts_with(dir) || dir.starts_with(&rel_path))
+            {
+                continue;
+            }
+            let old = self.baseline.get(&rel_path);
+            let changed = match old {
+                None => true,
+                // The ctime of a directory changes whenever its entries
+                // change, which is reported for the entries themselves.
+                Some(_) if is_dir => false,
+                Some((old_stamp, _)) => *old_stamp != stamp,
+            };
+            if !changed {
+                continue;
+            }
+            // BTreeMap iterates parents before their contents.
+            if violations.iter().any(|dir| rel_path.starts_with(dir)) {
+                continue;
+            }
+            violations.insert(rel_path);
+        }
+
+        // Files deleted from the upper directory are also writes. Deletions
+        // of files in lower layers appear as whiteouts, i.e. new character
+        // devices, which are handled above.
+        for rel_path in self.baseline.keys() {
+            if self.upper_dir.join(rel_path).symlink_metadata().is_err()
+                && !self
+                    .allowed_dirs
+                    .iter()
+                    .any(|dir| rel_path.starts_with(dir))
+                && !violations.iter().any(|dir| rel_path.starts_with(dir))
+            {
+                violations.insert(rel_path.clone());
+            }
+        }
+
+        Ok(violations
+            .into_iter()
+            .map(|rel_path| Path::new("/").join(rel_path))
+            .collect())
+    }
+}
+
+/// Writes sandbox policy violations to a report file, one per line.
+pub fn write_report(path: &Path, violations: &BTreeSet<Violation>) -> Result<()> {
+    let mut out = std::fs::File::create(path)
+        .with_context(|| format!("Failed to create {}", path.display()))?;
+    for violation in violations {
+        writeln!(out, "{violation}")?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use fileutil::SafeTempDir;
+
+    #[test]
+    fn test_write_audit() -> Result<()> {
+        let upper_dir = SafeTempDir::new()?;
+        let upper_dir = upper_dir.path();
+        std::fs::create_dir_all(upper_dir.join("etc"))?;
+        std::fs::write(upper_dir.join("etc/make.conf"), "")?;
+        std::fs::write(upper_dir.join("etc/untouched.conf"), "")?;
+
+        let audit = WriteAudit::start(upper_dir, &[Path::new("/build/board/tmp/portage")])?;
+
+        // Allowed writes.
+        std::fs::create_dir_all(upper_dir.join("build/board/tmp/portage/image"))?;
+        std::fs::write(upper_dir.join("build/board/tmp/portage/image/a"), "")?;
+        std::fs::create_dir(upper_dir.join("tmp"))?;
+        std::fs::write(upper_dir.join("tmp/b"), "")?;
+
+        // Violations.
+        std::fs::remove_file(upper_dir.join("etc/make.conf"))?;
+        std::fs::write(upper_dir.join("etc/make.conf"), "FEATURES=-sandbox")?;
+        std::fs::create_dir_all(upper_dir.join("usr/share/foo"))?;
+        std::fs::write(upper_dir.join("usr/share/foo/bar"), "")?;
+        std::fs::create_dir_all(upper_dir.join("build/board/etc"))?;
+        std::fs::write(upper_dir.join("build/board/etc/baz"), "")?;
+
+        assert_eq!(
+            audit.finish()?,
+            BTreeSet::from([
+                PathBuf::from("/build/board/etc"),
+                PathBuf::from("/etc/make.conf"),
+                PathBuf::from("/usr"),
+            ])
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_write_audit_deletion() -> Result<()> {
+        let upper_dir = SafeTempDir::new()?;
+        let upper_dir = upper_dir.path();
+        std::fs::create_dir_all(upper_dir.join("etc"))?;
+        std::fs::write(upper_dir.join("etc/foo"), "")?;
+
+        let audit = WriteAudit::start(upper_dir, &[])?;
+        std::fs::remove_file(upper_dir.join("etc/foo"))?;
+
+        assert_eq!(audit.finish()?, BTreeSet::from([PathBuf::from("/etc/foo")]));
+        Ok(())
+    }
+}
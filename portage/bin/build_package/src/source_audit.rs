@@ -0,0 +1,157 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use auditfuse_lib::{AccessType, AuditfuseDaemon, AuditfuseOptions};
+use nix::mount::{mount, umount2, MntFlags, MsFlags};
+use std::{
+    collections::BTreeSet,
+    io::Write,
+    path::{Path, PathBuf},
+};
+use tempfile::{NamedTempFile, TempDir};
+
+pub use auditfuse_lib::AuditEntry;
+
+/// The directory in the container where source code is mounted.
+pub const SOURCE_DIR: &str = "/mnt/host/source";
+
+/// Returns whether an access is covered by declared source paths.
+///
+/// Looking up ancestors of declared paths is necessary to reach them, so it is
+/// allowed. Listing an ancestor is not, as it reveals undeclared siblings.
+/// The path of `entry` is relative to [`SOURCE_DIR`].
+fn is_declared(entry: &AuditEntry, declared: &[PathBuf]) -> bool {
+    let path = entry.path.strip_prefix("/").unwrap_or(&entry.path);
+    declared.iter().any(|declared| {
+        path.starts_with(declared)
+            || (entry.access_type == AccessType::Lookup && declared.starts_with(path))
+    })
+}
+
+/// Audits accesses to [`SOURCE_DIR`] in a container by mounting auditfuse on
+/// top of it.
+///
+/// The original directory is bind-mounted to a temporary directory which
+/// auditfuse serves files from.
+pub struct SourceAudit {
+    orig_dir: TempDir,
+    audit_file: NamedTempFile,
+    daemon: Option<AuditfuseDaemon>,
+}
+
+impl SourceAudit {
+    /// Starts auditing [`SOURCE_DIR`] under the root directory of a
+    /// container. Returns None if the directory doesn't exist.
+    pub fn start(root_dir: &Path) -> Result<Option<Self>> {
+        let source_dir = root_dir.join(SOURCE_DIR.strip_prefix('/').unwrap());
+        if !source_dir.try_exists()? {
+            return Ok(None);
+        }
+
+        let orig_dir = TempDir::new()?;
+        mount(
+            Some(&source_dir),
+            orig_dir.path(),
+            None::<&str>,
+            MsFlags::MS_BIND | MsFlags::MS_REC,
+            None::<&str>,
+        )
+        .with_context(|| format!("Failed to bind-mount {}", source_dir.display()))?;
+
+        let mut audit = Self {
+            orig_dir,
+            audit_file: tempfile::Builder::new().prefix("source_audit").tempfile()?,
+            daemon: None,
+        };
+        // Ebuilds may write to their source directories, e.g. to generate
+        // files in place, so the view must be writable.
+        let options = AuditfuseOptions {
+            read_write: true,
+            ..Default::default()
+        };
+        audit.daemon = Some(AuditfuseDaemon::start(
+            &options,
+            audit.audit_file.path(),
+            audit.orig_dir.path(),
+            &source_dir,
+        )?);
+        Ok(Some(audit))
+    }
+
+    /// Stops auditing and returns accesses not covered by `declared`, which
+    /// are paths relative to [`SOURCE_DIR`]. Paths of returned entries are
+    /// absolute in the container.
+    pub fn finish(mut self, declared: &[PathBuf]) -> Result<BTreeSet<AuditEntry>> {
+        if let Some(daemon) = self.daemon.take() {
+            daemon.stop()?;
+        }
+        let entries = auditfuse_lib::parse_audit_file(self.audit_file.path())?;
+        Ok(entries
+            .into_iter()
+            .filter(|entry| !is_declared(entry, declared))
+            .map(|entry| AuditEntry {
+                path: Path::new(SOURCE_DIR)
+                    .join(entry.path.strip_prefix("/").unwrap_or(&entry.path)),
+                ..entry
+            })
+            .collect())
+    }
+}
+
+impl Drop for SourceAudit {
+    fn drop(&mut self) {
+        // Unmount auditfuse before the original directory it serves.
+        self.daemon.take();
+        // Errors are ignored as we may be unwinding on another error.
+        let _ = umount2(self.orig_dir.path(), MntFlags::MNT_DETACH);
+    }
+}
+
+/// Writes undeclared source accesses to a report file, one per line.
+pub fn write_report(path: &Path, entries: &BTreeSet<AuditEntry>) -> Result<()> {
+    let mut out = std::fs::File::create(path)
+        .with_context(|| format!("Failed to create {}", path.display()))?;
+    for entry in entries {
+        writeln!(out, "{entry}")?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn lookup(path: &str) -> AuditEntry {
+        AuditEntry {
+            access_type: AccessType::Lookup,
+            path: PathBuf::from(path),
+        }
+    }
+
+    fn readdir(path: &str) -> AuditEntry {
+        AuditEntry {
+            access_type: AccessType::Readdir,
+            path: PathBuf::from(path),
+        }
+    }
+
+    #[test]
+    fn test_is_declared() {
+        let declared = [
+            PathBuf::from("src/platform2/common-mk"),
+            PathBuf::from("src/platform2/libbrillo"),
+        ];
+        assert!(is_declared(
+            &lookup("src/platform2/common-mk/BUILD.gn"),
+            &declared
+        ));
+        assert!(is_declared(&readdir("src/platform2/libbrillo"), &declared));
+        assert!(is_declared(&lookup("src"), &declared));
+        assert!(is_declared(&lookup("src/platform2"), &declared));
+        assert!(!is_declared(&readdir("src/platform2"), &declared));
+        assert!(!is_declared(&lookup("src/platform2/metrics"), &declared));
+        assert!(!is_declared(&lookup("src/platform2/common-mk2"), &declared));
+    }
+}
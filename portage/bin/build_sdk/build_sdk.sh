@@ -36,7 +36,8 @@ chmod 755 "${ROOT}"
 
 # Copy the sysroot into the output directory so we can create a new durable
 # tree. We don't invoke fakeroot since we only need to copy the xattrs to
-# preserve ownership.
+# preserve ownership. build_sdk writes the paths to exclude, e.g. the ones in
+# snapshot_excludes.txt, to excludes.txt.
 time tar \
   --format gnu \
   --sort name \
@@ -44,14 +45,7 @@ time tar \
   --numeric-owner \
   --create \
   --directory "${ROOT}" \
-  --exclude "./tmp/*" \
-  --exclude "./var/cache/*" \
-  --exclude "./packages" \
-  --exclude "./build" \
-  --exclude "./usr/share/doc/*" \
-  --exclude "./usr/share/man/*" \
-  --exclude="./etc/make.conf" \
-  --exclude="./etc/make.conf.*" \
-  --exclude="./etc/portage" \
+  --anchored \
+  --exclude-from "/mnt/host/.build_sdk/excludes.txt" \
   . | \
   tar -x -C "/mnt/host/.build_sdk/output"
@@ -0,0 +1,89 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use std::path::Path;
+
+/// Paths excluded from an SDK snapshot.
+///
+/// A pattern is a path relative to the root of the snapshot, e.g.
+/// `usr/share/doc/*`, and may contain shell wildcards, i.e. `*`, `?` and
+/// bracket expressions. `*` also matches `/`. Leading `./` and `/` are
+/// ignored, so patterns written for `tar --exclude` work as well.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct ExcludeList {
+    patterns: Vec<String>,
+}
+
+impl ExcludeList {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Returns true if there are no patterns.
+    pub fn is_empty(&self) -> bool {
+        self.patterns.is_empty()
+    }
+
+    /// Adds a pattern.
+    pub fn push(&mut self, pattern: &str) {
+        let pattern = pattern.trim_start_matches("./").trim_start_matches('/');
+        if !pattern.is_empty() {
+            self.patterns.push(pattern.to_owned());
+        }
+    }
+
+    /// Adds patterns listed in a file, one per line. Empty lines and lines
+    /// starting with `#` are ignored.
+    pub fn load(&mut self, path: &Path) -> Result<()> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        for line in contents.lines() {
+            let line = line.trim();
+            if !line.starts_with('#') {
+                self.push(line);
+            }
+        }
+        Ok(())
+    }
+
+    /// Renders the patterns for `tar --anchored --exclude-from` creating an
+    /// archive of the root directory `.`, one per line.
+    pub fn to_tar_excludes(&self) -> String {
+        self.patterns
+            .iter()
+            .map(|pattern| format!("./{pattern}\n"))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use fileutil::SafeTempDir;
+
+    #[test]
+    fn test_to_tar_excludes() {
+        let mut excludes = ExcludeList::new();
+        for pattern in ["./tmp/*", "/usr/share/doc/*", "etc/make.conf*"] {
+            excludes.push(pattern);
+        }
+        assert_eq!(
+            excludes.to_tar_excludes(),
+            "./tmp/*\n./usr/share/doc/*\n./etc/make.conf*\n"
+        );
+    }
+
+    #[test]
+    fn test_load() -> Result<()> {
+        let dir = SafeTempDir::new()?;
+        let path = dir.path().join("excludes.txt");
+        std::fs::write(&path, "# Comment\n./tmp/*\n\n  var/cache/*  \n")?;
+
+        let mut excludes = ExcludeList::new();
+        excludes.load(&path)?;
+        assert_eq!(excludes.patterns, vec!["tmp/*", "var/cache/*"]);
+        Ok(())
+    }
+}
@@ -2,70 +2,206 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
+mod exclude;
+
 use anyhow::{ensure, Context, Result};
-use clap::Parser;
-use cliutil::cli_main;
-use container::{enter_mount_namespace, BindMount, CommonArgs, ContainerSettings};
+use clap::{Parser, ValueEnum};
+use cliutil::{cli_main, LoggingArgs};
+use container::{
+    enter_mount_namespace, BindMount, CommonArgs, ContainerSettings, DiffFilter, MountPropagation,
+};
 use durabletree::DurableTree;
-use fileutil::resolve_symlink_forest;
-
-use std::{path::PathBuf, process::ExitCode};
+use fileutil::{resolve_symlink_forest, SafeTempDir};
+
+use std::{
+    path::{Path, PathBuf},
+    process::ExitCode,
+};
+
+use crate::exclude::ExcludeList;
+
+const SCRIPTS_DIR: &str = "/mnt/host/.build_sdk";
+const SNAPSHOT_OUTPUT_DIR: &str = "/mnt/host/.build_sdk/output";
+const SNAPSHOT_EXCLUDES: &str = "/mnt/host/.build_sdk/excludes.txt";
+const TARBALLS_DIR: &str = "/stage/tarballs";
+
+/// How the output directory is populated.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+enum OutputFormat {
+    /// Runs build_sdk.sh to prepare the root of the board, and writes a full
+    /// copy of it to the output directory.
+    Snapshot,
+    /// Runs sdk_update.sh to install tarballs and patch Portage, and writes
+    /// the changes made in the container to the output directory as a layer.
+    Layer,
+}
 
-const MAIN_SCRIPT: &str = "/mnt/host/.build_sdk/build_sdk.sh";
+impl OutputFormat {
+    fn script_name(self) -> &'static str {
+        match self {
+            Self::Snapshot => "build_sdk.sh",
+            Self::Layer => "sdk_update.sh",
+        }
+    }
+}
 
 #[derive(Parser, Debug)]
 #[clap()]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
-    /// Name of board
-    #[arg(long, required = true)]
-    board: String,
+    /// How the output directory is populated.
+    #[arg(long, value_enum, required = true)]
+    output_format: OutputFormat,
 
-    /// The path of output file.
-    /// A .tar.zst suffix is expected
+    /// Name of board. Used by the snapshot format only. If unset, the root
+    /// of the SDK is copied.
+    #[arg(long)]
+    board: Option<String>,
+
+    /// A path to a directory where the output durable tree is written.
     #[arg(long, required = true)]
     output: PathBuf,
+
+    /// If set, package manager metadata such as the installed package
+    /// database is written to this directory as a separate durable tree
+    /// instead of the output directory.
+    #[arg(long)]
+    output_metadata: Option<PathBuf>,
+
+    /// Tarballs to install. Used by the layer format only.
+    #[arg(long)]
+    install_tarball: Vec<PathBuf>,
+
+    /// A path pattern to exclude from the output, relative to its root, e.g.
+    /// "usr/share/doc/*". Can be specified multiple times. Used by the
+    /// snapshot format only; use --diff-filter for the layer format.
+    #[arg(long, value_name = "PATTERN")]
+    exclude: Vec<String>,
+
+    /// A file listing path patterns to exclude from the output, one per line.
+    /// Can be specified multiple times. Used by the snapshot format only.
+    #[arg(long, value_name = "PATH")]
+    exclude_from: Vec<PathBuf>,
+
+    /// A file listing rsync-style include/exclude rules to apply to the
+    /// output. Used by the layer format only. See [`DiffFilter`] for the syntax.
+    #[arg(long, value_name = "PATH")]
+    diff_filter: Option<PathBuf>,
 }
 
 fn do_main() -> Result<()> {
     let args = Cli::try_parse()?;
 
+    let mut excludes = ExcludeList::new();
+    for path in &args.exclude_from {
+        excludes.load(path)?;
+    }
+    for pattern in &args.exclude {
+        excludes.push(pattern);
+    }
+    // Removing a path from a layer does not hide the same path in the layers
+    // below it, which would require writing overlayfs whiteouts.
+    ensure!(
+        args.output_format == OutputFormat::Snapshot || excludes.is_empty(),
+        "--exclude and --exclude-from are not supported with --output-format=layer; \
+        use --diff-filter instead"
+    );
+
     let mut settings = ContainerSettings::new();
     settings.apply_common_args(&args.common)?;
+    if let Some(path) = &args.diff_filter {
+        settings.set_diff_filter(DiffFilter::load(path)?);
+    }
 
     let r = runfiles::Runfiles::create()?;
 
+    for tarball in &args.install_tarball {
+        let tarball = resolve_symlink_forest(tarball)?;
+        let mount_path = Path::new(TARBALLS_DIR).join(tarball.file_name().unwrap());
+        settings.push_bind_mount(BindMount {
+            source: tarball,
+            mount_path,
+            rw: false,
+            propagation: MountPropagation::Private,
+        });
+    }
+
+    let script_name = args.output_format.script_name();
+    let main_script = Path::new(SCRIPTS_DIR).join(script_name);
     settings.push_bind_mount(BindMount {
         source: resolve_symlink_forest(&runfiles::rlocation!(
             r,
-            "cros/bazel/portage/bin/build_sdk/build_sdk.sh"
+            format!("cros/bazel/portage/bin/build_sdk/{script_name}")
         ))?,
-        mount_path: PathBuf::from(MAIN_SCRIPT),
+        mount_path: main_script.clone(),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
-    fileutil::remove_dir_all_with_chmod(&args.output)
-        .with_context(|| format!("rm -r {:?}", args.output))?;
-
-    std::fs::create_dir_all(&args.output).with_context(|| format!("mkdir -p {:?}", args.output))?;
-
-    // We want the container to directly write to the output file to avoid
-    // copying the tarball from /tmp to the output root.
-    settings.push_bind_mount(BindMount {
-        source: args.output.clone(),
-        mount_path: PathBuf::from("/mnt/host/.build_sdk/output"),
-        rw: true,
-    });
+    // build_sdk.sh passes the excludes to tar so that excluded paths are never
+    // copied to the output.
+    let excludes_dir = SafeTempDir::new()?;
+    if args.output_format == OutputFormat::Snapshot {
+        let excludes_file = excludes_dir.path().join("excludes.txt");
+        std::fs::write(&excludes_file, excludes.to_tar_excludes())
+            .with_context(|| format!("Failed to write {excludes_file:?}"))?;
+        settings.push_bind_mount(BindMount {
+            source: excludes_file,
+            mount_path: PathBuf::from(SNAPSHOT_EXCLUDES),
+            rw: false,
+            propagation: MountPropagation::Private,
+        });
+
+        fileutil::remove_dir_all_with_chmod(&args.output)
+            .with_context(|| format!("rm -r {:?}", args.output))?;
+
+        std::fs::create_dir_all(&args.output)
+            .with_context(|| format!("mkdir -p {:?}", args.output))?;
+
+        // We want the container to directly write to the output file to avoid
+        // copying the tarball from /tmp to the output root.
+        settings.push_bind_mount(BindMount {
+            source: args.output.clone(),
+            mount_path: PathBuf::from(SNAPSHOT_OUTPUT_DIR),
+            rw: true,
+            propagation: MountPropagation::Private,
+        });
+    }
 
     let mut container = settings.prepare()?;
 
-    let mut command = container.command(MAIN_SCRIPT);
-    command.env("BOARD", &args.board);
+    let mut command = container.command(&main_script);
+    if let Some(board) = &args.board {
+        command.env("BOARD", board);
+    }
 
     let status = command.status()?;
-    ensure!(status.success());
+    ensure!(status.success(), "Command failed: {:?}", status);
+
+    if args.output_format == OutputFormat::Layer {
+        // Move the upper directory contents to the output directory.
+        fileutil::move_dir_contents(&container.into_upper_dir()?, &args.output)
+            .with_context(|| "Failed to move the upper dir.")?;
+
+        container::clean_layer(&args.output).with_context(|| "Failed to clean the output dir.")?;
+    }
+
+    if let Some(output_metadata) = &args.output_metadata {
+        fileutil::remove_dir_all_with_chmod(output_metadata)
+            .with_context(|| format!("rm -r {:?}", output_metadata))?;
+        std::fs::create_dir_all(output_metadata)
+            .with_context(|| format!("mkdir -p {:?}", output_metadata))?;
+        container::split_metadata_layer(&args.output, output_metadata)
+            .with_context(|| "Failed to split the metadata layer.")?;
+        DurableTree::convert(output_metadata)?;
+    }
 
     DurableTree::convert(&args.output)?;
 
@@ -7,8 +7,10 @@ mod elf;
 use anyhow::bail;
 use anyhow::{ensure, Context, Result};
 use clap::{command, Parser};
-use cliutil::{cli_main, expanded_args_os};
-use container::{enter_mount_namespace, BindMount, CommonArgs, ContainerSettings};
+use cliutil::{cli_main, expanded_args_os, LoggingArgs};
+use container::{
+    enter_mount_namespace, BindMount, CommonArgs, ContainerSettings, MountPropagation,
+};
 use durabletree::DurableTree;
 use fileutil::{remove_dir_all_with_chmod, with_permissions};
 use rayon::iter::{Either, IntoParallelIterator, IntoParallelRefIterator, ParallelIterator};
@@ -33,6 +35,11 @@ const OUTPUT: &str = "/.output";
 #[derive(Parser, Debug)]
 #[clap(author, version, about, long_about=None)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
@@ -311,12 +318,14 @@ fn create_interface_libraries(
         mount_path: INPUT.into(),
         source: src_root.into(),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     sdk.push_bind_mount(BindMount {
         mount_path: OUTPUT.into(),
         source: dest_root.into(),
         rw: true,
+        propagation: MountPropagation::Private,
     });
 
     let mut work_list = NamedTempFile::new()?;
@@ -328,6 +337,7 @@ fn create_interface_libraries(
         mount_path: WORK_LIST.into(),
         source: work_list.path().to_path_buf(),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     let mut container = sdk.prepare()?;
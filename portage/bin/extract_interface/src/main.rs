@@ -7,7 +7,7 @@ mod specs;
 use anyhow::{bail, Context, Result};
 use binarypackage::BinaryPackage;
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use specs::{OutputFileSpec, XpakSpec};
 use std::{
     collections::{BTreeMap, BTreeSet},
@@ -18,6 +18,11 @@ use std::{
 #[derive(Parser, Debug)]
 #[clap(author, version, about, long_about=None)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[arg(long, required = true)]
     binpkg: PathBuf,
 
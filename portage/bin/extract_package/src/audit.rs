@@ -4,21 +4,20 @@
 
 use std::{
     collections::BTreeSet,
-    fmt::Display,
     fs::DirBuilder,
     os::unix::fs::DirBuilderExt,
     path::{Path, PathBuf},
-    process::Command,
-    str::FromStr,
 };
 
-use anyhow::{bail, ensure, Context, Result};
-use container::{BindMount, ContainerSettings};
-use nix::mount::{umount2, MntFlags};
+use anyhow::{bail, Context, Result};
+use auditfuse_lib::{parse_audit_file, AccessType, AuditfuseDaemon, AuditfuseOptions};
+use container::{BindMount, ContainerSettings, MountPropagation};
 use runfiles::Runfiles;
 use tempfile::{NamedTempFile, TempDir};
 use vdb::get_vdb_dir;
 
+pub use auditfuse_lib::AuditEntry;
+
 /// A list of directories to create in the mock environment where we run binary
 /// package hooks. This list doesn't need to be exhaustive for the hook check
 /// to be accurate, but adding popular directories here will help debugging
@@ -64,38 +63,6 @@ const MOCK_DIRS: &[&str] = &[
     "var",
 ];
 
-struct AuditfuseDaemon {
-    mount_dir: PathBuf,
-}
-
-impl AuditfuseDaemon {
-    pub fn start(audit_file: &Path, orig_dir: &Path, mount_dir: &Path) -> Result<Self> {
-        let r = Runfiles::create()?;
-        let auditfuse_path =
-            runfiles::rlocation!(r, "cros/bazel/portage/bin/auditfuse/auditfuse_/auditfuse");
-
-        let status = Command::new(auditfuse_path)
-            .arg("--verbose")
-            .arg("--output")
-            .arg(audit_file)
-            .arg(orig_dir)
-            .arg(mount_dir)
-            .status()?;
-
-        ensure!(status.success(), "auditfuse failed to start");
-
-        Ok(Self {
-            mount_dir: mount_dir.to_path_buf(),
-        })
-    }
-}
-
-impl Drop for AuditfuseDaemon {
-    fn drop(&mut self) {
-        umount2(&self.mount_dir, MntFlags::MNT_DETACH).expect("unmounting auditfuse");
-    }
-}
-
 fn drive_binary_package_with_auditfuse(
     cpf: &str,
     root_dir: &Path,
@@ -132,8 +99,16 @@ fn drive_binary_package_with_auditfuse(
     let fuse_dir = TempDir::new()?;
     let fuse_dir = fuse_dir.path();
 
-    let _auditfuse_daemon = AuditfuseDaemon::start(audit_file.path(), stage_dir, fuse_dir)
-        .context("Failed to start auditfuse")?;
+    let auditfuse_daemon = AuditfuseDaemon::start(
+        &AuditfuseOptions {
+            verbose: true,
+            ..Default::default()
+        },
+        audit_file.path(),
+        stage_dir,
+        fuse_dir,
+    )
+    .context("Failed to start auditfuse")?;
 
     let mut settings = ContainerSettings::new();
     settings.push_layer(fuse_dir)?;
@@ -143,6 +118,7 @@ fn drive_binary_package_with_auditfuse(
         source: runfiles::rlocation!(r, "files/bash-static"),
         mount_path: PathBuf::from("/bin/bash"),
         rw: false,
+        propagation: MountPropagation::Private,
     });
     settings.push_bind_mount(BindMount {
         source: runfiles::rlocation!(
@@ -151,11 +127,13 @@ fn drive_binary_package_with_auditfuse(
         ),
         mount_path: PathBuf::from("/bin/drive_binary_package.sh"),
         rw: false,
+        propagation: MountPropagation::Private,
     });
     settings.push_bind_mount(BindMount {
         source: vdb_dir.to_path_buf(),
         mount_path: get_vdb_dir(root_dir, cpf),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     let mut container = settings.prepare()?;
@@ -181,69 +159,20 @@ fn drive_binary_package_with_auditfuse(
         bail!("drive_binary_package.sh failed for an internal error!");
     }
 
+    auditfuse_daemon.stop()?;
     Ok(audit_file)
 }
 
-#[derive(
-    Clone,
-    Copy,
-    Debug,
-    Eq,
-    Ord,
-    PartialEq,
-    PartialOrd,
-    strum_macros::EnumString,
-    strum_macros::Display,
-)]
-#[strum(serialize_all = "UPPERCASE")]
-pub enum AccessType {
-    Lookup,
-    Readdir,
-}
-
-#[derive(Clone, Debug, Eq, Ord, PartialEq, PartialOrd)]
-pub struct AuditEntry {
-    pub access_type: AccessType,
-    pub path: PathBuf,
-}
-
-impl Display for AuditEntry {
-    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
-        write!(f, "{}\t{}", self.access_type, self.path.display())
-    }
-}
-
-impl FromStr for AuditEntry {
-    type Err = anyhow::Error;
-
-    fn from_str(s: &str) -> Result<Self> {
-        let (access_type, path) = s.split_once('\t').context("Corrupted audit line")?;
-        let access_type: AccessType = access_type.parse()?;
-        let path = PathBuf::from(path);
-        Ok(Self { access_type, path })
-    }
-}
-
-fn parse_audit_file(path: &Path) -> Result<Vec<AuditEntry>> {
-    let content = std::fs::read_to_string(path)?;
-    if content.is_empty() {
-        return Ok(Vec::new());
-    }
-    content
-        .strip_suffix('\0')
-        .context("Corrupted audit output")?
-        .split('\0')
-        .map(AuditEntry::from_str)
-        .collect::<Result<Vec<_>>>()
-}
-
 /// A static list of directories allowlisted for lookup.
 const LOOKUP_ALLOWED_DIRS: &[&str] = &[
     // Directories listed here must satisfy certain conditions to avoid false positives.
     // See comments in [`filter_audit_entry`] for details.
     "/bin", "/dev",
     // /host is used for pivot_root during the setup of a container, but is empty afterwards.
-    "/host", "/proc", "/sys",
+    "/host", "/proc",
+    // /run is a fresh tmpfs in every container, and /var provides /var/run and /var/lock that
+    // point to it. Lookups of descendants of /var are still audited.
+    "/run", "/sys", "/var",
 ];
 
 fn filter_audit_entry(
@@ -414,7 +343,7 @@ pkg_preinst() {
 }
 
 pkg_postinst() {
-    echo /run/*
+    echo /media/*
 }
 "#,
         )?;
@@ -425,13 +354,36 @@ pkg_postinst() {
                 readdir("/mnt"),
                 lookup("/opt"),
                 readdir("/opt"),
-                lookup("/run"),
-                readdir("/run"),
+                lookup("/media"),
+                readdir("/media"),
             ]
         );
         Ok(())
     }
 
+    #[test]
+    fn test_audit_hooks_runtime_dirs() -> Result<()> {
+        // /run is a tmpfs in containers, so accesses to runtime directories never depend on
+        // packages.
+        let entries = run_audit_hooks(
+            r#"
+pkg_setup() {
+    echo /run/*
+}
+
+pkg_preinst() {
+    : > /var/lock/a
+}
+
+pkg_postinst() {
+    : > /var/run/b
+}
+"#,
+        )?;
+        assert_eq!(entries, Vec::new());
+        Ok(())
+    }
+
     #[test]
     fn test_audit_hooks_conditional() -> Result<()> {
         // Exercise the common pattern to guard hooks with $MERGE_TYPE.
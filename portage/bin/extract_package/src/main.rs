@@ -9,7 +9,7 @@ use audit::audit_hooks;
 use binarypackage::BinaryPackage;
 use bzip2::read::BzDecoder;
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use container::enter_mount_namespace;
 use durabletree::DurableTree;
 use std::{
@@ -28,6 +28,11 @@ use walkdir::WalkDir;
 /// mounted as an overlayfs layer.
 #[derive(Parser, Debug)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     /// Input binary package file.
     #[arg(long)]
     input_binary_package: PathBuf,
@@ -4,7 +4,7 @@
 
 use anyhow::{bail, Context, Result};
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use extract_package_from_manifest_package::package::Package;
 use extract_package_from_manifest_package::package_set::PackageSet;
 use regex::Regex;
@@ -13,6 +13,11 @@ use std::{fs::File, io::BufReader, path::PathBuf, process::ExitCode};
 #[derive(Parser, Debug)]
 #[clap(author, version, about, long_about=None)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     /// The command to execute to fix an incorrect set of files in
     /// the interface
     #[arg(long)]
@@ -5,7 +5,7 @@
 use anyhow::{bail, Context, Result};
 use chrono::Datelike;
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use extract_package_from_manifest_package::package::{Package, PackageUid};
 use extract_package_from_manifest_package::package_set::PackageSet;
 use regex::{Captures, Regex};
@@ -29,6 +29,11 @@ static EXTRACTOR: &str =
 #[derive(Parser, Debug)]
 #[clap(author, version, about, long_about=None)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     /// The command to execute to regenerate the manifest
     #[arg(long)]
     regenerate_command: String,
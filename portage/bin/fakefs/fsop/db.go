@@ -0,0 +1,242 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package fsop
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Database stores overrides in files under a directory instead of xattrs.
+//
+// Xattrs are lost when files are copied to file systems without user xattr
+// support (e.g. tmpfs without user_xattr, 9p) or by tools unaware of them
+// (e.g. Bazel copying action outputs). Overrides in a database survive as long
+// as the database directory is kept, and can be exported to a file listing
+// overrides by path to be restored after files are copied.
+//
+// Each entry is a file named "<dev>_<ino>" after the inode it applies to, so
+// that overrides follow files across rename(2) and hard links like xattrs do.
+// The device and inode numbers are kept when overlayfs copies up a file, while
+// other attributes such as the birth time are not, so they are not part of the
+// key. libfakefs_preload.so checks the existence of entries to decide whether
+// it can process a call without ptrace.
+//
+// Unlike xattrs, entries are not dropped with inodes by the kernel. fakefs
+// therefore traces system calls removing files, and clears the entry of an
+// inode when its last link is removed so that a new file reusing the inode
+// number does not inherit the override. See PrepareRemove.
+type Database struct {
+	dir string
+}
+
+// db is the database to store overrides in. If it is nil, overrides are
+// stored in xattrs.
+var db *Database
+
+// OpenDatabase opens a database at dir, creating it if it does not exist.
+func OpenDatabase(dir string) (*Database, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Database{dir: dir}, nil
+}
+
+// Dir returns the absolute path to the database directory.
+func (d *Database) Dir() string {
+	return d.dir
+}
+
+// UseDatabase makes the process store overrides in d instead of xattrs.
+func UseDatabase(d *Database) {
+	db = d
+}
+
+// fileID identifies a file in a database.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func (id *fileID) entryName() string {
+	return fmt.Sprintf("%d_%d", id.dev, id.ino)
+}
+
+func newFileID(dirfd int, path string, flags int) (*fileID, error) {
+	// Use fstatat(2) rather than statx(2) to compute the device number so
+	// that it matches the one computed by libfakefs_preload.so.
+	var stat unix.Stat_t
+	if err := unix.Fstatat(dirfd, path, &stat, flags); err != nil {
+		return nil, err
+	}
+	return &fileID{dev: stat.Dev, ino: stat.Ino}, nil
+}
+
+// fdFileID returns the ID of a file. fd can be a file descriptor opened with
+// O_PATH.
+func fdFileID(fd int) (*fileID, error) {
+	return newFileID(fd, "", unix.AT_EMPTY_PATH)
+}
+
+func pathFileID(path string, followSymlinks bool) (*fileID, error) {
+	flags := 0
+	if !followSymlinks {
+		flags = unix.AT_SYMLINK_NOFOLLOW
+	}
+	return newFileID(unix.AT_FDCWD, path, flags)
+}
+
+// read returns the override of a file. It returns errNoOverride if the file
+// has no override.
+func (d *Database) read(id *fileID) (*overrideData, error) {
+	path := filepath.Join(d.dir, id.entryName())
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoOverride
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseOverrideData(b)
+}
+
+func (d *Database) write(id *fileID, data *overrideData) error {
+	// Write the entry atomically as libfakefs_preload.so may look it up
+	// concurrently. Use a unique temporary file as multiple tracee threads
+	// may update the same entry at once.
+	f, err := os.CreateTemp(d.dir, "."+id.entryName()+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data.Marshal()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(d.dir, id.entryName())); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *Database) clear(id *fileID) error {
+	err := os.Remove(filepath.Join(d.dir, id.entryName()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// PrepareRemove is called before a system call that may remove a link to the
+// file at path relative to dirfd, e.g. unlink(2) or rename(2) replacing it.
+// If the link is the last one to the file, it returns a function to be called
+// after the system call succeeds, which clears the override of the file.
+// Otherwise, including when overrides are not stored in a database, it
+// returns nil.
+func PrepareRemove(dirfd int, path string) func() error {
+	if db == nil {
+		return nil
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstatat(dirfd, path, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		// Let the system call fail.
+		return nil
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR && stat.Nlink > 1 {
+		return nil
+	}
+	id := &fileID{dev: stat.Dev, ino: stat.Ino}
+	return func() error {
+		return db.clear(id)
+	}
+}
+
+// Import loads overrides from a file written by Export. Paths in the file
+// are resolved relative to root. Files missing under root are ignored.
+func (d *Database) Import(r io.Reader, root string) error {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		rawData, quotedPath, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("line %d: malformed line: %s", lineno, line)
+		}
+		data, err := parseOverrideData([]byte(rawData))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineno, err)
+		}
+		relPath, err := strconv.Unquote(quotedPath)
+		if err != nil {
+			return fmt.Errorf("line %d: malformed path: %s", lineno, quotedPath)
+		}
+
+		id, err := pathFileID(filepath.Join(root, relPath), false)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := d.write(id, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Export writes overrides of files under root to w, one file per line in
+// the form of `<override data> <quoted relative path>`. Files are listed in
+// lexical order so that the output is reproducible.
+func (d *Database) Export(w io.Writer, root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() && !entry.IsDir() {
+			return nil
+		}
+
+		id, err := pathFileID(path, false)
+		if err != nil {
+			return err
+		}
+		data, err := d.read(id)
+		if err == errNoOverride {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s %s\n", data.Marshal(), strconv.Quote(relPath))
+		return err
+	})
+}
@@ -13,27 +13,101 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// xattrKeyOverride is the xattr key to record overridden file metadata in.
+//
+// Since xattrs belong to inodes rather than paths, overrides follow files
+// across rename(2) and hard links, and are dropped with the inode on the last
+// unlink(2), e.g. the common install pattern of creating a temporary file,
+// chowning it and renaming it over the destination just works.
+//
+// Overrides stored in a Database are keyed by inodes as well, but the kernel
+// doesn't drop them, so system calls removing the last link to a file, i.e.
+// unlink(2), rmdir(2) and rename(2) over an existing file, must clear them.
+// See PrepareRemove.
 const xattrKeyOverride = "user.fakefs.override"
 
+// XattrNameCapability is the name of the xattr to hold file capabilities.
+// Unprivileged users can't set it, so fakefs records it in the override xattr
+// instead.
+const XattrNameCapability = "security.capability"
+
+// specialModeBits is the set of mode bits that unprivileged users can't keep
+// on files reliably, e.g. the kernel clears setuid bits on writes.
+const specialModeBits = unix.S_ISUID | unix.S_ISGID | unix.S_ISVTX
+
 var errNoOverride = errors.New("no override")
 
 func readOverrideData(fd int) (*overrideData, error) {
-	buf := make([]byte, 64)
-	size, err := unix.Fgetxattr(fd, xattrKeyOverride, buf)
-	if err == unix.ENODATA || err == unix.ENOTSUP {
-		return nil, errNoOverride
+	if db != nil {
+		id, err := fdFileID(fd)
+		if err != nil {
+			return nil, err
+		}
+		return db.read(id)
 	}
-	if err != nil {
-		return nil, err
+	return doReadOverrideData(func(buf []byte) (int, error) {
+		return unix.Fgetxattr(fd, xattrKeyOverride, buf)
+	})
+}
+
+func readPathOverrideData(path string, followSymlinks bool) (*overrideData, error) {
+	if db != nil {
+		id, err := pathFileID(path, followSymlinks)
+		if err != nil {
+			return nil, err
+		}
+		return db.read(id)
+	}
+	return doReadOverrideData(func(buf []byte) (int, error) {
+		if followSymlinks {
+			return unix.Getxattr(path, xattrKeyOverride, buf)
+		}
+		return unix.Lgetxattr(path, xattrKeyOverride, buf)
+	})
+}
+
+func doReadOverrideData(getxattr func([]byte) (int, error)) (*overrideData, error) {
+	// Most overrides hold ownership only and fit in the initial buffer.
+	buf := make([]byte, 64)
+	for {
+		size, err := getxattr(buf)
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return nil, errNoOverride
+		}
+		if err == unix.ERANGE {
+			size, err := getxattr(nil)
+			if err != nil {
+				return nil, err
+			}
+			buf = make([]byte, size)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseOverrideData(buf[:size])
 	}
-	return parseOverrideData(buf[:size])
 }
 
 func writeOverrideData(fd int, data *overrideData) error {
+	if db != nil {
+		id, err := fdFileID(fd)
+		if err != nil {
+			return err
+		}
+		return db.write(id, data)
+	}
 	return unix.Fsetxattr(fd, xattrKeyOverride, data.Marshal(), 0)
 }
 
 func clearOverrideData(fd int) error {
+	if db != nil {
+		id, err := fdFileID(fd)
+		if err != nil {
+			return err
+		}
+		return db.clear(id)
+	}
 	err := unix.Fremovexattr(fd, xattrKeyOverride)
 	if err == unix.ENODATA {
 		return nil
@@ -47,10 +121,13 @@ func upgradeFd(fd int) (int, error) {
 	return unix.Open(fmt.Sprintf("/proc/self/fd/%d", fd), unix.O_RDONLY|unix.O_CLOEXEC, 0)
 }
 
-// HasOverride returns if a file has an override xattr.
-// If the file does not exist, it is considered that an override xattr is
-// missing.
+// HasOverride returns if a file has an override.
+// If the file does not exist, it is considered that an override is missing.
 func HasOverride(path string, followSymlinks bool) bool {
+	if db != nil {
+		_, err := readPathOverrideData(path, followSymlinks)
+		return err == nil
+	}
 	var err error
 	if followSymlinks {
 		_, err = unix.Getxattr(path, xattrKeyOverride, nil)
@@ -60,46 +137,86 @@ func HasOverride(path string, followSymlinks bool) bool {
 	return err == nil || err == unix.ERANGE
 }
 
-// FHasOverride returns if a file has an override xattr.
+// FHasOverride returns if a file has an override.
 func FHasOverride(fd int) bool {
+	if db != nil {
+		_, err := readOverrideData(fd)
+		return err == nil
+	}
 	_, err := unix.Fgetxattr(fd, xattrKeyOverride, nil)
 	return err == nil || err == unix.ERANGE
 }
 
-// Fstat returns stat_t for a given file descriptor.
-// If a file pointed by fd is a regular file or a directory, it considers xattrs
-// to override file metadata. Otherwise it behaves like normal fstat(2).
+// hasOverrideSupport returns if files of the given mode can have overrides.
+// Since unprivileged users can set user xattrs only on regular files and
+// directories, other files can't have overrides.
+func hasOverrideSupport(mode uint32) bool {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFREG, unix.S_IFDIR:
+		return true
+	default:
+		return false
+	}
+}
+
+// readFdOverrideData reads the override of a file whose real mode is mode.
+// It returns errNoOverride if the file has no override.
 // fd can be a file descriptor opened with O_PATH.
-func Fstat(fd int, stat *unix.Stat_t) (overridden bool, err error) {
+func readFdOverrideData(fd int, mode uint32) (*overrideData, error) {
+	if !hasOverrideSupport(mode) {
+		return nil, errNoOverride
+	}
+
+	ufd, err := upgradeFd(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(ufd)
+
+	return readOverrideData(ufd)
+}
+
+// fstatReal returns the real stat_t of a file, ignoring its override, and the
+// override data to apply to it. If the file has no override, it returns
+// override data that reflects the real stat_t.
+// fd can be a file descriptor opened with O_PATH.
+func fstatReal(fd int, stat *unix.Stat_t) (data *overrideData, overridden bool, err error) {
 	// Use fstatat(2) instead of fstat(2) to support file descriptors opened
 	// with O_PATH.
 	if err := unix.Fstatat(fd, "", stat, unix.AT_EMPTY_PATH); err != nil {
-		return false, err
+		return nil, false, err
 	}
 
-	switch stat.Mode & unix.S_IFMT {
-	case unix.S_IFREG, unix.S_IFDIR:
-		ufd, err := upgradeFd(fd)
-		if err != nil {
-			return false, err
-		}
-		defer unix.Close(ufd)
-
-		data, err := readOverrideData(ufd)
-		if err == errNoOverride {
-			return false, nil
-		}
-		if err != nil {
-			return false, err
-		}
+	data, err = readFdOverrideData(fd, stat.Mode)
+	if err == errNoOverride {
+		return &overrideData{
+			Uid: int(stat.Uid),
+			Gid: int(stat.Gid),
+		}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
 
-		stat.Uid = uint32(data.Uid)
-		stat.Gid = uint32(data.Gid)
-		return true, nil
+// Fstat returns stat_t for a given file descriptor.
+// If a file pointed by fd is a regular file or a directory, it considers xattrs
+// to override file metadata. Otherwise it behaves like normal fstat(2).
+// fd can be a file descriptor opened with O_PATH.
+func Fstat(fd int, stat *unix.Stat_t) (overridden bool, err error) {
+	data, overridden, err := fstatReal(fd, stat)
+	if err != nil || !overridden {
+		return false, err
+	}
 
-	default:
-		return false, nil
+	stat.Uid = uint32(data.Uid)
+	stat.Gid = uint32(data.Gid)
+	if data.Mode != 0 {
+		stat.Mode = data.Mode
+		stat.Rdev = data.Rdev
 	}
+	return true, nil
 }
 
 // Fstatx returns statx_t for a given file descriptor.
@@ -117,36 +234,29 @@ func Fstatx(fd int, mask int, statx *unix.Statx_t) (overridden bool, err error)
 		return false, err
 	}
 
-	switch statx.Mode & unix.S_IFMT {
-	case unix.S_IFREG, unix.S_IFDIR:
-		ufd, err := upgradeFd(fd)
-		if err != nil {
-			return false, err
-		}
-		defer unix.Close(ufd)
-
-		data, err := readOverrideData(ufd)
-		if err == errNoOverride {
-			return false, nil
-		}
-		if err != nil {
-			return false, err
-		}
-
-		if statx.Mask&unix.STATX_UID != 0 {
-			statx.Uid = uint32(data.Uid)
-		}
-		if statx.Mask&unix.STATX_GID != 0 {
-			statx.Gid = uint32(data.Gid)
-		}
-		return true, nil
-
-	default:
+	data, err := readFdOverrideData(fd, uint32(statx.Mode))
+	if err == errNoOverride {
 		return false, nil
 	}
+	if err != nil {
+		return false, err
+	}
+
+	if statx.Mask&unix.STATX_UID != 0 {
+		statx.Uid = uint32(data.Uid)
+	}
+	if statx.Mask&unix.STATX_GID != 0 {
+		statx.Gid = uint32(data.Gid)
+	}
+	if data.Mode != 0 {
+		statx.Mode = uint16(data.Mode)
+		statx.Rdev_major = unix.Major(data.Rdev)
+		statx.Rdev_minor = unix.Minor(data.Rdev)
+	}
+	return true, nil
 }
 
-func doListxattr(cap int, listxattr func([]byte) (int, error)) (keys []byte, size int, err error) {
+func doListxattr(cap int, capability bool, listxattr func([]byte) (int, error)) (keys []byte, size int, err error) {
 	unfiltered := make([]byte, cap)
 	size, err = listxattr(unfiltered)
 	if err != nil {
@@ -154,7 +264,8 @@ func doListxattr(cap int, listxattr func([]byte) (int, error)) (keys []byte, siz
 	}
 
 	// If cap is 0, listxattr(2) family returns the required size without storing
-	// results.
+	// results. The size is still large enough since the simulated capability
+	// key is shorter than the override key it replaces.
 	if cap == 0 {
 		return nil, size, nil
 	}
@@ -168,7 +279,13 @@ func doListxattr(cap int, listxattr func([]byte) (int, error)) (keys []byte, siz
 			key = append(key, b)
 			continue
 		}
-		if string(key) != xattrKeyOverride {
+		switch string(key) {
+		case xattrKeyOverride:
+		case XattrNameCapability:
+			if !capability {
+				filtered = append(filtered, append(key, 0)...)
+			}
+		default:
 			filtered = append(filtered, append(key, 0)...)
 		}
 		key = nil
@@ -176,12 +293,21 @@ func doListxattr(cap int, listxattr func([]byte) (int, error)) (keys []byte, siz
 	if len(key) > 0 {
 		return nil, 0, fmt.Errorf("listxattr result not null-terminated")
 	}
+	if capability {
+		filtered = append(filtered, append([]byte(XattrNameCapability), 0)...)
+	}
 	return filtered, len(filtered), nil
 }
 
-// Listxattr enumerates xattrs of a file, hiding fakefs-specific entries.
+// Listxattr enumerates xattrs of a file, hiding fakefs-specific entries and
+// showing simulated ones.
 func Listxattr(path string, cap int, followSymlinks bool) (keys []byte, size int, err error) {
-	return doListxattr(cap, func(buf []byte) (int, error) {
+	data, err := readPathOverrideData(path, followSymlinks)
+	if err != nil && err != errNoOverride {
+		return nil, 0, err
+	}
+	capability := err == nil && data.Capability != nil
+	return doListxattr(cap, capability, func(buf []byte) (int, error) {
 		if followSymlinks {
 			return unix.Listxattr(path, buf)
 		}
@@ -189,58 +315,210 @@ func Listxattr(path string, cap int, followSymlinks bool) (keys []byte, size int
 	})
 }
 
-// Flistxattr enumerates xattrs of a file, hiding fakefs-specific entries.
+// Flistxattr enumerates xattrs of a file, hiding fakefs-specific entries and
+// showing simulated ones.
 func Flistxattr(fd int, cap int) (keys []byte, size int, err error) {
-	return doListxattr(cap, func(buf []byte) (int, error) {
+	data, err := readOverrideData(fd)
+	if err != nil && err != errNoOverride {
+		return nil, 0, err
+	}
+	capability := err == nil && data.Capability != nil
+	return doListxattr(cap, capability, func(buf []byte) (int, error) {
 		return unix.Flistxattr(fd, buf)
 	})
 }
 
+// updateOverride records override data of a file whose real stat_t is stat.
+// If the override data matches the real metadata, the override is removed.
+// ufd must not be a file descriptor opened with O_PATH.
+func updateOverride(ufd int, stat *unix.Stat_t, data *overrideData) error {
+	if data.Mode == stat.Mode {
+		data.Mode = 0
+		data.Rdev = 0
+	}
+	if data.Uid == int(stat.Uid) && data.Gid == int(stat.Gid) && data.Mode == 0 && data.Capability == nil {
+		return clearOverrideData(ufd)
+	}
+	return writeOverrideData(ufd, data)
+}
+
+// effectiveMode returns the file mode to report for a file.
+func effectiveMode(stat *unix.Stat_t, data *overrideData) uint32 {
+	if data.Mode != 0 {
+		return data.Mode
+	}
+	return stat.Mode
+}
+
 // Fchown changes ownership of a given file.
 // If a file pointed by fd is a regular file or a directory, it sets xattrs
 // to override file metadata. Otherwise it fails if ownership is being changed.
+// Like chown(2), it clears setuid/setgid bits and capabilities of
+// non-directories.
 // fd can be a file descriptor opened with O_PATH.
 func Fchown(fd int, uid int, gid int) error {
 	// TODO: Consider locking the file to avoid races.
 	// TODO: Avoid upgrading the file descriptor twice.
 	var stat unix.Stat_t
-	if _, err := Fstat(fd, &stat); err != nil {
+	data, _, err := fstatReal(fd, &stat)
+	if err != nil {
 		return err
 	}
 
 	if uid < 0 {
-		uid = int(stat.Uid)
+		uid = data.Uid
 	}
 	if gid < 0 {
-		gid = int(stat.Gid)
+		gid = data.Gid
 	}
 
-	switch stat.Mode & unix.S_IFMT {
-	case unix.S_IFREG, unix.S_IFDIR:
-		ufd, err := upgradeFd(fd)
-		if err != nil {
-			return err
+	if !hasOverrideSupport(stat.Mode) {
+		if uid != int(stat.Uid) || gid != int(stat.Gid) {
+			return errors.New("cannot change ownership of non-regular files")
 		}
-		defer unix.Close(ufd)
+		return nil
+	}
 
-		if uid == int(stat.Uid) && gid == int(stat.Gid) {
-			if err := clearOverrideData(ufd); err != nil {
-				return err
-			}
-		} else {
-			data := &overrideData{
-				Uid: uid,
-				Gid: gid,
-			}
-			if err := writeOverrideData(ufd, data); err != nil {
-				return err
-			}
+	ufd, err := upgradeFd(fd)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(ufd)
+
+	data.Uid = uid
+	data.Gid = gid
+	if mode := effectiveMode(&stat, data); mode&unix.S_IFMT != unix.S_IFDIR {
+		newMode := mode &^ unix.S_ISUID
+		// A setgid bit without the group execute bit indicates mandatory
+		// locking rather than privileges, so the kernel keeps it.
+		if newMode&unix.S_IXGRP != 0 {
+			newMode &^= unix.S_ISGID
 		}
+		if newMode != mode {
+			data.Mode = newMode
+		}
+		data.Capability = nil
+	}
+	return updateOverride(ufd, &stat, data)
+}
+
+// Fchmod changes the mode of a given file.
+// If a file pointed by fd is a regular file or a directory, permission bits
+// are applied to the file, and setuid/setgid/sticky bits are recorded in
+// xattrs to override file metadata. Otherwise it behaves like normal chmod(2).
+// fd can be a file descriptor opened with O_PATH.
+func Fchmod(fd int, mode uint32) error {
+	var stat unix.Stat_t
+	data, _, err := fstatReal(fd, &stat)
+	if err != nil {
+		return err
+	}
+
+	if !hasOverrideSupport(stat.Mode) {
+		// fchmod(2) doesn't work with O_PATH file descriptors.
+		return unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), mode)
+	}
+
+	ufd, err := upgradeFd(fd)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(ufd)
+
+	// Keep the real permission bits in sync so that access checks work as
+	// expected.
+	if err := unix.Fchmod(ufd, mode&0o777); err != nil {
+		return err
+	}
+	if err := unix.Fstat(ufd, &stat); err != nil {
+		return err
+	}
+
+	fileType := effectiveMode(&stat, data) & unix.S_IFMT
+	data.Mode = fileType | mode&(0o777|specialModeBits)
+	return updateOverride(ufd, &stat, data)
+}
 
+// MknodDevice creates a character or block device file at path relative to
+// dirfd. Since unprivileged users can't create device files, it creates an
+// empty regular file and sets xattrs to make it look like a device file.
+// mode must have the umask applied already.
+func MknodDevice(dirfd int, path string, mode uint32, dev uint64) error {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFCHR, unix.S_IFBLK:
 	default:
-		if uid != int(stat.Uid) || gid != int(stat.Gid) {
-			return errors.New("cannot change ownership of non-regular files")
+		return unix.EINVAL
+	}
+
+	fd, err := unix.Openat(dirfd, path, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err := func() error {
+		var stat unix.Stat_t
+		if err := unix.Fstat(fd, &stat); err != nil {
+			return err
 		}
+		data := &overrideData{
+			Uid:  int(stat.Uid),
+			Gid:  int(stat.Gid),
+			Mode: mode,
+			Rdev: dev,
+		}
+		if err := writeOverrideData(fd, data); err != nil {
+			return err
+		}
+		return unix.Fchmod(fd, mode&0o777)
+	}(); err != nil {
+		_ = unix.Unlinkat(dirfd, path, 0)
+		return err
 	}
 	return nil
 }
+
+// GetCapability returns the simulated security.capability xattr of a given
+// file. ok is false if the file has no simulated capability.
+// fd can be a file descriptor opened with O_PATH.
+func GetCapability(fd int) (value []byte, ok bool, err error) {
+	var stat unix.Stat_t
+	data, _, err := fstatReal(fd, &stat)
+	if err != nil {
+		return nil, false, err
+	}
+	if data.Capability == nil {
+		return nil, false, nil
+	}
+	return data.Capability, true, nil
+}
+
+// SetCapability simulates setting the security.capability xattr of a given
+// file. flags are the same as setxattr(2).
+// fd can be a file descriptor opened with O_PATH.
+func SetCapability(fd int, value []byte, flags int) error {
+	var stat unix.Stat_t
+	data, _, err := fstatReal(fd, &stat)
+	if err != nil {
+		return err
+	}
+
+	if flags&unix.XATTR_CREATE != 0 && data.Capability != nil {
+		return unix.EEXIST
+	}
+	if flags&unix.XATTR_REPLACE != 0 && data.Capability == nil {
+		return unix.ENODATA
+	}
+	if !hasOverrideSupport(stat.Mode) {
+		return unix.EPERM
+	}
+
+	ufd, err := upgradeFd(fd)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(ufd)
+
+	data.Capability = append([]byte{}, value...)
+	return updateOverride(ufd, &stat, data)
+}
@@ -5,6 +5,7 @@
 package fsop
 
 import (
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -13,11 +14,25 @@ import (
 type overrideData struct {
 	Uid int
 	Gid int
+	// Mode is the full file mode, including the file type, to report instead
+	// of the real one. 0 means that the mode is not overridden.
+	Mode uint32
+	// Rdev is the device number to report for simulated device files.
+	Rdev uint64
+	// Capability is the value of the simulated security.capability xattr.
+	// nil means that the xattr is not set.
+	Capability []byte
 }
 
+// parseOverrideData parses override data in the form of "uid:gid" or
+// "uid:gid:mode:rdev:capability", where mode is in octal and capability is
+// hex-encoded.
+//
+// libfakefs_preload.so parses the same format in parse_override; keep them in
+// sync.
 func parseOverrideData(b []byte) (*overrideData, error) {
 	v := strings.Split(string(b), ":")
-	if len(v) != 2 {
+	if len(v) != 2 && len(v) != 5 {
 		return nil, fmt.Errorf("corrupted override data: %s", string(b))
 	}
 	uid, err := strconv.Atoi(v[0])
@@ -28,12 +43,43 @@ func parseOverrideData(b []byte) (*overrideData, error) {
 	if err != nil {
 		return nil, fmt.Errorf("corrupted override data: corrupted gid: %s", v[1])
 	}
-	return &overrideData{
+	data := &overrideData{
 		Uid: uid,
 		Gid: gid,
-	}, nil
+	}
+	if len(v) == 2 {
+		return data, nil
+	}
+
+	mode, err := strconv.ParseUint(v[2], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted override data: corrupted mode: %s", v[2])
+	}
+	rdev, err := strconv.ParseUint(v[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted override data: corrupted rdev: %s", v[3])
+	}
+	data.Mode = uint32(mode)
+	data.Rdev = rdev
+	if v[4] != "-" {
+		capability, err := hex.DecodeString(v[4])
+		if err != nil {
+			return nil, fmt.Errorf("corrupted override data: corrupted capability: %s", v[4])
+		}
+		data.Capability = capability
+	}
+	return data, nil
 }
 
 func (o *overrideData) Marshal() []byte {
-	return []byte(fmt.Sprintf("%d:%d", o.Uid, o.Gid))
+	// Keep the short form for ownership-only overrides, which
+	// libfakefs_preload.so knows how to handle by itself.
+	if o.Mode == 0 && o.Capability == nil {
+		return []byte(fmt.Sprintf("%d:%d", o.Uid, o.Gid))
+	}
+	capability := "-"
+	if o.Capability != nil {
+		capability = hex.EncodeToString(o.Capability)
+	}
+	return []byte(fmt.Sprintf("%d:%d:%o:%d:%s", o.Uid, o.Gid, o.Mode, o.Rdev, capability))
 }
@@ -0,0 +1,737 @@
+// Copyright 2022 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/elastic/go-seccomp-bpf"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"cros.local/bazel/portage/bin/fakefs/fsop"
+	"cros.local/bazel/portage/bin/fakefs/logging"
+	"cros.local/bazel/portage/bin/fakefs/ptracearch"
+	"cros.local/bazel/portage/bin/fakefs/syscallabi"
+)
+
+// sysIsFakefsRunning is a fake system call number that fakefs intercepts to
+// allow tracees to check if they are running under fakefs.
+const sysIsFakefsRunning = 1000042
+
+// IsFakefsRunning returns whether the current process is being traced by fakefs.
+func IsFakefsRunning() bool {
+	_, _, errno := unix.Syscall6(sysIsFakefsRunning, 0, 0, 0, 0, 0, 0)
+	return errno == 0
+}
+
+const backdoorKey = 0x20221107
+
+// xattrSizeMax is the maximum size of xattr values, XATTR_SIZE_MAX in
+// linux/limits.h.
+const xattrSizeMax = 65536
+
+func readCString(tid int, ptr uintptr) (string, error) {
+	// Use process_vm_readv(2) instead of ptrace(2) with PTRACE_PEEKDATA
+	// for much better efficiency.
+	var str []byte
+
+	// Always assume that the page size is 4096 bytes.
+	// Even if huge pages are enabled, the page size should be multiple of
+	// 4096 bytes, so it's fine for our purpose.
+	const pageSize = 4096
+	buf := make([]byte, pageSize)
+
+	for {
+		nextSize := pageSize - (ptr % pageSize)
+		localIov := []unix.Iovec{{
+			Base: (*byte)((unsafe.Pointer)((*reflect.SliceHeader)((unsafe.Pointer)(&buf)).Data)),
+			Len:  uint64(nextSize),
+		}}
+		remoteIov := []unix.RemoteIovec{{
+			Base: ptr,
+			Len:  int(nextSize),
+		}}
+
+		readSize, err := unix.ProcessVMReadv(tid, localIov, remoteIov, 0)
+		if err != nil {
+			return "", err
+		}
+
+		for _, b := range buf[:readSize] {
+			if b == 0 {
+				return string(str), nil
+			}
+			str = append(str, b)
+		}
+		ptr += uintptr(readSize)
+	}
+}
+
+func readBytes(tid int, ptr uintptr, size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	localIov := []unix.Iovec{{
+		Base: &buf[0],
+		Len:  uint64(size),
+	}}
+	remoteIov := []unix.RemoteIovec{{
+		Base: ptr,
+		Len:  size,
+	}}
+	readSize, err := unix.ProcessVMReadv(tid, localIov, remoteIov, 0)
+	if err != nil {
+		return nil, err
+	}
+	if readSize != size {
+		return nil, unix.EFAULT
+	}
+	return buf, nil
+}
+
+func writeBytes(tid int, ptr uintptr, data []byte) error {
+	// Use process_vm_writev(2) instead of ptrace(2) with PTRACE_POKEDATA
+	// for much better efficiency.
+	if len(data) == 0 {
+		return nil
+	}
+	localIov := []unix.Iovec{{
+		Base: &data[0],
+		Len:  uint64(len(data)),
+	}}
+	remoteIov := []unix.RemoteIovec{{
+		Base: ptr,
+		Len:  int(len(data)),
+	}}
+	_, err := unix.ProcessVMWritev(tid, localIov, remoteIov, 0)
+	return err
+}
+
+func writeStruct[T any](tid int, ptr uintptr, data *T) error {
+	return writeBytes(tid, ptr, unsafe.Slice((*byte)(unsafe.Pointer(data)), unsafe.Sizeof(*data)))
+}
+
+func dirfdPath(tid int, dfd int) string {
+	if dfd == unix.AT_FDCWD {
+		return fmt.Sprintf("/proc/%d/cwd", tid)
+	}
+	return fmt.Sprintf("/proc/%d/fd/%d", tid, dfd)
+}
+
+// readUmask returns the file mode creation mask of a tracee thread.
+func readUmask(tid int) (uint32, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if value, ok := strings.CutPrefix(line, "Umask:"); ok {
+			umask, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+			if err != nil {
+				return 0, fmt.Errorf("corrupted umask: %s", value)
+			}
+			return uint32(umask), nil
+		}
+	}
+	return 0, fmt.Errorf("umask not found in /proc/%d/status", tid)
+}
+
+// rewritePerThreadPaths rewrites file paths specific to threads.
+// TODO: Improve the method to reduce false negatives.
+func rewritePerThreadPaths(tid int, path string) string {
+	// /proc/self/ -> /proc/$tid/
+	const procSelf = "/proc/self/"
+	if strings.HasPrefix(path, procSelf) {
+		return fmt.Sprintf("/proc/%d/%s", tid, path[len(procSelf):])
+	}
+	return path
+}
+
+func blockSyscallAndReturn(tid int, regs *ptracearch.Regs, ret uint64) func(regs *ptracearch.Regs) {
+	_ = ptracearch.SkipSyscall(tid, regs)
+
+	return func(regs *ptracearch.Regs) {
+		ptracearch.SetReturnValue(regs, ret)
+		_ = ptracearch.SetRegs(tid, regs)
+	}
+}
+
+func blockSyscall(tid int, regs *ptracearch.Regs, logger *logging.Logger, err error) func(regs *ptracearch.Regs) {
+	errno, ok := err.(unix.Errno)
+	if err != nil && !ok {
+		logger.Errorf(tid, "%s: %v", syscallabi.Name(int(ptracearch.SyscallNumber(regs))), err)
+		errno = unix.ENOTRECOVERABLE
+	}
+	return blockSyscallAndReturn(tid, regs, -uint64(errno))
+}
+
+// openat opens a file with arguments intercepted for a tracee thread.
+// It returns a file descriptor opened with O_PATH.
+func openat(tid int, dfd int, filename string, flags int) (fd int, err error) {
+	oflags := unix.O_PATH | unix.O_CLOEXEC
+	if flags&unix.AT_SYMLINK_NOFOLLOW != 0 {
+		oflags |= unix.O_NOFOLLOW
+	}
+
+	// If the file path is absolute, no need to resolve dfd.
+	if filepath.IsAbs(filename) {
+		return unix.Open(filename, oflags, 0)
+	}
+
+	path := dirfdPath(tid, dfd)
+	dirfd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, unix.EBADF
+	}
+
+	if filename == "" && flags&unix.AT_EMPTY_PATH != 0 {
+		return dirfd, nil
+	}
+
+	fd, err = unix.Openat(dirfd, filename, oflags, 0)
+	_ = unix.Close(dirfd)
+	if err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+func simulateFstatat(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, statbuf uintptr, flags int) func(regs *ptracearch.Regs) {
+	filename = rewritePerThreadPaths(tid, filename)
+
+	// If the file path is absolute, no need to resolve dfd.
+	if filepath.IsAbs(filename) {
+		if !fsop.HasOverride(filename, flags&unix.AT_SYMLINK_NOFOLLOW == 0) {
+			return nil
+		}
+	}
+
+	fd, err := openat(tid, dfd, filename, flags)
+	if err != nil {
+		// Pass through the system call if the target file fails to open.
+		return nil
+	}
+	defer unix.Close(fd)
+
+	var stat unix.Stat_t
+	overridden, err := fsop.Fstat(fd, &stat)
+	if err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+	if !overridden {
+		// Pass through the system call if the file has no override.
+		return nil
+	}
+
+	err = writeStruct(tid, statbuf, &stat)
+	return blockSyscall(tid, regs, logger, err)
+}
+
+func simulateStatx(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, flags int, mask int, statxbuf uintptr) func(regs *ptracearch.Regs) {
+	filename = rewritePerThreadPaths(tid, filename)
+
+	// If the file path is absolute, no need to resolve dfd.
+	if filepath.IsAbs(filename) {
+		if !fsop.HasOverride(filename, flags&unix.AT_SYMLINK_NOFOLLOW == 0) {
+			return nil
+		}
+	}
+
+	fd, err := openat(tid, dfd, filename, flags)
+	if err != nil {
+		// Pass through the system call if the target file fails to open.
+		return nil
+	}
+	defer unix.Close(fd)
+
+	var statx unix.Statx_t
+	overridden, err := fsop.Fstatx(fd, mask, &statx)
+	if err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+	if !overridden {
+		// Pass through the system call if the file has no override.
+		return nil
+	}
+
+	err = writeStruct(tid, statxbuf, &statx)
+	return blockSyscall(tid, regs, logger, err)
+}
+
+func simulateListxattr(tid int, regs *ptracearch.Regs, logger *logging.Logger, filename string, list uintptr, size int, followSymlinks bool) func(regs *ptracearch.Regs) {
+	filename = rewritePerThreadPaths(tid, filename)
+	if !filepath.IsAbs(filename) {
+		filename = fmt.Sprintf("/proc/%d/cwd/%s", tid, filename)
+	}
+	if !fsop.HasOverride(filename, followSymlinks) {
+		return nil
+	}
+
+	data, actualSize, err := fsop.Listxattr(filename, size, followSymlinks)
+	if err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+
+	if err := writeBytes(tid, list, data); err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+
+	return blockSyscallAndReturn(tid, regs, uint64(actualSize))
+}
+
+func simulateFlistxattr(tid int, regs *ptracearch.Regs, logger *logging.Logger, fd int, list uintptr, size int) func(regs *ptracearch.Regs) {
+	nfd, err := unix.Open(fmt.Sprintf("/proc/%d/fd/%d", tid, fd), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return blockSyscall(tid, regs, logger, unix.EBADF)
+	}
+	defer unix.Close(nfd)
+
+	if !fsop.FHasOverride(nfd) {
+		return nil
+	}
+
+	data, actualSize, err := fsop.Flistxattr(nfd, size)
+	if err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+
+	if err := writeBytes(tid, list, data); err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+
+	return blockSyscallAndReturn(tid, regs, uint64(actualSize))
+}
+
+func simulateFchownat(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, user int, group int, flags int) func(regs *ptracearch.Regs) {
+	return blockSyscall(tid, regs, logger, func() error {
+		fd, err := openat(tid, dfd, filename, flags)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		return fsop.Fchown(fd, user, group)
+	}())
+}
+
+func simulateFchmodat(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, mode uint32, flags int) func(regs *ptracearch.Regs) {
+	return blockSyscall(tid, regs, logger, func() error {
+		fd, err := openat(tid, dfd, filename, flags)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		return fsop.Fchmod(fd, mode)
+	}())
+}
+
+func simulateMknodat(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, mode uint32, dev uint64) func(regs *ptracearch.Regs) {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFCHR, unix.S_IFBLK:
+	default:
+		// Unprivileged users can create other types of files.
+		return nil
+	}
+
+	return blockSyscall(tid, regs, logger, func() error {
+		umask, err := readUmask(tid)
+		if err != nil {
+			return err
+		}
+		mode &^= umask
+
+		filename = rewritePerThreadPaths(tid, filename)
+		if filepath.IsAbs(filename) {
+			return fsop.MknodDevice(unix.AT_FDCWD, filename, mode, dev)
+		}
+
+		dirfd, err := unix.Open(dirfdPath(tid, dfd), unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return unix.EBADF
+		}
+		defer unix.Close(dirfd)
+
+		return fsop.MknodDevice(dirfd, filename, mode, dev)
+	}())
+}
+
+func simulateGetxattr(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, flags int, value uintptr, size int) func(regs *ptracearch.Regs) {
+	fd, err := openat(tid, dfd, rewritePerThreadPaths(tid, filename), flags)
+	if err != nil {
+		// Pass through the system call if the target file fails to open.
+		return nil
+	}
+	defer unix.Close(fd)
+
+	capability, ok, err := fsop.GetCapability(fd)
+	if err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+	if !ok {
+		// Pass through the system call if the file has no simulated
+		// capability.
+		return nil
+	}
+
+	// If size is 0, getxattr(2) family returns the required size without
+	// storing results.
+	if size == 0 {
+		return blockSyscallAndReturn(tid, regs, uint64(len(capability)))
+	}
+	if size < len(capability) {
+		return blockSyscall(tid, regs, logger, unix.ERANGE)
+	}
+	if err := writeBytes(tid, value, capability); err != nil {
+		return blockSyscall(tid, regs, logger, err)
+	}
+	return blockSyscallAndReturn(tid, regs, uint64(len(capability)))
+}
+
+func simulateSetxattr(tid int, regs *ptracearch.Regs, logger *logging.Logger, dfd int, filename string, flags int, value uintptr, size int, xattrFlags int) func(regs *ptracearch.Regs) {
+	return blockSyscall(tid, regs, logger, func() error {
+		if size > xattrSizeMax {
+			return unix.E2BIG
+		}
+		capability, err := readBytes(tid, value, size)
+		if err != nil {
+			return unix.EFAULT
+		}
+
+		fd, err := openat(tid, dfd, rewritePerThreadPaths(tid, filename), flags)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		return fsop.SetCapability(fd, capability, xattrFlags)
+	}())
+}
+
+// traceRemove returns a hook to run after a system call that may remove a link
+// to a file, e.g. unlink(2) or rename(2) replacing it. If the link was the last
+// one to the file, the hook clears the override of the file so that a new file
+// reusing its inode number does not inherit it.
+func traceRemove(tid int, logger *logging.Logger, name string, dfd int, filename string) func(regs *ptracearch.Regs) {
+	filename = rewritePerThreadPaths(tid, filename)
+
+	dirfd := unix.AT_FDCWD
+	// If the file path is absolute, no need to resolve dfd.
+	if !filepath.IsAbs(filename) {
+		var err error
+		dirfd, err = unix.Open(dirfdPath(tid, dfd), unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			// Let the kernel report the error.
+			return nil
+		}
+		defer unix.Close(dirfd)
+	}
+
+	clear := fsop.PrepareRemove(dirfd, filename)
+	if clear == nil {
+		return nil
+	}
+	return func(regs *ptracearch.Regs) {
+		if ptracearch.ReturnValue(regs) != 0 {
+			return
+		}
+		if err := clear(); err != nil {
+			logger.Errorf(tid, "%s: failed to clear override: %v", name, err)
+		}
+	}
+}
+
+// readXattrName reads the name argument of xattr system calls. It returns
+// false if the system call doesn't need to be simulated.
+func readXattrName(tid int, ptr uintptr) (string, bool) {
+	name, err := readCString(tid, ptr)
+	if err != nil {
+		// Let the kernel report the error.
+		return "", false
+	}
+	return name, name == fsop.XattrNameCapability
+}
+
+// tracedSyscalls is the list of system calls to intercept on all
+// architectures. See also archTracedSyscalls.
+var tracedSyscalls = []string{
+	// stat
+	"fstat",
+	"statx",
+	// listxattr
+	"listxattr",
+	"llistxattr",
+	"flistxattr",
+	// chown
+	"fchown",
+	"fchownat",
+	// chmod
+	"fchmod",
+	"fchmodat",
+	// mknod
+	"mknodat",
+	// getxattr/setxattr, for security.capability
+	"getxattr",
+	"lgetxattr",
+	"fgetxattr",
+	"setxattr",
+	"lsetxattr",
+	"fsetxattr",
+}
+
+// dbTracedSyscalls is the list of system calls to intercept additionally when
+// overrides are stored in a database, as entries have to be cleared when the
+// files they apply to are removed. See also archDBTracedSyscalls.
+var dbTracedSyscalls = []string{
+	"unlinkat",
+	"renameat",
+	"renameat2",
+}
+
+// SeccompBPF returns a seccomp BPF program to intercept system calls fakefs
+// simulates. useDB should be true if overrides are stored in a database.
+func SeccompBPF(useDB bool) ([]bpf.Instruction, error) {
+	// Seccomp BPF program inspects the following packet.
+	//
+	//   struct seccomp_data {
+	//     int   nr;
+	//     __u32 arch;
+	//     __u64 instruction_pointer;
+	//     __u64 args[6];
+	//   };
+	//
+	// See man 2 seccomp for details.
+	backdoorProgram := []bpf.Instruction{
+		// Pass through system calls if the 6th argument is backdoorKey.
+		// We don't bother to check arch and __X32_SYSCALL_BIT because it's
+		// about passing through syscalls regardless of the syscall number.
+		bpf.LoadAbsolute{Off: 4 + 4 + 8 + 8*5, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: backdoorKey, SkipFalse: 1},
+		bpf.RetConstant{Val: uint32(seccomp.ActionAllow)},
+
+		// Intercept SysIsFakefsRunning.
+		bpf.LoadAbsolute{Off: 0, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: sysIsFakefsRunning, SkipFalse: 1},
+		bpf.RetConstant{Val: uint32(seccomp.ActionTrace)},
+	}
+
+	names := append(append([]string(nil), tracedSyscalls...), archTracedSyscalls...)
+	if useDB {
+		names = append(append(names, dbTracedSyscalls...), archDBTracedSyscalls...)
+	}
+
+	// TODO: Drop the dependency to go-seccomp-bpf and construct BPF program
+	// by ourselves. The library is not very useful when we need non-trivial
+	// BPF programs.
+	policy := seccomp.Policy{
+		DefaultAction: seccomp.ActionAllow,
+		Syscalls: []seccomp.SyscallGroup{{
+			Action: seccomp.ActionTrace,
+			Names:  names,
+		}},
+	}
+
+	traceProgram, err := policy.Assemble()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(backdoorProgram, traceProgram...), nil
+}
+
+func OnSyscall(tid int, regs *ptracearch.Regs, logger *logging.Logger) func(regs *ptracearch.Regs) {
+	switch ptracearch.SyscallNumber(regs) {
+	case unix.SYS_FSTAT:
+		args := syscallabi.ParseFstatArgs(regs)
+		logger.Infof(tid, "slow: fstat(%d)", args.Fd)
+		return simulateFstatat(tid, regs, logger, args.Fd, "", args.Statbuf, unix.AT_EMPTY_PATH)
+
+	case unix.SYS_STATX:
+		args := syscallabi.ParseStatxArgs(regs)
+		filename, err := readCString(tid, args.Filename)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: statx(%d, %q, %#x, %#x)", args.Dfd, filename, args.Flags, args.Mask)
+		return simulateStatx(tid, regs, logger, args.Dfd, filename, args.Flags, args.Mask, args.Buffer)
+
+	case unix.SYS_LISTXATTR:
+		args := syscallabi.ParseListxattrArgs(regs)
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: listxattr(%q, %d)", filename, args.Size)
+		return simulateListxattr(tid, regs, logger, filename, args.List, args.Size, true)
+
+	case unix.SYS_LLISTXATTR:
+		args := syscallabi.ParseLlistxattrArgs(regs)
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: llistxattr(%q, %d)", filename, args.Size)
+		return simulateListxattr(tid, regs, logger, filename, args.List, args.Size, false)
+
+	case unix.SYS_FLISTXATTR:
+		args := syscallabi.ParseFlistxattrArgs(regs)
+		logger.Infof(tid, "slow: flistxattr(%d, %d)", args.Fd, args.Size)
+		return simulateFlistxattr(tid, regs, logger, args.Fd, args.List, args.Size)
+
+	case unix.SYS_FCHOWN:
+		args := syscallabi.ParseFchownArgs(regs)
+		logger.Infof(tid, "slow: fchown(%d, %d, %d)", args.Fd, args.Owner, args.Group)
+		return simulateFchownat(tid, regs, logger, args.Fd, "", args.Owner, args.Group, unix.AT_EMPTY_PATH)
+
+	case unix.SYS_FCHOWNAT:
+		args := syscallabi.ParseFchownatArgs(regs)
+		filename, err := readCString(tid, args.Filename)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: fchownat(%d, %q, %d, %d, %#x)", args.Dfd, filename, args.User, args.Group, args.Flag)
+		return simulateFchownat(tid, regs, logger, args.Dfd, filename, args.User, args.Group, args.Flag)
+
+	case unix.SYS_FCHMOD:
+		args := syscallabi.ParseFchmodArgs(regs)
+		logger.Infof(tid, "slow: fchmod(%d, %#o)", args.Fd, args.Mode)
+		return simulateFchmodat(tid, regs, logger, args.Fd, "", args.Mode, unix.AT_EMPTY_PATH)
+
+	case unix.SYS_FCHMODAT:
+		args := syscallabi.ParseFchmodatArgs(regs)
+		filename, err := readCString(tid, args.Filename)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: fchmodat(%d, %q, %#o)", args.Dfd, filename, args.Mode)
+		return simulateFchmodat(tid, regs, logger, args.Dfd, filename, args.Mode, unix.AT_SYMLINK_FOLLOW)
+
+	case unix.SYS_MKNODAT:
+		args := syscallabi.ParseMknodatArgs(regs)
+		filename, err := readCString(tid, args.Filename)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: mknodat(%d, %q, %#o, %#x)", args.Dfd, filename, args.Mode, args.Dev)
+		return simulateMknodat(tid, regs, logger, args.Dfd, filename, args.Mode, args.Dev)
+
+	case unix.SYS_GETXATTR:
+		args := syscallabi.ParseGetxattrArgs(regs)
+		name, ok := readXattrName(tid, args.Name)
+		if !ok {
+			return nil
+		}
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: getxattr(%q, %q, %d)", filename, name, args.Size)
+		return simulateGetxattr(tid, regs, logger, unix.AT_FDCWD, filename, unix.AT_SYMLINK_FOLLOW, args.Value, args.Size)
+
+	case unix.SYS_LGETXATTR:
+		args := syscallabi.ParseLgetxattrArgs(regs)
+		name, ok := readXattrName(tid, args.Name)
+		if !ok {
+			return nil
+		}
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: lgetxattr(%q, %q, %d)", filename, name, args.Size)
+		return simulateGetxattr(tid, regs, logger, unix.AT_FDCWD, filename, unix.AT_SYMLINK_NOFOLLOW, args.Value, args.Size)
+
+	case unix.SYS_FGETXATTR:
+		args := syscallabi.ParseFgetxattrArgs(regs)
+		name, ok := readXattrName(tid, args.Name)
+		if !ok {
+			return nil
+		}
+		logger.Infof(tid, "slow: fgetxattr(%d, %q, %d)", args.Fd, name, args.Size)
+		return simulateGetxattr(tid, regs, logger, args.Fd, "", unix.AT_EMPTY_PATH, args.Value, args.Size)
+
+	case unix.SYS_SETXATTR:
+		args := syscallabi.ParseSetxattrArgs(regs)
+		name, ok := readXattrName(tid, args.Name)
+		if !ok {
+			return nil
+		}
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: setxattr(%q, %q, %d, %#x)", filename, name, args.Size, args.Flags)
+		return simulateSetxattr(tid, regs, logger, unix.AT_FDCWD, filename, unix.AT_SYMLINK_FOLLOW, args.Value, args.Size, args.Flags)
+
+	case unix.SYS_LSETXATTR:
+		args := syscallabi.ParseLsetxattrArgs(regs)
+		name, ok := readXattrName(tid, args.Name)
+		if !ok {
+			return nil
+		}
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: lsetxattr(%q, %q, %d, %#x)", filename, name, args.Size, args.Flags)
+		return simulateSetxattr(tid, regs, logger, unix.AT_FDCWD, filename, unix.AT_SYMLINK_NOFOLLOW, args.Value, args.Size, args.Flags)
+
+	case unix.SYS_FSETXATTR:
+		args := syscallabi.ParseFsetxattrArgs(regs)
+		name, ok := readXattrName(tid, args.Name)
+		if !ok {
+			return nil
+		}
+		logger.Infof(tid, "slow: fsetxattr(%d, %q, %d, %#x)", args.Fd, name, args.Size, args.Flags)
+		return simulateSetxattr(tid, regs, logger, args.Fd, "", unix.AT_EMPTY_PATH, args.Value, args.Size, args.Flags)
+
+	case unix.SYS_UNLINKAT:
+		args := syscallabi.ParseUnlinkatArgs(regs)
+		filename, err := readCString(tid, args.Pathname)
+		if err != nil {
+			// Let the kernel report the error.
+			return nil
+		}
+		logger.Infof(tid, "slow: unlinkat(%d, %q, %#x)", args.Dfd, filename, args.Flag)
+		return traceRemove(tid, logger, "unlinkat", args.Dfd, filename)
+
+	case unix.SYS_RENAMEAT:
+		args := syscallabi.ParseRenameatArgs(regs)
+		newname, err := readCString(tid, args.Newname)
+		if err != nil {
+			return nil
+		}
+		logger.Infof(tid, "slow: renameat(%d, _, %d, %q)", args.Olddfd, args.Newdfd, newname)
+		return traceRemove(tid, logger, "renameat", args.Newdfd, newname)
+
+	case unix.SYS_RENAMEAT2:
+		args := syscallabi.ParseRenameat2Args(regs)
+		if args.Flags&unix.RENAME_EXCHANGE != 0 {
+			// Exchanging files removes no link.
+			return nil
+		}
+		newname, err := readCString(tid, args.Newname)
+		if err != nil {
+			return nil
+		}
+		logger.Infof(tid, "slow: renameat2(%d, _, %d, %q, %#x)", args.Olddfd, args.Newdfd, newname, args.Flags)
+		return traceRemove(tid, logger, "renameat2", args.Newdfd, newname)
+
+	case sysIsFakefsRunning:
+		// Respond to the fake system call with success.
+		return blockSyscallAndReturn(tid, regs, 0)
+
+	default:
+		return onArchSyscall(tid, regs, logger)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package hooks
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"cros.local/bazel/portage/bin/fakefs/logging"
+	"cros.local/bazel/portage/bin/fakefs/ptracearch"
+	"cros.local/bazel/portage/bin/fakefs/syscallabi"
+)
+
+// archTracedSyscalls is the list of system calls to intercept in addition to
+// tracedSyscalls. arm64 uses the generic system call table, where legacy
+// system calls such as stat(2) and chown(2) don't exist; libc implements them
+// with their *at(2) counterparts.
+var archTracedSyscalls = []string{
+	// newfstatat(2) is named fstatat in the generic system call table.
+	"fstatat",
+}
+
+// archDBTracedSyscalls is the list of system calls to intercept in addition to
+// dbTracedSyscalls. It is empty as unlink(2), rmdir(2) and rename(2) don't
+// exist in the generic system call table.
+var archDBTracedSyscalls = []string{}
+
+func onArchSyscall(tid int, regs *ptracearch.Regs, logger *logging.Logger) func(regs *ptracearch.Regs) {
+	switch ptracearch.SyscallNumber(regs) {
+	case unix.SYS_FSTATAT:
+		args := syscallabi.ParseNewfstatatArgs(regs)
+		filename, err := readCString(tid, args.Filename)
+		if err != nil {
+			return blockSyscall(tid, regs, logger, fmt.Errorf("failed to read filename: %w", err))
+		}
+		logger.Infof(tid, "slow: newfstatat(%d, %q, %#x)", args.Dfd, filename, args.Flag)
+		return simulateFstatat(tid, regs, logger, args.Dfd, filename, args.Statbuf, args.Flag)
+
+	default:
+		return nil
+	}
+}
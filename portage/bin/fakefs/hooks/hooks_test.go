@@ -0,0 +1,17 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package hooks
+
+import "testing"
+
+// TestSeccompBPF ensures that all system calls to intercept exist on the
+// current architecture.
+func TestSeccompBPF(t *testing.T) {
+	for _, useDB := range []bool{false, true} {
+		if _, err := SeccompBPF(useDB); err != nil {
+			t.Fatalf("SeccompBPF(%v): %v", useDB, err)
+		}
+	}
+}
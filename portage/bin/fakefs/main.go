@@ -5,12 +5,14 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"runtime"
 
 	"github.com/urfave/cli/v2"
 
 	"cros.local/bazel/portage/bin/fakefs/exit"
+	"cros.local/bazel/portage/bin/fakefs/fsop"
 	"cros.local/bazel/portage/bin/fakefs/tracee"
 	"cros.local/bazel/portage/bin/fakefs/tracer"
 )
@@ -32,6 +34,28 @@ var flagPreload = &cli.StringFlag{
 	Usage: "shared library to be added to LD_PRELOAD",
 }
 
+var flagDB = &cli.StringFlag{
+	Name:    "db",
+	Usage:   "directory to store overrides in instead of xattrs",
+	EnvVars: []string{"FAKEFS_DB"},
+}
+
+var flagDBRoot = &cli.StringFlag{
+	Name:  "db-root",
+	Usage: "directory that paths in --db-import and --db-export files are relative to",
+	Value: ".",
+}
+
+var flagDBImport = &cli.StringFlag{
+	Name:  "db-import",
+	Usage: "file to load overrides from into --db before running the command",
+}
+
+var flagDBExport = &cli.StringFlag{
+	Name:  "db-export",
+	Usage: "file to save overrides in --db to after running the command",
+}
+
 var flagCompatS = &cli.StringFlag{
 	Name:   "s",
 	Usage:  "for compatibility with fakeroot (ignored)",
@@ -49,6 +73,10 @@ var app = &cli.App{
 		flagTracee,
 		flagVerbose,
 		flagPreload,
+		flagDB,
+		flagDBRoot,
+		flagDBImport,
+		flagDBExport,
 		flagCompatS,
 		flagCompatI,
 	},
@@ -56,18 +84,84 @@ var app = &cli.App{
 		runTracee := c.Bool(flagTracee.Name)
 		preloadPath := c.String(flagPreload.Name)
 		verbose := c.Bool(flagVerbose.Name)
+		dbPath := c.String(flagDB.Name)
+		dbRoot := c.String(flagDBRoot.Name)
+		importPath := c.String(flagDBImport.Name)
+		exportPath := c.String(flagDBExport.Name)
 		args := c.Args().Slice()
+
+		if runTracee {
+			return tracee.Run(args, dbPath != "")
+		}
+
+		var db *fsop.Database
+		if dbPath != "" {
+			var err error
+			db, err = fsop.OpenDatabase(dbPath)
+			if err != nil {
+				return err
+			}
+			fsop.UseDatabase(db)
+		} else if importPath != "" || exportPath != "" {
+			return errors.New("--db-import and --db-export require --db")
+		}
+
+		if importPath != "" {
+			if err := importDatabase(db, importPath, dbRoot); err != nil {
+				return err
+			}
+		}
+
+		// Allow running without a command to import/export the database only.
 		if len(args) == 0 {
-			cli.ShowAppHelpAndExit(c, 1)
+			if importPath == "" && exportPath == "" {
+				cli.ShowAppHelpAndExit(c, 1)
+			}
+			if exportPath != "" {
+				return exportDatabase(db, exportPath, dbRoot)
+			}
+			return nil
 		}
 
-		if runTracee {
-			return tracee.Run(args)
+		dbDir := ""
+		if db != nil {
+			dbDir = db.Dir()
 		}
-		return tracer.Run(os.Args, args, preloadPath, verbose)
+		err := tracer.Run(os.Args, args, preloadPath, verbose, dbDir)
+
+		// Export the database even if the command failed so that callers can
+		// inspect the results.
+		var code exit.Code
+		if exportPath != "" && errors.As(err, &code) {
+			if err := exportDatabase(db, exportPath, dbRoot); err != nil {
+				return err
+			}
+		}
+		return err
 	},
 }
 
+func importDatabase(db *fsop.Database, path string, root string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return db.Import(f, root)
+}
+
+func exportDatabase(db *fsop.Database, path string, root string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := db.Export(f, root); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func main() {
 	// Lock the main thread to avoid confusing ptrace(2).
 	runtime.LockOSThread()
@@ -103,6 +103,15 @@ func runBash(t *testing.T, mode runMode, cwd string, cmd string) string {
 	return runCmd(t, mode, cwd, []string{"bash", "-xe", "-c", cmd})
 }
 
+// runWithStorages runs f with overrides stored in xattrs and in a database.
+func runWithStorages(t *testing.T, f func(t *testing.T)) {
+	t.Run("xattr", f)
+	t.Run("db", func(t *testing.T) {
+		t.Setenv("FAKEFS_DB", filepath.Join(t.TempDir(), "db"))
+		f(t)
+	})
+}
+
 func runTestHelper(t *testing.T, mode runMode, cwd string, cmd string, args ...string) string {
 	bin := testHelperBin(t)
 	return runCmd(t, mode, cwd, append([]string{bin, cmd}, args...))
@@ -180,6 +189,97 @@ func TestChgrpAbsolute(t *testing.T) {
 	}
 }
 
+func TestChownRename(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			runWithStorages(t, func(t *testing.T) {
+				dir := t.TempDir()
+
+				// Simulate the pattern to atomically replace a file.
+				got := runBash(t, mode, dir, `
+					touch target tmp
+					chown 123:234 target
+					chown 345:456 tmp
+					mv tmp target
+					stat -c %u:%g target
+					`)
+
+				const want = "345:456"
+				if got != want {
+					t.Fatalf("Unexpected ownership: got %s, want %s", got, want)
+				}
+			})
+		})
+	}
+}
+
+func TestRenameOverOverriddenFile(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			runWithStorages(t, func(t *testing.T) {
+				dir := t.TempDir()
+
+				// The override of the replaced file must not leak to the new file.
+				got := runBash(t, mode, dir, `
+					touch target tmp
+					chown 123:234 target
+					mv tmp target
+					stat -c %u:%g target
+					`)
+
+				if want := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()); got != want {
+					t.Fatalf("Unexpected ownership: got %s, want %s", got, want)
+				}
+			})
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			got := runBash(t, mode, dir, `
+				echo hello > src
+				install -o 123 -g 234 -m 644 src dst
+				install -o 345 -g 456 -d dir
+				stat -c %u:%g dst dir
+				`)
+
+			const want = "123:234\n345:456"
+			if got != want {
+				t.Fatalf("Unexpected ownership: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestChownHardLinkAfterUnlink(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			runWithStorages(t, func(t *testing.T) {
+				dir := t.TempDir()
+
+				got := runBash(t, mode, dir, `
+					mkdir sub
+					touch foo
+					chown 123:234 foo
+					ln foo sub/bar
+					rm foo
+					mv sub moved
+					stat -c %u:%g moved/bar
+					`)
+
+				const want = "123:234"
+				if got != want {
+					t.Fatalf("Unexpected ownership: got %s, want %s", got, want)
+				}
+			})
+		})
+	}
+}
+
 func TestFstatatEmptyPath(t *testing.T) {
 	for _, mode := range productionModes {
 		t.Run(mode.String(), func(t *testing.T) {
@@ -260,3 +360,158 @@ func TestFchmodatStub(t *testing.T) {
 
 	runTestHelper(t, runNormal, dir, "fchmodat-stub")
 }
+
+func TestChmodSetuid(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			// Like chown(2), changing ownership clears setuid/setgid bits.
+			got := runBash(t, mode, dir, `
+				touch foo
+				mkdir bar
+				chmod 4755 foo
+				chmod 3775 bar
+				stat -c %a foo bar
+				chown 123:234 foo bar
+				stat -c %a foo bar
+				`)
+
+			const want = "4755\n3775\n755\n3775"
+			if got != want {
+				t.Fatalf("Unexpected mode: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestChmodFast(t *testing.T) {
+	dir := t.TempDir()
+
+	runBash(t, runNormal, dir, "touch foo")
+	runCmd(t, runAbortOnSlow, dir, []string{"chmod", "600", "foo"})
+}
+
+func TestOverriddenFast(t *testing.T) {
+	dir := t.TempDir()
+
+	runBash(t, runNormal, dir, "touch foo; mkdir bar; chown 123:234 foo bar")
+	got := runBash(t, runAbortOnSlow, dir, `
+		stat -c %u:%g foo bar
+		chown 345:456 foo
+		chown :567 bar
+		stat -c %u:%g foo bar
+		ls -ln foo | cut -d" " -f3,4
+		`)
+
+	const want = "123:234\n123:234\n345:456\n123:567\n345 456"
+	if got != want {
+		t.Fatalf("Unexpected ownership: got %q, want %q", got, want)
+	}
+}
+
+func TestCapabilityFast(t *testing.T) {
+	dir := t.TempDir()
+
+	runBash(t, runNormal, dir, "touch foo")
+	runTestHelper(t, runAbortOnSlow, dir, "set-capability", "foo")
+}
+
+func TestMknod(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			got := runBash(t, mode, dir, `
+				umask 022
+				mknod null c 1 3
+				mknod sda b 8 0
+				stat -c '%F %t:%T %a' null sda
+				chown 123:234 null
+				chmod 600 null
+				stat -c '%F %t:%T %a %u:%g' null
+				`)
+
+			const want = "character special file 1:3 644\nblock special file 8:0 644\ncharacter special file 1:3 600 123:234"
+			if got != want {
+				t.Fatalf("Unexpected stat: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCapability(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+
+			runBash(t, mode, dir, "touch foo")
+			got := runTestHelper(t, mode, dir, "set-capability", "foo")
+
+			const want = "0000000200200000000000000000000000000000\nlisted"
+			if got != want {
+				t.Fatalf("Unexpected capability: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDatabase(t *testing.T) {
+	for _, mode := range productionModes {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			workDir := filepath.Join(dir, "work")
+			copyDir := filepath.Join(dir, "copy")
+			exportPath := filepath.Join(dir, "export.txt")
+			if err := os.Mkdir(workDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			// Overrides persist across fakefs invocations.
+			t.Setenv("FAKEFS_DB", filepath.Join(dir, "db"))
+			runBash(t, mode, workDir, `
+				touch foo
+				mkdir bar
+				chown 123:234 foo
+				chmod 4755 foo
+				mv foo bar/baz
+				`)
+			got := runBash(t, mode, workDir, "stat -c %u:%g:%a bar/baz")
+			if want := "123:234:4755"; got != want {
+				t.Fatalf("Unexpected stat: got %q, want %q", got, want)
+			}
+
+			// Overrides survive copying files with the export file.
+			if out, err := exec.Command(fakeFsBin(t), "--db-root="+workDir, "--db-export="+exportPath).CombinedOutput(); err != nil {
+				t.Fatalf("Exporting the database failed: %v\n%s", err, out)
+			}
+			if out, err := exec.Command("cp", "-r", workDir, copyDir).CombinedOutput(); err != nil {
+				t.Fatalf("cp failed: %v\n%s", err, out)
+			}
+			t.Setenv("FAKEFS_DB", filepath.Join(dir, "db2"))
+			if out, err := exec.Command(fakeFsBin(t), "--db-root="+copyDir, "--db-import="+exportPath).CombinedOutput(); err != nil {
+				t.Fatalf("Importing the database failed: %v\n%s", err, out)
+			}
+			got = runBash(t, mode, copyDir, "stat -c %u:%g:%a bar/baz")
+			if want := "123:234:4755"; got != want {
+				t.Fatalf("Unexpected stat after copy: got %q, want %q", got, want)
+			}
+
+			// Overrides are cleared when files are removed so that new files
+			// reusing their inode numbers don't inherit them.
+			runBash(t, mode, copyDir, `
+				touch qux
+				chown 345:456 qux
+				mv qux bar/baz
+				rm bar/baz
+				`)
+			entries, err := os.ReadDir(filepath.Join(dir, "db2"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("Database has %d entries after removing files; want 0", len(entries))
+			}
+		})
+	}
+}
@@ -6,43 +6,82 @@
 #include <dlfcn.h>
 #include <errno.h>
 #include <fcntl.h>
+#include <limits.h>
 #include <pthread.h>
 #include <stdbool.h>
 #include <stddef.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
 #include <sys/stat.h>
 #include <sys/syscall.h>
 #include <sys/xattr.h>
 #include <unistd.h>
 
-// Maximize glibc compatibility.
+// Maximize glibc compatibility by linking to the oldest versions of symbols.
 // TODO: Compile this code with hermetic toolchains and get rid of this hack.
-__asm__(".symver __errno_location,__errno_location@GLIBC_2.2.5");
-__asm__(".symver abort,abort@GLIBC_2.2.5");
-__asm__(".symver close,close@GLIBC_2.2.5");
-__asm__(".symver dlsym,dlsym@GLIBC_2.2.5");
-__asm__(".symver fprintf,fprintf@GLIBC_2.2.5");
-__asm__(".symver fwrite,fwrite@GLIBC_2.2.5");
-__asm__(".symver getenv,getenv@GLIBC_2.2.5");
-__asm__(".symver gettid,gettid@GLIBC_2.30");
-__asm__(".symver getxattr,getxattr@GLIBC_2.3");
-__asm__(".symver lgetxattr,lgetxattr@GLIBC_2.3");
-__asm__(".symver lremovexattr,removexattr@GLIBC_2.3");
-__asm__(".symver openat,openat@GLIBC_2.4");
-__asm__(".symver pthread_once,pthread_once@GLIBC_2.2.5");
-__asm__(".symver removexattr,removexattr@GLIBC_2.3");
-__asm__(".symver sprintf,sprintf@GLIBC_2.2.5");
-__asm__(".symver stderr,stderr@GLIBC_2.2.5");
-__asm__(".symver syscall,syscall@GLIBC_2.2.5");
+#if defined(__x86_64__)
+#define GLIBC_BASE "GLIBC_2.2.5"
+#define GLIBC_2_3 "GLIBC_2.3"
+#define GLIBC_2_4 "GLIBC_2.4"
+#elif defined(__aarch64__)
+// aarch64 was first supported by glibc 2.17, so no symbol is older than that.
+#define GLIBC_BASE "GLIBC_2.17"
+#define GLIBC_2_3 "GLIBC_2.17"
+#define GLIBC_2_4 "GLIBC_2.17"
+#else
+#error "Unsupported architecture"
+#endif
+#define GLIBC_2_30 "GLIBC_2.30"
+
+#define SYMVER(name, symbol, version) \
+  __asm__(".symver " #name "," #symbol "@" version)
+
+SYMVER(__errno_location, __errno_location, GLIBC_BASE);
+SYMVER(abort, abort, GLIBC_BASE);
+SYMVER(access, access, GLIBC_BASE);
+SYMVER(close, close, GLIBC_BASE);
+SYMVER(dlsym, dlsym, GLIBC_BASE);
+SYMVER(dprintf, dprintf, GLIBC_BASE);
+SYMVER(fcntl, fcntl, GLIBC_BASE);
+SYMVER(fprintf, fprintf, GLIBC_BASE);
+SYMVER(free, free, GLIBC_BASE);
+SYMVER(fwrite, fwrite, GLIBC_BASE);
+SYMVER(getenv, getenv, GLIBC_BASE);
+SYMVER(getpid, getpid, GLIBC_BASE);
+SYMVER(gettid, gettid, GLIBC_2_30);
+SYMVER(lremovexattr, removexattr, GLIBC_2_3);
+SYMVER(malloc, malloc, GLIBC_BASE);
+SYMVER(openat, openat, GLIBC_2_4);
+SYMVER(pthread_once, pthread_once, GLIBC_BASE);
+SYMVER(removexattr, removexattr, GLIBC_2_3);
+SYMVER(snprintf, snprintf, GLIBC_BASE);
+SYMVER(sprintf, sprintf, GLIBC_BASE);
+SYMVER(stderr, stderr, GLIBC_BASE);
+SYMVER(strcmp, strcmp, GLIBC_BASE);
+SYMVER(strlen, strlen, GLIBC_BASE);
+SYMVER(strtoull, strtoull, GLIBC_BASE);
+SYMVER(syscall, syscall, GLIBC_BASE);
+
+// Clobbers the register of the 6th system call argument so that
+// FAKEFS_BACKDOOR_KEY is not preserved for later system calls.
+#if defined(__x86_64__)
+#define CLOBBER_BACKDOOR_KEY() asm volatile("mov $0, %%r9" ::: "r9")
+#elif defined(__aarch64__)
+#define CLOBBER_BACKDOOR_KEY() asm volatile("mov x5, #0" ::: "x5")
+#endif
 
 static const char OVERRIDE_XATTR_NAME[] = "user.fakefs.override";
+static const char CAPABILITY_XATTR_NAME[] = "security.capability";
 static const int FAKEFS_BACKDOOR_KEY = 0x20221107;
 
 static pthread_once_t g_init_flag = PTHREAD_ONCE_INIT;
 
 static bool g_verbose;
 static bool g_abort_on_slow;
+// The directory of the override database if fakefs stores overrides there
+// instead of xattrs, or NULL.
+static const char *g_db_dir;
 static int (*g_libc_fstatat)(int dirfd, const char *pathname,
                              struct stat *statbuf, int flags);
 static int (*g_libc_statx)(int dirfd, const char *pathname, int flags,
@@ -51,118 +90,119 @@ static int (*g_libc_fchownat)(int dirfd, const char *pathname, uid_t owner,
                               gid_t group, int flags);
 static int (*g_libc_fchmodat)(int dirfd, const char *pathname, mode_t mode,
                               int flags);
+static int (*g_libc_fchmod)(int fd, mode_t mode);
+static ssize_t (*g_libc_getxattr)(const char *pathname, const char *name,
+                                  void *value, size_t size);
+static ssize_t (*g_libc_lgetxattr)(const char *pathname, const char *name,
+                                   void *value, size_t size);
+static ssize_t (*g_libc_fgetxattr)(int fd, const char *name, void *value,
+                                   size_t size);
+static ssize_t (*g_libc_listxattr)(const char *pathname, char *list,
+                                   size_t size);
+static ssize_t (*g_libc_llistxattr)(const char *pathname, char *list,
+                                    size_t size);
+static ssize_t (*g_libc_flistxattr)(int fd, char *list, size_t size);
 
 static void do_init(void) {
   g_verbose = getenv("FAKEFS_VERBOSE") != NULL;
   g_abort_on_slow = getenv("FAKEFS_ABORT_ON_SLOW") != NULL;
+  g_db_dir = getenv("FAKEFS_DB");
+  if (g_db_dir != NULL && g_db_dir[0] == '\0') {
+    g_db_dir = NULL;
+  }
   g_libc_fstatat = dlsym(RTLD_NEXT, "fstatat");
   g_libc_statx = dlsym(RTLD_NEXT, "statx");
   g_libc_fchownat = dlsym(RTLD_NEXT, "fchownat");
   g_libc_fchmodat = dlsym(RTLD_NEXT, "fchmodat");
+  g_libc_fchmod = dlsym(RTLD_NEXT, "fchmod");
+  g_libc_getxattr = dlsym(RTLD_NEXT, "getxattr");
+  g_libc_lgetxattr = dlsym(RTLD_NEXT, "lgetxattr");
+  g_libc_fgetxattr = dlsym(RTLD_NEXT, "fgetxattr");
+  g_libc_listxattr = dlsym(RTLD_NEXT, "listxattr");
+  g_libc_llistxattr = dlsym(RTLD_NEXT, "llistxattr");
+  g_libc_flistxattr = dlsym(RTLD_NEXT, "flistxattr");
 }
 
 static void ensure_init(void) { pthread_once(&g_init_flag, do_init); }
 
-static bool path_has_no_override(const char *pathname, bool follow_symlink) {
-  int ret = (follow_symlink ? getxattr : lgetxattr)(
-      pathname, OVERRIDE_XATTR_NAME, NULL, 0);
-  return ret < 0 && (errno == ENODATA || errno == ENOTSUP || errno == ENOENT ||
-                     errno == ENOTDIR);
-}
+// Kinds of operations to count for FAKEFS_STATS.
+enum op {
+  OP_STAT,
+  OP_STATX,
+  OP_CHOWN,
+  OP_CHMOD,
+  OP_GETXATTR,
+  OP_LISTXATTR,
+  NUM_OPS,
+};
 
-static bool fd_has_no_override(int fd) {
-  // fgetxattr may not work with O_PATH file descriptors, so use /proc/self/fd
-  // instead.
-  char fdpath[64];
-  sprintf(fdpath, "/proc/self/fd/%d", fd);
-  return path_has_no_override(fdpath, true);
-}
+static const char *const OP_NAMES[NUM_OPS] = {
+    "stat", "statx", "chown", "chmod", "getxattr", "listxattr",
+};
 
-// Returns true if the specified file has no ownership override.
-// Even if this function returns false, it does not necessarily mean that the
-// file has ownership override, e.g. it might be because the function failed to
-// determine it due to errors.
-// This function preserves `errno`.
-static bool has_no_override(int dirfd, const char *pathname, int flags) {
-  int saved_errno = errno;
+static unsigned long g_fast_counts[NUM_OPS];
+static unsigned long g_slow_counts[NUM_OPS];
+// A duplicate of stderr to report stats to, or -1 if FAKEFS_STATS is unset.
+// Some programs, e.g. GNU coreutils, close stderr before exiting.
+static int g_stats_fd = -1;
 
-  bool no_override;
-  if ((flags & AT_EMPTY_PATH) != 0 && pathname[0] == '\0') {
-    no_override = fd_has_no_override(dirfd);
-  } else {
-    if (dirfd == AT_FDCWD || pathname[0] == '/') {
-      no_override =
-          path_has_no_override(pathname, (flags & AT_SYMLINK_NOFOLLOW) == 0);
-    } else {
-      int tmpfd =
-          openat(dirfd, pathname,
-                 O_RDONLY | O_CLOEXEC | O_PATH |
-                     ((flags & AT_SYMLINK_NOFOLLOW) != 0 ? O_NOFOLLOW : 0));
-      if (tmpfd >= 0) {
-        no_override = fd_has_no_override(tmpfd);
-        close(tmpfd);
-      } else {
-        no_override = false;
-      }
-    }
-  }
-
-  errno = saved_errno;
-  return no_override;
+static void count_fast(enum op op) {
+  __atomic_fetch_add(&g_fast_counts[op], 1, __ATOMIC_RELAXED);
 }
 
-static bool path_clear_override(const char *pathname, bool follow_symlink) {
-  int ret = (follow_symlink ? removexattr : lremovexattr)(pathname,
-                                                          OVERRIDE_XATTR_NAME);
-  return ret == 0 || errno == ENODATA || errno == ENOTSUP || errno == EPERM;
+static void count_slow(enum op op) {
+  __atomic_fetch_add(&g_slow_counts[op], 1, __ATOMIC_RELAXED);
 }
 
-static bool fd_clear_override(int fd) {
-  // fremovexattr may not support O_PATH file descriptors, so use /proc/self/fd
-  // instead.
-  char fdpath[40];
-  sprintf(fdpath, "/proc/self/fd/%d", fd);
-  return path_clear_override(fdpath, true);
+__attribute__((constructor)) static void init_stats(void) {
+  if (getenv("FAKEFS_STATS") != NULL) {
+    g_stats_fd = fcntl(STDERR_FILENO, F_DUPFD_CLOEXEC, 100);
+  }
 }
 
-// Clears ownership override of the specified file. It returns true on success.
-// This function preserves `errno`.
-static bool clear_override(int dirfd, const char *pathname, int flags) {
-  int saved_errno = errno;
-
-  bool no_override;
-  if ((flags & AT_EMPTY_PATH) != 0 && pathname[0] == '\0') {
-    no_override = fd_clear_override(dirfd);
-  } else {
-    if (dirfd == AT_FDCWD || pathname[0] == '/') {
-      no_override =
-          path_clear_override(pathname, (flags & AT_SYMLINK_NOFOLLOW) == 0);
-    } else {
-      // We use O_RDONLY instead of O_WRONLY because the latter updates mtime.
-      // Fortunately O_RDONLY is enough to manipulate xattrs.
-      int tmpfd =
-          openat(dirfd, pathname,
-                 O_RDONLY | O_CLOEXEC | O_PATH |
-                     ((flags & AT_SYMLINK_NOFOLLOW) != 0 ? O_NOFOLLOW : 0));
-      if (tmpfd >= 0) {
-        no_override = fd_clear_override(tmpfd);
-        close(tmpfd);
-      } else {
-        no_override = false;
-      }
+// Reports how many calls were processed without ptrace (fast) and with ptrace
+// (slow) when the process exits, if FAKEFS_STATS is set. Calls made before
+// execve(2) are not reported.
+__attribute__((destructor)) static void report_stats(void) {
+  if (g_stats_fd < 0) {
+    return;
+  }
+  for (int op = 0; op < NUM_OPS; op++) {
+    unsigned long fast = __atomic_load_n(&g_fast_counts[op], __ATOMIC_RELAXED);
+    unsigned long slow = __atomic_load_n(&g_slow_counts[op], __ATOMIC_RELAXED);
+    if (fast + slow == 0) {
+      continue;
     }
+    dprintf(g_stats_fd, "[fakefs %d] stats: %s: fast=%lu slow=%lu (%lu%% fast)\n",
+            getpid(), OP_NAMES[op], fast, slow, fast * 100 / (fast + slow));
   }
+}
 
-  errno = saved_errno;
-  return no_override;
+// getxattr(2) family is ptrace'd by fakefs to simulate file capabilities, so
+// call them with the backdoor key to avoid slowness.
+static ssize_t backdoor_getxattr(const char *pathname, const char *name,
+                                 void *value, size_t size,
+                                 bool follow_symlink) {
+  ssize_t ret =
+      syscall(follow_symlink ? SYS_getxattr : SYS_lgetxattr, pathname, name,
+              value, size, 0, FAKEFS_BACKDOOR_KEY);
+  CLOBBER_BACKDOOR_KEY();
+  return ret;
+}
+
+static ssize_t backdoor_fgetxattr(int fd, const char *name, void *value,
+                                  size_t size) {
+  ssize_t ret = syscall(SYS_fgetxattr, fd, name, value, size, 0,
+                        FAKEFS_BACKDOOR_KEY);
+  CLOBBER_BACKDOOR_KEY();
+  return ret;
 }
 
 static int backdoor_fstatat(int dirfd, const char *pathname, void *statbuf,
                             int flags) {
   int ret = syscall(SYS_newfstatat, dirfd, pathname, statbuf, flags, 0,
                     FAKEFS_BACKDOOR_KEY);
-  // Clobber %r9 so that FAKEFS_PASS_KEY is not preserved.
-  asm volatile("mov $0, %%r9" ::: "r9");
+  CLOBBER_BACKDOOR_KEY();
   return ret;
 }
 
@@ -170,8 +210,7 @@ static int backdoor_statx(int dirfd, const char *pathname, int flags,
                           unsigned int mask, struct statx *statxbuf) {
   int ret = syscall(SYS_statx, dirfd, pathname, flags, mask, statxbuf,
                     FAKEFS_BACKDOOR_KEY);
-  // Clobber %r9 so that FAKEFS_PASS_KEY is not preserved.
-  asm volatile("mov $0, %%r9" ::: "r9");
+  CLOBBER_BACKDOOR_KEY();
   return ret;
 }
 
@@ -179,24 +218,324 @@ static int backdoor_fchownat(int dirfd, const char *pathname, uid_t owner,
                              gid_t group, int flags) {
   int ret = syscall(SYS_fchownat, dirfd, pathname, owner, group, flags,
                     FAKEFS_BACKDOOR_KEY);
-  // Clobber %r9 so that FAKEFS_PASS_KEY is not preserved.
-  asm volatile("mov $0, %%r9" ::: "r9");
+  CLOBBER_BACKDOOR_KEY();
+  return ret;
+}
+
+static int backdoor_fchmodat(int dirfd, const char *pathname, mode_t mode) {
+  int ret = syscall(SYS_fchmodat, dirfd, pathname, mode, 0, 0,
+                    FAKEFS_BACKDOOR_KEY);
+  CLOBBER_BACKDOOR_KEY();
+  return ret;
+}
+
+static int backdoor_fchmod(int fd, mode_t mode) {
+  int ret = syscall(SYS_fchmod, fd, mode, 0, 0, 0, FAKEFS_BACKDOOR_KEY);
+  CLOBBER_BACKDOOR_KEY();
   return ret;
 }
 
-// Returns true if the specified file's original ownership (i.e. ignoring
-// fakefs ownership override) matches the given UID/GID.
-// This function returns false if the function failed to read the original
-// ownership due to errors.
+static ssize_t backdoor_setxattr(const char *pathname, const char *name,
+                                 const void *value, size_t size, int flags,
+                                 bool follow_symlink) {
+  ssize_t ret =
+      syscall(follow_symlink ? SYS_setxattr : SYS_lsetxattr, pathname, name,
+              value, size, flags, FAKEFS_BACKDOOR_KEY);
+  CLOBBER_BACKDOOR_KEY();
+  return ret;
+}
+
+static ssize_t backdoor_listxattr(const char *pathname, char *list, size_t size,
+                                  bool follow_symlink) {
+  ssize_t ret = syscall(follow_symlink ? SYS_listxattr : SYS_llistxattr,
+                        pathname, list, size, 0, 0, FAKEFS_BACKDOOR_KEY);
+  CLOBBER_BACKDOOR_KEY();
+  return ret;
+}
+
+// A file specified in the style of *at(2), resolved to a path that the
+// getxattr(2) family can operate on.
+struct target {
+  const char *path;
+  bool follow_symlink;
+  // A temporary file descriptor to close, or -1.
+  int tmpfd;
+  char fdpath[64];
+};
+
+// Resolves a file specified in the style of *at(2). It returns false if the
+// file can't be opened. Call release_target after use.
+static bool resolve_target(int dirfd, const char *pathname, int flags,
+                           struct target *target) {
+  target->tmpfd = -1;
+  if ((flags & AT_EMPTY_PATH) != 0 && pathname[0] == '\0') {
+    // f*xattr may not work with O_PATH file descriptors, so use
+    // /proc/self/fd instead.
+    sprintf(target->fdpath, "/proc/self/fd/%d", dirfd);
+    target->path = target->fdpath;
+    target->follow_symlink = true;
+    return true;
+  }
+  if (dirfd == AT_FDCWD || pathname[0] == '/') {
+    target->path = pathname;
+    target->follow_symlink = (flags & AT_SYMLINK_NOFOLLOW) == 0;
+    return true;
+  }
+  // We use O_RDONLY instead of O_WRONLY because the latter updates mtime.
+  // Fortunately O_RDONLY is enough to manipulate xattrs.
+  int tmpfd = openat(dirfd, pathname,
+                     O_RDONLY | O_CLOEXEC | O_PATH |
+                         ((flags & AT_SYMLINK_NOFOLLOW) != 0 ? O_NOFOLLOW : 0));
+  if (tmpfd < 0) {
+    return false;
+  }
+  target->tmpfd = tmpfd;
+  sprintf(target->fdpath, "/proc/self/fd/%d", tmpfd);
+  target->path = target->fdpath;
+  target->follow_symlink = true;
+  return true;
+}
+
+static void release_target(struct target *target) {
+  if (target->tmpfd >= 0) {
+    close(target->tmpfd);
+  }
+}
+
+// Simulated file metadata recorded by fakefs. See fsop.overrideData.
+struct override {
+  uid_t uid;
+  gid_t gid;
+  // The full file mode to report, or 0 if not overridden.
+  mode_t mode;
+  dev_t rdev;
+  // The value of the simulated security.capability xattr if capability_size
+  // is non-negative.
+  unsigned char capability[64];
+  ssize_t capability_size;
+};
+
+static bool parse_uint(const char **p, int base, unsigned long long *value) {
+  char *end;
+  errno = 0;
+  *value = strtoull(*p, &end, base);
+  if (errno != 0 || end == *p) {
+    return false;
+  }
+  *p = end;
+  return true;
+}
+
+static int hex_digit(char c) {
+  if (c >= '0' && c <= '9') {
+    return c - '0';
+  }
+  if (c >= 'a' && c <= 'f') {
+    return c - 'a' + 10;
+  }
+  return -1;
+}
+
+// Parses override data in the form of "uid:gid" or
+// "uid:gid:mode:rdev:capability". Keep this in sync with parseOverrideData in
+// fsop/xattrdata.go.
+static bool parse_override(const char *buf, struct override *override) {
+  unsigned long long uid, gid, mode = 0, rdev = 0;
+  const char *p = buf;
+  if (!parse_uint(&p, 10, &uid) || *p++ != ':' || !parse_uint(&p, 10, &gid)) {
+    return false;
+  }
+  override->uid = uid;
+  override->gid = gid;
+  override->mode = 0;
+  override->rdev = 0;
+  override->capability_size = -1;
+  if (*p == '\0') {
+    return true;
+  }
+
+  if (*p++ != ':' || !parse_uint(&p, 8, &mode) || *p++ != ':' ||
+      !parse_uint(&p, 10, &rdev) || *p++ != ':') {
+    return false;
+  }
+  override->mode = mode;
+  override->rdev = rdev;
+  if (strcmp(p, "-") == 0) {
+    return true;
+  }
+  size_t size = 0;
+  for (; p[0] != '\0'; p += 2) {
+    int hi = hex_digit(p[0]);
+    int lo = p[1] == '\0' ? -1 : hex_digit(p[1]);
+    if (hi < 0 || lo < 0 || size >= sizeof(override->capability)) {
+      return false;
+    }
+    override->capability[size++] = hi << 4 | lo;
+  }
+  override->capability_size = size;
+  return true;
+}
+
+enum override_status {
+  // The override could not be determined, e.g. due to errors. Callers should
+  // fall back to the slow path to let fakefs handle it.
+  OVERRIDE_UNKNOWN,
+  OVERRIDE_NONE,
+  OVERRIDE_FOUND,
+};
+
+// Returns true if the override database has no entry for the specified file.
+// An entry can be stale if its inode number was reused, in which case this
+// function returns false and fakefs ignores the entry on the slow path.
+static bool db_path_has_no_override(const char *pathname,
+                                    bool follow_symlink) {
+  struct stat statbuf;
+  if (backdoor_fstatat(AT_FDCWD, pathname, &statbuf,
+                       follow_symlink ? 0 : AT_SYMLINK_NOFOLLOW) < 0) {
+    return errno == ENOENT || errno == ENOTDIR;
+  }
+  // Keep the entry name in sync with fsop.fileID.entryName.
+  char entry_path[PATH_MAX];
+  int len = snprintf(entry_path, sizeof(entry_path), "%s/%llu_%llu", g_db_dir,
+                     (unsigned long long)statbuf.st_dev,
+                     (unsigned long long)statbuf.st_ino);
+  if (len < 0 || len >= (int)sizeof(entry_path)) {
+    return false;
+  }
+  return access(entry_path, F_OK) < 0 && errno == ENOENT;
+}
+
+static enum override_status path_read_override(const char *pathname,
+                                               bool follow_symlink,
+                                               struct override *override) {
+  if (g_db_dir != NULL) {
+    // Leave database entries to fakefs as they need validation.
+    return db_path_has_no_override(pathname, follow_symlink) ? OVERRIDE_NONE
+                                                             : OVERRIDE_UNKNOWN;
+  }
+  char buf[256];
+  ssize_t size = backdoor_getxattr(pathname, OVERRIDE_XATTR_NAME, buf,
+                                   sizeof(buf) - 1, follow_symlink);
+  if (size < 0) {
+    return errno == ENODATA || errno == ENOTSUP || errno == ENOENT ||
+                   errno == ENOTDIR
+               ? OVERRIDE_NONE
+               : OVERRIDE_UNKNOWN;
+  }
+  buf[size] = '\0';
+  return parse_override(buf, override) ? OVERRIDE_FOUND : OVERRIDE_UNKNOWN;
+}
+
+// Reads the override of the specified file.
 // This function preserves `errno`.
-static bool matches_original_ownership(int dirfd, const char *pathname,
-                                       int flags, uid_t owner, gid_t group) {
+static enum override_status read_override(int dirfd, const char *pathname,
+                                          int flags,
+                                          struct override *override) {
   int saved_errno = errno;
-  struct stat statbuf;
-  bool matched = backdoor_fstatat(dirfd, pathname, &statbuf, flags) == 0 &&
-                 statbuf.st_uid == owner && statbuf.st_gid == group;
+
+  enum override_status status = OVERRIDE_UNKNOWN;
+  struct target target;
+  if (resolve_target(dirfd, pathname, flags, &target)) {
+    status = path_read_override(target.path, target.follow_symlink, override);
+    release_target(&target);
+  }
+
+  errno = saved_errno;
+  return status;
+}
+
+// Returns true if the specified file has no ownership override.
+// Even if this function returns false, it does not necessarily mean that the
+// file has ownership override, e.g. it might be because the function failed to
+// determine it due to errors.
+// This function preserves `errno`.
+static bool has_no_override(int dirfd, const char *pathname, int flags) {
+  struct override override;
+  return read_override(dirfd, pathname, flags, &override) == OVERRIDE_NONE;
+}
+
+// Clears ownership override of the specified file. It returns true on success.
+// Other kinds of overrides, e.g. simulated device files, must not be cleared
+// on changing ownership, so it fails if the file has them.
+// This function preserves `errno`.
+static bool clear_override(int dirfd, const char *pathname, int flags) {
+  int saved_errno = errno;
+
+  bool cleared = false;
+  struct target target;
+  if (resolve_target(dirfd, pathname, flags, &target)) {
+    struct override override;
+    switch (path_read_override(target.path, target.follow_symlink,
+                               &override)) {
+    case OVERRIDE_NONE:
+      cleared = true;
+      break;
+    case OVERRIDE_FOUND:
+      if (override.mode == 0 && override.capability_size < 0) {
+        int ret = (target.follow_symlink ? removexattr : lremovexattr)(
+            target.path, OVERRIDE_XATTR_NAME);
+        cleared = ret == 0 || errno == ENODATA;
+      }
+      break;
+    case OVERRIDE_UNKNOWN:
+      break;
+    }
+    release_target(&target);
+  }
+
+  errno = saved_errno;
+  return cleared;
+}
+
+// Records an ownership-only override of the specified file. It returns true
+// on success.
+// This function preserves `errno`.
+static bool set_ownership_override(int dirfd, const char *pathname, int flags,
+                                   uid_t owner, gid_t group) {
+  int saved_errno = errno;
+
+  bool set = false;
+  struct target target;
+  if (resolve_target(dirfd, pathname, flags, &target)) {
+    // Keep the format in sync with overrideData.Marshal in fsop/xattrdata.go.
+    char buf[64];
+    int len = sprintf(buf, "%u:%u", owner, group);
+    set = backdoor_setxattr(target.path, OVERRIDE_XATTR_NAME, buf, len, 0,
+                            target.follow_symlink) == 0;
+    release_target(&target);
+  }
+
   errno = saved_errno;
-  return matched;
+  return set;
+}
+
+static void apply_override_to_stat(const struct override *override,
+                                   struct stat *statbuf) {
+  statbuf->st_uid = override->uid;
+  statbuf->st_gid = override->gid;
+  if (override->mode != 0) {
+    statbuf->st_mode = override->mode;
+    statbuf->st_rdev = override->rdev;
+  }
+}
+
+static void apply_override_to_statx(const struct override *override,
+                                    struct statx *statxbuf) {
+  if ((statxbuf->stx_mask & STATX_UID) != 0) {
+    statxbuf->stx_uid = override->uid;
+  }
+  if ((statxbuf->stx_mask & STATX_GID) != 0) {
+    statxbuf->stx_gid = override->gid;
+  }
+  if (override->mode != 0) {
+    statxbuf->stx_mode = override->mode;
+    // Equivalent to major(3) and minor(3), which are not always available as
+    // inline functions.
+    statxbuf->stx_rdev_major =
+        ((override->rdev >> 8) & 0xfff) | ((override->rdev >> 32) & ~0xfff);
+    statxbuf->stx_rdev_minor =
+        (override->rdev & 0xff) | ((override->rdev >> 12) & ~0xff);
+  }
 }
 
 static int wrap_fstatat(int dirfd, const char *pathname, void *statbuf,
@@ -206,14 +545,23 @@ static int wrap_fstatat(int dirfd, const char *pathname, void *statbuf,
     return -1;
   }
 
-  if (has_no_override(dirfd, pathname, flags)) {
+  struct override override;
+  enum override_status status =
+      read_override(dirfd, pathname, flags, &override);
+  if (status != OVERRIDE_UNKNOWN) {
     if (g_verbose) {
       fprintf(stderr, "[fakefs %d] fast: fstatat(%d, \"%s\", 0x%x)\n", gettid(),
               dirfd, pathname, flags);
     }
-    return backdoor_fstatat(dirfd, pathname, statbuf, flags);
+    count_fast(OP_STAT);
+    int ret = backdoor_fstatat(dirfd, pathname, statbuf, flags);
+    if (ret == 0 && status == OVERRIDE_FOUND) {
+      apply_override_to_stat(&override, statbuf);
+    }
+    return ret;
   }
 
+  count_slow(OP_STAT);
   if (g_abort_on_slow) {
     fprintf(stderr, "[fakefs %d] ABORT-ON-SLOW: fstatat(%d, \"%s\", 0x%x)\n",
             gettid(), dirfd, pathname, flags);
@@ -229,14 +577,23 @@ static int wrap_statx(int dirfd, const char *pathname, int flags,
     return -1;
   }
 
-  if (has_no_override(dirfd, pathname, flags)) {
+  struct override override;
+  enum override_status status =
+      read_override(dirfd, pathname, flags, &override);
+  if (status != OVERRIDE_UNKNOWN) {
     if (g_verbose) {
       fprintf(stderr, "[fakefs %d] fast: statx(%d, \"%s\", 0x%x, 0x%x)\n",
               gettid(), dirfd, pathname, flags, mask);
     }
-    return backdoor_statx(dirfd, pathname, flags, mask, statxbuf);
+    count_fast(OP_STATX);
+    int ret = backdoor_statx(dirfd, pathname, flags, mask, statxbuf);
+    if (ret == 0 && status == OVERRIDE_FOUND) {
+      apply_override_to_statx(&override, statxbuf);
+    }
+    return ret;
   }
 
+  count_slow(OP_STATX);
   if (g_abort_on_slow) {
     fprintf(stderr,
             "[fakefs %d] ABORT-ON-SLOW: statx(%d, \"%s\", 0x%x, 0x%x)\n",
@@ -246,6 +603,62 @@ static int wrap_statx(int dirfd, const char *pathname, int flags,
   return g_libc_statx(dirfd, pathname, flags, mask, statxbuf);
 }
 
+// Changes ownership of a file without ptrace if possible. It returns false if
+// the call needs to be processed by fakefs, e.g. to clear setuid bits or to
+// update the override database.
+// This function preserves `errno` if it returns false.
+static bool try_fast_fchownat(int dirfd, const char *pathname, uid_t owner,
+                              gid_t group, int flags, int *ret) {
+  int saved_errno = errno;
+  struct stat statbuf;
+  bool stat_ok = backdoor_fstatat(dirfd, pathname, &statbuf, flags) == 0;
+  errno = saved_errno;
+  if (!stat_ok) {
+    return false;
+  }
+
+  struct override override;
+  switch (read_override(dirfd, pathname, flags, &override)) {
+  case OVERRIDE_NONE:
+    override.uid = statbuf.st_uid;
+    override.gid = statbuf.st_gid;
+    break;
+  case OVERRIDE_FOUND:
+    if (override.mode != 0 || override.capability_size >= 0) {
+      return false;
+    }
+    break;
+  case OVERRIDE_UNKNOWN:
+    return false;
+  }
+  if (owner == (uid_t)-1) {
+    owner = override.uid;
+  }
+  if (group == (gid_t)-1) {
+    group = override.gid;
+  }
+
+  if (owner == statbuf.st_uid && group == statbuf.st_gid) {
+    if (!clear_override(dirfd, pathname, flags)) {
+      return false;
+    }
+    // Still call fchownat to update ctime.
+    *ret = backdoor_fchownat(dirfd, pathname, owner, group, flags);
+    return true;
+  }
+
+  // Unprivileged users can set xattrs only on regular files and directories.
+  if ((!S_ISREG(statbuf.st_mode) && !S_ISDIR(statbuf.st_mode)) ||
+      (statbuf.st_mode & (S_ISUID | S_ISGID)) != 0 || g_db_dir != NULL) {
+    return false;
+  }
+  if (!set_ownership_override(dirfd, pathname, flags, owner, group)) {
+    return false;
+  }
+  *ret = 0;
+  return true;
+}
+
 static int wrap_fchownat(int dirfd, const char *pathname, uid_t owner,
                          gid_t group, int flags) {
   if (pathname == NULL) {
@@ -253,18 +666,17 @@ static int wrap_fchownat(int dirfd, const char *pathname, uid_t owner,
     return -1;
   }
 
-  if (matches_original_ownership(dirfd, pathname, flags, owner, group)) {
-    if (clear_override(dirfd, pathname, flags)) {
-      if (g_verbose) {
-        fprintf(stderr,
-                "[fakefs %d] fast: fchownat(%d, \"%s\", %d, %d, 0x%x)\n",
-                gettid(), dirfd, pathname, owner, group, flags);
-      }
-      // Still call fchownat to update ctime.
-      return backdoor_fchownat(dirfd, pathname, owner, group, flags);
+  int ret;
+  if (try_fast_fchownat(dirfd, pathname, owner, group, flags, &ret)) {
+    if (g_verbose) {
+      fprintf(stderr, "[fakefs %d] fast: fchownat(%d, \"%s\", %d, %d, 0x%x)\n",
+              gettid(), dirfd, pathname, owner, group, flags);
     }
+    count_fast(OP_CHOWN);
+    return ret;
   }
 
+  count_slow(OP_CHOWN);
   if (g_abort_on_slow) {
     fprintf(stderr,
             "[fakefs %d] ABORT-ON-SLOW: fchownat(%d, \"%s\", %d, %d, 0x%x)\n",
@@ -293,9 +705,257 @@ static int wrap_fchmodat(int dirfd, const char *pathname, mode_t mode,
     errno = ENOTSUP;
     return -1;
   }
+
+  if (pathname == NULL) {
+    errno = EFAULT;
+    return -1;
+  }
+
+  // setuid/setgid/sticky bits are recorded in the override by fakefs.
+  if ((mode & 07000) == 0 && has_no_override(dirfd, pathname, flags)) {
+    if (g_verbose) {
+      fprintf(stderr, "[fakefs %d] fast: fchmodat(%d, \"%s\", 0%o, 0x%x)\n",
+              gettid(), dirfd, pathname, mode, flags);
+    }
+    count_fast(OP_CHMOD);
+    return backdoor_fchmodat(dirfd, pathname, mode);
+  }
+
+  count_slow(OP_CHMOD);
+  if (g_abort_on_slow) {
+    fprintf(stderr,
+            "[fakefs %d] ABORT-ON-SLOW: fchmodat(%d, \"%s\", 0%o, 0x%x)\n",
+            gettid(), dirfd, pathname, mode, flags);
+    abort();
+  }
   return g_libc_fchmodat(dirfd, pathname, mode, flags);
 }
 
+static int wrap_fchmod(int fd, mode_t mode) {
+  if ((mode & 07000) == 0 && has_no_override(fd, "", AT_EMPTY_PATH)) {
+    if (g_verbose) {
+      fprintf(stderr, "[fakefs %d] fast: fchmod(%d, 0%o)\n", gettid(), fd,
+              mode);
+    }
+    count_fast(OP_CHMOD);
+    return backdoor_fchmod(fd, mode);
+  }
+
+  count_slow(OP_CHMOD);
+  if (g_abort_on_slow) {
+    fprintf(stderr, "[fakefs %d] ABORT-ON-SLOW: fchmod(%d, 0%o)\n", gettid(),
+            fd, mode);
+    abort();
+  }
+  return g_libc_fchmod(fd, mode);
+}
+
+// Only security.capability is simulated by fakefs, so other xattrs can be read
+// directly.
+static bool is_simulated_xattr(const char *name) {
+  return name != NULL && strcmp(name, CAPABILITY_XATTR_NAME) == 0;
+}
+
+// Reads security.capability of a file with the override of the file. It
+// returns false if the call needs to be processed by fakefs.
+static bool try_fast_get_capability(const struct target *target, void *value,
+                                    size_t size, ssize_t *ret) {
+  struct override override;
+  switch (path_read_override(target->path, target->follow_symlink,
+                             &override)) {
+  case OVERRIDE_NONE:
+    break;
+  case OVERRIDE_FOUND:
+    if (override.capability_size >= 0) {
+      // If size is 0, getxattr(2) family returns the required size without
+      // storing results.
+      if (size == 0) {
+        *ret = override.capability_size;
+      } else if (size < (size_t)override.capability_size) {
+        errno = ERANGE;
+        *ret = -1;
+      } else {
+        for (ssize_t i = 0; i < override.capability_size; i++) {
+          ((unsigned char *)value)[i] = override.capability[i];
+        }
+        *ret = override.capability_size;
+      }
+      return true;
+    }
+    break;
+  case OVERRIDE_UNKNOWN:
+    return false;
+  }
+  // The file has no simulated capability, so read the real one.
+  *ret = backdoor_getxattr(target->path, CAPABILITY_XATTR_NAME, value, size,
+                           target->follow_symlink);
+  return true;
+}
+
+static ssize_t wrap_getxattr_at(int dirfd, const char *pathname, int flags,
+                                const char *name, void *value, size_t size) {
+  struct target target;
+  if (resolve_target(dirfd, pathname, flags, &target)) {
+    ssize_t ret;
+    bool ok = try_fast_get_capability(&target, value, size, &ret);
+    release_target(&target);
+    if (ok) {
+      if (g_verbose) {
+        fprintf(stderr, "[fakefs %d] fast: getxattr(%d, \"%s\", \"%s\")\n",
+                gettid(), dirfd, pathname, name);
+      }
+      count_fast(OP_GETXATTR);
+      return ret;
+    }
+  }
+
+  count_slow(OP_GETXATTR);
+  if (g_abort_on_slow) {
+    fprintf(stderr, "[fakefs %d] ABORT-ON-SLOW: getxattr(%d, \"%s\", \"%s\")\n",
+            gettid(), dirfd, pathname, name);
+    abort();
+  }
+  if ((flags & AT_EMPTY_PATH) != 0) {
+    return g_libc_fgetxattr(dirfd, name, value, size);
+  }
+  return ((flags & AT_SYMLINK_NOFOLLOW) != 0 ? g_libc_lgetxattr
+                                             : g_libc_getxattr)(
+      pathname, name, value, size);
+}
+
+static ssize_t wrap_getxattr(const char *pathname, const char *name,
+                             void *value, size_t size, bool follow_symlink) {
+  if (!is_simulated_xattr(name)) {
+    return backdoor_getxattr(pathname, name, value, size, follow_symlink);
+  }
+  if (pathname == NULL) {
+    errno = EFAULT;
+    return -1;
+  }
+  return wrap_getxattr_at(AT_FDCWD, pathname,
+                          follow_symlink ? 0 : AT_SYMLINK_NOFOLLOW, name, value,
+                          size);
+}
+
+static ssize_t wrap_fgetxattr(int fd, const char *name, void *value,
+                              size_t size) {
+  if (!is_simulated_xattr(name)) {
+    return backdoor_fgetxattr(fd, name, value, size);
+  }
+  return wrap_getxattr_at(fd, "", AT_EMPTY_PATH, name, value, size);
+}
+
+// Copies the xattr names in src to dst, hiding the override xattr and showing
+// the simulated security.capability instead of the real one if capability is
+// true. Keep this in sync with doListxattr in fsop/fsop.go.
+static ssize_t filter_xattr_list(const char *src, size_t src_size, char *dst,
+                                 size_t dst_size, bool capability) {
+  size_t len = 0;
+  for (size_t i = 0; i < src_size;) {
+    const char *key = &src[i];
+    size_t key_size = strlen(key) + 1;
+    i += key_size;
+    if (strcmp(key, OVERRIDE_XATTR_NAME) == 0 ||
+        (capability && strcmp(key, CAPABILITY_XATTR_NAME) == 0)) {
+      continue;
+    }
+    if (len + key_size > dst_size) {
+      errno = ERANGE;
+      return -1;
+    }
+    for (size_t j = 0; j < key_size; j++) {
+      dst[len++] = key[j];
+    }
+  }
+  if (capability) {
+    if (len + sizeof(CAPABILITY_XATTR_NAME) > dst_size) {
+      errno = ERANGE;
+      return -1;
+    }
+    for (size_t j = 0; j < sizeof(CAPABILITY_XATTR_NAME); j++) {
+      dst[len++] = CAPABILITY_XATTR_NAME[j];
+    }
+  }
+  return len;
+}
+
+// Lists xattrs of a file with the override of the file. It returns false if
+// the call needs to be processed by fakefs.
+static bool try_fast_listxattr(const struct target *target, char *list,
+                               size_t size, ssize_t *ret) {
+  struct override override;
+  switch (path_read_override(target->path, target->follow_symlink,
+                             &override)) {
+  case OVERRIDE_NONE:
+    *ret = backdoor_listxattr(target->path, list, size,
+                              target->follow_symlink);
+    return true;
+  case OVERRIDE_FOUND:
+    break;
+  case OVERRIDE_UNKNOWN:
+    return false;
+  }
+
+  ssize_t unfiltered_size =
+      backdoor_listxattr(target->path, NULL, 0, target->follow_symlink);
+  // If size is 0, listxattr(2) family returns the required size without
+  // storing results. The unfiltered size is still large enough since the
+  // simulated capability key is shorter than the override key it replaces.
+  if (unfiltered_size < 0 || size == 0) {
+    *ret = unfiltered_size;
+    return true;
+  }
+
+  char *unfiltered = malloc(unfiltered_size);
+  if (unfiltered == NULL) {
+    return false;
+  }
+  unfiltered_size = backdoor_listxattr(target->path, unfiltered,
+                                       unfiltered_size, target->follow_symlink);
+  if (unfiltered_size < 0) {
+    // xattrs may have been added concurrently.
+    free(unfiltered);
+    return false;
+  }
+  *ret = filter_xattr_list(unfiltered, unfiltered_size, list, size,
+                           override.capability_size >= 0);
+  free(unfiltered);
+  return true;
+}
+
+static ssize_t wrap_listxattr_at(int dirfd, const char *pathname, int flags,
+                                 char *list, size_t size) {
+  struct target target;
+  if (resolve_target(dirfd, pathname, flags, &target)) {
+    int saved_errno = errno;
+    ssize_t ret;
+    bool ok = try_fast_listxattr(&target, list, size, &ret);
+    release_target(&target);
+    if (ok) {
+      if (g_verbose) {
+        fprintf(stderr, "[fakefs %d] fast: listxattr(%d, \"%s\", 0x%x)\n",
+                gettid(), dirfd, pathname, flags);
+      }
+      count_fast(OP_LISTXATTR);
+      return ret;
+    }
+    errno = saved_errno;
+  }
+
+  count_slow(OP_LISTXATTR);
+  if (g_abort_on_slow) {
+    fprintf(stderr, "[fakefs %d] ABORT-ON-SLOW: listxattr(%d, \"%s\", 0x%x)\n",
+            gettid(), dirfd, pathname, flags);
+    abort();
+  }
+  if ((flags & AT_EMPTY_PATH) != 0) {
+    return g_libc_flistxattr(dirfd, list, size);
+  }
+  return ((flags & AT_SYMLINK_NOFOLLOW) != 0 ? g_libc_llistxattr
+                                             : g_libc_listxattr)(pathname, list,
+                                                                 size);
+}
+
 int __fakefs_stat(const char *pathname, struct stat *statbuf) {
   ensure_init();
   return wrap_fstatat(AT_FDCWD, pathname, statbuf, 0);
@@ -371,6 +1031,81 @@ int __fakefs_fchmodat(int dirfd, const char *pathname, mode_t mode, int flags) {
   return wrap_fchmodat(dirfd, pathname, mode, flags);
 }
 
+int __fakefs_chmod(const char *pathname, mode_t mode) {
+  ensure_init();
+  return wrap_fchmodat(AT_FDCWD, pathname, mode, 0);
+}
+
+int __fakefs_fchmod(int fd, mode_t mode) {
+  ensure_init();
+  return wrap_fchmod(fd, mode);
+}
+
+ssize_t __fakefs_getxattr(const char *pathname, const char *name, void *value,
+                          size_t size) {
+  ensure_init();
+  return wrap_getxattr(pathname, name, value, size, true);
+}
+
+ssize_t __fakefs_lgetxattr(const char *pathname, const char *name, void *value,
+                           size_t size) {
+  ensure_init();
+  return wrap_getxattr(pathname, name, value, size, false);
+}
+
+ssize_t __fakefs_fgetxattr(int fd, const char *name, void *value, size_t size) {
+  ensure_init();
+  return wrap_fgetxattr(fd, name, value, size);
+}
+
+ssize_t __fakefs_listxattr(const char *pathname, char *list, size_t size) {
+  ensure_init();
+  if (pathname == NULL) {
+    errno = EFAULT;
+    return -1;
+  }
+  return wrap_listxattr_at(AT_FDCWD, pathname, 0, list, size);
+}
+
+ssize_t __fakefs_llistxattr(const char *pathname, char *list, size_t size) {
+  ensure_init();
+  if (pathname == NULL) {
+    errno = EFAULT;
+    return -1;
+  }
+  return wrap_listxattr_at(AT_FDCWD, pathname, AT_SYMLINK_NOFOLLOW, list,
+                           size);
+}
+
+ssize_t __fakefs_flistxattr(int fd, char *list, size_t size) {
+  ensure_init();
+  return wrap_listxattr_at(fd, "", AT_EMPTY_PATH, list, size);
+}
+
+// Binaries built against glibc older than 2.33 call the following functions
+// instead of stat(2) family. `ver` selects the layout of struct stat, which
+// is the same as the current one on supported architectures.
+int __fakefs_xstat(int ver, const char *pathname, struct stat *statbuf) {
+  ensure_init();
+  return wrap_fstatat(AT_FDCWD, pathname, statbuf, 0);
+}
+
+int __fakefs_lxstat(int ver, const char *pathname, struct stat *statbuf) {
+  ensure_init();
+  return wrap_fstatat(AT_FDCWD, pathname, statbuf, AT_SYMLINK_NOFOLLOW);
+}
+
+int __fakefs_fxstat(int ver, int fd, struct stat *statbuf) {
+  ensure_init();
+  return wrap_fstatat(fd, "", statbuf, AT_EMPTY_PATH);
+}
+
+int __fakefs_fxstatat(int ver, int dirfd, const char *pathname,
+                      struct stat *statbuf, int flags) {
+  ensure_init();
+  return wrap_fstatat(dirfd, pathname, statbuf, flags);
+}
+
 // Define libc intercepting symbols as aliases.
 // Implementing them directly can lead to incorrect compiler optimizations
 // because prototype declarations of these functions in the standard library
@@ -405,3 +1140,35 @@ int fchownat(int dirfd, const char *pathname, uid_t owner, gid_t group,
              int flags) __attribute__((alias("__fakefs_fchownat")));
 int fchmodat(int dirfd, const char *pathname, mode_t mode, int flags)
     __attribute__((alias("__fakefs_fchmodat")));
+int chmod(const char *pathname, mode_t mode)
+    __attribute__((alias("__fakefs_chmod")));
+int fchmod(int fd, mode_t mode) __attribute__((alias("__fakefs_fchmod")));
+ssize_t getxattr(const char *pathname, const char *name, void *value,
+                 size_t size) __attribute__((alias("__fakefs_getxattr")));
+ssize_t lgetxattr(const char *pathname, const char *name, void *value,
+                  size_t size) __attribute__((alias("__fakefs_lgetxattr")));
+ssize_t fgetxattr(int fd, const char *name, void *value, size_t size)
+    __attribute__((alias("__fakefs_fgetxattr")));
+ssize_t listxattr(const char *pathname, char *list, size_t size)
+    __attribute__((alias("__fakefs_listxattr")));
+ssize_t llistxattr(const char *pathname, char *list, size_t size)
+    __attribute__((alias("__fakefs_llistxattr")));
+ssize_t flistxattr(int fd, char *list, size_t size)
+    __attribute__((alias("__fakefs_flistxattr")));
+int __xstat(int ver, const char *pathname, struct stat *statbuf)
+    __attribute__((alias("__fakefs_xstat")));
+int __xstat64(int ver, const char *pathname, struct stat64 *statbuf)
+    __attribute__((alias("__fakefs_xstat")));
+int __lxstat(int ver, const char *pathname, struct stat *statbuf)
+    __attribute__((alias("__fakefs_lxstat")));
+int __lxstat64(int ver, const char *pathname, struct stat64 *statbuf)
+    __attribute__((alias("__fakefs_lxstat")));
+int __fxstat(int ver, int fd, struct stat *statbuf)
+    __attribute__((alias("__fakefs_fxstat")));
+int __fxstat64(int ver, int fd, struct stat64 *statbuf)
+    __attribute__((alias("__fakefs_fxstat")));
+int __fxstatat(int ver, int dirfd, const char *pathname, struct stat *statbuf,
+               int flags) __attribute__((alias("__fakefs_fxstatat")));
+int __fxstatat64(int ver, int dirfd, const char *pathname,
+                 struct stat64 *statbuf, int flags)
+    __attribute__((alias("__fakefs_fxstatat")));
@@ -4,7 +4,11 @@
 
 package ptracearch
 
-import "golang.org/x/sys/unix"
+import (
+	"math"
+
+	"golang.org/x/sys/unix"
+)
 
 type Regs = unix.PtraceRegsAmd64
 
@@ -15,3 +19,26 @@ func GetRegs(tid int, regs *Regs) error {
 func SetRegs(tid int, regs *Regs) error {
 	return unix.PtraceSetRegsAmd64(tid, regs)
 }
+
+// SyscallNumber returns the number of the system call a thread is stopped at.
+func SyscallNumber(regs *Regs) uint64 {
+	return regs.Orig_rax
+}
+
+// SkipSyscall makes the system call a thread is stopped at fail with ENOSYS
+// without running it.
+func SkipSyscall(tid int, regs *Regs) error {
+	// Set the syscall number to -1, which should always fail with ENOSYS.
+	regs.Orig_rax = math.MaxUint64
+	return SetRegs(tid, regs)
+}
+
+// SetReturnValue sets the return value of a system call to regs.
+func SetReturnValue(regs *Regs, ret uint64) {
+	regs.Rax = ret
+}
+
+// ReturnValue returns the return value of a system call from regs.
+func ReturnValue(regs *Regs) uint64 {
+	return regs.Rax
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package ptracearch
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type Regs = unix.PtraceRegsArm64
+
+// Register set types for PTRACE_GETREGSET/PTRACE_SETREGSET.
+// See include/uapi/linux/elf.h.
+const (
+	ntPrstatus      = 1
+	ntArmSystemCall = 0x404
+)
+
+// arm64 doesn't support PTRACE_GETREGS/PTRACE_SETREGS, so use
+// PTRACE_GETREGSET/PTRACE_SETREGSET instead.
+
+func GetRegs(tid int, regs *Regs) error {
+	return unix.PtraceGetRegSetArm64(tid, ntPrstatus, regs)
+}
+
+func SetRegs(tid int, regs *Regs) error {
+	return unix.PtraceSetRegSetArm64(tid, ntPrstatus, regs)
+}
+
+// SyscallNumber returns the number of the system call a thread is stopped at.
+func SyscallNumber(regs *Regs) uint64 {
+	return regs.Regs[8]
+}
+
+// SkipSyscall makes the system call a thread is stopped at fail with ENOSYS
+// without running it.
+func SkipSyscall(tid int, regs *Regs) error {
+	// Changing x8 has no effect on the system call to run. The system call
+	// number has to be updated with NT_ARM_SYSTEM_CALL instead.
+	nr := int32(-1)
+	iov := unix.Iovec{Base: (*byte)(unsafe.Pointer(&nr)), Len: uint64(unsafe.Sizeof(nr))}
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SETREGSET, uintptr(tid), ntArmSystemCall, uintptr(unsafe.Pointer(&iov)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// SetReturnValue sets the return value of a system call to regs.
+func SetReturnValue(regs *Regs, ret uint64) {
+	regs.Regs[0] = ret
+}
+
+// ReturnValue returns the return value of a system call from regs.
+func ReturnValue(regs *Regs) uint64 {
+	return regs.Regs[0]
+}
@@ -101,3 +101,145 @@ type FlistxattrArgs struct {
 	List uintptr
 	Size int
 }
+
+// MknodArgs contains arguments to mknod(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type MknodArgs struct {
+	Filename uintptr
+	Mode     uint32
+	Dev      uint64
+}
+
+// MknodatArgs contains arguments to mknodat(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type MknodatArgs struct {
+	Dfd      int
+	Filename uintptr
+	Mode     uint32
+	Dev      uint64
+}
+
+// ChmodArgs contains arguments to chmod(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/open.c
+type ChmodArgs struct {
+	Filename uintptr
+	Mode     uint32
+}
+
+// FchmodArgs contains arguments to fchmod(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/open.c
+type FchmodArgs struct {
+	Fd   int
+	Mode uint32
+}
+
+// FchmodatArgs contains arguments to fchmodat(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/open.c
+type FchmodatArgs struct {
+	Dfd      int
+	Filename uintptr
+	Mode     uint32
+}
+
+// SetxattrArgs contains arguments to setxattr(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/xattr.c
+type SetxattrArgs struct {
+	Pathname uintptr
+	Name     uintptr
+	Value    uintptr
+	Size     int
+	Flags    int
+}
+
+// LsetxattrArgs contains arguments to lsetxattr(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/xattr.c
+type LsetxattrArgs struct {
+	Pathname uintptr
+	Name     uintptr
+	Value    uintptr
+	Size     int
+	Flags    int
+}
+
+// FsetxattrArgs contains arguments to fsetxattr(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/xattr.c
+type FsetxattrArgs struct {
+	Fd    int
+	Name  uintptr
+	Value uintptr
+	Size  int
+	Flags int
+}
+
+// GetxattrArgs contains arguments to getxattr(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/xattr.c
+type GetxattrArgs struct {
+	Pathname uintptr
+	Name     uintptr
+	Value    uintptr
+	Size     int
+}
+
+// LgetxattrArgs contains arguments to lgetxattr(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/xattr.c
+type LgetxattrArgs struct {
+	Pathname uintptr
+	Name     uintptr
+	Value    uintptr
+	Size     int
+}
+
+// FgetxattrArgs contains arguments to fgetxattr(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/xattr.c
+type FgetxattrArgs struct {
+	Fd    int
+	Name  uintptr
+	Value uintptr
+	Size  int
+}
+
+// UnlinkArgs contains arguments to unlink(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type UnlinkArgs struct {
+	Pathname uintptr
+}
+
+// RmdirArgs contains arguments to rmdir(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type RmdirArgs struct {
+	Pathname uintptr
+}
+
+// UnlinkatArgs contains arguments to unlinkat(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type UnlinkatArgs struct {
+	Dfd      int
+	Pathname uintptr
+	Flag     int
+}
+
+// RenameArgs contains arguments to rename(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type RenameArgs struct {
+	Oldname uintptr
+	Newname uintptr
+}
+
+// RenameatArgs contains arguments to renameat(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type RenameatArgs struct {
+	Olddfd  int
+	Oldname uintptr
+	Newdfd  int
+	Newname uintptr
+}
+
+// Renameat2Args contains arguments to renameat2(2).
+// https://source.chromium.org/chromiumos/chromiumos/codesearch/+/main:src/third_party/kernel/v5.15/fs/namei.c
+type Renameat2Args struct {
+	Olddfd  int
+	Oldname uintptr
+	Newdfd  int
+	Newname uintptr
+	Flags   int
+}
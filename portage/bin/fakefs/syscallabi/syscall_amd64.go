@@ -55,3 +55,71 @@ func ParseLlistxattrArgs(regs *ptracearch.Regs) LlistxattrArgs {
 func ParseFlistxattrArgs(regs *ptracearch.Regs) FlistxattrArgs {
 	return FlistxattrArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), int(regs.Rdx)}
 }
+
+func ParseMknodArgs(regs *ptracearch.Regs) MknodArgs {
+	return MknodArgs{uintptr(regs.Rdi), uint32(regs.Rsi), uint64(uint32(regs.Rdx))}
+}
+
+func ParseMknodatArgs(regs *ptracearch.Regs) MknodatArgs {
+	return MknodatArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), uint32(regs.Rdx), uint64(uint32(regs.R10))}
+}
+
+func ParseChmodArgs(regs *ptracearch.Regs) ChmodArgs {
+	return ChmodArgs{uintptr(regs.Rdi), uint32(regs.Rsi)}
+}
+
+func ParseFchmodArgs(regs *ptracearch.Regs) FchmodArgs {
+	return FchmodArgs{int(int32(regs.Rdi)), uint32(regs.Rsi)}
+}
+
+func ParseFchmodatArgs(regs *ptracearch.Regs) FchmodatArgs {
+	return FchmodatArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), uint32(regs.Rdx)}
+}
+
+func ParseSetxattrArgs(regs *ptracearch.Regs) SetxattrArgs {
+	return SetxattrArgs{uintptr(regs.Rdi), uintptr(regs.Rsi), uintptr(regs.Rdx), int(regs.R10), int(int32(regs.R8))}
+}
+
+func ParseLsetxattrArgs(regs *ptracearch.Regs) LsetxattrArgs {
+	return LsetxattrArgs{uintptr(regs.Rdi), uintptr(regs.Rsi), uintptr(regs.Rdx), int(regs.R10), int(int32(regs.R8))}
+}
+
+func ParseFsetxattrArgs(regs *ptracearch.Regs) FsetxattrArgs {
+	return FsetxattrArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), uintptr(regs.Rdx), int(regs.R10), int(int32(regs.R8))}
+}
+
+func ParseGetxattrArgs(regs *ptracearch.Regs) GetxattrArgs {
+	return GetxattrArgs{uintptr(regs.Rdi), uintptr(regs.Rsi), uintptr(regs.Rdx), int(regs.R10)}
+}
+
+func ParseLgetxattrArgs(regs *ptracearch.Regs) LgetxattrArgs {
+	return LgetxattrArgs{uintptr(regs.Rdi), uintptr(regs.Rsi), uintptr(regs.Rdx), int(regs.R10)}
+}
+
+func ParseFgetxattrArgs(regs *ptracearch.Regs) FgetxattrArgs {
+	return FgetxattrArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), uintptr(regs.Rdx), int(regs.R10)}
+}
+
+func ParseUnlinkArgs(regs *ptracearch.Regs) UnlinkArgs {
+	return UnlinkArgs{uintptr(regs.Rdi)}
+}
+
+func ParseRmdirArgs(regs *ptracearch.Regs) RmdirArgs {
+	return RmdirArgs{uintptr(regs.Rdi)}
+}
+
+func ParseUnlinkatArgs(regs *ptracearch.Regs) UnlinkatArgs {
+	return UnlinkatArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), int(int32(regs.Rdx))}
+}
+
+func ParseRenameArgs(regs *ptracearch.Regs) RenameArgs {
+	return RenameArgs{uintptr(regs.Rdi), uintptr(regs.Rsi)}
+}
+
+func ParseRenameatArgs(regs *ptracearch.Regs) RenameatArgs {
+	return RenameatArgs{int(int32(regs.Rdi)), uintptr(regs.Rsi), int(int32(regs.Rdx)), uintptr(regs.R10)}
+}
+
+func ParseRenameat2Args(regs *ptracearch.Regs) Renameat2Args {
+	return Renameat2Args{int(int32(regs.Rdi)), uintptr(regs.Rsi), int(int32(regs.Rdx)), uintptr(regs.R10), int(int32(regs.R8))}
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package syscallabi
+
+import "cros.local/bazel/portage/bin/fakefs/ptracearch"
+
+// See man 2 syscall for the system call calling convention.
+//
+// arm64 uses the generic system call table, which lacks legacy system calls
+// taking no directory file descriptor, such as stat(2) and chown(2).
+
+func ParseFstatArgs(regs *ptracearch.Regs) FstatArgs {
+	return FstatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1])}
+}
+
+func ParseNewfstatatArgs(regs *ptracearch.Regs) NewfstatatArgs {
+	return NewfstatatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(int32(regs.Regs[3]))}
+}
+
+func ParseStatxArgs(regs *ptracearch.Regs) StatxArgs {
+	return StatxArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), int(int32(regs.Regs[2])), int(int32(regs.Regs[3])), uintptr(regs.Regs[4])}
+}
+
+func ParseFchownArgs(regs *ptracearch.Regs) FchownArgs {
+	return FchownArgs{int(int32(regs.Regs[0])), int(int32(regs.Regs[1])), int(int32(regs.Regs[2]))}
+}
+
+func ParseFchownatArgs(regs *ptracearch.Regs) FchownatArgs {
+	return FchownatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), int(int32(regs.Regs[2])), int(int32(regs.Regs[3])), int(int32(regs.Regs[4]))}
+}
+
+func ParseListxattrArgs(regs *ptracearch.Regs) ListxattrArgs {
+	return ListxattrArgs{uintptr(regs.Regs[0]), uintptr(regs.Regs[1]), int(regs.Regs[2])}
+}
+
+func ParseLlistxattrArgs(regs *ptracearch.Regs) LlistxattrArgs {
+	return LlistxattrArgs{uintptr(regs.Regs[0]), uintptr(regs.Regs[1]), int(regs.Regs[2])}
+}
+
+func ParseFlistxattrArgs(regs *ptracearch.Regs) FlistxattrArgs {
+	return FlistxattrArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), int(regs.Regs[2])}
+}
+
+func ParseMknodatArgs(regs *ptracearch.Regs) MknodatArgs {
+	return MknodatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), uint32(regs.Regs[2]), uint64(uint32(regs.Regs[3]))}
+}
+
+func ParseFchmodArgs(regs *ptracearch.Regs) FchmodArgs {
+	return FchmodArgs{int(int32(regs.Regs[0])), uint32(regs.Regs[1])}
+}
+
+func ParseFchmodatArgs(regs *ptracearch.Regs) FchmodatArgs {
+	return FchmodatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), uint32(regs.Regs[2])}
+}
+
+func ParseSetxattrArgs(regs *ptracearch.Regs) SetxattrArgs {
+	return SetxattrArgs{uintptr(regs.Regs[0]), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(regs.Regs[3]), int(int32(regs.Regs[4]))}
+}
+
+func ParseLsetxattrArgs(regs *ptracearch.Regs) LsetxattrArgs {
+	return LsetxattrArgs{uintptr(regs.Regs[0]), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(regs.Regs[3]), int(int32(regs.Regs[4]))}
+}
+
+func ParseFsetxattrArgs(regs *ptracearch.Regs) FsetxattrArgs {
+	return FsetxattrArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(regs.Regs[3]), int(int32(regs.Regs[4]))}
+}
+
+func ParseGetxattrArgs(regs *ptracearch.Regs) GetxattrArgs {
+	return GetxattrArgs{uintptr(regs.Regs[0]), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(regs.Regs[3])}
+}
+
+func ParseLgetxattrArgs(regs *ptracearch.Regs) LgetxattrArgs {
+	return LgetxattrArgs{uintptr(regs.Regs[0]), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(regs.Regs[3])}
+}
+
+func ParseFgetxattrArgs(regs *ptracearch.Regs) FgetxattrArgs {
+	return FgetxattrArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), uintptr(regs.Regs[2]), int(regs.Regs[3])}
+}
+
+func ParseUnlinkatArgs(regs *ptracearch.Regs) UnlinkatArgs {
+	return UnlinkatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), int(int32(regs.Regs[2]))}
+}
+
+func ParseRenameatArgs(regs *ptracearch.Regs) RenameatArgs {
+	return RenameatArgs{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), int(int32(regs.Regs[2])), uintptr(regs.Regs[3])}
+}
+
+func ParseRenameat2Args(regs *ptracearch.Regs) Renameat2Args {
+	return Renameat2Args{int(int32(regs.Regs[0])), uintptr(regs.Regs[1]), int(int32(regs.Regs[2])), uintptr(regs.Regs[3]), int(int32(regs.Regs[4]))}
+}
@@ -5,10 +5,12 @@
 #define _GNU_SOURCE
 #include <errno.h>
 #include <fcntl.h>
+#include <stdbool.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
 #include <sys/stat.h>
+#include <sys/xattr.h>
 #include <unistd.h>
 
 // Calls fstatat with AT_EMPTY_PATH.
@@ -80,6 +82,44 @@ int fchmodat_stub(void) {
   return EXIT_SUCCESS;
 }
 
+// Sets security.capability of a file, and prints its value read back in hex
+// followed by whether listxattr reports it.
+int set_capability(const char *path) {
+  // A VFS_CAP_REVISION_2 value granting CAP_NET_RAW in the permitted set.
+  static const unsigned char cap[20] = {0x00, 0x00, 0x00, 0x02, 0x00,
+                                        0x20, 0x00, 0x00};
+  if (setxattr(path, "security.capability", cap, sizeof(cap), 0) < 0) {
+    perror("setxattr");
+    return EXIT_FAILURE;
+  }
+
+  unsigned char value[64];
+  ssize_t size = getxattr(path, "security.capability", value, sizeof(value));
+  if (size < 0) {
+    perror("getxattr");
+    return EXIT_FAILURE;
+  }
+  for (ssize_t i = 0; i < size; i++) {
+    printf("%02x", value[i]);
+  }
+  printf("\n");
+
+  char keys[1024];
+  ssize_t keys_size = listxattr(path, keys, sizeof(keys));
+  if (keys_size < 0) {
+    perror("listxattr");
+    return EXIT_FAILURE;
+  }
+  bool listed = false;
+  for (char *key = keys; key < keys + keys_size; key += strlen(key) + 1) {
+    if (strcmp(key, "security.capability") == 0) {
+      listed = true;
+    }
+  }
+  printf("%s\n", listed ? "listed" : "not listed");
+  return EXIT_SUCCESS;
+}
+
 int main(int argc, char **argv) {
   if (argc < 2) {
     fprintf(stderr, "testhelper: needs arguments\n");
@@ -113,6 +153,13 @@ int main(int argc, char **argv) {
     }
     return fchmodat_stub();
   }
+  if (strcmp(argv[1], "set-capability") == 0) {
+    if (argc != 3) {
+      fprintf(stderr, "testhelper: set-capability: needs exactly 1 path\n");
+      return EXIT_FAILURE;
+    }
+    return set_capability(argv[2]);
+  }
   fprintf(stderr, "testhelper: unknown subcommand %s\n", argv[1]);
   return EXIT_FAILURE;
 }
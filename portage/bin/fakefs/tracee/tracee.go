@@ -17,8 +17,8 @@ import (
 	"cros.local/bazel/portage/bin/fakefs/hooks"
 )
 
-func setUpSeccompBPF() error {
-	program, err := hooks.SeccompBPF()
+func setUpSeccompBPF(useDB bool) error {
+	program, err := hooks.SeccompBPF(useDB)
 	if err != nil {
 		return err
 	}
@@ -54,8 +54,10 @@ func setUpSeccompBPF() error {
 	return nil
 }
 
-func Run(args []string) error {
-	if err := setUpSeccompBPF(); err != nil {
+// Run sets up system call interception and executes args. useDB should be
+// true if overrides are stored in a database.
+func Run(args []string, useDB bool) error {
+	if err := setUpSeccompBPF(useDB); err != nil {
 		return err
 	}
 
@@ -7,13 +7,13 @@ package tracer
 import (
 	"sort"
 
-	"golang.org/x/sys/unix"
+	"cros.local/bazel/portage/bin/fakefs/ptracearch"
 )
 
 type threadState struct {
 	Tid             int
 	Pid             int
-	SyscallExitHook func(regs *unix.PtraceRegsAmd64)
+	SyscallExitHook func(regs *ptracearch.Regs)
 }
 
 type threadStateIndex struct {
@@ -18,7 +18,7 @@ import (
 	"cros.local/bazel/portage/bin/fakefs/ptracearch"
 )
 
-func startTracee(args []string, preloadPath string, verbose bool) (pid int, err error) {
+func startTracee(args []string, preloadPath string, verbose bool, dbDir string) (pid int, err error) {
 	// Ensure the preload library exists first.
 	if preloadPath != "" {
 		if _, err := os.Stat(preloadPath); err != nil {
@@ -44,6 +44,10 @@ func startTracee(args []string, preloadPath string, verbose bool) (pid int, err
 	if verbose {
 		cmd.Env = append(cmd.Env, "FAKEFS_VERBOSE=1")
 	}
+	if dbDir != "" {
+		// Let libfakefs_preload.so look up overrides in the database.
+		cmd.Env = append(cmd.Env, fmt.Sprintf("FAKEFS_DB=%s", dbDir))
+	}
 	if err := cmd.Start(); err != nil {
 		return 0, err
 	}
@@ -223,14 +227,14 @@ func processStop(thread *threadState, ws unix.WaitStatus, index *threadStateInde
 	return continueActionInject, nil
 }
 
-func Run(origArgs, args []string, preloadPath string, verbose bool) error {
+func Run(origArgs, args []string, preloadPath string, verbose bool, dbDir string) error {
 	if hooks.IsFakefsRunning() {
 		return errors.New("nested fakefs is not supported")
 	}
 
 	logger := logging.NewLogger(verbose, args)
 
-	rootPid, err := startTracee(origArgs, preloadPath, verbose)
+	rootPid, err := startTracee(origArgs, preloadPath, verbose, dbDir)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,284 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Result};
+use durabletree::DurableTree;
+use fileutil::glob_match;
+use itertools::Itertools;
+use std::{
+    collections::{BTreeMap, BTreeSet, HashMap},
+    fmt::Write,
+    os::unix::{ffi::OsStrExt, fs::FileTypeExt},
+    path::{Path, PathBuf},
+};
+use walkdir::WalkDir;
+
+/// Detects files installed by multiple packages, or over files in the base
+/// layers, like Portage's collision-protect feature.
+///
+/// Directories can be shared among packages, so only non-directory files are
+/// considered.
+#[derive(Debug, Default)]
+pub struct CollisionChecker {
+    owners: HashMap<PathBuf, String>,
+    collisions: BTreeMap<PathBuf, BTreeSet<String>>,
+    root_dir: PathBuf,
+    ignore_patterns: Vec<String>,
+}
+
+impl CollisionChecker {
+    /// Creates a checker that ignores files matching any of the given
+    /// patterns, like Portage's COLLISION_IGNORE and INSTALL_MASK.
+    ///
+    /// Patterns are matched against paths relative to `root_dir`. A pattern
+    /// matches a path if it is equal to the path or one of its parent
+    /// directories, or if it matches the path as a shell glob.
+    pub fn new(root_dir: &Path, ignore_patterns: Vec<String>) -> Self {
+        Self {
+            root_dir: root_dir.to_owned(),
+            ignore_patterns,
+            ..Self::default()
+        }
+    }
+
+    fn is_ignored(&self, path: &Path) -> bool {
+        if self.ignore_patterns.is_empty() {
+            return false;
+        }
+        let Ok(rel_path) = path.strip_prefix(&self.root_dir) else {
+            return false;
+        };
+        let path = Path::new("/").join(rel_path);
+        let path = path.as_os_str().as_bytes();
+        self.ignore_patterns.iter().any(|pattern| {
+            let pattern = pattern.trim_end_matches('/').as_bytes();
+            (path.starts_with(pattern)
+                && (path.len() == pattern.len() || path[pattern.len()] == b'/'))
+                || glob_match(pattern, path)
+        })
+    }
+
+    /// Records files under the root directory in a base layer that packages
+    /// are installed on top of, e.g. the SDK. Base layers must be added in the
+    /// mount order before package layers. Collisions among base layers are not
+    /// reported.
+    ///
+    /// Tarball layers are not inspected.
+    pub fn add_base_layer(&mut self, layer: &Path) -> Result<()> {
+        if !layer.is_dir() {
+            return Ok(());
+        }
+        let owner = format!("base layer {}", layer.display());
+        if DurableTree::try_exists(layer)? {
+            let tree = DurableTree::expand(layer)?;
+            for layer_dir in tree.layers() {
+                self.add_base_files(layer_dir, &owner)?;
+            }
+        } else {
+            self.add_base_files(layer, &owner)?;
+        }
+        Ok(())
+    }
+
+    fn add_base_files(&mut self, layer_dir: &Path, owner: &str) -> Result<()> {
+        let root_dir = layer_dir.join(self.root_dir.strip_prefix("/")?);
+        if !root_dir.is_dir() {
+            return Ok(());
+        }
+        for entry in WalkDir::new(&root_dir) {
+            let entry = entry?;
+            let file_type = entry.file_type();
+            if file_type.is_dir() {
+                continue;
+            }
+            let path = Path::new("/").join(entry.path().strip_prefix(layer_dir)?);
+            // Character devices are whiteouts hiding files in lower layers.
+            if file_type.is_char_device() {
+                self.owners.remove(&path);
+            } else if !self.is_ignored(&path) {
+                self.owners.insert(path, owner.to_owned());
+            }
+        }
+        Ok(())
+    }
+
+    /// Records files in an installed contents layer saved as a durable tree.
+    pub fn add_durable_tree(&mut self, dir: &Path, owner: &str) -> Result<()> {
+        let tree = DurableTree::expand(dir)?;
+        for layer_dir in tree.layers() {
+            self.add_layer(layer_dir, owner)?;
+        }
+        Ok(())
+    }
+
+    /// Records files in a plain layer directory.
+    pub fn add_layer(&mut self, layer_dir: &Path, owner: &str) -> Result<()> {
+        for entry in WalkDir::new(layer_dir).min_depth(1) {
+            let entry = entry?;
+            let file_type = entry.file_type();
+            // Character devices are whiteouts, which are never contained in
+            // package contents.
+            if file_type.is_dir() || file_type.is_char_device() {
+                continue;
+            }
+            let path = Path::new("/").join(entry.path().strip_prefix(layer_dir)?);
+            if self.is_ignored(&path) {
+                continue;
+            }
+            match self.owners.get(&path) {
+                None => {
+                    self.owners.insert(path, owner.to_owned());
+                }
+                Some(first_owner) if first_owner == owner => {}
+                Some(first_owner) => {
+                    self.collisions
+                        .entry(path)
+                        .or_insert_with(|| BTreeSet::from([first_owner.clone()]))
+                        .insert(owner.to_owned());
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Fails with a report if any file was installed by multiple packages.
+    pub fn check(&self) -> Result<()> {
+        if self.collisions.is_empty() {
+            return Ok(());
+        }
+        let mut report = String::new();
+        for (path, owners) in &self.collisions {
+            writeln!(
+                &mut report,
+                "  {}: {}",
+                path.display(),
+                owners.iter().join(", ")
+            )?;
+        }
+        bail!(
+            "Detected {} file(s) installed by multiple packages:\n{}",
+            self.collisions.len(),
+            report
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use fileutil::SafeTempDir;
+
+    fn make_layer(files: &[&str]) -> Result<SafeTempDir> {
+        let dir = SafeTempDir::new()?;
+        for file in files {
+            let path = dir.path().join(file);
+            std::fs::create_dir_all(path.parent().unwrap())?;
+            std::fs::write(path, "")?;
+        }
+        Ok(dir)
+    }
+
+    #[test]
+    fn test_no_collisions() -> Result<()> {
+        let foo = make_layer(&["usr/bin/foo", "usr/share/doc/foo/README"])?;
+        let bar = make_layer(&["usr/bin/bar", "usr/share/doc/bar/README"])?;
+
+        let mut checker = CollisionChecker::new(Path::new("/"), vec![]);
+        checker.add_layer(foo.path(), "sys-apps/foo-1.0")?;
+        checker.add_layer(bar.path(), "sys-apps/bar-1.0")?;
+        // The same package may have the same file in multiple layers.
+        checker.add_layer(bar.path(), "sys-apps/bar-1.0")?;
+        checker.check()
+    }
+
+    #[test]
+    fn test_collisions() -> Result<()> {
+        let foo = make_layer(&["usr/bin/foo", "usr/bin/common"])?;
+        let bar = make_layer(&["usr/bin/bar", "usr/bin/common"])?;
+        let baz = make_layer(&["usr/bin/baz", "usr/bin/common", "usr/bin/bar"])?;
+
+        let mut checker = CollisionChecker::new(Path::new("/"), vec![]);
+        checker.add_layer(foo.path(), "sys-apps/foo-1.0")?;
+        checker.add_layer(bar.path(), "sys-apps/bar-1.0")?;
+        checker.add_layer(baz.path(), "sys-apps/baz-1.0")?;
+
+        let err = checker.check().unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Detected 2 file(s) installed by multiple packages:
+  /usr/bin/bar: sys-apps/bar-1.0, sys-apps/baz-1.0
+  /usr/bin/common: sys-apps/bar-1.0, sys-apps/baz-1.0, sys-apps/foo-1.0
+"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_base_layers() -> Result<()> {
+        let sdk = make_layer(&["etc/passwd", "build/foo/etc/make.conf"])?;
+        let update = make_layer(&["build/foo/usr/bin/tool"])?;
+        let foo = make_layer(&[
+            "etc/passwd",
+            "build/foo/etc/make.conf",
+            "build/foo/usr/bin/tool",
+        ])?;
+
+        let mut checker = CollisionChecker::new(Path::new("/build/foo"), vec![]);
+        checker.add_base_layer(sdk.path())?;
+        checker.add_base_layer(update.path())?;
+        checker.add_layer(foo.path(), "sys-apps/foo-1.0")?;
+
+        // /etc/passwd is out of the root directory, so it is not recorded.
+
+        let err = checker.check().unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            format!(
+                "Detected 2 file(s) installed by multiple packages:
+  /build/foo/etc/make.conf: base layer {}, sys-apps/foo-1.0
+  /build/foo/usr/bin/tool: base layer {}, sys-apps/foo-1.0
+",
+                sdk.path().display(),
+                update.path().display()
+            )
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_ignore_patterns() -> Result<()> {
+        let foo = make_layer(&[
+            "build/foo/usr/bin/common",
+            "build/foo/usr/lib/debug/common.debug",
+            "build/foo/usr/share/info/dir",
+            "build/foo/usr/share/man/man1/common.1",
+        ])?;
+        let bar = make_layer(&[
+            "build/foo/usr/bin/common",
+            "build/foo/usr/lib/debug/common.debug",
+            "build/foo/usr/share/info/dir",
+            "build/foo/usr/share/man/man1/common.1",
+        ])?;
+
+        let mut checker = CollisionChecker::new(
+            Path::new("/build/foo"),
+            vec![
+                "/usr/lib/debug/".to_owned(),
+                "/usr/share/info/dir".to_owned(),
+                "/usr/share/man/man[0-9]/*.1".to_owned(),
+            ],
+        );
+        checker.add_layer(foo.path(), "sys-apps/foo-1.0")?;
+        checker.add_layer(bar.path(), "sys-apps/bar-1.0")?;
+
+        let err = checker.check().unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Detected 1 file(s) installed by multiple packages:
+  /build/foo/usr/bin/common: sys-apps/bar-1.0, sys-apps/foo-1.0
+"
+        );
+        Ok(())
+    }
+}
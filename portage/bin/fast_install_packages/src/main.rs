@@ -2,12 +2,17 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
+mod collision;
+mod plan;
+mod sysroot_check;
+
 use anyhow::{bail, ensure, Context, Error, Result};
 use binarypackage::BinaryPackage;
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use container::{
-    enter_mount_namespace, BindMount, CommonArgs, ContainerSettings, PreparedContainer,
+    enter_mount_namespace, BindMount, CommonArgs, ContainerSettings, MountPropagation,
+    PreparedContainer,
 };
 use durabletree::DurableTree;
 use fileutil::{resolve_symlink_forest, SafeTempDir, SafeTempDirBuilder};
@@ -25,6 +30,10 @@ use std::{
 use tracing::info_span;
 use vdb::{generate_vdb_contents, get_vdb_dir};
 
+use crate::collision::CollisionChecker;
+use crate::plan::InstallPlan;
+use crate::sysroot_check::SysrootChecker;
+
 /// The directory name under the file system root where package files to be
 /// installed to the target file system (aka "package image") are staged before
 /// installation so that pkg_preinst can modify them.
@@ -130,7 +139,7 @@ fn can_skip_install_hooks(staged_contents_dir: &Path, cpf: &str, root_dir: &Path
             &layer_dir.join(
                 root_dir
                     .strip_prefix("/")
-                    .expect("--root-dir must be absolute"),
+                    .expect("--root-dir is validated to be absolute"),
             ),
             cpf,
         );
@@ -168,6 +177,7 @@ fn bind_mount_binary_package(
         mount_path: binary_package_mount_path.clone(),
         source: real_binary_package_path,
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     Ok(())
@@ -227,7 +237,7 @@ fn run_pkg_setup_and_preinst(
 
     let mut container = settings.prepare()?;
     run_hooks_general(&mut container, root_dir, category_pf, &["setup", "preinst"])?;
-    move_directory(&container.into_upper_dir(), preinst_dir)?;
+    move_directory(&container.into_upper_dir()?, preinst_dir)?;
     Ok(())
 }
 
@@ -296,7 +306,7 @@ fn mangle_preinst_layer(
         let postinst_root_dir = postinst_upper_dir.path().join(
             root_dir
                 .strip_prefix("/")
-                .expect("--root-dir must be absolute"),
+                .expect("--root-dir is validated to be absolute"),
         );
         std::fs::create_dir_all(&postinst_root_dir)?;
         move_directory(&preinst_image_dir, &postinst_root_dir)?;
@@ -343,22 +353,25 @@ fn run_pkg_postinst(
 
     let mut container = settings.prepare_with_upper_dir(upper_dir)?;
     run_hooks_general(&mut container, root_dir, category_pf, &["postinst"])?;
-    move_directory(&container.into_upper_dir(), postinst_dir)?;
+    move_directory(&container.into_upper_dir()?, postinst_dir)?;
     Ok(())
 }
 
 /// Installs a package to the container in the sysroot at `root_dir`.
 ///
 /// This function adds layers to `settings` so that the installed package is available in the
-/// container.
+/// container. Files in the installed contents layer are recorded to `collisions`.
+///
+/// Returns the category/PF of the package as recorded in the VDB.
 fn install_package(
     settings: &mut ContainerSettings,
+    collisions: &mut CollisionChecker,
     spec: &InstallSpec,
     root_dir: &Path,
     mutable_base_dir: &Path,
     ensure_skip_hooks: bool,
     sparse_vdb: bool,
-) -> Result<()> {
+) -> Result<String> {
     let _span = info_span!(
         "install",
         package = ?spec.input_binary_package.file_name().unwrap(),
@@ -392,10 +405,11 @@ fn install_package(
         tracing::info!("Skipping install hooks safely");
 
         // Enough to just mount the installed contents layer.
-        // TODO(b/299564235): Check file collisions.
-        settings.push_layer(&resolve_symlink_forest(&spec.input_installed_contents_dir)?)?;
+        let installed_contents_dir = resolve_symlink_forest(&spec.input_installed_contents_dir)?;
+        collisions.add_durable_tree(&installed_contents_dir, category_pf)?;
+        settings.push_layer(&installed_contents_dir)?;
 
-        return Ok(());
+        return Ok(category_pf.to_owned());
     }
 
     if ensure_skip_hooks {
@@ -430,8 +444,9 @@ fn install_package(
     File::create(postinst_upper_dir.path().join(STAGE_DIR_NAME))?;
 
     // Mount the installed contents.
-    // TODO(b/299564235): Check file collisions.
-    settings.push_layer(&resolve_symlink_forest(&spec.input_installed_contents_dir)?)?;
+    let installed_contents_dir = resolve_symlink_forest(&spec.input_installed_contents_dir)?;
+    collisions.add_durable_tree(&installed_contents_dir, category_pf)?;
+    settings.push_layer(&installed_contents_dir)?;
 
     // Run pkg_postinst.
     run_pkg_postinst(
@@ -449,7 +464,7 @@ fn install_package(
         let vdb_dir = get_vdb_dir(
             root_dir
                 .strip_prefix("/")
-                .expect("--root-dir must return an absolute path"),
+                .expect("--root-dir is validated to be absolute"),
             category_pf,
         );
         let post_vdb_dir = spec.output_postinst_dir.join(vdb_dir);
@@ -466,7 +481,7 @@ fn install_package(
     // modifications made by pkg_postinst.
     settings.push_layer(&spec.output_postinst_dir)?;
 
-    Ok(())
+    Ok(category_pf.to_owned())
 }
 
 fn postprocess_layers(spec: &InstallSpec) -> Result<()> {
@@ -489,14 +504,27 @@ fn postprocess_layers(spec: &InstallSpec) -> Result<()> {
     Ok(())
 }
 
+/// Validates --root-dir, which must be absolute as it is joined to the
+/// directories of layers. This is meant to be used as a clap value parser.
+fn parse_root_dir(value: &str) -> Result<PathBuf> {
+    let path = PathBuf::from(value);
+    ensure!(path.is_absolute(), "must be an absolute path: {value:?}");
+    Ok(path)
+}
+
 #[derive(Parser, Clone, Debug)]
 struct Args {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
     /// Specifies the root directory to install packages at. It is typically
     /// "/" for host packages, or "/build/$BOARD" for target packages.
-    #[arg(long)]
+    #[arg(long, value_parser = parse_root_dir)]
     root_dir: PathBuf,
 
     /// Specifies binary packages to install, in the order of installation. A value contains
@@ -515,11 +543,60 @@ struct Args {
     /// generating a new `CONTENTS` entry.
     #[arg(long)]
     sparse_vdb: bool,
+
+    /// Prints the plan of installation, such as the order of packages, and
+    /// exits without mounting anything or running hooks.
+    #[arg(long)]
+    dry_run: bool,
+
+    /// Saves the plan of installation to the specified file in JSON.
+    #[arg(long)]
+    plan_json: Option<PathBuf>,
+
+    /// Verifies the consistency of the sysroot after installing packages,
+    /// and fails if installed packages contain broken symlinks or ELF files
+    /// whose NEEDED libraries are missing. It can't be used with --sparse-vdb
+    /// as the verification needs CONTENTS of installed packages.
+    #[arg(long, conflicts_with = "sparse_vdb")]
+    verify_sysroot: bool,
+
+    /// Files to exclude from the collision check, in the same format as
+    /// Portage's COLLISION_IGNORE. A value may contain multiple
+    /// whitespace-separated patterns.
+    #[arg(long)]
+    collision_ignore: Vec<String>,
+
+    /// Files masked by Portage's INSTALL_MASK, in the same format. They are
+    /// excluded from the collision check as they are never installed.
+    #[arg(long)]
+    install_mask: Vec<String>,
+
+    /// Fails the installation if multiple packages install the same file, or
+    /// a file already in the base layers, like Portage's collision-protect
+    /// feature. Such files are reported as warnings otherwise.
+    #[arg(long)]
+    collision_protect: bool,
 }
 
 fn do_main() -> Result<()> {
     let args = Args::try_parse()?;
 
+    if args.dry_run || args.plan_json.is_some() {
+        let plan = InstallPlan::new(
+            &args.root_dir,
+            args.sparse_vdb,
+            &args.common.layer,
+            &args.install,
+        )?;
+        if let Some(path) = &args.plan_json {
+            plan.save(path)?;
+        }
+        if args.dry_run {
+            print!("{plan}");
+            return Ok(());
+        }
+    }
+
     // Mount a tmpfs and use it as the mutable base directory.
     //
     // We do this to workaround the issue where overlayfs blocks on unmounting to flush all dirty
@@ -545,17 +622,56 @@ fn do_main() -> Result<()> {
             "cros/bazel/portage/bin/fast_install_packages/portageq_wrapper.py"
         ),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
+    let ignore_patterns = args
+        .collision_ignore
+        .iter()
+        .chain(&args.install_mask)
+        .flat_map(|value| value.split_whitespace())
+        .map(|pattern| pattern.to_owned())
+        .collect();
+    let mut collisions = CollisionChecker::new(&args.root_dir, ignore_patterns);
+    for layer in &args.common.layer {
+        collisions.add_base_layer(&resolve_symlink_forest(layer)?)?;
+    }
+    let mut category_pfs = Vec::new();
     for spec in &args.install {
-        install_package(
+        let category_pf = install_package(
             &mut settings,
+            &mut collisions,
             spec,
             &args.root_dir,
             tmpfs.path(),
             args.ensure_skip_hooks,
             args.sparse_vdb,
         )?;
+        category_pfs.push(category_pf);
+    }
+
+    // Like Portage's collision-protect, fail if packages install the same
+    // files as the later one would silently win.
+    if let Err(e) = collisions.check() {
+        if args.collision_protect {
+            return Err(e);
+        }
+        tracing::warn!("{e:#}");
+    }
+
+    if args.verify_sysroot {
+        let _span = info_span!("verify_sysroot").entered();
+        let file_system = settings.mount()?;
+        let sysroot = file_system.path().join(
+            args.root_dir
+                .strip_prefix("/")
+                .expect("--root-dir is validated to be absolute"),
+        );
+        let mut checker = SysrootChecker::new(&sysroot)?;
+        for category_pf in &category_pfs {
+            checker.check_package(category_pf)?;
+        }
+        checker.check()?;
     }
 
     for spec in &args.install {
@@ -0,0 +1,146 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use binarypackage::BinaryPackage;
+use serde::Serialize;
+use std::{
+    fmt::Display,
+    fs::File,
+    path::{Path, PathBuf},
+};
+
+use crate::InstallSpec;
+
+/// A package to be installed, as planned by [`InstallPlan`].
+#[derive(Clone, Debug, Eq, PartialEq, Serialize)]
+pub struct PlannedPackage {
+    /// The name of the package as recorded in VDB, e.g. "sys-apps/attr-2.5.1".
+    pub category_pf: String,
+    pub binary_package: PathBuf,
+    pub installed_contents_dir: PathBuf,
+    pub staged_contents_dir: PathBuf,
+    pub preinst_dir: PathBuf,
+    pub postinst_dir: PathBuf,
+}
+
+/// Describes what fast_install_packages is going to do, without mounting
+/// anything or running any hooks.
+#[derive(Clone, Debug, Eq, PartialEq, Serialize)]
+pub struct InstallPlan {
+    pub root_dir: PathBuf,
+    pub sparse_vdb: bool,
+    /// Layers the container starts with, in the mount order.
+    pub layers: Vec<PathBuf>,
+    /// Packages in the order of installation.
+    pub packages: Vec<PlannedPackage>,
+}
+
+impl InstallPlan {
+    /// Computes a plan by reading the binary packages to install.
+    pub fn new(
+        root_dir: &Path,
+        sparse_vdb: bool,
+        layers: &[PathBuf],
+        specs: &[InstallSpec],
+    ) -> Result<Self> {
+        let packages = specs
+            .iter()
+            .map(|spec| {
+                let binary_package =
+                    BinaryPackage::open(&spec.input_binary_package).with_context(|| {
+                        format!("Failed to open {}", spec.input_binary_package.display())
+                    })?;
+                // Sparse VDBs elide revision numbers. See install_package.
+                let category_pf = if sparse_vdb {
+                    binary_package.category_p()
+                } else {
+                    binary_package.category_pf()
+                };
+                Ok(PlannedPackage {
+                    category_pf: category_pf.to_owned(),
+                    binary_package: spec.input_binary_package.clone(),
+                    installed_contents_dir: spec.input_installed_contents_dir.clone(),
+                    staged_contents_dir: spec.input_staged_contents_dir.clone(),
+                    preinst_dir: spec.output_preinst_dir.clone(),
+                    postinst_dir: spec.output_postinst_dir.clone(),
+                })
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self {
+            root_dir: root_dir.to_owned(),
+            sparse_vdb,
+            layers: layers.to_vec(),
+            packages,
+        })
+    }
+
+    /// Saves the plan as JSON.
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let file =
+            File::create(path).with_context(|| format!("Failed to create {}", path.display()))?;
+        serde_json::to_writer_pretty(file, self)?;
+        Ok(())
+    }
+}
+
+impl Display for InstallPlan {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        writeln!(f, "Root directory: {}", self.root_dir.display())?;
+        writeln!(f, "Sparse VDB: {}", self.sparse_vdb)?;
+        writeln!(f, "Layers:")?;
+        for layer in &self.layers {
+            writeln!(f, "  {}", layer.display())?;
+        }
+        writeln!(f, "Packages (in the order of installation):")?;
+        for (i, package) in self.packages.iter().enumerate() {
+            writeln!(
+                f,
+                "  {}. {} ({})",
+                i + 1,
+                package.category_pf,
+                package.binary_package.display()
+            )?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_display() {
+        let package = |category_pf: &str, name: &str| PlannedPackage {
+            category_pf: category_pf.to_owned(),
+            binary_package: PathBuf::from(format!("/pkgs/{name}.tbz2")),
+            installed_contents_dir: PathBuf::from(format!("/out/{name}.installed")),
+            staged_contents_dir: PathBuf::from(format!("/out/{name}.staged")),
+            preinst_dir: PathBuf::from(format!("/out/{name}.preinst")),
+            postinst_dir: PathBuf::from(format!("/out/{name}.postinst")),
+        };
+        let plan = InstallPlan {
+            root_dir: PathBuf::from("/build/amd64-generic"),
+            sparse_vdb: false,
+            layers: vec![PathBuf::from("/sdk"), PathBuf::from("/overlays")],
+            packages: vec![
+                package("sys-libs/glibc-2.35-r1", "glibc"),
+                package("sys-apps/attr-2.5.1", "attr"),
+            ],
+        };
+        assert_eq!(
+            plan.to_string(),
+            "Root directory: /build/amd64-generic
+Sparse VDB: false
+Layers:
+  /sdk
+  /overlays
+Packages (in the order of installation):
+  1. sys-libs/glibc-2.35-r1 (/pkgs/glibc.tbz2)
+  2. sys-apps/attr-2.5.1 (/pkgs/attr.tbz2)
+"
+        );
+    }
+}
@@ -0,0 +1,526 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use elf::{
+    abi::{DT_NEEDED, DT_RPATH, DT_RUNPATH},
+    endian::AnyEndian,
+    ElfBytes,
+};
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    fmt::Write as _,
+    io::{ErrorKind, Read},
+    path::{Component, Path, PathBuf},
+};
+use vdb::get_vdb_dir;
+
+/// Library directories searched by the dynamic linker besides the ones
+/// listed in `/etc/ld.so.conf`.
+const DEFAULT_LIBRARY_DIRS: &[&str] = &["lib64", "usr/lib64", "lib", "usr/lib"];
+
+/// Directories whose contents only exist at run time. Symlinks pointing into
+/// them, e.g. `/etc/mtab -> /proc/self/mounts`, are not considered broken.
+const RUNTIME_DIRS: &[&str] = &["dev", "proc", "run", "sys"];
+
+/// The maximum number of symlinks to follow when resolving a path, which
+/// matches the kernel's limit.
+const MAX_SYMLINK_FOLLOWS: usize = 40;
+
+/// An entry of a `CONTENTS` file in the VDB that [`SysrootChecker`] checks.
+#[derive(Debug, PartialEq, Eq)]
+enum ContentsEntry {
+    /// A regular file, i.e. an "obj" line.
+    File(PathBuf),
+    /// A symlink, i.e. a "sym" line.
+    Symlink(PathBuf),
+}
+
+/// Parses a line of a `CONTENTS` file. Returns `None` for directories and
+/// other entries that are not checked.
+///
+/// Paths in `CONTENTS` may contain spaces, so trailing fields are stripped
+/// from the end of lines.
+fn parse_contents_line(line: &str) -> Result<Option<ContentsEntry>> {
+    let Some((kind, rest)) = line.split_once(' ') else {
+        return Ok(None);
+    };
+    let entry = match kind {
+        // "obj <path> <md5> <timestamp>"
+        "obj" => {
+            let path = rest
+                .rsplitn(3, ' ')
+                .nth(2)
+                .with_context(|| format!("Invalid CONTENTS line: {line:?}"))?;
+            ContentsEntry::File(PathBuf::from(path))
+        }
+        // "sym <path> -> <target> <timestamp>"
+        "sym" => {
+            let (path, _) = rest
+                .split_once(" -> ")
+                .with_context(|| format!("Invalid CONTENTS line: {line:?}"))?;
+            ContentsEntry::Symlink(PathBuf::from(path))
+        }
+        _ => return Ok(None),
+    };
+    Ok(Some(entry))
+}
+
+/// Returns the path relative to the sysroot, e.g. "usr/bin/foo" for
+/// "/usr/bin/foo".
+fn relative_path(path: &Path) -> &Path {
+    path.strip_prefix("/").unwrap_or(path)
+}
+
+/// Resolves symlinks in `path` relative to `sysroot` as if `sysroot` were the
+/// file system root, and returns the resolved path relative to `sysroot`.
+/// Returns `None` if the path doesn't exist.
+fn resolve_in_sysroot(sysroot: &Path, path: &Path) -> Result<Option<PathBuf>> {
+    let mut resolved = PathBuf::new();
+    let mut pending: Vec<PathBuf> = path
+        .components()
+        .rev()
+        .map(|c| PathBuf::from(c.as_os_str()))
+        .collect();
+    let mut follows = 0;
+    while let Some(name) = pending.pop() {
+        match Path::new(&name).components().next() {
+            Some(Component::Normal(_)) => {}
+            Some(Component::ParentDir) => {
+                resolved.pop();
+                continue;
+            }
+            _ => continue,
+        }
+        let candidate = resolved.join(&name);
+        let metadata = match std::fs::symlink_metadata(sysroot.join(&candidate)) {
+            Ok(metadata) => metadata,
+            Err(err) if err.kind() == ErrorKind::NotFound => return Ok(None),
+            Err(err) if err.raw_os_error() == Some(libc::ENOTDIR) => return Ok(None),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Failed to stat {}", candidate.display()))
+            }
+        };
+        if !metadata.is_symlink() {
+            resolved = candidate;
+            continue;
+        }
+        follows += 1;
+        if follows > MAX_SYMLINK_FOLLOWS {
+            return Ok(None);
+        }
+        let target = std::fs::read_link(sysroot.join(&candidate))?;
+        if target.is_absolute() {
+            resolved = PathBuf::new();
+        }
+        pending.extend(
+            target
+                .components()
+                .rev()
+                .map(|c| PathBuf::from(c.as_os_str())),
+        );
+    }
+    Ok(Some(resolved))
+}
+
+/// Returns whether a file starts with the ELF magic number.
+fn is_elf(path: &Path) -> Result<bool> {
+    let mut magic = [0u8; 4];
+    let mut file =
+        std::fs::File::open(path).with_context(|| format!("Failed to open {}", path.display()))?;
+    match file.read_exact(&mut magic) {
+        Ok(()) => Ok(&magic == b"\x7fELF"),
+        Err(err) if err.kind() == ErrorKind::UnexpectedEof => Ok(false),
+        Err(err) => Err(err).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+/// Shared libraries required by an ELF file.
+#[derive(Debug, Default, PartialEq, Eq)]
+struct NeededLibraries {
+    /// SONAMEs in DT_NEEDED entries.
+    needed: Vec<String>,
+    /// Directories in DT_RUNPATH and DT_RPATH entries, which may refer to
+    /// `$ORIGIN`.
+    search_dirs: Vec<String>,
+}
+
+/// Reads the dynamic section of an ELF file. Returns an empty
+/// [`NeededLibraries`] for statically linked files.
+fn read_needed_libraries(data: &[u8]) -> Result<NeededLibraries> {
+    let elf = ElfBytes::<AnyEndian>::minimal_parse(data).context("Invalid ELF")?;
+    let Some(dynamic) = elf.dynamic().context("Failed to parse dynamic section")? else {
+        return Ok(NeededLibraries::default());
+    };
+    let Some((_, string_table)) = elf
+        .dynamic_symbol_table()
+        .context("Failed to parse dynamic symbol table")?
+    else {
+        return Ok(NeededLibraries::default());
+    };
+
+    let mut libraries = NeededLibraries::default();
+    for entry in dynamic.iter() {
+        if ![DT_NEEDED, DT_RPATH, DT_RUNPATH].contains(&entry.d_tag) {
+            continue;
+        }
+        let value = string_table
+            .get(entry.d_val() as usize)
+            .context("Failed to read dynamic string")?;
+        if entry.d_tag == DT_NEEDED {
+            libraries.needed.push(value.to_owned());
+        } else {
+            libraries
+                .search_dirs
+                .extend(value.split(':').map(|dir| dir.to_owned()));
+        }
+    }
+    Ok(libraries)
+}
+
+/// Reads library directories listed in `/etc/ld.so.conf` and the files it
+/// includes, relative to the sysroot.
+fn read_ld_so_conf(sysroot: &Path) -> Result<Vec<PathBuf>> {
+    fn read(sysroot: &Path, conf: &Path, dirs: &mut Vec<PathBuf>) -> Result<()> {
+        let contents = match std::fs::read_to_string(sysroot.join(relative_path(conf))) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == ErrorKind::NotFound => return Ok(()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Failed to read {}", conf.display()))
+            }
+        };
+        for line in contents.lines() {
+            let line = line.split('#').next().unwrap_or_default().trim();
+            if line.is_empty() {
+                continue;
+            }
+            if let Some(pattern) = line.strip_prefix("include ") {
+                // Only "dir/*.conf" style patterns are supported.
+                let pattern = Path::new(pattern.trim());
+                let (Some(dir), Some(name)) = (pattern.parent(), pattern.file_name()) else {
+                    continue;
+                };
+                let suffix = name.to_string_lossy().trim_start_matches('*').to_owned();
+                let Ok(entries) = std::fs::read_dir(sysroot.join(relative_path(dir))) else {
+                    continue;
+                };
+                let mut includes = entries
+                    .filter_map(|entry| entry.ok())
+                    .map(|entry| entry.file_name().to_string_lossy().into_owned())
+                    .filter(|name| name.ends_with(&suffix))
+                    .collect::<Vec<_>>();
+                includes.sort();
+                for include in includes {
+                    read(sysroot, &dir.join(include), dirs)?;
+                }
+            } else {
+                dirs.push(relative_path(Path::new(line)).to_owned());
+            }
+        }
+        Ok(())
+    }
+
+    let mut dirs = Vec::new();
+    read(sysroot, Path::new("/etc/ld.so.conf"), &mut dirs)?;
+    Ok(dirs)
+}
+
+/// Verifies the consistency of packages installed to a sysroot, so that bugs
+/// in runtime dependencies are caught on building the sysroot rather than on
+/// booting an image.
+///
+/// It reports symlinks pointing to missing files, and ELF files whose
+/// DT_NEEDED libraries are not found in the sysroot. Files are enumerated from
+/// `CONTENTS` in the VDB so that each problem is attributed to the package
+/// owning the file. Packages installed with sparse VDB entries have no
+/// `CONTENTS` and thus are not checked. Files listed in `CONTENTS` but missing
+/// in the sysroot, e.g. ones omitted from interface layers, are ignored.
+pub struct SysrootChecker {
+    sysroot: PathBuf,
+    library_dirs: Vec<PathBuf>,
+    /// Problems found, keyed by the owner package.
+    problems: BTreeMap<String, BTreeSet<String>>,
+}
+
+impl SysrootChecker {
+    /// Creates a checker for a sysroot, e.g. the file system root joined with
+    /// "/build/$BOARD".
+    pub fn new(sysroot: &Path) -> Result<Self> {
+        let mut library_dirs: Vec<PathBuf> =
+            DEFAULT_LIBRARY_DIRS.iter().map(PathBuf::from).collect();
+        library_dirs.extend(read_ld_so_conf(sysroot)?);
+        Ok(Self {
+            sysroot: sysroot.to_owned(),
+            library_dirs,
+            problems: BTreeMap::new(),
+        })
+    }
+
+    /// Checks files owned by a package, identified by its category/PF.
+    pub fn check_package(&mut self, cpf: &str) -> Result<()> {
+        let contents_path = get_vdb_dir(&self.sysroot, cpf).join("CONTENTS");
+        let contents = match std::fs::read_to_string(&contents_path) {
+            Ok(contents) => contents,
+            Err(err) if err.kind() == ErrorKind::NotFound => return Ok(()),
+            Err(err) => {
+                return Err(err)
+                    .with_context(|| format!("Failed to read {}", contents_path.display()))
+            }
+        };
+        for line in contents.lines() {
+            let problem = match parse_contents_line(line)? {
+                None => None,
+                Some(ContentsEntry::File(path)) => self
+                    .check_file(&path)
+                    .with_context(|| format!("Failed to check {}", path.display()))?,
+                Some(ContentsEntry::Symlink(path)) => self
+                    .check_symlink(&path)
+                    .with_context(|| format!("Failed to check {}", path.display()))?,
+            };
+            if let Some(problem) = problem {
+                self.problems
+                    .entry(cpf.to_owned())
+                    .or_default()
+                    .insert(problem);
+            }
+        }
+        Ok(())
+    }
+
+    fn check_symlink(&self, path: &Path) -> Result<Option<String>> {
+        let real_path = self.sysroot.join(relative_path(path));
+        let Ok(target) = std::fs::read_link(&real_path) else {
+            // The symlink is missing or replaced by another package.
+            return Ok(None);
+        };
+        let target_path = match target.is_absolute() {
+            true => target.clone(),
+            false => path.parent().unwrap_or(Path::new("/")).join(&target),
+        };
+        if RUNTIME_DIRS
+            .iter()
+            .any(|dir| relative_path(&target_path).starts_with(dir))
+        {
+            return Ok(None);
+        }
+        if resolve_in_sysroot(&self.sysroot, path)?.is_some() {
+            return Ok(None);
+        }
+        Ok(Some(format!(
+            "{}: broken symlink to {}",
+            path.display(),
+            target.display()
+        )))
+    }
+
+    fn check_file(&self, path: &Path) -> Result<Option<String>> {
+        let relative = relative_path(path);
+        // Separate debug symbols have no code to run.
+        if relative.starts_with("usr/lib/debug") {
+            return Ok(None);
+        }
+        let real_path = self.sysroot.join(relative);
+        match std::fs::symlink_metadata(&real_path) {
+            Ok(metadata) if metadata.is_file() => {}
+            _ => return Ok(None),
+        }
+        if !is_elf(&real_path)? {
+            return Ok(None);
+        }
+        let data = std::fs::read(&real_path)?;
+        let libraries = read_needed_libraries(&data)?;
+
+        let origin = relative.parent().unwrap_or(Path::new(""));
+        let mut search_dirs: Vec<PathBuf> = libraries
+            .search_dirs
+            .iter()
+            .map(|dir| {
+                let dir = dir
+                    .replace("${ORIGIN}", "$ORIGIN")
+                    .replace("$ORIGIN", &format!("/{}", origin.display()));
+                relative_path(Path::new(&dir)).to_owned()
+            })
+            .collect();
+        search_dirs.extend(self.library_dirs.iter().cloned());
+
+        let mut missing = Vec::new();
+        for soname in &libraries.needed {
+            let mut found = false;
+            for dir in &search_dirs {
+                if resolve_in_sysroot(&self.sysroot, &dir.join(soname))?.is_some() {
+                    found = true;
+                    break;
+                }
+            }
+            if !found {
+                missing.push(soname.as_str());
+            }
+        }
+        if missing.is_empty() {
+            return Ok(None);
+        }
+        Ok(Some(format!(
+            "{}: missing NEEDED libraries: {}",
+            path.display(),
+            missing.join(", ")
+        )))
+    }
+
+    /// Fails with a report if any problem was found.
+    pub fn check(&self) -> Result<()> {
+        if self.problems.is_empty() {
+            return Ok(());
+        }
+        let mut report = String::new();
+        let mut count = 0;
+        for (owner, problems) in &self.problems {
+            writeln!(&mut report, "  {owner}:")?;
+            for problem in problems {
+                writeln!(&mut report, "    {problem}")?;
+                count += 1;
+            }
+        }
+        bail!(
+            "Detected {} inconsistencies in the sysroot:\n{}",
+            count,
+            report
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use fileutil::SafeTempDir;
+    use std::os::unix::fs::symlink;
+
+    fn write_file(root: &Path, path: &str, data: &[u8]) -> Result<()> {
+        let path = root.join(path);
+        std::fs::create_dir_all(path.parent().unwrap())?;
+        std::fs::write(path, data)?;
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse_contents_line() -> Result<()> {
+        assert_eq!(parse_contents_line("dir /usr/bin")?, None);
+        assert_eq!(
+            parse_contents_line("obj /usr/bin/foo bar d41d8cd98f00b204e9800998ecf8427e 0")?,
+            Some(ContentsEntry::File(PathBuf::from("/usr/bin/foo bar")))
+        );
+        assert_eq!(
+            parse_contents_line("sym /usr/lib64/libfoo.so -> libfoo.so.1 0")?,
+            Some(ContentsEntry::Symlink(PathBuf::from(
+                "/usr/lib64/libfoo.so"
+            )))
+        );
+        assert!(parse_contents_line("obj /usr/bin/foo").is_err());
+        assert!(parse_contents_line("sym /usr/bin/foo 0").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_resolve_in_sysroot() -> Result<()> {
+        let root = SafeTempDir::new()?;
+        let root = root.path();
+        write_file(root, "usr/lib64/libfoo.so.1.0", b"")?;
+        symlink("libfoo.so.1.0", root.join("usr/lib64/libfoo.so.1"))?;
+        symlink("/usr/lib64/libfoo.so.1", root.join("usr/lib64/libfoo.so"))?;
+        symlink("usr/lib64", root.join("lib64"))?;
+        symlink("missing", root.join("usr/lib64/libbar.so"))?;
+
+        assert_eq!(
+            resolve_in_sysroot(root, Path::new("/lib64/libfoo.so"))?,
+            Some(PathBuf::from("usr/lib64/libfoo.so.1.0"))
+        );
+        assert_eq!(
+            resolve_in_sysroot(root, Path::new("lib64/../../../usr/lib64/libfoo.so.1"))?,
+            Some(PathBuf::from("usr/lib64/libfoo.so.1.0"))
+        );
+        assert_eq!(
+            resolve_in_sysroot(root, Path::new("/usr/lib64/libbar.so"))?,
+            None
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_read_ld_so_conf() -> Result<()> {
+        let root = SafeTempDir::new()?;
+        let root = root.path();
+        write_file(
+            root,
+            "etc/ld.so.conf",
+            b"# comment\ninclude /etc/ld.so.conf.d/*.conf\n/usr/local/lib64\n",
+        )?;
+        write_file(root, "etc/ld.so.conf.d/10-foo.conf", b"/opt/foo/lib\n")?;
+        write_file(root, "etc/ld.so.conf.d/README", b"/ignored\n")?;
+
+        assert_eq!(
+            read_ld_so_conf(root)?,
+            vec![
+                PathBuf::from("opt/foo/lib"),
+                PathBuf::from("usr/local/lib64")
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_check_package() -> Result<()> {
+        let root = SafeTempDir::new()?;
+        let root = root.path();
+
+        // Use the test binary itself as a dynamically linked ELF file.
+        let exe = std::fs::read(std::env::current_exe()?)?;
+        let libraries = read_needed_libraries(&exe)?;
+        assert!(!libraries.needed.is_empty());
+
+        write_file(root, "usr/bin/foo", &exe)?;
+        write_file(root, "usr/share/foo/data.txt", b"")?;
+        symlink("../share/foo/data.txt", root.join("usr/bin/foo-data"))?;
+        symlink("/usr/bin/missing", root.join("usr/bin/foo-broken"))?;
+        std::fs::create_dir_all(root.join("etc"))?;
+        symlink("/proc/self/mounts", root.join("etc/mtab"))?;
+        write_file(
+            root,
+            "var/db/pkg/sys-apps/foo-1.0/CONTENTS",
+            b"dir /usr/bin\n\
+            obj /usr/bin/foo 0 0\n\
+            obj /usr/bin/omitted 0 0\n\
+            obj /usr/share/foo/data.txt 0 0\n\
+            sym /usr/bin/foo-data -> ../share/foo/data.txt 0\n\
+            sym /usr/bin/foo-broken -> /usr/bin/missing 0\n\
+            sym /etc/mtab -> /proc/self/mounts 0\n",
+        )?;
+
+        let mut checker = SysrootChecker::new(root)?;
+        checker.check_package("sys-apps/foo-1.0")?;
+        // Packages without CONTENTS are skipped.
+        checker.check_package("sys-apps/sparse-1.0")?;
+        let err = checker.check().unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            format!(
+                "Detected 2 inconsistencies in the sysroot:
+  sys-apps/foo-1.0:
+    /usr/bin/foo-broken: broken symlink to /usr/bin/missing
+    /usr/bin/foo: missing NEEDED libraries: {}
+",
+                libraries.needed.join(", ")
+            )
+        );
+
+        // Providing the libraries fixes the problem.
+        for soname in &libraries.needed {
+            write_file(root, &format!("lib64/{soname}"), b"")?;
+        }
+        std::fs::remove_file(root.join("usr/bin/foo-broken"))?;
+        let mut checker = SysrootChecker::new(root)?;
+        checker.check_package("sys-apps/foo-1.0")?;
+        checker.check()?;
+
+        Ok(())
+    }
+}
@@ -612,6 +612,40 @@ obj opt/files/{index}.txt d41d8cd98f00b204e9800998ecf8427e 0
     Ok(())
 }
 
+/// Verifies that installing the same file from multiple packages fails with
+/// --collision-protect, and only warns otherwise.
+#[test]
+fn test_install_collision() -> Result<()> {
+    let mut binary_packages: Vec<NamedTempFile> = Vec::new();
+    for name in ["foo", "bar"] {
+        let contents_dir = TempDir::new()?;
+        let contents_dir = contents_dir.path();
+        std::fs::create_dir_all(contents_dir.join("opt/files"))?;
+        std::fs::File::create(contents_dir.join("opt/files/common.txt"))?;
+
+        let binary_package =
+            create_binary_package(&format!("sys-apps/{name}-1.0"), contents_dir, "")?;
+        binary_packages.push(binary_package);
+    }
+
+    let result = fast_install_packages(
+        &mut create_fake_sdk_container()?,
+        &binary_packages.iter().map(|bp| bp.path()).collect_vec(),
+        Path::new("/build/eve"),
+        &["--collision-protect"],
+    );
+    assert!(result.is_err());
+
+    fast_install_packages(
+        &mut create_fake_sdk_container()?,
+        &binary_packages.iter().map(|bp| bp.path()).collect_vec(),
+        Path::new("/build/eve"),
+        &[],
+    )?;
+
+    Ok(())
+}
+
 #[test]
 fn test_install_skip_hooks() -> Result<()> {
     let mut settings = create_fake_sdk_container()?;
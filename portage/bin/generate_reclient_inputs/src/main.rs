@@ -4,8 +4,10 @@
 
 use anyhow::{ensure, Result};
 use clap::Parser;
-use cliutil::cli_main;
-use container::{enter_mount_namespace, BindMount, CommonArgs, ContainerSettings};
+use cliutil::{cli_main, LoggingArgs};
+use container::{
+    enter_mount_namespace, BindMount, CommonArgs, ContainerSettings, MountPropagation,
+};
 use fileutil::resolve_symlink_forest;
 use std::{path::PathBuf, process::ExitCode};
 
@@ -14,6 +16,11 @@ const MAIN_SCRIPT: &str = "/mnt/host/.generate_reclient_inputs/generate_reclient
 #[derive(Parser, Debug)]
 #[clap()]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
@@ -38,6 +45,7 @@ fn do_main() -> Result<()> {
         ))?,
         mount_path: PathBuf::from(MAIN_SCRIPT),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     // Create the output file, then drop the reference to close the handle.
@@ -50,6 +58,7 @@ fn do_main() -> Result<()> {
         source: args.output,
         mount_path: PathBuf::from("/mnt/host/.generate_reclient_inputs/output.tar.zst"),
         rw: true,
+        propagation: MountPropagation::Private,
     });
 
     let mut container = settings.prepare()?;
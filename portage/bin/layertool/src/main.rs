@@ -0,0 +1,198 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use binarypackage::BinaryPackage;
+use clap::{Parser, Subcommand};
+use cliutil::{cli_main, ConfigBuilder, LoggingArgs};
+use layer_manifest::{EntryKind, LayerManifest};
+use std::{
+    collections::BTreeMap,
+    io::Write,
+    path::{Path, PathBuf},
+    process::ExitCode,
+};
+
+#[derive(Parser, Debug)]
+#[command()]
+struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
+    #[clap(subcommand)]
+    commands: Commands,
+}
+
+#[derive(Subcommand, Debug)]
+enum Commands {
+    Generate(GenerateArgs),
+    Diff(DiffArgs),
+    Summary(SummaryArgs),
+}
+
+/// Generates a layer manifest of a directory, a tarball or the contents of a
+/// binary package.
+#[derive(Parser, Debug)]
+struct GenerateArgs {
+    /// Writes the manifest to the file instead of stdout.
+    #[arg(long)]
+    output: Option<PathBuf>,
+
+    /// A directory, a tarball or a binary package (*.tbz2).
+    #[arg()]
+    input: PathBuf,
+}
+
+/// Compares two layers. Fails if they differ.
+#[derive(Parser, Debug)]
+struct DiffArgs {
+    /// A directory, a tarball, a binary package (*.tbz2) or a layer
+    /// manifest (*.jsonl).
+    #[arg()]
+    left: PathBuf,
+
+    /// A directory, a tarball, a binary package (*.tbz2) or a layer
+    /// manifest (*.jsonl).
+    #[arg()]
+    right: PathBuf,
+}
+
+/// Shows sizes of regular files in a layer grouped by directories.
+#[derive(Parser, Debug)]
+struct SummaryArgs {
+    /// The number of path components to group files by.
+    #[arg(long, default_value_t = 1)]
+    depth: usize,
+
+    /// A directory, a tarball, a binary package (*.tbz2) or a layer
+    /// manifest (*.jsonl).
+    #[arg()]
+    input: PathBuf,
+}
+
+/// Loads a manifest from a layer manifest file, or generates one from a
+/// directory, a tarball or a binary package.
+fn open_layer(path: &Path) -> Result<LayerManifest> {
+    if path.is_dir() {
+        LayerManifest::from_dir(path)
+    } else if path.extension().is_some_and(|ext| ext == "jsonl") {
+        LayerManifest::load(path)
+    } else if path.extension().is_some_and(|ext| ext == "tbz2") {
+        let mut binary_package = BinaryPackage::open(path)?;
+        LayerManifest::from_archive(&mut binary_package.archive()?)
+            .with_context(|| format!("Failed to read {}", path.display()))
+    } else {
+        LayerManifest::from_tar_file(path)
+    }
+}
+
+fn do_generate(args: GenerateArgs) -> Result<()> {
+    let manifest = open_layer(&args.input)?;
+    match &args.output {
+        Some(output) => manifest.save(output),
+        None => manifest.write(std::io::stdout().lock()),
+    }
+}
+
+fn do_diff(args: DiffArgs) -> Result<()> {
+    let left = open_layer(&args.left)?;
+    let right = open_layer(&args.right)?;
+    let differences = left.diff(&right);
+    for difference in &differences {
+        println!("{difference}");
+    }
+    if !differences.is_empty() {
+        bail!("Found {} differences", differences.len());
+    }
+    Ok(())
+}
+
+fn summarize(manifest: &LayerManifest, depth: usize, out: &mut impl Write) -> Result<()> {
+    let mut sizes: BTreeMap<PathBuf, u64> = BTreeMap::new();
+    for entry in manifest.entries() {
+        if let EntryKind::Regular { size, .. } = entry.kind {
+            let group: PathBuf = entry.path.components().take(depth).collect();
+            *sizes.entry(group).or_default() += size;
+        }
+    }
+
+    let mut sizes: Vec<_> = sizes.into_iter().collect();
+    sizes.sort_by(|(a_path, a_size), (b_path, b_size)| {
+        b_size.cmp(a_size).then_with(|| a_path.cmp(b_path))
+    });
+    for (path, size) in sizes {
+        writeln!(out, "{size}\t{}", path.display())?;
+    }
+    writeln!(out, "{}\ttotal", manifest.total_size())?;
+    Ok(())
+}
+
+fn do_summary(args: SummaryArgs) -> Result<()> {
+    let manifest = open_layer(&args.input)?;
+    summarize(&manifest, args.depth, &mut std::io::stdout().lock())
+}
+
+fn do_main() -> Result<()> {
+    // Bazel will execute the command in the runfiles directory. This breaks
+    // relative paths passed into the command. Fix this by switching to the
+    // original directory.
+    if let Ok(orig_cwd) = std::env::var("BUILD_WORKING_DIRECTORY") {
+        std::env::set_current_dir(&orig_cwd).with_context(|| format!("cd {orig_cwd}"))?;
+    };
+
+    let cli = Cli::try_parse()?;
+    match cli.commands {
+        Commands::Generate(args) => do_generate(args),
+        Commands::Diff(args) => do_diff(args),
+        Commands::Summary(args) => do_summary(args),
+    }
+}
+
+fn main() -> ExitCode {
+    cli_main(
+        do_main,
+        ConfigBuilder::new()
+            .log_command_line(false)
+            .build()
+            .expect("valid config"),
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use layer_manifest::Entry;
+
+    #[test]
+    fn test_summarize() -> Result<()> {
+        let mut manifest = LayerManifest::new();
+        for (path, size) in [("usr/bin/a", 3), ("usr/lib/b", 5), ("etc/c", 1)] {
+            manifest.insert(Entry {
+                path: PathBuf::from(path),
+                kind: EntryKind::Regular {
+                    size,
+                    sha256: String::new(),
+                },
+                mode: 0o644,
+                uid: 0,
+                gid: 0,
+                xattrs: Default::default(),
+            });
+        }
+
+        let mut out = Vec::new();
+        summarize(&manifest, 1, &mut out)?;
+        assert_eq!(String::from_utf8(out)?, "8\tusr\n1\tetc\n9\ttotal\n");
+
+        let mut out = Vec::new();
+        summarize(&manifest, 2, &mut out)?;
+        assert_eq!(
+            String::from_utf8(out)?,
+            "5\tusr/lib\n3\tusr/bin\n1\tetc/c\n9\ttotal\n"
+        );
+        Ok(())
+    }
+}
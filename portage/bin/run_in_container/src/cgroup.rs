@@ -0,0 +1,379 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use itertools::Itertools;
+use nix::unistd::getuid;
+use run_in_container_lib::ResourceLimits;
+use std::{
+    convert::Infallible,
+    fmt::Display,
+    fs::File,
+    io::ErrorKind,
+    os::unix::process::CommandExt,
+    path::{Path, PathBuf},
+    process::Command,
+    time::Duration,
+};
+
+/// The mount point of the cgroup v2 file system.
+const CGROUP_ROOT: &str = "/sys/fs/cgroup";
+
+/// The period of CPU bandwidth control in microseconds.
+const CPU_PERIOD_USEC: u64 = 100000;
+
+/// Parses /proc/self/cgroup and returns the path of the cgroup v2 the process
+/// belongs to, relative to the cgroup v2 file system root.
+fn parse_proc_cgroup(contents: &str) -> Result<PathBuf> {
+    let path = contents
+        .lines()
+        .find_map(|line| line.strip_prefix("0::"))
+        .context("cgroup v2 is unavailable")?;
+    Ok(PathBuf::from(path.strip_prefix('/').unwrap_or(path)))
+}
+
+/// Returns the directory of the cgroup the current process belongs to.
+fn current_cgroup_dir() -> Result<PathBuf> {
+    let contents =
+        std::fs::read_to_string("/proc/self/cgroup").context("Failed to read /proc/self/cgroup")?;
+    Ok(Path::new(CGROUP_ROOT).join(parse_proc_cgroup(&contents)?))
+}
+
+/// Returns cgroup controllers needed to enforce the limits.
+fn required_controllers(limits: &ResourceLimits) -> Vec<&'static str> {
+    [
+        (limits.memory.is_some(), "memory"),
+        (limits.cpus.is_some(), "cpu"),
+        (limits.pids.is_some(), "pids"),
+    ]
+    .into_iter()
+    .filter_map(|(needed, controller)| needed.then_some(controller))
+    .collect()
+}
+
+/// Formats a CPU limit as a value of cpu.max.
+fn format_cpu_max(cpus: f64) -> String {
+    let quota = (cpus * CPU_PERIOD_USEC as f64).round() as u64;
+    format!("{quota} {CPU_PERIOD_USEC}")
+}
+
+/// Returns systemd unit properties equivalent to the limits.
+fn systemd_properties(limits: &ResourceLimits) -> Vec<String> {
+    let mut properties = Vec::new();
+    if let Some(memory) = limits.memory {
+        properties.push(format!("MemoryMax={memory}"));
+    }
+    if let Some(cpus) = limits.cpus {
+        properties.push(format!("CPUQuota={}%", (cpus * 100.0).round().max(1.0)));
+    }
+    if let Some(pids) = limits.pids {
+        properties.push(format!("TasksMax={pids}"));
+    }
+    properties
+}
+
+/// Returns the UID of the current user in the initial user namespace.
+///
+/// run_in_container usually runs in a user namespace where the current user
+/// is mapped to root, so this function looks up /proc/self/uid_map.
+fn host_uid() -> Result<u32> {
+    let uid = getuid().as_raw();
+    let uid_map = std::fs::read_to_string("/proc/self/uid_map")?;
+    for line in uid_map.lines() {
+        let Some((inside, outside, count)) = line
+            .split_whitespace()
+            .map(|field| field.parse::<u32>())
+            .collect_tuple()
+        else {
+            continue;
+        };
+        let (inside, outside, count) = (inside?, outside?, count?);
+        if uid >= inside && uid - inside < count {
+            return Ok(outside + (uid - inside));
+        }
+    }
+    bail!("UID {uid} is not mapped in /proc/self/uid_map");
+}
+
+/// Re-executes the current process in a transient systemd scope that enforces
+/// the limits. `extra_arg` is appended to the command line so that the new
+/// process can tell it is in the scope.
+///
+/// This is the fallback used when the current cgroup is not delegated to the
+/// current user. Unprivileged users use the per-user systemd instance, which
+/// usually has the needed controllers delegated.
+pub fn exec_in_systemd_scope(limits: &ResourceLimits, extra_arg: &str) -> Result<Infallible> {
+    let mut command = Command::new("systemd-run");
+    let uid = host_uid()?;
+    if uid != 0 {
+        command.arg("--user");
+        // Bazel actions usually don't inherit the variable needed to connect
+        // to the per-user systemd instance.
+        if std::env::var_os("XDG_RUNTIME_DIR").is_none() {
+            command.env("XDG_RUNTIME_DIR", format!("/run/user/{uid}"));
+        }
+    }
+    command.args(["--scope", "--quiet", "--collect"]);
+    for property in systemd_properties(limits) {
+        command.arg("--property").arg(property);
+    }
+    command
+        .arg("--")
+        .arg(std::env::current_exe()?)
+        .args(std::env::args_os().skip(1))
+        .arg(extra_arg);
+    let err = command.exec();
+    Err(err).context(
+        "Failed to run systemd-run to apply resource limits; the current cgroup is not \
+        delegated and systemd-run is unavailable",
+    )
+}
+
+/// Resource usage of a container reported on exit.
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct ResourceUsage {
+    /// The peak memory usage in bytes. Requires Linux 5.19+.
+    pub peak_memory: Option<u64>,
+    /// The total CPU time.
+    pub cpu_time: Option<Duration>,
+    /// The peak number of processes and threads. Requires Linux 6.1+.
+    pub peak_pids: Option<u64>,
+    /// The number of processes killed for exceeding the memory limit.
+    pub oom_kills: Option<u64>,
+}
+
+impl Display for ResourceUsage {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let mut fields = Vec::new();
+        if let Some(peak_memory) = self.peak_memory {
+            fields.push(format!(
+                "peak memory {:.1} MiB",
+                peak_memory as f64 / (1 << 20) as f64
+            ));
+        }
+        if let Some(cpu_time) = self.cpu_time {
+            fields.push(format!("CPU time {:.1}s", cpu_time.as_secs_f64()));
+        }
+        if let Some(peak_pids) = self.peak_pids {
+            fields.push(format!("peak processes {peak_pids}"));
+        }
+        if let Some(oom_kills) = self.oom_kills.filter(|n| *n > 0) {
+            fields.push(format!("OOM kills {oom_kills}"));
+        }
+        if fields.is_empty() {
+            return write!(f, "unavailable");
+        }
+        write!(f, "{}", fields.join(", "))
+    }
+}
+
+/// Finds a value in a flat keyed file of cgroup v2, e.g. cpu.stat.
+fn parse_keyed_value(contents: &str, key: &str) -> Option<u64> {
+    contents.lines().find_map(|line| {
+        let (k, v) = line.split_once(' ')?;
+        (k == key).then(|| v.trim().parse().ok()).flatten()
+    })
+}
+
+/// A cgroup v2 enforcing resource limits of a container.
+pub struct ContainerCgroup {
+    dir: PathBuf,
+    /// Whether the cgroup was created by [`ContainerCgroup::create`] and
+    /// should be removed on drop.
+    owned: bool,
+}
+
+impl ContainerCgroup {
+    /// Creates a child cgroup of the current cgroup that enforces the limits.
+    ///
+    /// Returns `None` if the current cgroup is not delegated to the current
+    /// user, or it is impossible to enable the required controllers for its
+    /// children, e.g. because the current cgroup has processes in it.
+    pub fn create(limits: &ResourceLimits) -> Result<Option<Self>> {
+        let parent = current_cgroup_dir()?;
+
+        let subtree_control = parent.join("cgroup.subtree_control");
+        let enabled = std::fs::read_to_string(&subtree_control).unwrap_or_default();
+        let missing = required_controllers(limits)
+            .into_iter()
+            .filter(|controller| !enabled.split_whitespace().contains(controller))
+            .map(|controller| format!("+{controller}"))
+            .join(" ");
+        if !missing.is_empty() && std::fs::write(&subtree_control, &missing).is_err() {
+            return Ok(None);
+        }
+
+        let dir = parent.join(format!("run_in_container.{}", std::process::id()));
+        match std::fs::create_dir(&dir) {
+            Ok(()) => {}
+            Err(err) if matches!(err.kind(), ErrorKind::PermissionDenied) => return Ok(None),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Failed to create {}", dir.display()))
+            }
+        }
+        let cgroup = Self { dir, owned: true };
+        cgroup.apply_limits(limits)?;
+        Ok(Some(cgroup))
+    }
+
+    /// Returns the cgroup the current process belongs to, which was created
+    /// by [`exec_in_systemd_scope`].
+    pub fn current() -> Result<Self> {
+        Ok(Self {
+            dir: current_cgroup_dir()?,
+            owned: false,
+        })
+    }
+
+    fn apply_limits(&self, limits: &ResourceLimits) -> Result<()> {
+        let mut settings = Vec::new();
+        if let Some(memory) = limits.memory {
+            settings.push(("memory.max", memory.to_string()));
+        }
+        if let Some(cpus) = limits.cpus {
+            settings.push(("cpu.max", format_cpu_max(cpus)));
+        }
+        if let Some(pids) = limits.pids {
+            settings.push(("pids.max", pids.to_string()));
+        }
+        for (name, value) in settings {
+            let path = self.dir.join(name);
+            std::fs::write(&path, &value)
+                .with_context(|| format!("Failed to write {value:?} to {}", path.display()))?;
+        }
+        Ok(())
+    }
+
+    /// Opens cgroup.procs of the cgroup for writing if processes have to be
+    /// moved to it explicitly. Writing "0" to the file moves the writer
+    /// process to the cgroup.
+    ///
+    /// Returns `None` if the current process already belongs to the cgroup.
+    pub fn open_procs(&self) -> Result<Option<File>> {
+        if !self.owned {
+            return Ok(None);
+        }
+        let path = self.dir.join("cgroup.procs");
+        let file = File::options()
+            .write(true)
+            .open(&path)
+            .with_context(|| format!("Failed to open {}", path.display()))?;
+        Ok(Some(file))
+    }
+
+    /// Reads the resource usage of processes in the cgroup so far.
+    pub fn usage(&self) -> ResourceUsage {
+        let read = |name: &str| std::fs::read_to_string(self.dir.join(name)).ok();
+        ResourceUsage {
+            peak_memory: read("memory.peak").and_then(|s| s.trim().parse().ok()),
+            cpu_time: read("cpu.stat")
+                .and_then(|s| parse_keyed_value(&s, "usage_usec"))
+                .map(Duration::from_micros),
+            peak_pids: read("pids.peak").and_then(|s| s.trim().parse().ok()),
+            oom_kills: read("memory.events").and_then(|s| parse_keyed_value(&s, "oom_kill")),
+        }
+    }
+}
+
+impl Drop for ContainerCgroup {
+    fn drop(&mut self) {
+        if self.owned {
+            // Fails if processes are still in the cgroup, which is unexpected
+            // as they are killed with the PID namespace.
+            if let Err(err) = std::fs::remove_dir(&self.dir) {
+                eprintln!(
+                    "WARNING: Failed to remove cgroup {}: {err}",
+                    self.dir.display()
+                );
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_proc_cgroup() -> Result<()> {
+        assert_eq!(
+            parse_proc_cgroup("0::/user.slice/user-1000.slice/session-1.scope\n")?,
+            PathBuf::from("user.slice/user-1000.slice/session-1.scope")
+        );
+        assert_eq!(parse_proc_cgroup("0::/\n")?, PathBuf::from(""));
+        assert!(parse_proc_cgroup("4:memory:/user.slice\n").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_required_controllers() {
+        assert!(required_controllers(&ResourceLimits::default()).is_empty());
+        assert_eq!(
+            required_controllers(&ResourceLimits {
+                memory: Some(1 << 30),
+                cpus: None,
+                pids: Some(100),
+            }),
+            ["memory", "pids"]
+        );
+    }
+
+    #[test]
+    fn test_format_cpu_max() {
+        assert_eq!(format_cpu_max(1.0), "100000 100000");
+        assert_eq!(format_cpu_max(2.5), "250000 100000");
+        assert_eq!(format_cpu_max(0.01), "1000 100000");
+    }
+
+    #[test]
+    fn test_systemd_properties() {
+        assert_eq!(
+            systemd_properties(&ResourceLimits {
+                memory: Some(1 << 30),
+                cpus: Some(1.5),
+                pids: Some(100),
+            }),
+            ["MemoryMax=1073741824", "CPUQuota=150%", "TasksMax=100"]
+        );
+        assert_eq!(
+            systemd_properties(&ResourceLimits {
+                memory: None,
+                cpus: Some(0.001),
+                pids: None,
+            }),
+            ["CPUQuota=1%"]
+        );
+    }
+
+    #[test]
+    fn test_parse_keyed_value() {
+        let cpu_stat = "usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n";
+        assert_eq!(parse_keyed_value(cpu_stat, "usage_usec"), Some(1500000));
+        assert_eq!(parse_keyed_value(cpu_stat, "system_usec"), Some(500000));
+        assert_eq!(parse_keyed_value(cpu_stat, "nr_periods"), None);
+    }
+
+    #[test]
+    fn test_format_resource_usage() {
+        assert_eq!(ResourceUsage::default().to_string(), "unavailable");
+        assert_eq!(
+            ResourceUsage {
+                peak_memory: Some(3 << 29),
+                cpu_time: Some(Duration::from_millis(12345)),
+                peak_pids: Some(42),
+                oom_kills: Some(0),
+            }
+            .to_string(),
+            "peak memory 1536.0 MiB, CPU time 12.3s, peak processes 42"
+        );
+        assert_eq!(
+            ResourceUsage {
+                oom_kills: Some(2),
+                ..Default::default()
+            }
+            .to_string(),
+            "OOM kills 2"
+        );
+    }
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Result};
+use nix::{
+    errno::Errno,
+    sched::{unshare, CloneFlags},
+    sys::wait::{waitpid, WaitStatus},
+    unistd::{fork, geteuid, ForkResult},
+};
+use std::path::Path;
+
+/// The command to run to diagnose the environment, mentioned in error messages.
+pub const DOCTOR_COMMAND: &str = "bazel run //bazel/portage/bin/run_in_container -- --doctor";
+
+const DOCKER_REASON: &str = "Running in a Docker container that disallows \
+    creating namespaces. Run the container with --privileged, or at least with \
+    a seccomp profile allowing unshare(2).";
+
+/// Checks if the current process can enter new namespaces of `flags` by trying
+/// it in a forked child process.
+fn probe_unshare(flags: CloneFlags) -> Result<(), Errno> {
+    // The child process calls async-signal-safe functions only, so it is safe
+    // to fork even if the current process is multi-threaded.
+    match unsafe { fork() }? {
+        ForkResult::Child => {
+            let code = match unshare(flags) {
+                Ok(()) => 0,
+                Err(errno) => errno as i32,
+            };
+            unsafe { libc::_exit(code) };
+        }
+        ForkResult::Parent { child } => match waitpid(child, None)? {
+            WaitStatus::Exited(_, 0) => Ok(()),
+            WaitStatus::Exited(_, code) => Err(Errno::from_i32(code)),
+            _ => Err(Errno::UnknownErrno),
+        },
+    }
+}
+
+/// Reads an integer sysctl value. Returns None if the sysctl does not exist on
+/// the running kernel.
+fn read_sysctl(name: &str) -> Option<i64> {
+    let path = Path::new("/proc/sys").join(name.replace('.', "/"));
+    std::fs::read_to_string(path).ok()?.trim().parse().ok()
+}
+
+/// Returns whether the current process is running in a Docker container.
+fn in_docker() -> bool {
+    Path::new("/.dockerenv").exists()
+        || std::fs::read_to_string("/proc/1/cgroup").is_ok_and(|cgroup| cgroup.contains("docker"))
+}
+
+/// Explains why unprivileged user namespaces are unavailable.
+fn explain_user_namespace_failure(errno: Errno) -> String {
+    if read_sysctl("kernel.unprivileged_userns_clone") == Some(0) {
+        return "Unprivileged user namespaces are disabled by the kernel: \
+            kernel.unprivileged_userns_clone is 0. Run \
+            `sudo sysctl -w kernel.unprivileged_userns_clone=1` to enable them."
+            .to_string();
+    }
+    if read_sysctl("user.max_user_namespaces") == Some(0) {
+        return "User namespaces are disabled by the kernel: \
+            user.max_user_namespaces is 0. Run \
+            `sudo sysctl -w user.max_user_namespaces=<N>` with a positive N to \
+            enable them."
+            .to_string();
+    }
+    if read_sysctl("kernel.apparmor_restrict_unprivileged_userns") == Some(1) {
+        return "Unprivileged user namespaces are restricted by AppArmor: \
+            kernel.apparmor_restrict_unprivileged_userns is 1. Run \
+            `sudo sysctl -w kernel.apparmor_restrict_unprivileged_userns=0` \
+            to lift the restriction."
+            .to_string();
+    }
+    if in_docker() {
+        return DOCKER_REASON.to_string();
+    }
+    format!("Failed to create a user namespace: {errno}")
+}
+
+/// Checks that the current process can enter the namespaces of `flags`, which
+/// run_in_container needs to set up a container.
+///
+/// This fails early with a descriptive error naming the missing prerequisite,
+/// instead of a bare EPERM in the middle of setting up the container.
+pub fn check_namespaces(flags: CloneFlags) -> Result<()> {
+    let errno = match probe_unshare(flags) {
+        Ok(()) => return Ok(()),
+        Err(errno) => errno,
+    };
+
+    let reason = if geteuid().is_root() {
+        // Root in the current user namespace may still lack capabilities to
+        // create namespaces, which happens in unprivileged Docker containers.
+        if in_docker() {
+            DOCKER_REASON.to_string()
+        } else {
+            format!("Failed to create namespaces ({flags:?}) even as root: {errno}")
+        }
+    } else {
+        match probe_unshare(CloneFlags::CLONE_NEWUSER) {
+            Err(errno) => explain_user_namespace_failure(errno),
+            Ok(()) => "run_in_container must be run as root, or in a user \
+                namespace created by the caller."
+                .to_string(),
+        }
+    };
+    bail!(
+        "Cannot create a container: {reason}\n\
+         Run `{DOCTOR_COMMAND}` to diagnose the environment."
+    );
+}
+
+/// The entry point of --doctor. Prints the results of checking the
+/// prerequisites to run containers, and fails if any of them is unmet.
+pub fn doctor_main() -> Result<()> {
+    let mut ok = true;
+    let mut report = |name: &str, result: Result<(), String>| match result {
+        Ok(()) => println!("[ OK ] {name}"),
+        Err(reason) => {
+            println!("[FAIL] {name}\n       {reason}");
+            ok = false;
+        }
+    };
+
+    report(
+        "Unprivileged user namespaces",
+        probe_unshare(CloneFlags::CLONE_NEWUSER).map_err(explain_user_namespace_failure),
+    );
+
+    // Unless the current process is root, callers enter a user namespace
+    // before running containers, so probe in a new one.
+    let mut flags = CloneFlags::CLONE_NEWNS
+        | CloneFlags::CLONE_NEWPID
+        | CloneFlags::CLONE_NEWIPC
+        | CloneFlags::CLONE_NEWUTS
+        | CloneFlags::CLONE_NEWNET;
+    if !geteuid().is_root() {
+        flags |= CloneFlags::CLONE_NEWUSER;
+    }
+    report(
+        "Mount, PID, IPC, UTS and network namespaces",
+        probe_unshare(flags).map_err(|errno| format!("unshare({flags:?}) failed: {errno}")),
+    );
+
+    if !ok {
+        bail!("Some prerequisites to run containers are unmet");
+    }
+    println!("All prerequisites to run containers are met");
+    Ok(())
+}
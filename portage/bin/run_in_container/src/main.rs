@@ -2,81 +2,389 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::{Context, Result};
+mod cgroup;
+mod doctor;
+mod mount_plan;
+mod profile;
+mod stack_dump;
+
+use anyhow::{bail, ensure, Context, Result};
+use cgroup::ContainerCgroup;
 use clap::Parser;
-use cliutil::{cli_main, handle_top_level_result, log_current_command_line};
+use cliutil::{
+    cli_main, handle_top_level_result, log_current_command_line, parse_duration, LoggingArgs,
+    LoggingConfig,
+};
 use fileutil::SafeTempDir;
 use itertools::Itertools;
+use mount_plan::MountPlan;
 use nix::{
     errno::Errno,
+    fcntl::{fcntl, FcntlArg, FdFlag, OFlag},
     mount::MntFlags,
     mount::{mount, umount2, MsFlags},
-    sched::{unshare, CloneFlags},
+    sched::{setns, unshare, CloneFlags},
+    sys::signal::{kill, Signal},
     sys::socket::{socket, AddressFamily, SockFlag, SockProtocol, SockType},
-    unistd::{pivot_root, sethostname},
+    unistd::{pipe2, pivot_root, sethostname, Pid},
+};
+use processes::{status_to_exit_code, ProcessEvent};
+use run_in_container_lib::{
+    parse_cpu_limit, parse_hostname, parse_machine_id, parse_memory_limit, parse_tmpfs_size,
+    time_phase, MountPropagation, NetworkMode, ResourceLimits, RunInContainerConfig,
+    DEFAULT_HOSTNAME, DEFAULT_MACHINE_ID, SETUP_FAILURE_EXIT_CODE, TIMEOUT_EXIT_CODE,
 };
-use processes::status_to_exit_code;
-use run_in_container_lib::RunInContainerConfig;
 use std::{
+    collections::{HashMap, VecDeque},
+    ffi::OsString,
     fs::File,
+    io::{ErrorKind, Read, Write},
     os::{
         fd::{AsRawFd, FromRawFd, OwnedFd},
-        unix::fs::symlink,
+        unix::{ffi::OsStringExt, process::CommandExt},
     },
-    path::PathBuf,
+    path::{Component, Path, PathBuf},
     process::{Command, ExitCode, Stdio},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        mpsc::{channel, Receiver, RecvTimeoutError},
+        Arc,
+    },
+    time::Duration,
 };
 use tracing::info_span;
-use tracing_subscriber::filter::{EnvFilter, LevelFilter};
 
 #[derive(Parser, Debug)]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     /// A path to a serialized RunInContainerConfig.
-    #[arg(long, required = true)]
-    config: PathBuf,
+    #[arg(long, required_unless_present = "doctor")]
+    config: Option<PathBuf>,
+
+    /// Checks if the current environment meets the prerequisites to run
+    /// containers, such as support for unprivileged user namespaces, and
+    /// exits.
+    #[arg(long, exclusive = true)]
+    doctor: bool,
+
+    /// Writes the error to the specified file if run_in_container fails
+    /// before starting the command. The exit code is 125 in that case, but
+    /// the command may exit with 125 by itself as well, so callers should
+    /// check this file to tell setup failures.
+    #[arg(long)]
+    setup_error_file: Option<PathBuf>,
 
     /// Whether we are already in the namespace. Never set this, as it's as internal flag.
     #[arg(long)]
     already_in_namespace: bool,
+
+    /// Whether we are already in a systemd scope enforcing resource limits.
+    /// Never set this, as it's an internal flag.
+    #[arg(long)]
+    already_in_cgroup: bool,
+
+    /// Terminates the container if the command does not finish within the
+    /// specified duration, e.g. "90s", "30m". On expiry, SIGTERM is sent to
+    /// the processes in the container, followed by SIGKILL after
+    /// --timeout-grace-period. The exit code is 124 on timeout.
+    #[arg(long, value_parser = parse_duration)]
+    timeout: Option<Duration>,
+
+    /// Duration to wait after sending SIGTERM on timeout before sending
+    /// SIGKILL. Also used as the duration to wait for stack dumps with
+    /// --timeout-dump-stacks.
+    #[arg(long, value_parser = parse_duration, default_value = "10s")]
+    timeout_grace_period: Duration,
+
+    /// On timeout, sends SIGQUIT to the processes of the command before
+    /// terminating them, and waits for --timeout-grace-period. Go programs and
+    /// JVMs respond to SIGQUIT by dumping stacks of their threads to the
+    /// output, which helps to debug hangs.
+    #[arg(long, requires = "timeout")]
+    timeout_dump_stacks: bool,
+
+    /// Hides a path in the container, in addition to the ones specified in
+    /// the config. A directory is masked by an empty read-only tmpfs, and
+    /// other files are masked by /dev/null.
+    #[arg(long)]
+    mask_path: Vec<PathBuf>,
+
+    /// Size of the tmpfs mounted at /dev/shm, e.g. "64m" or "50%". Overrides
+    /// the size specified in the config.
+    #[arg(long, value_parser = parse_tmpfs_size)]
+    shm_size: Option<String>,
+
+    /// Exposes a host device file in the container at the same path, in
+    /// addition to the ones specified in the config, e.g. "/dev/kvm".
+    #[arg(long)]
+    device: Vec<PathBuf>,
+
+    /// Host name of the container. Overrides the host name specified in the
+    /// config. Defaults to "cros-bazel".
+    #[arg(long, value_parser = parse_hostname)]
+    hostname: Option<String>,
+
+    /// Machine ID to expose at /etc/machine-id in the container, as 32
+    /// lowercase hexadecimal digits. Overrides the machine ID specified in the
+    /// config. Defaults to a fixed value.
+    #[arg(long, value_parser = parse_machine_id)]
+    machine_id: Option<String>,
+
+    /// Network configuration of the container. Overrides the network mode
+    /// specified in the config.
+    ///
+    /// - none: only the loopback interface is available (default).
+    /// - host: the container shares the network of the host.
+    /// - slirp: the container has its own network connected to the outside
+    ///   via slirp4netns, which works without privileges. slirp4netns must be
+    ///   installed on the host.
+    #[arg(long, value_name = "none|host|slirp", verbatim_doc_comment)]
+    network: Option<NetworkMode>,
+
+    /// Limits the memory usage of the container, e.g. "16g". Processes in the
+    /// container are killed by the OOM killer on exceeding the limit.
+    #[arg(long, value_parser = parse_memory_limit)]
+    memory_limit: Option<u64>,
+
+    /// Limits the CPU usage of the container in number of CPUs, e.g. "4" or
+    /// "0.5".
+    #[arg(long, value_parser = parse_cpu_limit)]
+    cpu_limit: Option<f64>,
+
+    /// Limits the number of processes and threads in the container.
+    #[arg(long, value_parser = clap::value_parser!(u64).range(1..))]
+    pids_limit: Option<u64>,
+
+    /// Prints the time spent on each phase of setting up the container,
+    /// including the ones done before starting run_in_container such as
+    /// mounting layers, before running the command.
+    #[arg(long)]
+    profile_mounts: bool,
+
+    /// Saves the time spent on each phase of setting up the container to the
+    /// specified file in JSON.
+    #[arg(long)]
+    profile_mounts_json: Option<PathBuf>,
 }
 
 pub fn main() -> ExitCode {
     let args = Cli::parse();
 
+    if args.doctor {
+        return cli_main(doctor::doctor_main, Default::default());
+    }
+
     if !args.already_in_namespace {
-        let _guard = cliutil::LoggingConfig {
-            trace_file: None,
-            log_file: None,
-            console_logger: Some(
-                EnvFilter::builder()
-                    .with_default_directive(LevelFilter::INFO.into())
-                    .from_env_lossy(),
-            ),
-        }
-        .setup()
-        .unwrap();
+        let setup_error_file = open_setup_error_file(&args);
+        // Set up logging from the environment like cli_main does, so that
+        // the resource usage of the container is recorded in the trace of the
+        // action with --profile.
+        let _guard = match LoggingConfig::from_env().and_then(|config| config.setup()) {
+            Ok(guard) => guard,
+            Err(err) => {
+                return handle_top_level_result(exit_on_setup_failure(
+                    Err(err.context("Failed to set up logging")),
+                    setup_error_file,
+                ));
+            }
+        };
         log_current_command_line();
-        let result = || -> Result<_> {
-            enter_namespace(RunInContainerConfig::deserialize_from(&args.config)?)
-        }();
-        handle_top_level_result(result)
+        let result = || -> Result<_> { enter_namespace(load_config(&args)?, &args) }();
+        handle_top_level_result(exit_on_setup_failure(result, setup_error_file))
     } else {
+        // Open the file now as the host file system is inaccessible after
+        // pivot_root.
+        let setup_error_file = open_setup_error_file(&args);
         cli_main(
-            || continue_namespace(RunInContainerConfig::deserialize_from(&args.config)?),
+            || {
+                exit_on_setup_failure(
+                    load_config(&args).and_then(|cfg| continue_namespace(cfg, &args)),
+                    setup_error_file,
+                )
+            },
             Default::default(),
         )
     }
 }
 
-fn enter_namespace(cfg: RunInContainerConfig) -> Result<ExitCode> {
+/// Whether the current process has started the command, or the child
+/// run_in_container process that sets up the container and runs the command.
+/// Errors after that are not failures to set up the container.
+static COMMAND_STARTED: AtomicBool = AtomicBool::new(false);
+
+/// Reports an error that happened before starting the command, which means
+/// that we failed to set up the container, to --setup-error-file and exits
+/// with [`SETUP_FAILURE_EXIT_CODE`]. Errors after starting the command are
+/// returned as is.
+fn exit_on_setup_failure(
+    result: Result<ExitCode>,
+    setup_error_file: Option<File>,
+) -> Result<ExitCode> {
+    match result {
+        Err(err) if !COMMAND_STARTED.load(Ordering::SeqCst) => {
+            eprintln!("FATAL: run_in_container: {err:?}");
+            if let Some(mut file) = setup_error_file {
+                if let Err(write_err) = write!(file, "{err:#}") {
+                    eprintln!("Failed to write to --setup-error-file: {write_err}");
+                }
+            }
+            Ok(ExitCode::from(SETUP_FAILURE_EXIT_CODE))
+        }
+        result => result,
+    }
+}
+
+/// Opens --setup-error-file for [`exit_on_setup_failure`] if specified.
+fn open_setup_error_file(args: &Cli) -> Option<File> {
+    let path = args.setup_error_file.as_ref()?;
+    match File::create(path) {
+        Ok(file) => Some(file),
+        Err(err) => {
+            eprintln!("Failed to create {path:?}: {err}");
+            None
+        }
+    }
+}
+
+/// Loads [`RunInContainerConfig`] and applies overrides given in the command
+/// line.
+fn load_config(args: &Cli) -> Result<RunInContainerConfig> {
+    let config = args.config.as_ref().context("--config is required")?;
+    let mut cfg = RunInContainerConfig::deserialize_from(config)?;
+    cfg.mask_paths.extend(args.mask_path.iter().cloned());
+    cfg.devices.extend(args.device.iter().cloned());
+    if let Some(shm_size) = &args.shm_size {
+        cfg.shm_size = Some(shm_size.clone());
+    }
+    if let Some(hostname) = &args.hostname {
+        cfg.hostname = Some(hostname.clone());
+    }
+    if let Some(machine_id) = &args.machine_id {
+        cfg.machine_id = Some(machine_id.clone());
+    }
+    if let Some(network) = args.network {
+        cfg.network = network;
+    }
+    Ok(cfg)
+}
+
+/// Returns resource limits specified in the command line.
+fn resource_limits(args: &Cli) -> ResourceLimits {
+    ResourceLimits {
+        memory: args.memory_limit,
+        cpus: args.cpu_limit,
+        pids: args.pids_limit,
+    }
+}
+
+/// Sets up a cgroup enforcing resource limits of the container.
+///
+/// A child of the current cgroup is created if the current cgroup is
+/// delegated to the user. Otherwise, the current process is re-executed in a
+/// transient scope created by systemd-run. Returns `None` if no limit is set.
+fn setup_cgroup(args: &Cli) -> Result<Option<ContainerCgroup>> {
+    let limits = resource_limits(args);
+    if limits.is_empty() {
+        return Ok(None);
+    }
+    if args.already_in_cgroup {
+        return Ok(Some(ContainerCgroup::current()?));
+    }
+    if let Some(cgroup) = ContainerCgroup::create(&limits)? {
+        return Ok(Some(cgroup));
+    }
+    match cgroup::exec_in_systemd_scope(&limits, "--already-in-cgroup")? {}
+}
+
+/// Terminates the container if the command does not exit within `timeout`.
+///
+/// `pid` is the PID of the init process of the container's PID namespace
+/// (dumb-init), and `exited` must be notified or disconnected when it exits.
+/// If `dump_stacks` is set, SIGQUIT is sent to the processes of the command
+/// first so that they can dump their stacks within `grace_period`.
+/// Then SIGTERM is sent to the init process, which forwards it to the
+/// command. If it is still running after `grace_period`, SIGKILL is sent to the
+/// init process, which makes the kernel kill all processes in the PID
+/// namespace. This in turn releases the mount namespace of the container,
+/// tearing down all mounts made in it before the init process is reaped.
+fn start_watchdog(
+    pid: u32,
+    timeout: Duration,
+    grace_period: Duration,
+    dump_stacks: bool,
+    exited: Receiver<()>,
+    timed_out: Arc<AtomicBool>,
+) -> Result<()> {
+    let pid = Pid::from_raw(pid.try_into()?);
+    std::thread::spawn(move || {
+        if exited.recv_timeout(timeout) != Err(RecvTimeoutError::Timeout) {
+            return;
+        }
+        timed_out.store(true, Ordering::SeqCst);
+
+        if dump_stacks {
+            match stack_dump::request_stack_dumps(pid) {
+                Ok(processes) => {
+                    eprintln!(
+                        "Command timed out after {timeout:?}; sent SIGQUIT to dump stacks: {}",
+                        processes
+                            .iter()
+                            .map(|process| format!("{} ({})", process.pid, process.comm))
+                            .join(", ")
+                    );
+                }
+                Err(err) => {
+                    eprintln!(
+                        "Command timed out after {timeout:?}; failed to dump stacks: {err:#}"
+                    );
+                }
+            }
+            if exited.recv_timeout(grace_period) != Err(RecvTimeoutError::Timeout) {
+                return;
+            }
+        }
+
+        eprintln!("Command timed out after {timeout:?}; sending SIGTERM");
+        // The init process may have exited in the meantime, so ignore errors.
+        let _ = kill(pid, Signal::SIGTERM);
+
+        if exited.recv_timeout(grace_period) != Err(RecvTimeoutError::Timeout) {
+            return;
+        }
+        eprintln!("Command did not exit within {grace_period:?}; sending SIGKILL");
+        let _ = kill(pid, Signal::SIGKILL);
+    });
+    Ok(())
+}
+
+fn enter_namespace(cfg: RunInContainerConfig, cli: &Cli) -> Result<ExitCode> {
     let r = runfiles::Runfiles::create()?;
     let dumb_init_path = runfiles::rlocation!(r, "files/dumb_init");
 
+    // Set up a cgroup first as we may re-execute the current process.
+    let cgroup = setup_cgroup(cli).context("Failed to set up resource limits")?;
+
     // Enter various namespaces except mount/PID namespace.
+    // In the slirp mode, the network namespace is created by the sentinel
+    // process below instead, so that slirp4netns can be started in the current
+    // network namespace.
     let mut unshare_flags = CloneFlags::CLONE_NEWIPC | CloneFlags::CLONE_NEWUTS;
-    if !cfg.allow_network_access {
+    if cfg.network == NetworkMode::None {
         unshare_flags |= CloneFlags::CLONE_NEWNET;
     }
+
+    // Fail early with a descriptive error if the environment disallows
+    // creating the namespaces we need, e.g. in unprivileged Docker containers.
+    let mut check_flags = unshare_flags | CloneFlags::CLONE_NEWPID | CloneFlags::CLONE_NEWNS;
+    if cfg.network == NetworkMode::Slirp {
+        check_flags |= CloneFlags::CLONE_NEWNET;
+    }
+    doctor::check_namespaces(check_flags)?;
+
     unshare(unshare_flags)
         .with_context(|| format!("Failed to enter namespaces (flags={:?})", unshare_flags))?;
 
@@ -98,15 +406,30 @@ fn enter_namespace(cfg: RunInContainerConfig) -> Result<ExitCode> {
     // once the current process calls unshare(CLONE_NEWPID), it is limited to
     // call fork at most once. But fortunately it seems like destroying a PID
     // namespace is cheap.
-    let sentinel = Command::new("/bin/cat")
+    let mut sentinel_command = Command::new("/bin/cat");
+    sentinel_command
         .stdin(Stdio::piped())
         .stdout(Stdio::null())
-        .stderr(Stdio::null())
-        .spawn()?;
+        .stderr(Stdio::null());
+    if cfg.network == NetworkMode::Slirp {
+        // SAFETY: unshare is async-signal-safe.
+        unsafe {
+            sentinel_command.pre_exec(|| {
+                unshare(CloneFlags::CLONE_NEWNET)?;
+                Ok(())
+            });
+        }
+    }
+    let sentinel = sentinel_command.spawn()?;
+    if cfg.network == NetworkMode::Slirp {
+        enter_slirp_network(sentinel.id())?;
+    }
     std::mem::forget(sentinel);
 
-    // Set the host name to the fixed one.
-    sethostname("ephemeral").context("Failed to set the host name")?;
+    // Set the host name to the fixed one so that it doesn't leak into build
+    // artifacts.
+    sethostname(cfg.hostname.as_deref().unwrap_or(DEFAULT_HOSTNAME))
+        .context("Failed to set the host name")?;
 
     // Enter a PID namespace.
     unshare(CloneFlags::CLONE_NEWPID).context("Failed to enter PID namespace")?;
@@ -132,19 +455,143 @@ fn enter_namespace(cfg: RunInContainerConfig) -> Result<ExitCode> {
     // in the PID namespace to shut down cleanly, then wait for all processes
     // to exit.
     let args: Vec<String> = std::env::args().collect();
-    let status = processes::run(
-        Command::new(dumb_init_path)
-            .arg("--single-child")
-            .arg(&args[0])
-            .arg("--already-in-namespace")
-            .args(&args[1..])
-            .env("TMPDIR", temp_dir.path()),
-    )?;
+    let timed_out = Arc::new(AtomicBool::new(false));
+    let (exited_sender, exited_receiver) = channel();
+    let mut exited_receiver = Some(exited_receiver);
+    let mut watchdog_result = Ok(());
+    let mut command = Command::new(dumb_init_path);
+    command
+        .arg("--single-child")
+        .arg(&args[0])
+        .arg("--already-in-namespace")
+        .args(&args[1..])
+        .env("TMPDIR", temp_dir.path());
+    // Move the init process to the cgroup so that all processes in the
+    // container are subject to the resource limits.
+    let cgroup_procs = match &cgroup {
+        Some(cgroup) => cgroup.open_procs()?,
+        None => None,
+    };
+    if let Some(cgroup_procs) = &cgroup_procs {
+        let fd = cgroup_procs.as_raw_fd();
+        // SAFETY: write is async-signal-safe.
+        unsafe {
+            command.pre_exec(move || {
+                let res = libc::write(fd, b"0".as_ptr() as *const libc::c_void, 1);
+                Errno::result(res)?;
+                Ok(())
+            });
+        }
+    }
+    let status = processes::run_with_observer(&mut command, |event| match *event {
+        ProcessEvent::Started { pid } => {
+            // The child process reports its own setup failures.
+            COMMAND_STARTED.store(true, Ordering::SeqCst);
+            if let (Some(timeout), Some(exited)) = (cli.timeout, exited_receiver.take()) {
+                watchdog_result = start_watchdog(
+                    pid,
+                    timeout,
+                    cli.timeout_grace_period,
+                    cli.timeout_dump_stacks,
+                    exited,
+                    timed_out.clone(),
+                );
+            }
+        }
+        ProcessEvent::Exited { .. } => {
+            let _ = exited_sender.send(());
+        }
+        _ => {}
+    })?;
+    watchdog_result.context("Failed to start the timeout watchdog")?;
+    drop(cgroup_procs);
+
+    if let Some(cgroup) = &cgroup {
+        let usage = cgroup.usage();
+        tracing::info!(
+            peak_memory_bytes = usage.peak_memory,
+            cpu_time_usec = usage.cpu_time.map(|d| d.as_micros() as u64),
+            peak_pids = usage.peak_pids,
+            oom_kills = usage.oom_kills,
+            "Container resource usage: {usage}"
+        );
+        if usage.oom_kills.unwrap_or_default() > 0 {
+            eprintln!("Processes in the container were killed for exceeding --memory-limit");
+        }
+    }
+
+    if timed_out.load(Ordering::SeqCst) {
+        if cli.timeout_dump_stacks {
+            eprintln!(
+                "Command was terminated due to --timeout; see the output above for stack dumps"
+            );
+        } else {
+            eprintln!("Command was terminated due to --timeout");
+        }
+        return Ok(ExitCode::from(TIMEOUT_EXIT_CODE));
+    }
 
     // Propagate the exit status of the command.
     Ok(status_to_exit_code(&status))
 }
 
+/// Connects the network namespace of the process `pid` to the outside with
+/// slirp4netns, and makes the current process enter the namespace.
+///
+/// slirp4netns is started in the current network namespace and exits when
+/// the current process exits.
+fn enter_slirp_network(pid: u32) -> Result<()> {
+    let (ready_reader, ready_writer) = pipe2(OFlag::O_CLOEXEC).context("pipe2 failed")?;
+    let (exit_reader, exit_writer) = pipe2(OFlag::O_CLOEXEC).context("pipe2 failed")?;
+    let mut ready_reader = unsafe { File::from_raw_fd(ready_reader) };
+    let ready_writer = unsafe { OwnedFd::from_raw_fd(ready_writer) };
+    let exit_reader = unsafe { OwnedFd::from_raw_fd(exit_reader) };
+
+    let child_fds = [ready_writer.as_raw_fd(), exit_reader.as_raw_fd()];
+    let mut command = Command::new("slirp4netns");
+    command
+        .arg("--configure")
+        .arg("--mtu=65520")
+        .arg("--disable-host-loopback")
+        .arg(format!("--ready-fd={}", child_fds[0]))
+        .arg(format!("--exit-fd={}", child_fds[1]))
+        .arg(pid.to_string())
+        .arg("tap0")
+        .stdin(Stdio::null())
+        .stdout(Stdio::null());
+    // SAFETY: fcntl is async-signal-safe.
+    unsafe {
+        command.pre_exec(move || {
+            for fd in child_fds {
+                fcntl(fd, FcntlArg::F_SETFD(FdFlag::empty()))?;
+            }
+            Ok(())
+        });
+    }
+    let child = command
+        .spawn()
+        .context("Failed to start slirp4netns; is it installed?")?;
+    std::mem::forget(child);
+    // Leave the write end of the exit pipe open. slirp4netns exits when it is
+    // closed, which happens when the current process exits.
+    let _ = exit_writer;
+    drop(ready_writer);
+    drop(exit_reader);
+
+    // slirp4netns writes a byte to the ready pipe once it has configured the
+    // network. The pipe is closed without data if it fails.
+    let mut buf = [0u8; 1];
+    if ready_reader.read(&mut buf)? == 0 {
+        bail!("slirp4netns failed to set up the network");
+    }
+
+    let netns = File::open(format!("/proc/{pid}/ns/net"))
+        .with_context(|| format!("Failed to open the network namespace of {pid}"))?;
+    setns(netns.as_raw_fd(), CloneFlags::CLONE_NEWNET)
+        .context("Failed to enter the network namespace")?;
+    Ok(())
+}
+
 /// Enables the loopback networking.
 fn enable_loopback_networking() -> Result<()> {
     let socket = unsafe {
@@ -181,117 +628,262 @@ fn enable_loopback_networking() -> Result<()> {
     Ok(())
 }
 
-fn mount_filesystems(cfg: &RunInContainerConfig) -> Result<()> {
-    // Remount all file systems as private so that we never interact with the
-    // original namespace. This is needed when the current process is privileged
-    // and did not enter an unprivileged user namespace.
-    mount(
-        Some(""),
-        "/",
-        Some(""),
-        MsFlags::MS_PRIVATE | MsFlags::MS_REC,
-        Some(""),
-    )
-    .context("Failed to remount file systems as private")?;
-
-    // Populate /dev with a minimal set of files. Note that we can't call mknod
-    // to create them as it requires privileges.
-    mount(
-        Some("dev"),
-        &cfg.root_dir.join("dev"),
-        Some("tmpfs"),
-        MsFlags::empty(),
-        Some("mode=0555,size=64k"),
-    )
-    .context("Failed to mount tmpfs at /dev")?;
-
-    for name in ["full", "fuse", "null", "tty", "urandom", "zero"] {
-        let target = cfg.root_dir.join("dev").join(name);
-        File::create(&target).with_context(|| format!("Failed to touch /dev/{name}"))?;
+/// Decodes the octal escapes (e.g. `\040` for a space) used in
+/// /proc/self/mountinfo.
+fn unescape_mountinfo(field: &str) -> Vec<u8> {
+    let bytes = field.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        match bytes.get(i..i + 4) {
+            Some([b'\\', a @ b'0'..=b'3', b @ b'0'..=b'7', c @ b'0'..=b'7']) => {
+                out.push((a - b'0') * 64 + (b - b'0') * 8 + (c - b'0'));
+                i += 4;
+            }
+            _ => {
+                out.push(bytes[i]);
+                i += 1;
+            }
+        }
+    }
+    out
+}
+
+/// Returns the mount points in the current mount namespace.
+fn list_mount_points() -> Result<Vec<PathBuf>> {
+    let contents = std::fs::read_to_string("/proc/self/mountinfo")
+        .context("Failed to read /proc/self/mountinfo")?;
+    contents
+        .lines()
+        .map(|line| {
+            let field = line
+                .split(' ')
+                .nth(4)
+                .with_context(|| format!("Malformed mountinfo line: {line:?}"))?;
+            Ok(PathBuf::from(OsString::from_vec(unescape_mountinfo(field))))
+        })
+        .collect()
+}
+
+/// Remounts all file systems as private so that we never interact with the
+/// original namespace, except bind mounts whose propagation is configured
+/// otherwise. This is needed when the current process is privileged and did
+/// not enter an unprivileged user namespace.
+fn set_mount_propagation(cfg: &RunInContainerConfig) -> Result<()> {
+    let propagations = cfg
+        .bind_mounts
+        .iter()
+        .filter(|spec| spec.propagation != MountPropagation::Private)
+        .map(|spec| {
+            let path = cfg.root_dir.join(
+                spec.mount_path
+                    .strip_prefix("/")
+                    .unwrap_or(&spec.mount_path),
+            );
+            let path = path
+                .canonicalize()
+                .with_context(|| format!("Failed to resolve {}", path.display()))?;
+            Ok((path, spec.propagation))
+        })
+        .collect::<Result<HashMap<_, _>>>()?;
+
+    if propagations.is_empty() {
         mount(
-            Some(format!("/dev/{name}").as_str()),
-            &target,
             Some(""),
-            MsFlags::MS_BIND,
+            "/",
+            Some(""),
+            MsFlags::MS_PRIVATE | MsFlags::MS_REC,
             Some(""),
         )
-        .with_context(|| format!("Failed to bind-mount /dev/{name}"))?;
-    }
-    for (name, original) in [
-        ("ptmx", "pts/ptmx"),
-        ("fd", "/proc/self/fd"),
-        ("stdin", "fd/0"),
-        ("stdout", "fd/1"),
-        ("stderr", "fd/2"),
-    ] {
-        symlink(original, cfg.root_dir.join("dev").join(name))
-            .with_context(|| format!("Failed to symlink /dev/{name} to {original}"))?;
-    }
-
-    // Mount /dev/pts.
-    std::fs::create_dir(cfg.root_dir.join("dev/pts")).context("Failed to mkdir /dev/pts")?;
-    mount(
-        Some("devpts"),
-        &cfg.root_dir.join("dev/pts"),
-        Some("devpts"),
-        MsFlags::empty(),
-        Some("newinstance,mode=0620,ptmxmode=0666"),
-    )
-    .context("Failed to mount /dev/pts")?;
-
-    // Mount /dev/shm.
-    std::fs::create_dir(cfg.root_dir.join("dev/shm")).context("Failed to mkdir /dev/shm")?;
-    mount(
-        Some("tmpfs"),
-        &cfg.root_dir.join("dev/shm"),
-        Some("tmpfs"),
-        MsFlags::MS_NODEV | MsFlags::MS_NOSUID,
-        Some(""),
-    )
-    .context("Failed to mount /dev/shm")?;
-
-    mount(
-        Some(""),
-        &cfg.root_dir.join("dev"),
-        Some(""),
-        MsFlags::MS_REMOUNT | MsFlags::MS_RDONLY,
-        Some(""),
-    )
-    .context("Failed to remount /dev read-only")?;
-
-    // Mount /proc. It is done here, not in the container crate, because we need
-    // to enter a PID namespace to mount one.
-    mount(
-        Some("/proc"),
-        &cfg.root_dir.join("proc"),
-        Some("proc"),
-        MsFlags::empty(),
-        Some(""),
-    )
-    .context("Failed to mount /proc")?;
-
-    // Mount read-only tmpfs at /sys. We don't mount the real sysfs there
-    // because it exposes good amount of host details, which can lead to
-    // non-reproducible build results.
-    mount(
-        Some("sys"),
-        &cfg.root_dir.join("sys"),
-        Some("tmpfs"),
-        MsFlags::empty(),
-        Some("ro,mode=0555,size=64k"),
-    )
-    .context("Failed to mount tmpfs on /sys")?;
+        .context("Failed to remount file systems as private")?;
+        return Ok(());
+    }
 
+    // Remounting "/" recursively would also detach the bind mounts to keep from
+    // their peer groups, so update mounts one by one.
+    for mount_point in list_mount_points()? {
+        let flags = match propagations.get(&mount_point) {
+            Some(MountPropagation::Shared) => continue,
+            Some(MountPropagation::Slave) => MsFlags::MS_SLAVE,
+            _ => MsFlags::MS_PRIVATE,
+        };
+        match mount(
+            None::<&str>,
+            &mount_point,
+            None::<&str>,
+            flags,
+            None::<&str>,
+        ) {
+            // Mounts hidden under other mounts are unreachable by path, and
+            // thus can't be used by the container either.
+            Err(Errno::ENOENT | Errno::EINVAL) => {}
+            other => other.with_context(|| {
+                format!(
+                    "Failed to change the propagation of {}",
+                    mount_point.display()
+                )
+            })?,
+        }
+    }
     Ok(())
 }
 
-fn continue_namespace(cfg: RunInContainerConfig) -> Result<ExitCode> {
-    unshare(CloneFlags::CLONE_NEWNS).context("Failed to enter mount namespace")?;
+fn mount_filesystems(cfg: &RunInContainerConfig) -> Result<()> {
+    MountPlan::essential_filesystems(cfg.shm_size.as_deref(), &cfg.devices).apply(&cfg.root_dir)?;
+    MountPlan::runtime_directories().apply(&cfg.root_dir)
+}
+
+/// Bind-mounts a file containing the fixed machine ID at /etc/machine-id so
+/// that the machine ID of the host doesn't leak into build artifacts.
+///
+/// The container crate provides /etc/machine-id as a mount point in its stage
+/// directory so that it never lands in the upper directory. This is skipped if
+/// the container has no regular file there.
+fn mount_machine_id(cfg: &RunInContainerConfig) -> Result<()> {
+    let mount_point = cfg.root_dir.join("etc/machine-id");
+    match std::fs::symlink_metadata(&mount_point) {
+        Ok(metadata) if metadata.is_file() => {}
+        Ok(_) => return Ok(()),
+        Err(err) if err.kind() == ErrorKind::NotFound => return Ok(()),
+        Err(err) => {
+            return Err(err).with_context(|| format!("Failed to stat {}", mount_point.display()))
+        }
+    }
+
+    // Write the machine ID to a private directory as TMPDIR may be shared
+    // with other containers. The bind mount keeps the file alive after the
+    // directory is removed.
+    let source_dir = SafeTempDir::new()?;
+    let source = source_dir.path().join("machine-id");
+    let machine_id = cfg.machine_id.as_deref().unwrap_or(DEFAULT_MACHINE_ID);
+    std::fs::write(&source, format!("{machine_id}\n"))
+        .with_context(|| format!("Failed to write {}", source.display()))?;
+    MountPlan::machine_id(&source).apply(&cfg.root_dir)
+}
 
-    mount_filesystems(&cfg)?;
+/// The maximum number of symlinks to follow when resolving a path, which
+/// matches the kernel's limit.
+const MAX_SYMLINK_FOLLOWS: usize = 40;
+
+/// Resolves symlinks in `path` as if `root_dir` were the file system root.
+///
+/// Symlinks must not be resolved against the real file system root, otherwise
+/// an absolute symlink in the container could make us mount over a host path.
+/// The returned path is relative to `root_dir`. Components that do not exist
+/// are kept as-is.
+fn resolve_in_root(root_dir: &Path, path: &Path) -> Result<PathBuf> {
+    fn components(path: &Path) -> impl Iterator<Item = OsString> + '_ {
+        path.components().filter_map(|c| match c {
+            Component::Normal(name) => Some(name.to_owned()),
+            Component::ParentDir => Some("..".into()),
+            _ => None,
+        })
+    }
 
-    if !cfg.allow_network_access {
-        enable_loopback_networking()?;
+    let mut resolved = PathBuf::new();
+    let mut pending: VecDeque<OsString> = components(path).collect();
+    let mut follows = 0;
+    while let Some(name) = pending.pop_front() {
+        if name == ".." {
+            resolved.pop();
+            continue;
+        }
+        let candidate = resolved.join(&name);
+        let real_path = root_dir.join(&candidate);
+        match std::fs::symlink_metadata(&real_path) {
+            Ok(metadata) if metadata.is_symlink() => {
+                follows += 1;
+                ensure!(
+                    follows <= MAX_SYMLINK_FOLLOWS,
+                    "Too many levels of symbolic links: {}",
+                    path.display()
+                );
+                let link = std::fs::read_link(&real_path)
+                    .with_context(|| format!("Failed to read symlink {}", candidate.display()))?;
+                if link.is_absolute() {
+                    resolved = PathBuf::new();
+                }
+                for c in components(&link).collect::<Vec<_>>().into_iter().rev() {
+                    pending.push_front(c);
+                }
+            }
+            _ => resolved = candidate,
+        }
+    }
+    Ok(resolved)
+}
+
+/// Returns a plan to hide paths listed in
+/// [`RunInContainerConfig::mask_paths`].
+///
+/// This must be applied after all other file systems are mounted under the
+/// root directory so that masks take precedence.
+fn mask_paths_plan(cfg: &RunInContainerConfig) -> Result<MountPlan> {
+    let mut plan = MountPlan::new();
+    for path in cfg.mask_paths.iter() {
+        if !path.is_absolute() {
+            bail!("Mask path {} must be absolute", path.display());
+        }
+        let resolved = resolve_in_root(&cfg.root_dir, path)?;
+        let metadata = match std::fs::metadata(cfg.root_dir.join(&resolved)) {
+            Ok(metadata) => metadata,
+            // There is nothing to hide.
+            Err(err) if err.kind() == ErrorKind::NotFound => continue,
+            Err(err) => {
+                return Err(err).with_context(|| format!("Failed to stat {}", path.display()))
+            }
+        };
+        let target = Path::new("/").join(resolved);
+        if metadata.is_dir() {
+            plan.push_mount(
+                "tmpfs",
+                target,
+                "tmpfs",
+                MsFlags::MS_RDONLY | MsFlags::MS_NODEV | MsFlags::MS_NOSUID | MsFlags::MS_NOEXEC,
+                "mode=0555,size=4k",
+            );
+        } else {
+            plan.push_mount("/dev/null", target, "", MsFlags::MS_BIND, "");
+        }
+    }
+    Ok(plan)
+}
+
+fn continue_namespace(cfg: RunInContainerConfig, cli: &Cli) -> Result<ExitCode> {
+    let mut phases = cfg.setup_phases.clone();
+
+    time_phase(&mut phases, "mount namespace", || {
+        unshare(CloneFlags::CLONE_NEWNS).context("Failed to enter mount namespace")
+    })?;
+
+    // Open the profile output now as the host file system is inaccessible
+    // after pivot_root.
+    let profile_json = cli
+        .profile_mounts_json
+        .as_ref()
+        .map(|path| File::create(path).with_context(|| format!("Failed to create {path:?}")))
+        .transpose()?;
+
+    time_phase(&mut phases, "mount propagation", || {
+        set_mount_propagation(&cfg)
+    })?;
+
+    time_phase(&mut phases, "/dev, /proc, /sys and /run", || {
+        mount_filesystems(&cfg)
+    })?;
+
+    time_phase(&mut phases, "/etc/machine-id", || mount_machine_id(&cfg))?;
+
+    time_phase(&mut phases, "mask paths", || {
+        mask_paths_plan(&cfg)?.apply(&cfg.root_dir)
+    })?;
+
+    if cfg.network != NetworkMode::Host {
+        time_phase(
+            &mut phases,
+            "loopback networking",
+            enable_loopback_networking,
+        )?;
     }
 
     // We switch into the root dir so that pivot_root will automatically update
@@ -299,12 +891,23 @@ fn continue_namespace(cfg: RunInContainerConfig) -> Result<ExitCode> {
     std::env::set_current_dir(&cfg.root_dir)
         .with_context(|| format!("Failed to `cd {}`", cfg.root_dir.display()))?;
 
-    pivot_root(".", &cfg.root_dir.join("host")).context("Failed to pivot root")?;
+    time_phase(&mut phases, "pivot_root", || {
+        pivot_root(".", &cfg.root_dir.join("host")).context("Failed to pivot root")
+    })?;
 
     if !cfg.keep_host_mount {
         // Do a lazy unmount with DETACH. Since the binary is dynamically linked, we still have some
         // file descriptors such as /host/usr/lib/x86_64-linux-gnu/libc.so.6 open.
-        umount2("/host", MntFlags::MNT_DETACH).context("Failed to unmount /host")?;
+        time_phase(&mut phases, "unmount /host", || {
+            umount2("/host", MntFlags::MNT_DETACH).context("Failed to unmount /host")
+        })?;
+    }
+
+    if cli.profile_mounts {
+        eprint!("{}", profile::format_table(&phases));
+    }
+    if let Some(file) = profile_json {
+        serde_json::to_writer_pretty(file, &profile::to_json(&phases))?;
     }
 
     let escaped_command = cfg
@@ -316,15 +919,63 @@ fn continue_namespace(cfg: RunInContainerConfig) -> Result<ExitCode> {
 
     let status = {
         let _span = info_span!("run", command = escaped_command).entered();
-        processes::run(
+        processes::run_with_observer(
             Command::new(&cfg.args[0])
                 .args(&cfg.args[1..])
                 .env_clear()
                 .envs(cfg.envs)
                 .current_dir(cfg.chdir),
+            |event| {
+                if let ProcessEvent::Started { .. } = event {
+                    COMMAND_STARTED.store(true, Ordering::SeqCst);
+                }
+            },
         )
         .with_context(|| format!("Failed command: {}", escaped_command))?
     };
 
     Ok(status_to_exit_code(&status))
 }
+
+#[cfg(test)]
+mod tests {
+    use std::os::unix::fs::symlink;
+
+    use super::*;
+
+    #[test]
+    fn test_resolve_in_root() -> Result<()> {
+        let root = SafeTempDir::new()?;
+        let root = root.path();
+        std::fs::create_dir_all(root.join("usr/share/zoneinfo"))?;
+        std::fs::create_dir_all(root.join("etc"))?;
+        File::create(root.join("usr/share/zoneinfo/UTC"))?;
+        symlink("/usr/share/zoneinfo/UTC", root.join("etc/localtime"))?;
+        symlink("../usr/share", root.join("etc/share"))?;
+        symlink("loop", root.join("loop"))?;
+
+        assert_eq!(
+            resolve_in_root(root, Path::new("/etc/localtime"))?,
+            PathBuf::from("usr/share/zoneinfo/UTC")
+        );
+        assert_eq!(
+            resolve_in_root(root, Path::new("/etc/share/zoneinfo"))?,
+            PathBuf::from("usr/share/zoneinfo")
+        );
+        assert_eq!(
+            resolve_in_root(root, Path::new("/etc/../../../etc/missing"))?,
+            PathBuf::from("etc/missing")
+        );
+        assert!(resolve_in_root(root, Path::new("/loop")).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_unescape_mountinfo() {
+        assert_eq!(unescape_mountinfo("/mnt/a\\040b"), b"/mnt/a b");
+        assert_eq!(unescape_mountinfo("/mnt/a\\134b"), b"/mnt/a\\b");
+        assert_eq!(unescape_mountinfo("/mnt/a\\b"), b"/mnt/a\\b");
+        assert_eq!(unescape_mountinfo("/mnt/a\\04"), b"/mnt/a\\04");
+    }
+}
@@ -0,0 +1,407 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use nix::mount::{mount, MsFlags};
+use std::{
+    fmt::{Display, Formatter},
+    fs::File,
+    io::ErrorKind,
+    os::unix::fs::symlink,
+    path::{Path, PathBuf},
+};
+
+/// Mount flags rendered as mount(8) options, in the order they're rendered.
+const FLAG_NAMES: &[(MsFlags, &str)] = &[
+    (MsFlags::MS_REMOUNT, "remount"),
+    (MsFlags::MS_RDONLY, "ro"),
+    (MsFlags::MS_NODEV, "nodev"),
+    (MsFlags::MS_NOSUID, "nosuid"),
+    (MsFlags::MS_NOEXEC, "noexec"),
+];
+
+/// A step to set up file systems in a container.
+///
+/// Paths are absolute paths in the container, and are resolved against the
+/// root directory of the container when the step is applied.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum MountStep {
+    /// Creates an empty file to bind-mount a file on, unless it exists.
+    Touch(PathBuf),
+    /// Creates a directory, unless it exists.
+    Mkdir(PathBuf),
+    /// Creates a symlink.
+    Symlink { original: PathBuf, link: PathBuf },
+    /// Mounts a file system, or bind-mounts a host path if `flags` contains
+    /// `MS_BIND`.
+    Mount {
+        source: String,
+        target: PathBuf,
+        fstype: String,
+        flags: MsFlags,
+        data: String,
+    },
+}
+
+impl MountStep {
+    fn apply(&self, root_dir: &Path) -> Result<()> {
+        let resolve = |path: &Path| root_dir.join(path.strip_prefix("/").unwrap_or(path));
+        match self {
+            Self::Touch(path) => {
+                let path = resolve(path);
+                if !path.exists() {
+                    File::create(&path)?;
+                }
+            }
+            Self::Mkdir(path) => match std::fs::create_dir(resolve(path)) {
+                Err(err) if err.kind() != ErrorKind::AlreadyExists => return Err(err.into()),
+                _ => {}
+            },
+            Self::Symlink { original, link } => symlink(original, resolve(link))?,
+            Self::Mount {
+                source,
+                target,
+                fstype,
+                flags,
+                data,
+            } => mount(
+                Some(source.as_str()),
+                &resolve(target),
+                Some(fstype.as_str()),
+                *flags,
+                Some(data.as_str()),
+            )?,
+        }
+        Ok(())
+    }
+}
+
+impl Display for MountStep {
+    /// Renders the step as a shell command.
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Touch(path) => write!(f, "touch {}", path.display()),
+            Self::Mkdir(path) => write!(f, "mkdir {}", path.display()),
+            Self::Symlink { original, link } => {
+                write!(f, "ln -s {} {}", original.display(), link.display())
+            }
+            Self::Mount {
+                source,
+                target,
+                fstype,
+                flags,
+                data,
+            } => {
+                write!(f, "mount")?;
+                if flags.contains(MsFlags::MS_BIND) {
+                    write!(f, " --bind")?;
+                }
+                if !fstype.is_empty() {
+                    write!(f, " -t {fstype}")?;
+                }
+                let options: Vec<&str> = FLAG_NAMES
+                    .iter()
+                    .filter(|(flag, _)| flags.contains(*flag))
+                    .map(|(_, name)| *name)
+                    .chain((!data.is_empty()).then_some(data.as_str()))
+                    .collect();
+                if !options.is_empty() {
+                    write!(f, " -o {}", options.join(","))?;
+                }
+                if !source.is_empty() {
+                    write!(f, " {source}")?;
+                }
+                write!(f, " {}", target.display())
+            }
+        }
+    }
+}
+
+/// Describes file systems to set up under the root directory of a container
+/// as a sequence of steps, so that the layout can be tested without mounting
+/// anything. Applying a plan again fails only at steps that can't be
+/// repeated, i.e. symlinks and mounts.
+///
+/// Only mounts under the root directory before pivot_root are described.
+/// Changing the propagation of existing mounts, pivot_root and unmounting the
+/// host file system act on the mount table of the host, which is known only at
+/// run time, so run_in_container does them directly.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct MountPlan {
+    steps: Vec<MountStep>,
+}
+
+impl MountPlan {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn push(&mut self, step: MountStep) -> &mut Self {
+        self.steps.push(step);
+        self
+    }
+
+    /// Appends a step to mount a file system.
+    pub fn push_mount(
+        &mut self,
+        source: &str,
+        target: impl Into<PathBuf>,
+        fstype: &str,
+        flags: MsFlags,
+        data: &str,
+    ) -> &mut Self {
+        self.push(MountStep::Mount {
+            source: source.to_owned(),
+            target: target.into(),
+            fstype: fstype.to_owned(),
+            flags,
+            data: data.to_owned(),
+        })
+    }
+
+    /// Returns a plan to set up /dev, /proc and /sys.
+    ///
+    /// `shm_size` is the size of the tmpfs mounted at /dev/shm. `devices` are
+    /// host device files to expose at the same paths in addition to the
+    /// minimal set of devices.
+    pub fn essential_filesystems(shm_size: Option<&str>, devices: &[PathBuf]) -> Self {
+        let mut plan = Self::new();
+
+        // Populate /dev with a minimal set of files. Note that we can't call
+        // mknod to create them as it requires privileges.
+        plan.push_mount(
+            "dev",
+            "/dev",
+            "tmpfs",
+            MsFlags::empty(),
+            "mode=0555,size=64k",
+        );
+        for name in ["full", "fuse", "null", "tty", "urandom", "zero"] {
+            let path = format!("/dev/{name}");
+            plan.push(MountStep::Touch(path.clone().into()));
+            plan.push_mount(&path, &path, "", MsFlags::MS_BIND, "");
+        }
+        for path in devices {
+            plan.push(MountStep::Touch(path.clone()));
+            plan.push_mount(&path.to_string_lossy(), path, "", MsFlags::MS_BIND, "");
+        }
+        for (name, original) in [
+            ("ptmx", "pts/ptmx"),
+            ("fd", "/proc/self/fd"),
+            ("stdin", "fd/0"),
+            ("stdout", "fd/1"),
+            ("stderr", "fd/2"),
+        ] {
+            plan.push(MountStep::Symlink {
+                original: original.into(),
+                link: format!("/dev/{name}").into(),
+            });
+        }
+
+        plan.push(MountStep::Mkdir("/dev/pts".into()));
+        plan.push_mount(
+            "devpts",
+            "/dev/pts",
+            "devpts",
+            MsFlags::empty(),
+            "newinstance,mode=0620,ptmxmode=0666",
+        );
+
+        // Mount /dev/shm for POSIX shared memory and named semaphores.
+        let mut shm_options = "mode=1777".to_owned();
+        if let Some(shm_size) = shm_size {
+            shm_options.push_str(&format!(",size={shm_size}"));
+        }
+        plan.push(MountStep::Mkdir("/dev/shm".into()));
+        plan.push_mount(
+            "tmpfs",
+            "/dev/shm",
+            "tmpfs",
+            MsFlags::MS_NODEV | MsFlags::MS_NOSUID,
+            &shm_options,
+        );
+
+        // Mount /dev/mqueue for POSIX message queues. This exposes the queues
+        // of the IPC namespace of the container only.
+        plan.push(MountStep::Mkdir("/dev/mqueue".into()));
+        plan.push_mount(
+            "mqueue",
+            "/dev/mqueue",
+            "mqueue",
+            MsFlags::MS_NODEV | MsFlags::MS_NOSUID | MsFlags::MS_NOEXEC,
+            "",
+        );
+
+        plan.push_mount("", "/dev", "", MsFlags::MS_REMOUNT | MsFlags::MS_RDONLY, "");
+
+        // Mount /proc. It is done here, not in the container crate, because
+        // we need to enter a PID namespace to mount one.
+        plan.push_mount("/proc", "/proc", "proc", MsFlags::empty(), "");
+
+        // Mount read-only tmpfs at /sys. We don't mount the real sysfs there
+        // because it exposes good amount of host details, which can lead to
+        // non-reproducible build results.
+        plan.push_mount(
+            "sys",
+            "/sys",
+            "tmpfs",
+            MsFlags::empty(),
+            "ro,mode=0555,size=64k",
+        );
+
+        plan
+    }
+
+    /// Returns a plan to mount fresh tmpfs at /run and /run/lock, and to
+    /// pre-create the directory Portage takes lock files in.
+    ///
+    /// The container crate points /var/run and /var/lock to them. Since they
+    /// are mounted after bind-mounts, anything bind-mounted under /run is
+    /// hidden.
+    pub fn runtime_directories() -> Self {
+        let mut plan = Self::new();
+        plan.push_mount(
+            "run",
+            "/run",
+            "tmpfs",
+            MsFlags::MS_NODEV | MsFlags::MS_NOSUID,
+            "mode=0755",
+        );
+        plan.push(MountStep::Mkdir("/run/lock".into()));
+        plan.push_mount(
+            "lock",
+            "/run/lock",
+            "tmpfs",
+            MsFlags::MS_NODEV | MsFlags::MS_NOSUID | MsFlags::MS_NOEXEC,
+            "mode=1777,size=5m",
+        );
+        plan.push(MountStep::Mkdir("/run/lock/portage".into()));
+        plan
+    }
+
+    /// Returns a plan to bind-mount `source` on the host at /etc/machine-id
+    /// read-only. /etc/machine-id must exist in the container.
+    pub fn machine_id(source: &Path) -> Self {
+        let mut plan = Self::new();
+        plan.push_mount(
+            &source.to_string_lossy(),
+            "/etc/machine-id",
+            "",
+            MsFlags::MS_BIND,
+            "",
+        );
+        plan.push_mount(
+            "",
+            "/etc/machine-id",
+            "",
+            MsFlags::MS_REMOUNT | MsFlags::MS_BIND | MsFlags::MS_RDONLY,
+            "",
+        );
+        plan
+    }
+
+    /// Renders the plan as shell commands, one step per line.
+    #[cfg(test)]
+    pub fn render(&self) -> String {
+        self.steps.iter().map(|step| format!("{step}\n")).collect()
+    }
+
+    /// Applies the plan to the root directory of a container.
+    pub fn apply(&self, root_dir: &Path) -> Result<()> {
+        for step in &self.steps {
+            step.apply(root_dir)
+                .with_context(|| format!("Failed to set up file systems: {step}"))?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render_essential_filesystems() {
+        assert_eq!(
+            MountPlan::essential_filesystems(Some("64m"), &[]).render(),
+            "mount -t tmpfs -o mode=0555,size=64k dev /dev
+touch /dev/full
+mount --bind /dev/full /dev/full
+touch /dev/fuse
+mount --bind /dev/fuse /dev/fuse
+touch /dev/null
+mount --bind /dev/null /dev/null
+touch /dev/tty
+mount --bind /dev/tty /dev/tty
+touch /dev/urandom
+mount --bind /dev/urandom /dev/urandom
+touch /dev/zero
+mount --bind /dev/zero /dev/zero
+ln -s pts/ptmx /dev/ptmx
+ln -s /proc/self/fd /dev/fd
+ln -s fd/0 /dev/stdin
+ln -s fd/1 /dev/stdout
+ln -s fd/2 /dev/stderr
+mkdir /dev/pts
+mount -t devpts -o newinstance,mode=0620,ptmxmode=0666 devpts /dev/pts
+mkdir /dev/shm
+mount -t tmpfs -o nodev,nosuid,mode=1777,size=64m tmpfs /dev/shm
+mkdir /dev/mqueue
+mount -t mqueue -o nodev,nosuid,noexec mqueue /dev/mqueue
+mount -o remount,ro /dev
+mount -t proc /proc /proc
+mount -t tmpfs -o ro,mode=0555,size=64k sys /sys
+"
+        );
+    }
+
+    #[test]
+    fn test_render_essential_filesystems_with_devices() {
+        let rendered =
+            MountPlan::essential_filesystems(None, &[PathBuf::from("/dev/kvm")]).render();
+        assert!(rendered.contains(
+            "mount --bind /dev/zero /dev/zero
+touch /dev/kvm
+mount --bind /dev/kvm /dev/kvm
+ln -s pts/ptmx /dev/ptmx
+"
+        ));
+    }
+
+    #[test]
+    fn test_render_runtime_directories() {
+        assert_eq!(
+            MountPlan::runtime_directories().render(),
+            "mount -t tmpfs -o nodev,nosuid,mode=0755 run /run
+mkdir /run/lock
+mount -t tmpfs -o nodev,nosuid,noexec,mode=1777,size=5m lock /run/lock
+mkdir /run/lock/portage
+"
+        );
+    }
+
+    #[test]
+    fn test_render_machine_id() {
+        assert_eq!(
+            MountPlan::machine_id(Path::new("/tmp/machine-id")).render(),
+            "mount --bind /tmp/machine-id /etc/machine-id
+mount --bind -o remount,ro /etc/machine-id
+"
+        );
+    }
+
+    #[test]
+    fn test_apply_is_idempotent_for_files() -> Result<()> {
+        let root = fileutil::SafeTempDir::new()?;
+        let mut plan = MountPlan::new();
+        plan.push(MountStep::Mkdir("/dev".into()))
+            .push(MountStep::Touch("/dev/null".into()));
+
+        plan.apply(root.path())?;
+        plan.apply(root.path())?;
+
+        assert!(root.path().join("dev/null").is_file());
+        Ok(())
+    }
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use run_in_container_lib::SetupPhase;
+use serde_json::json;
+use std::{fmt::Write, time::Duration};
+
+/// Converts a duration to milliseconds with microsecond precision.
+fn millis(duration: Duration) -> f64 {
+    duration.as_micros() as f64 / 1000.0
+}
+
+/// Formats setup phases as a table, with the share of each phase in the total
+/// time.
+pub fn format_table(phases: &[SetupPhase]) -> String {
+    let total: Duration = phases.iter().map(|phase| phase.duration).sum();
+    let width = phases
+        .iter()
+        .map(|phase| phase.name.len())
+        .chain(["Phase".len(), "Total".len()])
+        .max()
+        .unwrap_or_default();
+
+    let mut table = String::new();
+    writeln!(
+        table,
+        "{:<width$}  {:>10}  {:>6}",
+        "Phase", "Time (ms)", "%"
+    )
+    .unwrap();
+    for phase in phases {
+        let percent = if total.is_zero() {
+            0.0
+        } else {
+            phase.duration.as_secs_f64() / total.as_secs_f64() * 100.0
+        };
+        writeln!(
+            table,
+            "{:<width$}  {:>10.3}  {:>5.1}%",
+            phase.name,
+            millis(phase.duration),
+            percent
+        )
+        .unwrap();
+    }
+    writeln!(
+        table,
+        "{:<width$}  {:>10.3}  {:>5.1}%",
+        "Total",
+        millis(total),
+        100.0
+    )
+    .unwrap();
+    table
+}
+
+/// Converts setup phases to JSON, with durations in milliseconds.
+pub fn to_json(phases: &[SetupPhase]) -> serde_json::Value {
+    let total: Duration = phases.iter().map(|phase| phase.duration).sum();
+    json!({
+        "phases": phases
+            .iter()
+            .map(|phase| json!({
+                "name": phase.name,
+                "duration_ms": millis(phase.duration),
+            }))
+            .collect::<Vec<_>>(),
+        "total_ms": millis(total),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn phases() -> Vec<SetupPhase> {
+        vec![
+            SetupPhase {
+                name: "layer /foo (Dir)".to_owned(),
+                duration: Duration::from_millis(30),
+            },
+            SetupPhase {
+                name: "pivot_root".to_owned(),
+                duration: Duration::from_millis(10),
+            },
+        ]
+    }
+
+    #[test]
+    fn test_format_table() {
+        assert_eq!(
+            format_table(&phases()),
+            "Phase              Time (ms)       %\n\
+             layer /foo (Dir)      30.000   75.0%\n\
+             pivot_root            10.000   25.0%\n\
+             Total                 40.000  100.0%\n"
+        );
+    }
+
+    #[test]
+    fn test_to_json() {
+        assert_eq!(
+            to_json(&phases()),
+            json!({
+                "phases": [
+                    {"name": "layer /foo (Dir)", "duration_ms": 30.0},
+                    {"name": "pivot_root", "duration_ms": 10.0},
+                ],
+                "total_ms": 40.0,
+            })
+        );
+    }
+}
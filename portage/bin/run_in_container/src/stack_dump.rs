@@ -0,0 +1,165 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use nix::{
+    sys::signal::{kill, Signal},
+    unistd::Pid,
+};
+use std::collections::{BTreeMap, BTreeSet};
+
+/// A process found in /proc.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct ProcessInfo {
+    pub pid: i32,
+    pub ppid: i32,
+    pub comm: String,
+}
+
+/// Parses the content of /proc/PID/stat.
+///
+/// The command name is enclosed in parentheses and may contain spaces and
+/// parentheses itself, so fields are located from the last `)`.
+fn parse_stat(content: &str) -> Result<ProcessInfo> {
+    let (pid, rest) = content.split_once(" (").context("Malformed stat")?;
+    let (comm, rest) = rest.rsplit_once(") ").context("Malformed stat")?;
+    let ppid = rest.split(' ').nth(1).context("Malformed stat")?;
+    Ok(ProcessInfo {
+        pid: pid.parse()?,
+        ppid: ppid.parse()?,
+        comm: comm.to_owned(),
+    })
+}
+
+/// Lists all processes visible in /proc.
+fn list_processes() -> Result<Vec<ProcessInfo>> {
+    let mut processes = Vec::new();
+    for entry in std::fs::read_dir("/proc").context("Failed to read /proc")? {
+        let entry = entry?;
+        let is_pid = entry
+            .file_name()
+            .to_str()
+            .is_some_and(|name| name.bytes().all(|b| b.is_ascii_digit()));
+        if !is_pid {
+            continue;
+        }
+        // Processes may exit while we scan, so ignore errors.
+        let Ok(content) = std::fs::read_to_string(entry.path().join("stat")) else {
+            continue;
+        };
+        processes.push(parse_stat(&content)?);
+    }
+    Ok(processes)
+}
+
+/// Returns the descendants of `pid` among `processes`, not including `pid`
+/// itself.
+fn descendants(processes: &[ProcessInfo], pid: i32) -> Vec<ProcessInfo> {
+    let mut children: BTreeMap<i32, Vec<&ProcessInfo>> = BTreeMap::new();
+    for process in processes {
+        children.entry(process.ppid).or_default().push(process);
+    }
+
+    let mut found = Vec::new();
+    let mut visited = BTreeSet::from([pid]);
+    let mut pending = vec![pid];
+    while let Some(parent) = pending.pop() {
+        for child in children.get(&parent).into_iter().flatten() {
+            if visited.insert(child.pid) {
+                found.push((*child).clone());
+                pending.push(child.pid);
+            }
+        }
+    }
+    found.sort_by_key(|process| process.pid);
+    found
+}
+
+/// Sends SIGQUIT to the processes running the command in the container to
+/// let them dump their stacks before they're terminated. Go programs print
+/// goroutine stacks to stderr, and JVMs print thread dumps to stdout, so the
+/// dumps end up in the output of the command.
+///
+/// `init_pid` is the PID of the init process of the container's PID
+/// namespace. Its only child is the run_in_container process that set up the
+/// container, which is spared as it has to report the exit status of the
+/// command. Returns the processes signaled.
+pub fn request_stack_dumps(init_pid: Pid) -> Result<Vec<ProcessInfo>> {
+    let processes = list_processes()?;
+    let mut targets = Vec::new();
+    for child in processes
+        .iter()
+        .filter(|process| process.ppid == init_pid.as_raw())
+    {
+        targets.extend(descendants(&processes, child.pid));
+    }
+    // Processes may exit while we signal them, so ignore errors.
+    targets.retain(|process| kill(Pid::from_raw(process.pid), Signal::SIGQUIT).is_ok());
+    Ok(targets)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::process::Command;
+
+    fn process(pid: i32, ppid: i32) -> ProcessInfo {
+        ProcessInfo {
+            pid,
+            ppid,
+            comm: format!("p{pid}"),
+        }
+    }
+
+    #[test]
+    fn test_parse_stat() -> Result<()> {
+        assert_eq!(
+            parse_stat("1234 (java) S 1200 1234 1200 0 -1 4194560")?,
+            ProcessInfo {
+                pid: 1234,
+                ppid: 1200,
+                comm: "java".to_owned(),
+            }
+        );
+        assert_eq!(
+            parse_stat("42 (a) (b c) R 7 42 7 0")?,
+            ProcessInfo {
+                pid: 42,
+                ppid: 7,
+                comm: "a) (b c".to_owned(),
+            }
+        );
+        assert!(parse_stat("42 a R 7").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_descendants() {
+        let processes = [
+            process(1, 0),
+            process(2, 1),
+            process(3, 2),
+            process(4, 3),
+            process(5, 2),
+            process(6, 1),
+        ];
+        assert_eq!(
+            descendants(&processes, 2),
+            vec![process(3, 2), process(4, 3), process(5, 2)]
+        );
+        assert_eq!(descendants(&processes, 4), vec![]);
+    }
+
+    #[test]
+    fn test_list_processes() -> Result<()> {
+        let mut child = Command::new("sleep").arg("60").spawn()?;
+        let processes = list_processes();
+        child.kill()?;
+        child.wait()?;
+
+        let found = descendants(&processes?, std::process::id() as i32);
+        assert!(found.iter().any(|process| process.pid == child.id() as i32));
+        Ok(())
+    }
+}
@@ -2,21 +2,33 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::bail;
+use anyhow::Context;
 use anyhow::Result;
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use durabletree::DurableTree;
-use runfiles::Runfiles;
 use std::ffi::OsStr;
+use std::fs::File;
+use std::io::BufRead;
+use std::io::BufReader;
+use std::io::Read;
+use std::os::unix::ffi::OsStrExt;
+use std::path::Component;
+use std::path::Path;
 use std::path::PathBuf;
-use std::process::Command;
 use std::process::ExitCode;
 
 #[derive(Parser, Debug)]
 #[clap()]
 struct Cli {
-    /// A path to a .tar.{xz,zst} archive file containing base SDK.
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
+    /// A path to a tar archive file containing base SDK. The archive can be
+    /// compressed with zstd, xz or gzip. The compression format is detected
+    /// from the file header.
     #[arg(long, required = true)]
     input: PathBuf,
 
@@ -25,44 +37,169 @@ struct Cli {
     output: PathBuf,
 }
 
-fn do_main() -> Result<()> {
-    let r = Runfiles::create()?;
+/// Compression formats supported for input archives.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum Compression {
+    Zstd,
+    Xz,
+    Gzip,
+    None,
+}
 
-    let args = Cli::try_parse()?;
+impl Compression {
+    /// Detects the compression format from the magic number at the beginning
+    /// of a file.
+    fn detect(header: &[u8]) -> Self {
+        if header.starts_with(&[0x28, 0xb5, 0x2f, 0xfd]) {
+            Self::Zstd
+        } else if header.starts_with(&[0xfd, b'7', b'z', b'X', b'Z', 0x00]) {
+            Self::Xz
+        } else if header.starts_with(&[0x1f, 0x8b]) {
+            Self::Gzip
+        } else {
+            Self::None
+        }
+    }
+}
 
-    std::fs::create_dir_all(&args.output)?;
+/// Paths in the archive that must not be extracted.
+///
+/// Each entry excludes the path itself and anything under it.
+const EXCLUDED_PATHS: &[&str] = &[
+    "etc/make.conf",
+    "etc/portage",
+    // This is a symlink to `chromeos-cache/distfiles` which we don't have.
+    "var/cache/distfiles",
+];
+
+/// Prefixes of file names under `etc` that must not be extracted.
+const EXCLUDED_ETC_PREFIXES: &[&str] = &["make.conf."];
+
+/// Checks if an archive entry at the given path should be skipped.
+fn is_excluded(path: &Path) -> bool {
+    let path = path.strip_prefix(".").unwrap_or(path);
+    if EXCLUDED_PATHS
+        .iter()
+        .any(|excluded| path.starts_with(excluded))
+    {
+        return true;
+    }
+    if let (Some(parent), Some(file_name)) = (path.parent(), path.file_name()) {
+        if parent == Path::new("etc") {
+            let file_name = file_name.to_string_lossy();
+            return EXCLUDED_ETC_PREFIXES
+                .iter()
+                .any(|prefix| file_name.starts_with(prefix));
+        }
+    }
+    false
+}
+
+/// Opens an archive file, transparently decompressing it.
+fn open_archive(input: &Path) -> Result<tar::Archive<Box<dyn Read>>> {
+    let file = File::open(input).with_context(|| format!("open {}", input.display()))?;
+    let mut reader = BufReader::new(file);
+    let compression = Compression::detect(reader.fill_buf()?);
+
+    let decompressed: Box<dyn Read> = match compression {
+        Compression::Zstd => Box::new(zstd::stream::read::Decoder::with_buffer(reader)?),
+        Compression::Xz => Box::new(xz2::bufread::XzDecoder::new_multi_decoder(reader)),
+        Compression::Gzip => Box::new(flate2::bufread::MultiGzDecoder::new(reader)),
+        Compression::None => Box::new(reader),
+    };
+
+    let mut archive = tar::Archive::new(decompressed);
+    archive.set_preserve_permissions(true);
+    archive.set_preserve_mtime(true);
+    // Extended attributes are applied by [`unpack_entry`] instead because
+    // the tar crate fails hard on attributes we are not allowed to set.
+    archive.set_unpack_xattrs(false);
+    archive.set_overwrite(true);
+    Ok(archive)
+}
+
+/// Returns the extended attributes recorded for an archive entry.
+fn entry_xattrs<R: Read>(entry: &mut tar::Entry<R>) -> Result<Vec<(Vec<u8>, Vec<u8>)>> {
+    const PREFIX: &str = "SCHILY.xattr.";
+    let mut xattrs = Vec::new();
+    if let Some(extensions) = entry.pax_extensions()? {
+        for extension in extensions {
+            let extension = extension?;
+            if let Some(name) = extension.key_bytes().strip_prefix(PREFIX.as_bytes()) {
+                xattrs.push((name.to_vec(), extension.value_bytes().to_vec()));
+            }
+        }
+    }
+    Ok(xattrs)
+}
+
+/// Extracts an archive entry under the output directory.
+///
+/// Extended attributes that can't be set, e.g. `security.*` attributes when
+/// running unprivileged, are skipped with a warning.
+fn unpack_entry<R: Read>(entry: &mut tar::Entry<R>, path: &Path, output: &Path) -> Result<()> {
+    let xattrs = entry_xattrs(entry)?;
+    if !entry
+        .unpack_in(output)
+        .with_context(|| format!("extract {}", path.display()))?
+    {
+        return Ok(());
+    }
+
+    // This mirrors how [`tar::Entry::unpack_in`] sanitizes the path.
+    let dest = path
+        .components()
+        .filter(|c| matches!(c, Component::Normal(_)))
+        .fold(output.to_path_buf(), |dest, c| dest.join(c));
+    for (name, value) in xattrs {
+        let name = OsStr::from_bytes(&name);
+        if let Err(err) = xattr::set(&dest, name, &value) {
+            tracing::warn!("Skipping xattr {:?} on {}: {}", name, dest.display(), err);
+        }
+    }
+    Ok(())
+}
 
-    let mut command = Command::new("tar");
-
-    if let Some(ext) = args.input.extension() {
-        // TODO: Remove the dependency to the system pixz.
-        if ext == OsStr::new("xz") {
-            command.arg("-Ipixz");
-        } else if ext == OsStr::new("zst") {
-            command.arg(format!(
-                "-I{}",
-                runfiles::rlocation!(r, "zstd/pzstd").display()
-            ));
+/// Extracts an archive to the output directory, skipping excluded paths.
+fn extract_archive(input: &Path, output: &Path) -> Result<()> {
+    let mut archive = open_archive(input)?;
+
+    // Delay extracting directories until all other entries have been
+    // extracted so that their permissions don't prevent creating files in
+    // them. This is what [`tar::Archive::unpack`] does.
+    let mut directories = Vec::new();
+    for entry in archive.entries()? {
+        let mut entry = entry?;
+        let path = entry.path()?.into_owned();
+        if is_excluded(&path) {
+            continue;
+        }
+        if entry.header().entry_type().is_dir() {
+            directories.push(entry);
         } else {
-            bail!("Unsupported extension: {:?}", ext);
+            unpack_entry(&mut entry, &path, output)?;
         }
-    } else {
-        bail!("Input missing extension: {}", args.input.display());
     }
+    // Extract deeper directories first so that permissions of a parent
+    // directory are applied after its children are created.
+    directories.reverse();
+    for mut entry in directories {
+        let path = entry.path()?.into_owned();
+        unpack_entry(&mut entry, &path, output)?;
+    }
+
+    // Read the remaining data so that decompression errors after the end of
+    // the archive, e.g. a truncated xz stream, are detected.
+    std::io::copy(&mut archive.into_inner(), &mut std::io::sink())?;
+    Ok(())
+}
 
-    command.args([
-        "-xf",
-        &args.input.to_string_lossy(),
-        "--exclude=./etc/make.conf",
-        "--exclude=./etc/make.conf.*",
-        "--exclude=./etc/portage",
-        // This is a symlink to `chromeos-cache/distfiles` which we don't have.
-        "--exclude=./var/cache/distfiles",
-        "-C",
-        &args.output.to_string_lossy(),
-    ]);
+fn do_main() -> Result<()> {
+    let args = Cli::try_parse()?;
+
+    std::fs::create_dir_all(&args.output)?;
 
-    processes::run_and_check(&mut command)?;
+    extract_archive(&args.input, &args.output)?;
 
     DurableTree::convert(&args.output)?;
 
@@ -72,3 +209,47 @@ fn do_main() -> Result<()> {
 fn main() -> ExitCode {
     cli_main(do_main, Default::default())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn detect_compression() {
+        assert_eq!(
+            Compression::detect(&[0x28, 0xb5, 0x2f, 0xfd, 0x00]),
+            Compression::Zstd
+        );
+        assert_eq!(
+            Compression::detect(b"\xfd7zXZ\x00\x00\x04"),
+            Compression::Xz
+        );
+        assert_eq!(Compression::detect(&[0x1f, 0x8b, 0x08]), Compression::Gzip);
+        assert_eq!(Compression::detect(b"archive/"), Compression::None);
+        assert_eq!(Compression::detect(b""), Compression::None);
+    }
+
+    #[test]
+    fn excluded_paths() {
+        for path in [
+            "./etc/make.conf",
+            "./etc/make.conf.board",
+            "./etc/portage",
+            "./etc/portage/make.profile",
+            "./var/cache/distfiles",
+            "etc/portage/package.use",
+        ] {
+            assert!(is_excluded(Path::new(path)), "{path} should be excluded");
+        }
+        for path in [
+            "./",
+            "./etc",
+            "./etc/make.config",
+            "./etc/portage-foo",
+            "./usr/etc/make.conf.board",
+            "./var/cache/distfiles-foo",
+        ] {
+            assert!(!is_excluded(Path::new(path)), "{path} should be included");
+        }
+    }
+}
@@ -60,6 +60,16 @@ fn tar_zst_succeeds() -> Result<()> {
     base_test("archive.tar.zst", 0)
 }
 
+#[test]
+fn tar_gz_succeeds() -> Result<()> {
+    base_test("archive.tar.gz", 0)
+}
+
+#[test]
+fn uncompressed_tar_succeeds() -> Result<()> {
+    base_test("archive.tar", 0)
+}
+
 #[test]
 fn tar_fails() -> Result<()> {
     base_test("/NO/SUCH/FILE.tar.xz", 1)
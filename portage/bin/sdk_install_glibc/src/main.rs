@@ -4,8 +4,10 @@
 
 use anyhow::{ensure, Context, Result};
 use clap::Parser;
-use cliutil::cli_main;
-use container::{enter_mount_namespace, BindMount, CommonArgs, ContainerSettings};
+use cliutil::{cli_main, LoggingArgs};
+use container::{
+    enter_mount_namespace, BindMount, CommonArgs, ContainerSettings, DiffFilter, MountPropagation,
+};
 use durabletree::DurableTree;
 use fileutil::resolve_symlink_forest;
 use std::{path::PathBuf, process::ExitCode};
@@ -16,6 +18,11 @@ const GLIBC_BINPKG: &str = "/mnt/host/.sdk_install_glibc/glibc.tbz2";
 #[derive(Parser, Debug)]
 #[clap()]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[command(flatten)]
     common: CommonArgs,
 
@@ -30,6 +37,11 @@ struct Cli {
     /// cross-*-glibc package to install into the board's sysroot
     #[arg(long)]
     glibc: PathBuf,
+
+    /// A file listing rsync-style include/exclude rules to apply to the
+    /// output. See [`DiffFilter`] for the syntax.
+    #[arg(long, value_name = "PATH")]
+    diff_filter: Option<PathBuf>,
 }
 
 fn do_main() -> Result<()> {
@@ -37,6 +49,9 @@ fn do_main() -> Result<()> {
 
     let mut settings = ContainerSettings::new();
     settings.apply_common_args(&args.common)?;
+    if let Some(path) = &args.diff_filter {
+        settings.set_diff_filter(DiffFilter::load(path)?);
+    }
 
     let r = runfiles::Runfiles::create()?;
 
@@ -45,6 +60,7 @@ fn do_main() -> Result<()> {
         source: glibc_binpkg,
         mount_path: GLIBC_BINPKG.into(),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     settings.push_bind_mount(BindMount {
@@ -54,6 +70,7 @@ fn do_main() -> Result<()> {
         ))?,
         mount_path: PathBuf::from(MAIN_SCRIPT),
         rw: false,
+        propagation: MountPropagation::Private,
     });
 
     let mut container = settings.prepare()?;
@@ -65,7 +82,7 @@ fn do_main() -> Result<()> {
     ensure!(status.success(), "Command failed: {:?}", status);
 
     // Move the upper directory contents to the output directory.
-    fileutil::move_dir_contents(&container.into_upper_dir(), &args.output)
+    fileutil::move_dir_contents(&container.into_upper_dir()?, &args.output)
         .with_context(|| "Failed to move the upper dir.")?;
 
     container::clean_layer(&args.output).with_context(|| "Failed to clean the output dir.")?;
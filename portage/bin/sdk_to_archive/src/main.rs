@@ -4,7 +4,7 @@
 
 use anyhow::{bail, Result};
 use clap::Parser;
-use cliutil::cli_main;
+use cliutil::{cli_main, LoggingArgs};
 use container::{enter_mount_namespace, ContainerSettings};
 use fileutil::resolve_symlink_forest;
 use runfiles::Runfiles;
@@ -15,6 +15,11 @@ use std::process::{Command, ExitCode};
 #[derive(Parser, Debug)]
 #[clap()]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     /// Adds a file system layer to be added to the archive.
     #[arg(long)]
     pub layer: Vec<PathBuf>,
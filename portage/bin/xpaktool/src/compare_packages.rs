@@ -7,30 +7,286 @@ use binarypackage::BinaryPackage;
 use bzip2::read::BzDecoder;
 use clap::Parser;
 use itertools::Itertools;
-use std::collections::HashSet;
+use rayon::prelude::*;
+use serde_json::json;
+use std::collections::{BTreeMap, HashSet};
+use std::fmt::Write as _;
 use std::fs::{create_dir_all, File};
 use std::path::Path;
 use std::path::PathBuf;
 use std::process::Command;
 use tempfile::TempDir;
+use walkdir::WalkDir;
 
 use crate::util::{files_contents_equal, files_size_equal, reader_contents_equal};
 
 /// Compares two packages.
+///
+/// If both arguments are directories, binary packages found under them are
+/// matched by CPV and compared pairwise in parallel.
 #[derive(Parser, Debug)]
 pub struct ComparePackagesArgs {
-    /// Portage binary packages to compare
+    /// Portage binary package, or directory containing them, to compare
     #[arg(name = "PACKAGE-A")]
     package_a: PathBuf,
 
-    /// Portage binary packages to compare
+    /// Portage binary package, or directory containing them, to compare
     #[arg(name = "PACKAGE-B")]
     package_b: PathBuf,
+
+    /// Number of packages to compare in parallel. Defaults to the number of
+    /// CPUs.
+    #[arg(long, short = 'j')]
+    jobs: Option<usize>,
+
+    /// Writes a machine-readable report of the comparison in JSON.
+    #[arg(long, value_name = "PATH")]
+    output_json: Option<PathBuf>,
+
+    /// Writes a report of the comparison in HTML.
+    #[arg(long, value_name = "PATH")]
+    output_html: Option<PathBuf>,
+}
+
+/// A file that differs between the tarballs of two packages.
+#[derive(Debug, PartialEq, Eq)]
+struct FileDiff {
+    path: String,
+    /// Descriptions of the differences, e.g. a unified diff.
+    diffs: Vec<String>,
+}
+
+/// An XPAK entry that differs between two packages. A value is None if the
+/// package lacks the key.
+#[derive(Debug, PartialEq, Eq)]
+struct XpakDiff {
+    key: String,
+    a: Option<String>,
+    b: Option<String>,
+    /// A unified diff of the values, if available.
+    diff: Option<String>,
+}
+
+/// The result of comparing a pair of binary packages.
+#[derive(Debug, Default)]
+struct PackageComparison {
+    equal: bool,
+    /// Human-readable log of the comparison.
+    log: String,
+    file_diffs: Vec<FileDiff>,
+    xpak_diffs: Vec<XpakDiff>,
+}
+
+/// The status of a package in the report.
+#[derive(Debug)]
+enum PackageStatus {
+    OnlyInA,
+    OnlyInB,
+    Compared(PackageComparison),
+    Error(String),
+}
+
+#[derive(Debug)]
+struct PackageReport {
+    /// The CPV of the package, or the file name if packages are compared
+    /// directly.
+    name: String,
+    path_a: Option<PathBuf>,
+    path_b: Option<PathBuf>,
+    status: PackageStatus,
+}
+
+impl PackageReport {
+    fn equal(&self) -> bool {
+        matches!(&self.status, PackageStatus::Compared(comparison) if comparison.equal)
+    }
+
+    fn status_name(&self) -> &'static str {
+        match &self.status {
+            PackageStatus::OnlyInA => "only_in_a",
+            PackageStatus::OnlyInB => "only_in_b",
+            PackageStatus::Compared(comparison) if comparison.equal => "equal",
+            PackageStatus::Compared(_) => "different",
+            PackageStatus::Error(_) => "error",
+        }
+    }
+}
+
+/// A report of comparing packages, ordered by package names.
+#[derive(Debug, Default)]
+struct Report {
+    packages: Vec<PackageReport>,
+}
+
+impl Report {
+    fn equal(&self) -> bool {
+        self.packages.iter().all(|package| package.equal())
+    }
+
+    /// Prints the human-readable log of the comparison.
+    fn print(&self) {
+        for package in self.packages.iter() {
+            match &package.status {
+                PackageStatus::OnlyInA => println!("Only in A: {}", package.name),
+                PackageStatus::OnlyInB => println!("Only in B: {}", package.name),
+                _ => {}
+            }
+        }
+        let compared = self.packages.iter().filter(|package| {
+            !matches!(
+                package.status,
+                PackageStatus::OnlyInA | PackageStatus::OnlyInB
+            )
+        });
+        for package in compared {
+            println!();
+            println!("* {}", package.name);
+            match &package.status {
+                PackageStatus::Compared(comparison) => print!("{}", comparison.log),
+                PackageStatus::Error(error) => println!("Failed to compare: {error}"),
+                _ => unreachable!(),
+            }
+        }
+    }
+
+    fn to_json(&self) -> serde_json::Value {
+        let packages = self
+            .packages
+            .iter()
+            .map(|package| {
+                let mut value = json!({
+                    "name": package.name,
+                    "status": package.status_name(),
+                    "package_a": package.path_a,
+                    "package_b": package.path_b,
+                });
+                match &package.status {
+                    PackageStatus::Compared(comparison) => {
+                        value["file_diffs"] = comparison
+                            .file_diffs
+                            .iter()
+                            .map(|diff| json!({ "path": diff.path, "diffs": diff.diffs }))
+                            .collect();
+                        value["xpak_diffs"] = comparison
+                            .xpak_diffs
+                            .iter()
+                            .map(|diff| {
+                                json!({
+                                    "key": diff.key,
+                                    "a": diff.a,
+                                    "b": diff.b,
+                                    "diff": diff.diff,
+                                })
+                            })
+                            .collect();
+                    }
+                    PackageStatus::Error(error) => value["error"] = json!(error),
+                    _ => {}
+                }
+                value
+            })
+            .collect::<Vec<_>>();
+        json!({
+            "equal": self.equal(),
+            "packages": packages,
+        })
+    }
+
+    fn to_html(&self) -> String {
+        let mut html = String::new();
+        writeln!(
+            html,
+            "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n\
+             <title>Package comparison</title>\n<style>\n\
+             .equal {{ color: green; }}\n\
+             .different, .error, .only_in_a, .only_in_b {{ color: red; }}\n\
+             td, th {{ padding: 0 1em; text-align: left; vertical-align: top; }}\n\
+             </style>\n</head>\n<body>"
+        )
+        .unwrap();
+        let different = self.packages.iter().filter(|p| !p.equal()).count();
+        writeln!(
+            html,
+            "<h1>Package comparison</h1>\n<p>{} packages, {} with differences</p>",
+            self.packages.len(),
+            different
+        )
+        .unwrap();
+        writeln!(
+            html,
+            "<table>\n<tr><th>Package</th><th>Status</th><th>Details</th></tr>"
+        )
+        .unwrap();
+        for package in self.packages.iter() {
+            let status = package.status_name();
+            writeln!(
+                html,
+                "<tr><td>{}</td><td class=\"{status}\">{status}</td><td>",
+                escape_html(&package.name)
+            )
+            .unwrap();
+            match &package.status {
+                PackageStatus::Compared(comparison) => {
+                    for diff in comparison.file_diffs.iter() {
+                        writeln!(
+                            html,
+                            "<details><summary>File {}</summary><pre>{}</pre></details>",
+                            escape_html(&diff.path),
+                            escape_html(&diff.diffs.join("\n"))
+                        )
+                        .unwrap();
+                    }
+                    for diff in comparison.xpak_diffs.iter() {
+                        let details = match &diff.diff {
+                            Some(diff) => diff.clone(),
+                            None => format!(
+                                "A: {}\nB: {}",
+                                diff.a.as_deref().unwrap_or("(missing)"),
+                                diff.b.as_deref().unwrap_or("(missing)")
+                            ),
+                        };
+                        writeln!(
+                            html,
+                            "<details><summary>XPAK {}</summary><pre>{}</pre></details>",
+                            escape_html(&diff.key),
+                            escape_html(&details)
+                        )
+                        .unwrap();
+                    }
+                }
+                PackageStatus::Error(error) => {
+                    writeln!(html, "<pre>{}</pre>", escape_html(error)).unwrap();
+                }
+                _ => {}
+            }
+            writeln!(html, "</td></tr>").unwrap();
+        }
+        writeln!(html, "</table>\n</body>\n</html>").unwrap();
+        html
+    }
 }
 
-fn diff_environment(a: &Vec<u8>, b: &Vec<u8>) -> Result<()> {
+fn escape_html(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+/// Formats an XPAK value for display.
+fn format_xpak_value(value: &[u8]) -> String {
+    match std::str::from_utf8(value) {
+        Ok(value) => format!("{:?}", value),
+        Err(_) => format!("{:x?}", value),
+    }
+}
+
+fn diff_environment(name: &str, a: &[u8], b: &[u8]) -> Result<String> {
     let (_temp, base) = if let Some(outputs) = std::env::var_os("TEST_UNDECLARED_OUTPUTS_DIR") {
-        (None, PathBuf::from(outputs))
+        // Packages are compared in parallel, so use a directory per package.
+        let path = PathBuf::from(outputs).join(name.replace('/', "_"));
+        create_dir_all(&path)?;
+        (None, path)
     } else {
         let temp = TempDir::new()?;
         let path = temp.path().to_path_buf();
@@ -44,22 +300,26 @@ fn diff_environment(a: &Vec<u8>, b: &Vec<u8>) -> Result<()> {
     let mut file_a = File::create(&path_a)?;
     let mut file_b = File::create(&path_b)?;
 
-    std::io::copy(&mut BzDecoder::new(a.as_slice()), &mut file_a)?;
-    std::io::copy(&mut BzDecoder::new(b.as_slice()), &mut file_b)?;
+    std::io::copy(&mut BzDecoder::new(a), &mut file_a)?;
+    std::io::copy(&mut BzDecoder::new(b), &mut file_b)?;
 
     drop(file_a);
     drop(file_b);
 
-    Command::new("diff")
+    let output = Command::new("diff")
         .current_dir(base)
         .arg("-u")
         .arg(&path_a)
         .arg(&path_b)
-        .status()?;
-    Ok(())
+        .output()?;
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
 }
 
-fn diff_tarball_contents(pkg_a: &mut BinaryPackage, pkg_b: &mut BinaryPackage) -> Result<()> {
+fn diff_tarball_contents(
+    pkg_a: &mut BinaryPackage,
+    pkg_b: &mut BinaryPackage,
+    comparison: &mut PackageComparison,
+) -> Result<()> {
     // We don't use TEST_UNDECLARED_OUTPUTS_DIR because it's VERY slow when
     // there are a lot of files.
     let temp = TempDir::new()?;
@@ -76,18 +336,32 @@ fn diff_tarball_contents(pkg_a: &mut BinaryPackage, pkg_b: &mut BinaryPackage) -
 
     let diff = crate::diff::diff(&path_a, &path_b)?;
 
-    print!("{}", diff.display());
+    write!(comparison.log, "{}", diff.display())?;
+
+    for (path, items) in &diff {
+        comparison.file_diffs.push(FileDiff {
+            path: Path::new("/").join(path).display().to_string(),
+            diffs: items.iter().map(|item| item.to_string()).collect(),
+        });
+    }
 
     Ok(())
 }
 
-fn diff_xpak_contents(pkg_a: &BinaryPackage, pkg_b: &BinaryPackage) -> Result<()> {
+fn diff_xpak_contents(
+    name: &str,
+    pkg_a: &BinaryPackage,
+    pkg_b: &BinaryPackage,
+    comparison: &mut PackageComparison,
+) -> Result<()> {
+    let log = &mut comparison.log;
     let keys_a: HashSet<&String> = pkg_a.xpak_order().iter().collect();
     let keys_b: HashSet<&String> = pkg_b.xpak_order().iter().collect();
 
     if keys_a != keys_b {
-        println!("XPAK keys equal - ❌");
-        println!(
+        writeln!(log, "XPAK keys equal - ❌")?;
+        writeln!(
+            log,
             "  * A: {}\n  \
                 * B: {}\n  \
                 * New keys: {}\n  \
@@ -96,17 +370,27 @@ fn diff_xpak_contents(pkg_a: &BinaryPackage, pkg_b: &BinaryPackage) -> Result<()
             keys_b.iter().sorted().join(", "),
             keys_b.difference(&keys_a).sorted().join(", "),
             keys_a.difference(&keys_b).sorted().join(", ")
-        );
+        )?;
     } else if pkg_a.xpak_order() == pkg_b.xpak_order() {
-        println!("XPAK keys equal - ✅");
+        writeln!(log, "XPAK keys equal - ✅")?;
     } else {
-        println!("XPAK key order equal - ❌");
+        writeln!(log, "XPAK key order equal - ❌")?;
 
-        println!(
+        writeln!(
+            log,
             "  * A: {}\n  * B: {}",
             pkg_a.xpak_order().join(", "),
             pkg_b.xpak_order().join(", "),
-        );
+        )?;
+    }
+
+    for key in keys_a.symmetric_difference(&keys_b).sorted() {
+        comparison.xpak_diffs.push(XpakDiff {
+            key: key.to_string(),
+            a: pkg_a.xpak().get(*key).map(|v| format_xpak_value(v)),
+            b: pkg_b.xpak().get(*key).map(|v| format_xpak_value(v)),
+            diff: None,
+        });
     }
 
     for key in keys_a.intersection(&keys_b).sorted() {
@@ -116,43 +400,53 @@ fn diff_xpak_contents(pkg_a: &BinaryPackage, pkg_b: &BinaryPackage) -> Result<()
             continue;
         }
 
-        println!("  * XPAK key '{}' has a value mismatch:", key);
+        writeln!(
+            comparison.log,
+            "  * XPAK key '{}' has a value mismatch:",
+            key
+        )?;
+        let mut xpak_diff = XpakDiff {
+            key: key.to_string(),
+            a: Some(format_xpak_value(value_a)),
+            b: Some(format_xpak_value(value_b)),
+            diff: None,
+        };
         if *key == "environment.bz2" {
-            diff_environment(value_a, value_b)?;
-            continue;
-        }
-
-        if let Ok(value_a) = std::str::from_utf8(value_a) {
-            println!("    * A: {:?}", value_a);
-        } else {
-            println!("    * A: {:x?}", value_a);
-        }
-
-        if let Ok(value_b) = std::str::from_utf8(value_b) {
-            println!("    * B: {:?}", value_b);
+            let diff = diff_environment(name, value_a, value_b)?;
+            comparison.log.push_str(&diff);
+            xpak_diff.diff = Some(diff);
         } else {
-            println!("    * B: {:x?}", value_b);
+            writeln!(
+                comparison.log,
+                "    * A: {}\n    * B: {}",
+                xpak_diff.a.as_deref().unwrap(),
+                xpak_diff.b.as_deref().unwrap()
+            )?;
         }
+        comparison.xpak_diffs.push(xpak_diff);
     }
 
     // TODO: Check the order of the xpak data entries.
     Ok(())
 }
 
-fn packages_equal(path_a: &Path, path_b: &Path) -> Result<bool> {
-    println!("Package A: {:?}", path_a);
-    println!("Package B: {:?}", path_b);
+fn compare_packages(name: &str, path_a: &Path, path_b: &Path) -> Result<PackageComparison> {
+    let mut comparison = PackageComparison::default();
+    let log = &mut comparison.log;
+    writeln!(log, "Package A: {:?}", path_a)?;
+    writeln!(log, "Package B: {:?}", path_b)?;
 
     if files_size_equal(path_a, path_b)? {
-        println!("File size equal - ✅");
+        writeln!(log, "File size equal - ✅")?;
         if files_contents_equal(path_a, path_b)? {
-            println!("File contents equal - ✅");
-            return Ok(true);
+            writeln!(log, "File contents equal - ✅")?;
+            comparison.equal = true;
+            return Ok(comparison);
         } else {
-            println!("File contents equal - ❌");
+            writeln!(log, "File contents equal - ❌")?;
         }
     } else {
-        println!("File sizes equal - ❌");
+        writeln!(log, "File sizes equal - ❌")?;
     }
 
     let mut pkg_a = BinaryPackage::open(path_a).with_context(|| format!("{path_a:?}"))?;
@@ -162,23 +456,126 @@ fn packages_equal(path_a: &Path, path_b: &Path) -> Result<bool> {
         &mut pkg_a.new_tarball_reader()?,
         &mut pkg_b.new_tarball_reader()?,
     )? {
-        println!("Tarball contents equal - ✅");
+        writeln!(comparison.log, "Tarball contents equal - ✅")?;
     } else {
-        println!("Tarball contents equal - ❌");
-        diff_tarball_contents(&mut pkg_a, &mut pkg_b)?;
+        writeln!(comparison.log, "Tarball contents equal - ❌")?;
+        diff_tarball_contents(&mut pkg_a, &mut pkg_b, &mut comparison)?;
     }
 
     if reader_contents_equal(&mut pkg_a.new_xpak_reader()?, &mut pkg_b.new_xpak_reader()?)? {
-        println!("XPAK contents equal - ✅");
+        writeln!(comparison.log, "XPAK contents equal - ✅")?;
     } else {
-        println!("XPAK contents equal - ❌");
-        diff_xpak_contents(&pkg_a, &pkg_b)?;
+        writeln!(comparison.log, "XPAK contents equal - ❌")?;
+        diff_xpak_contents(name, &pkg_a, &pkg_b, &mut comparison)?;
+    }
+
+    Ok(comparison)
+}
+
+fn compare_package_files(path_a: &Path, path_b: &Path) -> Report {
+    let name = path_a
+        .file_name()
+        .map(|name| name.to_string_lossy().into_owned())
+        .unwrap_or_default();
+    let status = match compare_packages(&name, path_a, path_b) {
+        Ok(comparison) => PackageStatus::Compared(comparison),
+        Err(e) => PackageStatus::Error(format!("{e:?}")),
+    };
+    Report {
+        packages: vec![PackageReport {
+            name,
+            path_a: Some(path_a.to_owned()),
+            path_b: Some(path_b.to_owned()),
+            status,
+        }],
+    }
+}
+
+/// Finds Portage binary packages under a directory and returns them keyed by
+/// CPV, e.g. "sys-apps/attr-2.5.1-r1".
+fn find_packages(dir: &Path) -> Result<BTreeMap<String, PathBuf>> {
+    let mut packages = BTreeMap::new();
+    for entry in WalkDir::new(dir).sort_by_file_name() {
+        let entry = entry?;
+        if !entry.file_type().is_file()
+            || entry.path().extension().and_then(|ext| ext.to_str()) != Some("tbz2")
+        {
+            continue;
+        }
+        let path = entry.into_path();
+        let pkg = BinaryPackage::open(&path).with_context(|| format!("{path:?}"))?;
+        let cpv = pkg.category_pf().to_string();
+        if let Some(other) = packages.insert(cpv.clone(), path.clone()) {
+            bail!("Found multiple packages for {cpv}: {other:?} and {path:?}");
+        }
     }
+    Ok(packages)
+}
 
-    Ok(false)
+/// Compares packages found under two directories, matched by CPV.
+fn compare_package_dirs(dir_a: &Path, dir_b: &Path) -> Result<Report> {
+    let packages_a = find_packages(dir_a)?;
+    let packages_b = find_packages(dir_b)?;
+
+    let cpvs: Vec<&String> = packages_a
+        .keys()
+        .chain(packages_b.keys())
+        .sorted()
+        .dedup()
+        .collect();
+
+    // Comparing packages is slow as it may extract tarballs, so do it in
+    // parallel. The order of packages is kept.
+    let packages = cpvs
+        .into_par_iter()
+        .map(|cpv| {
+            let path_a = packages_a.get(cpv);
+            let path_b = packages_b.get(cpv);
+            let status = match (path_a, path_b) {
+                (Some(path_a), Some(path_b)) => match compare_packages(cpv, path_a, path_b) {
+                    Ok(comparison) => PackageStatus::Compared(comparison),
+                    Err(e) => PackageStatus::Error(format!("{e:?}")),
+                },
+                (Some(_), None) => PackageStatus::OnlyInA,
+                (None, _) => PackageStatus::OnlyInB,
+            };
+            PackageReport {
+                name: cpv.clone(),
+                path_a: path_a.cloned(),
+                path_b: path_b.cloned(),
+                status,
+            }
+        })
+        .collect();
+
+    Ok(Report { packages })
 }
+
 pub fn do_compare_packages(args: ComparePackagesArgs) -> Result<()> {
-    if packages_equal(&args.package_a, &args.package_b)? {
+    if let Some(jobs) = args.jobs {
+        rayon::ThreadPoolBuilder::new()
+            .num_threads(jobs)
+            .build_global()
+            .context("Failed to set up the thread pool")?;
+    }
+
+    let report = match (args.package_a.is_dir(), args.package_b.is_dir()) {
+        (true, true) => compare_package_dirs(&args.package_a, &args.package_b)?,
+        (false, false) => compare_package_files(&args.package_a, &args.package_b),
+        _ => bail!("Cannot compare a directory with a file"),
+    };
+    report.print();
+
+    if let Some(path) = &args.output_json {
+        std::fs::write(path, serde_json::to_string_pretty(&report.to_json())?)
+            .with_context(|| format!("Failed to write {path:?}"))?;
+    }
+    if let Some(path) = &args.output_html {
+        std::fs::write(path, report.to_html())
+            .with_context(|| format!("Failed to write {path:?}"))?;
+    }
+
+    if report.equal() {
         Ok(())
     } else {
         bail!("Packages are not equal")
@@ -190,6 +587,18 @@ mod tests {
     use super::*;
     use crate::testdata::*;
 
+    fn packages_equal(path_a: &Path, path_b: &Path) -> Result<bool> {
+        let report = compare_package_files(path_a, path_b);
+        if let PackageStatus::Error(error) = &report.packages[0].status {
+            bail!("{error}");
+        }
+        Ok(report.equal())
+    }
+
+    fn package_dirs_equal(dir_a: &Path, dir_b: &Path) -> Result<bool> {
+        Ok(compare_package_dirs(dir_a, dir_b)?.equal())
+    }
+
     #[test]
     fn packages_equal_match() -> Result<()> {
         assert!(packages_equal(&testdata(BINPKG)?, &testdata(BINPKG)?)?);
@@ -216,4 +625,97 @@ mod tests {
 
         Ok(())
     }
+
+    /// Copies test packages into a new directory under the given names.
+    fn package_dir(packages: &[(&str, &str)]) -> Result<TempDir> {
+        let dir = TempDir::new()?;
+        for (name, file_name) in packages {
+            let path = dir.path().join(file_name);
+            create_dir_all(path.parent().unwrap())?;
+            std::fs::copy(testdata(name)?, path)?;
+        }
+        Ok(dir)
+    }
+
+    #[test]
+    fn package_dirs_equal_match() -> Result<()> {
+        let dir_a = package_dir(&[(BINPKG, "app-editors/nano-6.4.tbz2")])?;
+        // Packages are matched by CPV regardless of their file names.
+        let dir_b = package_dir(&[(BINPKG, "packages/nano.tbz2")])?;
+
+        assert!(package_dirs_equal(dir_a.path(), dir_b.path())?);
+
+        Ok(())
+    }
+
+    #[test]
+    fn package_dirs_equal_different() -> Result<()> {
+        let dir_a = package_dir(&[(BINPKG, "nano.tbz2")])?;
+        let dir_b = package_dir(&[(BINPKG_DIFF_XPAK, "nano.tbz2")])?;
+
+        assert!(!package_dirs_equal(dir_a.path(), dir_b.path())?);
+
+        Ok(())
+    }
+
+    #[test]
+    fn package_dirs_equal_missing() -> Result<()> {
+        let dir_a = package_dir(&[(BINPKG, "nano.tbz2")])?;
+        let dir_b = package_dir(&[])?;
+
+        assert!(!package_dirs_equal(dir_a.path(), dir_b.path())?);
+        assert!(!package_dirs_equal(dir_b.path(), dir_a.path())?);
+
+        Ok(())
+    }
+
+    #[test]
+    fn find_packages_duplicated() -> Result<()> {
+        let dir = package_dir(&[(BINPKG, "a/nano.tbz2"), (BINPKG, "b/nano.tbz2")])?;
+
+        assert!(find_packages(dir.path()).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn report_json() -> Result<()> {
+        let dir_a = package_dir(&[(BINPKG, "nano.tbz2")])?;
+        let dir_b = package_dir(&[(BINPKG_DIFF_XPAK, "nano.tbz2")])?;
+
+        let json = compare_package_dirs(dir_a.path(), dir_b.path())?.to_json();
+        assert_eq!(json["equal"], false);
+        let packages = json["packages"].as_array().unwrap();
+        assert_eq!(packages.len(), 1);
+        assert_eq!(packages[0]["status"], "different");
+        assert!(!packages[0]["xpak_diffs"].as_array().unwrap().is_empty());
+
+        let empty = package_dir(&[])?;
+        let json = compare_package_dirs(dir_a.path(), empty.path())?.to_json();
+        assert_eq!(json["equal"], false);
+        assert_eq!(json["packages"][0]["status"], "only_in_a");
+
+        let json = compare_package_dirs(dir_a.path(), dir_a.path())?.to_json();
+        assert_eq!(json["equal"], true);
+        assert_eq!(json["packages"][0]["status"], "equal");
+
+        Ok(())
+    }
+
+    #[test]
+    fn report_html() -> Result<()> {
+        let dir_a = package_dir(&[(BINPKG, "nano.tbz2")])?;
+        let dir_b = package_dir(&[(BINPKG_DIFF_TAR, "nano.tbz2")])?;
+
+        let html = compare_package_dirs(dir_a.path(), dir_b.path())?.to_html();
+        assert!(html.contains("<td class=\"different\">different</td>"));
+        assert!(html.contains("<details><summary>File "));
+
+        assert_eq!(
+            escape_html("<a href=\"x\">&</a>"),
+            "&lt;a href=&quot;x&quot;&gt;&amp;&lt;/a&gt;"
+        );
+
+        Ok(())
+    }
 }
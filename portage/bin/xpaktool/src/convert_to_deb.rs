@@ -0,0 +1,445 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use binarypackage::BinaryPackage;
+use clap::Parser;
+use flate2::{write::GzEncoder, Compression};
+use itertools::Itertools;
+use std::collections::HashMap;
+use std::fs::File;
+use std::io::{BufWriter, Write};
+use std::path::PathBuf;
+use version::{Version, VersionSuffixLabel};
+
+/// Parses a single Portage package to Debian package mapping.
+fn parse_package_mapping(s: &str) -> Result<(String, String)> {
+    s.split_once('=')
+        .with_context(|| format!("Invalid package mapping: {:?}", s))
+        .map(|(k, v)| (k.to_string(), v.to_string()))
+}
+
+/// Converts a Portage binary package into a Debian binary package (.deb) so
+/// that it can be consumed by systems that don't speak Portage.
+#[derive(Parser, Debug)]
+pub struct ConvertToDebArgs {
+    /// Portage binary package to convert.
+    #[arg(long)]
+    binpkg: PathBuf,
+
+    /// Path to write the Debian package to.
+    #[arg(long)]
+    output: PathBuf,
+
+    /// Maps a Portage package to a Debian package for translating RDEPEND.
+    /// Format: <category>/<package>=<debian package>.
+    /// Runtime dependencies without a mapping are dropped.
+    #[arg(long, value_parser = parse_package_mapping)]
+    map_package: Vec<(String, String)>,
+
+    /// Debian architecture of the package. If unset, it is derived from CHOST.
+    #[arg(long)]
+    architecture: Option<String>,
+
+    /// Value of the Maintainer field.
+    #[arg(long, default_value = "ChromiumOS Authors")]
+    maintainer: String,
+}
+
+/// A node of a Portage dependency expression. The RDEPEND stored in a binary
+/// package has USE conditionals already evaluated, so only package atoms,
+/// any-of groups and all-of groups are left.
+#[derive(Debug, PartialEq, Eq)]
+enum Dependency {
+    Package(String),
+    AnyOf(Vec<Dependency>),
+    AllOf(Vec<Dependency>),
+}
+
+fn parse_dependency_list<'a>(
+    tokens: &mut impl Iterator<Item = &'a str>,
+) -> Result<Vec<Dependency>> {
+    let mut deps = Vec::new();
+    while let Some(token) = tokens.next() {
+        match token {
+            ")" => return Ok(deps),
+            "(" => deps.push(Dependency::AllOf(parse_dependency_list(tokens)?)),
+            "||" => {
+                if tokens.next() != Some("(") {
+                    bail!("|| must be followed by (");
+                }
+                deps.push(Dependency::AnyOf(parse_dependency_list(tokens)?));
+            }
+            token if token.ends_with('?') => {
+                bail!("Unexpected USE conditional {token:?} in a binary package")
+            }
+            // Blockers don't translate into dependencies.
+            token if token.starts_with('!') => {}
+            token => deps.push(Dependency::Package(atom_to_package(token)?)),
+        }
+    }
+    Ok(deps)
+}
+
+/// Parses a reduced Portage dependency expression, e.g. RDEPEND of a binary
+/// package.
+fn parse_dependencies(deps: &str) -> Result<Vec<Dependency>> {
+    parse_dependency_list(&mut deps.split_whitespace())
+}
+
+/// Strips version restrictions, slots and USE dependencies from an atom and
+/// returns the <category>/<package> part.
+fn atom_to_package(atom: &str) -> Result<String> {
+    let unversioned = atom.trim_start_matches(['<', '>', '=', '~']);
+    let has_version = unversioned.len() != atom.len();
+
+    let name = unversioned
+        .split_once('[')
+        .map_or(unversioned, |(name, _)| name);
+    let name = name.split_once(':').map_or(name, |(name, _)| name);
+    let name = if has_version {
+        Version::from_str_suffix(name.trim_end_matches('*'))
+            .with_context(|| format!("Invalid atom {atom:?}"))?
+            .0
+    } else {
+        name
+    };
+
+    if name.split('/').count() != 2 {
+        bail!("Invalid atom {atom:?}");
+    }
+    Ok(name.to_string())
+}
+
+/// Converts a Portage package name into a valid Debian package name.
+fn to_debian_package_name(name: &str) -> String {
+    name.to_ascii_lowercase().replace('_', "-")
+}
+
+/// Converts a Portage version into a Debian version so that the ordering of
+/// versions is preserved, e.g. "1.2_rc3-r1" becomes "1.2~rc3-1".
+fn to_debian_version(version: &Version) -> String {
+    let mut out = version.main().join(".");
+    out.push_str(version.letter());
+    for suffix in version.suffixes() {
+        let label = match suffix.label() {
+            VersionSuffixLabel::Alpha => "~alpha",
+            VersionSuffixLabel::Beta => "~beta",
+            VersionSuffixLabel::Pre => "~pre",
+            VersionSuffixLabel::Rc => "~rc",
+            VersionSuffixLabel::P => "+p",
+        };
+        out.push_str(label);
+        out.push_str(suffix.number());
+    }
+    if !version.revision().is_empty() {
+        out.push('-');
+        out.push_str(version.revision());
+    }
+    out
+}
+
+/// Derives the Debian architecture from a CHOST value.
+fn chost_to_debian_architecture(chost: &str) -> Result<&'static str> {
+    let arch = chost.split('-').next().unwrap_or_default();
+    Ok(match arch {
+        "x86_64" => "amd64",
+        "aarch64" => "arm64",
+        "i686" => "i386",
+        arch if arch.starts_with("armv7") => "armhf",
+        _ => bail!("Cannot map CHOST {chost:?} to a Debian architecture; use --architecture"),
+    })
+}
+
+/// Translates the dependencies into the value of the Depends field.
+fn to_debian_depends(deps: &[Dependency], mapping: &HashMap<String, String>) -> String {
+    let translate = |dep: &Dependency| -> Option<String> {
+        match dep {
+            Dependency::Package(name) => {
+                let translated = mapping.get(name).cloned();
+                if translated.is_none() {
+                    eprintln!("WARNING: Dropping unmapped dependency {name}");
+                }
+                translated
+            }
+            _ => {
+                eprintln!("WARNING: Dropping nested dependency group {dep:?}");
+                None
+            }
+        }
+    };
+
+    let mut clauses = Vec::new();
+    let mut pending: Vec<&Dependency> = deps.iter().collect();
+    while let Some(dep) = pending.pop() {
+        match dep {
+            Dependency::Package(_) => clauses.extend(translate(dep)),
+            Dependency::AllOf(children) => pending.extend(children),
+            Dependency::AnyOf(children) => {
+                let alternatives = children.iter().filter_map(translate).collect_vec();
+                // Drop the whole group if any alternative can't be translated
+                // since the remaining ones may be unsatisfiable.
+                if !alternatives.is_empty() && alternatives.len() == children.len() {
+                    clauses.push(alternatives.join(" | "));
+                }
+            }
+        }
+    }
+    clauses.into_iter().sorted().dedup().join(", ")
+}
+
+fn xpak_value(pkg: &BinaryPackage, key: &str) -> Result<Option<String>> {
+    pkg.xpak()
+        .get(key)
+        .map(|value| {
+            std::str::from_utf8(value)
+                .with_context(|| format!("{key} is not valid UTF-8"))
+                .map(|value| value.trim().to_string())
+        })
+        .transpose()
+}
+
+/// Generates the contents of the DEBIAN/control file.
+fn generate_control(pkg: &BinaryPackage, args: &ConvertToDebArgs) -> Result<String> {
+    let (package, version) = Version::from_str_suffix(pkg.category_pf())?;
+    let (_, name) = package
+        .split_once('/')
+        .with_context(|| format!("Invalid package {package:?}"))?;
+
+    let architecture = match &args.architecture {
+        Some(architecture) => architecture.clone(),
+        None => chost_to_debian_architecture(
+            &xpak_value(pkg, "CHOST")?.context("Binary package missing CHOST")?,
+        )?
+        .to_string(),
+    };
+
+    let mapping: HashMap<String, String> = args.map_package.iter().cloned().collect();
+    let depends = to_debian_depends(
+        &parse_dependencies(&xpak_value(pkg, "RDEPEND")?.unwrap_or_default())?,
+        &mapping,
+    );
+
+    let mut control = String::new();
+    control.push_str(&format!("Package: {}\n", to_debian_package_name(name)));
+    control.push_str(&format!("Version: {}\n", to_debian_version(&version)));
+    control.push_str(&format!("Architecture: {architecture}\n"));
+    control.push_str(&format!("Maintainer: {}\n", args.maintainer));
+    if let Some(size) = xpak_value(pkg, "SIZE")? {
+        let size: u64 = size
+            .parse()
+            .with_context(|| format!("Invalid SIZE {size:?}"))?;
+        control.push_str(&format!("Installed-Size: {}\n", size.div_ceil(1024)));
+    }
+    if !depends.is_empty() {
+        control.push_str(&format!("Depends: {depends}\n"));
+    }
+    if let Some(homepage) = xpak_value(pkg, "HOMEPAGE")? {
+        if let Some(homepage) = homepage.split_whitespace().next() {
+            control.push_str(&format!("Homepage: {homepage}\n"));
+        }
+    }
+    let description =
+        xpak_value(pkg, "DESCRIPTION")?.unwrap_or_else(|| pkg.category_pf().to_string());
+    control.push_str(&format!(
+        "Description: {description}\n Converted from the Portage binary package {}.\n",
+        pkg.category_pf()
+    ));
+
+    Ok(control)
+}
+
+/// Creates control.tar.gz containing the control file.
+fn create_control_tarball(control: &str) -> Result<Vec<u8>> {
+    let mut builder = tar::Builder::new(GzEncoder::new(Vec::new(), Compression::default()));
+    let mut header = tar::Header::new_gnu();
+    header.set_size(control.len().try_into()?);
+    header.set_mode(0o644);
+    header.set_mtime(0);
+    builder.append_data(&mut header, "./control", control.as_bytes())?;
+    Ok(builder.into_inner()?.finish()?)
+}
+
+/// Creates data.tar.gz by re-packing the contents of the binary package.
+///
+/// Long paths and link targets are recorded with GNU extensions.
+fn create_data_tarball(pkg: &mut BinaryPackage) -> Result<Vec<u8>> {
+    let mut builder = tar::Builder::new(GzEncoder::new(Vec::new(), Compression::default()));
+    let mut archive = pkg.archive()?;
+    for entry in archive.entries()? {
+        let mut entry = entry?;
+        let path = entry.path()?.into_owned();
+        let mut header = entry.header().clone();
+        match entry.link_name()? {
+            Some(link_name) => {
+                let link_name = link_name.into_owned();
+                builder.append_link(&mut header, &path, &link_name)?;
+            }
+            None => builder.append_data(&mut header, &path, &mut entry)?,
+        }
+    }
+    Ok(builder.into_inner()?.finish()?)
+}
+
+/// Writes a member of an ar archive.
+fn write_ar_member(out: &mut impl Write, name: &str, data: &[u8]) -> Result<()> {
+    // name, mtime, uid, gid, mode, size, end marker.
+    write!(
+        out,
+        "{:<16}{:<12}{:<6}{:<6}{:<8}{:<10}`\n",
+        name,
+        0,
+        0,
+        0,
+        "100644",
+        data.len()
+    )?;
+    out.write_all(data)?;
+    if data.len() % 2 == 1 {
+        out.write_all(b"\n")?;
+    }
+    Ok(())
+}
+
+pub fn do_convert_to_deb(args: ConvertToDebArgs) -> Result<()> {
+    let mut pkg =
+        BinaryPackage::open(&args.binpkg).with_context(|| format!("{:?}", args.binpkg))?;
+
+    let control = generate_control(&pkg, &args)?;
+    let control_tarball = create_control_tarball(&control)?;
+    let data_tarball = create_data_tarball(&mut pkg)?;
+
+    let mut out =
+        BufWriter::new(File::create(&args.output).with_context(|| format!("{:?}", args.output))?);
+    out.write_all(b"!<arch>\n")?;
+    write_ar_member(&mut out, "debian-binary", b"2.0\n")?;
+    write_ar_member(&mut out, "control.tar.gz", &control_tarball)?;
+    write_ar_member(&mut out, "data.tar.gz", &data_tarball)?;
+    out.flush()?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+    use flate2::read::GzDecoder;
+    use std::io::Read;
+    use std::path::Path;
+
+    #[test]
+    fn parse_atoms() -> Result<()> {
+        assert_eq!(atom_to_package("sys-libs/ncurses")?, "sys-libs/ncurses");
+        assert_eq!(
+            atom_to_package(">=sys-libs/ncurses-6.0:0=[unicode(+)]")?,
+            "sys-libs/ncurses"
+        );
+        assert_eq!(atom_to_package("=dev-libs/foo-1.2*")?, "dev-libs/foo");
+        assert_eq!(
+            atom_to_package("~dev-libs/foo-bar-1.2-r3")?,
+            "dev-libs/foo-bar"
+        );
+        assert!(atom_to_package("foo").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn translate_dependencies() -> Result<()> {
+        let deps = parse_dependencies(
+            "sys-libs/ncurses:0= !app-editors/ee || ( dev-libs/a dev-libs/b ) \
+             || ( dev-libs/a dev-libs/c ) ( sys-libs/zlib )",
+        )?;
+        let mapping = HashMap::from([
+            ("sys-libs/ncurses".to_string(), "libncurses6".to_string()),
+            ("sys-libs/zlib".to_string(), "zlib1g".to_string()),
+            ("dev-libs/a".to_string(), "liba".to_string()),
+            ("dev-libs/b".to_string(), "libb".to_string()),
+        ]);
+        assert_eq!(
+            to_debian_depends(&deps, &mapping),
+            "liba | libb, libncurses6, zlib1g"
+        );
+        assert!(parse_dependencies("foo? ( dev-libs/a )").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn convert_versions() -> Result<()> {
+        for (portage, debian) in [
+            ("1.2.3", "1.2.3"),
+            ("1.2.3b", "1.2.3b"),
+            ("1.2_rc3-r1", "1.2~rc3-1"),
+            ("2.0_p20240101", "2.0+p20240101"),
+        ] {
+            assert_eq!(to_debian_version(&Version::try_new(portage)?), debian);
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn convert_package() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let output = dir.path().join("nano.deb");
+
+        do_convert_to_deb(ConvertToDebArgs {
+            binpkg: testdata(BINPKG)?,
+            output: output.clone(),
+            map_package: vec![("sys-libs/ncurses".into(), "libncurses6".into())],
+            architecture: None,
+            maintainer: "Test".into(),
+        })?;
+
+        let deb = std::fs::read(&output)?;
+        assert!(deb.starts_with(b"!<arch>\n"));
+
+        // Locate control.tar.gz, which is the second member.
+        let header = &deb[8 + 60 + 4..][..60];
+        assert!(header.starts_with(b"control.tar.gz"));
+        let size: usize = std::str::from_utf8(&header[48..58])?.trim().parse()?;
+        let control_tarball = &deb[8 + 60 + 4 + 60..][..size];
+
+        let mut archive = tar::Archive::new(GzDecoder::new(control_tarball));
+        let mut entry = archive
+            .entries()?
+            .next()
+            .context("empty control.tar.gz")??;
+        let mut control = String::new();
+        entry.read_to_string(&mut control)?;
+
+        assert!(control.contains("Package: nano\n"), "{control}");
+        assert!(control.contains("Architecture: amd64\n"), "{control}");
+        assert!(control.contains("Maintainer: Test\n"), "{control}");
+        Ok(())
+    }
+
+    #[test]
+    fn long_link_targets() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let target = format!("/usr/lib/{}", "x".repeat(200));
+
+        let mut builder = tar::Builder::new(Vec::new());
+        let mut header = tar::Header::new_ustar();
+        header.set_entry_type(tar::EntryType::Symlink);
+        header.set_mode(0o777);
+        header.set_size(0);
+        builder.append_link(&mut header, "usr/bin/long", &target)?;
+        let tarball_path = dir.path().join("image.tar.zst");
+        std::fs::write(
+            &tarball_path,
+            zstd::encode_all(builder.into_inner()?.as_slice(), 0)?,
+        )?;
+
+        let src = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut pkg =
+            BinaryPackage::create(&tarball_path, src.xpak(), &dir.path().join("long.tbz2"))?;
+
+        let data_tarball = create_data_tarball(&mut pkg)?;
+        let mut archive = tar::Archive::new(GzDecoder::new(data_tarball.as_slice()));
+        let entry = archive.entries()?.next().context("empty data.tar.gz")??;
+        assert_eq!(entry.path()?, Path::new("usr/bin/long"));
+        assert_eq!(entry.link_name()?.as_deref(), Some(Path::new(&target)));
+        Ok(())
+    }
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use binarypackage::BinaryPackage;
+use clap::Parser;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+/// Creates a Portage binary package from a compressed tarball and XPAK
+/// entries.
+#[derive(Parser, Debug)]
+pub struct CreateArgs {
+    /// Compressed tarball containing the package image, e.g. "image.tar.zst".
+    #[arg(long)]
+    tarball: PathBuf,
+
+    /// Directory containing XPAK entries, one file per key named after the
+    /// key, as saved by `extract-xpak --dump`. CATEGORY, PF and SLOT are
+    /// required.
+    #[arg(long)]
+    xpak_dir: PathBuf,
+
+    /// Path to write the binary package to.
+    #[arg(long)]
+    output: PathBuf,
+}
+
+/// Reads XPAK entries from files in a directory.
+fn read_xpak_dir(dir: &Path) -> Result<HashMap<String, Vec<u8>>> {
+    let mut xpak = HashMap::new();
+    for entry in std::fs::read_dir(dir).with_context(|| format!("read_dir {dir:?}"))? {
+        let entry = entry?;
+        if !entry.file_type()?.is_file() {
+            continue;
+        }
+        let key = entry
+            .file_name()
+            .into_string()
+            .map_err(|name| anyhow::anyhow!("Invalid XPAK key: {name:?}"))?;
+        let value = std::fs::read(entry.path())?;
+        xpak.insert(key, value);
+    }
+    Ok(xpak)
+}
+
+pub fn do_create(args: CreateArgs) -> Result<()> {
+    let xpak = read_xpak_dir(&args.xpak_dir)?;
+    BinaryPackage::create(&args.tarball, &xpak, &args.output)
+        .with_context(|| format!("Failed to create {:?}", args.output))?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+
+    #[test]
+    fn create_package() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        let mut src = BinaryPackage::open(&testdata(BINPKG)?)?;
+
+        let tarball = dir.join("image.tar.zst");
+        std::io::copy(
+            &mut src.new_tarball_reader()?,
+            &mut std::fs::File::create(&tarball)?,
+        )?;
+
+        let xpak_dir = dir.join("xpak");
+        std::fs::create_dir(&xpak_dir)?;
+        for (key, value) in src.xpak() {
+            std::fs::write(xpak_dir.join(key), value)?;
+        }
+        std::fs::write(xpak_dir.join("repository"), "chromiumos\n")?;
+
+        let output = dir.join("out.tbz2");
+        do_create(CreateArgs {
+            tarball,
+            xpak_dir,
+            output: output.clone(),
+        })?;
+
+        let dest = BinaryPackage::open(&output)?;
+        assert_eq!(dest.category_pf(), src.category_pf());
+        assert_eq!(
+            dest.xpak().get("repository").unwrap(),
+            "chromiumos\n".as_bytes()
+        );
+
+        Ok(())
+    }
+}
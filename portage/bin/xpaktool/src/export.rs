@@ -0,0 +1,303 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use binarypackage::{encode_pax_records, BinaryPackage};
+use clap::Parser;
+use std::collections::HashMap;
+use std::fs::File;
+use std::io::{BufWriter, Read, Write};
+use std::path::{Component, Path, PathBuf};
+use tar::EntryType;
+
+/// Merges the contents of binary packages into a single tarball as if they
+/// were installed to an empty root in order, e.g. to create a minimal
+/// container of a package and its runtime dependencies.
+///
+/// Unlike emerge, it only copies files in the packages: pkg_preinst and
+/// pkg_postinst are not run, and INSTALL_MASK is not applied. Packages
+/// relying on them, e.g. to create users or update caches, may need
+/// additional setup in the resulting root file system.
+#[derive(Parser, Debug)]
+pub struct ExportArgs {
+    /// Path to write the tarball to. It is compressed with zstd if the file
+    /// name ends with ".zst".
+    #[arg(long)]
+    output: PathBuf,
+
+    /// Binary packages to merge, in installation order. A file in a package
+    /// overrides the same path in packages before it.
+    #[arg(required = true)]
+    binary_packages: Vec<PathBuf>,
+}
+
+/// Normalizes a path in a binary package tarball, e.g. "./usr/bin/" to
+/// "usr/bin", so that the same paths in different packages can be matched.
+fn normalize_path(path: &Path) -> PathBuf {
+    let path: PathBuf = path
+        .components()
+        .filter(|component| *component != Component::CurDir)
+        .collect();
+    if path.as_os_str().is_empty() {
+        PathBuf::from(".")
+    } else {
+        path
+    }
+}
+
+/// Returns the index of the last binary package containing each path.
+fn compute_owners(packages: &mut [BinaryPackage]) -> Result<HashMap<PathBuf, usize>> {
+    let mut owners = HashMap::new();
+    for (index, pkg) in packages.iter_mut().enumerate() {
+        for entry in pkg.archive()?.entries()? {
+            owners.insert(normalize_path(&entry?.path()?), index);
+        }
+    }
+    Ok(owners)
+}
+
+/// PAX extension keys not copied to the merged tarball as paths are rewritten.
+const DROPPED_PAX_KEYS: &[&str] = &["path", "linkpath"];
+
+/// Copies PAX extensions of `entry`, e.g. xattrs such as security.capability,
+/// to `builder` as an extended header applying to the entry appended next.
+fn append_pax_extensions(
+    builder: &mut tar::Builder<impl Write>,
+    entry: &mut tar::Entry<impl Read>,
+) -> Result<()> {
+    let Some(extensions) = entry.pax_extensions()? else {
+        return Ok(());
+    };
+    let mut records = Vec::new();
+    for extension in extensions {
+        let extension = extension?;
+        let key = extension.key()?;
+        if DROPPED_PAX_KEYS.contains(&key) {
+            continue;
+        }
+        records.push((key.to_string(), extension.value_bytes().to_vec()));
+    }
+    if records.is_empty() {
+        return Ok(());
+    }
+
+    let data = encode_pax_records(&records);
+    let mut header = tar::Header::new_ustar();
+    header.set_entry_type(EntryType::XHeader);
+    header.set_path("@PaxHeader")?;
+    header.set_mode(0o644);
+    header.set_mtime(0);
+    header.set_size(data.len().try_into()?);
+    header.set_cksum();
+    builder.append(&header, data.as_slice())?;
+    Ok(())
+}
+
+/// Writes a tarball containing the last entry of each path in the binary
+/// packages.
+fn write_merged_tarball(packages: &mut [BinaryPackage], out: impl Write) -> Result<()> {
+    let owners = compute_owners(packages)?;
+
+    let mut builder = tar::Builder::new(out);
+    for (index, pkg) in packages.iter_mut().enumerate() {
+        let category_pf = pkg.category_pf().to_string();
+        let mut archive = pkg.archive()?;
+        for entry in archive.entries()? {
+            let mut entry = entry?;
+            let path = normalize_path(&entry.path()?);
+            if owners[&path] != index {
+                continue;
+            }
+
+            append_pax_extensions(&mut builder, &mut entry)?;
+
+            let mut header = entry.header().clone();
+            match header.entry_type() {
+                EntryType::Symlink | EntryType::Link => {
+                    let target = entry
+                        .link_name()?
+                        .with_context(|| format!("{path:?} in {category_pf} has no link target"))?
+                        .into_owned();
+                    // Hard links refer to paths in the output tarball, which
+                    // must have been written before them.
+                    let target = if header.entry_type() == EntryType::Link {
+                        let target = normalize_path(&target);
+                        if owners.get(&target) != Some(&index) {
+                            bail!(
+                                "Target of the hard link {path:?} in {category_pf} is \
+                                overridden by another package"
+                            );
+                        }
+                        target
+                    } else {
+                        target
+                    };
+                    builder.append_link(&mut header, &path, &target)?;
+                }
+                _ => {
+                    builder.append_data(&mut header, &path, &mut entry)?;
+                }
+            }
+        }
+    }
+    builder.finish()?;
+    Ok(())
+}
+
+pub fn do_export(args: ExportArgs) -> Result<()> {
+    let mut packages = args
+        .binary_packages
+        .iter()
+        .map(|path| BinaryPackage::open(path).with_context(|| format!("{path:?}")))
+        .collect::<Result<Vec<_>>>()?;
+
+    let mut out =
+        BufWriter::new(File::create(&args.output).with_context(|| format!("{:?}", args.output))?);
+    if args.output.extension() == Some("zst".as_ref()) {
+        let mut encoder = zstd::Encoder::new(&mut out, 0)?;
+        write_merged_tarball(&mut packages, &mut encoder)?;
+        encoder.finish()?;
+    } else {
+        write_merged_tarball(&mut packages, &mut out)?;
+    }
+    out.flush()?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+    use std::collections::HashSet;
+    use std::io::Read;
+
+    /// Reads a zstd-compressed tarball and returns its entries with contents.
+    fn read_tarball(path: &Path) -> Result<Vec<(PathBuf, Vec<u8>)>> {
+        let mut archive = tar::Archive::new(zstd::Decoder::new(File::open(path)?)?);
+        let mut files = Vec::new();
+        for entry in archive.entries()? {
+            let mut entry = entry?;
+            let mut contents = Vec::new();
+            entry.read_to_end(&mut contents)?;
+            files.push((entry.path()?.into_owned(), contents));
+        }
+        Ok(files)
+    }
+
+    /// Returns the contents of the binary package by normalized paths.
+    fn read_binary_package(path: &Path) -> Result<HashMap<PathBuf, Vec<u8>>> {
+        let mut pkg = BinaryPackage::open(path)?;
+        let mut archive = pkg.archive()?;
+        let mut files = HashMap::new();
+        for entry in archive.entries()? {
+            let mut entry = entry?;
+            let mut contents = Vec::new();
+            entry.read_to_end(&mut contents)?;
+            files.insert(normalize_path(&entry.path()?), contents);
+        }
+        Ok(files)
+    }
+
+    #[test]
+    fn normalize_paths() {
+        assert_eq!(
+            normalize_path(Path::new("./usr/bin/")),
+            Path::new("usr/bin")
+        );
+        assert_eq!(
+            normalize_path(Path::new("usr/bin/nano")),
+            Path::new("usr/bin/nano")
+        );
+        assert_eq!(normalize_path(Path::new("./")), Path::new("."));
+    }
+
+    #[test]
+    fn later_packages_override_earlier_ones() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let output = dir.path().join("out.tar.zst");
+
+        do_export(ExportArgs {
+            output: output.clone(),
+            binary_packages: vec![testdata(BINPKG)?, testdata(BINPKG_DIFF_TAR)?],
+        })?;
+
+        let files = read_tarball(&output)?;
+        let expected = read_binary_package(&testdata(BINPKG_DIFF_TAR)?)?;
+
+        // Each path appears only once with the contents of the last package.
+        let paths: HashSet<_> = files.iter().map(|(path, _)| path).collect();
+        assert_eq!(paths.len(), files.len());
+        for (path, contents) in &files {
+            if let Some(expected_contents) = expected.get(path) {
+                assert_eq!(contents, expected_contents, "{path:?}");
+            }
+        }
+        assert!(files.len() >= expected.len());
+
+        Ok(())
+    }
+
+    #[test]
+    fn keeps_pax_extensions() -> Result<()> {
+        const XATTR_KEY: &str = "SCHILY.xattr.security.capability";
+        const XATTR_VALUE: &[u8] = b"\x01\x00\x00\x02\x00\x20\x00\x00";
+
+        let dir = tempfile::tempdir()?;
+        let dir = dir.path();
+
+        // Build a package containing a file with a capability xattr.
+        let tarball = dir.join("image.tar.zst");
+        let mut builder = tar::Builder::new(zstd::Encoder::new(File::create(&tarball)?, 0)?);
+        let records = encode_pax_records(&[(XATTR_KEY.to_string(), XATTR_VALUE.to_vec())]);
+        let mut header = tar::Header::new_ustar();
+        header.set_entry_type(EntryType::XHeader);
+        header.set_path("@PaxHeader")?;
+        header.set_mode(0o644);
+        header.set_size(records.len().try_into()?);
+        header.set_cksum();
+        builder.append(&header, records.as_slice())?;
+        let mut header = tar::Header::new_ustar();
+        header.set_mode(0o755);
+        header.set_size(5);
+        builder.append_data(&mut header, "./usr/bin/ping", "ping\n".as_bytes())?;
+        builder.into_inner()?.finish()?;
+
+        let xpak = HashMap::from([
+            ("CATEGORY".to_string(), b"net-misc\n".to_vec()),
+            ("PF".to_string(), b"iputils-1\n".to_vec()),
+            ("SLOT".to_string(), b"0\n".to_vec()),
+        ]);
+        let package = dir.join("iputils-1.tbz2");
+        BinaryPackage::create(&tarball, &xpak, &package)?;
+
+        let output = dir.join("out.tar.zst");
+        do_export(ExportArgs {
+            output: output.clone(),
+            binary_packages: vec![package],
+        })?;
+
+        let mut archive = tar::Archive::new(zstd::Decoder::new(File::open(&output)?)?);
+        let mut entries = archive.entries()?;
+        let mut entry = entries.next().context("no entry")??;
+        assert_eq!(entry.path()?, Path::new("usr/bin/ping"));
+        let extensions = entry
+            .pax_extensions()?
+            .context("no PAX extensions")?
+            .map(|extension| {
+                let extension = extension?;
+                Ok((
+                    extension.key()?.to_string(),
+                    extension.value_bytes().to_vec(),
+                ))
+            })
+            .collect::<Result<Vec<_>>>()?;
+        assert_eq!(
+            extensions,
+            vec![(XATTR_KEY.to_string(), XATTR_VALUE.to_vec())]
+        );
+
+        Ok(())
+    }
+}
@@ -0,0 +1,479 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use binarypackage::BinaryPackage;
+use clap::Parser;
+use elf::{
+    abi::{DT_SONAME, SHN_ABS, STB_LOCAL, STT_NOTYPE, STT_OBJECT, VER_FLG_BASE},
+    endian::AnyEndian,
+    ElfBytes,
+};
+use sha2::{Digest, Sha256};
+use std::collections::{BTreeMap, HashMap};
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use tar::EntryType;
+
+/// XPAK entries that affect how reverse dependencies are built.
+const XPAK_KEYS: &[&str] = &["PROVIDES", "REQUIRES", "SLOT", "USE"];
+
+/// Computes the interface fingerprint of a binary package: a hash over the
+/// parts of the package that packages depending on it at build time can
+/// observe, i.e. headers, pkg-config files, shared library SONAMEs and
+/// exported symbols, static libraries, build system files, Rust crates,
+/// configuration scripts and selected XPAK entries.
+///
+/// Rebuilding a package without changing its interface, e.g. fixing a bug in
+/// a function body, keeps the fingerprint unchanged even though the binary
+/// package itself differs. The fingerprint is advisory: other executables a
+/// reverse dependency may run at build time are not covered, so it must not be
+/// used as a rebuild key.
+#[derive(Parser, Debug)]
+pub struct FingerprintArgs {
+    /// Path to write the hex-encoded fingerprint to.
+    #[arg(long)]
+    output: PathBuf,
+
+    /// Path to write the list of interface items the fingerprint is computed
+    /// from. Comparing two manifests tells why a fingerprint changed.
+    #[arg(long)]
+    manifest: Option<PathBuf>,
+
+    /// Portage binary package file.
+    #[arg()]
+    binary_package: PathBuf,
+}
+
+/// Kinds of files that are part of the interface of a package.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum InterfaceKind {
+    Header,
+    PkgConfig,
+    SharedLibrary,
+    StaticLibrary,
+    BuildSystem,
+    RustCrate,
+    ConfigScript,
+}
+
+impl InterfaceKind {
+    fn name(self) -> &'static str {
+        match self {
+            InterfaceKind::Header => "header",
+            InterfaceKind::PkgConfig => "pkgconfig",
+            InterfaceKind::SharedLibrary => "shlib",
+            InterfaceKind::StaticLibrary => "staticlib",
+            InterfaceKind::BuildSystem => "buildsystem",
+            InterfaceKind::RustCrate => "crate",
+            InterfaceKind::ConfigScript => "config",
+        }
+    }
+}
+
+/// Returns whether a file name looks like a shared library, e.g. "libfoo.so"
+/// or "libfoo.so.1.2.3".
+fn is_shared_library_name(name: &str) -> bool {
+    let Some((_, suffix)) = name.rsplit_once(".so") else {
+        return false;
+    };
+    (suffix.is_empty() || suffix.starts_with('.'))
+        && suffix
+            .split('.')
+            .skip(1)
+            .all(|part| !part.is_empty() && part.bytes().all(|c| c.is_ascii_digit()))
+}
+
+/// Directories the linker searches for libraries.
+const LIB_DIRS: &[&str] = &["/lib", "/lib32", "/lib64"];
+
+/// Directories executables are installed to.
+const BIN_DIRS: &[&str] = &["/bin", "/sbin"];
+
+/// Classifies an absolute path in a binary package. Paths are matched
+/// regardless of the sysroot they are installed to, e.g. both
+/// "/usr/include/foo.h" and "/build/board/usr/include/foo.h" are headers.
+fn classify(path: &str) -> Option<InterfaceKind> {
+    let (dir, name) = path.rsplit_once('/')?;
+    let in_lib_dir = LIB_DIRS.iter().any(|lib_dir| dir.ends_with(lib_dir));
+    if path.contains("/usr/include/") {
+        Some(InterfaceKind::Header)
+    } else if name.ends_with(".pc") && dir.ends_with("/pkgconfig") {
+        Some(InterfaceKind::PkgConfig)
+    } else if in_lib_dir && is_shared_library_name(name) {
+        // Shared libraries in subdirectories, e.g. plugins, are not found by
+        // the linker.
+        Some(InterfaceKind::SharedLibrary)
+    } else if in_lib_dir && (name.ends_with(".a") || name.ends_with(".la")) {
+        Some(InterfaceKind::StaticLibrary)
+    } else if path.contains("/usr/share/aclocal/")
+        || LIB_DIRS
+            .iter()
+            .chain(&["/share"])
+            .any(|base| path.contains(&format!("/usr{base}/cmake/")))
+    {
+        Some(InterfaceKind::BuildSystem)
+    } else if path.contains("/cros_rust_registry/") {
+        Some(InterfaceKind::RustCrate)
+    } else if name.ends_with("-config") && BIN_DIRS.iter().any(|bin_dir| dir.ends_with(bin_dir)) {
+        // Scripts like "foo-config" print compiler and linker flags for
+        // reverse dependencies, like pkg-config files.
+        Some(InterfaceKind::ConfigScript)
+    } else {
+        None
+    }
+}
+
+fn sha256_hex(data: &[u8]) -> String {
+    hex::encode(Sha256::digest(data))
+}
+
+/// Describes the exported interface of a shared library, i.e. its SONAME and
+/// exported dynamic symbols, in a stable text form. Returns `None` if the file
+/// is not an ELF file, e.g. a linker script.
+fn describe_shared_library(data: &[u8]) -> Result<Option<String>> {
+    if !data.starts_with(b"\x7fELF") {
+        return Ok(None);
+    }
+    let elf = ElfBytes::<AnyEndian>::minimal_parse(data).context("Invalid ELF")?;
+
+    let Some((symbol_table, string_table)) = elf
+        .dynamic_symbol_table()
+        .context("Failed to parse dynamic symbol table")?
+    else {
+        return Ok(Some(String::new()));
+    };
+
+    let mut lines = Vec::new();
+
+    if let Some(dynamic) = elf.dynamic().context("Failed to parse dynamic section")? {
+        for entry in dynamic.iter().filter(|entry| entry.d_tag == DT_SONAME) {
+            let soname = string_table
+                .get(entry.d_val() as usize)
+                .context("Failed to read SONAME")?;
+            lines.push(format!("SONAME {soname}"));
+        }
+    }
+
+    let version_table = elf
+        .symbol_version_table()
+        .context("Failed to parse symbol version table")?;
+
+    let mut symbols = Vec::new();
+    for (index, symbol) in symbol_table.iter().enumerate() {
+        // Only defined global symbols with a type can be linked against. See
+        // create_interface_layer for details.
+        if symbol.is_undefined()
+            || symbol.st_symtype() == STT_NOTYPE
+            || symbol.st_bind() == STB_LOCAL
+            || (symbol.st_shndx == SHN_ABS
+                && symbol.st_value == 0
+                && symbol.st_symtype() == STT_OBJECT)
+        {
+            continue;
+        }
+        let name = string_table
+            .get(symbol.st_name as usize)
+            .with_context(|| format!("Failed to read symbol name at offset {}", symbol.st_name))?;
+
+        let version = match &version_table {
+            Some(version_table) => match version_table
+                .get_definition(index)
+                .context("Failed to parse symbol version definition")?
+            {
+                Some(mut definition) if definition.flags & VER_FLG_BASE == 0 => definition
+                    .names
+                    .next()
+                    .transpose()
+                    .context("Failed to read symbol version")?
+                    .map(|version| format!("@{version}")),
+                _ => None,
+            },
+            None => None,
+        };
+
+        // The size of a data object is part of the ABI because of copy
+        // relocations.
+        let size = if symbol.st_symtype() == STT_OBJECT {
+            format!(" {}", symbol.st_size)
+        } else {
+            String::new()
+        };
+
+        symbols.push(format!(
+            "SYMBOL {name}{} {}{size}",
+            version.unwrap_or_default(),
+            symbol.st_symtype()
+        ));
+    }
+    symbols.sort();
+    lines.extend(symbols);
+
+    Ok(Some(lines.join("\n")))
+}
+
+/// Computes the manifest of interface items in a binary package, keyed by
+/// absolute paths of files or "xpak:<KEY>" for XPAK entries. Each value is a
+/// line of the form "<kind> <digest or link target>".
+fn compute_manifest(
+    archive: &mut tar::Archive<impl Read>,
+    xpak: &HashMap<String, Vec<u8>>,
+) -> Result<BTreeMap<String, String>> {
+    let mut manifest = BTreeMap::new();
+
+    for key in XPAK_KEYS {
+        if let Some(value) = xpak.get(*key) {
+            manifest.insert(format!("xpak:{key}"), format!("xpak {}", sha256_hex(value)));
+        }
+    }
+
+    for entry in archive.entries()? {
+        let mut entry = entry?;
+        let path = format!(
+            "/{}",
+            entry
+                .path()?
+                .to_string_lossy()
+                .trim_start_matches("./")
+                .trim_start_matches('/')
+        );
+        let Some(kind) = classify(&path) else {
+            continue;
+        };
+
+        let value = match entry.header().entry_type() {
+            EntryType::Symlink | EntryType::Link => {
+                let target = entry
+                    .link_name()?
+                    .with_context(|| format!("{path} has no link target"))?;
+                format!("{} -> {}", kind.name(), target.to_string_lossy())
+            }
+            EntryType::Regular | EntryType::Continuous => {
+                let mut data = Vec::new();
+                entry.read_to_end(&mut data)?;
+                let description = match kind {
+                    InterfaceKind::SharedLibrary => describe_shared_library(&data)
+                        .with_context(|| format!("Failed to inspect {path}"))?,
+                    _ => None,
+                };
+                let digest = match description {
+                    Some(description) => sha256_hex(description.as_bytes()),
+                    None => sha256_hex(&data),
+                };
+                format!("{} {digest}", kind.name())
+            }
+            _ => continue,
+        };
+        manifest.insert(path, value);
+    }
+
+    Ok(manifest)
+}
+
+/// Formats a manifest into text. The fingerprint is the hash of the text.
+fn format_manifest(manifest: &BTreeMap<String, String>) -> String {
+    manifest
+        .iter()
+        .map(|(key, value)| format!("{key} {value}\n"))
+        .collect()
+}
+
+fn compute_fingerprint(path: &Path) -> Result<(String, String)> {
+    let mut pkg = BinaryPackage::open(path).with_context(|| format!("{path:?}"))?;
+    let xpak = pkg.xpak().clone();
+    let manifest = format_manifest(&compute_manifest(&mut pkg.archive()?, &xpak)?);
+    Ok((sha256_hex(manifest.as_bytes()), manifest))
+}
+
+pub fn do_fingerprint(args: FingerprintArgs) -> Result<()> {
+    let (fingerprint, manifest) = compute_fingerprint(&args.binary_package)?;
+
+    std::fs::write(&args.output, format!("{fingerprint}\n"))
+        .with_context(|| format!("Failed to write {:?}", args.output))?;
+    if let Some(path) = &args.manifest {
+        std::fs::write(path, manifest).with_context(|| format!("Failed to write {path:?}"))?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+
+    /// Creates an in-memory tarball from (path, contents) pairs. Contents
+    /// starting with "->" create symlinks.
+    fn create_tarball(files: &[(&str, &str)]) -> Result<Vec<u8>> {
+        let mut builder = tar::Builder::new(Vec::new());
+        for (path, contents) in files {
+            let mut header = tar::Header::new_gnu();
+            header.set_mode(0o644);
+            match contents.strip_prefix("->") {
+                Some(target) => {
+                    header.set_entry_type(EntryType::Symlink);
+                    header.set_size(0);
+                    builder.append_link(&mut header, path, target)?;
+                }
+                None => {
+                    header.set_entry_type(EntryType::Regular);
+                    header.set_size(contents.len() as u64);
+                    builder.append_data(&mut header, path, contents.as_bytes())?;
+                }
+            }
+        }
+        Ok(builder.into_inner()?)
+    }
+
+    fn manifest_of(files: &[(&str, &str)], xpak: &[(&str, &str)]) -> Result<String> {
+        let tarball = create_tarball(files)?;
+        let xpak = xpak
+            .iter()
+            .map(|(key, value)| (key.to_string(), value.as_bytes().to_vec()))
+            .collect();
+        Ok(format_manifest(&compute_manifest(
+            &mut tar::Archive::new(tarball.as_slice()),
+            &xpak,
+        )?))
+    }
+
+    #[test]
+    fn test_is_shared_library_name() {
+        assert!(is_shared_library_name("libfoo.so"));
+        assert!(is_shared_library_name("libfoo.so.1"));
+        assert!(is_shared_library_name("libfoo.so.1.2.3"));
+        assert!(!is_shared_library_name("libfoo.so.debug"));
+        assert!(!is_shared_library_name("libfoo.sock"));
+        assert!(!is_shared_library_name("libfoo.a"));
+    }
+
+    #[test]
+    fn test_classify() {
+        assert_eq!(classify("/usr/include/foo.h"), Some(InterfaceKind::Header));
+        assert_eq!(
+            classify("/build/board/usr/include/foo/bar.h"),
+            Some(InterfaceKind::Header)
+        );
+        assert_eq!(
+            classify("/usr/lib64/pkgconfig/foo.pc"),
+            Some(InterfaceKind::PkgConfig)
+        );
+        assert_eq!(
+            classify("/usr/lib64/libfoo.so.1"),
+            Some(InterfaceKind::SharedLibrary)
+        );
+        assert_eq!(
+            classify("/lib64/libc.so.6"),
+            Some(InterfaceKind::SharedLibrary)
+        );
+        assert_eq!(
+            classify("/usr/lib64/libfoo.a"),
+            Some(InterfaceKind::StaticLibrary)
+        );
+        assert_eq!(
+            classify("/usr/lib64/libfoo.la"),
+            Some(InterfaceKind::StaticLibrary)
+        );
+        assert_eq!(
+            classify("/usr/lib64/cmake/Foo/FooConfig.cmake"),
+            Some(InterfaceKind::BuildSystem)
+        );
+        assert_eq!(
+            classify("/usr/share/cmake/Modules/FindFoo.cmake"),
+            Some(InterfaceKind::BuildSystem)
+        );
+        assert_eq!(
+            classify("/usr/share/aclocal/foo.m4"),
+            Some(InterfaceKind::BuildSystem)
+        );
+        assert_eq!(
+            classify("/build/board/usr/lib/cros_rust_registry/store/foo-1.0.0.crate"),
+            Some(InterfaceKind::RustCrate)
+        );
+        assert_eq!(
+            classify("/usr/bin/foo-config"),
+            Some(InterfaceKind::ConfigScript)
+        );
+        assert_eq!(classify("/usr/lib64/foo/plugin.so"), None);
+        assert_eq!(classify("/usr/lib64/foo/plugin.a"), None);
+        assert_eq!(classify("/usr/bin/foo"), None);
+        assert_eq!(classify("/usr/share/doc/foo.pc"), None);
+        assert_eq!(classify("/etc/foo-config"), None);
+    }
+
+    #[test]
+    fn test_compute_manifest() -> Result<()> {
+        let manifest = manifest_of(
+            &[
+                ("./usr/bin/foo", "binary"),
+                ("./usr/include/foo.h", "int foo(void);"),
+                ("./usr/lib64/libfoo.so", "->libfoo.so.1"),
+                ("./usr/lib64/libbar.so", "GROUP ( libbar.so.1 )"),
+                ("./usr/lib64/libfoo.a", "!<arch>"),
+                ("./usr/lib64/pkgconfig/foo.pc", "Libs: -lfoo"),
+            ],
+            &[("SLOT", "0"), ("DESCRIPTION", "Foo")],
+        )?;
+        assert_eq!(
+            manifest,
+            format!(
+                "/usr/include/foo.h header {}\n\
+                 /usr/lib64/libbar.so shlib {}\n\
+                 /usr/lib64/libfoo.a staticlib {}\n\
+                 /usr/lib64/libfoo.so shlib -> libfoo.so.1\n\
+                 /usr/lib64/pkgconfig/foo.pc pkgconfig {}\n\
+                 xpak:SLOT xpak {}\n",
+                sha256_hex(b"int foo(void);"),
+                sha256_hex(b"GROUP ( libbar.so.1 )"),
+                sha256_hex(b"!<arch>"),
+                sha256_hex(b"Libs: -lfoo"),
+                sha256_hex(b"0"),
+            )
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_manifest_ignores_non_interface_changes() -> Result<()> {
+        let manifest = manifest_of(
+            &[
+                ("./usr/bin/foo", "binary"),
+                ("./usr/include/foo.h", "int foo(void);"),
+            ],
+            &[("SLOT", "0")],
+        )?;
+        let rebuilt_manifest = manifest_of(
+            &[
+                ("./usr/include/foo.h", "int foo(void);"),
+                ("./usr/bin/foo", "new binary"),
+                ("./usr/share/doc/foo/README", "docs"),
+            ],
+            &[("SLOT", "0"), ("BUILD_TIME", "12345")],
+        )?;
+        assert_eq!(manifest, rebuilt_manifest);
+
+        let changed_manifest = manifest_of(
+            &[
+                ("./usr/bin/foo", "binary"),
+                ("./usr/include/foo.h", "int foo(int x);"),
+            ],
+            &[("SLOT", "0")],
+        )?;
+        assert_ne!(manifest, changed_manifest);
+        Ok(())
+    }
+
+    #[test]
+    fn test_fingerprint_of_binary_packages() -> Result<()> {
+        let (fingerprint, _) = compute_fingerprint(&testdata(BINPKG)?)?;
+        assert_eq!(fingerprint.len(), 64);
+
+        // The packages differ only in non-interface files and the ebuild.
+        let (diff_tar_fingerprint, _) = compute_fingerprint(&testdata(BINPKG_DIFF_TAR)?)?;
+        let (diff_xpak_fingerprint, _) = compute_fingerprint(&testdata(BINPKG_DIFF_XPAK)?)?;
+        assert_eq!(fingerprint, diff_tar_fingerprint);
+        assert_eq!(fingerprint, diff_xpak_fingerprint);
+        Ok(())
+    }
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use binarypackage::BinaryPackage;
+use clap::Parser;
+use std::collections::BTreeMap;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+/// Prints values of XPAK entries of a Portage binary package.
+#[derive(Parser, Debug)]
+pub struct GetArgs {
+    /// Prints the values as a JSON object mapping keys to values. All values
+    /// must be valid UTF-8.
+    #[arg(long, conflicts_with = "output_dir")]
+    json: bool,
+
+    /// Saves each value to a file named after its key in the specified
+    /// directory instead of printing them.
+    #[arg(long)]
+    output_dir: Option<PathBuf>,
+
+    /// Portage binary package file.
+    #[arg()]
+    binary_package: PathBuf,
+
+    /// XPAK keys to get, e.g. "USE", "RDEPEND".
+    #[arg(required = true)]
+    keys: Vec<String>,
+}
+
+/// Looks up the values of the given keys, failing if any of them is missing.
+fn lookup<'a>(pkg: &'a BinaryPackage, keys: &'a [String]) -> Result<Vec<(&'a str, &'a [u8])>> {
+    keys.iter()
+        .map(|key| {
+            let value = pkg
+                .xpak()
+                .get(key)
+                .with_context(|| format!("{key} XPAK entry not found"))?;
+            Ok((key.as_str(), value.as_slice()))
+        })
+        .collect()
+}
+
+fn get(pkg: &BinaryPackage, keys: &[String], json: bool, out: &mut impl Write) -> Result<()> {
+    let entries = lookup(pkg, keys)?;
+    if json {
+        let values = entries
+            .into_iter()
+            .map(|(key, value)| {
+                let value = std::str::from_utf8(value)
+                    .with_context(|| format!("{key} is not valid UTF-8; use --output-dir"))?;
+                Ok((key, value))
+            })
+            .collect::<Result<BTreeMap<_, _>>>()?;
+        serde_json::to_writer_pretty(&mut *out, &values)?;
+        writeln!(out)?;
+    } else {
+        for (_, value) in entries {
+            out.write_all(value)?;
+        }
+    }
+    Ok(())
+}
+
+fn get_to_dir(pkg: &BinaryPackage, keys: &[String], output_dir: &Path) -> Result<()> {
+    let entries = lookup(pkg, keys)?;
+    std::fs::create_dir_all(output_dir)?;
+    for (key, value) in entries {
+        let path = output_dir.join(key);
+        std::fs::write(&path, value).with_context(|| format!("write {}", path.display()))?;
+    }
+    Ok(())
+}
+
+pub fn do_get(args: GetArgs) -> Result<()> {
+    let pkg = BinaryPackage::open(&args.binary_package)?;
+    match &args.output_dir {
+        Some(output_dir) => get_to_dir(&pkg, &args.keys, output_dir),
+        None => get(&pkg, &args.keys, args.json, &mut std::io::stdout().lock()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+
+    fn keys(keys: &[&str]) -> Vec<String> {
+        keys.iter().map(|key| key.to_string()).collect()
+    }
+
+    #[test]
+    fn get_raw() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut out = Vec::new();
+        get(&pkg, &keys(&["SLOT", "CATEGORY"]), false, &mut out)?;
+
+        assert_eq!(String::from_utf8(out)?, "0\napp-editors\n");
+
+        Ok(())
+    }
+
+    #[test]
+    fn get_json() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut out = Vec::new();
+        get(&pkg, &keys(&["SLOT", "CATEGORY"]), true, &mut out)?;
+
+        let values: BTreeMap<String, String> = serde_json::from_slice(&out)?;
+        assert_eq!(
+            values,
+            BTreeMap::from([
+                ("CATEGORY".to_string(), "app-editors\n".to_string()),
+                ("SLOT".to_string(), "0\n".to_string()),
+            ])
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn get_json_binary() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut out = Vec::new();
+
+        assert!(get(&pkg, &keys(&["environment.bz2"]), true, &mut out).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn get_missing_key() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut out = Vec::new();
+
+        assert!(get(&pkg, &keys(&["SLOT", "NO_SUCH_KEY"]), false, &mut out).is_err());
+        assert!(out.is_empty());
+
+        Ok(())
+    }
+
+    #[test]
+    fn get_output_dir() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let dir = tempfile::tempdir()?;
+        let output_dir = dir.path().join("out");
+
+        get_to_dir(&pkg, &keys(&["SLOT", "environment.bz2"]), &output_dir)?;
+
+        assert_eq!(std::fs::read_to_string(output_dir.join("SLOT"))?, "0\n");
+        assert_eq!(
+            std::fs::read(output_dir.join("environment.bz2"))?,
+            pkg.xpak()["environment.bz2"]
+        );
+
+        Ok(())
+    }
+}
@@ -3,7 +3,14 @@
 // found in the LICENSE file.
 
 mod compare_packages;
+mod convert_to_deb;
+mod create;
 mod diff;
+mod export;
+mod fingerprint;
+mod get;
+mod show;
+mod split;
 #[cfg(test)]
 mod testdata;
 mod update_xpak;
@@ -13,10 +20,17 @@ mod validate_package;
 use anyhow::{Context, Result};
 use binarypackage::BinaryPackage;
 use clap::{Parser, Subcommand};
-use cliutil::{cli_main, ConfigBuilder};
+use cliutil::{cli_main, ConfigBuilder, LoggingArgs};
 use itertools::Itertools;
 
 use crate::compare_packages::{do_compare_packages, ComparePackagesArgs};
+use crate::convert_to_deb::{do_convert_to_deb, ConvertToDebArgs};
+use crate::create::{do_create, CreateArgs};
+use crate::export::{do_export, ExportArgs};
+use crate::fingerprint::{do_fingerprint, FingerprintArgs};
+use crate::get::{do_get, GetArgs};
+use crate::show::{do_show, ShowArgs};
+use crate::split::{do_merge, do_split, MergeArgs, SplitArgs};
 use crate::update_xpak::{do_update_xpak, UpdateXpakArgs};
 use crate::validate_package::{do_validate_package, ValidatePackageArgs};
 use std::{path::PathBuf, process::ExitCode};
@@ -24,6 +38,11 @@ use std::{path::PathBuf, process::ExitCode};
 #[derive(Parser, Debug)]
 #[command()]
 struct Cli {
+    // Read by cli_main before the command line is parsed.
+    #[allow(dead_code)]
+    #[command(flatten)]
+    logging: LoggingArgs,
+
     #[clap(subcommand)]
     commands: Commands,
 }
@@ -31,9 +50,19 @@ struct Cli {
 #[derive(Subcommand, Debug)]
 enum Commands {
     ExtractXpak(ExtractXpakArgs),
+    #[command(alias = "diff")]
     ComparePackages(ComparePackagesArgs),
     ValidatePackage(ValidatePackageArgs),
+    Create(CreateArgs),
+    #[command(alias = "set")]
     UpdateXpak(UpdateXpakArgs),
+    ConvertToDeb(ConvertToDebArgs),
+    Show(ShowArgs),
+    Get(GetArgs),
+    Split(SplitArgs),
+    Merge(MergeArgs),
+    Export(ExportArgs),
+    Fingerprint(FingerprintArgs),
 }
 
 /// Shows XPAK entries in a Portage binary package file.
@@ -62,7 +91,15 @@ fn do_main() -> Result<()> {
         Commands::ExtractXpak(args) => do_extract_xpak(args),
         Commands::ComparePackages(args) => do_compare_packages(args),
         Commands::ValidatePackage(args) => do_validate_package(args),
+        Commands::Create(args) => do_create(args),
         Commands::UpdateXpak(args) => do_update_xpak(args),
+        Commands::ConvertToDeb(args) => do_convert_to_deb(args),
+        Commands::Show(args) => do_show(args),
+        Commands::Get(args) => do_get(args),
+        Commands::Split(args) => do_split(args),
+        Commands::Merge(args) => do_merge(args),
+        Commands::Export(args) => do_export(args),
+        Commands::Fingerprint(args) => do_fingerprint(args),
     }
 }
 
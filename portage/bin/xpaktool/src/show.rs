@@ -0,0 +1,78 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::Result;
+use binarypackage::BinaryPackage;
+use clap::Parser;
+use itertools::Itertools;
+use std::collections::BTreeMap;
+use std::io::Write;
+use std::path::PathBuf;
+
+/// Lists XPAK entries of a Portage binary package with their sizes.
+#[derive(Parser, Debug)]
+pub struct ShowArgs {
+    /// Prints the entries as a JSON object mapping keys to sizes in bytes.
+    #[arg(long)]
+    json: bool,
+
+    /// Portage binary package file.
+    #[arg()]
+    binary_package: PathBuf,
+}
+
+fn show(pkg: &BinaryPackage, json: bool, out: &mut impl Write) -> Result<()> {
+    if json {
+        let sizes: BTreeMap<&str, usize> = pkg
+            .xpak()
+            .iter()
+            .map(|(key, value)| (key.as_str(), value.len()))
+            .collect();
+        serde_json::to_writer_pretty(&mut *out, &sizes)?;
+        writeln!(out)?;
+    } else {
+        for (key, value) in pkg.xpak().iter().sorted_by(|a, b| a.0.cmp(b.0)) {
+            writeln!(out, "{key}\t{}", value.len())?;
+        }
+    }
+    Ok(())
+}
+
+pub fn do_show(args: ShowArgs) -> Result<()> {
+    let pkg = BinaryPackage::open(&args.binary_package)?;
+    show(&pkg, args.json, &mut std::io::stdout().lock())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+
+    #[test]
+    fn show_text() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut out = Vec::new();
+        show(&pkg, false, &mut out)?;
+
+        let out = String::from_utf8(out)?;
+        let lines = out.lines().collect_vec();
+        assert_eq!(lines.len(), pkg.xpak().len());
+        assert!(lines.iter().any(|line| *line == "SLOT\t2"), "{out}");
+
+        Ok(())
+    }
+
+    #[test]
+    fn show_json() -> Result<()> {
+        let pkg = BinaryPackage::open(&testdata(BINPKG)?)?;
+        let mut out = Vec::new();
+        show(&pkg, true, &mut out)?;
+
+        let sizes: BTreeMap<String, usize> = serde_json::from_slice(&out)?;
+        assert_eq!(sizes.len(), pkg.xpak().len());
+        assert_eq!(sizes.get("SLOT"), Some(&2));
+
+        Ok(())
+    }
+}
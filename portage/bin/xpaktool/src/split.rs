@@ -0,0 +1,100 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use binarypackage::BinaryPackageReader;
+use clap::Parser;
+use std::path::PathBuf;
+
+/// Splits a Portage binary package into the compressed tarball and the XPAK
+/// segment, e.g. to edit or download them separately.
+#[derive(Parser, Debug)]
+pub struct SplitArgs {
+    /// Path to write the compressed tarball to, e.g. "image.tar.zst".
+    #[arg(long)]
+    tarball: PathBuf,
+
+    /// Path to write the XPAK segment to, e.g. "image.xpak".
+    #[arg(long)]
+    xpak: PathBuf,
+
+    /// Portage binary package file.
+    #[arg()]
+    binary_package: PathBuf,
+}
+
+/// Merges a compressed tarball and an XPAK segment written by `split` back
+/// into a Portage binary package.
+#[derive(Parser, Debug)]
+pub struct MergeArgs {
+    /// Compressed tarball written by `split`.
+    #[arg(long)]
+    tarball: PathBuf,
+
+    /// XPAK segment written by `split`.
+    #[arg(long)]
+    xpak: PathBuf,
+
+    /// Path to write the binary package to.
+    #[arg(long)]
+    output: PathBuf,
+}
+
+pub fn do_split(args: SplitArgs) -> Result<()> {
+    BinaryPackageReader::open(&args.binary_package)?
+        .write_split(&args.tarball, &args.xpak)
+        .with_context(|| format!("Failed to split {:?}", args.binary_package))
+}
+
+pub fn do_merge(args: MergeArgs) -> Result<()> {
+    BinaryPackageReader::open_split(&args.tarball, &args.xpak)?
+        .write_tbz2(&args.output)
+        .with_context(|| format!("Failed to create {:?}", args.output))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::testdata::*;
+    use binarypackage::BinaryPackage;
+
+    #[test]
+    fn split_and_merge() -> Result<()> {
+        for (name, category_pf) in [
+            (BINPKG, "app-editors/nano-6.4"),
+            (BINPKG_DIFF_XPAK, "app-editors/nano-6.4"),
+            (BINPKG_DIFF_TAR, "app-editors/nano-6.4"),
+            (BINPKG_CLEAN_ENV, "app-editors/nano-7.2-r1"),
+        ] {
+            let dir = tempfile::tempdir()?;
+            let dir = dir.as_ref();
+            let binary_package = testdata(name)?;
+
+            let tarball = dir.join("image.tar.zst");
+            let xpak = dir.join("image.xpak");
+            do_split(SplitArgs {
+                tarball: tarball.clone(),
+                xpak: xpak.clone(),
+                binary_package: binary_package.clone(),
+            })?;
+
+            let output = dir.join("out.tbz2");
+            do_merge(MergeArgs {
+                tarball,
+                xpak,
+                output: output.clone(),
+            })?;
+
+            assert_eq!(
+                std::fs::read(&output)?,
+                std::fs::read(&binary_package)?,
+                "{name}"
+            );
+            let pkg = BinaryPackage::open(&output)?;
+            assert_eq!(pkg.category_pf(), category_pf, "{name}");
+        }
+
+        Ok(())
+    }
+}
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::{Context, Result};
+use anyhow::{bail, Context, Result};
 use binarypackage::BinaryPackage;
 use clap::Parser;
 use std::path::PathBuf;
@@ -14,7 +14,7 @@ fn parse_key_val(s: &str) -> Result<(String, String)> {
         .map(|(k, v)| (k.to_string(), v.to_string()))
 }
 
-/// Compares two packages.
+/// Sets or removes XPAK entries of a Portage binary package in place.
 #[derive(Parser, PartialEq, Eq, Debug)]
 pub struct UpdateXpakArgs {
     /// Portage binary package to update.
@@ -25,6 +25,10 @@ pub struct UpdateXpakArgs {
     /// Note: value must be valid UTF-8.
     #[arg(value_parser = parse_key_val)]
     values: Vec<(String, String)>,
+
+    /// Keys to remove. Can be specified multiple times.
+    #[arg(long, value_name = "KEY")]
+    unset: Vec<String>,
 }
 
 pub fn do_update_xpak(args: UpdateXpakArgs) -> Result<()> {
@@ -36,6 +40,12 @@ pub fn do_update_xpak(args: UpdateXpakArgs) -> Result<()> {
         xpak.insert(k, v.into_bytes());
     }
 
+    for k in args.unset {
+        if xpak.remove(&k).is_none() {
+            bail!("{k} XPAK entry not found");
+        }
+    }
+
     pkg.replace_xpak(&xpak)?;
 
     Ok(())
@@ -63,7 +73,8 @@ mod tests {
                 values: vec![
                     ("Hello".into(), "World".into()),
                     ("Foo".into(), "Bar=Baz".into()),
-                ]
+                ],
+                unset: vec![],
             }
         );
 
@@ -86,6 +97,7 @@ mod tests {
                 ("NEW_KEY".to_string(), "Hello World".to_string()),
                 ("CHOST".to_string(), "x86_64-pc-linux-gnu\n".to_string()),
             ],
+            unset: vec![],
         })?;
 
         let src = BinaryPackage::open(src).with_context(|| format!("src: {src:?}"))?;
@@ -108,4 +120,28 @@ mod tests {
 
         Ok(())
     }
+
+    #[test]
+    fn unset_keys() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dest = dir.as_ref().join("out.tbz2");
+        std::fs::copy(testdata(BINPKG)?, &dest)?;
+
+        do_update_xpak(UpdateXpakArgs {
+            binpkg: dest.clone(),
+            values: vec![],
+            unset: vec!["CHOST".to_string()],
+        })?;
+        assert!(!BinaryPackage::open(&dest)?.xpak().contains_key("CHOST"));
+
+        // Removing a missing key is an error.
+        assert!(do_update_xpak(UpdateXpakArgs {
+            binpkg: dest.clone(),
+            values: vec![],
+            unset: vec!["CHOST".to_string()],
+        })
+        .is_err());
+
+        Ok(())
+    }
 }
@@ -48,6 +48,17 @@ pub struct ValidatePackageArgs {
     )]
     use_flags: Option<HashMap<String, bool>>,
 
+    /// The slot the package should be installed to, e.g. "0/1.2". A slot
+    /// without a sub-slot is treated as having the sub-slot equal to the
+    /// main slot.
+    #[arg(long)]
+    slot: Option<String>,
+
+    /// URL the package was downloaded from, if it is a prebuilt. Used to
+    /// explain validation failures.
+    #[arg(long)]
+    prebuilt: Option<String>,
+
     /// Bazel requires a file to be generated for all actions
     #[arg(long, hide = true)]
     touch: Option<PathBuf>,
@@ -88,6 +99,29 @@ fn extract_iuse_effective_flags(package: &binarypackage::BinaryPackage) -> Resul
     Ok(use_flags.split_whitespace().collect())
 }
 
+/// Returns the slot the package was built for, normalized to the
+/// "main/sub" form.
+fn extract_slot(package: &binarypackage::BinaryPackage) -> Result<String> {
+    let slot = std::str::from_utf8(
+        package
+            .xpak()
+            .get("SLOT")
+            .context("SLOT XPAK entry not found")?,
+    )?;
+
+    Ok(normalize_slot(slot))
+}
+
+/// Normalizes a slot string to the "main/sub" form.
+fn normalize_slot(slot: &str) -> String {
+    let slot = slot.trim();
+    if slot.contains('/') {
+        slot.to_string()
+    } else {
+        format!("{slot}/{slot}")
+    }
+}
+
 fn extract_environment(pkg: &BinaryPackage) -> Result<String> {
     let bz2_env = pkg
         .xpak()
@@ -156,7 +190,18 @@ pub fn do_validate_package(args: ValidatePackageArgs) -> Result<()> {
 
     // Reports a validation error. If --report-only is set, it just prints the error to stdout and
     // return success. Otherwise, it returns an error value with the given message.
+    // If the package is a prebuilt, the message explains that it can't be
+    // substituted for a local build.
     let report = |message: std::fmt::Arguments| -> Result<()> {
+        let message = match &args.prebuilt {
+            Some(url) => format!(
+                "{}\n* The prebuilt binary package {} was not built with the \
+                configuration resolved for this package; refusing to use it. \
+                Drop the prebuilt flag to build the package locally.",
+                message, url
+            ),
+            None => message.to_string(),
+        };
         if args.report_only {
             println!("{}", message);
             return Ok(());
@@ -217,6 +262,20 @@ pub fn do_validate_package(args: ValidatePackageArgs) -> Result<()> {
         }
     }
 
+    if let Some(expected_slot) = &args.slot {
+        let expected_slot = normalize_slot(expected_slot);
+        let actual_slot = extract_slot(&package)?;
+        if actual_slot != expected_slot {
+            report(format_args!(
+                "\n* SLOT mismatch!\n  \
+                Expected SLOT: {}\n  \
+                Actual SLOT: {}\n  \
+                ",
+                expected_slot, actual_slot,
+            ))?;
+        }
+    }
+
     if args.check_non_hermetic_variables {
         if let Err(env_error) = validate_env(&package) {
             report(format_args!("{}", env_error))?;
@@ -251,6 +310,8 @@ mod tests {
                 package: PathBuf::from("foo.tbz2"),
                 touch: Some(PathBuf::from("touch")),
                 use_flags: None,
+                slot: None,
+                prebuilt: None,
                 report_only: false,
                 check_non_hermetic_variables: false,
             }
@@ -278,6 +339,8 @@ mod tests {
                     ("foo".to_string(), true),
                     ("bar".to_string(), false)
                 ])),
+                slot: None,
+                prebuilt: None,
                 report_only: false,
                 check_non_hermetic_variables: false,
             }
@@ -302,6 +365,8 @@ mod tests {
                 package: PathBuf::from("foo.tbz2"),
                 touch: None,
                 use_flags: Some(HashMap::new()),
+                slot: None,
+                prebuilt: None,
                 report_only: false,
                 check_non_hermetic_variables: false,
             }
@@ -430,6 +495,8 @@ mod tests {
                 ("x86-solaris".into(), false),
                 ("x86-winnt".into(), false),
             ])),
+            slot: None,
+            prebuilt: None,
             report_only: false,
             check_non_hermetic_variables: false,
         };
@@ -445,6 +512,8 @@ mod tests {
             package: testdata(BINPKG)?,
             touch: None,
             use_flags: Some(HashMap::from([("foo".into(), true), ("bar".into(), false)])),
+            slot: None,
+            prebuilt: None,
             report_only: false,
             check_non_hermetic_variables: false,
         };
@@ -460,6 +529,8 @@ mod tests {
             package: testdata(BINPKG)?,
             touch: None,
             use_flags: Some(HashMap::from([("foo".into(), true), ("bar".into(), false)])),
+            slot: None,
+            prebuilt: None,
             report_only: true,
             check_non_hermetic_variables: true,
         };
@@ -469,6 +540,70 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn slot_equal() -> Result<()> {
+        for slot in ["0", "0/0"] {
+            let args = ValidatePackageArgs {
+                package: testdata(BINPKG)?,
+                touch: None,
+                use_flags: None,
+                slot: Some(slot.into()),
+                prebuilt: None,
+                report_only: false,
+                check_non_hermetic_variables: false,
+            };
+
+            do_validate_package(args)?;
+        }
+
+        Ok(())
+    }
+
+    #[test]
+    fn slot_not_equal() -> Result<()> {
+        let args = ValidatePackageArgs {
+            package: testdata(BINPKG)?,
+            touch: None,
+            use_flags: None,
+            slot: Some("0/1".into()),
+            prebuilt: None,
+            report_only: false,
+            check_non_hermetic_variables: false,
+        };
+
+        assert!(do_validate_package(args).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn prebuilt_mismatch() -> Result<()> {
+        let args = ValidatePackageArgs {
+            package: testdata(BINPKG)?,
+            touch: None,
+            use_flags: Some(HashMap::from([("foo".into(), true)])),
+            slot: None,
+            prebuilt: Some("gs://bucket/nano.tbz2".into()),
+            report_only: false,
+            check_non_hermetic_variables: false,
+        };
+
+        let err = do_validate_package(args).unwrap_err();
+        assert!(
+            err.to_string().contains("gs://bucket/nano.tbz2"),
+            "unexpected error: {err}"
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn normalize_slot_adds_sub_slot() {
+        assert_eq!(normalize_slot("0"), "0/0");
+        assert_eq!(normalize_slot("2/2.1"), "2/2.1");
+        assert_eq!(normalize_slot("1\n"), "1/1");
+    }
+
     #[test]
     fn touch() -> Result<()> {
         let dir = tempfile::tempdir()?;
@@ -480,6 +615,8 @@ mod tests {
             package: testdata(BINPKG)?,
             touch: Some(validation.clone()),
             use_flags: None,
+            slot: None,
+            prebuilt: None,
             report_only: false,
             check_non_hermetic_variables: false,
         };
@@ -31,6 +31,7 @@ def _binary_package_impl(ctx):
     package_info = BinaryPackageInfo(
         partial = src,
         contents = contents,
+        interface_hash = None,
         package_name = ctx.attr.package_name or ctx.label.name,
         category = ctx.attr.category,
         version = ctx.attr.version,
@@ -93,6 +94,7 @@ def _add_runtime_deps(ctx):
     package_info = BinaryPackageInfo(
         partial = original_package_info.partial,
         contents = original_package_info.contents,
+        interface_hash = original_package_info.interface_hash,
         category = original_package_info.category,
         package_name = original_package_info.package_name,
         version = original_package_info.version,
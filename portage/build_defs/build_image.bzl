@@ -2,10 +2,38 @@
 # Use of this source code is governed by a BSD-style license that can be
 # found in the LICENSE file.
 
+load("@bazel_skylib//rules:common_settings.bzl", "BuildSettingInfo")
 load("@rules_pkg//pkg:providers.bzl", "PackageArtifactInfo")
 load("//bazel/portage/build_defs:common.bzl", "BinaryPackageSetInfo", "OverlaySetInfo", "SDKInfo", "sdk_to_layer_list")
 load("//bazel/portage/build_defs:install_deps.bzl", "install_deps")
 
+# Image types supported by build_image.
+#
+# file_name: The name of the image file generated by the build_image script.
+# packages: Packages installed on the image by default.
+IMAGE_TYPES = {
+    "base": struct(
+        file_name = "chromiumos_base_image",
+        packages = ["virtual/target-os"],
+    ),
+    "dev": struct(
+        file_name = "chromiumos_image",
+        packages = ["virtual/target-os", "virtual/target-os-dev"],
+    ),
+    "test": struct(
+        file_name = "chromiumos_test_image",
+        packages = [
+            "virtual/target-os",
+            "virtual/target-os-dev",
+            "virtual/target-os-test",
+        ],
+    ),
+    "factory": struct(
+        file_name = "factory_install_shim",
+        packages = ["virtual/target-os-factory-shim"],
+    ),
+}
+
 def _build_image_impl(ctx):
     # Declare outputs.
     output_image_file = ctx.actions.declare_file(
@@ -42,6 +70,10 @@ def _build_image_impl(ctx):
             ctx.executable._fast_install_packages,
         progress_message = "Setting up SDK to build image",
         contents = "full",
+        verify_sysroot = ctx.attr._verify_sysroot[BuildSettingInfo].value,
+        collision_ignore = ctx.attr._collision_ignore[BuildSettingInfo].value,
+        install_mask = ctx.attr._install_mask[BuildSettingInfo].value,
+        collision_protect = ctx.attr._collision_protect[BuildSettingInfo].value,
     )
 
     # Compute arguments and inputs to build_image.
@@ -53,8 +85,7 @@ def _build_image_impl(ctx):
         "--output",
         output_image_file,
         "--board=" + ctx.attr.board,
-        "--image-to-build=" + ctx.attr.image_to_build,
-        "--image-file-name=" + ctx.attr.image_file_name,
+        "--image-type=" + ctx.attr.image_type,
     ])
 
     layers = (
@@ -89,7 +120,11 @@ def _build_image_impl(ctx):
         ],
     )
     args.add_all(host_package_files, format_each = "--host-package=%s")
-    transitive_inputs.append(target_package_files)
+    transitive_inputs.append(host_package_files)
+
+    if ctx.file.toolchain:
+        args.add("--toolchain", ctx.file.toolchain)
+        direct_inputs.append(ctx.file.toolchain)
 
     if ctx.attr.override_base_packages:
         args.add_all(ctx.attr.override_base_packages, format_each = "--override-base-package=%s")
@@ -139,21 +174,16 @@ def _build_image_impl(ctx):
         ),
     ]
 
-build_image = rule(
+_build_image = rule(
     implementation = _build_image_impl,
     doc = "Builds a ChromeOS image.",
     attrs = dict(
-        image_to_build = attr.string(
-            doc = """
-            The name of the image to build (e.g. "base", "dev", or "test").
-            """,
-            mandatory = True,
-        ),
-        image_file_name = attr.string(
+        image_type = attr.string(
             doc = """
-            The name of the image file generated by build_image script (e.g. "chromiumos_base_image").
+            The type of the image to build. See IMAGE_TYPES for choices.
             """,
             mandatory = True,
+            values = IMAGE_TYPES.keys(),
         ),
         output_image_file_name = attr.string(
             doc = """
@@ -188,6 +218,14 @@ build_image = rule(
             Extra files to be made available in the ephemeral chroot.
             """,
         ),
+        toolchain = attr.label(
+            allow_single_file = [".json"],
+            doc = """
+            A JSON file describing the cross-compilation toolchain of the
+            board, generated by alchemist. If set, build_image verifies that
+            host_packages provide the toolchain.
+            """,
+        ),
         board = attr.string(
             mandatory = True,
             doc = """
@@ -225,5 +263,57 @@ build_image = rule(
             cfg = "exec",
             default = Label("//bazel/portage/bin/fast_install_packages"),
         ),
+        _verify_sysroot = attr.label(
+            default = Label("//bazel/portage:verify_sysroot"),
+            providers = [BuildSettingInfo],
+        ),
+        _collision_ignore = attr.label(
+            default = Label("//bazel/portage:collision_ignore"),
+            providers = [BuildSettingInfo],
+        ),
+        _install_mask = attr.label(
+            default = Label("//bazel/portage:install_mask"),
+            providers = [BuildSettingInfo],
+        ),
+        _collision_protect = attr.label(
+            default = Label("//bazel/portage:collision_protect"),
+            providers = [BuildSettingInfo],
+        ),
     ),
 )
+
+def build_image(
+        name,
+        image_type,
+        target_packages = None,
+        output_image_file_name = None,
+        **kwargs):
+    """Builds a ChromeOS image of a type.
+
+    Args:
+        name: The name of the target.
+        image_type: The type of the image to build. See IMAGE_TYPES.
+        target_packages: Packages included in the image. Defaults to the
+            packages of the image type, which are resolved against the
+            "target" package of the current repository.
+        output_image_file_name: The name of the output image file without
+            the extension. Defaults to the file name of the image type.
+        **kwargs: Other arguments passed to the rule.
+    """
+    if image_type not in IMAGE_TYPES:
+        fail("Unknown image type: %s" % image_type)
+    spec = IMAGE_TYPES[image_type]
+
+    if target_packages == None:
+        target_packages = [
+            "//target/%s:package_set" % package
+            for package in spec.packages
+        ]
+
+    _build_image(
+        name = name,
+        image_type = image_type,
+        target_packages = target_packages,
+        output_image_file_name = output_image_file_name or spec.file_name,
+        **kwargs
+    )
@@ -20,11 +20,21 @@ def _build_sdk_impl(ctx):
         "--temp-dir",
         output_log_file.dirname + "/tmp",
         ctx.executable._build_sdk,
+        "--output-format=snapshot",
         "--board",
         ctx.attr.board,
         "--output",
         output_sdk,
+        "--exclude-from",
+        ctx.file._snapshot_excludes,
     ], expand_directories = False)
+    args.add_all(ctx.attr.excludes, format_each = "--exclude=%s")
+
+    outputs = [output_sdk]
+    if ctx.attr.split_metadata:
+        output_metadata = ctx.actions.declare_directory(output_prefix + "_metadata")
+        args.add("--output-metadata", output_metadata)
+        outputs.append(output_metadata)
 
     layer_inputs = (
         sdk_to_layer_list(sdk) +
@@ -35,8 +45,8 @@ def _build_sdk_impl(ctx):
     args.add_all(layer_inputs, format_each = "--layer=%s", expand_directories = False)
 
     ctx.actions.run(
-        inputs = depset(layer_inputs),
-        outputs = [output_sdk, output_log_file],
+        inputs = depset(layer_inputs + [ctx.file._snapshot_excludes]),
+        outputs = outputs + [output_log_file],
         executable = ctx.executable._action_wrapper,
         tools = [ctx.executable._build_sdk],
         arguments = [args],
@@ -52,13 +62,14 @@ def _build_sdk_impl(ctx):
     )
 
     return [
-        DefaultInfo(files = depset([output_sdk])),
+        DefaultInfo(files = depset(outputs)),
         OutputGroupInfo(
             logs = depset([output_log_file]),
         ),
         SDKInfo(
-            layers = [
-                SDKLayer(file = output_sdk),
+            layers = [SDKLayer(file = output_sdk)] + [
+                SDKLayer(file = output, metadata = True)
+                for output in outputs[1:]
             ],
             packages = depset(),
         ),
@@ -73,6 +84,12 @@ build_sdk = rule(
             The board name of the target SDK board.
             """,
         ),
+        "excludes": attr.string_list(
+            doc = """
+            Additional path patterns to exclude from the SDK, relative to its
+            root, e.g. "usr/share/info/*".
+            """,
+        ),
         "extra_tarballs": attr.label_list(
             allow_files = True,
         ),
@@ -103,6 +120,14 @@ build_sdk = rule(
             mandatory = True,
             providers = [SDKInfo],
         ),
+        "split_metadata": attr.bool(
+            doc = """
+            If True, package manager metadata such as the installed package
+            database is emitted as a separate layer on top of the content
+            layer, so that metadata-only changes don't invalidate actions
+            depending only on the contents.
+            """,
+        ),
         "_action_wrapper": attr.label(
             executable = True,
             cfg = "exec",
@@ -113,5 +138,9 @@ build_sdk = rule(
             cfg = "exec",
             default = Label("//bazel/portage/bin/build_sdk"),
         ),
+        "_snapshot_excludes": attr.label(
+            allow_single_file = True,
+            default = Label("//bazel/portage/bin/build_sdk:snapshot_excludes.txt"),
+        ),
     },
 )
@@ -42,6 +42,15 @@ BinaryPackageInfo, _new_binary_package_info = provider(
             See the provider description for why this field is a tuple, not a
             list.
         """,
+        "interface_hash": """
+            Optional[File]: A file containing the hash of the package's
+            interface, i.e. headers, pkg-config files, shared library SONAMEs
+            and exported symbols, and selected XPAK entries. It stays the same
+            when the package is rebuilt without changing its interface, so
+            actions that only care about the interface should depend on this
+            file instead of the binary package. None for prebuilt binary
+            packages.
+        """,
         "metadata": """
             File: A json file containing metadata about the package that cannot
             be determined during the analysis phase.
@@ -223,6 +232,17 @@ SDKLayer = provider(
             Option[File]: If present, it contains an interface library layer
             derived from the `file`.
         """,
+        "metadata": """
+            Option[bool]: If True, the layer only contains package manager
+            metadata, such as the installed package database, split out of
+            the layer below it. sdk_to_layer_list omits such layers if
+            requested.
+        """,
+        "packages": """
+            Option[bool]: If True, the layer is derived from binary packages in
+            SDKInfo.packages and the layers below it, so those packages
+            identify its contents.
+        """,
     },
 )
 SysrootInfo = provider(
@@ -383,7 +403,7 @@ def get_all_deps(ctx):
                     deps.append(value)
     return deps
 
-def sdk_to_layer_list(sdk, interface_layers = False):
+def sdk_to_layer_list(sdk, interface_layers = False, metadata_layers = True):
     """
     Returns a list of filesystem layers that make up the SDK.
 
@@ -391,12 +411,17 @@ def sdk_to_layer_list(sdk, interface_layers = False):
         sdk: SDKInfo: The SDK Info.
         interface_layers: bool: Prefer returning interface layers if they are
             available.
+        metadata_layers: bool: Include layers containing only package manager
+            metadata. Actions that never read the installed package database
+            may pass False to avoid depending on them.
 
     Returns:
         list[File]: All the layers for the SDK.
     """
     layers = []
     for layer in sdk.layers:
+        if getattr(layer, "metadata", False) and not metadata_layers:
+            continue
         interface_file = getattr(layer, "interface_file", None)
         if interface_layers and interface_file:
             layers.append(interface_file)
@@ -12,6 +12,7 @@ load("//bazel/portage/build_defs:package_contents.bzl", "generate_contents")
 load("ebuild_sizing.bzl", "HOST", "PACKAGE_TO_CORE_COUNT", "TARGET")
 
 _CCACHE_DIR_LABEL = "//bazel/portage:ccache_dir"
+
 _DEFAULT_CORES = 8
 
 # Extract patterns from `PACKAGE_TO_CORE_COUNT` so that ebuild_exec_contraint() doesn't need to
@@ -64,6 +65,13 @@ _EBUILD_COMMON_ATTRS = dict(
     distfiles = attr.label_keyed_string_dict(
         allow_files = True,
     ),
+    manifest = attr.label(
+        allow_single_file = True,
+        doc = """
+        The Manifest file of the package. If set, distfiles are verified
+        against the checksums recorded in it before building.
+        """,
+    ),
     srcs = attr.label_list(
         doc = "src files used by the ebuild",
         allow_files = True,
@@ -92,6 +100,15 @@ _EBUILD_COMMON_ATTRS = dict(
         compute them.
         """,
     ),
+    use_flag_overrides = attr.string_list(
+        allow_empty = True,
+        doc = """
+        USE flags to override on top of the ones computed for the package,
+        e.g. ["foo", "-bar"]. A flag prefixed with "-" is disabled. This is
+        meant for experiments and per-board tweaks not captured in profiles.
+        Ignored unless `inject_use_flags` is True.
+        """,
+    ),
     files = attr.label_list(
         allow_files = True,
     ),
@@ -110,6 +127,14 @@ _EBUILD_COMMON_ATTRS = dict(
         """,
         providers = [EbuildLibraryInfo],
     ),
+    exec_requirements = attr.string_list(
+        doc = """
+        Features of the executor the package requires to build, e.g. "kvm".
+        Device files needed by the features are exposed in the build
+        container. Use ebuild_exec_properties() to also route the actions to
+        executors providing them.
+        """,
+    ),
     allow_network_access = attr.bool(
         default = False,
         doc = """
@@ -215,6 +240,46 @@ _EBUILD_COMMON_ATTRS = dict(
         default = Label(_CCACHE_DIR_LABEL),
         providers = [BuildSettingInfo],
     ),
+    _contents_digests = attr.label(
+        default = Label("//bazel/portage:contents_digests"),
+        providers = [BuildSettingInfo],
+    ),
+    _verify_distfiles = attr.label(
+        default = Label("//bazel/portage:verify_distfiles"),
+        providers = [BuildSettingInfo],
+    ),
+    _audit_source_reads = attr.label(
+        default = Label("//bazel/portage:audit_source_reads"),
+        providers = [BuildSettingInfo],
+    ),
+    _sandbox_report = attr.label(
+        default = Label("//bazel/portage:sandbox_report"),
+        providers = [BuildSettingInfo],
+    ),
+    _binpkg_cache = attr.label(
+        default = Label("//bazel/portage:binpkg_cache"),
+        providers = [BuildSettingInfo],
+    ),
+    _binpkg_cache_upload = attr.label(
+        default = Label("//bazel/portage:binpkg_cache_upload"),
+        providers = [BuildSettingInfo],
+    ),
+    _layer_backend = attr.label(
+        default = Label("//bazel/portage:layer_backend"),
+        providers = [BuildSettingInfo],
+    ),
+    _memory_limit = attr.label(
+        default = Label("//bazel/portage:memory_limit"),
+        providers = [BuildSettingInfo],
+    ),
+    _cpu_limit = attr.label(
+        default = Label("//bazel/portage:cpu_limit"),
+        providers = [BuildSettingInfo],
+    ),
+    _pids_limit = attr.label(
+        default = Label("//bazel/portage:pids_limit"),
+        providers = [BuildSettingInfo],
+    ),
     supports_remoteexec = attr.bool(
         default = False,
         doc = """
@@ -226,6 +291,21 @@ _EBUILD_COMMON_ATTRS = dict(
 def _bashrc_to_path(bashrc):
     return bashrc[BashrcInfo].path
 
+def _effective_use_flags(ctx):
+    """Applies `use_flag_overrides` to `use_flags` if USE flags are injected.
+
+    Returns:
+        list[str]: The USE flags the package is expected to be built with.
+    """
+    overrides = ctx.attr.use_flag_overrides if ctx.attr.inject_use_flags else []
+    flags = {}
+    for flag in ctx.attr.use_flags + overrides:
+        if flag.startswith("-"):
+            flags[flag[1:]] = "-"
+        else:
+            flags[flag.removeprefix("+")] = ""
+    return ["%s%s" % (prefix, name) for name, prefix in flags.items()]
+
 def _ccache_settings(ctx):
     """Helper to get ccache settings.
 
@@ -246,7 +326,28 @@ def _ccache_settings(ctx):
     return ccache, ccache_dir
 
 # TODO(b/269558613): Fix all call sites to always use runfile paths and delete `for_test`.
-def _compute_build_package_args(ctx, output_file, use_runfiles):
+_SOURCES_PACKAGE_PREFIX = "internal/sources/"
+
+def _declared_source_dir(label):
+    """Returns the path under /mnt/host/source that a source target provides.
+
+    Args:
+        label: Label: A label of a source target, e.g.
+            @portage//internal/sources/src/platform2/common-mk:__tarballs__.
+
+    Returns:
+        Optional[str]: The path relative to /mnt/host/source, or None if the
+            target is not generated under internal/sources.
+    """
+    if not label.package.startswith(_SOURCES_PACKAGE_PREFIX):
+        return None
+    return label.package.removeprefix(_SOURCES_PACKAGE_PREFIX)
+
+# A tag to fail builds of an ebuild target that violate the sandbox policy.
+# See --enforce-sandbox-policy of build_package.
+ENFORCE_SANDBOX_POLICY_TAG = "enforce_sandbox_policy"
+
+def _compute_build_package_args(ctx, output_file, use_runfiles, source_audit_file = None, sandbox_report_file = None, phase_timings_file = None):
     """
     Computes the arguments to run build_package.
 
@@ -264,6 +365,12 @@ def _compute_build_package_args(ctx, output_file, use_runfiles):
             is saved. If None, a binary package is not saved.
         use_runfiles: bool: Whether to refer to runfiles paths instead of files.
             See compute_file_arg for details.
+        source_audit_file: Optional[File]: A file where source files read by
+            the build but not declared in `srcs` are reported.
+        sandbox_report_file: Optional[File]: A file where violations of the
+            sandbox policy are reported.
+        phase_timings_file: Optional[File]: A JSON file where the time spent
+            on each ebuild phase is reported.
 
     Returns:
         struct where:
@@ -323,6 +430,13 @@ def _compute_build_package_args(ctx, output_file, use_runfiles):
         )
         direct_inputs.append(file)
 
+    # --manifest, --verify-distfiles
+    if (ctx.file.manifest and ctx.attr.distfiles and
+        ctx.attr._verify_distfiles[BuildSettingInfo].value):
+        args.add("--manifest", compute_file_arg(ctx.file.manifest, use_runfiles))
+        args.add("--verify-distfiles")
+        direct_inputs.append(ctx.file.manifest)
+
     # --layer for SDK, overlays and eclasses
     sdk = ctx.attr.sdk[SDKInfo]
     overlays = ctx.attr.overlays[OverlaySetInfo]
@@ -345,6 +459,25 @@ def _compute_build_package_args(ctx, output_file, use_runfiles):
         args.add("--layer", compute_file_arg(file, use_runfiles))
         direct_inputs.append(file)
 
+    # --audit-source-reads, --sandbox-report, --enforce-sandbox-policy,
+    # --declared-source
+    if source_audit_file:
+        args.add("--audit-source-reads", source_audit_file)
+    if sandbox_report_file:
+        args.add("--sandbox-report", sandbox_report_file)
+        if ENFORCE_SANDBOX_POLICY_TAG in ctx.attr.tags:
+            args.add("--enforce-sandbox-policy")
+    if source_audit_file or sandbox_report_file:
+        declared_dirs = [_declared_source_dir(src.label) for src in ctx.attr.srcs]
+        args.add_all(
+            [dir for dir in declared_dirs if dir != None],
+            before_each = "--declared-source",
+        )
+
+    # --phase-timings
+    if phase_timings_file:
+        args.add("--phase-timings", phase_timings_file)
+
     # --layer for extra source code
     for extra_src in ctx.attr.extra_srcs:
         tar = extra_src[ExtraSourcesInfo].tar
@@ -362,6 +495,12 @@ def _compute_build_package_args(ctx, output_file, use_runfiles):
     )
     direct_inputs.extend(ctx.files.git_trees)
 
+    # --device
+    for requirement in ctx.attr.exec_requirements:
+        if requirement not in _EXEC_REQUIREMENT_DEVICES:
+            fail("Unknown exec requirement: %s" % requirement)
+        args.add_all(_EXEC_REQUIREMENT_DEVICES[requirement], format_each = "--device=%s")
+
     # --allow-network-access
     if ctx.attr.allow_network_access:
         args.add("--allow-network-access")
@@ -388,9 +527,62 @@ def _compute_build_package_args(ctx, output_file, use_runfiles):
         args.add("--ccache")
         args.add(ccache_dir, format = "--ccache-dir=%s")
 
-    # --use-flags
+    # --layer-backend
+    layer_backend = ctx.attr._layer_backend[BuildSettingInfo].value
+    if layer_backend:
+        args.add(layer_backend, format = "--layer-backend=%s")
+
+    # --memory-limit, --cpu-limit, --pids-limit
+    for name, setting in [
+        ("memory-limit", ctx.attr._memory_limit),
+        ("cpu-limit", ctx.attr._cpu_limit),
+        ("pids-limit", ctx.attr._pids_limit),
+    ]:
+        limit = setting[BuildSettingInfo].value
+        if limit:
+            args.add("--%s=%s" % (name, limit))
+
+    # --use-flags, --use
     if ctx.attr.inject_use_flags:
         args.add_joined("--use-flags", ctx.attr.use_flags, join_with = ",")
+        args.add_all(ctx.attr.use_flag_overrides, format_each = "--use=%s")
+
+    # --contents-digests
+    if ctx.attr._contents_digests[BuildSettingInfo].value and output_file:
+        args.add("--contents-digests")
+
+    # --binpkg-cache, --binpkg-cache-upload, --binpkg-cache-key-input
+    # A cache hit skips the build, so don't use the cache when auditing it.
+    binpkg_cache = ctx.attr._binpkg_cache[BuildSettingInfo].value
+    if binpkg_cache and output_file and not source_audit_file and not sandbox_report_file:
+        args.add(binpkg_cache, format = "--binpkg-cache=%s")
+        if ctx.attr._binpkg_cache_upload[BuildSettingInfo].value:
+            args.add("--binpkg-cache-upload")
+
+        # Layers made of installed binary packages are too expensive to hash.
+        # Use the binary packages themselves to identify them. All other
+        # inputs affecting the build are hashed as they are.
+        key_inputs = (
+            [
+                layer.file
+                for layer in sdk.layers
+                if not getattr(layer, "packages", False) and
+                   not getattr(layer, "metadata", False)
+            ] +
+            [package.partial for package in sdk.packages.to_list()] +
+            overlays.layers +
+            ctx.files.eclasses +
+            ctx.files.portage_config +
+            ctx.files.bashrcs +
+            ctx.files.srcs +
+            [extra_src[ExtraSourcesInfo].tar for extra_src in ctx.attr.extra_srcs]
+        )
+        args.add_all(
+            [compute_file_arg(f, use_runfiles) for f in key_inputs],
+            before_each = "--binpkg-cache-key-input",
+            expand_directories = False,
+        )
+        direct_inputs.extend(key_inputs)
 
     if ctx.attr.supports_remoteexec:
         args.add_all([
@@ -484,7 +676,14 @@ def _generate_ebuild_validation_action(ctx, binpkg):
         binpkg,
         "--check-non-hermetic-variables",
     ])
-    args.add_joined("--use-flags", ctx.attr.use_flags, join_with = ",", omit_if_empty = False)
+    args.add_joined("--use-flags", _effective_use_flags(ctx), join_with = ",", omit_if_empty = False)
+    args.add("--slot", ctx.attr.slot)
+
+    # Prebuilts must match the resolved configuration exactly, otherwise
+    # substituting them would silently change what we build.
+    prebuilt = ctx.attr.prebuilt[BuildSettingInfo].value
+    if prebuilt:
+        args.add("--prebuilt", prebuilt)
 
     ctx.actions.run(
         inputs = depset([binpkg]),
@@ -497,6 +696,55 @@ def _generate_ebuild_validation_action(ctx, binpkg):
 
     return validation_file
 
+def _generate_interface_hash_action(ctx, binpkg):
+    src_basename = _get_basename(ctx)
+
+    interface_hash = ctx.actions.declare_file(src_basename + ".interface_hash")
+    interface_manifest = ctx.actions.declare_file(src_basename + ".interface_manifest")
+
+    args = ctx.actions.args()
+    args.add_all([
+        "fingerprint",
+        "--output",
+        interface_hash,
+        "--manifest",
+        interface_manifest,
+        binpkg,
+    ])
+
+    ctx.actions.run(
+        inputs = [binpkg],
+        outputs = [interface_hash, interface_manifest],
+        executable = ctx.executable._xpaktool,
+        arguments = [args],
+        mnemonic = "EbuildInterfaceHash",
+        progress_message = "Computing the interface hash of %{label}",
+    )
+
+    return interface_hash, interface_manifest
+
+def _generate_layer_manifest_action(ctx, binpkg):
+    layer_manifest = ctx.actions.declare_file(_get_basename(ctx) + ".layer.jsonl")
+
+    args = ctx.actions.args()
+    args.add_all([
+        "generate",
+        "--output",
+        layer_manifest,
+        binpkg,
+    ])
+
+    ctx.actions.run(
+        inputs = [binpkg],
+        outputs = [layer_manifest],
+        executable = ctx.executable._layertool,
+        arguments = [args],
+        mnemonic = "EbuildLayerManifest",
+        progress_message = "Generating the layer manifest of %{label}",
+    )
+
+    return layer_manifest
+
 def _ebuild_compare_package(ctx, name, packages):
     if len(packages) != 2:
         fail("Expected two packages, got %d" % (len(packages)))
@@ -534,6 +782,11 @@ def _ebuild_impl(ctx):
     output_profile_file = ctx.actions.declare_file(
         src_basename + ".profile.json",
     )
+    output_phase_timings_file = ctx.actions.declare_file(
+        src_basename + ".phase_timings.json",
+    )
+    source_audit_files = []
+    sandbox_report_files = []
 
     # Define the main action.
     prebuilt = ctx.attr.prebuilt[BuildSettingInfo].value
@@ -541,12 +794,26 @@ def _ebuild_impl(ctx):
         _download_prebuilt(ctx, prebuilt, output_binary_package_file)
         ctx.actions.write(output_log_file, "Downloaded from %s\n" % prebuilt)
         ctx.actions.write(output_profile_file, "[]")
+        ctx.actions.write(output_phase_timings_file, "{}")
     else:
+        if ctx.attr._audit_source_reads[BuildSettingInfo].value:
+            source_audit_files.append(
+                ctx.actions.declare_file(src_basename + ".source_audit.txt"),
+            )
+        if (ctx.attr._sandbox_report[BuildSettingInfo].value or
+            ENFORCE_SANDBOX_POLICY_TAG in ctx.attr.tags):
+            sandbox_report_files.append(
+                ctx.actions.declare_file(src_basename + ".sandbox_report.txt"),
+            )
+
         # Compute arguments and inputs to run build_package.
         build_package_args = _compute_build_package_args(
             ctx,
             output_file = output_binary_package_file,
             use_runfiles = False,
+            source_audit_file = source_audit_files[0] if source_audit_files else None,
+            sandbox_report_file = sandbox_report_files[0] if sandbox_report_files else None,
+            phase_timings_file = output_phase_timings_file,
         )
 
         execution_requirements = {
@@ -559,11 +826,17 @@ def _ebuild_impl(ctx):
         if ctx.attr.supports_remoteexec:
             # Do not execute remotely when the underlying build is executing remote jobs.
             execution_requirements["no-remote-exec"] = ""
+        if (ctx.attr._binpkg_cache[BuildSettingInfo].value and
+            not source_audit_files and not sandbox_report_files):
+            # The remote binary package cache is accessed over the network.
+            execution_requirements["requires-network"] = ""
 
         action_wrapper_args = ctx.actions.args()
         action_wrapper_args.add_all([
             "--banner",
             "Building %s" % ctx.label,
+            "--log-label",
+            str(ctx.label),
             "--log",
             output_log_file,
             "--profile",
@@ -578,7 +851,8 @@ def _ebuild_impl(ctx):
                 output_binary_package_file,
                 output_log_file,
                 output_profile_file,
-            ],
+                output_phase_timings_file,
+            ] + source_audit_files + sandbox_report_files,
             executable = ctx.executable._action_wrapper,
             tools = [ctx.executable._build_package],
             arguments = [action_wrapper_args, build_package_args.args],
@@ -635,10 +909,21 @@ def _ebuild_impl(ctx):
         },
     )
 
+    interface_hash, interface_manifest = _generate_interface_hash_action(
+        ctx,
+        output_binary_package_file,
+    )
+
+    layer_manifest = _generate_layer_manifest_action(
+        ctx,
+        output_binary_package_file,
+    )
+
     # Compute provider data.
     package_info = BinaryPackageInfo(
         partial = output_binary_package_file,
         metadata = metadata,
+        interface_hash = interface_hash,
         contents = contents,
         category = ctx.attr.category,
         package_name = ctx.attr.package_name,
@@ -707,6 +992,11 @@ def _ebuild_impl(ctx):
         OutputGroupInfo(
             logs = depset([output_log_file]),
             traces = depset([output_profile_file]),
+            phase_timings = depset([output_phase_timings_file]),
+            source_audits = depset(source_audit_files),
+            sandbox_reports = depset(sandbox_report_files),
+            interface_hash = depset([interface_hash, interface_manifest]),
+            layer_manifest = depset([layer_manifest]),
             _validation = depset(validation_files),
         ),
         package_info,
@@ -829,6 +1119,11 @@ ebuild = rule(
             cfg = "exec",
             default = Label("//bazel/portage/bin/xpaktool"),
         ),
+        _layertool = attr.label(
+            executable = True,
+            cfg = "exec",
+            default = Label("//bazel/portage/bin/layertool"),
+        ),
         _gen_metadata = attr.label(
             executable = True,
             cfg = "exec",
@@ -882,6 +1177,44 @@ def ebuild_exec_contraint(portage_package_name, is_host):
         core_count = _DEFAULT_CORES
     return "@//bazel/platforms:rbe_%s_cores" % core_count
 
+# Maps requirements declared with `exec_requirements` in Bazel-specific package
+# metadata to execution properties. Remote execution schedules actions with
+# these properties only on worker pools carrying the same labels, which have
+# to be set up by the remote execution administrator; see
+# docs/advanced.md. Keep the keys in sync with _EXEC_REQUIREMENT_DEVICES.
+_EXEC_REQUIREMENT_PROPERTIES = {
+    "fuse": {"label:fuse": "true"},
+    "kvm": {"label:kvm": "true"},
+    "large_memory": {"label:large_memory": "true"},
+}
+
+# Maps requirements declared with `exec_requirements` in Bazel-specific package
+# metadata to host device files exposed in the build container. /dev/fuse is
+# always available in the container, so "fuse" needs no extra device.
+_EXEC_REQUIREMENT_DEVICES = {
+    "fuse": [],
+    "kvm": ["/dev/kvm"],
+    "large_memory": [],
+}
+
+def ebuild_exec_properties(requirements):
+    """
+    Returns the execution properties for features an ebuild requires.
+
+    Args:
+        requirements: list[str]: Features of the executor the package requires
+            to build, e.g. "kvm".
+
+    Returns:
+        dict[str, str]: The execution properties.
+    """
+    properties = {}
+    for requirement in requirements:
+        if requirement not in _EXEC_REQUIREMENT_PROPERTIES:
+            fail("Unknown exec requirement: %s" % requirement)
+        properties.update(_EXEC_REQUIREMENT_PROPERTIES[requirement])
+    return properties
+
 _DEBUG_SCRIPT = """
 # Arguments passed in during build time are passed in relative to the execroot,
 # which means all files passed in are relative paths starting with bazel-out/
@@ -118,7 +118,12 @@ def install_deps(
         executable_action_wrapper,
         executable_fast_install_packages,
         progress_message,
-        contents):
+        contents,
+        root = None,
+        verify_sysroot = False,
+        collision_ignore = [],
+        install_mask = [],
+        collision_protect = False):
     """
     Creates an action which builds file system layers in which the build dependencies are installed.
 
@@ -126,10 +131,10 @@ def install_deps(
         ctx: ctx: A context object passed to the rule implementation.
         output_prefix: str: A file name prefix to prepend to output files
             defined in this function.
-        board: str: The target board name to install dependencies for. If it is
-            non-empty, packages are installed to the corresponding sysroot
-            (ROOT="/build/<board>"). If it is an empty string, packages are
-            installed to the host (ROOT="/").
+        board: str: The target board name to install dependencies for. Unless
+            root is set, packages are installed to the corresponding sysroot
+            (ROOT="/build/<board>") if it is non-empty, or to the host
+            (ROOT="/") otherwise.
         sdk: SDKInfo: The provider describing the base file system layers.
         overlays: OverlaySetInfo: Overlays providing packages.
         portage_configs: list[File]: Tarballs containing portage config.
@@ -149,6 +154,23 @@ def install_deps(
             full, sparse, or interface. When interface is set, it has the same
             effect as sparse, but it also adds the `interface_file` to the
             SDKLayer.
+        root: Optional[str]: Where to install packages. "host" installs them to
+            the host (ROOT="/") regardless of board, which is useful to make
+            newly built host tools available without rebuilding the SDK.
+            "board" installs them to the board's sysroot and requires board.
+            If None, it is derived from board.
+        verify_sysroot: bool: Whether to verify the consistency of the sysroot
+            after installing packages. The installation fails if installed
+            packages contain broken symlinks or ELF files whose NEEDED
+            libraries are missing, reporting the packages owning them. It is
+            ignored unless contents is full.
+        collision_ignore: list[str]: Patterns of files excluded from the
+            collision check, like Portage's COLLISION_IGNORE.
+        install_mask: list[str]: Patterns of files masked by Portage's
+            INSTALL_MASK. They are also excluded from the collision check.
+        collision_protect: bool: Whether to fail if multiple packages install
+            the same file, or a file in the base layers. Such files are
+            otherwise reported as warnings.
 
     Returns:
         struct where:
@@ -156,7 +178,16 @@ def install_deps(
             log_file: File: Log file generated when building the layers.
             trace_file: File: Trace file generated when building the layers.
     """
-    sysroot = "/build/%s" % board if board else "/"
+    if root == None:
+        root = "board" if board else "host"
+    if root == "host":
+        sysroot = "/"
+    elif root == "board":
+        if not board:
+            fail("%s: cannot install packages to the board sysroot without a board" % ctx.label)
+        sysroot = "/build/%s" % board
+    else:
+        fail("%s: invalid root %r" % (ctx.label, root))
 
     install_list = compute_install_list(sdk, install_set)
 
@@ -181,6 +212,16 @@ def install_deps(
     if contents in ["sparse", "interface"]:
         args.add("--sparse-vdb")
 
+    # Sparse VDBs lack CONTENTS needed to verify sysroots, so only sysroots
+    # with full VDBs are verified.
+    if verify_sysroot and contents == "full":
+        args.add("--verify-sysroot")
+
+    args.add_all(collision_ignore, format_each = "--collision-ignore=%s")
+    args.add_all(install_mask, format_each = "--install-mask=%s")
+    if collision_protect:
+        args.add("--collision-protect")
+
     input_layers = sdk_to_layer_list(sdk) + overlays.layers + portage_configs
     args.add_all(
         input_layers,
@@ -247,9 +288,13 @@ def install_deps(
         outputs.extend([output_preinst, output_postinst])
 
         layers.extend([
-            SDKLayer(file = output_preinst),
-            SDKLayer(file = installed_layer, interface_file = interface_layer),
-            SDKLayer(file = output_postinst),
+            SDKLayer(file = output_preinst, packages = True),
+            SDKLayer(
+                file = installed_layer,
+                interface_file = interface_layer,
+                packages = True,
+            ),
+            SDKLayer(file = output_postinst, packages = True),
         ])
 
     actual_progress_message = progress_message.replace(
@@ -4,6 +4,44 @@
 
 load("common.bzl", "BinaryPackageSetInfo")
 
+def _format_install_order_entry(package):
+    return json.encode(struct(
+        category = package.category,
+        package_name = package.package_name,
+        version = package.version,
+        slot = package.slot,
+        sysroot = package.contents.sysroot,
+        partial = package.partial.path,
+        direct_runtime_deps = [dep.path for dep in package.direct_runtime_deps],
+    ))
+
+def _write_install_order(ctx, packages):
+    """
+    Writes a JSON file listing packages in a package set in installation order.
+
+    The list is expanded at execution time so that package sets don't have to
+    flatten their depsets during analysis.
+
+    Args:
+        ctx: ctx: A context object passed to the rule implementation.
+        packages: Depset[BinaryPackageInfo]: Packages in installation order.
+
+    Returns:
+        File: The JSON file.
+    """
+    output = ctx.actions.declare_file(ctx.attr.name + ".install_order.json")
+    args = ctx.actions.args()
+    args.set_param_file_format("multiline")
+    args.add_joined(
+        packages,
+        map_each = _format_install_order_entry,
+        join_with = ",\n",
+        format_joined = "[\n%s\n]",
+        omit_if_empty = False,
+    )
+    ctx.actions.write(output, args)
+    return output
+
 def _package_set_impl(ctx):
     packages = depset(
         transitive = [
@@ -21,6 +59,9 @@ def _package_set_impl(ctx):
 
     return [
         DefaultInfo(files = partials),
+        OutputGroupInfo(
+            install_order = depset([_write_install_order(ctx, packages)]),
+        ),
         BinaryPackageSetInfo(
             packages = packages,
             partials = partials,
@@ -29,9 +70,68 @@ def _package_set_impl(ctx):
 
 package_set = rule(
     implementation = _package_set_impl,
+    doc = """
+    Collects binary packages and their transitive runtime dependencies.
+
+    The "install_order" output group provides a JSON file listing the packages
+    in the order they are installed, i.e. each package appears after all its
+    runtime dependencies.
+    """,
     attrs = {
         "deps": attr.label_list(
             providers = [BinaryPackageSetInfo],
         ),
     },
 )
+
+def _partial_path(package):
+    return package.partial.path
+
+def _package_set_tarball_impl(ctx):
+    package_set = ctx.attr.package_set[BinaryPackageSetInfo]
+    output = ctx.actions.declare_file(ctx.attr.name + ".tar.zst")
+
+    args = ctx.actions.args()
+    args.add("export")
+    args.add("--output", output)
+    args.add_all(
+        package_set.packages,
+        map_each = _partial_path,
+    )
+
+    ctx.actions.run(
+        inputs = package_set.partials,
+        outputs = [output],
+        executable = ctx.executable._xpaktool,
+        arguments = [args],
+        mnemonic = "PackageSetTarball",
+        progress_message = "Exporting %{label}",
+    )
+
+    return [DefaultInfo(files = depset([output]))]
+
+package_set_tarball = rule(
+    implementation = _package_set_tarball_impl,
+    doc = """
+    Merges the files of all packages in a package set into a single tarball.
+
+    Packages are merged in installation order, so a file in a package
+    overrides the same path in its runtime dependencies. This is useful to
+    create a minimal root file system of a package and its runtime
+    dependencies, e.g. for containers.
+
+    Only files in the packages are merged: pkg_preinst and pkg_postinst are
+    not run, and INSTALL_MASK is not applied.
+    """,
+    attrs = {
+        "package_set": attr.label(
+            mandatory = True,
+            providers = [BinaryPackageSetInfo],
+        ),
+        "_xpaktool": attr.label(
+            executable = True,
+            cfg = "exec",
+            default = Label("//bazel/portage/bin/xpaktool"),
+        ),
+    },
+)
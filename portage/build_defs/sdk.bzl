@@ -2,6 +2,7 @@
 # Use of this source code is governed by a BSD-style license that can be
 # found in the LICENSE file.
 
+load("@bazel_skylib//rules:common_settings.bzl", "BuildSettingInfo")
 load("@rules_pkg//pkg:providers.bzl", "PackageArtifactInfo")
 load(":common.bzl", "BinaryPackageInfo", "BinaryPackageSetInfo", "OverlaySetInfo", "SDKInfo", "SDKLayer", "sdk_to_layer_list")
 load(":install_deps.bzl", "compute_install_list", "install_deps")
@@ -107,7 +108,8 @@ def _sdk_update_impl(ctx):
         output_profile,
         "--temp-dir",
         output_log.dirname + "/tmp",
-        ctx.executable._sdk_update,
+        ctx.executable._build_sdk,
+        "--output-format=layer",
         "--output",
         output_root,
     ], expand_directories = False)
@@ -117,22 +119,33 @@ def _sdk_update_impl(ctx):
     args.add_all(layer_inputs, format_each = "--layer=%s", expand_directories = False)
 
     args.add_all(ctx.files.extra_tarballs, format_each = "--install-tarball=%s")
+    diff_filter = []
+    if ctx.file.diff_filter:
+        args.add("--diff-filter", ctx.file.diff_filter)
+        diff_filter = [ctx.file.diff_filter]
+
+    output_layers = [output_root]
+    if ctx.attr.split_metadata:
+        output_metadata = ctx.actions.declare_directory(output_prefix + "_metadata")
+        args.add("--output-metadata", output_metadata)
+        output_layers.append(output_metadata)
 
     inputs = depset(
-        [ctx.executable._sdk_update] + layer_inputs + ctx.files.extra_tarballs,
+        [ctx.executable._build_sdk] + layer_inputs + ctx.files.extra_tarballs +
+        diff_filter,
     )
 
-    outputs = [output_root, output_log, output_profile]
+    outputs = output_layers + [output_log, output_profile]
 
     ctx.actions.run(
         inputs = inputs,
         outputs = outputs,
         executable = ctx.executable._action_wrapper,
-        tools = [ctx.executable._sdk_update],
+        tools = [ctx.executable._build_sdk],
         arguments = [args],
         execution_requirements = {
             # Disable sandbox to avoid creating a symlink forest.
-            # This does not affect hermeticity since sdk_update runs in a container.
+            # This does not affect hermeticity since build_sdk runs in a container.
             "no-sandbox": "",
             # Send SIGTERM instead of SIGKILL on user interruption.
             "supports-graceful-termination": "",
@@ -142,14 +155,15 @@ def _sdk_update_impl(ctx):
     )
 
     return [
-        DefaultInfo(files = depset([output_root])),
+        DefaultInfo(files = depset(output_layers)),
         OutputGroupInfo(
             logs = depset([output_log]),
             traces = depset([output_profile]),
         ),
         SDKInfo(
-            layers = base_sdk.layers + [
-                SDKLayer(file = output_root),
+            layers = base_sdk.layers + [SDKLayer(file = output_root)] + [
+                SDKLayer(file = output, metadata = True)
+                for output in output_layers[1:]
             ],
             packages = base_sdk.packages,
         ),
@@ -162,6 +176,14 @@ sdk_update = rule(
             mandatory = True,
             providers = [SDKInfo],
         ),
+        "diff_filter": attr.label(
+            allow_single_file = True,
+            doc = """
+            A file listing rsync-style include/exclude rules applied to the
+            changes made in the container before they are saved as the output
+            layer, e.g. "- /var/log/".
+            """,
+        ),
         "extra_tarballs": attr.label_list(
             allow_files = True,
         ),
@@ -176,15 +198,23 @@ sdk_update = rule(
             """,
             default = "Updating SDK",
         ),
+        "split_metadata": attr.bool(
+            doc = """
+            If True, package manager metadata such as the installed package
+            database is emitted as a separate layer on top of the content
+            layer, so that metadata-only changes don't invalidate actions
+            depending only on the contents.
+            """,
+        ),
         "_action_wrapper": attr.label(
             executable = True,
             cfg = "exec",
             default = Label("//bazel/portage/bin/action_wrapper"),
         ),
-        "_sdk_update": attr.label(
+        "_build_sdk": attr.label(
             executable = True,
             cfg = "exec",
-            default = Label("//bazel/portage/bin/sdk_update"),
+            default = Label("//bazel/portage/bin/build_sdk"),
         ),
     },
 )
@@ -224,6 +254,22 @@ _SDK_INSTALL_DEPS_COMMON_ATTRS = {
         cfg = "exec",
         default = Label("//bazel/portage/bin/fast_install_packages"),
     ),
+    "_verify_sysroot": attr.label(
+        default = Label("//bazel/portage:verify_sysroot"),
+        providers = [BuildSettingInfo],
+    ),
+    "_collision_ignore": attr.label(
+        default = Label("//bazel/portage:collision_ignore"),
+        providers = [BuildSettingInfo],
+    ),
+    "_install_mask": attr.label(
+        default = Label("//bazel/portage:install_mask"),
+        providers = [BuildSettingInfo],
+    ),
+    "_collision_protect": attr.label(
+        default = Label("//bazel/portage:collision_protect"),
+        providers = [BuildSettingInfo],
+    ),
 }
 
 def _sdk_install_deps_impl(ctx):
@@ -257,6 +303,11 @@ def _sdk_install_deps_impl(ctx):
             ctx.executable._fast_install_packages,
         progress_message = ctx.attr.progress_message,
         contents = ctx.attr.contents,
+        root = ctx.attr.root or None,
+        verify_sysroot = ctx.attr._verify_sysroot[BuildSettingInfo].value,
+        collision_ignore = ctx.attr._collision_ignore[BuildSettingInfo].value,
+        install_mask = ctx.attr._install_mask[BuildSettingInfo].value,
+        collision_protect = ctx.attr._collision_protect[BuildSettingInfo].value,
     )
 
     return [
@@ -280,9 +331,26 @@ sdk_install_deps = rule(
         board = attr.string(
             doc = """
             If set, the packages are installed into the board's sysroot,
-            otherwise they are installed into the host's sysroot.
+            otherwise they are installed into the host's sysroot. See also
+            root.
             """,
         ),
+        root = attr.string(
+            doc = """
+            Where to install the packages.
+
+            Valid options:
+            * host: The packages are installed to the host (ROOT=/), even if
+                board is set. Use this to install host packages, e.g. BDEPEND
+                of a target package, into the SDK layer so that newly built
+                host tools are available without a full build_sdk cycle.
+            * board: The packages are installed to the board's sysroot
+                (ROOT=/build/<board>). board must be set.
+
+            If unset, it is determined by whether board is set.
+            """,
+            values = ["", "host", "board"],
+        ),
         overlays = attr.label(
             providers = [OverlaySetInfo],
             mandatory = True,
@@ -535,6 +603,11 @@ def _sdk_install_host_and_target_deps_impl(ctx):
                 ctx.executable._fast_install_packages,
             progress_message = ctx.attr.progress_message + " (%d host dependencies on top of %s)" % (len(host_packages), best_base_sdk.description),
             contents = ctx.attr.host_contents,
+            root = "host",
+            verify_sysroot = ctx.attr._verify_sysroot[BuildSettingInfo].value,
+            collision_ignore = ctx.attr._collision_ignore[BuildSettingInfo].value,
+            install_mask = ctx.attr._install_mask[BuildSettingInfo].value,
+            collision_protect = ctx.attr._collision_protect[BuildSettingInfo].value,
         )
 
         sdk = SDKInfo(
@@ -562,6 +635,10 @@ def _sdk_install_host_and_target_deps_impl(ctx):
                 ctx.executable._fast_install_packages,
             progress_message = ctx.attr.progress_message + " (installing %d target dependencies on top of %s)" % (len(target_packages), best_base_sdk.description),
             contents = ctx.attr.target_contents,
+            verify_sysroot = ctx.attr._verify_sysroot[BuildSettingInfo].value,
+            collision_ignore = ctx.attr._collision_ignore[BuildSettingInfo].value,
+            install_mask = ctx.attr._install_mask[BuildSettingInfo].value,
+            collision_protect = ctx.attr._collision_protect[BuildSettingInfo].value,
         )
 
         sdk = SDKInfo(
@@ -767,8 +844,13 @@ def _sdk_install_glibc_impl(ctx):
     glibc = ctx.attr.glibc[BinaryPackageInfo].partial
     args.add("--glibc", glibc)
 
+    diff_filter = []
+    if ctx.file.diff_filter:
+        args.add("--diff-filter", ctx.file.diff_filter)
+        diff_filter = [ctx.file.diff_filter]
+
     inputs = depset(
-        [ctx.executable._sdk_install_glibc] + layer_inputs + [glibc],
+        [ctx.executable._sdk_install_glibc] + layer_inputs + [glibc] + diff_filter,
     )
 
     outputs = [output_root, output_log, output_profile]
@@ -818,6 +900,14 @@ sdk_install_glibc = rule(
             doc = "The cross-* package is installed into the board's sysroot.",
             mandatory = True,
         ),
+        "diff_filter": attr.label(
+            allow_single_file = True,
+            doc = """
+            A file listing rsync-style include/exclude rules applied to the
+            changes made in the container before they are saved as the output
+            layer, e.g. "- /var/log/".
+            """,
+        ),
         "glibc": attr.label(
             doc = "The cross-*-cros-linux-gnu/glibc package to install",
             mandatory = True,
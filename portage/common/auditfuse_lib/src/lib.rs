@@ -0,0 +1,204 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//! Runs auditfuse, a FUSE file system recording accesses to a directory, and
+//! parses its reports.
+
+use anyhow::{bail, ensure, Context, Result};
+use nix::mount::{umount2, MntFlags};
+use runfiles::Runfiles;
+use std::{
+    fmt::Display,
+    path::{Path, PathBuf},
+    process::Command,
+    str::FromStr,
+};
+
+#[derive(Clone, Copy, Debug, Eq, Ord, PartialEq, PartialOrd)]
+pub enum AccessType {
+    Lookup,
+    Readdir,
+}
+
+impl Display for AccessType {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Lookup => write!(f, "LOOKUP"),
+            Self::Readdir => write!(f, "READDIR"),
+        }
+    }
+}
+
+impl FromStr for AccessType {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "LOOKUP" => Ok(Self::Lookup),
+            "READDIR" => Ok(Self::Readdir),
+            _ => bail!("Unknown access type: {s}"),
+        }
+    }
+}
+
+/// A file access recorded by auditfuse. `path` is an absolute path relative to
+/// the root of the auditfuse mount.
+#[derive(Clone, Debug, Eq, Ord, PartialEq, PartialOrd)]
+pub struct AuditEntry {
+    pub access_type: AccessType,
+    pub path: PathBuf,
+}
+
+impl Display for AuditEntry {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}\t{}", self.access_type, self.path.display())
+    }
+}
+
+impl FromStr for AuditEntry {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        let (access_type, path) = s.split_once('\t').context("Corrupted audit line")?;
+        Ok(Self {
+            access_type: access_type.parse()?,
+            path: PathBuf::from(path),
+        })
+    }
+}
+
+/// Parses an audit file written by auditfuse, which consists of
+/// NUL-terminated [`AuditEntry`] lines.
+pub fn parse_audit_file(path: &Path) -> Result<Vec<AuditEntry>> {
+    let content = std::fs::read_to_string(path)
+        .with_context(|| format!("Failed to read {}", path.display()))?;
+    if content.is_empty() {
+        return Ok(Vec::new());
+    }
+    content
+        .strip_suffix('\0')
+        .context("Corrupted audit output")?
+        .split('\0')
+        .map(AuditEntry::from_str)
+        .collect()
+}
+
+/// Options to start auditfuse with.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct AuditfuseOptions {
+    /// Allows writes to the mount.
+    pub read_write: bool,
+    /// Prints verbose logs.
+    pub verbose: bool,
+}
+
+/// An auditfuse daemon serving files in a directory at another directory.
+///
+/// Accesses are written to the audit file when the daemon exits, which happens
+/// when the mount is unmounted by [`AuditfuseDaemon::stop`] or on drop.
+pub struct AuditfuseDaemon {
+    mount_dir: PathBuf,
+    mounted: bool,
+}
+
+impl AuditfuseDaemon {
+    /// Starts auditfuse to serve `orig_dir` at `mount_dir`, recording accesses
+    /// to `audit_file`. It returns after the mount is ready.
+    pub fn start(
+        options: &AuditfuseOptions,
+        audit_file: &Path,
+        orig_dir: &Path,
+        mount_dir: &Path,
+    ) -> Result<Self> {
+        let r = Runfiles::create()?;
+        let auditfuse_path =
+            runfiles::rlocation!(r, "cros/bazel/portage/bin/auditfuse/auditfuse_/auditfuse");
+
+        let mut command = Command::new(auditfuse_path);
+        if options.read_write {
+            command.arg("--read-write");
+        }
+        if options.verbose {
+            command.arg("--verbose");
+        }
+        let status = command
+            .arg("--output")
+            .arg(audit_file)
+            .arg(orig_dir)
+            .arg(mount_dir)
+            .status()?;
+        ensure!(status.success(), "auditfuse failed to start");
+
+        Ok(Self {
+            mount_dir: mount_dir.to_path_buf(),
+            mounted: true,
+        })
+    }
+
+    /// Unmounts auditfuse so that it writes out the audit file.
+    pub fn stop(mut self) -> Result<()> {
+        self.mounted = false;
+        umount2(&self.mount_dir, MntFlags::MNT_DETACH)
+            .with_context(|| format!("Failed to unmount {}", self.mount_dir.display()))
+    }
+}
+
+impl Drop for AuditfuseDaemon {
+    fn drop(&mut self) {
+        if self.mounted {
+            // Errors are ignored as we may be unwinding on another error.
+            let _ = umount2(&self.mount_dir, MntFlags::MNT_DETACH);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_audit_entry() -> Result<()> {
+        assert_eq!(
+            "LOOKUP\t/src/platform2".parse::<AuditEntry>()?,
+            AuditEntry {
+                access_type: AccessType::Lookup,
+                path: PathBuf::from("/src/platform2"),
+            }
+        );
+        assert_eq!(
+            "READDIR\t/".parse::<AuditEntry>()?,
+            AuditEntry {
+                access_type: AccessType::Readdir,
+                path: PathBuf::from("/"),
+            }
+        );
+        assert!("OPEN\t/src".parse::<AuditEntry>().is_err());
+        assert!("LOOKUP".parse::<AuditEntry>().is_err());
+        assert_eq!(
+            "LOOKUP\t/etc/passwd".parse::<AuditEntry>()?.to_string(),
+            "LOOKUP\t/etc/passwd"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse_audit_file() -> Result<()> {
+        let dir = tempfile::TempDir::new()?;
+        let path = dir.path().join("audit");
+
+        std::fs::write(&path, "")?;
+        assert_eq!(parse_audit_file(&path)?, Vec::new());
+
+        std::fs::write(&path, "LOOKUP\t/etc\0READDIR\t/etc\0")?;
+        let entries: Vec<String> = parse_audit_file(&path)?
+            .iter()
+            .map(|entry| entry.to_string())
+            .collect();
+        assert_eq!(entries, ["LOOKUP\t/etc", "READDIR\t/etc"]);
+
+        std::fs::write(&path, "LOOKUP\t/etc")?;
+        assert!(parse_audit_file(&path).is_err());
+        Ok(())
+    }
+}
@@ -8,9 +8,10 @@ use itertools::Itertools;
 use std::{
     ffi::OsStr,
     process::{ExitCode, Termination},
+    time::Duration,
 };
 
-use anyhow::{bail, Result};
+use anyhow::{bail, Context, Result};
 
 mod config;
 mod logging;
@@ -33,7 +34,7 @@ where
     F: FnOnce() -> Result<T, anyhow::Error> + std::panic::UnwindSafe,
     T: Termination,
 {
-    let _log_guard = config.logging.setup().unwrap();
+    let log_guard = config.logging.setup().unwrap();
     if config.log_command_line {
         log_current_command_line();
     }
@@ -51,6 +52,8 @@ where
     // ExitCode doesn't implement Eq, so we can't check whether it's a success or a failure.
     let failure = result.is_err();
 
+    log_guard.log_completion(!failure);
+
     let exit_code = handle_top_level_result(result);
 
     if failure {
@@ -115,3 +118,51 @@ pub fn split_key_value(spec: &str) -> Result<(&str, &str)> {
     }
     Ok((v[0], v[1]))
 }
+
+/// Parses a duration such as "90", "90s", "15m" or "2h". A number without a
+/// unit is interpreted as seconds.
+///
+/// This function can be used as a clap value parser.
+pub fn parse_duration(spec: &str) -> Result<Duration> {
+    let (number, unit) = match spec.find(|c: char| !c.is_ascii_digit()) {
+        Some(pos) => spec.split_at(pos),
+        None => (spec, "s"),
+    };
+    let number: u64 = number
+        .parse()
+        .with_context(|| format!("invalid duration: {:?}", spec))?;
+    let seconds = |multiplier: u64| {
+        number
+            .checked_mul(multiplier)
+            .map(Duration::from_secs)
+            .with_context(|| format!("duration too long: {:?}", spec))
+    };
+    match unit {
+        "ms" => Ok(Duration::from_millis(number)),
+        "s" => Ok(Duration::from_secs(number)),
+        "m" => seconds(60),
+        "h" => seconds(60 * 60),
+        _ => bail!("invalid duration: {:?}", spec),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_duration() -> Result<()> {
+        assert_eq!(parse_duration("90")?, Duration::from_secs(90));
+        assert_eq!(parse_duration("90s")?, Duration::from_secs(90));
+        assert_eq!(parse_duration("250ms")?, Duration::from_millis(250));
+        assert_eq!(parse_duration("15m")?, Duration::from_secs(15 * 60));
+        assert_eq!(parse_duration("2h")?, Duration::from_secs(2 * 60 * 60));
+        assert!(parse_duration("").is_err());
+        assert!(parse_duration("s").is_err());
+        assert!(parse_duration("10d").is_err());
+        assert!(parse_duration("1.5h").is_err());
+        assert!(parse_duration(&format!("{}m", u64::MAX)).is_err());
+        assert!(parse_duration(&format!("{}h", u64::MAX / 60)).is_err());
+        Ok(())
+    }
+}
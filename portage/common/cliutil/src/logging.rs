@@ -3,16 +3,21 @@
 // found in the LICENSE file.
 
 use anyhow::{bail, Context, Result};
+use clap::ValueEnum;
 use itertools::Itertools;
 use std::{
+    ffi::OsString,
     path::{Path, PathBuf},
-    time::SystemTime,
+    str::FromStr,
+    time::{Instant, SystemTime},
 };
 use tracing_chrome_trace::ChromeTraceLayer;
 use tracing_subscriber::filter::{EnvFilter, LevelFilter};
 use tracing_subscriber::prelude::*;
 use tracing_subscriber::Layer;
 
+use crate::expanded_args_os;
+
 /// Name of the environment variable containing the trace directory and file respectively.
 /// If both are provided, an error is thrown.
 /// If neither is provided, no tracing is performed.
@@ -30,10 +35,181 @@ pub const LOG_FILE_ENV: &str = "CROS_BAZEL_LOG_FILE";
 /// Otherwise, do log to the console.
 pub const CONSOLE_LOG_ENV: &str = "CROS_BAZEL_LOG_CONSOLE";
 
+/// Names of the environment variables providing the defaults of
+/// `--log-level`, `--log-format` and `--log-label` respectively. The values
+/// given by the flags are exported to them so that subprocesses log in the
+/// same way.
+pub const LOG_LEVEL_ENV: &str = "CROS_BAZEL_LOG_LEVEL";
+pub const LOG_FORMAT_ENV: &str = "CROS_BAZEL_LOG_FORMAT";
+pub const LOG_LABEL_ENV: &str = "CROS_BAZEL_LOG_LABEL";
+
+/// The format of logs written to the console and log files.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, ValueEnum)]
+pub enum LogFormat {
+    /// Human-readable lines.
+    #[default]
+    Text,
+    /// One JSON object per line, carrying the command name and the label of
+    /// the Bazel target, so that logs from many actions can be aggregated.
+    Json,
+}
+
+impl FromStr for LogFormat {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match <Self as ValueEnum>::from_str(s, false) {
+            Ok(format) => Ok(format),
+            Err(_) => bail!("Invalid log format: {s:?}"),
+        }
+    }
+}
+
+/// Logging flags accepted by all commands. Flatten this into the CLI of a
+/// program using [`crate::cli_main`] so that clap accepts the flags.
+///
+/// Logging is set up before the CLI is parsed, so the values are actually
+/// read from the command line by [`LoggingArgs::from_env`] rather than from
+/// the parsed struct.
+#[derive(clap::Args, Clone, Debug, Default, PartialEq, Eq)]
+pub struct LoggingArgs {
+    /// Minimum level of logs written to the console and log files, e.g.
+    /// "debug". Overrides RUST_LOG.
+    #[arg(long, global = true, value_name = "LEVEL")]
+    pub log_level: Option<LevelFilter>,
+
+    /// Format of logs written to the console and log files.
+    #[arg(long, global = true, value_name = "FORMAT")]
+    pub log_format: Option<LogFormat>,
+
+    /// Label of the Bazel target the command runs for. It is attached to JSON
+    /// log records.
+    #[arg(long, global = true, value_name = "LABEL")]
+    pub log_label: Option<String>,
+}
+
+/// Finds the value of a long flag, e.g. "--log-level=debug" or
+/// "--log-level debug", in command line arguments excluding the program name.
+/// Arguments after "--" are ignored. The last occurrence wins.
+fn find_flag_value(args: &[OsString], name: &str) -> Option<String> {
+    let mut value = None;
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        let Some(arg) = arg.to_str() else {
+            continue;
+        };
+        if arg == "--" {
+            break;
+        }
+        let Some(rest) = arg.strip_prefix(name) else {
+            continue;
+        };
+        if rest.is_empty() {
+            value = iter
+                .next()
+                .and_then(|value| value.to_str())
+                .map(str::to_owned);
+        } else if let Some(rest) = rest.strip_prefix('=') {
+            value = Some(rest.to_owned());
+        }
+    }
+    value
+}
+
+/// Returns the value of a flag if it is given in `args`, or an environment
+/// variable otherwise. An invalid flag value is ignored here since clap
+/// reports it later with a proper usage message.
+fn flag_or_env<T: FromStr>(
+    args: &[OsString],
+    flag: &str,
+    env: &impl Fn(&str) -> Option<String>,
+    env_name: &str,
+) -> Result<Option<T>> {
+    if let Some(value) = find_flag_value(args, flag).and_then(|value| value.parse().ok()) {
+        return Ok(Some(value));
+    }
+    match env(env_name) {
+        Some(value) => match value.parse() {
+            Ok(value) => Ok(Some(value)),
+            Err(_) => bail!("Invalid value of {env_name}: {value:?}"),
+        },
+        None => Ok(None),
+    }
+}
+
+impl LoggingArgs {
+    /// Reads the flags from the command line of the current process, falling
+    /// back to the environment variables, and exports the values to the
+    /// environment variables for subprocesses.
+    pub fn from_env() -> Result<Self> {
+        let mut args: Vec<OsString> = match expanded_args_os() {
+            Ok(args) => args,
+            Err(_) => std::env::args_os().collect(),
+        };
+        if !args.is_empty() {
+            args.remove(0);
+        }
+        let logging_args = Self::parse_args_and_env(&args, |name| std::env::var(name).ok())?;
+        logging_args.export_env();
+        Ok(logging_args)
+    }
+
+    /// Exports the values to the environment variables so that subprocesses
+    /// log in the same way.
+    pub fn export_env(&self) {
+        if let Some(level) = &self.log_level {
+            std::env::set_var(LOG_LEVEL_ENV, level.to_string());
+        }
+        if let Some(value) = self
+            .log_format
+            .and_then(|format| format.to_possible_value())
+        {
+            std::env::set_var(LOG_FORMAT_ENV, value.get_name());
+        }
+        if let Some(label) = &self.log_label {
+            std::env::set_var(LOG_LABEL_ENV, label);
+        }
+    }
+
+    fn parse_args_and_env(args: &[OsString], env: impl Fn(&str) -> Option<String>) -> Result<Self> {
+        Ok(Self {
+            log_level: flag_or_env(args, "--log-level", &env, LOG_LEVEL_ENV)?,
+            log_format: flag_or_env(args, "--log-format", &env, LOG_FORMAT_ENV)?,
+            log_label: flag_or_env(args, "--log-label", &env, LOG_LABEL_ENV)?,
+        })
+    }
+
+    /// Returns a filter of logs at `--log-level` or above. If the level is not
+    /// specified, the filter is configured with RUST_LOG, defaulting to INFO.
+    pub fn filter(&self) -> Result<EnvFilter> {
+        let builder = EnvFilter::builder().with_default_directive(LevelFilter::INFO.into());
+        Ok(match self.log_level {
+            Some(level) => builder.parse(level.to_string())?,
+            None => builder.from_env()?,
+        })
+    }
+}
+
 /// A guard object to perform cleanups with RAII.
 pub struct LogGuard {
     _span_guard: tracing::span::EnteredSpan,
+    _command_span_guard: Option<tracing::span::EnteredSpan>,
     _flush_guard: Option<tracing_chrome_trace::FlushGuard>,
+    format: LogFormat,
+    start_time: Instant,
+}
+
+impl LogGuard {
+    /// Logs a record with the duration of the command. It is logged at INFO
+    /// in the JSON format for aggregation, but only at DEBUG in the text
+    /// format to keep the console quiet.
+    pub fn log_completion(&self, success: bool) {
+        let duration_ms = self.start_time.elapsed().as_millis() as u64;
+        match self.format {
+            LogFormat::Json => tracing::info!(duration_ms, success, "Command finished"),
+            LogFormat::Text => tracing::debug!(duration_ms, success, "Command finished"),
+        }
+    }
 }
 
 /// The configuration for the logger.
@@ -48,6 +224,10 @@ pub struct LoggingConfig {
     /// A filter for which logs should be written to the console.
     /// If None, logs will not be written to the console.
     pub console_logger: Option<EnvFilter>,
+    /// The format of logs written to the console and the log file.
+    pub format: LogFormat,
+    /// The label of the Bazel target attached to JSON log records.
+    pub label: Option<String>,
 }
 
 impl LoggingConfig {
@@ -81,22 +261,15 @@ impl LoggingConfig {
         let trace_file = get_file(TRACE_DIR_ENV, TRACE_FILE_ENV, "json")?;
         let log_file = get_file(LOG_DIR_ENV, LOG_FILE_ENV, "log")?;
 
+        let logging_args = LoggingArgs::from_env()?;
+
         let console_logger = match std::env::var(CONSOLE_LOG_ENV).ok().as_deref() {
             Some("0") => None,
-            _ => Some(
-                EnvFilter::builder()
-                    .with_default_directive(LevelFilter::INFO.into())
-                    .from_env()?,
-            ),
+            _ => Some(logging_args.filter()?),
         };
 
         let log_file = match log_file {
-            Some(log_file) => Some((
-                log_file,
-                EnvFilter::builder()
-                    .with_default_directive(LevelFilter::INFO.into())
-                    .from_env()?,
-            )),
+            Some(log_file) => Some((log_file, logging_args.filter()?)),
             None => None,
         };
 
@@ -104,6 +277,8 @@ impl LoggingConfig {
             trace_file,
             log_file,
             console_logger,
+            format: logging_args.log_format.unwrap_or_default(),
+            label: logging_args.log_label,
         })
     }
 
@@ -125,25 +300,39 @@ impl LoggingConfig {
         };
 
         if let Some(filter) = self.console_logger {
-            layers.push(
-                tracing_subscriber::fmt::layer()
+            layers.push(match self.format {
+                LogFormat::Text => tracing_subscriber::fmt::layer()
                     .with_ansi(true)
                     .with_writer(std::io::stderr)
                     .with_filter(filter)
                     .boxed(),
-            );
+                LogFormat::Json => tracing_subscriber::fmt::layer()
+                    .json()
+                    .with_current_span(false)
+                    .with_span_list(true)
+                    .with_writer(std::io::stderr)
+                    .with_filter(filter)
+                    .boxed(),
+            });
         }
 
         if let Some((log_file, filter)) = self.log_file {
             let f = std::fs::File::create(&log_file)
                 .with_context(|| format!("Failed to open log file {log_file:?}"))?;
-            layers.push(
-                tracing_subscriber::fmt::layer()
+            layers.push(match self.format {
+                LogFormat::Text => tracing_subscriber::fmt::layer()
                     .with_ansi(false)
                     .with_writer(f)
                     .with_filter(filter)
                     .boxed(),
-            );
+                LogFormat::Json => tracing_subscriber::fmt::layer()
+                    .json()
+                    .with_current_span(false)
+                    .with_span_list(true)
+                    .with_writer(f)
+                    .with_filter(filter)
+                    .boxed(),
+            });
         }
 
         tracing_subscriber::registry()
@@ -154,6 +343,21 @@ impl LoggingConfig {
                 subscriber running.",
             )?;
 
+        // JSON records list the spans they are in, so enter a span identifying
+        // the command for them. It uses the highest level so that it is
+        // enabled whatever the log level is.
+        let command_span_guard = (self.format == LogFormat::Json).then(|| {
+            let span = tracing::error_span!(
+                "command",
+                command = %crate::get_current_process_name(),
+                label = tracing::field::Empty
+            );
+            if let Some(label) = &self.label {
+                span.record("label", label.as_str());
+            }
+            span.entered()
+        });
+
         let args = std::env::args()
             .map(|s| shell_escape::escape(s.into()))
             .join(" ");
@@ -166,7 +370,10 @@ impl LoggingConfig {
 
         Ok(LogGuard {
             _span_guard: span_guard,
+            _command_span_guard: command_span_guard,
             _flush_guard: flush_guard,
+            format: self.format,
+            start_time: Instant::now(),
         })
     }
 }
@@ -177,6 +384,67 @@ mod tests {
 
     use fileutil::SafeTempDir;
 
+    fn to_args(args: &[&str]) -> Vec<OsString> {
+        args.iter().map(OsString::from).collect()
+    }
+
+    #[test]
+    fn find_flag_value_works() {
+        let args = to_args(&[
+            "--log-level=debug",
+            "--log-format",
+            "json",
+            "--log-label-foo=bar",
+            "--",
+            "--log-label=ignored",
+        ]);
+        assert_eq!(
+            find_flag_value(&args, "--log-level"),
+            Some("debug".to_owned())
+        );
+        assert_eq!(
+            find_flag_value(&args, "--log-format"),
+            Some("json".to_owned())
+        );
+        assert_eq!(find_flag_value(&args, "--log-label"), None);
+
+        let args = to_args(&["--log-level=debug", "--log-level=warn"]);
+        assert_eq!(
+            find_flag_value(&args, "--log-level"),
+            Some("warn".to_owned())
+        );
+    }
+
+    #[test]
+    fn logging_args_prefer_flags_to_env() -> Result<()> {
+        let env = |name: &str| match name {
+            LOG_LEVEL_ENV => Some("warn".to_owned()),
+            LOG_FORMAT_ENV => Some("json".to_owned()),
+            _ => None,
+        };
+
+        let args = LoggingArgs::parse_args_and_env(
+            &to_args(&["--log-level", "debug", "--log-label=//foo:bar"]),
+            env,
+        )?;
+        assert_eq!(
+            args,
+            LoggingArgs {
+                log_level: Some(LevelFilter::DEBUG),
+                log_format: Some(LogFormat::Json),
+                log_label: Some("//foo:bar".to_owned()),
+            }
+        );
+
+        // Invalid flags are left to clap, but invalid environment variables
+        // are errors.
+        let args = LoggingArgs::parse_args_and_env(&to_args(&["--log-format=xml"]), |_| None)?;
+        assert_eq!(args, LoggingArgs::default());
+        assert!(LoggingArgs::parse_args_and_env(&[], |_| Some("xml".to_owned())).is_err());
+
+        Ok(())
+    }
+
     #[test]
     fn setup_logging_works() -> Result<()> {
         const INFO_MESSAGE: &str = "log at level info";
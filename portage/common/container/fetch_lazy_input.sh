@@ -0,0 +1,57 @@
+#!/bin/bash
+# Copyright 2024 The ChromiumOS Authors
+# Use of this source code is governed by a BSD-style license that can be
+# found in the LICENSE file.
+
+# Requests the host to fetch a lazy input by its SHA-256 digest, waits for it
+# to be available, and prints its path in the container.
+#
+# Usage: /.fetch_lazy_input.sh <sha256>
+#
+# It gives up after LAZY_INPUT_TIMEOUT seconds (default: 600).
+
+set -eu
+
+if [[ "$#" -ne 1 ]]; then
+  echo "usage: $0 <sha256>" >&2
+  exit 1
+fi
+
+readonly digest="$1"
+readonly spool_dir="/mnt/lazy_inputs"
+readonly path="${spool_dir}/${digest}"
+readonly error_path="${path}.error"
+readonly timeout="${LAZY_INPUT_TIMEOUT:-600}"
+
+if [[ ! "${digest}" =~ ^[0-9a-f]{64}$ ]]; then
+  echo "$0: invalid SHA-256 digest: ${digest}" >&2
+  exit 1
+fi
+
+if [[ ! -e "${path}" && ! -e "${error_path}" ]]; then
+  if [[ ! -p /.control ]]; then
+    echo "$0: lazy inputs are not enabled for this container" >&2
+    exit 1
+  fi
+  printf 'f%s\n' "${digest}" > /.control
+  # Poll with exponential backoff from 10ms up to 1s, as fetching large inputs
+  # can take minutes.
+  delay_ms=10
+  deadline=$((SECONDS + timeout))
+  while [[ ! -e "${path}" && ! -e "${error_path}" ]]; do
+    if (( SECONDS >= deadline )); then
+      echo "$0: timed out after ${timeout}s waiting for ${digest}" >&2
+      exit 1
+    fi
+    sleep "$(printf '%d.%03d' $((delay_ms / 1000)) $((delay_ms % 1000)))"
+    delay_ms=$((delay_ms * 2 > 1000 ? 1000 : delay_ms * 2))
+  done
+fi
+
+if [[ ! -e "${path}" ]]; then
+  echo -n "$0: " >&2
+  cat "${error_path}" >&2
+  exit 1
+fi
+
+echo "${path}"
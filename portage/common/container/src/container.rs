@@ -7,23 +7,30 @@ use std::{
     ffi::{OsStr, OsString},
     fs::File,
     io::Read,
-    os::unix::prelude::PermissionsExt,
+    os::unix::{fs::symlink, prelude::PermissionsExt},
     path::{Path, PathBuf},
     process::{Command, ExitStatus},
     str::FromStr,
+    sync::Arc,
+    time::{Duration, Instant},
 };
 
 use anyhow::{bail, ensure, Context, Result};
 use durabletree::DurableTree;
 use fileutil::{resolve_symlink_forest, SafeTempDir, SafeTempDirBuilder};
 use nix::sys::statfs::{statfs, OVERLAYFS_SUPER_MAGIC};
-use run_in_container_lib::{BindMountConfig, RunInContainerConfig};
+use processes::ProcessEvent;
+use run_in_container_lib::{time_phase, BindMountConfig, RunInContainerConfig, SetupPhase};
 use strum_macros::EnumString;
-use tracing::info_span;
+use tracing::{info, info_span};
 
 use crate::{
     control::ControlChannel,
-    mounts::{bind_mount, mount_overlayfs, remount_readonly, MountGuard},
+    lazy_inputs::{LazyInputs, LAZY_INPUTS_MOUNT_PATH},
+    mounts::{
+        bind_mount, make_shared, mount_archive, mount_overlayfs, remount_readonly, MountGuard,
+    },
+    ContainerError, DiffFilter,
 };
 
 const DEFAULT_PATH: &str = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:\
@@ -49,23 +56,66 @@ pub enum LoginMode {
     AfterFail,
 }
 
+/// Specifies how tarball layers are made available to containers.
+#[derive(Debug, Clone, Copy, Default, PartialEq, EnumString, strum_macros::Display)]
+#[strum(serialize_all = "kebab-case")]
+pub enum LayerBackend {
+    /// Extracts tarballs to temporary directories.
+    #[default]
+    Extract,
+    /// Mounts tarballs with a FUSE file system, fuse-archive or archivemount.
+    Fuse,
+}
+
+pub use run_in_container_lib::{MountPropagation, NetworkMode, ResourceLimits};
+
 #[derive(Clone, Debug)]
 pub struct BindMount {
     pub mount_path: PathBuf,
     pub source: PathBuf,
     pub rw: bool,
+    pub propagation: MountPropagation,
+}
+
+/// Parses comma-separated bind mount options, e.g. "rw" or "ro,slave".
+///
+/// Returns [`None`] if any of the options is unknown so that callers can treat
+/// the string as part of a path instead.
+fn parse_bind_mount_options(options: &str) -> Option<(bool, MountPropagation)> {
+    let mut rw = false;
+    let mut propagation = MountPropagation::Private;
+    for option in options.split(',') {
+        match option {
+            "ro" => rw = false,
+            "rw" => rw = true,
+            _ => propagation = option.parse().ok()?,
+        }
+    }
+    Some((rw, propagation))
 }
 
 impl FromStr for BindMount {
     type Err = anyhow::Error;
 
+    /// Parses a bind mount spec in the form of
+    /// `<mount_path>=<source>[:<options>]`, where `<options>` is a
+    /// comma-separated list of "ro" (default) or "rw", and "private" (default),
+    /// "slave" or "shared".
     fn from_str(spec: &str) -> Result<Self> {
         let v: Vec<_> = spec.split('=').collect();
         ensure!(v.len() == 2, "Invalid bind-mount spec: {:?}", spec);
+        let (source, rw, propagation) = v[1]
+            .rsplit_once(':')
+            .and_then(|(source, options)| {
+                let (rw, propagation) = parse_bind_mount_options(options)?;
+                Some((source, rw, propagation))
+            })
+            .unwrap_or((v[1], false, MountPropagation::Private));
         Ok(Self {
             mount_path: v[0].into(),
-            source: v[1].into(),
-            rw: false,
+            source: source.into(),
+            rw,
+            propagation,
         })
     }
 }
@@ -76,6 +126,7 @@ impl BindMount {
             mount_path: self.mount_path,
             source: self.source,
             rw: self.rw,
+            propagation: self.propagation,
         }
     }
 }
@@ -124,6 +175,96 @@ pub struct CommonArgs {
     /// Keeps the host file system at /host. Use for debuggin only.
     #[arg(long)]
     pub keep_host_mount: bool,
+
+    /// Terminates the command in the container if it does not finish within
+    /// the specified duration, e.g. "90s", "30m".
+    #[arg(long, value_parser = cliutil::parse_duration)]
+    pub timeout: Option<Duration>,
+
+    /// On timeout, asks the processes of the command to dump their stacks
+    /// with SIGQUIT before terminating them. Useful to debug hung Go programs
+    /// and JVMs.
+    #[arg(long, requires = "timeout")]
+    pub timeout_dump_stacks: bool,
+
+    /// Hides a path in the container, e.g. "/etc/localtime".
+    #[arg(long)]
+    pub mask_path: Vec<PathBuf>,
+
+    /// Size of the tmpfs mounted at /dev/shm in the container, e.g. "64m" or
+    /// "50%".
+    #[arg(long, value_parser = run_in_container_lib::parse_tmpfs_size)]
+    pub shm_size: Option<String>,
+
+    /// Exposes a host device file in the container at the same path, e.g.
+    /// "/dev/kvm". Can be specified multiple times.
+    #[arg(long)]
+    pub device: Vec<PathBuf>,
+
+    /// Host name of the container. Defaults to "cros-bazel".
+    #[arg(long, value_parser = run_in_container_lib::parse_hostname)]
+    pub hostname: Option<String>,
+
+    /// Machine ID exposed at /etc/machine-id in the container, as 32
+    /// lowercase hexadecimal digits. Defaults to a fixed value.
+    #[arg(long, value_parser = run_in_container_lib::parse_machine_id)]
+    pub machine_id: Option<String>,
+
+    /// Network configuration of the container: "none" (default) allows
+    /// loopback networking only, "host" shares the host network, and "slirp"
+    /// connects to the outside with slirp4netns without privileges. Use for
+    /// debugging only as it reduces hermeticity.
+    #[arg(long, value_name = "none|host|slirp")]
+    pub network: Option<NetworkMode>,
+
+    /// Limits the memory usage of the container, e.g. "16g".
+    #[arg(long, value_parser = run_in_container_lib::parse_memory_limit)]
+    pub memory_limit: Option<u64>,
+
+    /// Limits the CPU usage of the container in number of CPUs, e.g. "4".
+    #[arg(long, value_parser = run_in_container_lib::parse_cpu_limit)]
+    pub cpu_limit: Option<f64>,
+
+    /// Limits the number of processes and threads in the container.
+    #[arg(long, value_parser = clap::value_parser!(u64).range(1..))]
+    pub pids_limit: Option<u64>,
+
+    /// Prints the time spent on each phase of setting up the container, such
+    /// as mounting layers, before running the command.
+    #[arg(long)]
+    pub profile_mounts: bool,
+
+    /// Saves the time spent on each phase of setting up the container to the
+    /// specified file in JSON.
+    #[arg(long)]
+    pub profile_mounts_json: Option<PathBuf>,
+
+    /// Mounts tarball layers with a FUSE file system, fuse-archive or
+    /// archivemount, instead of extracting them. Falls back to extraction if
+    /// neither is installed. Same as --layer-backend=fuse.
+    #[arg(long)]
+    pub lazy_archive_layers: bool,
+
+    /// How to make tarball layers available to the container: "extract"
+    /// (default) extracts them, and "fuse" mounts them with a FUSE file
+    /// system. Falls back to extraction if the backend is unavailable.
+    #[arg(
+        long,
+        value_name = "extract|fuse",
+        conflicts_with = "lazy_archive_layers"
+    )]
+    pub layer_backend: Option<LayerBackend>,
+
+    /// Makes files listed in the manifest, in the output format of
+    /// `sha256sum`, available to the container on request. See
+    /// [`LazyInputs`] for details.
+    #[arg(long)]
+    pub lazy_inputs_manifest: Option<PathBuf>,
+
+    /// A program to fetch lazy inputs not listed in --lazy-inputs-manifest,
+    /// invoked as `<program> <sha256> <output>`.
+    #[arg(long)]
+    pub lazy_inputs_fetcher: Option<PathBuf>,
 }
 
 #[derive(Clone, Debug)]
@@ -163,14 +304,37 @@ impl LayerType {
 /// [`PreparedContainer`] objects.
 pub struct ContainerSettings {
     mutable_base_dir: PathBuf,
-    allow_network_access: bool,
+    network: NetworkMode,
     login_mode: LoginMode,
     keep_host_mount: bool,
+    timeout: Option<Duration>,
+    timeout_dump_stacks: bool,
+    resource_limits: ResourceLimits,
     lower_dirs: Vec<PathBuf>,
     archive_dirs: Vec<SafeTempDir>,
+    archive_mounts: Vec<ArchiveMount>,
     durable_trees: Vec<DurableTree>,
     reusable_archive_dir: Option<PathBuf>,
     bind_mounts: Vec<BindMount>,
+    mask_paths: Vec<PathBuf>,
+    shm_size: Option<String>,
+    devices: Vec<PathBuf>,
+    hostname: Option<String>,
+    machine_id: Option<String>,
+    profile_mounts: bool,
+    profile_mounts_json: Option<PathBuf>,
+    setup_phases: Vec<SetupPhase>,
+    layer_backend: LayerBackend,
+    lazy_inputs: Option<Arc<LazyInputs>>,
+    diff_filter: DiffFilter,
+}
+
+/// A tarball layer mounted with a FUSE file system.
+struct ArchiveMount {
+    // Note: The order of fields matters here! The mount point must be
+    // unmounted before removing the directory.
+    _guard: MountGuard,
+    _dir: SafeTempDir,
 }
 
 impl ContainerSettings {
@@ -178,14 +342,29 @@ impl ContainerSettings {
     pub fn new() -> Self {
         Self {
             mutable_base_dir: std::env::temp_dir(),
-            allow_network_access: false,
+            network: NetworkMode::None,
             login_mode: LoginMode::Never,
             keep_host_mount: false,
+            timeout: None,
+            timeout_dump_stacks: false,
+            resource_limits: ResourceLimits::default(),
             lower_dirs: Vec::new(),
             archive_dirs: Vec::new(),
+            archive_mounts: Vec::new(),
             durable_trees: Vec::new(),
             reusable_archive_dir: None,
             bind_mounts: Vec::new(),
+            mask_paths: Vec::new(),
+            shm_size: None,
+            devices: Vec::new(),
+            hostname: None,
+            machine_id: None,
+            profile_mounts: false,
+            profile_mounts_json: None,
+            setup_phases: Vec::new(),
+            layer_backend: LayerBackend::Extract,
+            lazy_inputs: None,
+            diff_filter: DiffFilter::new(),
         }
     }
 
@@ -202,8 +381,21 @@ impl ContainerSettings {
     /// Sets whether to allow network access to processes in the container.
     /// This option should be enabled only when it's absolutely needed since it
     /// reduces hermeticity of the container.
+    ///
+    /// This is a shorthand of [`ContainerSettings::set_network_mode`] with
+    /// [`NetworkMode::Host`] or [`NetworkMode::None`].
     pub fn set_allow_network_access(&mut self, allow_network_access: bool) {
-        self.allow_network_access = allow_network_access;
+        self.network = if allow_network_access {
+            NetworkMode::Host
+        } else {
+            NetworkMode::None
+        };
+    }
+
+    /// Sets the network configuration of the container. The default is
+    /// [`NetworkMode::None`], which allows no network access.
+    pub fn set_network_mode(&mut self, network: NetworkMode) {
+        self.network = network;
     }
 
     /// Sets the login mode for containers.
@@ -224,6 +416,107 @@ impl ContainerSettings {
         self.keep_host_mount = keep_host_mount;
     }
 
+    /// Sets the maximum duration commands in containers can run for.
+    ///
+    /// When the timeout expires, the command is terminated gracefully and
+    /// [`ContainerCommand::status`] returns the exit status 124, which
+    /// [`ContainerCommand::run`] reports as [`ContainerError::Timeout`].
+    pub fn set_timeout(&mut self, timeout: Option<Duration>) {
+        self.timeout = timeout;
+    }
+
+    /// Sets whether to send SIGQUIT to the command on timeout before
+    /// terminating it, so that Go programs and JVMs dump their stacks to the
+    /// output.
+    pub fn set_timeout_dump_stacks(&mut self, timeout_dump_stacks: bool) {
+        self.timeout_dump_stacks = timeout_dump_stacks;
+    }
+
+    /// Sets resource limits of the container, enforced with cgroup v2.
+    ///
+    /// Processes in the container are killed by the OOM killer if they exceed
+    /// the memory limit. The peak resource usage is logged when the container
+    /// exits.
+    pub fn set_resource_limits(&mut self, resource_limits: ResourceLimits) {
+        self.resource_limits = resource_limits;
+    }
+
+    /// Sets the size of the tmpfs mounted at /dev/shm in the container, in the
+    /// format accepted by the tmpfs "size" mount option.
+    ///
+    /// By default, the kernel default size is used.
+    pub fn set_shm_size(&mut self, shm_size: Option<String>) {
+        self.shm_size = shm_size;
+    }
+
+    /// Exposes a host device file, e.g. /dev/kvm, in the container at the
+    /// same path.
+    ///
+    /// Only a minimal set of devices, such as /dev/null and /dev/fuse, is
+    /// available by default.
+    pub fn push_device(&mut self, path: &Path) {
+        self.devices.push(path.to_owned());
+    }
+
+    /// Sets the host name of the container.
+    ///
+    /// By default, [`run_in_container_lib::DEFAULT_HOSTNAME`] is used.
+    pub fn set_hostname(&mut self, hostname: Option<String>) {
+        self.hostname = hostname;
+    }
+
+    /// Sets the machine ID exposed at /etc/machine-id in the container.
+    ///
+    /// By default, [`run_in_container_lib::DEFAULT_MACHINE_ID`] is used.
+    pub fn set_machine_id(&mut self, machine_id: Option<String>) {
+        self.machine_id = machine_id;
+    }
+
+    /// Makes run_in_container report the time spent on each phase of setting
+    /// up containers. The report is printed if `print` is true, and saved to
+    /// `json_path` in JSON if specified.
+    pub fn set_profile_mounts(&mut self, print: bool, json_path: Option<PathBuf>) {
+        self.profile_mounts = print;
+        self.profile_mounts_json = json_path;
+    }
+
+    /// Mounts tarball layers pushed afterwards lazily with a FUSE file system
+    /// instead of extracting them, which saves time and disk space for large
+    /// layers. Tarballs are still extracted if no FUSE file system to mount
+    /// them, fuse-archive or archivemount, is installed.
+    pub fn set_lazy_archive_layers(&mut self, lazy_archive_layers: bool) {
+        self.set_layer_backend(if lazy_archive_layers {
+            LayerBackend::Fuse
+        } else {
+            LayerBackend::Extract
+        });
+    }
+
+    /// Selects how tarball layers pushed afterwards are made available to
+    /// containers. See [`LayerBackend`] for available backends. Tarballs are
+    /// extracted if the selected backend is unavailable in the environment.
+    pub fn set_layer_backend(&mut self, layer_backend: LayerBackend) {
+        self.layer_backend = layer_backend;
+    }
+
+    /// Sets include/exclude rules applied to the upper directory by
+    /// [`PreparedContainer::into_upper_dir`].
+    pub fn set_diff_filter(&mut self, diff_filter: DiffFilter) {
+        self.diff_filter = diff_filter;
+    }
+
+    /// Serves lazy inputs to containers on request, and bind-mounts the spool
+    /// directory at [`LAZY_INPUTS_MOUNT_PATH`].
+    pub fn set_lazy_inputs(&mut self, lazy_inputs: LazyInputs) {
+        self.push_bind_mount(BindMount {
+            mount_path: PathBuf::from(LAZY_INPUTS_MOUNT_PATH),
+            source: lazy_inputs.spool_dir().to_owned(),
+            rw: false,
+            propagation: MountPropagation::Private,
+        });
+        self.lazy_inputs = Some(Arc::new(lazy_inputs));
+    }
+
     /// Pushes a new layer to the container settings.
     ///
     /// This function prepares a layer by extracting archives and/or mounting
@@ -235,7 +528,30 @@ impl ContainerSettings {
 
         let _span = info_span!("push_layer", ?layer_type, ?path).entered();
 
+        let mut phases = std::mem::take(&mut self.setup_phases);
+        let name = format!("layer {} ({:?})", path.display(), layer_type);
+        let result = time_phase(&mut phases, name, || {
+            self.push_layer_inner(layer_type, path)
+        });
+        self.setup_phases = phases;
+        result
+    }
+
+    fn push_layer_inner(&mut self, layer_type: LayerType, path: &Path) -> Result<()> {
         match layer_type {
+            LayerType::Archive if self.layer_backend == LayerBackend::Fuse => {
+                if self.mount_archive(path)? {
+                    return Ok(());
+                }
+                eprintln!(
+                    "WARNING: Extracting {} because neither fuse-archive nor archivemount \
+                    is installed",
+                    path.display()
+                );
+                let archive_dir = self.request_archive_dir()?;
+                Self::extract_archive(path, &archive_dir)?;
+                Ok(())
+            }
             LayerType::Archive => {
                 let archive_dir = self.request_archive_dir()?;
                 Self::extract_archive(path, &archive_dir)?;
@@ -266,14 +582,59 @@ impl ContainerSettings {
         self.bind_mounts.push(bind_mount);
     }
 
+    /// Hides a path in the container.
+    ///
+    /// Unlike bind mounts, masks are applied by run_in_container after all
+    /// layers and bind mounts are assembled, so they can hide files provided
+    /// by any of them. A directory is masked by an empty read-only tmpfs, and
+    /// other files are masked by `/dev/null`.
+    pub fn push_mask_path(&mut self, path: &Path) {
+        self.mask_paths.push(path.to_owned());
+    }
+
     /// Applies container settings represented in [`CommonArgs`].
     pub fn apply_common_args(&mut self, args: &CommonArgs) -> Result<()> {
         self.set_keep_host_mount(args.keep_host_mount);
         self.set_login_mode(args.login);
+        self.set_timeout(args.timeout);
+        self.set_timeout_dump_stacks(args.timeout_dump_stacks);
+        self.set_resource_limits(ResourceLimits {
+            memory: args.memory_limit,
+            cpus: args.cpu_limit,
+            pids: args.pids_limit,
+        });
+        self.set_shm_size(args.shm_size.clone());
+        self.set_hostname(args.hostname.clone());
+        self.set_machine_id(args.machine_id.clone());
+        if let Some(network) = args.network {
+            self.set_network_mode(network);
+        }
+        self.set_profile_mounts(args.profile_mounts, args.profile_mounts_json.clone());
+        if let Some(layer_backend) = args.layer_backend {
+            self.set_layer_backend(layer_backend);
+        } else {
+            self.set_lazy_archive_layers(args.lazy_archive_layers);
+        }
 
         for path in args.layer.iter() {
             self.push_layer(&resolve_symlink_forest(path)?)?;
         }
+        for path in args.mask_path.iter() {
+            self.push_mask_path(path);
+        }
+        for path in args.device.iter() {
+            self.push_device(path);
+        }
+        if args.lazy_inputs_manifest.is_some() || args.lazy_inputs_fetcher.is_some() {
+            let mut lazy_inputs = LazyInputs::new(&self.mutable_base_dir)?;
+            if let Some(path) = &args.lazy_inputs_manifest {
+                lazy_inputs.load_manifest(path)?;
+            }
+            if let Some(path) = &args.lazy_inputs_fetcher {
+                lazy_inputs.set_fetcher(path);
+            }
+            self.set_lazy_inputs(lazy_inputs);
+        }
         Ok(())
     }
 
@@ -368,14 +729,38 @@ impl ContainerSettings {
         }
     }
 
-    fn extract_archive(archive_path: &Path, extract_dir: &Path) -> Result<()> {
+    /// Mounts a tarball as a new lower directory. Returns false if no FUSE file
+    /// system to mount tarballs is available.
+    fn mount_archive(&mut self, archive_path: &Path) -> Result<bool> {
+        let dir = SafeTempDirBuilder::new()
+            .base_dir(&self.mutable_base_dir)
+            .prefix("archive.")
+            .build()?;
+        let Some(guard) = mount_archive(archive_path, dir.path())? else {
+            return Ok(false);
+        };
+        self.lower_dirs.push(dir.path().to_owned());
+        self.archive_mounts.push(ArchiveMount {
+            _guard: guard,
+            _dir: dir,
+        });
+        // Later tarballs must not be extracted under the mounted one.
+        self.reusable_archive_dir = None;
+        Ok(true)
+    }
+
+    /// Opens a tarball, decompressing it according to its file extension.
+    fn open_archive(archive_path: &Path) -> Result<Box<dyn Read>> {
         let f = File::open(archive_path)?;
-        let decompressed: Box<dyn Read> = match archive_path.extension() {
+        Ok(match archive_path.extension() {
             Some(s) if s == OsStr::new("zst") => Box::new(zstd::stream::read::Decoder::new(f)?),
             Some(s) if s == OsStr::new("gz") => Box::new(flate2::read::GzDecoder::new(f)),
             _ => Box::new(f),
-        };
-        tar::Archive::new(decompressed).unpack(extract_dir)?;
+        })
+    }
+
+    fn extract_archive(archive_path: &Path, extract_dir: &Path) -> Result<()> {
+        tar::Archive::new(Self::open_archive(archive_path)?).unpack(extract_dir)?;
         Ok(())
     }
 }
@@ -443,12 +828,16 @@ pub struct PreparedContainer<'settings> {
     upper_dir: SafeTempDir,
 
     base_envs: BTreeMap<OsString, OsString>,
+    setup_phases: Vec<SetupPhase>,
 }
 
 impl<'settings> PreparedContainer<'settings> {
     fn new(settings: &'settings ContainerSettings, upper_dir: SafeTempDir) -> Result<Self> {
         ensure_not_overlayfs(&settings.mutable_base_dir)?;
 
+        let mut setup_phases = settings.setup_phases.clone();
+        let stage_start = Instant::now();
+
         let mut base_envs: BTreeMap<OsString, OsString> = BTreeMap::from_iter([
             ("PATH".into(), DEFAULT_PATH.into()),
             // Always enable Rust backtrace.
@@ -481,18 +870,44 @@ impl<'settings> PreparedContainer<'settings> {
             .build()?;
 
         // Create mount points for essential top-level directories.
-        for d in ["dev", "proc", "sys", "host"] {
+        for d in ["dev", "proc", "sys", "host", "run"] {
             std::fs::create_dir(stage_dir.path().join(d))?;
         }
 
-        // Copy `setup.sh` to `/.setup.sh`.
-        let r = runfiles::Runfiles::create()?;
-        let setup_sh_path = stage_dir.path().join(".setup.sh");
-        std::fs::copy(
-            runfiles::rlocation!(r, "cros/bazel/portage/common/container/setup.sh"),
-            &setup_sh_path,
+        // Point the legacy runtime directories to /run, where
+        // run_in_container mounts a fresh tmpfs, so that lock files and
+        // sockets never leak into the upper directory. Minimal layers often
+        // lack them entirely.
+        std::fs::create_dir(stage_dir.path().join("var"))?;
+        std::fs::set_permissions(
+            stage_dir.path().join("var"),
+            PermissionsExt::from_mode(0o755),
         )?;
-        std::fs::set_permissions(&setup_sh_path, PermissionsExt::from_mode(0o755))?;
+        for (name, original) in [("lock", "../run/lock"), ("run", "../run")] {
+            symlink(original, stage_dir.path().join("var").join(name))?;
+        }
+
+        // Provide the mount point of /etc/machine-id, where run_in_container
+        // bind-mounts a fixed machine ID, so that it never lands in the upper
+        // directory even if no layer has the file.
+        std::fs::create_dir(stage_dir.path().join("etc"))?;
+        std::fs::set_permissions(
+            stage_dir.path().join("etc"),
+            PermissionsExt::from_mode(0o755),
+        )?;
+        File::create(stage_dir.path().join("etc/machine-id"))?;
+
+        // Copy `setup.sh` to `/.setup.sh`, and `fetch_lazy_input.sh` to
+        // `/.fetch_lazy_input.sh`.
+        let r = runfiles::Runfiles::create()?;
+        for name in ["setup.sh", "fetch_lazy_input.sh"] {
+            let path = stage_dir.path().join(format!(".{name}"));
+            std::fs::copy(
+                runfiles::rlocation!(r, format!("cros/bazel/portage/common/container/{name}")),
+                &path,
+            )?;
+            std::fs::set_permissions(&path, PermissionsExt::from_mode(0o755))?;
+        }
 
         // Create mount points for bind-mounts.
         for spec in settings.bind_mounts.iter() {
@@ -530,15 +945,27 @@ impl<'settings> PreparedContainer<'settings> {
             .chain([stage_dir.path()])
             .collect();
 
+        setup_phases.push(SetupPhase {
+            name: "stage directory".to_owned(),
+            duration: stage_start.elapsed(),
+        });
+
         // Mount the overlayfs.
-        let overlayfs_guard = mount_overlayfs(
-            root_dir.path(),
-            &lower_dirs,
-            upper_dir.path(),
-            scratch_dir.path(),
+        let overlayfs_guard = time_phase(
+            &mut setup_phases,
+            format!("overlayfs ({} lower dirs)", lower_dirs.len()),
+            || {
+                mount_overlayfs(
+                    root_dir.path(),
+                    &lower_dirs,
+                    upper_dir.path(),
+                    scratch_dir.path(),
+                )
+            },
         )?;
 
         // Perform bind-mounts.
+        let bind_mounts_start = Instant::now();
         for spec in settings.bind_mounts.iter() {
             let target = root_dir.path().join(spec.mount_path.strip_prefix("/")?);
 
@@ -548,7 +975,16 @@ impl<'settings> PreparedContainer<'settings> {
             if !spec.rw {
                 remount_readonly(&target)?;
             }
+            // Make the mount point a peer group so that run_in_container can
+            // keep the propagation to its copy in the container.
+            if spec.propagation != MountPropagation::Private {
+                make_shared(&target)?;
+            }
         }
+        setup_phases.push(SetupPhase {
+            name: "bind mounts".to_owned(),
+            duration: bind_mounts_start.elapsed(),
+        });
 
         // Note that we don't mount special file systems (/dev, /proc, and /sys)
         // here but they are mounted by run_in_container instead. It is because
@@ -564,6 +1000,7 @@ impl<'settings> PreparedContainer<'settings> {
             _scratch_dir: scratch_dir,
             upper_dir,
             base_envs,
+            setup_phases,
         })
     }
 
@@ -572,6 +1009,21 @@ impl<'settings> PreparedContainer<'settings> {
         self.root_dir.path()
     }
 
+    /// Returns the `overlayfs` upper directory where changes made to the
+    /// filesystem root are recorded.
+    pub fn upper_dir(&self) -> &Path {
+        self.upper_dir.path()
+    }
+
+    /// Checks the exit status of a command run in the container, and fails
+    /// with [`ContainerError`] unless the command succeeded.
+    pub fn check_status(&self, status: ExitStatus) -> Result<()> {
+        match ContainerError::from_status(status, self.settings.timeout) {
+            Some(err) => Err(err.into()),
+            None => Ok(()),
+        }
+    }
+
     /// Creates a [`ContainerCommand`] that can be used to run a command within
     /// the container.
     ///
@@ -585,13 +1037,23 @@ impl<'settings> PreparedContainer<'settings> {
     }
 
     /// Destructs the prepared container and returns the path to its upper
-    /// directory.
+    /// directory, after removing paths excluded by the diff filter set with
+    /// [`ContainerSettings::set_diff_filter`].
     ///
     /// It is your responsibility to remove the returned upper directory once
     /// you are done with it.
-    #[must_use]
-    pub fn into_upper_dir(self) -> PathBuf {
-        self.upper_dir.into_path()
+    pub fn into_upper_dir(self) -> Result<PathBuf> {
+        // Drop the other fields to unmount the overlayfs before touching the
+        // upper directory.
+        let (settings, upper_dir) = {
+            let this = self;
+            (this.settings, this.upper_dir)
+        };
+        settings
+            .diff_filter
+            .apply(upper_dir.path())
+            .context("Failed to apply the diff filter")?;
+        Ok(upper_dir.into_path())
     }
 }
 
@@ -674,6 +1136,9 @@ impl<'container> ContainerCommand<'container> {
     }
 
     /// Runs a process in the container and returns its exit status.
+    ///
+    /// It fails if run_in_container failed to set up the container, in which
+    /// case the command didn't run.
     pub fn status(&mut self) -> Result<ExitStatus> {
         let _span = info_span!("status").entered();
 
@@ -686,8 +1151,22 @@ impl<'container> ContainerCommand<'container> {
             root_dir: self.container.root_dir.path().to_path_buf(),
             envs: self.envs.clone(),
             chdir: self.current_dir.clone(),
-            allow_network_access: self.container.settings.allow_network_access,
+            network: self.container.settings.network,
             keep_host_mount: self.container.settings.keep_host_mount,
+            mask_paths: self.container.settings.mask_paths.clone(),
+            shm_size: self.container.settings.shm_size.clone(),
+            devices: self.container.settings.devices.clone(),
+            hostname: self.container.settings.hostname.clone(),
+            machine_id: self.container.settings.machine_id.clone(),
+            bind_mounts: self
+                .container
+                .settings
+                .bind_mounts
+                .iter()
+                .cloned()
+                .map(BindMount::into_config)
+                .collect(),
+            setup_phases: self.container.setup_phases.clone(),
         };
 
         // Save run_in_container.json.
@@ -698,14 +1177,18 @@ impl<'container> ContainerCommand<'container> {
         let config_path = config_dir.path().join("run_in_container.json");
         config.serialize_to(&config_path)?;
 
-        // Start a control channel for interactive shells if needed.
-        let _control = if self.container.settings.login_mode == LoginMode::Never {
-            None
-        } else {
-            Some(ControlChannel::new(
-                self.container.root_dir.path().join(".control"),
-            )?)
-        };
+        // Start a control channel for interactive shells and lazy inputs if
+        // needed.
+        let lazy_inputs = self.container.settings.lazy_inputs.clone();
+        let _control =
+            if self.container.settings.login_mode == LoginMode::Never && lazy_inputs.is_none() {
+                None
+            } else {
+                Some(ControlChannel::new(
+                    self.container.root_dir.path().join(".control"),
+                    lazy_inputs,
+                )?)
+            };
 
         // Now it's time to start a container!
         let r = runfiles::Runfiles::create()?;
@@ -713,13 +1196,51 @@ impl<'container> ContainerCommand<'container> {
             r,
             "cros/bazel/portage/bin/run_in_container/run_in_container"
         );
-        let status = processes::run(
-            Command::new(run_in_container_path)
-                .arg("--config")
-                .arg(&config_path),
-        )?;
+        // run_in_container reports failures to set up the container to this
+        // file, as the command may exit with the same exit code.
+        let setup_error_path = config_dir.path().join("setup_error");
+        let mut command = Command::new(run_in_container_path);
+        command
+            .arg("--config")
+            .arg(&config_path)
+            .arg("--setup-error-file")
+            .arg(&setup_error_path);
+        if let Some(timeout) = self.container.settings.timeout {
+            command.arg(format!("--timeout={}ms", timeout.as_millis()));
+            if self.container.settings.timeout_dump_stacks {
+                command.arg("--timeout-dump-stacks");
+            }
+        }
+        command.args(self.container.settings.resource_limits.to_args());
+        if self.container.settings.profile_mounts {
+            command.arg("--profile-mounts");
+        }
+        if let Some(path) = &self.container.settings.profile_mounts_json {
+            command.arg("--profile-mounts-json").arg(path);
+        }
+        let status = processes::run_with_observer(&mut command, |event| match event {
+            ProcessEvent::SignalForwarded { pid, signal } => {
+                info!("Forwarded {signal} to run_in_container (pid {pid})");
+            }
+            ProcessEvent::SignalIgnored { pid, signal } => {
+                info!("Not forwarding {signal} to run_in_container (pid {pid})");
+            }
+            ProcessEvent::Started { .. } | ProcessEvent::Exited { .. } => {}
+        })?;
+
+        match std::fs::read_to_string(&setup_error_path) {
+            Ok(message) if !message.is_empty() => {
+                bail!("run_in_container failed before starting the command: {message}")
+            }
+            _ => Ok(status),
+        }
+    }
 
-        Ok(status)
+    /// Runs a process in the container, and fails with [`ContainerError`]
+    /// unless it succeeds.
+    pub fn run(&mut self) -> Result<()> {
+        let status = self.status().context(ContainerError::Setup)?;
+        self.container.check_status(status)
     }
 }
 
@@ -737,6 +1258,7 @@ mod tests {
             mount_path: PathBuf::from("/bin/bash"),
             source: runfiles::rlocation!(r, "files/bash-static"),
             rw: false,
+            propagation: MountPropagation::Private,
         });
         Ok(())
     }
@@ -788,6 +1310,45 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_run_failure() -> Result<()> {
+        let mut settings = ContainerSettings::new();
+        bind_mount_bash(&mut settings)?;
+
+        let mut container = settings.prepare()?;
+
+        let err = container
+            .command("bash")
+            .args(["-c", "exit 28"])
+            .run()
+            .unwrap_err();
+        match err.downcast_ref::<ContainerError>() {
+            Some(ContainerError::Command(status)) => assert_eq!(status.code(), Some(28)),
+            other => panic!("Unexpected error: {other:?}"),
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_run_failure_with_setup_failure_exit_code() -> Result<()> {
+        let mut settings = ContainerSettings::new();
+        bind_mount_bash(&mut settings)?;
+
+        let mut container = settings.prepare()?;
+
+        // The exit code doesn't make the failure a setup failure.
+        let err = container
+            .command("bash")
+            .args(["-c", "exit 125"])
+            .run()
+            .unwrap_err();
+        match err.downcast_ref::<ContainerError>() {
+            Some(ContainerError::Command(status)) => assert_eq!(status.code(), Some(125)),
+            other => panic!("Unexpected error: {other:?}"),
+        }
+        Ok(())
+    }
+
     #[test]
     fn test_current_dir() -> Result<()> {
         let mut settings = ContainerSettings::new();
@@ -874,16 +1435,19 @@ mod tests {
             mount_path: PathBuf::from("/bind1"),
             source: temp_dir.path().to_owned(),
             rw: false,
+            propagation: MountPropagation::Private,
         });
         settings.push_bind_mount(BindMount {
             mount_path: PathBuf::from("/bind2/ok"),
             source: temp_dir.path().join("ok"),
             rw: false,
+            propagation: MountPropagation::Private,
         });
         settings.push_bind_mount(BindMount {
             mount_path: PathBuf::from("/bind3/fifo"),
             source: temp_dir.path().join("fifo"),
             rw: false,
+            propagation: MountPropagation::Private,
         });
 
         let mut container = settings.prepare()?;
@@ -899,6 +1463,43 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_parse_bind_mount() -> Result<()> {
+        let parse = |spec: &str| -> Result<_> {
+            let bind_mount: BindMount = spec.parse()?;
+            Ok((
+                bind_mount.mount_path,
+                bind_mount.source,
+                bind_mount.rw,
+                bind_mount.propagation,
+            ))
+        };
+        assert_eq!(
+            parse("/a=/b")?,
+            ("/a".into(), "/b".into(), false, MountPropagation::Private)
+        );
+        assert_eq!(
+            parse("/a=/b:rw")?,
+            ("/a".into(), "/b".into(), true, MountPropagation::Private)
+        );
+        assert_eq!(
+            parse("/a=/b:ro,slave")?,
+            ("/a".into(), "/b".into(), false, MountPropagation::Slave)
+        );
+        assert_eq!(
+            parse("/a=/b:rw,shared")?,
+            ("/a".into(), "/b".into(), true, MountPropagation::Shared)
+        );
+        // Unknown options are part of the source path.
+        assert_eq!(
+            parse("/a=/b:c")?,
+            ("/a".into(), "/b:c".into(), false, MountPropagation::Private)
+        );
+        assert!(parse("/a").is_err());
+        assert!(parse("/a=/b=/c").is_err());
+        Ok(())
+    }
+
     #[test]
     fn test_bind_mount_read_write() -> Result<()> {
         let mut settings = ContainerSettings::new();
@@ -913,11 +1514,13 @@ mod tests {
             mount_path: PathBuf::from("/bind-ro"),
             source: temp_dir.path().to_owned(),
             rw: false,
+            propagation: MountPropagation::Private,
         });
         settings.push_bind_mount(BindMount {
             mount_path: PathBuf::from("/bind-rw"),
             source: temp_dir.path().to_owned(),
             rw: true,
+            propagation: MountPropagation::Private,
         });
 
         let mut container = settings.prepare()?;
@@ -939,6 +1542,106 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_mask_path() -> Result<()> {
+        let mut settings = ContainerSettings::new();
+        bind_mount_bash(&mut settings)?;
+
+        let temp_dir = SafeTempDir::new()?;
+        std::fs::write(temp_dir.path().join("file"), "secret")?;
+
+        settings.push_bind_mount(BindMount {
+            mount_path: PathBuf::from("/bind"),
+            source: temp_dir.path().to_owned(),
+            rw: false,
+            propagation: MountPropagation::Private,
+        });
+        settings.push_bind_mount(BindMount {
+            mount_path: PathBuf::from("/dir/file"),
+            source: temp_dir.path().join("file"),
+            rw: false,
+            propagation: MountPropagation::Private,
+        });
+        settings.push_mask_path(Path::new("/bind"));
+        settings.push_mask_path(Path::new("/dir/file"));
+        settings.push_mask_path(Path::new("/no/such/file"));
+
+        let mut container = settings.prepare()?;
+        let status = container
+            .command("bash")
+            .args([
+                "-c",
+                "[[ -d /bind ]] && [[ ! -e /bind/file ]] && [[ ! -s /dir/file ]]",
+            ])
+            .status()?;
+        assert!(status.success());
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_shm() -> Result<()> {
+        let mut settings = ContainerSettings::new();
+        bind_mount_bash(&mut settings)?;
+        settings.set_shm_size(Some("1m".to_owned()));
+
+        let mut container = settings.prepare()?;
+
+        // /dev/shm and /dev/mqueue are world-writable sticky directories.
+        let status = container
+            .command("bash")
+            .args([
+                "-c",
+                "[[ -k /dev/shm && -w /dev/shm && -k /dev/mqueue && -w /dev/mqueue ]]",
+            ])
+            .status()?;
+        assert!(status.success());
+
+        // Writing more than the size limit to /dev/shm fails.
+        let status = container
+            .command("bash")
+            .args(["-c", "printf '%2000000s' '' > /dev/shm/large"])
+            .status()?;
+        assert!(!status.success());
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_hostname_and_machine_id() -> Result<()> {
+        const MACHINE_ID: &str = "0123456789abcdef0123456789abcdef";
+
+        let mut settings = ContainerSettings::new();
+        bind_mount_bash(&mut settings)?;
+        let layer_dir = SafeTempDir::new()?;
+        std::fs::create_dir(layer_dir.path().join("etc"))?;
+        settings.push_layer(layer_dir.path())?;
+        settings.set_hostname(Some("test-host".to_owned()));
+        settings.set_machine_id(Some(MACHINE_ID.to_owned()));
+
+        let mut container = settings.prepare()?;
+
+        let status = container
+            .command("bash")
+            .args(["-c", r#"[[ "${HOSTNAME}" == test-host ]]"#])
+            .status()?;
+        assert!(status.success());
+
+        assert_content(&mut container, Path::new("/etc/machine-id"), MACHINE_ID)?;
+
+        // The machine ID is read-only.
+        let status = container
+            .command("bash")
+            .args(["-c", "echo > /etc/machine-id"])
+            .status()?;
+        assert!(!status.success());
+
+        // The mount point doesn't leak into the upper directory.
+        assert!(!container.upper_dir().join("etc/machine-id").exists());
+
+        Ok(())
+    }
+
     #[test]
     fn test_layers() -> Result<()> {
         let mut settings = ContainerSettings::new();
@@ -1010,7 +1713,7 @@ mod tests {
             .success());
 
         // Extract the upper directory and push it as a new lower directory.
-        let upper_dir = container.into_upper_dir();
+        let upper_dir = container.into_upper_dir()?;
         settings.push_layer(&upper_dir)?;
 
         // Run a container, and it should see the new file.
@@ -1051,6 +1754,57 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_lazy_archive_layers() -> Result<()> {
+        if !Path::new("/dev/fuse").exists()
+            || !["fuse-archive", "archivemount"]
+                .iter()
+                .any(|name| processes::locate_system_binary(name).is_ok())
+        {
+            eprintln!("Skipping the test because FUSE is unavailable");
+            return Ok(());
+        }
+
+        let mut settings = ContainerSettings::new();
+        bind_mount_bash(&mut settings)?;
+        settings.set_lazy_archive_layers(true);
+
+        // Create a directory for a directory layer.
+        let layer_dir = create_layer_dir()?;
+
+        let r = runfiles::Runfiles::create()?;
+
+        settings.push_layer(layer_dir.path())?;
+        settings.push_layer(&runfiles::rlocation!(
+            r,
+            "cros/bazel/portage/common/container/testdata/layer-archive.tar.zst"
+        ))?;
+
+        // The archive layer must be mounted with FUSE rather than extracted.
+        assert_eq!(settings.archive_mounts.len(), 1);
+        let mount_dir = settings.lower_dirs.last().unwrap();
+        assert_eq!(
+            statfs(mount_dir)?.filesystem_type(),
+            nix::sys::statfs::FUSE_SUPER_MAGIC
+        );
+
+        assert_content(
+            &mut settings.prepare()?,
+            Path::new("/hello.txt"),
+            "This file is from the archive layer.",
+        )?;
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_layer_backend_from_str() -> Result<()> {
+        assert_eq!(LayerBackend::from_str("extract")?, LayerBackend::Extract);
+        assert_eq!(LayerBackend::from_str("fuse")?, LayerBackend::Fuse);
+        assert!(LayerBackend::from_str("erofs").is_err());
+        Ok(())
+    }
+
     #[test]
     fn test_mount() -> Result<()> {
         let mut settings = ContainerSettings::new();
@@ -1135,6 +1889,23 @@ mod tests {
             interactive: false,
             login: LoginMode::Never,
             keep_host_mount: false,
+            timeout: None,
+            timeout_dump_stacks: false,
+            mask_path: vec![],
+            shm_size: None,
+            device: vec![],
+            hostname: None,
+            machine_id: None,
+            network: None,
+            memory_limit: None,
+            cpu_limit: None,
+            pids_limit: None,
+            profile_mounts: false,
+            profile_mounts_json: None,
+            lazy_archive_layers: false,
+            layer_backend: None,
+            lazy_inputs_manifest: None,
+            lazy_inputs_fetcher: None,
         })?;
 
         assert_content(
@@ -1164,6 +1935,23 @@ mod tests {
             interactive: false,
             login: LoginMode::Never,
             keep_host_mount: false,
+            timeout: None,
+            timeout_dump_stacks: false,
+            mask_path: vec![],
+            shm_size: None,
+            device: vec![],
+            hostname: None,
+            machine_id: None,
+            network: None,
+            memory_limit: None,
+            cpu_limit: None,
+            pids_limit: None,
+            profile_mounts: false,
+            profile_mounts_json: None,
+            lazy_archive_layers: false,
+            layer_backend: None,
+            lazy_inputs_manifest: None,
+            lazy_inputs_fetcher: None,
         })?;
 
         assert_content(&mut settings.prepare()?, Path::new("/hello.txt"), "world")?;
@@ -10,7 +10,17 @@ use nix::{
 };
 use scopeguard::defer;
 use std::os::unix::io::{AsRawFd, RawFd};
-use std::{fs::OpenOptions, io::Read, path::PathBuf};
+use std::{
+    fs::OpenOptions,
+    io::Read,
+    path::PathBuf,
+    sync::{mpsc::Sender, Arc},
+};
+
+use crate::lazy_inputs::LazyInputs;
+
+/// Maximum length of arguments of a control command.
+const MAX_ARGUMENT_LEN: usize = 256;
 
 pub(crate) struct ControlChannel {
     join_handle: Option<std::thread::JoinHandle<()>>,
@@ -32,7 +42,63 @@ impl ControlChannel {
         Ok(())
     }
 
-    fn read_fifo(path: PathBuf, rx: RawFd) -> Result<()> {
+    /// Reads an argument of a control command terminated by a newline.
+    ///
+    /// An invalid argument is consumed up to the newline before returning an
+    /// error so that the next command can be read.
+    fn read_argument(fifo: &mut impl Read) -> Result<String> {
+        let mut arg = Vec::new();
+        let mut too_long = false;
+        loop {
+            let mut buf: [u8; 1] = [0];
+            fifo.read_exact(&mut buf)?;
+            if buf[0] == b'\n' {
+                break;
+            }
+            if arg.len() >= MAX_ARGUMENT_LEN {
+                too_long = true;
+                continue;
+            }
+            arg.push(buf[0]);
+        }
+        if too_long {
+            bail!("Control command argument too long");
+        }
+        Ok(String::from_utf8(arg)?)
+    }
+
+    fn fetch_lazy_input(lazy_inputs: Option<&LazyInputs>, digest: &str) {
+        let Some(lazy_inputs) = lazy_inputs else {
+            eprintln!("Lazy input {digest} requested, but lazy inputs are not enabled");
+            return;
+        };
+        // Errors are reported to the requester via the spool directory, so
+        // don't stop the control channel.
+        if let Err(e) = lazy_inputs.materialize(digest) {
+            eprintln!("Failed to fetch lazy input {digest}: {e:#}");
+        }
+    }
+
+    fn read_fifo(path: PathBuf, rx: RawFd, lazy_inputs: Option<Arc<LazyInputs>>) -> Result<()> {
+        // Fetch lazy inputs on a worker thread so that a slow fetch doesn't
+        // block other control commands. Requests are processed one by one, so
+        // a digest requested twice is fetched only once.
+        let (fetch_tx, fetch_rx) = std::sync::mpsc::channel::<String>();
+        let worker = std::thread::spawn(move || {
+            for digest in fetch_rx {
+                Self::fetch_lazy_input(lazy_inputs.as_deref(), &digest);
+            }
+        });
+
+        let result = Self::serve_fifo(path, rx, &fetch_tx);
+
+        // Wait for pending fetches so that the spool directory outlives them.
+        drop(fetch_tx);
+        worker.join().unwrap();
+        result
+    }
+
+    fn serve_fifo(path: PathBuf, rx: RawFd, fetch_tx: &Sender<String>) -> Result<()> {
         // We open RDWR so that we always keep a write handle to the FIFO. This
         // makes the open call not block waiting for a writer to open the FIFO. It
         // also allows writers to open/close the FIFO without causing the reader (us)
@@ -56,7 +122,13 @@ impl ControlChannel {
                 match buf[0] as char {
                     't' => ControlChannel::reset_controlling_terminal()
                         .with_context(|| "Failed to update terminal pgid")?,
-                    c => bail!("Unknown control command: {c}"),
+                    'f' => match Self::read_argument(&mut fifo) {
+                        Ok(digest) => fetch_tx.send(digest)?,
+                        // A malformed request only fails the requester, who
+                        // times out waiting for the input.
+                        Err(e) => eprintln!("Invalid lazy input request: {e:#}"),
+                    },
+                    c => eprintln!("Unknown control command: {c}"),
                 }
             }
 
@@ -67,12 +139,14 @@ impl ControlChannel {
         }
     }
 
-    pub fn new(path: PathBuf) -> Result<Self> {
+    /// Starts a control channel at `path`. Requests of lazy inputs are served
+    /// from `lazy_inputs` if set.
+    pub fn new(path: PathBuf, lazy_inputs: Option<Arc<LazyInputs>>) -> Result<Self> {
         nix::unistd::mkfifo(&path, nix::sys::stat::Mode::from_bits(0o666).unwrap())?;
         let (tx, rx) = nix::unistd::pipe()?;
         Ok(Self {
             join_handle: Some(std::thread::spawn(move || {
-                if let Err(e) = Self::read_fifo(path, rx) {
+                if let Err(e) = Self::read_fifo(path, rx, lazy_inputs) {
                     eprintln!("Failed to read fifo: {e}");
                 }
             })),
@@ -100,7 +174,7 @@ mod tests {
     pub fn creates_control_channel() -> Result<()> {
         let tmp_dir = SafeTempDir::new()?;
         let path = tmp_dir.path().join("control");
-        let _control = ControlChannel::new(path.clone())?;
+        let _control = ControlChannel::new(path.clone(), None)?;
         assert!(path.try_exists()?);
         std::thread::sleep(Duration::from_millis(50));
         std::fs::write(&path, "t")?;
@@ -108,4 +182,30 @@ mod tests {
 
         Ok(())
     }
+
+    #[test]
+    pub fn fetches_lazy_input() -> Result<()> {
+        let tmp_dir = SafeTempDir::new()?;
+        std::fs::write(tmp_dir.path().join("hello.txt"), "hello\n")?;
+        let digest = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03";
+        let mut lazy_inputs = LazyInputs::new(tmp_dir.path())?;
+        lazy_inputs.insert_file(digest, &tmp_dir.path().join("hello.txt"))?;
+        let lazy_inputs = Arc::new(lazy_inputs);
+
+        let path = tmp_dir.path().join("control");
+        let control = ControlChannel::new(path.clone(), Some(lazy_inputs.clone()))?;
+        std::thread::sleep(Duration::from_millis(50));
+        // A malformed request must not stop serving later ones.
+        std::fs::write(
+            &path,
+            format!("f{}\nxf{digest}\nf{}\n", "a".repeat(1000), "0".repeat(64)),
+        )?;
+        std::thread::sleep(Duration::from_millis(50));
+        drop(control);
+
+        let spool_dir = lazy_inputs.spool_dir();
+        assert_eq!(std::fs::read_to_string(spool_dir.join(digest))?, "hello\n");
+        assert!(spool_dir.join(format!("{}.error", "0".repeat(64))).exists());
+        Ok(())
+    }
 }
@@ -0,0 +1,297 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use fileutil::path_glob_match;
+use std::path::Path;
+
+/// Whether a rule of [`DiffFilter`] keeps or removes matching paths.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum RuleKind {
+    Include,
+    Exclude,
+}
+
+/// A rule of [`DiffFilter`].
+#[derive(Clone, Debug, PartialEq, Eq)]
+struct Rule {
+    kind: RuleKind,
+    /// The pattern without a leading and trailing slash.
+    pattern: String,
+    /// Whether the pattern is matched against the whole path from the root
+    /// rather than trailing path components.
+    anchored: bool,
+    /// Whether the rule matches directories only.
+    dir_only: bool,
+}
+
+impl Rule {
+    fn parse(kind: RuleKind, pattern: &str) -> Result<Self> {
+        let (pattern, dir_only) = match pattern.strip_suffix('/') {
+            Some(pattern) => (pattern, true),
+            None => (pattern, false),
+        };
+        let (pattern, anchored) = match pattern.strip_prefix('/') {
+            Some(pattern) => (pattern, true),
+            None => (pattern, false),
+        };
+        if pattern.is_empty() {
+            bail!("Empty pattern");
+        }
+        Ok(Self {
+            kind,
+            pattern: pattern.to_owned(),
+            anchored,
+            dir_only,
+        })
+    }
+
+    /// Returns whether the rule matches a path relative to the root.
+    fn matches(&self, path: &str, is_dir: bool) -> bool {
+        if self.dir_only && !is_dir {
+            return false;
+        }
+        if self.anchored {
+            return path_glob_match(self.pattern.as_bytes(), path.as_bytes());
+        }
+        // Try matching against trailing components, e.g. "b/c" and "c" for
+        // "a/b/c".
+        std::iter::once(0)
+            .chain(path.match_indices('/').map(|(i, _)| i + 1))
+            .any(|start| path_glob_match(self.pattern.as_bytes(), path[start..].as_bytes()))
+    }
+}
+
+/// Include/exclude rules applied to the upper directory of a container to
+/// drop changes that should not be part of its output, such as temporary
+/// files and logs.
+///
+/// Rules are written one per line in a subset of the rsync filter rule
+/// syntax:
+///
+/// - `- PATTERN` excludes matching paths, and `+ PATTERN` includes them.
+///   A line without a prefix is an exclude rule.
+/// - A pattern starting with `/` is matched against the path from the root
+///   of the directory. Other patterns are matched against trailing path
+///   components, e.g. `log/*.txt` matches `var/log/a.txt`.
+/// - A pattern ending with `/` matches directories only.
+/// - `*`, `?` and bracket expressions match any characters except `/`, and
+///   `**` matches any characters including `/`.
+/// - Empty lines and lines starting with `#` are ignored.
+///
+/// For each path, the first matching rule wins, and paths not matching any
+/// rule are kept. Like rsync, an excluded directory is removed as a whole,
+/// so an include rule can't keep paths under it.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct DiffFilter {
+    rules: Vec<Rule>,
+}
+
+impl DiffFilter {
+    /// Creates an empty [`DiffFilter`] that keeps all paths.
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Parses rules. See [`DiffFilter`] for the syntax.
+    pub fn parse(contents: &str) -> Result<Self> {
+        let mut rules = Vec::new();
+        for (index, line) in contents.lines().enumerate() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (kind, pattern) = if let Some(pattern) = line.strip_prefix("+ ") {
+                (RuleKind::Include, pattern)
+            } else if let Some(pattern) = line.strip_prefix("- ") {
+                (RuleKind::Exclude, pattern)
+            } else {
+                (RuleKind::Exclude, line)
+            };
+            rules.push(
+                Rule::parse(kind, pattern.trim())
+                    .with_context(|| format!("Invalid rule at line {}: {line}", index + 1))?,
+            );
+        }
+        Ok(Self { rules })
+    }
+
+    /// Loads rules from a file. See [`DiffFilter`] for the syntax.
+    pub fn load(path: &Path) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse(&contents).with_context(|| format!("Failed to parse {}", path.display()))
+    }
+
+    /// Returns whether a path relative to the root is excluded.
+    fn is_excluded(&self, path: &str, is_dir: bool) -> bool {
+        self.rules
+            .iter()
+            .find(|rule| rule.matches(path, is_dir))
+            .is_some_and(|rule| rule.kind == RuleKind::Exclude)
+    }
+
+    /// Removes paths excluded by the rules under `root`.
+    pub fn apply(&self, root: &Path) -> Result<()> {
+        if self.rules.is_empty() {
+            return Ok(());
+        }
+        self.apply_dir(root, "")
+    }
+
+    fn apply_dir(&self, dir: &Path, rel_dir: &str) -> Result<()> {
+        for entry in std::fs::read_dir(dir).with_context(|| format!("Failed to read {dir:?}"))? {
+            let entry = entry?;
+            let path = entry.path();
+            let Some(name) = entry.file_name().to_str().map(|name| name.to_owned()) else {
+                // Keep non-UTF-8 file names since patterns can't name them.
+                continue;
+            };
+            let rel_path = if rel_dir.is_empty() {
+                name
+            } else {
+                format!("{rel_dir}/{name}")
+            };
+            let is_dir = entry.file_type()?.is_dir();
+
+            if self.is_excluded(&rel_path, is_dir) {
+                if is_dir {
+                    fileutil::remove_dir_all_with_chmod(&path)?;
+                } else {
+                    fileutil::remove_file_with_chmod(&path)?;
+                }
+            } else if is_dir {
+                self.apply_dir(&path, &rel_path)?;
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use fileutil::SafeTempDir;
+    use std::path::PathBuf;
+    use walkdir::WalkDir;
+
+    #[test]
+    fn test_rule_matches() -> Result<()> {
+        let rule = Rule::parse(RuleKind::Exclude, "/var/log/")?;
+        assert!(rule.matches("var/log", true));
+        assert!(!rule.matches("var/log", false));
+        assert!(!rule.matches("build/foo/var/log", true));
+
+        let rule = Rule::parse(RuleKind::Exclude, "var/log")?;
+        assert!(rule.matches("var/log", true));
+        assert!(rule.matches("build/foo/var/log", false));
+        assert!(!rule.matches("var/logs", true));
+
+        let rule = Rule::parse(RuleKind::Exclude, "*.pyc")?;
+        assert!(rule.matches("usr/lib64/foo.pyc", false));
+        assert!(!rule.matches("usr/lib64/foo.py", false));
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse() -> Result<()> {
+        let filter = DiffFilter::parse(
+            r#"
+            # Comment
+            + /var/log/keep
+            - /var/log/
+            tmp
+            "#,
+        )?;
+        assert_eq!(
+            filter.rules,
+            vec![
+                Rule {
+                    kind: RuleKind::Include,
+                    pattern: "var/log/keep".to_owned(),
+                    anchored: true,
+                    dir_only: false,
+                },
+                Rule {
+                    kind: RuleKind::Exclude,
+                    pattern: "var/log".to_owned(),
+                    anchored: true,
+                    dir_only: true,
+                },
+                Rule {
+                    kind: RuleKind::Exclude,
+                    pattern: "tmp".to_owned(),
+                    anchored: false,
+                    dir_only: false,
+                },
+            ]
+        );
+
+        assert!(DiffFilter::parse("- /").is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_apply() -> Result<()> {
+        let root = SafeTempDir::new()?;
+        let root = root.path();
+
+        for dir in [
+            "build/foo/tmp",
+            "tmp",
+            "usr/bin",
+            "var/cache/edb",
+            "var/log",
+        ] {
+            std::fs::create_dir_all(root.join(dir))?;
+        }
+        for file in [
+            "build/foo/tmp/a",
+            "tmp/a",
+            "usr/bin/foo",
+            "usr/bin/foo.pyc",
+            "var/cache/edb/counter",
+            "var/cache/other",
+            "var/log/emerge.log",
+        ] {
+            std::fs::write(root.join(file), "")?;
+        }
+
+        let filter = DiffFilter::parse(
+            r#"
+            + /var/cache/edb/
+            - /var/cache/*
+            - /var/log/
+            - tmp/
+            - *.pyc
+            "#,
+        )?;
+        filter.apply(root)?;
+
+        let paths: Vec<PathBuf> = WalkDir::new(root)
+            .min_depth(1)
+            .sort_by_file_name()
+            .into_iter()
+            .map(|entry| Ok(entry?.path().strip_prefix(root)?.to_path_buf()))
+            .collect::<Result<_>>()?;
+        assert_eq!(
+            paths,
+            vec![
+                PathBuf::from("build"),
+                PathBuf::from("build/foo"),
+                PathBuf::from("usr"),
+                PathBuf::from("usr/bin"),
+                PathBuf::from("usr/bin/foo"),
+                PathBuf::from("var"),
+                PathBuf::from("var/cache"),
+                PathBuf::from("var/cache/edb"),
+                PathBuf::from("var/cache/edb/counter"),
+            ]
+        );
+
+        Ok(())
+    }
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    fmt::{Display, Formatter},
+    os::unix::process::ExitStatusExt,
+    process::{ExitCode, ExitStatus},
+    time::Duration,
+};
+
+use anyhow::Result;
+use nix::sys::signal::Signal;
+use run_in_container_lib::{SETUP_FAILURE_EXIT_CODE, TIMEOUT_EXIT_CODE};
+
+/// An error in running a command in a container.
+///
+/// It tells infrastructure failures, i.e. [`ContainerError::Setup`] and
+/// [`ContainerError::Timeout`], from failures of the command itself so that
+/// callers can decide e.g. whether to retry.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum ContainerError {
+    /// Failed to set up the container, so the command didn't run. It is used
+    /// as the context of the error describing the cause.
+    Setup,
+    /// The command exited with a non-zero exit code or was killed by a signal.
+    Command(ExitStatus),
+    /// The command was terminated due to the timeout.
+    Timeout(Duration),
+}
+
+impl ContainerError {
+    /// Classifies the exit status of a command run by run_in_container.
+    /// Returns `None` if the command succeeded.
+    ///
+    /// `timeout` is the timeout the command ran with. Without it, the exit
+    /// code of timeout(1) is considered to come from the command. Setup
+    /// failures are not told from exit codes, as the command may exit with
+    /// any code; [`crate::ContainerCommand::status`] reports them as errors.
+    pub fn from_status(status: ExitStatus, timeout: Option<Duration>) -> Option<Self> {
+        if status.success() {
+            return None;
+        }
+        Some(match (status.code(), timeout) {
+            (Some(code), Some(timeout)) if code == i32::from(TIMEOUT_EXIT_CODE) => {
+                Self::Timeout(timeout)
+            }
+            _ => Self::Command(status),
+        })
+    }
+
+    /// Returns the exit code for a program to exit with on the error.
+    ///
+    /// Infrastructure failures keep the exit codes of run_in_container, and
+    /// failures of the command are reported as general failures.
+    pub fn exit_code(&self) -> ExitCode {
+        match self {
+            Self::Setup => ExitCode::from(SETUP_FAILURE_EXIT_CODE),
+            Self::Command(_) => ExitCode::FAILURE,
+            Self::Timeout(_) => ExitCode::from(TIMEOUT_EXIT_CODE),
+        }
+    }
+}
+
+impl Display for ContainerError {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Setup => write!(f, "Failed to set up the container"),
+            Self::Command(status) => match (status.code(), status.signal()) {
+                (Some(code), _) => write!(f, "Command exited with code {code}"),
+                (None, Some(signal)) => match Signal::try_from(signal) {
+                    Ok(signal) => write!(f, "Command was killed by {signal}"),
+                    Err(_) => write!(f, "Command was killed by signal {signal}"),
+                },
+                (None, None) => write!(f, "Command failed with {status}"),
+            },
+            Self::Timeout(timeout) => write!(f, "Command timed out after {timeout:?}"),
+        }
+    }
+}
+
+impl std::error::Error for ContainerError {}
+
+/// Handles the result of the main function of a program that runs commands in
+/// containers.
+///
+/// If the error is caused by [`ContainerError`], it is reported and the exit
+/// code for it is returned. Other errors are returned as is.
+pub fn exit_on_container_error(result: Result<()>) -> Result<ExitCode> {
+    match result {
+        Ok(()) => Ok(ExitCode::SUCCESS),
+        Err(err) => match err.downcast_ref::<ContainerError>() {
+            Some(container_err) => {
+                eprintln!("FATAL: {err:?}");
+                Ok(container_err.exit_code())
+            }
+            None => Err(err),
+        },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use anyhow::Context;
+
+    use super::*;
+
+    fn exited(code: i32) -> ExitStatus {
+        ExitStatus::from_raw(code << 8)
+    }
+
+    #[test]
+    fn test_from_status() {
+        let timeout = Some(Duration::from_secs(60));
+        assert_eq!(ContainerError::from_status(exited(0), timeout), None);
+        assert_eq!(
+            ContainerError::from_status(exited(1), timeout),
+            Some(ContainerError::Command(exited(1)))
+        );
+        // The command may exit with the exit code of setup failures.
+        assert_eq!(
+            ContainerError::from_status(exited(125), timeout),
+            Some(ContainerError::Command(exited(125)))
+        );
+        assert_eq!(
+            ContainerError::from_status(exited(124), timeout),
+            Some(ContainerError::Timeout(Duration::from_secs(60)))
+        );
+        assert_eq!(
+            ContainerError::from_status(exited(124), None),
+            Some(ContainerError::Command(exited(124)))
+        );
+        assert_eq!(
+            ContainerError::from_status(ExitStatus::from_raw(9), timeout),
+            Some(ContainerError::Command(ExitStatus::from_raw(9)))
+        );
+    }
+
+    #[test]
+    fn test_display() {
+        assert_eq!(
+            ContainerError::Command(exited(3)).to_string(),
+            "Command exited with code 3"
+        );
+        assert_eq!(
+            ContainerError::Command(ExitStatus::from_raw(9)).to_string(),
+            "Command was killed by SIGKILL"
+        );
+        assert_eq!(
+            ContainerError::Timeout(Duration::from_secs(60)).to_string(),
+            "Command timed out after 60s"
+        );
+    }
+
+    #[test]
+    fn test_exit_on_container_error() -> Result<()> {
+        let result: Result<()> = Err(ContainerError::Setup).context("Failed to build");
+        assert_eq!(
+            format!("{:?}", exit_on_container_error(result)?),
+            format!("{:?}", ExitCode::from(125))
+        );
+
+        let result: Result<()> = Err(anyhow::anyhow!("Something went wrong"));
+        assert!(exit_on_container_error(result).is_err());
+        Ok(())
+    }
+}
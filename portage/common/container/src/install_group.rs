@@ -10,7 +10,7 @@ use std::ffi::OsString;
 use std::path::{Path, PathBuf};
 use std::str::FromStr;
 
-use crate::BindMount;
+use crate::{BindMount, MountPropagation};
 
 #[derive(Debug, Clone)]
 pub struct InstallGroup {
@@ -39,6 +39,7 @@ impl InstallGroup {
                 source: package,
                 mount_path: dir.join(format!("{category_pf}.tbz2")),
                 rw: false,
+                propagation: MountPropagation::Private,
             });
             atoms.push(format!("={category_pf}"));
         }
@@ -0,0 +1,237 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use std::{
+    collections::BTreeMap,
+    fs::File,
+    io::ErrorKind,
+    path::{Path, PathBuf},
+    process::Command,
+};
+
+use anyhow::{bail, ensure, Context, Result};
+use fileutil::{SafeTempDir, SafeTempDirBuilder};
+use sha2::{Digest, Sha256};
+
+/// The directory in the container where lazy inputs appear once fetched.
+pub const LAZY_INPUTS_MOUNT_PATH: &str = "/mnt/lazy_inputs";
+
+/// Serves large optional inputs, such as test data and debug symbols, to
+/// containers on request instead of mounting them upfront.
+///
+/// Processes in the container request an input by its SHA-256 digest through
+/// the control channel, e.g. with `/.fetch_lazy_input.sh`. The host then
+/// fetches the file into a spool directory that is bind-mounted read-only at
+/// [`LAZY_INPUTS_MOUNT_PATH`], so the container never needs network access.
+///
+/// A fetched input appears as `<digest>` in the spool directory. If fetching
+/// fails, `<digest>.error` containing the error message appears instead.
+pub struct LazyInputs {
+    /// Inputs available on the host file system, keyed by their digests.
+    files: BTreeMap<String, PathBuf>,
+    /// A program to fetch inputs missing in `files`, e.g. from a remote
+    /// content-addressed store. It is invoked as `<fetcher> <digest> <output>`.
+    fetcher: Option<PathBuf>,
+    spool_dir: SafeTempDir,
+}
+
+/// Returns whether a string is a hex-encoded SHA-256 digest.
+fn is_valid_digest(digest: &str) -> bool {
+    digest.len() == 64
+        && digest
+            .chars()
+            .all(|c| c.is_ascii_digit() || ('a'..='f').contains(&c))
+}
+
+fn hash_file(path: &Path) -> Result<String> {
+    let mut file =
+        File::open(path).with_context(|| format!("Failed to open {}", path.display()))?;
+    let mut hasher = Sha256::new();
+    std::io::copy(&mut file, &mut hasher)?;
+    Ok(hex::encode(hasher.finalize()))
+}
+
+impl LazyInputs {
+    /// Creates a [`LazyInputs`] with an empty spool directory under
+    /// `base_dir`.
+    pub fn new(base_dir: &Path) -> Result<Self> {
+        Ok(Self {
+            files: BTreeMap::new(),
+            fetcher: None,
+            spool_dir: SafeTempDirBuilder::new()
+                .base_dir(base_dir)
+                .prefix("lazy_inputs.")
+                .build()?,
+        })
+    }
+
+    /// Makes a file on the host file system available as a lazy input.
+    pub fn insert_file(&mut self, digest: &str, path: &Path) -> Result<()> {
+        ensure!(is_valid_digest(digest), "Invalid SHA-256 digest: {digest}");
+        self.files.insert(digest.to_owned(), path.to_owned());
+        Ok(())
+    }
+
+    /// Loads a manifest of lazy inputs in the output format of `sha256sum`,
+    /// i.e. lines of a digest and a file path separated by whitespace.
+    /// Relative paths are resolved against the directory of the manifest.
+    pub fn load_manifest(&mut self, path: &Path) -> Result<()> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        let base_dir = path.parent().unwrap_or(Path::new(""));
+        for (i, line) in contents.lines().enumerate() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let Some((digest, file)) = line.split_once(char::is_whitespace) else {
+                bail!("{}:{}: Malformed line: {line}", path.display(), i + 1);
+            };
+            // sha256sum marks files read in binary mode with '*'.
+            let file = file.trim_start().trim_start_matches('*');
+            self.insert_file(digest, &base_dir.join(file))
+                .with_context(|| format!("{}:{}", path.display(), i + 1))?;
+        }
+        Ok(())
+    }
+
+    /// Sets a program to fetch inputs that are not listed in manifests.
+    pub fn set_fetcher(&mut self, fetcher: &Path) {
+        self.fetcher = Some(fetcher.to_owned());
+    }
+
+    /// Returns the spool directory on the host.
+    pub fn spool_dir(&self) -> &Path {
+        self.spool_dir.path()
+    }
+
+    /// Fetches an input into the spool directory if it is not there yet, and
+    /// returns its path on the host.
+    ///
+    /// On failure, the error is also recorded in the spool directory so that
+    /// the requesting process can report it.
+    pub fn materialize(&self, digest: &str) -> Result<PathBuf> {
+        ensure!(is_valid_digest(digest), "Invalid SHA-256 digest: {digest}");
+
+        let path = self.spool_dir().join(digest);
+        if path.try_exists()? {
+            return Ok(path);
+        }
+
+        let result = self.fetch(digest, &path);
+        if let Err(err) = &result {
+            // Write the error atomically so that the requester never reads a
+            // partial message.
+            let temp_path = self.spool_dir().join(format!(".{digest}.error.tmp"));
+            std::fs::write(&temp_path, format!("{err:#}\n"))?;
+            std::fs::rename(&temp_path, self.spool_dir().join(format!("{digest}.error")))?;
+        }
+        result.map(|()| path)
+    }
+
+    fn fetch(&self, digest: &str, path: &Path) -> Result<()> {
+        // Fetch to a temporary file first so that partially fetched inputs are
+        // never visible to the container.
+        let temp_path = self.spool_dir().join(format!(".{digest}.tmp"));
+        if let Some(source) = self.files.get(digest) {
+            std::fs::copy(source, &temp_path)
+                .with_context(|| format!("Failed to copy {}", source.display()))?;
+        } else if let Some(fetcher) = &self.fetcher {
+            let status = Command::new(fetcher)
+                .arg(digest)
+                .arg(&temp_path)
+                .status()
+                .with_context(|| format!("Failed to run {}", fetcher.display()))?;
+            if !status.success() {
+                let _ = std::fs::remove_file(&temp_path);
+                bail!("{} failed for {digest}: {status}", fetcher.display());
+            }
+        } else {
+            bail!("Unknown lazy input: {digest}");
+        }
+
+        let actual_digest = hash_file(&temp_path)?;
+        if actual_digest != digest {
+            std::fs::remove_file(&temp_path)?;
+            bail!("Digest mismatch: requested {digest}, but fetched {actual_digest}");
+        }
+        std::fs::rename(&temp_path, path)?;
+        // Drop the error of an earlier failed attempt, if any.
+        match std::fs::remove_file(self.spool_dir().join(format!("{digest}.error"))) {
+            Err(e) if e.kind() != ErrorKind::NotFound => return Err(e.into()),
+            _ => {}
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::os::unix::fs::PermissionsExt;
+
+    use fileutil::SafeTempDir;
+
+    use super::*;
+
+    const HELLO_DIGEST: &str = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03";
+
+    #[test]
+    fn test_materialize_from_manifest() -> Result<()> {
+        let temp_dir = SafeTempDir::new()?;
+        std::fs::write(temp_dir.path().join("hello.txt"), "hello\n")?;
+        let manifest_path = temp_dir.path().join("manifest.txt");
+        std::fs::write(&manifest_path, format!("{HELLO_DIGEST}  hello.txt\n"))?;
+
+        let mut lazy_inputs = LazyInputs::new(temp_dir.path())?;
+        lazy_inputs.load_manifest(&manifest_path)?;
+
+        let path = lazy_inputs.materialize(HELLO_DIGEST)?;
+        assert_eq!(path, lazy_inputs.spool_dir().join(HELLO_DIGEST));
+        assert_eq!(std::fs::read_to_string(&path)?, "hello\n");
+
+        // Materializing again is a no-op.
+        assert_eq!(lazy_inputs.materialize(HELLO_DIGEST)?, path);
+        Ok(())
+    }
+
+    #[test]
+    fn test_materialize_with_fetcher() -> Result<()> {
+        let temp_dir = SafeTempDir::new()?;
+        let fetcher = temp_dir.path().join("fetcher.sh");
+        std::fs::write(&fetcher, "#!/bin/sh\necho hello > \"$2\"\n")?;
+        std::fs::set_permissions(&fetcher, PermissionsExt::from_mode(0o755))?;
+
+        let mut lazy_inputs = LazyInputs::new(temp_dir.path())?;
+        lazy_inputs.set_fetcher(&fetcher);
+
+        let path = lazy_inputs.materialize(HELLO_DIGEST)?;
+        assert_eq!(std::fs::read_to_string(path)?, "hello\n");
+
+        // The fetcher returns wrong contents for other digests.
+        let digest = "0".repeat(64);
+        let err = lazy_inputs.materialize(&digest).unwrap_err();
+        assert!(format!("{err:#}").contains("Digest mismatch"), "{err:#}");
+        assert!(!lazy_inputs.spool_dir().join(&digest).exists());
+        assert!(lazy_inputs
+            .spool_dir()
+            .join(format!("{digest}.error"))
+            .exists());
+        Ok(())
+    }
+
+    #[test]
+    fn test_materialize_unknown() -> Result<()> {
+        let temp_dir = SafeTempDir::new()?;
+        let lazy_inputs = LazyInputs::new(temp_dir.path())?;
+
+        let digest = "0".repeat(64);
+        assert!(lazy_inputs.materialize(&digest).is_err());
+        let error =
+            std::fs::read_to_string(lazy_inputs.spool_dir().join(format!("{digest}.error")))?;
+        assert_eq!(error, format!("Unknown lazy input: {digest}\n"));
+
+        assert!(lazy_inputs.materialize("../etc/passwd").is_err());
+        Ok(())
+    }
+}
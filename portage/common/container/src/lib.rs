@@ -5,14 +5,22 @@
 mod clean_layer;
 mod container;
 mod control;
+mod diff_filter;
+mod error;
 mod install_group;
+mod lazy_inputs;
 mod mounts;
 mod namespace;
+mod split_layer;
 
 pub use clean_layer::*;
 pub use container::*;
+pub use diff_filter::*;
+pub use error::*;
 pub use install_group::*;
+pub use lazy_inputs::*;
 pub use namespace::*;
+pub use split_layer::*;
 
 // Run unit tests in a mount namespace.
 #[cfg(test)]
@@ -77,6 +77,58 @@ pub(crate) fn bind_mount(old_dir: &Path, new_dir: &Path) -> Result<MountGuard> {
     Ok(MountGuard::new(new_dir))
 }
 
+/// FUSE file systems that can mount tarballs read-only, with the arguments to
+/// pass before the archive path and the mount point.
+const ARCHIVE_MOUNTERS: &[(&str, &[&str])] =
+    &[("fuse-archive", &[]), ("archivemount", &["-o", "readonly"])];
+
+/// Mounts a tarball read-only at `mount_dir` with a FUSE file system found on
+/// the system, so that its contents are read lazily instead of extracted.
+///
+/// Returns `Ok(None)` if no FUSE file system to mount tarballs is installed.
+pub(crate) fn mount_archive(archive: &Path, mount_dir: &Path) -> Result<Option<MountGuard>> {
+    let Some((path, args)) = ARCHIVE_MOUNTERS.iter().find_map(|(name, args)| {
+        processes::locate_system_binary(name)
+            .ok()
+            .map(|path| (path, args))
+    }) else {
+        return Ok(None);
+    };
+
+    let _span = info_span!("mount_archive", ?archive).entered();
+
+    // The FUSE daemon detaches itself once the file system is mounted, and
+    // exits when it is unmounted.
+    let status = Command::new(&path)
+        .args(args.iter())
+        .arg(archive)
+        .arg(mount_dir)
+        .status()
+        .with_context(|| format!("Failed to run {}", path.display()))?;
+    ensure!(
+        status.success(),
+        "Failed to mount {} with {}: {:?}",
+        archive.display(),
+        path.display(),
+        status
+    );
+    Ok(Some(MountGuard::new(mount_dir)))
+}
+
+/// Makes a mount point shared, i.e. a member of a peer group that propagates
+/// mount events.
+pub(crate) fn make_shared(path: &Path) -> Result<()> {
+    mount(
+        None::<&str>,
+        path,
+        None::<&str>,
+        MsFlags::MS_SHARED,
+        None::<&str>,
+    )
+    .with_context(|| format!("Failed to make {} shared", path.display()))?;
+    Ok(())
+}
+
 pub(crate) fn remount_readonly(path: &Path) -> Result<()> {
     let mut flags = MsFlags::MS_REMOUNT | MsFlags::MS_BIND | MsFlags::MS_RDONLY;
 
@@ -2,13 +2,54 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::{ensure, Context, Result};
+use anyhow::{bail, ensure, Context, Result};
 use nix::{
     errno::Errno,
     mount::{mount, MsFlags},
     sched::{unshare, CloneFlags},
-    unistd::{getgid, getuid},
+    sys::wait::{waitpid, WaitStatus},
+    unistd::{fork, getgid, getpid, getuid, pipe, ForkResult, Pid},
 };
+use std::{
+    fs::File,
+    io::{Read, Write},
+    os::fd::FromRawFd,
+    process::Command,
+    str::FromStr,
+};
+
+/// A range of user or group IDs mapped into a user namespace, see
+/// user_namespaces(7).
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct IdMap {
+    /// The first ID in the user namespace.
+    pub inside: u32,
+    /// The first ID outside of the user namespace.
+    pub outside: u32,
+    /// The number of IDs to map.
+    pub count: u32,
+}
+
+impl FromStr for IdMap {
+    type Err = anyhow::Error;
+
+    /// Parses an ID map spec in the form of `<inside>:<outside>:<count>`.
+    fn from_str(spec: &str) -> Result<Self> {
+        let v: Vec<_> = spec.split(':').collect();
+        ensure!(v.len() == 3, "Invalid ID map spec: {:?}", spec);
+        let parse = |s: &str| -> Result<u32> {
+            s.parse()
+                .with_context(|| format!("Invalid ID map spec: {:?}", spec))
+        };
+        let map = Self {
+            inside: parse(v[0])?,
+            outside: parse(v[1])?,
+            count: parse(v[2])?,
+        };
+        ensure!(map.count > 0, "Invalid ID map spec: {:?}", spec);
+        Ok(map)
+    }
+}
 
 fn ensure_single_threaded() -> Result<()> {
     let entries: Vec<_> = std::fs::read_dir("/proc/self/task")?.collect::<std::io::Result<_>>()?;
@@ -16,7 +57,101 @@ fn ensure_single_threaded() -> Result<()> {
     Ok(())
 }
 
-fn enter_unprivileged_user_namespace() -> Result<()> {
+/// Runs newuidmap(1) and newgidmap(1) to set up ID mappings of the user
+/// namespace of the process `pid`. A helper is run only if its map list is
+/// non-empty.
+fn run_id_map_helpers(pid: Pid, uid_maps: &[IdMap], gid_maps: &[IdMap]) -> Result<()> {
+    for (helper, maps) in [("newuidmap", uid_maps), ("newgidmap", gid_maps)] {
+        if maps.is_empty() {
+            continue;
+        }
+        let mut command = Command::new(helper);
+        command.arg(pid.to_string());
+        for map in maps {
+            command.args([
+                map.inside.to_string(),
+                map.outside.to_string(),
+                map.count.to_string(),
+            ]);
+        }
+        let status = command
+            .status()
+            .with_context(|| format!("Failed to run {helper}; is it installed?"))?;
+        ensure!(status.success(), "{helper} failed: {status}");
+    }
+    Ok(())
+}
+
+/// Enters a new user namespace whose ID mappings are set up by the setuid
+/// helpers newuidmap(1) and newgidmap(1), which allow mapping subordinate IDs
+/// listed in /etc/subuid and /etc/subgid.
+///
+/// The helpers must be run from the parent user namespace, so we fork a child
+/// process before entering the new one and let it run the helpers for us. If
+/// one of the map lists is empty, the current user or group is mapped to root
+/// as usual instead.
+fn enter_user_namespace_with_helpers(uid_maps: &[IdMap], gid_maps: &[IdMap]) -> Result<()> {
+    let pid = getpid();
+    let uid = getuid();
+    let gid = getgid();
+    let (reader, writer) = pipe().context("pipe failed")?;
+    let (mut reader, mut writer) =
+        unsafe { (File::from_raw_fd(reader), File::from_raw_fd(writer)) };
+
+    // It is safe to fork since the current process is single-threaded.
+    match unsafe { fork() }.context("fork failed")? {
+        ForkResult::Child => {
+            drop(writer);
+            // Wait for the parent process to enter a new user namespace. If it
+            // fails, the pipe is closed without any data.
+            let mut buf = [0u8];
+            let result = match reader.read(&mut buf) {
+                Ok(1) => run_id_map_helpers(pid, uid_maps, gid_maps),
+                _ => Err(anyhow::anyhow!("The parent process did not unshare")),
+            };
+            let code = match result {
+                Ok(()) => 0,
+                Err(e) => {
+                    eprintln!("ERROR: {e:?}");
+                    1
+                }
+            };
+            std::process::exit(code);
+        }
+        ForkResult::Parent { child } => {
+            drop(reader);
+            let result = unshare(CloneFlags::CLONE_NEWUSER)
+                .context("Failed to create an unprivileged user namespace");
+            if result.is_ok() {
+                writer.write_all(&[0])?;
+            }
+            drop(writer);
+            let status = waitpid(child, None).context("waitpid failed")?;
+            result?;
+            match status {
+                WaitStatus::Exited(_, 0) => {}
+                _ => bail!("Failed to set up ID mappings: {status:?}"),
+            }
+            if uid_maps.is_empty() {
+                std::fs::write("/proc/self/uid_map", format!("0 {uid} 1\n"))
+                    .with_context(|| "Writing /proc/self/uid_map")?;
+            }
+            if gid_maps.is_empty() {
+                std::fs::write("/proc/self/setgroups", "deny")
+                    .with_context(|| "Writing /proc/self/setgroups")?;
+                std::fs::write("/proc/self/gid_map", format!("0 {gid} 1\n"))
+                    .with_context(|| "Writing /proc/self/gid_map")?;
+            }
+            Ok(())
+        }
+    }
+}
+
+fn enter_unprivileged_user_namespace(uid_maps: &[IdMap], gid_maps: &[IdMap]) -> Result<()> {
+    if !uid_maps.is_empty() || !gid_maps.is_empty() {
+        return enter_user_namespace_with_helpers(uid_maps, gid_maps);
+    }
+
     let uid = getuid();
     let gid = getgid();
     unshare(CloneFlags::CLONE_NEWUSER)
@@ -39,13 +174,25 @@ fn enter_unprivileged_user_namespace() -> Result<()> {
 /// regardless of whether the current process has privilege to directly enter a
 /// mount namespace.
 pub fn enter_mount_namespace() -> Result<()> {
+    enter_mount_namespace_with_id_maps(&[], &[])
+}
+
+/// Similar to [`enter_mount_namespace`], but maps the given UID/GID ranges if
+/// it enters an unprivileged user namespace.
+///
+/// Mapping more than the current user allows processes in containers to switch
+/// users, e.g. to drop privileges to the portage user. This requires
+/// newuidmap(1) and newgidmap(1), and the outside IDs must be the current user
+/// or be assigned to it in /etc/subuid and /etc/subgid. If both of the maps are
+/// empty, the current user and group are mapped to root as usual.
+pub fn enter_mount_namespace_with_id_maps(uid_maps: &[IdMap], gid_maps: &[IdMap]) -> Result<()> {
     ensure_single_threaded()?;
 
     match unshare(CloneFlags::CLONE_NEWNS) {
         Err(Errno::EPERM) => {
             // If the current process does not have privilege, enter an
             // unprivileged user namespace and try it again.
-            enter_unprivileged_user_namespace()?;
+            enter_unprivileged_user_namespace(uid_maps, gid_maps)?;
             unshare(CloneFlags::CLONE_NEWNS)
         }
         other => other,
@@ -66,3 +213,24 @@ pub fn enter_mount_namespace() -> Result<()> {
 
     Ok(())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_id_map() -> Result<()> {
+        assert_eq!(
+            "1:100000:65536".parse::<IdMap>()?,
+            IdMap {
+                inside: 1,
+                outside: 100000,
+                count: 65536,
+            }
+        );
+        for spec in ["", "1", "1:2", "1:2:3:4", "a:2:3", "1:2:0", "-1:2:3"] {
+            assert!(spec.parse::<IdMap>().is_err(), "{spec:?} should be invalid");
+        }
+        Ok(())
+    }
+}
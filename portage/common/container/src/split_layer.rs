@@ -0,0 +1,135 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use std::path::Path;
+use tracing::instrument;
+
+/// Paths, relative to a root directory, that hold package manager metadata
+/// rather than file system contents.
+const METADATA_PATHS: &[&str] = &["var/cache/edb", "var/db/pkg", "var/lib/portage"];
+
+/// Moves a path relative to `from_root` to the same relative path under
+/// `to_root`, creating missing parent directories with the same permissions as
+/// the original ones.
+fn move_path(from_root: &Path, to_root: &Path, rel_path: &Path) -> Result<()> {
+    let from = from_root.join(rel_path);
+    if !from.try_exists()? {
+        return Ok(());
+    }
+
+    let mut ancestors: Vec<&Path> = rel_path
+        .ancestors()
+        .skip(1)
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .collect();
+    ancestors.reverse();
+    for dir in ancestors {
+        let to_dir = to_root.join(dir);
+        if to_dir.try_exists()? {
+            continue;
+        }
+        let permissions = std::fs::metadata(from_root.join(dir))?.permissions();
+        std::fs::create_dir(&to_dir)
+            .with_context(|| format!("Failed to create {}", to_dir.display()))?;
+        std::fs::set_permissions(&to_dir, permissions)?;
+    }
+
+    let to = to_root.join(rel_path);
+    std::fs::rename(&from, &to)
+        .with_context(|| format!("Failed to rename {} to {}", from.display(), to.display()))?;
+    Ok(())
+}
+
+fn split_root(layer_dir: &Path, metadata_dir: &Path, root: &Path) -> Result<()> {
+    for path in METADATA_PATHS {
+        move_path(layer_dir, metadata_dir, &root.join(path))?;
+    }
+    Ok(())
+}
+
+/// Moves package manager metadata, such as the installed package database, out
+/// of a layer into a separate metadata layer.
+///
+/// Metadata often changes even if file system contents don't, e.g. on
+/// reinstalling the same packages. Splitting them allows actions depending only
+/// on the contents to be cached across such changes. Sysroots under `build`
+/// are split as well. `metadata_dir` must be an existing directory, and the
+/// metadata layer must be mounted on top of the content layer.
+#[instrument]
+pub fn split_metadata_layer(layer_dir: &Path, metadata_dir: &Path) -> Result<()> {
+    split_root(layer_dir, metadata_dir, Path::new(""))?;
+    let build_dir = layer_dir.join("build");
+    if build_dir.try_exists()? {
+        for entry in std::fs::read_dir(build_dir)? {
+            let entry = entry?;
+            if entry.metadata()?.is_dir() {
+                split_root(
+                    layer_dir,
+                    metadata_dir,
+                    &Path::new("build").join(entry.file_name()),
+                )?;
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::os::unix::fs::PermissionsExt;
+
+    use fileutil::SafeTempDir;
+
+    use super::*;
+
+    #[test]
+    fn test_split_metadata_layer() -> Result<()> {
+        let layer_dir = SafeTempDir::new()?;
+        let layer_dir = layer_dir.path();
+        let metadata_dir = SafeTempDir::new()?;
+        let metadata_dir = metadata_dir.path();
+
+        for file in [
+            "build/foo/usr/bin/foo",
+            "build/foo/var/db/pkg/sys-apps/foo-1/CONTENTS",
+            "usr/bin/bar",
+            "var/db/pkg/sys-apps/bar-1/CONTENTS",
+            "var/lib/portage/world",
+            "var/lib/misc/keep",
+        ] {
+            let path = layer_dir.join(file);
+            std::fs::create_dir_all(path.parent().unwrap())?;
+            std::fs::write(&path, file)?;
+        }
+        std::fs::set_permissions(layer_dir.join("var/db"), PermissionsExt::from_mode(0o750))?;
+
+        split_metadata_layer(layer_dir, metadata_dir)?;
+
+        for file in ["build/foo/usr/bin/foo", "usr/bin/bar", "var/lib/misc/keep"] {
+            assert!(layer_dir.join(file).exists(), "{file} should be kept");
+            assert!(
+                !metadata_dir.join(file).exists(),
+                "{file} should not be moved"
+            );
+        }
+        for file in [
+            "build/foo/var/db/pkg/sys-apps/foo-1/CONTENTS",
+            "var/db/pkg/sys-apps/bar-1/CONTENTS",
+            "var/lib/portage/world",
+        ] {
+            assert!(!layer_dir.join(file).exists(), "{file} should be moved");
+            assert_eq!(std::fs::read_to_string(metadata_dir.join(file))?, file);
+        }
+        assert_eq!(
+            std::fs::metadata(metadata_dir.join("var/db"))?
+                .permissions()
+                .mode()
+                & 0o7777,
+            0o750
+        );
+
+        Ok(())
+    }
+}
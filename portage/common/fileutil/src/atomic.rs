@@ -0,0 +1,259 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{Context, Result};
+use std::ffi::CString;
+use std::fs::{File, Permissions};
+use std::io::{ErrorKind, Write};
+use std::os::unix::ffi::OsStrExt;
+use std::os::unix::fs::PermissionsExt;
+use std::os::unix::io::AsRawFd;
+use std::path::Path;
+
+use crate::remove_dir_all_with_chmod;
+
+/// Controls whether atomic writes flush data to the disk before publishing it.
+///
+/// Without syncing, a crash of the process never leaves partially written
+/// outputs behind, but a crash of the system may.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum SyncMode {
+    NoSync,
+    Sync,
+}
+
+/// Returns the directory containing `path`, which is where temporary files
+/// must be created so that they can be renamed to `path`.
+fn parent_dir(path: &Path) -> &Path {
+    match path.parent() {
+        Some(parent) if !parent.as_os_str().is_empty() => parent,
+        _ => Path::new("."),
+    }
+}
+
+/// Flushes directory entries of `dir`, e.g. the ones updated by renames.
+fn sync_dir(dir: &Path) -> Result<()> {
+    File::open(dir)
+        .and_then(|dir| dir.sync_all())
+        .with_context(|| format!("Failed to sync {dir:?}"))
+}
+
+/// Flushes the file system containing `path`.
+fn sync_fs(path: &Path) -> Result<()> {
+    let file = File::open(path).with_context(|| format!("Failed to open {path:?}"))?;
+    // SAFETY: The file descriptor is valid while `file` is alive.
+    if unsafe { libc::syncfs(file.as_raw_fd()) } < 0 {
+        return Err(std::io::Error::last_os_error())
+            .with_context(|| format!("Failed to sync the file system of {path:?}"));
+    }
+    Ok(())
+}
+
+/// Atomically exchanges two paths with renameat2(2).
+fn exchange(a: &Path, b: &Path) -> std::io::Result<()> {
+    let a = CString::new(a.as_os_str().as_bytes())?;
+    let b = CString::new(b.as_os_str().as_bytes())?;
+    // SAFETY: The path arguments are valid C strings.
+    let ret = unsafe {
+        libc::renameat2(
+            libc::AT_FDCWD,
+            a.as_ptr(),
+            libc::AT_FDCWD,
+            b.as_ptr(),
+            libc::RENAME_EXCHANGE,
+        )
+    };
+    if ret < 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+/// Writes a file atomically by calling `write` with a temporary file in the
+/// same directory and renaming it to `path`.
+///
+/// Readers see either the old contents or the complete new contents. If
+/// `write` fails, `path` is left untouched. The file is created with mode
+/// 0644.
+pub fn atomic_write_with(
+    path: &Path,
+    sync: SyncMode,
+    write: impl FnOnce(&mut File) -> Result<()>,
+) -> Result<()> {
+    let parent = parent_dir(path);
+    let mut temp = tempfile::Builder::new()
+        .prefix(".tmp-")
+        .tempfile_in(parent)
+        .with_context(|| format!("Failed to create a temporary file in {parent:?}"))?;
+    temp.as_file()
+        .set_permissions(Permissions::from_mode(0o644))?;
+
+    write(temp.as_file_mut()).with_context(|| format!("Failed to write {path:?}"))?;
+
+    if sync == SyncMode::Sync {
+        temp.as_file()
+            .sync_all()
+            .with_context(|| format!("Failed to sync {path:?}"))?;
+    }
+    temp.persist(path)
+        .with_context(|| format!("Failed to rename a temporary file to {path:?}"))?;
+    if sync == SyncMode::Sync {
+        sync_dir(parent)?;
+    }
+    Ok(())
+}
+
+/// Writes `contents` to a file atomically. See [`atomic_write_with`] for
+/// details.
+pub fn atomic_write(path: &Path, contents: impl AsRef<[u8]>, sync: SyncMode) -> Result<()> {
+    atomic_write_with(path, sync, |file| Ok(file.write_all(contents.as_ref())?))
+}
+
+/// Replaces a directory atomically by calling `populate` with an empty
+/// temporary directory next to `dir` and swapping the two directories.
+///
+/// Readers see either the old tree or the complete new tree. If `populate`
+/// fails, `dir` is left untouched and the temporary directory is removed.
+/// Files written by `populate` must not record the path of the temporary
+/// directory since it is renamed afterwards.
+///
+/// On file systems that do not support exchanging directories, the old tree
+/// is removed before the new one is renamed into place, so `dir` may be
+/// missing if the process crashes in between.
+pub fn atomic_replace_dir<T>(
+    dir: &Path,
+    sync: SyncMode,
+    populate: impl FnOnce(&Path) -> Result<T>,
+) -> Result<T> {
+    let parent = parent_dir(dir);
+    let staging = tempfile::Builder::new()
+        .prefix(".tmp-")
+        .tempdir_in(parent)
+        .with_context(|| format!("Failed to create a temporary directory in {parent:?}"))?;
+    std::fs::set_permissions(staging.path(), Permissions::from_mode(0o755))?;
+
+    let result = populate(staging.path())?;
+
+    if sync == SyncMode::Sync {
+        sync_fs(staging.path())?;
+    }
+
+    // From here on, we clean up the temporary directory by ourselves since it
+    // holds the old tree after the exchange.
+    let staging = staging.into_path();
+    match exchange(&staging, dir) {
+        Ok(()) => {
+            remove_dir_all_with_chmod(&staging)?;
+        }
+        Err(err) if err.kind() == ErrorKind::NotFound => {
+            std::fs::rename(&staging, dir)
+                .with_context(|| format!("Failed to rename {staging:?} to {dir:?}"))?;
+        }
+        Err(err) if err.raw_os_error() == Some(libc::EINVAL) => {
+            remove_dir_all_with_chmod(dir)?;
+            std::fs::rename(&staging, dir)
+                .with_context(|| format!("Failed to rename {staging:?} to {dir:?}"))?;
+        }
+        Err(err) => {
+            let _ = remove_dir_all_with_chmod(&staging);
+            return Err(err).with_context(|| format!("Failed to exchange {staging:?} and {dir:?}"));
+        }
+    }
+
+    if sync == SyncMode::Sync {
+        sync_dir(parent)?;
+    }
+    Ok(result)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::bail;
+
+    fn list_dir(dir: &Path) -> Result<Vec<String>> {
+        let mut names = std::fs::read_dir(dir)?
+            .map(|entry| Ok(entry?.file_name().to_string_lossy().into_owned()))
+            .collect::<Result<Vec<_>>>()?;
+        names.sort();
+        Ok(names)
+    }
+
+    #[test]
+    fn atomic_write_replaces_file() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let path = dir.path().join("deps.json");
+
+        atomic_write(&path, "old", SyncMode::NoSync)?;
+        assert_eq!(std::fs::read_to_string(&path)?, "old");
+        assert_eq!(
+            std::fs::metadata(&path)?.permissions().mode() & 0o777,
+            0o644
+        );
+
+        atomic_write(&path, "new", SyncMode::Sync)?;
+        assert_eq!(std::fs::read_to_string(&path)?, "new");
+        assert_eq!(list_dir(dir.path())?, vec!["deps.json"]);
+
+        Ok(())
+    }
+
+    #[test]
+    fn atomic_write_keeps_file_on_error() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let path = dir.path().join("deps.json");
+        atomic_write(&path, "old", SyncMode::NoSync)?;
+
+        let result = atomic_write_with(&path, SyncMode::NoSync, |file| {
+            file.write_all(b"partial")?;
+            bail!("interrupted");
+        });
+        assert!(result.is_err());
+        assert_eq!(std::fs::read_to_string(&path)?, "old");
+        assert_eq!(list_dir(dir.path())?, vec!["deps.json"]);
+
+        Ok(())
+    }
+
+    #[test]
+    fn atomic_replace_dir_swaps_tree() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let output = dir.path().join("output");
+
+        // Creates the directory if it is missing.
+        atomic_replace_dir(&output, SyncMode::NoSync, |staging| {
+            Ok(std::fs::write(staging.join("old"), "")?)
+        })?;
+        assert_eq!(list_dir(&output)?, vec!["old"]);
+
+        let value = atomic_replace_dir(&output, SyncMode::Sync, |staging| {
+            std::fs::create_dir(staging.join("sub"))?;
+            std::fs::write(staging.join("sub/new"), "")?;
+            Ok(42)
+        })?;
+        assert_eq!(value, 42);
+        assert_eq!(list_dir(&output)?, vec!["sub"]);
+        assert_eq!(list_dir(dir.path())?, vec!["output"]);
+
+        Ok(())
+    }
+
+    #[test]
+    fn atomic_replace_dir_keeps_tree_on_error() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let output = dir.path().join("output");
+        std::fs::create_dir(&output)?;
+        std::fs::write(output.join("old"), "")?;
+
+        let result = atomic_replace_dir(&output, SyncMode::NoSync, |staging| -> Result<()> {
+            std::fs::write(staging.join("new"), "")?;
+            bail!("interrupted");
+        });
+        assert!(result.is_err());
+        assert_eq!(list_dir(&output)?, vec!["old"]);
+        assert_eq!(list_dir(dir.path())?, vec!["output"]);
+
+        Ok(())
+    }
+}
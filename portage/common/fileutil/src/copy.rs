@@ -0,0 +1,313 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, Context, Result};
+use std::fs::{File, OpenOptions};
+use std::io::ErrorKind;
+use std::os::unix::fs::{FileExt, OpenOptionsExt};
+use std::os::unix::io::AsRawFd;
+use std::path::Path;
+
+use crate::list_user_xattrs;
+
+/// `FICLONE` ioctl request number from <linux/fs.h>. It is not available in
+/// the libc crate version we use.
+const FICLONE: u64 = 0x40049409;
+
+/// Prefix of xattrs fakefs uses to record overridden file metadata. They are
+/// meaningful only to the fakefs instance that created them, so they are not
+/// copied.
+const FAKEFS_XATTR_PREFIX: &str = "user.fakefs.";
+
+/// Maximum number of bytes to copy at once, so that progress is reported
+/// reasonably often for large files.
+const CHUNK_SIZE: u64 = 64 << 20;
+
+/// Tries to share the data of `src` with `dest` by reflink. Returns false if
+/// the file system does not support it, e.g. when the files are on different
+/// file systems.
+fn try_reflink(src: &File, dest: &File) -> bool {
+    // SAFETY: Both file descriptors are valid while the files are alive.
+    let ret = unsafe { libc::ioctl(dest.as_raw_fd(), FICLONE as _, src.as_raw_fd()) };
+    // Any failure is fine here since we can always fall back to copying data.
+    ret == 0
+}
+
+/// Calls lseek(2) with `whence`. Returns `None` if there is no data or hole
+/// at or after `offset`.
+fn seek(file: &File, offset: u64, whence: libc::c_int) -> Result<Option<u64>> {
+    // SAFETY: The file descriptor is valid while the file is alive.
+    let ret = unsafe { libc::lseek(file.as_raw_fd(), offset as libc::off_t, whence) };
+    if ret < 0 {
+        let err = std::io::Error::last_os_error();
+        if err.raw_os_error() == Some(libc::ENXIO) {
+            return Ok(None);
+        }
+        return Err(err.into());
+    }
+    Ok(Some(ret as u64))
+}
+
+/// Copies `len` bytes at `offset` from `src` to the same offset of `dest` with
+/// copy_file_range(2).
+///
+/// Returns `Unsupported` error if copy_file_range(2) can't be used for the
+/// files, e.g. on old kernels or some file system combinations.
+fn copy_file_range(src: &File, dest: &File, offset: u64, len: u64) -> std::io::Result<()> {
+    let mut off_in = offset as libc::loff_t;
+    let mut off_out = offset as libc::loff_t;
+    let mut remaining = len;
+    while remaining > 0 {
+        // SAFETY: Both file descriptors are valid while the files are alive,
+        // and the offset pointers are valid during the call.
+        let ret = unsafe {
+            libc::copy_file_range(
+                src.as_raw_fd(),
+                &mut off_in,
+                dest.as_raw_fd(),
+                &mut off_out,
+                remaining as usize,
+                0,
+            )
+        };
+        if ret < 0 {
+            let err = std::io::Error::last_os_error();
+            return match err.raw_os_error() {
+                Some(
+                    libc::EXDEV | libc::ENOSYS | libc::EOPNOTSUPP | libc::EINVAL | libc::EPERM,
+                ) if remaining == len => Err(ErrorKind::Unsupported.into()),
+                _ => Err(err),
+            };
+        }
+        if ret == 0 {
+            return Err(ErrorKind::UnexpectedEof.into());
+        }
+        remaining -= ret as u64;
+    }
+    Ok(())
+}
+
+/// Copies `len` bytes at `offset` from `src` to the same offset of `dest` by
+/// reading and writing them.
+fn copy_by_read_write(src: &File, dest: &File, offset: u64, len: u64) -> std::io::Result<()> {
+    let mut buf = vec![0; len.min(1 << 20) as usize];
+    let mut done = 0;
+    while done < len {
+        let size = buf.len().min((len - done) as usize);
+        src.read_exact_at(&mut buf[..size], offset + done)?;
+        dest.write_all_at(&buf[..size], offset + done)?;
+        done += size as u64;
+    }
+    Ok(())
+}
+
+/// Copies the data regions of `src` to `dest`, leaving holes in `dest` where
+/// `src` has holes. `progress` is called after each chunk except the last one.
+fn copy_sparse(
+    src: &File,
+    dest: &File,
+    len: u64,
+    progress: &mut impl FnMut(u64, u64),
+) -> Result<()> {
+    let mut use_copy_file_range = true;
+    let mut offset = 0;
+    while offset < len {
+        // File systems not tracking holes report the whole file as data.
+        let Some(data_start) = seek(src, offset, libc::SEEK_DATA)? else {
+            // The rest of the file is a hole.
+            break;
+        };
+        let data_end = seek(src, data_start, libc::SEEK_HOLE)?
+            .unwrap_or(len)
+            .min(len);
+
+        let mut chunk_start = data_start;
+        while chunk_start < data_end {
+            let chunk_len = (data_end - chunk_start).min(CHUNK_SIZE);
+            if use_copy_file_range {
+                match copy_file_range(src, dest, chunk_start, chunk_len) {
+                    Ok(()) => {}
+                    Err(err) if err.kind() == ErrorKind::Unsupported => {
+                        use_copy_file_range = false;
+                    }
+                    Err(err) => return Err(err.into()),
+                }
+            }
+            if !use_copy_file_range {
+                copy_by_read_write(src, dest, chunk_start, chunk_len)?;
+            }
+            chunk_start += chunk_len;
+            if chunk_start < len {
+                progress(chunk_start, len);
+            }
+        }
+        offset = data_end;
+    }
+
+    // Extend the file to cover a trailing hole, if any.
+    dest.set_len(len)?;
+    Ok(())
+}
+
+/// Copies a regular file like [`std::fs::copy`], calling `progress` with the
+/// number of bytes processed so far and the total size.
+///
+/// The data is shared by reflink if the file system supports it, which is
+/// almost free for large files. Otherwise the data is copied with
+/// copy_file_range(2), falling back to read(2)/write(2), while preserving
+/// holes of sparse files. Permissions and user xattrs are copied as well,
+/// except for the ones recorded by fakefs.
+pub fn copy_file_with_progress(
+    from: &Path,
+    to: &Path,
+    mut progress: impl FnMut(u64, u64),
+) -> Result<()> {
+    let src = File::open(from).with_context(|| format!("Failed to open {from:?}"))?;
+    let metadata = src.metadata()?;
+    if !metadata.is_file() {
+        bail!("{from:?} is not a regular file");
+    }
+    let len = metadata.len();
+
+    let dest = OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(0o600)
+        .open(to)
+        .with_context(|| format!("Failed to create {to:?}"))?;
+
+    if !try_reflink(&src, &dest) {
+        copy_sparse(&src, &dest, len, &mut progress)
+            .with_context(|| format!("Failed to copy {from:?} to {to:?}"))?;
+    }
+    progress(len, len);
+
+    dest.set_permissions(metadata.permissions())?;
+    for key in list_user_xattrs(from)? {
+        if key.to_string_lossy().starts_with(FAKEFS_XATTR_PREFIX) {
+            continue;
+        }
+        if let Some(value) = xattr::get(from, &key)? {
+            xattr::set(to, &key, &value)
+                .with_context(|| format!("Failed to set xattr {key:?} on {to:?}"))?;
+        }
+    }
+    Ok(())
+}
+
+/// Copies a regular file. See [`copy_file_with_progress`] for details.
+pub fn copy_file(from: &Path, to: &Path) -> Result<()> {
+    copy_file_with_progress(from, to, |_, _| {})
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs::Permissions;
+    use std::os::unix::fs::{MetadataExt, PermissionsExt};
+
+    #[test]
+    fn copy_file_copies_contents_and_permissions() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let src = dir.path().join("src");
+        let dest = dir.path().join("dest");
+        std::fs::write(&src, "hello")?;
+        std::fs::set_permissions(&src, Permissions::from_mode(0o751))?;
+
+        let mut reports = Vec::new();
+        copy_file_with_progress(&src, &dest, |done, total| reports.push((done, total)))?;
+
+        assert_eq!(std::fs::read_to_string(&dest)?, "hello");
+        assert_eq!(std::fs::metadata(&dest)?.mode() & 0o777, 0o751);
+        assert_eq!(reports.last(), Some(&(5, 5)));
+
+        Ok(())
+    }
+
+    #[test]
+    fn copy_file_overwrites_existing_file() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let src = dir.path().join("src");
+        let dest = dir.path().join("dest");
+        std::fs::write(&src, "new")?;
+        std::fs::write(&dest, "old contents")?;
+
+        copy_file(&src, &dest)?;
+
+        assert_eq!(std::fs::read_to_string(&dest)?, "new");
+
+        Ok(())
+    }
+
+    #[test]
+    fn copy_file_copies_empty_file() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let src = dir.path().join("src");
+        let dest = dir.path().join("dest");
+        std::fs::write(&src, "")?;
+
+        let mut reports = Vec::new();
+        copy_file_with_progress(&src, &dest, |done, total| reports.push((done, total)))?;
+
+        assert_eq!(std::fs::read(&dest)?, b"");
+        assert_eq!(reports, vec![(0, 0)]);
+
+        Ok(())
+    }
+
+    #[test]
+    fn copy_file_preserves_holes() -> Result<()> {
+        const SIZE: u64 = 16 << 20;
+
+        let dir = tempfile::tempdir()?;
+        let src = dir.path().join("src");
+        let dest = dir.path().join("dest");
+        {
+            let file = File::create(&src)?;
+            file.set_len(SIZE)?;
+            file.write_all_at(b"data", SIZE / 2)?;
+        }
+        let src_blocks = std::fs::metadata(&src)?.blocks();
+
+        copy_file(&src, &dest)?;
+
+        assert_eq!(std::fs::read(&dest)?, std::fs::read(&src)?);
+        // Skip the sparseness check if the file system doesn't support holes.
+        if src_blocks * 512 < SIZE {
+            assert!(std::fs::metadata(&dest)?.blocks() * 512 < SIZE);
+        }
+
+        Ok(())
+    }
+
+    #[test]
+    fn copy_file_skips_fakefs_xattrs() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let src = dir.path().join("src");
+        let dest = dir.path().join("dest");
+        std::fs::write(&src, "hello")?;
+        if xattr::set(&src, "user.foo", b"bar").is_err() {
+            eprintln!("Skipping the test: user xattrs are not supported");
+            return Ok(());
+        }
+        xattr::set(&src, "user.fakefs.override", b"0:0")?;
+
+        copy_file(&src, &dest)?;
+
+        assert_eq!(xattr::get(&dest, "user.foo")?, Some(b"bar".to_vec()));
+        assert_eq!(xattr::get(&dest, "user.fakefs.override")?, None);
+
+        Ok(())
+    }
+
+    #[test]
+    fn copy_file_rejects_directories() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+
+        assert!(copy_file(dir.path(), &dir.path().join("dest")).is_err());
+
+        Ok(())
+    }
+}
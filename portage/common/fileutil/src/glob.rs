@@ -0,0 +1,114 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+/// Matches `text` against a shell glob `pattern` supporting `*`, `?` and
+/// bracket expressions like `[a-z]` and `[!a-z]`. Like Python's fnmatch and
+/// Portage, `*` and `?` also match slashes.
+pub fn glob_match(pattern: &[u8], text: &[u8]) -> bool {
+    match_impl(pattern, text, false)
+}
+
+/// Matches a path against a glob pattern like [`glob_match`], except that
+/// `*`, `?` and bracket expressions don't match `/`, while `**` matches any
+/// sequence of characters including `/`.
+pub fn path_glob_match(pattern: &[u8], path: &[u8]) -> bool {
+    match_impl(pattern, path, true)
+}
+
+fn match_impl(pattern: &[u8], text: &[u8], path: bool) -> bool {
+    let is_wildcard = |c: &u8| !path || *c != b'/';
+    match pattern {
+        [] => text.is_empty(),
+        [b'*', b'*', rest @ ..] if path => {
+            (0..=text.len()).any(|i| match_impl(rest, &text[i..], path))
+        }
+        [b'*', rest @ ..] => {
+            let limit = text
+                .iter()
+                .position(|c| !is_wildcard(c))
+                .unwrap_or(text.len());
+            (0..=limit).any(|i| match_impl(rest, &text[i..], path))
+        }
+        [b'?', rest @ ..] => match text {
+            [c, text_rest @ ..] if is_wildcard(c) => match_impl(rest, text_rest, path),
+            _ => false,
+        },
+        [b'[', bracket @ ..] => {
+            let Some((&c, text_rest)) = text.split_first() else {
+                return false;
+            };
+            match match_bracket(bracket, c) {
+                Some((matched, rest)) => {
+                    matched && is_wildcard(&c) && match_impl(rest, text_rest, path)
+                }
+                // An unterminated bracket matches a literal '['.
+                None => c == b'[' && match_impl(bracket, text_rest, path),
+            }
+        }
+        [p, rest @ ..] => match text {
+            [c, text_rest @ ..] if c == p => match_impl(rest, text_rest, path),
+            _ => false,
+        },
+    }
+}
+
+/// Matches a character against a bracket expression following '['. Returns
+/// whether it matched and the rest of the pattern after ']', or `None` if the
+/// bracket is not terminated.
+fn match_bracket(pattern: &[u8], c: u8) -> Option<(bool, &[u8])> {
+    let (negate, mut pattern) = match pattern.first() {
+        Some(b'!') => (true, &pattern[1..]),
+        _ => (false, pattern),
+    };
+    let mut matched = false;
+    let mut first = true;
+    loop {
+        match pattern {
+            [] => return None,
+            [b']', rest @ ..] if !first => return Some((matched != negate, rest)),
+            [lo, b'-', hi, rest @ ..] if *hi != b']' => {
+                matched |= (*lo..=*hi).contains(&c);
+                pattern = rest;
+            }
+            [ch, rest @ ..] => {
+                matched |= *ch == c;
+                pattern = rest;
+            }
+        }
+        first = false;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_glob_match() {
+        assert!(glob_match(b"/usr/*", b"/usr/bin/foo"));
+        assert!(glob_match(b"/usr/bin/fo?", b"/usr/bin/foo"));
+        assert!(glob_match(b"/usr/bin/[a-f]oo", b"/usr/bin/foo"));
+        assert!(glob_match(b"/usr/bin/[!b]oo", b"/usr/bin/foo"));
+        assert!(glob_match(b"/usr/bin/[]]", b"/usr/bin/]"));
+        assert!(glob_match(b"/usr/bin/[", b"/usr/bin/["));
+        assert!(glob_match(b"sys-libs/*", b"sys-libs/glibc"));
+        assert!(!glob_match(b"/usr/bin/fo?", b"/usr/bin/fooo"));
+        assert!(!glob_match(b"/usr/bin/[!f]oo", b"/usr/bin/foo"));
+        assert!(!glob_match(b"/usr/lib/*", b"/usr/bin/foo"));
+    }
+
+    #[test]
+    fn test_path_glob_match() {
+        assert!(path_glob_match(b"tmp", b"tmp"));
+        assert!(!path_glob_match(b"tmp", b"tmpfs"));
+        assert!(path_glob_match(b"*.log", b"emerge.log"));
+        assert!(!path_glob_match(b"*.log", b"var/emerge.log"));
+        assert!(path_glob_match(b"var/**", b"var/log/emerge.log"));
+        assert!(path_glob_match(b"?.txt", b"a.txt"));
+        assert!(!path_glob_match(b"?.txt", b"ab.txt"));
+        assert!(!path_glob_match(b"var?log", b"var/log"));
+        assert!(path_glob_match(b"lib[0-9][0-9]", b"lib64"));
+        assert!(!path_glob_match(b"var[/]log", b"var/log"));
+    }
+}
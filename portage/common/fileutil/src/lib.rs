@@ -2,7 +2,10 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
+mod atomic;
+mod copy;
 mod dualpath;
+mod glob;
 mod r#move;
 mod remove;
 mod symlink_forest;
@@ -10,7 +13,10 @@ mod tempdir;
 mod xattr;
 
 pub use crate::xattr::*;
+pub use atomic::*;
+pub use copy::*;
 pub use dualpath::DualPath;
+pub use glob::*;
 pub use r#move::*;
 pub use remove::*;
 pub use symlink_forest::*;
@@ -0,0 +1,804 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{anyhow, bail, ensure, Context, Result};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::{
+    collections::{BTreeMap, HashMap},
+    fmt::Display,
+    fs::File,
+    io::{BufRead, BufReader, BufWriter, Read, Write},
+    os::unix::fs::MetadataExt,
+    path::{Component, Path, PathBuf},
+};
+use walkdir::WalkDir;
+
+const MODE_MASK: u32 = 0o7777;
+const S_IFMT: u32 = 0o170000;
+const S_IFDIR: u32 = 0o040000;
+const S_IFREG: u32 = 0o100000;
+
+/// The xattr fakefs records overridden file metadata in. See
+/// portage/bin/fakefs/fsop/xattrdata.go for the format.
+const XATTR_FAKEFS_OVERRIDE: &str = "user.fakefs.override";
+const XATTR_CAPABILITY: &str = "security.capability";
+
+/// The prefix of PAX records holding xattrs.
+const PAX_XATTR_PREFIX: &str = "SCHILY.xattr.";
+
+/// The type-specific part of a [`Entry`].
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+pub enum EntryKind {
+    Directory,
+    Regular {
+        size: u64,
+        /// The hex-encoded SHA-256 digest of the file contents.
+        sha256: String,
+    },
+    Symlink {
+        target: PathBuf,
+    },
+    /// A hard link to another path in the same layer.
+    ///
+    /// Hard links are normalized regardless of the source of a manifest: among
+    /// the paths sharing a file, the smallest one records the file itself, and
+    /// the others are hard links to it with the same mode and ownership.
+    Hardlink {
+        target: PathBuf,
+    },
+    /// Device files, FIFOs and sockets. They rarely appear in layers and we
+    /// don't record their details.
+    Other,
+}
+
+/// A file in a layer.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Entry {
+    /// The path relative to the root of the layer. The root directory itself
+    /// is not recorded.
+    pub path: PathBuf,
+    #[serde(flatten)]
+    pub kind: EntryKind,
+    /// Permission bits, including setuid, setgid and sticky bits.
+    pub mode: u32,
+    pub uid: u32,
+    pub gid: u32,
+    /// Extended attributes with hex-encoded values.
+    ///
+    /// `user.fakefs.override` is not recorded as is; instead the ownership,
+    /// mode and capabilities it holds are reflected to the entry, so that it
+    /// describes the file as seen by processes running under fakefs.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub xattrs: BTreeMap<String, String>,
+}
+
+impl Entry {
+    /// Reflects the metadata fakefs recorded in the override xattr, if any.
+    fn apply_fakefs_override(&mut self) -> Result<()> {
+        let Some(value) = self.xattrs.remove(XATTR_FAKEFS_OVERRIDE) else {
+            return Ok(());
+        };
+        let value = String::from_utf8(hex::decode(value)?)?;
+        let corrupted = || format!("Corrupted fakefs override: {value}");
+
+        // Either "uid:gid" or "uid:gid:mode:rdev:capability".
+        let fields: Vec<&str> = value.split(':').collect();
+        ensure!(
+            matches!(fields.len(), 2 | 5),
+            "Corrupted fakefs override: {value}"
+        );
+        self.uid = fields[0].parse().with_context(corrupted)?;
+        self.gid = fields[1].parse().with_context(corrupted)?;
+        if fields.len() == 2 {
+            return Ok(());
+        }
+
+        // The mode includes the file type, and 0 means it's not overridden.
+        let mode = u32::from_str_radix(fields[2], 8).with_context(corrupted)?;
+        if mode != 0 {
+            self.mode = mode & MODE_MASK;
+            // fakefs simulates device files with regular files.
+            if !matches!(mode & S_IFMT, S_IFDIR | S_IFREG) {
+                self.kind = EntryKind::Other;
+            }
+        }
+        if fields[4] != "-" {
+            hex::decode(fields[4]).with_context(corrupted)?;
+            self.xattrs
+                .insert(XATTR_CAPABILITY.to_owned(), fields[4].to_owned());
+        }
+        Ok(())
+    }
+}
+
+/// Describes all files in a layer, i.e. a directory tree that is extracted
+/// or mounted to form a file system.
+///
+/// A manifest can be generated from a directory or a tarball, and is
+/// serialized as JSON lines, one [`Entry`] per line sorted by paths, so that
+/// manifests of the same layer are byte-identical and can be compared with
+/// text tools as well as [`LayerManifest::diff`].
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct LayerManifest {
+    entries: BTreeMap<PathBuf, Entry>,
+}
+
+/// Normalizes a path in a layer, e.g. "./usr/bin/" to "usr/bin". Returns
+/// None for the root directory.
+fn normalize_path(path: &Path) -> Result<Option<PathBuf>> {
+    let mut normalized = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::Normal(name) => normalized.push(name),
+            Component::CurDir | Component::RootDir => {}
+            _ => bail!("Invalid path in layer: {}", path.display()),
+        }
+    }
+    Ok((!normalized.as_os_str().is_empty()).then_some(normalized))
+}
+
+/// Reads all xattrs of a file without following symlinks.
+fn read_xattrs(path: &Path) -> Result<BTreeMap<String, String>> {
+    let mut xattrs = BTreeMap::new();
+    for name in xattr::list(path)? {
+        let value = xattr::get(path, &name)?.unwrap_or_default();
+        let name = name
+            .into_string()
+            .map_err(|name| anyhow!("Invalid xattr name {name:?}"))?;
+        xattrs.insert(name, hex::encode(value));
+    }
+    Ok(xattrs)
+}
+
+fn hash_contents(mut reader: impl Read) -> Result<(u64, String)> {
+    let mut hasher = Sha256::new();
+    let size = std::io::copy(&mut reader, &mut hasher)?;
+    Ok((size, hex::encode(hasher.finalize())))
+}
+
+impl LayerManifest {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Adds an entry, replacing one at the same path if any.
+    pub fn insert(&mut self, entry: Entry) {
+        self.entries.insert(entry.path.clone(), entry);
+    }
+
+    /// Returns the entry at a path relative to the root of the layer.
+    pub fn get(&self, path: &Path) -> Option<&Entry> {
+        self.entries.get(path)
+    }
+
+    /// Returns entries sorted by paths.
+    pub fn entries(&self) -> impl Iterator<Item = &Entry> {
+        self.entries.values()
+    }
+
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// Returns the total size of regular files.
+    pub fn total_size(&self) -> u64 {
+        self.entries
+            .values()
+            .map(|entry| match entry.kind {
+                EntryKind::Regular { size, .. } => size,
+                _ => 0,
+            })
+            .sum()
+    }
+
+    /// Rewrites hard links so that they're recorded the same way whichever
+    /// order they appear in the source. See [`EntryKind::Hardlink`].
+    fn normalize_hardlinks(&mut self) -> Result<()> {
+        // Maps the path recording the contents of a file to all paths sharing
+        // the file. Tarballs may have hard links to hard links, so follow them.
+        let mut groups: BTreeMap<PathBuf, Vec<PathBuf>> = BTreeMap::new();
+        for entry in self.entries.values() {
+            let mut origin = &entry.path;
+            let mut hops = 0;
+            while let EntryKind::Hardlink { target } = &self
+                .entries
+                .get(origin)
+                .with_context(|| format!("{} links to a missing file", entry.path.display()))?
+                .kind
+            {
+                hops += 1;
+                ensure!(
+                    hops <= self.entries.len(),
+                    "{} is in a hard link loop",
+                    entry.path.display()
+                );
+                origin = target;
+            }
+            if origin != &entry.path {
+                groups
+                    .entry(origin.clone())
+                    .or_insert_with(|| vec![origin.clone()])
+                    .push(entry.path.clone());
+            }
+        }
+
+        for (origin, paths) in groups {
+            let origin_entry = self.entries[&origin].clone();
+            let canonical = paths.iter().min().expect("group is not empty").clone();
+            for path in paths {
+                let kind = if path == canonical {
+                    origin_entry.kind.clone()
+                } else {
+                    EntryKind::Hardlink {
+                        target: canonical.clone(),
+                    }
+                };
+                self.insert(Entry {
+                    path,
+                    kind,
+                    ..origin_entry.clone()
+                });
+            }
+        }
+        Ok(())
+    }
+
+    /// Generates a manifest of a directory.
+    pub fn from_dir(root: &Path) -> Result<Self> {
+        let mut manifest = Self::new();
+        // Maps inodes with multiple links to the first path found.
+        let mut inodes: HashMap<(u64, u64), PathBuf> = HashMap::new();
+        for dir_entry in WalkDir::new(root).min_depth(1).sort_by_file_name() {
+            let dir_entry = dir_entry?;
+            let path = dir_entry.path();
+            let rel_path = path.strip_prefix(root)?.to_path_buf();
+            let metadata = dir_entry.metadata()?;
+            let file_type = metadata.file_type();
+            let first_link = if !file_type.is_dir() && metadata.nlink() > 1 {
+                match inodes.get(&(metadata.dev(), metadata.ino())) {
+                    Some(first_link) => Some(first_link.clone()),
+                    None => {
+                        inodes.insert((metadata.dev(), metadata.ino()), rel_path.clone());
+                        None
+                    }
+                }
+            } else {
+                None
+            };
+            let kind = if let Some(target) = first_link {
+                EntryKind::Hardlink { target }
+            } else if file_type.is_dir() {
+                EntryKind::Directory
+            } else if file_type.is_file() {
+                let file = File::open(path)
+                    .with_context(|| format!("Failed to open {}", path.display()))?;
+                let (size, sha256) = hash_contents(file)?;
+                EntryKind::Regular { size, sha256 }
+            } else if file_type.is_symlink() {
+                EntryKind::Symlink {
+                    target: std::fs::read_link(path)?,
+                }
+            } else {
+                EntryKind::Other
+            };
+            let xattrs = read_xattrs(path)
+                .with_context(|| format!("Failed to read xattrs of {}", path.display()))?;
+            let mut entry = Entry {
+                path: rel_path,
+                kind,
+                mode: metadata.mode() & MODE_MASK,
+                uid: metadata.uid(),
+                gid: metadata.gid(),
+                xattrs,
+            };
+            entry
+                .apply_fakefs_override()
+                .with_context(|| format!("Invalid xattrs on {}", path.display()))?;
+            manifest.insert(entry);
+        }
+        manifest.normalize_hardlinks()?;
+        Ok(manifest)
+    }
+
+    /// Generates a manifest of an uncompressed tarball.
+    pub fn from_tar(reader: impl Read) -> Result<Self> {
+        Self::from_archive(&mut tar::Archive::new(reader))
+    }
+
+    /// Generates a manifest of a tar archive, e.g. the one returned by
+    /// `BinaryPackage::archive`.
+    pub fn from_archive(archive: &mut tar::Archive<impl Read>) -> Result<Self> {
+        let mut manifest = Self::new();
+        for tar_entry in archive.entries()? {
+            let mut tar_entry = tar_entry?;
+            let Some(path) = normalize_path(&tar_entry.path()?)? else {
+                continue;
+            };
+            let mut xattrs = BTreeMap::new();
+            for extension in tar_entry.pax_extensions()?.into_iter().flatten() {
+                let extension = extension?;
+                if let Some(name) = extension.key()?.strip_prefix(PAX_XATTR_PREFIX) {
+                    xattrs.insert(name.to_owned(), hex::encode(extension.value_bytes()));
+                }
+            }
+            let header = tar_entry.header();
+            let mode = header.mode()? & MODE_MASK;
+            let uid = header.uid()?.try_into()?;
+            let gid = header.gid()?.try_into()?;
+            let link_target = || -> Result<PathBuf> {
+                Ok(tar_entry
+                    .link_name()?
+                    .with_context(|| format!("{} has no link target", path.display()))?
+                    .into_owned())
+            };
+            let kind = match header.entry_type() {
+                tar::EntryType::Directory => EntryKind::Directory,
+                tar::EntryType::Symlink => EntryKind::Symlink {
+                    target: link_target()?,
+                },
+                tar::EntryType::Link => EntryKind::Hardlink {
+                    target: normalize_path(&link_target()?)?
+                        .with_context(|| format!("{} links to the root", path.display()))?,
+                },
+                tar::EntryType::Regular | tar::EntryType::Continuous => {
+                    let (size, sha256) = hash_contents(&mut tar_entry)?;
+                    EntryKind::Regular { size, sha256 }
+                }
+                _ => EntryKind::Other,
+            };
+            let mut entry = Entry {
+                path,
+                kind,
+                mode,
+                uid,
+                gid,
+                xattrs,
+            };
+            entry
+                .apply_fakefs_override()
+                .with_context(|| format!("Invalid xattrs on {}", entry.path.display()))?;
+            manifest.insert(entry);
+        }
+        manifest.normalize_hardlinks()?;
+        Ok(manifest)
+    }
+
+    /// Generates a manifest of a tarball file. The compression format is
+    /// detected from the file name.
+    pub fn from_tar_file(path: &Path) -> Result<Self> {
+        let file = BufReader::new(
+            File::open(path).with_context(|| format!("Failed to open {}", path.display()))?,
+        );
+        let name = path.to_string_lossy();
+        let manifest = if name.ends_with(".tar.gz") || name.ends_with(".tgz") {
+            Self::from_tar(flate2::read::GzDecoder::new(file))
+        } else if name.ends_with(".tar.zst") {
+            Self::from_tar(zstd::stream::read::Decoder::with_buffer(file)?)
+        } else if name.ends_with(".tar.bz2") {
+            Self::from_tar(bzip2::read::BzDecoder::new(file))
+        } else if name.ends_with(".tar") {
+            Self::from_tar(file)
+        } else {
+            bail!("Unknown tarball format: {}", path.display());
+        };
+        manifest.with_context(|| format!("Failed to read {}", path.display()))
+    }
+
+    /// Reads a manifest serialized as JSON lines.
+    pub fn read(reader: impl BufRead) -> Result<Self> {
+        let mut manifest = Self::new();
+        for (i, line) in reader.lines().enumerate() {
+            let line = line?;
+            if line.is_empty() {
+                continue;
+            }
+            let entry: Entry = serde_json::from_str(&line)
+                .with_context(|| format!("Corrupted manifest at line {}", i + 1))?;
+            manifest.insert(entry);
+        }
+        Ok(manifest)
+    }
+
+    /// Writes the manifest as JSON lines.
+    pub fn write(&self, mut writer: impl Write) -> Result<()> {
+        for entry in self.entries.values() {
+            serde_json::to_writer(&mut writer, entry)?;
+            writer.write_all(b"\n")?;
+        }
+        writer.flush()?;
+        Ok(())
+    }
+
+    /// Loads a manifest from a file.
+    pub fn load(path: &Path) -> Result<Self> {
+        let file =
+            File::open(path).with_context(|| format!("Failed to open {}", path.display()))?;
+        Self::read(BufReader::new(file))
+            .with_context(|| format!("Failed to read {}", path.display()))
+    }
+
+    /// Saves the manifest to a file.
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let file =
+            File::create(path).with_context(|| format!("Failed to create {}", path.display()))?;
+        self.write(BufWriter::new(file))
+    }
+
+    /// Returns differences from `self` to `other`, sorted by paths.
+    pub fn diff<'a>(&'a self, other: &'a Self) -> Vec<Difference<'a>> {
+        let mut differences = Vec::new();
+        for (path, left) in &self.entries {
+            match other.entries.get(path) {
+                None => differences.push(Difference::OnlyInLeft(left)),
+                Some(right) if left != right => {
+                    differences.push(Difference::Changed { left, right })
+                }
+                _ => {}
+            }
+        }
+        for (path, right) in &other.entries {
+            if !self.entries.contains_key(path) {
+                differences.push(Difference::OnlyInRight(right));
+            }
+        }
+        differences.sort_by(|a, b| a.path().cmp(b.path()));
+        differences
+    }
+}
+
+/// A difference between two manifests.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub enum Difference<'a> {
+    OnlyInLeft(&'a Entry),
+    OnlyInRight(&'a Entry),
+    Changed { left: &'a Entry, right: &'a Entry },
+}
+
+impl Difference<'_> {
+    pub fn path(&self) -> &Path {
+        match self {
+            Self::OnlyInLeft(entry) | Self::OnlyInRight(entry) => &entry.path,
+            Self::Changed { left, .. } => &left.path,
+        }
+    }
+}
+
+impl Display for Difference<'_> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::OnlyInLeft(entry) => write!(f, "{}: Only in left", entry.path.display()),
+            Self::OnlyInRight(entry) => write!(f, "{}: Only in right", entry.path.display()),
+            Self::Changed { left, right } => {
+                let mut changes = Vec::new();
+                if left.kind != right.kind {
+                    changes.push(match (&left.kind, &right.kind) {
+                        (EntryKind::Regular { .. }, EntryKind::Regular { .. }) => {
+                            "contents".to_owned()
+                        }
+                        (EntryKind::Symlink { target: l }, EntryKind::Symlink { target: r })
+                        | (EntryKind::Hardlink { target: l }, EntryKind::Hardlink { target: r }) => {
+                            format!("target {} != {}", l.display(), r.display())
+                        }
+                        _ => "type".to_owned(),
+                    });
+                }
+                if left.mode != right.mode {
+                    changes.push(format!("mode {:o} != {:o}", left.mode, right.mode));
+                }
+                if (left.uid, left.gid) != (right.uid, right.gid) {
+                    changes.push(format!(
+                        "owner {}:{} != {}:{}",
+                        left.uid, left.gid, right.uid, right.gid
+                    ));
+                }
+                if left.xattrs != right.xattrs {
+                    changes.push("xattrs".to_owned());
+                }
+                write!(f, "{}: {}", left.path.display(), changes.join(", "))
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::{symlink, PermissionsExt};
+    use tempfile::TempDir;
+
+    fn regular(path: &str, contents: &[u8], mode: u32) -> Result<Entry> {
+        let (size, sha256) = hash_contents(contents)?;
+        Ok(Entry {
+            path: PathBuf::from(path),
+            kind: EntryKind::Regular { size, sha256 },
+            mode,
+            uid: 0,
+            gid: 0,
+            xattrs: BTreeMap::new(),
+        })
+    }
+
+    #[test]
+    fn test_from_dir() -> Result<()> {
+        let dir = TempDir::new()?;
+        let root = dir.path();
+        std::fs::create_dir(root.join("bin"))?;
+        std::fs::write(root.join("bin/hello"), "hello")?;
+        std::fs::set_permissions(root.join("bin/hello"), PermissionsExt::from_mode(0o755))?;
+        symlink("hello", root.join("bin/hi"))?;
+        std::fs::hard_link(root.join("bin/hello"), root.join("bin/hello2"))?;
+
+        let manifest = LayerManifest::from_dir(root)?;
+        let paths: Vec<_> = manifest
+            .entries()
+            .map(|entry| entry.path.to_str().unwrap())
+            .collect();
+        assert_eq!(paths, ["bin", "bin/hello", "bin/hello2", "bin/hi"]);
+
+        let hello = manifest.get(Path::new("bin/hello")).unwrap();
+        assert_eq!(
+            hello.kind,
+            EntryKind::Regular {
+                size: 5,
+                sha256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+                    .to_owned(),
+            }
+        );
+        assert_eq!(hello.mode, 0o755);
+        let hello2 = manifest.get(Path::new("bin/hello2")).unwrap();
+        assert_eq!(
+            hello2.kind,
+            EntryKind::Hardlink {
+                target: PathBuf::from("bin/hello")
+            }
+        );
+        assert_eq!(hello2.mode, 0o755);
+        assert_eq!(
+            manifest.get(Path::new("bin/hi")).unwrap().kind,
+            EntryKind::Symlink {
+                target: PathBuf::from("hello")
+            }
+        );
+        assert_eq!(manifest.total_size(), 5);
+        Ok(())
+    }
+
+    #[test]
+    fn test_from_tar() -> Result<()> {
+        let mut builder = tar::Builder::new(Vec::new());
+        let mut header = tar::Header::new_gnu();
+        header.set_entry_type(tar::EntryType::Directory);
+        header.set_mode(0o755);
+        header.set_uid(0);
+        header.set_gid(0);
+        header.set_size(0);
+        builder.append_data(&mut header, "./", std::io::empty())?;
+        builder.append_data(&mut header, "./etc/", std::io::empty())?;
+
+        let mut header = tar::Header::new_gnu();
+        header.set_mode(0o4644);
+        header.set_uid(1000);
+        header.set_gid(1000);
+        header.set_size(5);
+        builder.append_data(&mut header, "./etc/passwd", &b"hello"[..])?;
+
+        let mut header = tar::Header::new_gnu();
+        header.set_entry_type(tar::EntryType::Link);
+        header.set_mode(0o644);
+        header.set_uid(0);
+        header.set_gid(0);
+        header.set_size(0);
+        builder.append_link(&mut header, "./etc/passwd-", "./etc/passwd")?;
+
+        let manifest = LayerManifest::from_tar(&builder.into_inner()?[..])?;
+        let paths: Vec<_> = manifest
+            .entries()
+            .map(|entry| entry.path.to_str().unwrap())
+            .collect();
+        assert_eq!(paths, ["etc", "etc/passwd", "etc/passwd-"]);
+
+        let mut passwd = regular("etc/passwd", b"hello", 0o4644)?;
+        passwd.uid = 1000;
+        passwd.gid = 1000;
+        assert_eq!(manifest.get(Path::new("etc/passwd")), Some(&passwd));
+        // The hard link shares the mode and the owner of the file regardless
+        // of its tar header.
+        assert_eq!(
+            manifest.get(Path::new("etc/passwd-")),
+            Some(&Entry {
+                path: PathBuf::from("etc/passwd-"),
+                kind: EntryKind::Hardlink {
+                    target: PathBuf::from("etc/passwd")
+                },
+                ..passwd
+            })
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_from_dir_xattrs() -> Result<()> {
+        let dir = TempDir::new()?;
+        let root = dir.path();
+        std::fs::write(root.join("ping"), "ping")?;
+        xattr::set(root.join("ping"), "user.foo", b"bar")?;
+        xattr::set(
+            root.join("ping"),
+            XATTR_FAKEFS_OVERRIDE,
+            b"0:20:104755:0:01000002",
+        )?;
+        std::fs::write(root.join("null"), "")?;
+        xattr::set(root.join("null"), XATTR_FAKEFS_OVERRIDE, b"0:0:20666:259:-")?;
+        std::fs::create_dir(root.join("home"))?;
+        xattr::set(root.join("home"), XATTR_FAKEFS_OVERRIDE, b"1000:1000")?;
+
+        let manifest = LayerManifest::from_dir(root)?;
+
+        let ping = manifest.get(Path::new("ping")).unwrap();
+        assert_eq!((ping.uid, ping.gid, ping.mode), (0, 20, 0o4755));
+        assert_eq!(
+            ping.xattrs,
+            BTreeMap::from([
+                (XATTR_CAPABILITY.to_owned(), "01000002".to_owned()),
+                ("user.foo".to_owned(), hex::encode("bar")),
+            ])
+        );
+        let null = manifest.get(Path::new("null")).unwrap();
+        assert_eq!(null.kind, EntryKind::Other);
+        assert_eq!(null.mode, 0o666);
+        assert!(null.xattrs.is_empty());
+        let home = manifest.get(Path::new("home")).unwrap();
+        assert_eq!(home.kind, EntryKind::Directory);
+        assert_eq!((home.uid, home.gid), (1000, 1000));
+        Ok(())
+    }
+
+    #[test]
+    fn test_from_tar_xattrs() -> Result<()> {
+        let mut records = Vec::new();
+        for (key, value) in [
+            ("SCHILY.xattr.user.fakefs.override", "0:0:100600:0:-"),
+            ("SCHILY.xattr.user.foo", "bar"),
+        ] {
+            // The length of a record includes its own digits.
+            let rest = format!(" {key}={value}\n");
+            let mut len = rest.len() + 1;
+            while len.to_string().len() + rest.len() > len {
+                len += 1;
+            }
+            records.extend_from_slice(format!("{len}{rest}").as_bytes());
+        }
+
+        let mut builder = tar::Builder::new(Vec::new());
+        let mut header = tar::Header::new_ustar();
+        header.set_entry_type(tar::EntryType::XHeader);
+        header.set_size(records.len() as u64);
+        builder.append_data(&mut header, "PaxHeader", &records[..])?;
+        let mut header = tar::Header::new_ustar();
+        header.set_mode(0o644);
+        header.set_uid(1000);
+        header.set_gid(1000);
+        header.set_size(0);
+        builder.append_data(&mut header, "shadow", std::io::empty())?;
+
+        let manifest = LayerManifest::from_tar(&builder.into_inner()?[..])?;
+        let mut shadow = regular("shadow", b"", 0o600)?;
+        shadow
+            .xattrs
+            .insert("user.foo".to_owned(), hex::encode("bar"));
+        assert_eq!(manifest.get(Path::new("shadow")), Some(&shadow));
+        Ok(())
+    }
+
+    #[test]
+    fn test_hardlinks_normalized() -> Result<()> {
+        // Hard links are recorded the same way regardless of the order in the
+        // tarball, as directories have no order of links.
+        let mut builder = tar::Builder::new(Vec::new());
+        let mut header = tar::Header::new_gnu();
+        header.set_mode(0o755);
+        header.set_uid(0);
+        header.set_gid(0);
+        header.set_size(5);
+        builder.append_data(&mut header, "c", &b"hello"[..])?;
+
+        let mut header = tar::Header::new_gnu();
+        header.set_entry_type(tar::EntryType::Link);
+        header.set_mode(0o644);
+        header.set_uid(1000);
+        header.set_gid(1000);
+        header.set_size(0);
+        builder.append_link(&mut header, "b", "c")?;
+        builder.append_link(&mut header, "a", "b")?;
+
+        let manifest = LayerManifest::from_tar(&builder.into_inner()?[..])?;
+
+        let dir = TempDir::new()?;
+        let root = dir.path();
+        std::fs::write(root.join("b"), "hello")?;
+        std::fs::set_permissions(root.join("b"), PermissionsExt::from_mode(0o755))?;
+        std::fs::hard_link(root.join("b"), root.join("a"))?;
+        std::fs::hard_link(root.join("b"), root.join("c"))?;
+        let mut dir_manifest = LayerManifest::from_dir(root)?;
+        for entry in dir_manifest.entries.values_mut() {
+            entry.uid = 0;
+            entry.gid = 0;
+        }
+
+        assert_eq!(manifest, dir_manifest);
+        let a = regular("a", b"hello", 0o755)?;
+        assert_eq!(manifest.get(Path::new("a")), Some(&a));
+        for path in ["b", "c"] {
+            assert_eq!(
+                manifest.get(Path::new(path)),
+                Some(&Entry {
+                    path: PathBuf::from(path),
+                    kind: EntryKind::Hardlink {
+                        target: PathBuf::from("a")
+                    },
+                    ..a.clone()
+                })
+            );
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_serialization() -> Result<()> {
+        let mut manifest = LayerManifest::new();
+        manifest.insert(regular("b", b"", 0o644)?);
+        manifest.insert(Entry {
+            path: PathBuf::from("a"),
+            kind: EntryKind::Symlink {
+                target: PathBuf::from("b"),
+            },
+            mode: 0o777,
+            uid: 0,
+            gid: 0,
+            xattrs: BTreeMap::new(),
+        });
+
+        let mut buf = Vec::new();
+        manifest.write(&mut buf)?;
+        assert_eq!(
+            String::from_utf8(buf.clone())?,
+            r#"{"path":"a","type":"symlink","target":"b","mode":511,"uid":0,"gid":0}
+{"path":"b","type":"regular","size":0,"sha256":"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855","mode":420,"uid":0,"gid":0}
+"#
+        );
+        assert_eq!(LayerManifest::read(&buf[..])?, manifest);
+        Ok(())
+    }
+
+    #[test]
+    fn test_diff() -> Result<()> {
+        let mut left = LayerManifest::new();
+        left.insert(regular("same", b"same", 0o644)?);
+        left.insert(regular("removed", b"", 0o644)?);
+        left.insert(regular("modified", b"old", 0o644)?);
+
+        let mut right = LayerManifest::new();
+        right.insert(regular("same", b"same", 0o644)?);
+        right.insert(regular("added", b"", 0o644)?);
+        right.insert(regular("modified", b"new", 0o755)?);
+
+        let differences: Vec<String> = left.diff(&right).iter().map(|d| d.to_string()).collect();
+        assert_eq!(
+            differences,
+            [
+                "added: Only in right",
+                "modified: contents, mode 644 != 755",
+                "removed: Only in left",
+            ]
+        );
+        assert!(left.diff(&left).is_empty());
+        Ok(())
+    }
+}
@@ -2,19 +2,57 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::{bail, ensure, Context, Result};
-use bytes::ByteOrder;
+use anyhow::{ensure, Context, Result};
 use processes::locate_system_binary;
 use runfiles::Runfiles;
+use sha2::{Digest, Sha256};
 use std::{
-    collections::HashMap,
+    collections::{BTreeMap, HashMap},
+    ffi::OsStr,
     fs::File,
     io::{Read, Seek, SeekFrom::Start, Write},
-    os::{fd::AsRawFd, unix::fs::MetadataExt},
+    os::{
+        fd::AsRawFd,
+        unix::{
+            ffi::OsStrExt,
+            fs::{FileExt, MetadataExt},
+        },
+    },
     path::Path,
     process::{Command, Stdio},
 };
 
+use crate::reader::{locate_xpak, read_xpak_index, Compression};
+
+/// The XPAK key to store SHA-256 digests of regular files in the package.
+///
+/// The value lists files in the form of "<hex digest>  <absolute path>" per
+/// line, sorted by path, just like the output of sha256sum(1).
+pub const CONTENTS_DIGESTS_XPAK_KEY: &str = "CONTENTS_DIGESTS";
+
+/// XPAK keys whose values differ between builds of the same package.
+const NONDETERMINISTIC_XPAK_KEYS: &[&str] = &["BUILD_TIME"];
+
+/// PAX extended header keys that are dropped on normalizing binary packages.
+/// Timestamps are cleared, and paths are recorded with GNU extensions instead.
+const DROPPED_PAX_KEYS: &[&str] = &["atime", "ctime", "mtime", "path", "linkpath"];
+
+/// The zstd compression level used on normalizing binary packages.
+const ZSTD_LEVEL: i32 = 3;
+
+/// The bzip2 compression level used on normalizing binary packages.
+const BZIP2_LEVEL: u32 = 9;
+
+/// A tar entry to be rewritten by [`BinaryPackage::normalize`].
+struct TarEntry {
+    path: Vec<u8>,
+    link_name: Option<Vec<u8>>,
+    header: tar::Header,
+    pax_extensions: Vec<(String, Vec<u8>)>,
+    data_position: u64,
+    size: u64,
+}
+
 /// Works with Portage binary package files (.tbz2).
 ///
 /// See https://www.mankier.com/5/xpak for the format specification.
@@ -37,25 +75,11 @@ pub struct Slot {
 impl BinaryPackage {
     /// Opens a Portage binary package file.
     pub fn open(path: &Path) -> Result<Self> {
-        let mut file = File::open(path).with_context(|| format!("open {path:?}"))?;
-        let metadata = std::fs::metadata(path)?;
-        let size = metadata.size();
-
-        if size < 24 {
-            bail!("corrupted .tbz2 file: size is too small")
-        }
-
-        const CORRUPTED: &str = "Corrupted .tbz2 file";
+        let file = File::open(path).with_context(|| format!("open {path:?}"))?;
+        let size = file.metadata()?.size();
+        let xpak_start = locate_xpak(&file, size)?;
 
-        expect_magic(&mut file, size - 4, "STOP").context(CORRUPTED)?;
-        expect_magic(&mut file, size - 16, "XPAKSTOP").context(CORRUPTED)?;
-
-        let xpak_offset: u64 = u64::from(read_u32(&mut file, size - 8).context(CORRUPTED)?);
-        let xpak_start = size - 8 - xpak_offset;
-
-        expect_magic(&mut file, xpak_start, "XPAKPACK").context(CORRUPTED)?;
-
-        let (xpak_order, xpak) = parse_xpak(&mut file, xpak_start, size)?;
+        let (xpak_order, xpak) = parse_xpak(&file, xpak_start, size)?;
 
         let category = std::str::from_utf8(
             xpak.get("CATEGORY")
@@ -194,6 +218,56 @@ impl BinaryPackage {
         Ok(())
     }
 
+    /// Computes SHA-256 digests of regular files in the tarball, keyed by
+    /// their absolute paths once installed.
+    pub fn compute_contents_digests(&mut self) -> Result<BTreeMap<String, String>> {
+        let mut digests = BTreeMap::new();
+        for entry in self.archive()?.entries()? {
+            let mut entry = entry?;
+            if !entry.header().entry_type().is_file() {
+                continue;
+            }
+            let path = normalize_tar_path(&entry.path_bytes())?;
+            let mut hasher = Sha256::new();
+            std::io::copy(&mut entry, &mut hasher)?;
+            digests.insert(path, hex::encode(hasher.finalize()));
+        }
+        Ok(digests)
+    }
+
+    /// Returns file digests recorded in the CONTENTS_DIGESTS XPAK entry, keyed
+    /// by their absolute paths. Returns None if the entry does not exist.
+    pub fn contents_digests(&self) -> Result<Option<BTreeMap<String, String>>> {
+        let Some(value) = self.xpak.get(CONTENTS_DIGESTS_XPAK_KEY) else {
+            return Ok(None);
+        };
+        let value = std::str::from_utf8(value)
+            .with_context(|| format!("{CONTENTS_DIGESTS_XPAK_KEY} is not UTF-8"))?;
+        let digests = value
+            .lines()
+            .map(|line| {
+                let (digest, path) = line.split_once("  ").with_context(|| {
+                    format!("Malformed line in {CONTENTS_DIGESTS_XPAK_KEY}: {line:?}")
+                })?;
+                Ok((path.to_string(), digest.to_string()))
+            })
+            .collect::<Result<_>>()?;
+        Ok(Some(digests))
+    }
+
+    /// Computes digests of the files in the package and records them in the
+    /// CONTENTS_DIGESTS XPAK entry.
+    pub fn embed_contents_digests(mut self) -> Result<()> {
+        let digests = self.compute_contents_digests()?;
+        let mut value = String::new();
+        for (path, digest) in digests {
+            value.push_str(&format!("{digest}  {path}\n"));
+        }
+        let mut xpak = self.xpak.clone();
+        xpak.insert(CONTENTS_DIGESTS_XPAK_KEY.to_string(), value.into_bytes());
+        self.replace_xpak(&xpak)
+    }
+
     // Writes the new XPAK to the `BinaryPackage`.
     pub fn replace_xpak(self, xpak: &HashMap<String, Vec<u8>>) -> Result<()> {
         // Reopen file with write permissions.
@@ -205,16 +279,212 @@ impl BinaryPackage {
         file.set_len(self.xpak_start)?;
         file.seek(Start(self.xpak_start))?;
 
-        write_xpak(&mut file, xpak)?;
+        append_xpak(&mut file, xpak)?;
+
+        Ok(())
+    }
+
+    /// Creates a Portage binary package at `output` from a compressed tarball
+    /// and XPAK entries, and opens it.
+    ///
+    /// CATEGORY, PF and SLOT entries are required to open the package.
+    pub fn create(tarball: &Path, xpak: &HashMap<String, Vec<u8>>, output: &Path) -> Result<Self> {
+        for key in ["CATEGORY", "PF", "SLOT"] {
+            ensure!(xpak.contains_key(key), "XPAK entry {key} is missing");
+        }
+
+        let mut file = File::create(output).with_context(|| format!("create {output:?}"))?;
+        std::io::copy(
+            &mut File::open(tarball).with_context(|| format!("open {tarball:?}"))?,
+            &mut file,
+        )?;
+        append_xpak(&mut file, xpak)?;
+        drop(file);
+
+        Self::open(output)
+    }
+
+    /// Rewrites a binary package so that building a package from the same
+    /// inputs yields an identical file.
+    ///
+    /// Tar entries are sorted by path and their timestamps are cleared, the
+    /// tarball is recompressed single-threaded at a fixed level in the same
+    /// format as the input, and XPAK entries that vary between builds, such as
+    /// BUILD_TIME, are removed.
+    pub fn normalize(path: &Path) -> Result<()> {
+        let mut pkg = Self::open(path)?;
+
+        let mut magic = Vec::new();
+        pkg.new_tarball_reader()?.take(4).read_to_end(&mut magic)?;
+        let compression = Compression::detect(&magic)
+            .with_context(|| format!("Unknown compression format of the tarball in {path:?}"))?;
+
+        // Decompress the tarball to a temporary file so that we can write
+        // entries in a different order.
+        let mut tarball = tempfile::tempfile()?;
+        match compression {
+            Compression::Zstd => std::io::copy(
+                &mut zstd::stream::read::Decoder::new(pkg.new_tarball_reader()?)?,
+                &mut tarball,
+            )?,
+            Compression::Bzip2 => std::io::copy(
+                &mut bzip2::read::MultiBzDecoder::new(pkg.new_tarball_reader()?),
+                &mut tarball,
+            )?,
+        };
+        tarball.rewind()?;
+
+        let mut entries = Vec::new();
+        for entry in tar::Archive::new(&tarball).entries()? {
+            let mut entry = entry?;
+            let header = entry.header().clone();
+            ensure!(
+                !header.entry_type().is_gnu_sparse(),
+                "Sparse files are not supported: {}",
+                String::from_utf8_lossy(&entry.path_bytes())
+            );
+            let pax_extensions = match entry.pax_extensions()? {
+                Some(extensions) => extensions
+                    .map(|extension| {
+                        let extension = extension?;
+                        Ok((
+                            extension.key()?.to_string(),
+                            extension.value_bytes().to_vec(),
+                        ))
+                    })
+                    .collect::<Result<Vec<_>>>()?
+                    .into_iter()
+                    .filter(|(key, _)| !DROPPED_PAX_KEYS.contains(&key.as_str()))
+                    .collect(),
+                None => Vec::new(),
+            };
+            entries.push(TarEntry {
+                path: entry.path_bytes().into_owned(),
+                link_name: entry.link_name_bytes().map(|name| name.into_owned()),
+                header,
+                pax_extensions,
+                data_position: entry.raw_file_position(),
+                size: entry.size(),
+            });
+        }
+
+        // Sort entries by path, except that hard links are placed at the end
+        // so that their targets are always extracted first.
+        entries.sort_by(|a, b| {
+            let a_key = (a.header.entry_type().is_hard_link(), &a.path);
+            let b_key = (b.header.entry_type().is_hard_link(), &b.path);
+            a_key.cmp(&b_key)
+        });
+
+        // Write the uncompressed tarball to another temporary file, and then
+        // compress it in the original format.
+        let mut new_tarball = tempfile::tempfile()?;
+        let mut builder = tar::Builder::new(&mut new_tarball);
+        for mut entry in entries {
+            if !entry.pax_extensions.is_empty() {
+                let data = encode_pax_records(&entry.pax_extensions);
+                let mut header = tar::Header::new_ustar();
+                header.set_entry_type(tar::EntryType::XHeader);
+                header.set_path("@PaxHeader")?;
+                header.set_mode(0o644);
+                header.set_mtime(0);
+                header.set_size(data.len().try_into()?);
+                header.set_cksum();
+                builder.append(&header, data.as_slice())?;
+            }
 
-        let xpak_end = file.stream_position()?;
-        write_be32(&mut file, (xpak_end - self.xpak_start).try_into()?)?;
-        file.write_all(b"STOP")?;
+            entry.header.set_mtime(0);
+            if let Some(gnu) = entry.header.as_gnu_mut() {
+                gnu.set_atime(0);
+                gnu.set_ctime(0);
+            }
+            let path = Path::new(OsStr::from_bytes(&entry.path));
+            let entry_type = entry.header.entry_type();
+            if entry_type.is_symlink() || entry_type.is_hard_link() {
+                let link_name = entry
+                    .link_name
+                    .as_deref()
+                    .with_context(|| format!("Link {path:?} has no target"))?;
+                builder.append_link(
+                    &mut entry.header,
+                    path,
+                    Path::new(OsStr::from_bytes(link_name)),
+                )?;
+            } else {
+                let mut data = &tarball;
+                data.seek(Start(entry.data_position))?;
+                builder.append_data(&mut entry.header, path, data.take(entry.size))?;
+            }
+        }
+        builder.into_inner()?;
+        new_tarball.rewind()?;
+
+        let dir = path.parent().context("Binary package path has no parent")?;
+        let mut output = tempfile::NamedTempFile::new_in(dir)?;
+        match compression {
+            Compression::Zstd => {
+                zstd::stream::copy_encode(&new_tarball, output.as_file_mut(), ZSTD_LEVEL)?
+            }
+            Compression::Bzip2 => {
+                let mut encoder = bzip2::write::BzEncoder::new(
+                    output.as_file_mut(),
+                    bzip2::Compression::new(BZIP2_LEVEL),
+                );
+                std::io::copy(&mut new_tarball, &mut encoder)?;
+                encoder.finish()?;
+            }
+        }
+
+        let mut xpak = pkg.xpak.clone();
+        for key in NONDETERMINISTIC_XPAK_KEYS {
+            xpak.remove(*key);
+        }
+        let file = output.as_file_mut();
+        append_xpak(file, &xpak)?;
+
+        file.set_permissions(std::fs::metadata(path)?.permissions())?;
+        output
+            .persist(path)
+            .with_context(|| format!("Failed to replace {path:?}"))?;
 
         Ok(())
     }
 }
 
+/// Converts a path in a tarball, e.g. "./usr/bin/hello", to the absolute path
+/// once installed, e.g. "/usr/bin/hello".
+fn normalize_tar_path(path: &[u8]) -> Result<String> {
+    let path = std::str::from_utf8(path)
+        .with_context(|| format!("Non-UTF-8 path in tarball: {path:?}"))?;
+    let path = path.trim_start_matches("./").trim_start_matches('/');
+    ensure!(
+        !path.contains('\n'),
+        "Path containing a newline in tarball: {path:?}"
+    );
+    Ok(format!("/{path}"))
+}
+
+/// Encodes PAX extended header records, each of which is in the form of
+/// "<length> <key>=<value>\n" where the length includes its own digits.
+pub fn encode_pax_records(records: &[(String, Vec<u8>)]) -> Vec<u8> {
+    let mut data = Vec::new();
+    for (key, value) in records {
+        let rest_len = 1 + key.len() + 1 + value.len() + 1;
+        let mut len = rest_len;
+        loop {
+            let next_len = rest_len + len.to_string().len();
+            if next_len == len {
+                break;
+            }
+            len = next_len;
+        }
+        data.extend_from_slice(format!("{len} {key}=").as_bytes());
+        data.extend_from_slice(value);
+        data.push(b'\n');
+    }
+    data
+}
+
 fn write_xpak(out: &mut impl std::io::Write, xpak: &HashMap<String, Vec<u8>>) -> Result<()> {
     let mut keys: Vec<_> = xpak.keys().collect();
     keys.sort();
@@ -251,77 +521,39 @@ fn write_xpak(out: &mut impl std::io::Write, xpak: &HashMap<String, Vec<u8>>) ->
     Ok(())
 }
 
-fn read_u32(f: &mut File, offset: u64) -> Result<u32> {
-    f.seek(Start(offset))?;
-    let mut buffer = [0_u8; std::mem::size_of::<u32>()];
-    f.read_exact(&mut buffer)?;
-    Ok(bytes::BigEndian::read_u32(&buffer))
+/// Writes the XPAK segment and the trailer at the current position of `file`.
+fn append_xpak(file: &mut File, xpak: &HashMap<String, Vec<u8>>) -> Result<()> {
+    let xpak_start = file.stream_position()?;
+    write_xpak(file, xpak)?;
+    let xpak_end = file.stream_position()?;
+    write_be32(file, (xpak_end - xpak_start).try_into()?)?;
+    file.write_all(b"STOP")?;
+    Ok(())
 }
 
 fn write_be32(file: &mut impl std::io::Write, data: usize) -> Result<()> {
     Ok(file.write_all(&u32::try_from(data)?.to_be_bytes())?)
 }
 
-fn expect_magic(f: &mut File, offset: u64, want: &str) -> Result<()> {
-    f.seek(Start(offset))?;
-    let mut got: String = "".to_string();
-    f.take(want.len() as u64).read_to_string(&mut got)?;
-    if got != want {
-        bail!("Bad magic: got {got}, want {want}");
-    }
-    Ok(())
-}
-
 fn parse_xpak(
-    file: &mut File,
+    file: &File,
     xpak_start: u64,
     size: u64,
 ) -> Result<(Vec<String>, HashMap<String, Vec<u8>>)> {
-    let index_len = u64::from(read_u32(file, xpak_start + 8)?);
-    let data_len = u64::from(read_u32(file, xpak_start + 12)?);
-    let index_start = xpak_start + 16;
-    let data_start = index_start + index_len;
-    if data_start + data_len != size - 16 {
-        bail!("corrupted .tbz2 file: data length inconsistency")
-    }
-
     let mut xpak: HashMap<String, Vec<u8>> = HashMap::new();
     let mut xpak_order: Vec<String> = Vec::new();
-    let mut index_pos = index_start;
-    while index_pos < data_start {
-        let name_len = u64::from(read_u32(file, index_pos)?);
-        index_pos += 4;
-        let mut name: String = String::new();
-        file.take(name_len).read_to_string(&mut name)?;
-        if name.len() != name_len.try_into()? {
-            bail!("Got '{name}', want a name of length {name_len}")
-        }
-
-        index_pos += name_len;
-        let data_offset = u64::from(read_u32(file, index_pos)?);
-        index_pos += 4;
-        let data_len = u64::from(read_u32(file, index_pos)?);
-        index_pos += 4;
-
-        file.seek(Start(data_start + data_offset))?;
-        let mut data = Vec::new();
-        file.take(data_len).read_to_end(&mut data)?;
-        if data.len() != data_len.try_into()? {
-            bail!(
-                "Got a buffer of length {}, want length {}",
-                data.len(),
-                data_len
-            );
-        }
-
-        xpak_order.push(name.clone());
-        xpak.insert(name, data);
+    for entry in read_xpak_index(file, xpak_start, size)? {
+        let mut data = vec![0_u8; entry.len.try_into()?];
+        file.read_exact_at(&mut data, entry.offset)?;
+        xpak_order.push(entry.key.clone());
+        xpak.insert(entry.key, data);
     }
     Ok((xpak_order, xpak))
 }
 
 #[cfg(test)]
 mod tests {
+    use crate::reader::BinaryPackageReader;
     use fileutil::SafeTempDir;
     use std::{collections::HashSet, path::PathBuf};
 
@@ -534,4 +766,145 @@ mod tests {
 
         Ok(())
     }
+
+    #[test]
+    fn create() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        let mut src = binary_package()?;
+        let tarball_path = dir.join("image.tar.zst");
+        std::io::copy(
+            &mut src.new_tarball_reader()?,
+            &mut File::create(&tarball_path)?,
+        )?;
+
+        let dest_path = dir.join("out.tbz2");
+        let mut dest = BinaryPackage::create(&tarball_path, src.xpak(), &dest_path)?;
+        assert_eq!(dest.xpak(), src.xpak());
+        assert_eq!(dest.category_pf(), src.category_pf());
+
+        let mut src_tarball = Vec::new();
+        src.new_tarball_reader()?.read_to_end(&mut src_tarball)?;
+        let mut dest_tarball = Vec::new();
+        dest.new_tarball_reader()?.read_to_end(&mut dest_tarball)?;
+        assert_eq!(dest_tarball, src_tarball);
+
+        // Packages without mandatory entries can't be opened.
+        let mut xpak = src.xpak().clone();
+        xpak.remove("CATEGORY");
+        assert!(BinaryPackage::create(&tarball_path, &xpak, &dir.join("bad.tbz2")).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn contents_digests() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let path = dir.path().join("out.tbz2");
+        std::fs::copy(testfile()?, &path)?;
+
+        let bp = BinaryPackage::open(&path)?;
+        assert_eq!(bp.contents_digests()?, None);
+        bp.embed_contents_digests()?;
+
+        let mut bp = BinaryPackage::open(&path)?;
+        let digests = bp
+            .contents_digests()?
+            .context("CONTENTS_DIGESTS is missing")?;
+        assert!(digests.contains_key("/usr/bin/hello"));
+        assert!(digests.values().all(|digest| digest.len() == 64));
+        assert_eq!(digests, bp.compute_contents_digests()?);
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_normalize_tar_path() -> Result<()> {
+        assert_eq!(normalize_tar_path(b"./usr/bin/hello")?, "/usr/bin/hello");
+        assert_eq!(normalize_tar_path(b"usr/bin/hello")?, "/usr/bin/hello");
+        assert!(normalize_tar_path(b"usr/bin/a\nb").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn normalize() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        let path = dir.join("out.tbz2");
+        std::fs::copy(testfile()?, &path)?;
+
+        BinaryPackage::normalize(&path)?;
+
+        let mut bp = BinaryPackage::open(&path)?;
+        assert!(!bp.xpak().contains_key("BUILD_TIME"));
+        assert_eq!(bp.category_pf(), "sys-apps/binpkg-test-1.2.3");
+
+        let mut paths = Vec::new();
+        for entry in bp.archive()?.entries()? {
+            let entry = entry?;
+            assert_eq!(entry.header().mtime()?, 0);
+            paths.push(entry.path_bytes().into_owned());
+        }
+        assert!(!paths.is_empty());
+        let mut sorted_paths = paths.clone();
+        sorted_paths.sort();
+        assert_eq!(paths, sorted_paths);
+
+        // Normalization is idempotent.
+        let normalized = std::fs::read(&path)?;
+        BinaryPackage::normalize(&path)?;
+        assert_eq!(std::fs::read(&path)?, normalized);
+
+        // The tarball is still valid.
+        let temp_dir = SafeTempDir::new()?;
+        bp.extract_image(temp_dir.path(), false)?;
+        assert!(temp_dir.path().join("usr/bin/hello").try_exists()?);
+
+        assert_eq!(
+            BinaryPackageReader::open(&path)?.compression()?,
+            Compression::Zstd
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn normalize_keeps_bzip2() -> Result<()> {
+        let dir = tempfile::tempdir()?;
+        let dir = dir.as_ref();
+
+        // Recompress the test package with bzip2.
+        let mut src = binary_package()?;
+        let tarball_path = dir.join("image.tar.bz2");
+        let mut encoder = bzip2::write::BzEncoder::new(
+            File::create(&tarball_path)?,
+            bzip2::Compression::default(),
+        );
+        std::io::copy(
+            &mut zstd::stream::read::Decoder::new(src.new_tarball_reader()?)?,
+            &mut encoder,
+        )?;
+        encoder.finish()?;
+        let path = dir.join("out.tbz2");
+        BinaryPackage::create(&tarball_path, src.xpak(), &path)?;
+
+        BinaryPackage::normalize(&path)?;
+
+        let reader = BinaryPackageReader::open(&path)?;
+        assert_eq!(reader.compression()?, Compression::Bzip2);
+        let mut paths = Vec::new();
+        for entry in reader.archive()?.entries()? {
+            let entry = entry?;
+            assert_eq!(entry.header().mtime()?, 0);
+            paths.push(entry.path_bytes().into_owned());
+        }
+        assert!(!paths.is_empty());
+        let mut sorted_paths = paths.clone();
+        sorted_paths.sort();
+        assert_eq!(paths, sorted_paths);
+
+        Ok(())
+    }
 }
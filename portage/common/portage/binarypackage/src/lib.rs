@@ -3,5 +3,7 @@
 // found in the LICENSE file.
 
 mod binarypackage;
+mod reader;
 
 pub use binarypackage::*;
+pub use reader::*;
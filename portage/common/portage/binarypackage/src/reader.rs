@@ -0,0 +1,414 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+use anyhow::{bail, ensure, Context, Result};
+use std::{
+    fs::File,
+    io::Read,
+    os::unix::fs::{FileExt, MetadataExt},
+    path::Path,
+};
+
+/// An entry of the XPAK index, locating the value of a key in the file.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct XpakIndexEntry {
+    pub key: String,
+    /// The offset of the value from the beginning of the file containing the
+    /// XPAK segment.
+    pub offset: u64,
+    pub len: u64,
+}
+
+/// Compression formats of tarballs in binary packages.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum Compression {
+    Zstd,
+    Bzip2,
+}
+
+impl Compression {
+    /// Detects the compression format from the magic number.
+    pub(crate) fn detect(magic: &[u8]) -> Option<Self> {
+        if magic.starts_with(&[0x28, 0xb5, 0x2f, 0xfd]) {
+            Some(Self::Zstd)
+        } else if magic.starts_with(b"BZh") {
+            Some(Self::Bzip2)
+        } else {
+            None
+        }
+    }
+}
+
+/// Reads a byte range of a file with positioned reads.
+///
+/// Readers don't share the file offset, so any number of them can read the
+/// same file at the same time.
+pub struct SectionReader<'a> {
+    file: &'a File,
+    pos: u64,
+    end: u64,
+}
+
+impl<'a> SectionReader<'a> {
+    pub fn new(file: &'a File, offset: u64, len: u64) -> Self {
+        Self {
+            file,
+            pos: offset,
+            end: offset + len,
+        }
+    }
+
+    /// Returns the number of bytes left to read.
+    pub fn remaining(&self) -> u64 {
+        self.end - self.pos
+    }
+}
+
+impl Read for SectionReader<'_> {
+    fn read(&mut self, buf: &mut [u8]) -> std::io::Result<usize> {
+        let len = buf
+            .len()
+            .min(usize::try_from(self.remaining()).unwrap_or(usize::MAX));
+        if len == 0 {
+            return Ok(0);
+        }
+        let size = self.file.read_at(&mut buf[..len], self.pos)?;
+        self.pos += size as u64;
+        Ok(size)
+    }
+}
+
+fn read_u32_at(file: &File, offset: u64) -> Result<u32> {
+    let mut buf = [0_u8; 4];
+    file.read_exact_at(&mut buf, offset)?;
+    Ok(u32::from_be_bytes(buf))
+}
+
+fn expect_magic_at(file: &File, offset: u64, want: &[u8]) -> Result<()> {
+    let mut got = vec![0_u8; want.len()];
+    file.read_exact_at(&mut got, offset)?;
+    if got != want {
+        bail!(
+            "Bad magic: got {}, want {}",
+            String::from_utf8_lossy(&got),
+            String::from_utf8_lossy(want)
+        );
+    }
+    Ok(())
+}
+
+/// Validates the trailer of a binary package of `size` bytes, and returns the
+/// offset where the XPAK segment starts.
+pub(crate) fn locate_xpak(file: &File, size: u64) -> Result<u64> {
+    const CORRUPTED: &str = "Corrupted .tbz2 file";
+
+    ensure!(size >= 24, "corrupted .tbz2 file: size is too small");
+
+    expect_magic_at(file, size - 4, b"STOP").context(CORRUPTED)?;
+    expect_magic_at(file, size - 16, b"XPAKSTOP").context(CORRUPTED)?;
+
+    let xpak_offset = u64::from(read_u32_at(file, size - 8).context(CORRUPTED)?);
+    let xpak_start = (size - 8).checked_sub(xpak_offset).context(CORRUPTED)?;
+
+    expect_magic_at(file, xpak_start, b"XPAKPACK").context(CORRUPTED)?;
+
+    Ok(xpak_start)
+}
+
+/// Parses the XPAK index without reading values.
+pub(crate) fn read_xpak_index(
+    file: &File,
+    xpak_start: u64,
+    size: u64,
+) -> Result<Vec<XpakIndexEntry>> {
+    let index_len = u64::from(read_u32_at(file, xpak_start + 8)?);
+    let data_len = u64::from(read_u32_at(file, xpak_start + 12)?);
+    let index_start = xpak_start + 16;
+    let data_start = index_start + index_len;
+    if data_start + data_len != size - 16 {
+        bail!("corrupted .tbz2 file: data length inconsistency")
+    }
+
+    let mut index = Vec::new();
+    let mut index_pos = index_start;
+    while index_pos < data_start {
+        let name_len = u64::from(read_u32_at(file, index_pos)?);
+        index_pos += 4;
+        let mut name = vec![0_u8; name_len.try_into()?];
+        file.read_exact_at(&mut name, index_pos)
+            .with_context(|| format!("Failed to read a name of length {name_len}"))?;
+        let key = String::from_utf8(name)?;
+        index_pos += name_len;
+
+        let value_offset = u64::from(read_u32_at(file, index_pos)?);
+        index_pos += 4;
+        let value_len = u64::from(read_u32_at(file, index_pos)?);
+        index_pos += 4;
+
+        if value_offset + value_len > data_len {
+            bail!("corrupted .tbz2 file: XPAK entry {key} is out of range");
+        }
+
+        index.push(XpakIndexEntry {
+            key,
+            offset: data_start + value_offset,
+            len: value_len,
+        });
+    }
+    Ok(index)
+}
+
+/// Reads Portage binary package files (.tbz2) without loading them into
+/// memory.
+///
+/// Unlike [`crate::BinaryPackage`], only the XPAK index is parsed on opening,
+/// and XPAK values and the tarball are read on demand with positioned reads.
+/// This is suitable to inspect large packages, e.g. chromeos-chrome.
+///
+/// A package can also be read from the split representation written by
+/// [`BinaryPackageReader::write_split`], i.e. a pair of the compressed tarball
+/// and the XPAK segment with its trailer. Concatenating the two files yields
+/// the .tbz2 file.
+pub struct BinaryPackageReader {
+    /// The file containing the tarball.
+    file: File,
+    tarball_len: u64,
+    /// The file containing the XPAK segment if it's not `file`.
+    xpak_file: Option<File>,
+    /// The range of the XPAK segment, including the trailer, in its file.
+    xpak_start: u64,
+    xpak_end: u64,
+    index: Vec<XpakIndexEntry>,
+}
+
+impl BinaryPackageReader {
+    /// Opens a Portage binary package file.
+    pub fn open(path: &Path) -> Result<Self> {
+        let file = File::open(path).with_context(|| format!("open {path:?}"))?;
+        let size = file.metadata()?.size();
+        let xpak_start = locate_xpak(&file, size)?;
+        let index = read_xpak_index(&file, xpak_start, size)?;
+        Ok(Self {
+            file,
+            tarball_len: xpak_start,
+            xpak_file: None,
+            xpak_start,
+            xpak_end: size,
+            index,
+        })
+    }
+
+    /// Opens a binary package split into a compressed tarball and an XPAK
+    /// file. It reads the same as the .tbz2 file they were split from.
+    pub fn open_split(tarball: &Path, xpak: &Path) -> Result<Self> {
+        let file = File::open(tarball).with_context(|| format!("open {tarball:?}"))?;
+        let tarball_len = file.metadata()?.size();
+        let xpak_file = File::open(xpak).with_context(|| format!("open {xpak:?}"))?;
+        let size = xpak_file.metadata()?.size();
+        let xpak_start = locate_xpak(&xpak_file, size).with_context(|| format!("{xpak:?}"))?;
+        ensure!(
+            xpak_start == 0,
+            "{xpak:?} has {xpak_start} extra bytes before the XPAK segment"
+        );
+        let index = read_xpak_index(&xpak_file, xpak_start, size)?;
+        Ok(Self {
+            file,
+            tarball_len,
+            xpak_file: Some(xpak_file),
+            xpak_start,
+            xpak_end: size,
+            index,
+        })
+    }
+
+    fn xpak_file(&self) -> &File {
+        self.xpak_file.as_ref().unwrap_or(&self.file)
+    }
+
+    /// Returns a reader of the XPAK segment including the trailer.
+    fn xpak_segment_reader(&self) -> SectionReader<'_> {
+        SectionReader::new(
+            self.xpak_file(),
+            self.xpak_start,
+            self.xpak_end - self.xpak_start,
+        )
+    }
+
+    /// Writes the package as a .tbz2 file.
+    pub fn write_tbz2(&self, output: &Path) -> Result<()> {
+        let mut file = File::create(output).with_context(|| format!("create {output:?}"))?;
+        std::io::copy(&mut self.tarball_reader(), &mut file)?;
+        std::io::copy(&mut self.xpak_segment_reader(), &mut file)?;
+        Ok(())
+    }
+
+    /// Writes the package split into a compressed tarball and an XPAK file,
+    /// which can be opened with [`BinaryPackageReader::open_split`].
+    pub fn write_split(&self, tarball: &Path, xpak: &Path) -> Result<()> {
+        let mut file = File::create(tarball).with_context(|| format!("create {tarball:?}"))?;
+        std::io::copy(&mut self.tarball_reader(), &mut file)?;
+        let mut file = File::create(xpak).with_context(|| format!("create {xpak:?}"))?;
+        std::io::copy(&mut self.xpak_segment_reader(), &mut file)?;
+        Ok(())
+    }
+
+    /// Returns the XPAK index in the order of the file.
+    pub fn xpak_index(&self) -> &[XpakIndexEntry] {
+        &self.index
+    }
+
+    fn find_xpak_entry(&self, key: &str) -> Option<&XpakIndexEntry> {
+        self.index.iter().find(|entry| entry.key == key)
+    }
+
+    /// Returns a reader of the XPAK value of `key`, or None if the key does
+    /// not exist.
+    pub fn xpak_value_reader(&self, key: &str) -> Option<SectionReader<'_>> {
+        self.find_xpak_entry(key)
+            .map(|entry| SectionReader::new(self.xpak_file(), entry.offset, entry.len))
+    }
+
+    /// Reads the XPAK value of `key`, or returns None if the key does not
+    /// exist.
+    pub fn read_xpak_value(&self, key: &str) -> Result<Option<Vec<u8>>> {
+        let Some(entry) = self.find_xpak_entry(key) else {
+            return Ok(None);
+        };
+        let mut value = vec![0_u8; entry.len.try_into()?];
+        self.xpak_file().read_exact_at(&mut value, entry.offset)?;
+        Ok(Some(value))
+    }
+
+    /// Returns a reader of the compressed tarball.
+    pub fn tarball_reader(&self) -> SectionReader<'_> {
+        SectionReader::new(&self.file, 0, self.tarball_len)
+    }
+
+    /// Detects the compression format of the tarball.
+    pub fn compression(&self) -> Result<Compression> {
+        let mut magic = Vec::new();
+        self.tarball_reader().take(4).read_to_end(&mut magic)?;
+        Compression::detect(&magic).context("Unknown compression format of the tarball")
+    }
+
+    /// Returns a reader of the decompressed tarball.
+    pub fn decompressed_tarball_reader(&self) -> Result<Box<dyn Read + '_>> {
+        let tarball = self.tarball_reader();
+        Ok(match self.compression()? {
+            Compression::Zstd => Box::new(zstd::stream::read::Decoder::new(tarball)?),
+            Compression::Bzip2 => Box::new(bzip2::read::MultiBzDecoder::new(tarball)),
+        })
+    }
+
+    /// Returns a tar archive to iterate over entries in the package.
+    pub fn archive(&self) -> Result<tar::Archive<Box<dyn Read + '_>>> {
+        Ok(tar::Archive::new(self.decompressed_tarball_reader()?))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use runfiles::Runfiles;
+    use std::path::PathBuf;
+
+    use super::*;
+    use crate::BinaryPackage;
+    use fileutil::SafeTempDir;
+
+    fn testfile() -> Result<PathBuf> {
+        let r = Runfiles::create()?;
+        Ok(runfiles::rlocation!(
+            r,
+            "cros/bazel/portage/common/portage/binarypackage/testdata/binpkg-test-1.2.3.tbz2"
+        ))
+    }
+
+    #[test]
+    fn xpak() -> Result<()> {
+        let path = testfile()?;
+        let reader = BinaryPackageReader::open(&path)?;
+        let pkg = BinaryPackage::open(&path)?;
+
+        let keys: Vec<&String> = reader.xpak_index().iter().map(|e| &e.key).collect();
+        assert_eq!(keys, pkg.xpak_order().iter().collect::<Vec<_>>());
+        for (key, value) in pkg.xpak() {
+            assert_eq!(reader.read_xpak_value(key)?.as_ref(), Some(value));
+
+            let mut streamed = Vec::new();
+            reader
+                .xpak_value_reader(key)
+                .context("missing key")?
+                .read_to_end(&mut streamed)?;
+            assert_eq!(&streamed, value);
+        }
+        assert_eq!(reader.read_xpak_value("NO_SUCH_KEY")?, None);
+
+        Ok(())
+    }
+
+    #[test]
+    fn tarball() -> Result<()> {
+        let path = testfile()?;
+        let reader = BinaryPackageReader::open(&path)?;
+        let mut pkg = BinaryPackage::open(&path)?;
+
+        let mut want = Vec::new();
+        pkg.new_tarball_reader()?.read_to_end(&mut want)?;
+        let mut got = Vec::new();
+        reader.tarball_reader().read_to_end(&mut got)?;
+        assert_eq!(got, want);
+
+        assert_eq!(reader.compression()?, Compression::Zstd);
+        let paths = reader
+            .archive()?
+            .entries()?
+            .map(|entry| Ok(entry?.path()?.to_string_lossy().into_owned()))
+            .collect::<Result<Vec<_>>>()?;
+        assert!(paths.iter().any(|path| path.ends_with("usr/bin/hello")));
+
+        Ok(())
+    }
+
+    /// Merging split files back is covered by the round-trip test of xpaktool.
+    #[test]
+    fn open_split() -> Result<()> {
+        let path = testfile()?;
+        let dir = SafeTempDir::new()?;
+        let tarball_path = dir.path().join("image.tar.zst");
+        let xpak_path = dir.path().join("image.xpak");
+
+        let reader = BinaryPackageReader::open(&path)?;
+        reader.write_split(&tarball_path, &xpak_path)?;
+
+        let split = BinaryPackageReader::open_split(&tarball_path, &xpak_path)?;
+        assert_eq!(split.xpak_index().len(), reader.xpak_index().len());
+        for entry in reader.xpak_index() {
+            assert_eq!(
+                split.read_xpak_value(&entry.key)?,
+                reader.read_xpak_value(&entry.key)?
+            );
+        }
+        let mut want = Vec::new();
+        reader.tarball_reader().read_to_end(&mut want)?;
+        let mut got = Vec::new();
+        split.tarball_reader().read_to_end(&mut got)?;
+        assert_eq!(got, want);
+        assert_eq!(split.compression()?, Compression::Zstd);
+
+        // The XPAK file must not be confused with the .tbz2 file.
+        assert!(BinaryPackageReader::open_split(&tarball_path, &path).is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn detect_compression() {
+        assert_eq!(
+            Compression::detect(&[0x28, 0xb5, 0x2f, 0xfd]),
+            Some(Compression::Zstd)
+        );
+        assert_eq!(Compression::detect(b"BZh9"), Some(Compression::Bzip2));
+        assert_eq!(Compression::detect(b"\x1f\x8b"), None);
+    }
+}
@@ -0,0 +1,505 @@
+// Copyright 2024 The ChromiumOS Authors
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//! Parser and serializer of Portage Manifest files.
+//!
+//! See https://www.gentoo.org/glep/glep-0044.html for the format.
+
+use anyhow::{bail, ensure, Context, Result};
+use blake2::Blake2b512;
+use sha2::{Digest, Sha256, Sha512};
+use std::{
+    collections::{BTreeMap, HashSet},
+    fmt::Display,
+    fs::File,
+    io::Read,
+    path::Path,
+    str::FromStr,
+};
+
+/// Hash algorithms supported for verifying files, in the order of preference.
+const SUPPORTED_HASHES: &[&str] = &["BLAKE2B", "SHA512", "SHA256"];
+
+/// The type of a Manifest entry.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum EntryKind {
+    /// A source archive of the package, fetched to `DISTDIR`.
+    Dist,
+    /// An ebuild file in the package directory.
+    Ebuild,
+    /// A file under the `files` directory of the package.
+    Aux,
+    /// Any other file in the package directory, e.g. `metadata.xml`.
+    Misc,
+}
+
+impl EntryKind {
+    fn as_str(&self) -> &'static str {
+        match self {
+            Self::Dist => "DIST",
+            Self::Ebuild => "EBUILD",
+            Self::Aux => "AUX",
+            Self::Misc => "MISC",
+        }
+    }
+}
+
+impl FromStr for EntryKind {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        Ok(match s {
+            "DIST" => Self::Dist,
+            "EBUILD" => Self::Ebuild,
+            "AUX" => Self::Aux,
+            "MISC" => Self::Misc,
+            _ => bail!("Unknown Manifest entry type: {s}"),
+        })
+    }
+}
+
+impl Display for EntryKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// An entry in a Manifest file, describing a file with its size and digests.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct ManifestEntry {
+    pub kind: EntryKind,
+    /// The file name. For `AUX` entries, it is relative to the `files`
+    /// directory.
+    pub filename: String,
+    /// The size of the file in bytes.
+    pub size: u64,
+    /// Hex-encoded digests of the file keyed by hash algorithm names, e.g.
+    /// "SHA512".
+    pub hashes: BTreeMap<String, String>,
+}
+
+fn compute_hash(name: &str, path: &Path) -> Result<String> {
+    fn digest<D: Digest>(mut file: File) -> Result<String> {
+        let mut hasher = D::new();
+        let mut buf = vec![0u8; 1 << 16];
+        loop {
+            let n = file.read(&mut buf)?;
+            if n == 0 {
+                break;
+            }
+            hasher.update(&buf[..n]);
+        }
+        Ok(hex::encode(hasher.finalize()))
+    }
+
+    let file = File::open(path).with_context(|| format!("Failed to open {}", path.display()))?;
+    match name {
+        "BLAKE2B" => digest::<Blake2b512>(file),
+        "SHA512" => digest::<Sha512>(file),
+        "SHA256" => digest::<Sha256>(file),
+        _ => bail!("Unsupported hash: {name}"),
+    }
+}
+
+impl ManifestEntry {
+    /// Parses a line of a Manifest file.
+    ///
+    /// In the lenient mode, lines of unknown entry types are ignored by
+    /// returning `None`, and a trailing hash name without a value is dropped,
+    /// as Portage does. In the strict mode, they are errors and the entry is
+    /// validated.
+    fn parse(line: &str, strict: bool) -> Result<Option<Self>> {
+        let mut columns = line.split_ascii_whitespace();
+        let kind = match columns.next().unwrap_or_default().parse() {
+            Ok(kind) => kind,
+            Err(_) if !strict => return Ok(None),
+            Err(err) => return Err(err),
+        };
+        let (Some(filename), Some(size)) = (columns.next(), columns.next()) else {
+            bail!("Corrupted Manifest line: {}", line);
+        };
+        let size = size
+            .parse()
+            .with_context(|| format!("Corrupted Manifest line: {}", line))?;
+        let columns: Vec<&str> = columns.collect();
+        ensure!(
+            !strict || columns.len() % 2 == 0,
+            "Corrupted Manifest line: {}",
+            line
+        );
+        let hashes = columns
+            .chunks_exact(2)
+            .map(|pair| (pair[0].to_owned(), pair[1].to_owned()))
+            .collect();
+        let entry = Self {
+            kind,
+            filename: filename.to_owned(),
+            size,
+            hashes,
+        };
+        if strict {
+            entry.validate()?;
+        }
+        Ok(Some(entry))
+    }
+
+    /// Checks that the entry is well-formed: the file name is non-empty and
+    /// has no whitespace, and there is at least one hash whose value is a
+    /// hex-encoded digest.
+    pub fn validate(&self) -> Result<()> {
+        ensure!(
+            !self.filename.is_empty() && !self.filename.contains(char::is_whitespace),
+            "Invalid file name in Manifest: {:?}",
+            self.filename
+        );
+        ensure!(
+            !self.hashes.is_empty(),
+            "{}: no hash found in Manifest",
+            self.filename
+        );
+        for (name, value) in &self.hashes {
+            ensure!(
+                !name.is_empty() && name.chars().all(|c| c.is_ascii_alphanumeric()),
+                "{}: invalid hash name {:?}",
+                self.filename,
+                name
+            );
+            ensure!(
+                !value.is_empty() && hex::decode(value).is_ok(),
+                "{}: invalid {} value {:?}",
+                self.filename,
+                name,
+                value
+            );
+        }
+        Ok(())
+    }
+
+    /// Verifies that the file at `path` matches the size and the most
+    /// preferred supported hash recorded in this entry. Other hashes are not
+    /// computed so that the file is read only once.
+    ///
+    /// It is an error if the entry has no supported hash.
+    pub fn verify(&self, path: &Path) -> Result<()> {
+        let size = std::fs::metadata(path)
+            .with_context(|| format!("Failed to stat {}", path.display()))?
+            .len();
+        ensure!(
+            size == self.size,
+            "{}: size mismatch: expected {}, got {}",
+            self.filename,
+            self.size,
+            size
+        );
+
+        let Some((name, expected)) = SUPPORTED_HASHES
+            .iter()
+            .find_map(|name| Some((*name, self.hashes.get(*name)?)))
+        else {
+            bail!("{}: no supported hash found in Manifest", self.filename);
+        };
+        let actual = compute_hash(name, path)?;
+        ensure!(
+            actual.eq_ignore_ascii_case(expected),
+            "{}: {} mismatch: expected {}, got {}",
+            self.filename,
+            name,
+            expected,
+            actual
+        );
+        Ok(())
+    }
+}
+
+impl Display for ManifestEntry {
+    /// Formats the entry as a Manifest line without a trailing newline.
+    /// Hashes are written in the alphabetical order of their names.
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{} {} {}", self.kind, self.filename, self.size)?;
+        for (name, value) in &self.hashes {
+            write!(f, " {} {}", name, value)?;
+        }
+        Ok(())
+    }
+}
+
+/// A parsed Manifest file of a package.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Manifest {
+    pub entries: Vec<ManifestEntry>,
+}
+
+impl Manifest {
+    fn parse_impl(contents: &str, strict: bool) -> Result<Self> {
+        let entries = contents
+            .lines()
+            .filter(|line| !line.trim().is_empty())
+            .filter_map(|line| ManifestEntry::parse(line, strict).transpose())
+            .collect::<Result<Vec<_>>>()?;
+        let manifest = Self { entries };
+        if strict {
+            manifest.validate()?;
+        }
+        Ok(manifest)
+    }
+
+    /// Parses the contents of a Manifest file. Empty lines are ignored.
+    ///
+    /// Like Portage, this accepts Manifest files that are not strictly
+    /// well-formed: lines of unknown entry types are skipped, and entries are
+    /// not validated. Use [`Manifest::parse_strict`] to reject them.
+    pub fn parse(contents: &str) -> Result<Self> {
+        Self::parse_impl(contents, false)
+    }
+
+    /// Parses the contents of a Manifest file, rejecting unknown entry types
+    /// and entries that don't pass [`Manifest::validate`].
+    pub fn parse_strict(contents: &str) -> Result<Self> {
+        Self::parse_impl(contents, true)
+    }
+
+    /// Loads a Manifest file with [`Manifest::parse`].
+    pub fn load(path: &Path) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse(&contents).with_context(|| format!("Failed to parse {}", path.display()))
+    }
+
+    /// Loads a Manifest file with [`Manifest::parse_strict`].
+    pub fn load_strict(path: &Path) -> Result<Self> {
+        let contents = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse_strict(&contents).with_context(|| format!("Failed to parse {}", path.display()))
+    }
+
+    /// Checks that all entries are well-formed and no file is listed twice.
+    ///
+    /// Distfiles live in a namespace separate from files in the package
+    /// directory, so a `DIST` entry may share its file name with another
+    /// entry.
+    pub fn validate(&self) -> Result<()> {
+        let mut seen = HashSet::new();
+        for entry in &self.entries {
+            entry.validate()?;
+            let is_dist = entry.kind == EntryKind::Dist;
+            ensure!(
+                seen.insert((is_dist, entry.filename.as_str())),
+                "{} is listed multiple times in Manifest",
+                entry.filename
+            );
+        }
+        Ok(())
+    }
+
+    /// Returns entries of a type.
+    pub fn entries_of(&self, kind: EntryKind) -> impl Iterator<Item = &ManifestEntry> {
+        self.entries.iter().filter(move |entry| entry.kind == kind)
+    }
+
+    /// Returns `DIST` entries.
+    pub fn dists(&self) -> impl Iterator<Item = &ManifestEntry> {
+        self.entries_of(EntryKind::Dist)
+    }
+
+    /// Finds the `DIST` entry of a distfile.
+    pub fn find_dist(&self, filename: &str) -> Option<&ManifestEntry> {
+        self.dists().find(|dist| dist.filename == filename)
+    }
+
+    /// Verifies a distfile at `path` against the `DIST` entry of `filename`.
+    pub fn verify_distfile(&self, filename: &str, path: &Path) -> Result<()> {
+        let dist = self
+            .find_dist(filename)
+            .with_context(|| format!("{filename} not found in Manifest"))?;
+        dist.verify(path)
+    }
+}
+
+impl Display for Manifest {
+    /// Formats the Manifest file contents, one entry per line in the stored
+    /// order.
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        for entry in &self.entries {
+            writeln!(f, "{entry}")?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use tempfile::TempDir;
+
+    use super::*;
+
+    const CONTENTS: &[u8] = b"hello, world\n";
+
+    fn manifest_for(contents: &[u8]) -> String {
+        format!(
+            "AUX fix.patch 10 SHA256 00\n\
+             DIST hello-1.0.tar.gz {} BLAKE2B {} SHA512 {}\n\
+             EBUILD hello-1.0.ebuild 100 SHA256 00\n",
+            contents.len(),
+            hex::encode(Blake2b512::digest(contents)),
+            hex::encode(Sha512::digest(contents)),
+        )
+    }
+
+    #[test]
+    fn test_parse() -> Result<()> {
+        let manifest = Manifest::parse(
+            "DIST a.tar.gz 123 SHA256 abcd SHA512 ef01\nEBUILD a-1.ebuild 1 SHA256 00\n\n",
+        )?;
+        assert_eq!(
+            manifest,
+            Manifest {
+                entries: vec![
+                    ManifestEntry {
+                        kind: EntryKind::Dist,
+                        filename: "a.tar.gz".to_owned(),
+                        size: 123,
+                        hashes: BTreeMap::from([
+                            ("SHA256".to_owned(), "abcd".to_owned()),
+                            ("SHA512".to_owned(), "ef01".to_owned()),
+                        ]),
+                    },
+                    ManifestEntry {
+                        kind: EntryKind::Ebuild,
+                        filename: "a-1.ebuild".to_owned(),
+                        size: 1,
+                        hashes: BTreeMap::from([("SHA256".to_owned(), "00".to_owned())]),
+                    },
+                ],
+            }
+        );
+        assert_eq!(
+            manifest
+                .dists()
+                .map(|d| d.filename.as_str())
+                .collect::<Vec<_>>(),
+            vec!["a.tar.gz"]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn test_parse_errors() {
+        for contents in [
+            "DIST a.tar.gz\n",
+            "DIST a.tar.gz x SHA256 abcd\n",
+            "DIST a.tar.gz 123 SHA256\n",
+            "DIST a.tar.gz 123\n",
+            "DIST a.tar.gz 123 SHA256 xyz0\n",
+            "DIST a.tar.gz 123 SHA256 abc\n",
+            "FOO a.tar.gz 123 SHA256 abcd\n",
+            "DIST a.tar.gz 123 SHA256 abcd\nDIST a.tar.gz 123 SHA256 abcd\n",
+        ] {
+            assert!(
+                Manifest::parse_strict(contents).is_err(),
+                "{contents:?} should be invalid"
+            );
+        }
+    }
+
+    #[test]
+    fn test_parse_lenient() -> Result<()> {
+        let manifest = Manifest::parse(
+            "FOO a.tar.gz 123 SHA256 abcd\n\
+             IGNORE foo\n\
+             DIST a.tar.gz 123 SHA256 xyz0 SHA512\n\
+             DIST a.tar.gz 123\n",
+        )?;
+        assert_eq!(
+            manifest.entries,
+            vec![
+                ManifestEntry {
+                    kind: EntryKind::Dist,
+                    filename: "a.tar.gz".to_owned(),
+                    size: 123,
+                    hashes: BTreeMap::from([("SHA256".to_owned(), "xyz0".to_owned())]),
+                },
+                ManifestEntry {
+                    kind: EntryKind::Dist,
+                    filename: "a.tar.gz".to_owned(),
+                    size: 123,
+                    hashes: BTreeMap::new(),
+                },
+            ]
+        );
+        assert!(manifest.validate().is_err());
+
+        // Lines without a file name or a size are still errors.
+        for contents in ["DIST a.tar.gz\n", "DIST a.tar.gz x SHA256 abcd\n"] {
+            assert!(
+                Manifest::parse(contents).is_err(),
+                "{contents:?} should be invalid"
+            );
+        }
+        Ok(())
+    }
+
+    #[test]
+    fn test_same_name_in_different_namespaces() -> Result<()> {
+        let manifest = Manifest::parse("AUX a.patch 1 SHA256 00\nDIST a.patch 1 SHA256 00\n")?;
+        assert_eq!(manifest.entries.len(), 2);
+        Ok(())
+    }
+
+    #[test]
+    fn test_serialize() -> Result<()> {
+        let contents = manifest_for(CONTENTS);
+        let manifest = Manifest::parse(&contents)?;
+        assert_eq!(manifest.to_string(), contents);
+        Ok(())
+    }
+
+    #[test]
+    fn test_verify_distfile() -> Result<()> {
+        let temp_dir = TempDir::new()?;
+        let path = temp_dir.path().join("hello-1.0.tar.gz");
+        std::fs::write(&path, CONTENTS)?;
+        std::fs::write(temp_dir.path().join("Manifest"), manifest_for(CONTENTS))?;
+
+        let manifest = Manifest::load(&temp_dir.path().join("Manifest"))?;
+        manifest.verify_distfile("hello-1.0.tar.gz", &path)?;
+
+        // Same size, different contents.
+        std::fs::write(&path, b"HELLO, WORLD\n")?;
+        let err = manifest
+            .verify_distfile("hello-1.0.tar.gz", &path)
+            .unwrap_err();
+        assert!(err.to_string().contains("BLAKE2B mismatch"), "{err:?}");
+
+        // Different size.
+        std::fs::write(&path, b"hello\n")?;
+        let err = manifest
+            .verify_distfile("hello-1.0.tar.gz", &path)
+            .unwrap_err();
+        assert!(err.to_string().contains("size mismatch"), "{err:?}");
+
+        // Unknown distfile.
+        let other_path = temp_dir.path().join("other.tar.gz");
+        std::fs::write(&other_path, CONTENTS)?;
+        assert!(manifest
+            .verify_distfile("other.tar.gz", &other_path)
+            .is_err());
+
+        Ok(())
+    }
+
+    #[test]
+    fn test_verify_without_supported_hash() -> Result<()> {
+        let temp_dir = TempDir::new()?;
+        let path = temp_dir.path().join("a.tar.gz");
+        std::fs::write(&path, CONTENTS)?;
+        let dist = ManifestEntry {
+            kind: EntryKind::Dist,
+            filename: "a.tar.gz".to_owned(),
+            size: CONTENTS.len() as u64,
+            hashes: BTreeMap::from([("MD5".to_owned(), "00".to_owned())]),
+        };
+        assert!(dist.verify(&path).is_err());
+        Ok(())
+    }
+}
@@ -137,7 +137,14 @@ impl Version {
         }
     }
 
-    /// Checks if the [`Version`] has `prefix` as a prefix.
+    /// Checks if the [`Version`] has `prefix` as a prefix in the sense of
+    /// `=cat/pkg-ver*` dependency atoms.
+    ///
+    /// PMS only says that the asterisk acts as a wildcard for further version
+    /// components. We follow Portage, which performs a literal prefix match on
+    /// version strings but only accepts matches ending on a boundary between
+    /// version parts, so "1.2" does not match "1.20" and "9" does not match
+    /// "9999". Leading zeros of the major component are insignificant.
     ///
     /// # Example
     ///
@@ -148,43 +155,30 @@ impl Version {
     /// assert_eq!(true, Version::try_new("1.2.3g_beta7_p4-r8")?.starts_with(&Version::try_new("1.2")?));
     /// assert_eq!(false, Version::try_new("1.2.3g_beta7_p4-r8")?.starts_with(&Version::try_new("1.2.4")?));
     /// assert_eq!(false, Version::try_new("1.2.3g_beta7_p4-r8")?.starts_with(&Version::try_new("1.2.3g_p4-r8")?));
+    /// assert_eq!(false, Version::try_new("1.20")?.starts_with(&Version::try_new("1.2")?));
     /// # Ok::<(), anyhow::Error>(())
     /// ```
     pub fn starts_with(&self, prefix: &Version) -> bool {
-        let trimed_version = (|| {
-            let mut copy = self.clone();
-
-            if !prefix.revision.is_empty() {
-                return copy;
-            }
-            copy.revision.clear();
-
-            if copy.suffixes.len() > prefix.suffixes.len() {
-                copy.suffixes.truncate(prefix.suffixes.len());
-            }
-            if copy.suffixes.len() == prefix.suffixes.len() {
-                if let Some(suffix) = prefix.suffixes.last() {
-                    if suffix.number.is_empty() {
-                        copy.suffixes.last_mut().unwrap().number.clear();
-                    }
-                }
-            }
-            if !prefix.suffixes.is_empty() {
-                return copy;
-            }
-
-            if !prefix.letter.is_empty() {
-                return copy;
-            }
-            copy.letter.clear();
-
-            if copy.main.len() > prefix.main.len() {
-                copy.main.truncate(prefix.main.len());
-            }
-            copy
-        })();
+        let text = self.to_string_without_leading_zeros();
+        let prefix = prefix.to_string_without_leading_zeros();
+        let Some(rest) = text.strip_prefix(&prefix) else {
+            return false;
+        };
+        match rest.chars().next() {
+            None => true,
+            Some('.' | '_' | '-') => true,
+            // A letter following a number, or a number following a suffix
+            // label, e.g. "1.2" matching "1.2a", or "1_rc" matching "1_rc3".
+            Some(c) => prefix.ends_with(|p: char| p.is_ascii_digit()) != c.is_ascii_digit(),
+        }
+    }
 
-        &trimed_version == prefix
+    /// Formats the version with leading zeros of the major component removed.
+    fn to_string_without_leading_zeros(&self) -> String {
+        let text = self.to_string();
+        let major = self.main[0].trim_start_matches('0');
+        let major = if major.is_empty() { "0" } else { major };
+        format!("{}{}", major, &text[self.main[0].len()..])
     }
 }
 
@@ -491,6 +485,46 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_starts_with() -> Result<()> {
+        // (version, prefix, expected)
+        let cases = [
+            ("1.2", "1.2", true),
+            ("1.2.3", "1.2", true),
+            ("1.2.3", "1", true),
+            ("1.2a", "1.2", true),
+            ("1.2_rc1", "1.2", true),
+            ("1.2-r1", "1.2", true),
+            ("1.20", "1.2", false),
+            ("1.2", "1.2.3", false),
+            ("1.02", "1.2", false),
+            ("1.00", "1.0", false),
+            ("1.0.1", "1.0", true),
+            ("9999", "9", false),
+            ("9999", "9999", true),
+            ("1.2_rc1", "1.2_rc", true),
+            ("1.2_rc10", "1.2_rc1", false),
+            ("1.2_rc1_p2", "1.2_rc1", true),
+            ("1.2_rc1", "1.2_rc01", false),
+            ("1.2_pre1", "1.2_p", false),
+            ("1.2", "1.2_rc", false),
+            ("1.2-r1", "1.2-r1", true),
+            ("1.2-r10", "1.2-r1", false),
+            ("1.2-r1", "1.2-r01", false),
+            ("1.2.3", "01.2", true),
+            ("001.2.3", "1.2", true),
+            ("0.1", "00", true),
+        ];
+        for (version, prefix, expected) in cases {
+            assert_eq!(
+                Version::try_new(version)?.starts_with(&Version::try_new(prefix)?),
+                expected,
+                "{version} starts with {prefix}"
+            );
+        }
+        Ok(())
+    }
+
     proptest! {
         #[test]
         fn proptest_parse_no_crash(s in "\\PC*") {
@@ -15,6 +15,21 @@ use std::{
 };
 use tracing::instrument;
 
+/// Events reported to the observer of [`run_with_observer`].
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ProcessEvent {
+    /// The child process has been spawned.
+    Started { pid: u32 },
+    /// A signal received by the current process has been forwarded to the
+    /// child process.
+    SignalForwarded { pid: u32, signal: Signal },
+    /// A signal received by the current process has been ignored because the
+    /// child process is expected to receive it directly.
+    SignalIgnored { pid: u32, signal: Signal },
+    /// The child process has exited.
+    Exited { pid: u32, status: ExitStatus },
+}
+
 // run runs a child process, with some special signal handling:
 //   - Forwards SIGTERM to the child processes
 //   - Ignores SIGINT while the processes is running. SIGINT is normally generated
@@ -23,24 +38,50 @@ use tracing::instrument;
 //     should receive the signal by default so we don't need to forward it. One
 //     exception is if the child puts itself into a different processes group, but
 //     we want to avoid that.
-#[instrument(skip_all, fields(command = %cmd.get_program().to_string_lossy()))]
 pub fn run(cmd: &mut Command) -> Result<ExitStatus> {
+    run_with_observer(cmd, |_| {})
+}
+
+/// Same as [`run`], but calls `observer` on lifecycle events of the child
+/// process, e.g. to log signal forwarding decisions.
+#[instrument(skip_all, fields(command = %cmd.get_program().to_string_lossy()))]
+pub fn run_with_observer(
+    cmd: &mut Command,
+    mut observer: impl FnMut(&ProcessEvent),
+) -> Result<ExitStatus> {
     // Register the signal handler before spawning the process to ensure we don't drop any signals.
     let mut signals = Signals::new([SIGCHLD, SIGINT, SIGTERM])?;
 
     let mut child = cmd.spawn()?;
+    let pid = child.id();
+    observer(&ProcessEvent::Started { pid });
 
     for signal in signals.forever() {
         match signal {
             SIGCHLD => match &child.try_wait()? {
-                Some(status) => return Ok(*status),
+                Some(status) => {
+                    observer(&ProcessEvent::Exited {
+                        pid,
+                        status: *status,
+                    });
+                    return Ok(*status);
+                }
                 None => continue,
             },
-            SIGINT => {}
-            SIGTERM => nix::sys::signal::kill(
-                nix::unistd::Pid::from_raw(child.id().try_into()?),
-                Signal::SIGTERM,
-            )?,
+            SIGINT => observer(&ProcessEvent::SignalIgnored {
+                pid,
+                signal: Signal::SIGINT,
+            }),
+            SIGTERM => {
+                nix::sys::signal::kill(
+                    nix::unistd::Pid::from_raw(pid.try_into()?),
+                    Signal::SIGTERM,
+                )?;
+                observer(&ProcessEvent::SignalForwarded {
+                    pid,
+                    signal: Signal::SIGTERM,
+                });
+            }
             _ => unreachable!(),
         }
     }
@@ -49,9 +90,9 @@ pub fn run(cmd: &mut Command) -> Result<ExitStatus> {
 
 #[instrument(skip_all, fields(command = %cmd.get_program().to_string_lossy()))]
 pub fn run_and_check(cmd: &mut Command) -> Result<()> {
-    let stauts = run(cmd)?;
-    if !stauts.success() {
-        bail!("Command {cmd:?} failed with {stauts}");
+    let status = run(cmd)?;
+    if !status.success() {
+        bail!("Command {cmd:?} failed with {status}");
     }
 
     Ok(())
@@ -107,6 +148,20 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn observes_lifecycle() -> Result<()> {
+        let mut events = Vec::new();
+        let status = run_with_observer(&mut Command::new("false"), |event| events.push(*event))?;
+
+        assert_eq!(events.len(), 2);
+        let pid = match events[0] {
+            ProcessEvent::Started { pid } => pid,
+            event => panic!("Unexpected event: {event:?}"),
+        };
+        assert_eq!(events[1], ProcessEvent::Exited { pid, status });
+        Ok(())
+    }
+
     #[test]
     fn test_locate_system_binary() {
         locate_system_binary("bash").unwrap();
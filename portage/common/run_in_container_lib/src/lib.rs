@@ -2,19 +2,154 @@
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-use anyhow::Result;
+use anyhow::{bail, Result};
 use serde::{Deserialize, Serialize};
 use std::collections::BTreeMap;
 use std::ffi::OsString;
 use std::fs::File;
 use std::io::BufReader;
 use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::time::{Duration, Instant};
+
+/// The exit code of run_in_container when the command is terminated due to
+/// --timeout. It follows the convention of timeout(1).
+pub const TIMEOUT_EXIT_CODE: u8 = 124;
+
+/// The exit code of run_in_container when it fails to set up the container
+/// and the command may not have run. It follows the convention of env(1).
+pub const SETUP_FAILURE_EXIT_CODE: u8 = 125;
+
+/// The host name of containers unless specified otherwise.
+pub const DEFAULT_HOSTNAME: &str = "cros-bazel";
+
+/// The content of /etc/machine-id in containers unless specified otherwise.
+/// It is an arbitrary fixed value so that artifacts embedding the machine ID
+/// are reproducible.
+pub const DEFAULT_MACHINE_ID: &str = "c7b5a6d1e4f24b5f9d3c2a1b0e8f7d6c";
+
+/// Propagation type of a bind mount, see mount_namespaces(7).
+///
+/// Propagation is relative to the mount namespace that prepared the container.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum MountPropagation {
+    /// Mount events never propagate between the container and the outside.
+    #[default]
+    Private,
+    /// Mount events under the mount point propagate into the container, but
+    /// not vice versa.
+    Slave,
+    /// Mount events under the mount point propagate in both directions.
+    Shared,
+}
+
+impl FromStr for MountPropagation {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        Ok(match s {
+            "private" => Self::Private,
+            "slave" => Self::Slave,
+            "shared" => Self::Shared,
+            _ => bail!("unknown mount propagation: {s}"),
+        })
+    }
+}
+
+/// Network configuration of a container.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum NetworkMode {
+    /// The container has its own network namespace where only the loopback
+    /// interface is available.
+    #[default]
+    None,
+    /// The container shares the network namespace of the host.
+    Host,
+    /// The container has its own network namespace connected to the outside
+    /// with slirp4netns, a userspace network stack that works without
+    /// privileges. slirp4netns must be installed on the host.
+    Slirp,
+}
+
+impl FromStr for NetworkMode {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        Ok(match s {
+            "none" => Self::None,
+            "host" => Self::Host,
+            "slirp" => Self::Slirp,
+            _ => bail!("unknown network mode: {s}"),
+        })
+    }
+}
+
+/// Resource limits of a container, enforced with cgroup v2.
+#[derive(Clone, Debug, Default, PartialEq)]
+pub struct ResourceLimits {
+    /// The maximum memory usage in bytes.
+    pub memory: Option<u64>,
+    /// The maximum CPU bandwidth in number of CPUs, e.g. 1.5.
+    pub cpus: Option<f64>,
+    /// The maximum number of processes and threads.
+    pub pids: Option<u64>,
+}
+
+impl ResourceLimits {
+    /// Returns whether no limit is set.
+    pub fn is_empty(&self) -> bool {
+        self.memory.is_none() && self.cpus.is_none() && self.pids.is_none()
+    }
+
+    /// Returns run_in_container flags to apply the limits.
+    pub fn to_args(&self) -> Vec<String> {
+        let mut args = Vec::new();
+        if let Some(memory) = self.memory {
+            args.push(format!("--memory-limit={memory}"));
+        }
+        if let Some(cpus) = self.cpus {
+            args.push(format!("--cpu-limit={cpus}"));
+        }
+        if let Some(pids) = self.pids {
+            args.push(format!("--pids-limit={pids}"));
+        }
+        args
+    }
+}
 
 #[derive(Clone, Debug, Serialize, Deserialize)]
 pub struct BindMountConfig {
     pub mount_path: PathBuf,
     pub source: PathBuf,
     pub rw: bool,
+    #[serde(default)]
+    pub propagation: MountPropagation,
+}
+
+/// Time spent on a phase of setting up a container, e.g. mounting a layer.
+#[derive(Clone, Debug, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SetupPhase {
+    pub name: String,
+    pub duration: Duration,
+}
+
+/// Runs `f` and records its duration to `phases` as a phase named `name`.
+///
+/// The duration is recorded even if `f` fails.
+pub fn time_phase<T>(
+    phases: &mut Vec<SetupPhase>,
+    name: impl Into<String>,
+    f: impl FnOnce() -> Result<T>,
+) -> Result<T> {
+    let start = Instant::now();
+    let result = f();
+    phases.push(SetupPhase {
+        name: name.into(),
+        duration: start.elapsed(),
+    });
+    result
 }
 
 #[derive(Clone, Debug, Serialize, Deserialize)]
@@ -33,12 +168,54 @@ pub struct RunInContainerConfig {
     /// Directory to use as the working directory while inside the namespace.
     pub chdir: PathBuf,
 
-    /// Allows network access. This option should be used only when it's
-    /// absolutely needed since it reduces hermeticity.
-    pub allow_network_access: bool,
+    /// Network configuration. Modes other than [`NetworkMode::None`] allow
+    /// network access, so they should be used only when it's absolutely
+    /// needed since they reduce hermeticity.
+    #[serde(default)]
+    pub network: NetworkMode,
 
     /// If true, the contents of the host machine are mounted at /host.
     pub keep_host_mount: bool,
+
+    /// Paths in the container to hide from processes. Directories are masked
+    /// by an empty read-only tmpfs, and other files are masked by bind-mounting
+    /// /dev/null. Non-existent paths are ignored.
+    #[serde(default)]
+    pub mask_paths: Vec<PathBuf>,
+
+    /// The size of the tmpfs mounted at /dev/shm, in the format accepted by
+    /// the tmpfs "size" mount option, e.g. "64m" or "50%". If unset, the
+    /// kernel default (half of the RAM) is used.
+    #[serde(default)]
+    pub shm_size: Option<String>,
+
+    /// Host device files bind-mounted at the same paths in the container, in
+    /// addition to the minimal set of devices always available, e.g.
+    /// /dev/kvm.
+    #[serde(default)]
+    pub devices: Vec<PathBuf>,
+
+    /// The host name of the container. If unset, [`DEFAULT_HOSTNAME`] is used.
+    #[serde(default)]
+    pub hostname: Option<String>,
+
+    /// The machine ID bind-mounted at /etc/machine-id in the container. If
+    /// unset, [`DEFAULT_MACHINE_ID`] is used.
+    #[serde(default)]
+    pub machine_id: Option<String>,
+
+    /// Bind mounts already set up in `root_dir`. run_in_container uses them
+    /// only to keep their mount propagation; all other mounts are made
+    /// private.
+    #[serde(default)]
+    pub bind_mounts: Vec<BindMountConfig>,
+
+    /// Phases of setting up the container done before starting
+    /// run_in_container, such as extracting layers and mounting overlayfs.
+    /// run_in_container reports them along with its own phases on
+    /// --profile-mounts.
+    #[serde(default)]
+    pub setup_phases: Vec<SetupPhase>,
 }
 
 impl RunInContainerConfig {
@@ -52,6 +229,83 @@ impl RunInContainerConfig {
     }
 }
 
+/// Validates a size value for the tmpfs "size" mount option.
+///
+/// A valid value is a positive integer optionally followed by a "k", "m" or
+/// "g" suffix, or a percentage of the RAM such as "50%". This is meant to be
+/// used as a clap value parser.
+pub fn parse_tmpfs_size(value: &str) -> Result<String> {
+    let digits = value.trim_end_matches(['k', 'm', 'g', 'K', 'M', 'G', '%']);
+    if value.len() - digits.len() > 1 {
+        bail!("invalid size suffix: {value}");
+    }
+    match digits.parse::<u64>() {
+        Ok(0) | Err(_) => bail!("invalid size: {value}"),
+        Ok(_) => Ok(value.to_owned()),
+    }
+}
+
+/// Validates a host name of a container.
+///
+/// A valid host name consists of up to 64 letters, digits, hyphens and dots.
+/// This is meant to be used as a clap value parser.
+pub fn parse_hostname(value: &str) -> Result<String> {
+    if value.is_empty() || value.len() > 64 {
+        bail!("host name must be 1 to 64 characters long: {value:?}");
+    }
+    if !value
+        .chars()
+        .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '.')
+    {
+        bail!("invalid host name: {value:?}");
+    }
+    Ok(value.to_owned())
+}
+
+/// Validates a machine ID in the format of /etc/machine-id, i.e. 32
+/// lowercase hexadecimal digits that are not all zeros. This is meant to be
+/// used as a clap value parser.
+pub fn parse_machine_id(value: &str) -> Result<String> {
+    if value.len() != 32 || !value.chars().all(|c| matches!(c, '0'..='9' | 'a'..='f')) {
+        bail!("machine ID must be 32 lowercase hexadecimal digits: {value:?}");
+    }
+    if value.chars().all(|c| c == '0') {
+        bail!("machine ID must not be all zeros");
+    }
+    Ok(value.to_owned())
+}
+
+/// Parses a memory limit in bytes.
+///
+/// A valid value is a positive integer optionally followed by a "k", "m", "g"
+/// or "t" suffix, which are binary units, e.g. "512m" for 512 MiB. This is
+/// meant to be used as a clap value parser.
+pub fn parse_memory_limit(value: &str) -> Result<u64> {
+    let (digits, shift) = match value.chars().last().map(|c| c.to_ascii_lowercase()) {
+        Some('k') => (&value[..value.len() - 1], 10),
+        Some('m') => (&value[..value.len() - 1], 20),
+        Some('g') => (&value[..value.len() - 1], 30),
+        Some('t') => (&value[..value.len() - 1], 40),
+        _ => (value, 0),
+    };
+    match digits.parse::<u64>() {
+        Ok(0) | Err(_) => bail!("invalid memory limit: {value}"),
+        Ok(n) => n
+            .checked_mul(1 << shift)
+            .ok_or_else(|| anyhow::anyhow!("memory limit too large: {value}")),
+    }
+}
+
+/// Parses a CPU limit in number of CPUs, e.g. "2" or "0.5". This is meant to
+/// be used as a clap value parser.
+pub fn parse_cpu_limit(value: &str) -> Result<f64> {
+    match value.parse::<f64>() {
+        // The kernel rejects CPU bandwidth quotas below 1ms per 100ms period.
+        Ok(cpus) if cpus.is_finite() && cpus >= 0.01 => Ok(cpus),
+        _ => bail!("invalid CPU limit: {value}"),
+    }
+}
+
 /// Implements serialization/deserialization of `BTreeMap<OsString, T>`.
 ///
 /// By default, serde doesn't support maps with non-String keys. This module
@@ -89,3 +343,134 @@ mod serde_os_string_map {
         Ok(map)
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_time_phase() {
+        let mut phases = Vec::new();
+        assert_eq!(time_phase(&mut phases, "ok", || Ok(42)).unwrap(), 42);
+        assert!(time_phase(&mut phases, "fail", || -> Result<()> { bail!("error") }).is_err());
+        assert_eq!(
+            phases.iter().map(|p| p.name.as_str()).collect::<Vec<_>>(),
+            ["ok", "fail"]
+        );
+    }
+
+    #[test]
+    fn test_parse_network_mode() {
+        assert_eq!("none".parse::<NetworkMode>().unwrap(), NetworkMode::None);
+        assert_eq!("host".parse::<NetworkMode>().unwrap(), NetworkMode::Host);
+        assert_eq!("slirp".parse::<NetworkMode>().unwrap(), NetworkMode::Slirp);
+        assert!("veth".parse::<NetworkMode>().is_err());
+    }
+
+    #[test]
+    fn test_parse_tmpfs_size() {
+        for value in ["1048576", "64k", "64m", "1g", "1G", "50%"] {
+            assert_eq!(parse_tmpfs_size(value).unwrap(), value);
+        }
+        for value in ["", "0", "0m", "m", "-1m", "1mm", "1t", "1.5g", "50%%"] {
+            assert!(
+                parse_tmpfs_size(value).is_err(),
+                "{value:?} should be invalid"
+            );
+        }
+    }
+
+    #[test]
+    fn test_parse_memory_limit() {
+        for (value, bytes) in [
+            ("1048576", 1 << 20),
+            ("64k", 64 << 10),
+            ("512m", 512 << 20),
+            ("4G", 4 << 30),
+            ("1t", 1 << 40),
+        ] {
+            assert_eq!(parse_memory_limit(value).unwrap(), bytes);
+        }
+        for value in [
+            "",
+            "0",
+            "0m",
+            "m",
+            "-1m",
+            "1mm",
+            "1.5g",
+            "50%",
+            "99999999999t",
+        ] {
+            assert!(
+                parse_memory_limit(value).is_err(),
+                "{value:?} should be invalid"
+            );
+        }
+    }
+
+    #[test]
+    fn test_parse_cpu_limit() {
+        assert_eq!(parse_cpu_limit("2").unwrap(), 2.0);
+        assert_eq!(parse_cpu_limit("0.5").unwrap(), 0.5);
+        for value in ["", "0", "0.001", "-1", "inf", "NaN", "two"] {
+            assert!(
+                parse_cpu_limit(value).is_err(),
+                "{value:?} should be invalid"
+            );
+        }
+    }
+
+    #[test]
+    fn test_resource_limits_to_args() {
+        assert!(ResourceLimits::default().is_empty());
+        assert!(ResourceLimits::default().to_args().is_empty());
+        let limits = ResourceLimits {
+            memory: Some(1 << 30),
+            cpus: Some(1.5),
+            pids: Some(1000),
+        };
+        assert!(!limits.is_empty());
+        assert_eq!(
+            limits.to_args(),
+            [
+                "--memory-limit=1073741824",
+                "--cpu-limit=1.5",
+                "--pids-limit=1000"
+            ]
+        );
+    }
+
+    #[test]
+    fn test_parse_hostname() {
+        for value in [DEFAULT_HOSTNAME, "localhost", "build-1.example"] {
+            assert_eq!(parse_hostname(value).unwrap(), value);
+        }
+        for value in ["", "a b", "host_name", "host/name", &"a".repeat(65)] {
+            assert!(
+                parse_hostname(value).is_err(),
+                "{value:?} should be invalid"
+            );
+        }
+    }
+
+    #[test]
+    fn test_parse_machine_id() {
+        assert_eq!(
+            parse_machine_id(DEFAULT_MACHINE_ID).unwrap(),
+            DEFAULT_MACHINE_ID
+        );
+        for value in [
+            "",
+            "c7b5a6d1e4f24b5f9d3c2a1b0e8f7d6",
+            "C7B5A6D1E4F24B5F9D3C2A1B0E8F7D6C",
+            "g7b5a6d1e4f24b5f9d3c2a1b0e8f7d6c",
+            "00000000000000000000000000000000",
+        ] {
+            assert!(
+                parse_machine_id(value).is_err(),
+                "{value:?} should be invalid"
+            );
+        }
+    }
+}
@@ -3,7 +3,7 @@
 // found in the LICENSE file.
 
 use std::{
-    path::{Path, PathBuf},
+    path::{Component, Path, PathBuf},
     process::Command,
 };
 
@@ -13,10 +13,49 @@ use anyhow::{bail, ensure, Context, Result};
 /// golden data.
 const REGENERATE_VAR_NAME: &str = "ALCHEMY_REGENERATE_GOLDEN";
 
+/// The name of the environment variable specifying paths in golden
+/// directories to regenerate, relative to the workspace root and separated by
+/// commas.
+const REGENERATE_PATHS_VAR_NAME: &str = "ALCHEMY_REGENERATE_GOLDEN_PATHS";
+
 fn should_regenerate() -> bool {
     std::env::var(REGENERATE_VAR_NAME).unwrap_or_default() != ""
 }
 
+/// Parses the value of [`REGENERATE_PATHS_VAR_NAME`].
+fn parse_regenerate_paths(value: &str) -> Result<Vec<PathBuf>> {
+    value
+        .split(',')
+        .filter(|path| !path.is_empty())
+        .map(|path| {
+            let path = PathBuf::from(path);
+            ensure!(
+                path.components().all(|c| matches!(c, Component::Normal(_))),
+                "{REGENERATE_PATHS_VAR_NAME} must contain relative paths without \"..\": {path:?}"
+            );
+            Ok(path)
+        })
+        .collect()
+}
+
+/// Selects paths under `golden` out of `paths`, and returns them relative to
+/// `golden`. An empty path stands for `golden` itself.
+fn select_regenerate_paths(paths: Vec<PathBuf>, golden: &Path) -> Vec<PathBuf> {
+    paths
+        .into_iter()
+        .filter_map(|path| Some(path.strip_prefix(golden).ok()?.to_owned()))
+        .collect()
+}
+
+/// Returns paths to regenerate in `golden`, relative to it. Paths in other
+/// golden data are ignored, so that running multiple golden tests at once
+/// regenerates only the specified paths.
+fn paths_to_regenerate(golden: &Path) -> Result<Vec<PathBuf>> {
+    let paths =
+        parse_regenerate_paths(&std::env::var(REGENERATE_PATHS_VAR_NAME).unwrap_or_default())?;
+    Ok(select_regenerate_paths(paths, golden))
+}
+
 // Renames output files as required to ensure that bazel doesn't interpret them as bazel packages.
 fn rename_bazel_special_files(dir: &Path) -> std::io::Result<()> {
     for entry in walkdir::WalkDir::new(dir) {
@@ -29,13 +68,37 @@ fn rename_bazel_special_files(dir: &Path) -> std::io::Result<()> {
     Ok(())
 }
 
-fn compute_real_golden_path(golden: &Path) -> Result<PathBuf> {
+/// Replaces `golden` with a copy of `output`. If `output` doesn't exist,
+/// `golden` is just removed.
+fn replace_golden(output: &Path, golden: &Path) -> Result<()> {
+    if golden.is_dir() {
+        std::fs::remove_dir_all(golden)?;
+    } else if golden.is_file() {
+        std::fs::remove_file(golden)?;
+    } else {
+        ensure!(!golden.try_exists()?, "Unknown file type");
+    }
+    if !output.try_exists()? {
+        return Ok(());
+    }
+    if let Some(parent) = golden.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+    let status = Command::new("cp")
+        .args(["--recursive", "--dereference", "--"])
+        .arg(output)
+        .arg(golden)
+        .status()?;
     ensure!(
-        golden.is_relative(),
-        "Golden path must be relative to the workspace root! \
-        See the description of compare_with_golden_data."
+        status.success(),
+        "Failed to update golden data: {:?}",
+        status
     );
-    Ok(if should_regenerate() {
+    Ok(())
+}
+
+fn compute_real_golden_path(golden: &Path, regenerate: bool) -> Result<PathBuf> {
+    Ok(if regenerate {
         // When regenerating under Bazel, writing to the runfiles root would just write to the
         // sandbox.
         crate::workspace_root()
@@ -74,32 +137,46 @@ fn compute_real_golden_path(golden: &Path) -> Result<PathBuf> {
 /// ```sh
 /// ALCHEMY_REGENERATE_GOLDEN=1 cargo test
 /// ```
+///
+/// Regenerating a large golden directory produces a large diff that is hard to
+/// review. To update only some files or subdirectories in a golden directory,
+/// set the environment variable `ALCHEMY_REGENERATE_GOLDEN_PATHS` to their
+/// paths relative to the workspace root, i.e. in the same form as `golden`,
+/// separated by commas. The rest of the golden directory is compared with the
+/// output as usual, and golden data not containing any of the paths is not
+/// touched.
+///
+/// ```sh
+/// ALCHEMY_REGENERATE_GOLDEN_PATHS=bazel/portage/bin/alchemist/src/bin/alchemist/testdata/golden/internal/packages/stage2/host/portage-stable/sys-libs/libxcrypt \
+///   bazel run :foo_test
+/// ```
 pub fn compare_with_golden_data(output: &Path, golden: &Path) -> Result<()> {
-    let real_golden = &compute_real_golden_path(golden)?;
+    ensure!(
+        golden.is_relative(),
+        "Golden path must be relative to the workspace root! \
+        See the description of compare_with_golden_data."
+    );
+    let paths = paths_to_regenerate(golden)?;
+    let regenerate_all = should_regenerate() || paths.iter().any(|p| p.as_os_str().is_empty());
+    let real_golden = &compute_real_golden_path(golden, regenerate_all || !paths.is_empty())?;
 
     if output.is_dir() {
         rename_bazel_special_files(output)?;
     }
 
-    if should_regenerate() {
-        if real_golden.is_dir() {
-            std::fs::remove_dir_all(real_golden)?;
-        } else if real_golden.is_file() {
-            std::fs::remove_file(real_golden)?;
-        } else {
-            ensure!(!real_golden.try_exists()?, "Unknown file type");
-        }
-        let status = Command::new("cp")
-            .args(["--recursive", "--dereference", "--"])
-            .arg(output)
-            .arg(real_golden)
-            .status()?;
-        ensure!(
-            status.success(),
-            "Failed to update golden data: {:?}",
-            status
-        );
+    if regenerate_all {
+        replace_golden(output, real_golden)?;
     } else {
+        if !paths.is_empty() {
+            ensure!(
+                output.is_dir(),
+                "{REGENERATE_PATHS_VAR_NAME} is supported only for golden directories"
+            );
+            for path in paths {
+                replace_golden(&output.join(&path), &real_golden.join(&path))?;
+            }
+        }
+
         let bazel_target = std::env::var("TEST_TARGET").ok();
         if let Some(ref bazel_target) = bazel_target {
             ensure!(
@@ -245,6 +322,40 @@ mod tests {
         Ok(())
     }
 
+    #[test]
+    fn test_parse_regenerate_paths() -> Result<()> {
+        assert_eq!(parse_regenerate_paths("")?, Vec::<PathBuf>::new());
+        assert_eq!(
+            parse_regenerate_paths("a.txt,d/c.txt,")?,
+            vec![PathBuf::from("a.txt"), PathBuf::from("d/c.txt")]
+        );
+        assert!(parse_regenerate_paths("/a.txt").is_err());
+        assert!(parse_regenerate_paths("d/../../a.txt").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn test_select_regenerate_paths() {
+        let paths = vec![
+            PathBuf::from("golden/foo/a.txt"),
+            PathBuf::from("golden/foo/d"),
+            PathBuf::from("golden/bar/a.txt"),
+            PathBuf::from("golden/foobar"),
+        ];
+        assert_eq!(
+            select_regenerate_paths(paths.clone(), Path::new("golden/foo")),
+            vec![PathBuf::from("a.txt"), PathBuf::from("d")]
+        );
+        assert_eq!(
+            select_regenerate_paths(paths.clone(), Path::new("golden/bar/a.txt")),
+            vec![PathBuf::from("")]
+        );
+        assert_eq!(
+            select_regenerate_paths(paths, Path::new("golden/baz")),
+            Vec::<PathBuf>::new()
+        );
+    }
+
     // TODO: Write a test that regenerates golden data. It is not trivial to
     // write one because of Bazel sandbox.
 }